@@ -0,0 +1,227 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package attrschema provides validation of the extra-info attributes
+// of identities against a configured schema.
+package attrschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+// Config holds the configuration of an attribute schema.
+type Config struct {
+	// Version holds the version of the schema. It must be positive
+	// and should be increased whenever the schema is changed. The
+	// version is reported in validation errors so that the writer
+	// of a rejected attribute can tell which schema rejected it.
+	Version int `yaml:"version"`
+
+	// Attributes holds the schema of each attribute, keyed by
+	// attribute name. Attributes that are not listed are not
+	// validated.
+	Attributes map[string]Attribute `yaml:"attributes"`
+}
+
+// Attribute holds the schema of a single attribute.
+type Attribute struct {
+	// Type holds the JSON type that values of the attribute must
+	// have. It is one of "string", "number", "integer", "boolean",
+	// "list" or "object". If it is empty values of any type are
+	// allowed.
+	Type string `yaml:"type"`
+
+	// Required is set if every identity with attributes must have a
+	// value for this attribute.
+	Required bool `yaml:"required"`
+
+	// Values holds the values that are allowed for a string
+	// attribute, or for each element of a list attribute. If it is
+	// empty any value is allowed.
+	Values []string `yaml:"values"`
+
+	// Pattern holds a regular expression that a string attribute, or
+	// each element of a list attribute, must match in full.
+	Pattern string `yaml:"pattern"`
+}
+
+// A Schema validates identity attributes.
+type Schema struct {
+	version    int
+	attributes map[string]attribute
+	required   []string
+}
+
+// attribute holds a parsed Attribute.
+type attribute struct {
+	typ     string
+	values  map[string]bool
+	expr    string
+	pattern *regexp.Regexp
+}
+
+var types = map[string]bool{
+	"":        true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"list":    true,
+	"object":  true,
+}
+
+// New returns a schema with the given configuration.
+func New(c Config) (*Schema, error) {
+	if c.Version <= 0 {
+		return nil, errgo.Newf("invalid identity attribute schema version %d", c.Version)
+	}
+	s := &Schema{
+		version:    c.Version,
+		attributes: make(map[string]attribute, len(c.Attributes)),
+	}
+	for name, a := range c.Attributes {
+		if !types[a.Type] {
+			return nil, errgo.Newf("attribute %q: invalid type %q", name, a.Type)
+		}
+		attr := attribute{
+			typ: a.Type,
+		}
+		if len(a.Values) > 0 || a.Pattern != "" {
+			if a.Type != "string" && a.Type != "list" {
+				return nil, errgo.Newf("attribute %q: values and pattern can only be used with string and list attributes", name)
+			}
+		}
+		if len(a.Values) > 0 {
+			attr.values = make(map[string]bool, len(a.Values))
+			for _, v := range a.Values {
+				attr.values[v] = true
+			}
+		}
+		if a.Pattern != "" {
+			var err error
+			attr.expr = a.Pattern
+			attr.pattern, err = regexp.Compile("^(?:" + a.Pattern + ")$")
+			if err != nil {
+				return nil, errgo.Notef(err, "attribute %q: invalid pattern", name)
+			}
+		}
+		s.attributes[name] = attr
+		if a.Required {
+			s.required = append(s.required, name)
+		}
+	}
+	sort.Strings(s.required)
+	return s, nil
+}
+
+// Version returns the version of the schema.
+func (s *Schema) Version() int {
+	return s.version
+}
+
+// CheckAttribute checks that the given stored values of the named
+// attribute conform to the schema. Each value is expected to hold JSON,
+// as written by the extra-info API; a value that is not valid JSON is
+// treated as a string. If a value does not conform an error with a
+// cause of params.ErrBadRequest that names the attribute is returned.
+func (s *Schema) CheckAttribute(name string, values []string) error {
+	attr, ok := s.attributes[name]
+	if !ok {
+		return nil
+	}
+	for _, v := range values {
+		var x interface{}
+		if err := json.Unmarshal([]byte(v), &x); err != nil {
+			x = v
+		}
+		if err := attr.check(x); err != nil {
+			return s.errorf(name, "%s", err)
+		}
+	}
+	return nil
+}
+
+// CheckRequired checks that the given attributes include a value for
+// every required attribute. If one is missing an error with a cause of
+// params.ErrBadRequest that names the attribute is returned.
+func (s *Schema) CheckRequired(attrs map[string][]string) error {
+	for _, name := range s.required {
+		if len(attrs[name]) == 0 {
+			return s.errorf(name, "attribute is required")
+		}
+	}
+	return nil
+}
+
+// errorf returns a validation error for the named attribute.
+func (s *Schema) errorf(name string, f string, a ...interface{}) error {
+	return errgo.WithCausef(nil, params.ErrBadRequest, "invalid attribute %q (schema version %d): %s", name, s.version, fmt.Sprintf(f, a...))
+}
+
+// check checks that the given decoded value conforms to the attribute.
+func (a attribute) check(x interface{}) error {
+	switch a.typ {
+	case "":
+		return nil
+	case "string":
+		s, ok := x.(string)
+		if !ok {
+			return errgo.Newf("value must be a string")
+		}
+		return a.checkString(s)
+	case "number":
+		if _, ok := x.(float64); !ok {
+			return errgo.Newf("value must be a number")
+		}
+	case "integer":
+		if f, ok := x.(float64); !ok || f != math.Trunc(f) {
+			return errgo.Newf("value must be an integer")
+		}
+	case "boolean":
+		if _, ok := x.(bool); !ok {
+			return errgo.Newf("value must be a boolean")
+		}
+	case "list":
+		l, ok := x.([]interface{})
+		if !ok {
+			return errgo.Newf("value must be a list")
+		}
+		if a.values == nil && a.pattern == nil {
+			return nil
+		}
+		for _, e := range l {
+			s, ok := e.(string)
+			if !ok {
+				return errgo.Newf("list elements must be strings")
+			}
+			if err := a.checkString(s); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	case "object":
+		if _, ok := x.(map[string]interface{}); !ok {
+			return errgo.Newf("value must be an object")
+		}
+	}
+	return nil
+}
+
+// checkString checks that the given string is one of the allowed
+// values and matches the pattern.
+func (a attribute) checkString(s string) error {
+	if a.values != nil && !a.values[s] {
+		return errgo.Newf("value %q is not allowed", s)
+	}
+	if a.pattern != nil && !a.pattern.MatchString(s) {
+		return errgo.Newf("value %q does not match pattern %q", s, a.expr)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package attrschema_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/attrschema"
+	"github.com/canonical/candid/params"
+)
+
+var newTests = []struct {
+	about       string
+	config      attrschema.Config
+	expectError string
+}{{
+	about: "valid",
+	config: attrschema.Config{
+		Version: 1,
+		Attributes: map[string]attrschema.Attribute{
+			"department": {Type: "string", Values: []string{"eng"}},
+			"teams":      {Type: "list", Pattern: "[a-z]+"},
+			"anything":   {},
+		},
+	},
+}, {
+	about:       "no version",
+	config:      attrschema.Config{},
+	expectError: `invalid identity attribute schema version 0`,
+}, {
+	about: "invalid type",
+	config: attrschema.Config{
+		Version: 1,
+		Attributes: map[string]attrschema.Attribute{
+			"department": {Type: "text"},
+		},
+	},
+	expectError: `attribute "department": invalid type "text"`,
+}, {
+	about: "values with number",
+	config: attrschema.Config{
+		Version: 1,
+		Attributes: map[string]attrschema.Attribute{
+			"level": {Type: "number", Values: []string{"1"}},
+		},
+	},
+	expectError: `attribute "level": values and pattern can only be used with string and list attributes`,
+}, {
+	about: "invalid pattern",
+	config: attrschema.Config{
+		Version: 1,
+		Attributes: map[string]attrschema.Attribute{
+			"department": {Type: "string", Pattern: "("},
+		},
+	},
+	expectError: `attribute "department": invalid pattern: .*`,
+}}
+
+func TestNew(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range newTests {
+		c.Run(test.about, func(c *qt.C) {
+			s, err := attrschema.New(test.config)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(s.Version(), qt.Equals, test.config.Version)
+		})
+	}
+}
+
+var checkAttributeTests = []struct {
+	about       string
+	name        string
+	values      []string
+	expectError string
+}{{
+	about:  "conforming string",
+	name:   "department",
+	values: []string{`"engineering"`},
+}, {
+	about:       "string not allowed",
+	name:        "department",
+	values:      []string{`"marketing"`},
+	expectError: `invalid attribute "department" \(schema version 2\): value "marketing" is not allowed`,
+}, {
+	about:       "string with wrong type",
+	name:        "department",
+	values:      []string{`12`},
+	expectError: `invalid attribute "department" \(schema version 2\): value must be a string`,
+}, {
+	about:  "string not stored as JSON",
+	name:   "department",
+	values: []string{`sales`},
+}, {
+	about:  "conforming integer",
+	name:   "employee-number",
+	values: []string{`1234`},
+}, {
+	about:       "non-integer number",
+	name:        "employee-number",
+	values:      []string{`12.5`},
+	expectError: `invalid attribute "employee-number" \(schema version 2\): value must be an integer`,
+}, {
+	about:  "conforming number",
+	name:   "score",
+	values: []string{`12.5`},
+}, {
+	about:       "number with wrong type",
+	name:        "score",
+	values:      []string{`true`},
+	expectError: `invalid attribute "score" \(schema version 2\): value must be a number`,
+}, {
+	about:  "conforming boolean",
+	name:   "contractor",
+	values: []string{`false`},
+}, {
+	about:       "boolean with wrong type",
+	name:        "contractor",
+	values:      []string{`"no"`},
+	expectError: `invalid attribute "contractor" \(schema version 2\): value must be a boolean`,
+}, {
+	about:  "conforming list",
+	name:   "teams",
+	values: []string{`["core", "web"]`},
+}, {
+	about:       "list element does not match pattern",
+	name:        "teams",
+	values:      []string{`["core", "Web"]`},
+	expectError: `invalid attribute "teams" \(schema version 2\): value "Web" does not match pattern "\[a-z\]\+"`,
+}, {
+	about:       "list element with wrong type",
+	name:        "teams",
+	values:      []string{`["core", 1]`},
+	expectError: `invalid attribute "teams" \(schema version 2\): list elements must be strings`,
+}, {
+	about:       "list with wrong type",
+	name:        "teams",
+	values:      []string{`"core"`},
+	expectError: `invalid attribute "teams" \(schema version 2\): value must be a list`,
+}, {
+	about:  "conforming object",
+	name:   "address",
+	values: []string{`{"city": "London"}`},
+}, {
+	about:       "object with wrong type",
+	name:        "address",
+	values:      []string{`["London"]`},
+	expectError: `invalid attribute "address" \(schema version 2\): value must be an object`,
+}, {
+	about:  "unconstrained attribute",
+	name:   "anything",
+	values: []string{`[1, "two"]`},
+}, {
+	about:  "attribute not in schema",
+	name:   "unknown",
+	values: []string{`{}`},
+}}
+
+func TestCheckAttribute(t *testing.T) {
+	c := qt.New(t)
+	s, err := attrschema.New(attrschema.Config{
+		Version: 2,
+		Attributes: map[string]attrschema.Attribute{
+			"department":      {Type: "string", Values: []string{"engineering", "sales"}},
+			"employee-number": {Type: "integer"},
+			"score":           {Type: "number"},
+			"contractor":      {Type: "boolean"},
+			"teams":           {Type: "list", Pattern: "[a-z]+"},
+			"address":         {Type: "object"},
+			"anything":        {},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	for _, test := range checkAttributeTests {
+		c.Run(test.about, func(c *qt.C) {
+			err := s.CheckAttribute(test.name, test.values)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+		})
+	}
+}
+
+func TestCheckRequired(t *testing.T) {
+	c := qt.New(t)
+	s, err := attrschema.New(attrschema.Config{
+		Version: 1,
+		Attributes: map[string]attrschema.Attribute{
+			"department": {Required: true},
+			"location":   {Required: true},
+			"nickname":   {},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.CheckRequired(map[string][]string{
+		"department": {`"sales"`},
+		"location":   {`"London"`},
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.CheckRequired(map[string][]string{
+		"department": {`"sales"`},
+		"nickname":   {`"bob"`},
+	})
+	c.Assert(err, qt.ErrorMatches, `invalid attribute "location" \(schema version 1\): attribute is required`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package audit provides a record of authentication events, such as
+// logins and changes to which identity providers are enabled, for later
+// review.
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// Outcomes of an authentication attempt.
+const (
+	// Success is the outcome of an attempt that authenticated a
+	// user.
+	Success = "success"
+
+	// Failure is the outcome of an attempt that did not
+	// authenticate a user.
+	Failure = "failure"
+)
+
+// Actions recorded by events that are not authentication attempts.
+const (
+	// IDPEnabled is the action of an administrator enabling an
+	// identity provider.
+	IDPEnabled = "idp-enabled"
+
+	// IDPDisabled is the action of an administrator disabling an
+	// identity provider.
+	IDPDisabled = "idp-disabled"
+)
+
+// An Event records a single authentication attempt, or an
+// administrative action that changes how users may authenticate.
+type Event struct {
+	// Time holds the time the attempt completed.
+	Time time.Time `json:"time"`
+
+	// Action holds the administrative action recorded by the event.
+	// It is empty for authentication attempts.
+	Action string `json:"action,omitempty"`
+
+	// Outcome holds the outcome of the attempt, either Success or
+	// Failure.
+	Outcome string `json:"outcome"`
+
+	// Username holds the username of the authenticated user. For
+	// failed attempts it holds the username that was submitted, if
+	// any, which has not been verified. For administrative actions
+	// it holds the username of the administrator.
+	Username string `json:"username,omitempty"`
+
+	// IDP holds the name of the identity provider used in the
+	// attempt, if known, or the identity provider changed by an
+	// administrative action.
+	IDP string `json:"idp,omitempty"`
+
+	// ClientIP holds the address of the client that made the
+	// attempt.
+	ClientIP string `json:"client-ip,omitempty"`
+
+	// WaitID holds the ID of the discharge wait that the attempt
+	// completes, if any.
+	WaitID string `json:"wait-id,omitempty"`
+
+	// Expires holds the time that the identity macaroon issued by
+	// a successful attempt expires.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// Error holds the reason a failed attempt failed.
+	Error string `json:"error,omitempty"`
+}
+
+// A Logger records authentication events.
+type Logger interface {
+	// Log records the given event.
+	Log(ctx context.Context, e *Event) error
+}
+
+// A JSONLogger is a Logger that writes each event as a single line of
+// JSON. The lines form a hash chain: each holds, in its "prev-hash"
+// field, the hex-encoded SHA-256 hash of the line before it, so that
+// changing or removing a line can be detected with Verify.
+type JSONLogger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	prev string
+}
+
+// NewJSONLogger returns a JSONLogger that writes events to the given
+// writer. Each event is written with a single call to Write. The first
+// event written is chained to a previous line with the given hash,
+// which should be the hash returned by Verify for any events already
+// in the log, or empty if there are none.
+func NewJSONLogger(w io.Writer, prevHash string) *JSONLogger {
+	return &JSONLogger{
+		w:    w,
+		prev: prevHash,
+	}
+}
+
+// A record is the form in which an event is written by a JSONLogger.
+type record struct {
+	*Event
+	PrevHash string `json:"prev-hash"`
+}
+
+// Log implements Logger.Log.
+func (l *JSONLogger) Log(_ context.Context, e *Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, err := json.Marshal(record{
+		Event:    e,
+		PrevHash: l.prev,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		return errgo.Notef(err, "cannot write audit event")
+	}
+	l.prev = hash(b)
+	return nil
+}
+
+// ErrBrokenChain is the cause of the error returned by Verify when a
+// line of the log does not follow the line before it, which happens if
+// the log has been changed other than by a JSONLogger.
+var ErrBrokenChain = errgo.New("audit log hash chain broken")
+
+// maxRecordSize holds the maximum length of a line read by Verify.
+const maxRecordSize = 1024 * 1024
+
+// Verify reads a log written by a JSONLogger from the given reader and
+// checks that each line holds the hash of the line before it. It
+// returns the hash of the last line, suitable for passing to
+// NewJSONLogger to continue the log. If the chain is broken, the hash
+// of the last line is returned along with an error that identifies
+// the first line that does not follow the line before it and has a
+// cause of ErrBrokenChain.
+func Verify(r io.Reader) (string, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxRecordSize)
+	var prev string
+	var verr error
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Bytes()
+		if verr == nil {
+			var rec struct {
+				PrevHash string `json:"prev-hash"`
+			}
+			if err := json.Unmarshal(line, &rec); err != nil {
+				verr = errgo.WithCausef(nil, ErrBrokenChain, "invalid audit record on line %d: %s", n, err)
+			} else if rec.PrevHash != prev {
+				verr = errgo.WithCausef(nil, ErrBrokenChain, "audit record on line %d does not follow the previous record", n)
+			}
+		}
+		prev = hash(line)
+	}
+	if err := sc.Err(); err != nil {
+		return "", errgo.Notef(err, "cannot read audit log")
+	}
+	return prev, verr
+}
+
+// hash returns the hex-encoded SHA-256 hash of the given line.
+func hash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
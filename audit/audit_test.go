@@ -0,0 +1,131 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package audit_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/audit"
+)
+
+func TestJSONLogger(t *testing.T) {
+	c := qt.New(t)
+	var buf bytes.Buffer
+	l := audit.NewJSONLogger(&buf, "")
+	ctx := context.Background()
+	t0 := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	expires := t0.Add(24 * time.Hour)
+	err := l.Log(ctx, &audit.Event{
+		Time:     t0,
+		Outcome:  audit.Success,
+		Username: "bob",
+		IDP:      "test",
+		ClientIP: "192.0.2.1",
+		WaitID:   "1234",
+		Expires:  &expires,
+	})
+	c.Assert(err, qt.IsNil)
+	err = l.Log(ctx, &audit.Event{
+		Time:     t0.Add(time.Minute),
+		Outcome:  audit.Failure,
+		Username: "alice",
+		IDP:      "test",
+		ClientIP: "192.0.2.2",
+		Error:    "invalid username or password",
+	})
+	c.Assert(err, qt.IsNil)
+	line1 := `{"time":"2020-06-01T12:00:00Z","outcome":"success","username":"bob","idp":"test","client-ip":"192.0.2.1","wait-id":"1234","expires":"2020-06-02T12:00:00Z","prev-hash":""}`
+	line2 := `{"time":"2020-06-01T12:01:00Z","outcome":"failure","username":"alice","idp":"test","client-ip":"192.0.2.2","error":"invalid username or password","prev-hash":"` + hash(line1) + `"}`
+	c.Assert(buf.String(), qt.Equals, line1+"\n"+line2+"\n")
+
+	last, err := audit.Verify(strings.NewReader(buf.String()))
+	c.Assert(err, qt.IsNil)
+	c.Assert(last, qt.Equals, hash(line2))
+}
+
+func TestJSONLoggerContinuesChain(t *testing.T) {
+	c := qt.New(t)
+	var buf bytes.Buffer
+	ctx := context.Background()
+	err := audit.NewJSONLogger(&buf, "").Log(ctx, &audit.Event{
+		Outcome: audit.Success,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// A new logger continues the chain from the existing log.
+	last, err := audit.Verify(strings.NewReader(buf.String()))
+	c.Assert(err, qt.IsNil)
+	err = audit.NewJSONLogger(&buf, last).Log(ctx, &audit.Event{
+		Outcome: audit.Failure,
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = audit.Verify(strings.NewReader(buf.String()))
+	c.Assert(err, qt.IsNil)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	c := qt.New(t)
+	var buf bytes.Buffer
+	l := audit.NewJSONLogger(&buf, "")
+	for _, u := range []string{"alice", "bob", "charlie"} {
+		err := l.Log(context.Background(), &audit.Event{
+			Outcome:  audit.Failure,
+			Username: u,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	log := buf.String()
+	lines := strings.SplitAfter(log, "\n")
+	last, err := audit.Verify(strings.NewReader(log))
+	c.Assert(err, qt.IsNil)
+
+	// Changing a record breaks the chain at the following record.
+	tampered := strings.Replace(log, `"bob"`, `"eve"`, 1)
+	_, err = audit.Verify(strings.NewReader(tampered))
+	c.Assert(err, qt.ErrorMatches, `audit record on line 3 does not follow the previous record`)
+	c.Assert(errgo.Cause(err), qt.Equals, audit.ErrBrokenChain)
+
+	// So does removing a record.
+	_, err = audit.Verify(strings.NewReader(lines[0] + lines[2]))
+	c.Assert(err, qt.ErrorMatches, `audit record on line 2 does not follow the previous record`)
+
+	// The hash of the last line is returned even if the chain is
+	// broken.
+	l2, err := audit.Verify(strings.NewReader(lines[1] + lines[2]))
+	c.Assert(err, qt.ErrorMatches, `audit record on line 1 does not follow the previous record`)
+	c.Assert(l2, qt.Equals, last)
+
+	_, err = audit.Verify(strings.NewReader("not json\n"))
+	c.Assert(err, qt.ErrorMatches, `invalid audit record on line 1: .*`)
+}
+
+func TestJSONLoggerWriteError(t *testing.T) {
+	c := qt.New(t)
+	l := audit.NewJSONLogger(errorWriter{}, "")
+	err := l.Log(context.Background(), &audit.Event{
+		Outcome: audit.Success,
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot write audit event: disk full`)
+}
+
+func hash(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(sum[:])
+}
+
+type errorWriter struct{}
+
+func (errorWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
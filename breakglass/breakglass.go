@@ -0,0 +1,183 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package breakglass provides an emergency credential that grants admin
+// access when the usual means of authenticating administrators are
+// unavailable.
+package breakglass
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/utils/debugstatus"
+	"golang.org/x/crypto/bcrypt"
+	errgo "gopkg.in/errgo.v1"
+)
+
+// DefaultUsername holds the username used with the break-glass
+// credential when none has been configured.
+const DefaultUsername = "break-glass"
+
+// MinCost holds the minimum bcrypt cost of the hash of a break-glass
+// password.
+const MinCost = 12
+
+// MaxFailures holds the number of consecutive failed attempts to use
+// the credential after which it is locked out.
+const MaxFailures = 5
+
+// LockoutDuration holds the time for which the credential is locked out
+// after MaxFailures consecutive failed attempts.
+const LockoutDuration = 15 * time.Minute
+
+// Config holds the configuration of break-glass access.
+type Config struct {
+	// Enabled must be set for the break-glass credential to be
+	// accepted. If it is not set the other fields are ignored.
+	Enabled bool `yaml:"enabled"`
+
+	// Username holds the username that must be presented with the
+	// password. If it is empty DefaultUsername is used. It cannot be
+	// "admin" or contain an "@", so that it never names a local
+	// identity.
+	Username string `yaml:"username"`
+
+	// PasswordHash holds the bcrypt hash of the password. The hash
+	// must have a cost of at least MinCost.
+	PasswordHash string `yaml:"password-hash"`
+
+	// Expires, if set, holds the time after which the credential is
+	// no longer accepted.
+	Expires time.Time `yaml:"expires"`
+}
+
+// Validate checks that the configuration is valid.
+func (c Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Username == "admin" {
+		return errgo.Newf("username %q is reserved for the admin user", c.Username)
+	}
+	if strings.Contains(c.Username, "@") {
+		return errgo.Newf("username %q is reserved for local identities", c.Username)
+	}
+	if c.PasswordHash == "" {
+		return errgo.Newf("password-hash not specified")
+	}
+	cost, err := bcrypt.Cost([]byte(c.PasswordHash))
+	if err != nil {
+		return errgo.Newf("password-hash is not a valid bcrypt hash")
+	}
+	if cost < MinCost {
+		return errgo.Newf("password-hash has bcrypt cost %d, at least %d is required", cost, MinCost)
+	}
+	return nil
+}
+
+// A Credential holds an enabled break-glass credential. A nil
+// Credential matches nothing.
+type Credential struct {
+	username string
+	hash     []byte
+	expires  time.Time
+
+	// mu guards the fields below. It is held while the password is
+	// checked so that concurrent attempts cannot exceed MaxFailures.
+	mu          sync.Mutex
+	failures    int
+	lockedUntil time.Time
+}
+
+// New returns the credential with the given configuration. If the
+// configuration does not enable break-glass access a nil Credential is
+// returned.
+func New(c Config) (*Credential, error) {
+	if err := c.Validate(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if !c.Enabled {
+		return nil, nil
+	}
+	cred := &Credential{
+		username: c.Username,
+		hash:     []byte(c.PasswordHash),
+		expires:  c.Expires,
+	}
+	if cred.username == "" {
+		cred.username = DefaultUsername
+	}
+	return cred, nil
+}
+
+// Username returns the username of the credential.
+func (c *Credential) Username() string {
+	if c == nil {
+		return ""
+	}
+	return c.username
+}
+
+// Expires returns the time after which the credential is no longer
+// accepted. The zero time is returned if the credential does not
+// expire.
+func (c *Credential) Expires() time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	return c.expires
+}
+
+// Match reports whether the given username and password match the
+// credential. If they match but the credential has expired at the
+// given time an error is returned. After MaxFailures consecutive
+// failed attempts the credential is locked out for LockoutDuration,
+// during which every attempt returns an error without the password
+// being checked.
+func (c *Credential) Match(username, password string, now time.Time) (bool, error) {
+	if c == nil || username != c.username {
+		return false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Before(c.lockedUntil) {
+		return false, errgo.Newf("break-glass credential locked out until %s", c.lockedUntil.Format(time.RFC3339))
+	}
+	if bcrypt.CompareHashAndPassword(c.hash, []byte(password)) != nil {
+		c.failures++
+		if c.failures >= MaxFailures {
+			c.failures = 0
+			c.lockedUntil = now.Add(LockoutDuration)
+		}
+		return false, nil
+	}
+	c.failures = 0
+	if !c.expires.IsZero() && !now.Before(c.expires) {
+		return false, errgo.Newf("break-glass credential expired at %s", c.expires.Format(time.RFC3339))
+	}
+	return true, nil
+}
+
+// CheckerFunc returns a debugstatus.CheckerFunc that reports whether
+// break-glass access is enabled, so that it cannot be enabled without
+// being visible. The check always passes.
+func (c *Credential) CheckerFunc() debugstatus.CheckerFunc {
+	return func(context.Context) (key string, result debugstatus.CheckResult) {
+		result.Name = "Break-glass admin access"
+		result.Passed = true
+		switch {
+		case c == nil:
+			result.Value = "disabled"
+		case c.expires.IsZero():
+			result.Value = "ENABLED for user " + c.username
+		case time.Now().Before(c.expires):
+			result.Value = "ENABLED for user " + c.username + " until " + c.expires.Format(time.RFC3339)
+		default:
+			result.Value = "expired at " + c.expires.Format(time.RFC3339)
+		}
+		return "break_glass", result
+	}
+}
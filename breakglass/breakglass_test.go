@@ -0,0 +1,178 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package breakglass_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/canonical/candid/breakglass"
+)
+
+func hash(c *qt.C, password string, cost int) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	c.Assert(err, qt.IsNil)
+	return string(h)
+}
+
+func TestValidate(t *testing.T) {
+	c := qt.New(t)
+	good := hash(c, "emergency", breakglass.MinCost)
+	tests := []struct {
+		about       string
+		config      breakglass.Config
+		expectError string
+	}{{
+		about: "disabled",
+		config: breakglass.Config{
+			PasswordHash: "not a hash",
+		},
+	}, {
+		about: "enabled",
+		config: breakglass.Config{
+			Enabled:      true,
+			PasswordHash: good,
+		},
+	}, {
+		about: "no hash",
+		config: breakglass.Config{
+			Enabled: true,
+		},
+		expectError: `password-hash not specified`,
+	}, {
+		about: "invalid hash",
+		config: breakglass.Config{
+			Enabled:      true,
+			PasswordHash: "emergency",
+		},
+		expectError: `password-hash is not a valid bcrypt hash`,
+	}, {
+		about: "weak hash",
+		config: breakglass.Config{
+			Enabled:      true,
+			PasswordHash: hash(c, "emergency", bcrypt.MinCost),
+		},
+		expectError: `password-hash has bcrypt cost 4, at least 12 is required`,
+	}, {
+		about: "admin username",
+		config: breakglass.Config{
+			Enabled:      true,
+			Username:     "admin",
+			PasswordHash: good,
+		},
+		expectError: `username "admin" is reserved for the admin user`,
+	}, {
+		about: "local identity username",
+		config: breakglass.Config{
+			Enabled:      true,
+			Username:     "bob@candid",
+			PasswordHash: good,
+		},
+		expectError: `username "bob@candid" is reserved for local identities`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			err := test.config.Validate()
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+		})
+	}
+}
+
+func TestNewDisabled(t *testing.T) {
+	c := qt.New(t)
+	cred, err := breakglass.New(breakglass.Config{
+		PasswordHash: hash(c, "emergency", breakglass.MinCost),
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cred, qt.IsNil)
+	ok, err := cred.Match(breakglass.DefaultUsername, "emergency", time.Now())
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+	_, result := cred.CheckerFunc()(context.Background())
+	c.Assert(result.Value, qt.Equals, "disabled")
+}
+
+func TestMatch(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	cred, err := breakglass.New(breakglass.Config{
+		Enabled:      true,
+		PasswordHash: hash(c, "emergency", breakglass.MinCost),
+		Expires:      now.Add(time.Hour),
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(cred.Username(), qt.Equals, breakglass.DefaultUsername)
+
+	ok, err := cred.Match(breakglass.DefaultUsername, "emergency", now)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+
+	ok, err = cred.Match(breakglass.DefaultUsername, "guess", now)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+
+	ok, err = cred.Match("admin", "emergency", now)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+
+	ok, err = cred.Match(breakglass.DefaultUsername, "emergency", now.Add(time.Hour))
+	c.Assert(err, qt.ErrorMatches, `break-glass credential expired at 2020-06-01T13:00:00Z`)
+	c.Assert(ok, qt.IsFalse)
+}
+
+func TestMatchLockout(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	cred, err := breakglass.New(breakglass.Config{
+		Enabled:      true,
+		PasswordHash: hash(c, "emergency", breakglass.MinCost),
+	})
+	c.Assert(err, qt.IsNil)
+
+	// A successful attempt resets the count of failures.
+	for i := 0; i < breakglass.MaxFailures-1; i++ {
+		ok, err := cred.Match(breakglass.DefaultUsername, "guess", now)
+		c.Assert(err, qt.IsNil)
+		c.Assert(ok, qt.IsFalse)
+	}
+	ok, err := cred.Match(breakglass.DefaultUsername, "emergency", now)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+
+	for i := 0; i < breakglass.MaxFailures; i++ {
+		ok, err := cred.Match(breakglass.DefaultUsername, "guess", now)
+		c.Assert(err, qt.IsNil)
+		c.Assert(ok, qt.IsFalse)
+	}
+	// The correct password is rejected while locked out.
+	ok, err = cred.Match(breakglass.DefaultUsername, "emergency", now.Add(breakglass.LockoutDuration-time.Second))
+	c.Assert(err, qt.ErrorMatches, `break-glass credential locked out until 2020-06-01T12:15:00Z`)
+	c.Assert(ok, qt.IsFalse)
+
+	ok, err = cred.Match(breakglass.DefaultUsername, "emergency", now.Add(breakglass.LockoutDuration))
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+}
+
+func TestCheckerFunc(t *testing.T) {
+	c := qt.New(t)
+	cred, err := breakglass.New(breakglass.Config{
+		Enabled:      true,
+		Username:     "emergency-admin",
+		PasswordHash: hash(c, "emergency", breakglass.MinCost),
+	})
+	c.Assert(err, qt.IsNil)
+	key, result := cred.CheckerFunc()(context.Background())
+	c.Assert(key, qt.Equals, "break_glass")
+	c.Assert(result.Passed, qt.IsTrue)
+	c.Assert(result.Value, qt.Equals, "ENABLED for user emergency-admin")
+}
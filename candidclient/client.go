@@ -7,6 +7,7 @@ import (
 	"context"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"gopkg.in/errgo.v1"
@@ -15,12 +16,18 @@ import (
 	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
+	"gopkg.in/macaroon.v2"
 
 	"github.com/canonical/candid/params"
 )
 
 // Note: tests for this code are in the server implementation.
 
+// ErrReauthenticationRequired is the error cause returned by
+// RenewMacaroon when a macaroon can no longer be renewed and the user
+// must authenticate again.
+var ErrReauthenticationRequired = errgo.New("re-authentication required")
+
 const (
 	// Production holds the URL of the production jujucharms candid
 	// server.
@@ -96,6 +103,43 @@ func New(p NewParams) (*Client, error) {
 	return &c, nil
 }
 
+// RenewMacaroon requests a renewed version of the given identity
+// macaroon, which must still be valid. If the server does not support
+// renewal then the given macaroon is returned unchanged. If the
+// macaroon cannot be renewed, for example because it has expired or
+// has reached its maximum lifetime, an error with a cause of
+// ErrReauthenticationRequired is returned.
+func (c *Client) RenewMacaroon(ctx context.Context, ms macaroon.Slice) (macaroon.Slice, error) {
+	m, err := c.RenewToken(ctx, &params.RenewTokenRequest{
+		Macaroons: ms,
+	})
+	switch errgo.Cause(err) {
+	case nil:
+		return macaroon.Slice{m.M()}, nil
+	case params.ErrNotFound:
+		return ms, nil
+	case params.ErrForbidden:
+		return nil, errgo.WithCausef(err, ErrReauthenticationRequired, "")
+	}
+	return nil, errgo.Mask(err)
+}
+
+// IntrospectMacaroon asks the identity server for information about
+// the given identity macaroon, such as one presented to a resource
+// server by a client. If the macaroon is not valid the returned result
+// has Active set to false; an error is only returned if the server
+// could not be asked. The request is authenticated using the agent
+// identity configured for the client, if any.
+func (c *Client) IntrospectMacaroon(ctx context.Context, ms macaroon.Slice) (*params.IntrospectTokenResponse, error) {
+	resp, err := c.IntrospectToken(ctx, &params.IntrospectTokenRequest{
+		Macaroons: ms,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return resp, nil
+}
+
 // IdentityFromContext implements identchecker.IdentityClient.IdentityFromContext
 // by returning caveats created by IdentityCaveats.
 func (c *Client) IdentityFromContext(ctx context.Context) (identchecker.Identity, []checkers.Caveat, error) {
@@ -196,6 +240,31 @@ func IdentityCaveats(url string) []checkers.Caveat {
 	}
 }
 
+// IdentityCaveatsWithGroups is like IdentityCaveats except that the
+// discharge macaroon will also declare the groups the user is a
+// member of. Only groups matching one of the given patterns are
+// declared. A pattern ending in "*" matches all groups with the
+// preceding prefix, any other pattern matches a single group. If no
+// patterns are given then all the user's groups are declared. The
+// groups can be determined by calling DeclaredGroups on the
+// declarations made by the discharge macaroon.
+func IdentityCaveatsWithGroups(url string, patterns ...string) []checkers.Caveat {
+	cond := "is-authenticated-user groups"
+	if len(patterns) > 0 {
+		cond += "=" + strings.Join(patterns, ",")
+	}
+	return []checkers.Caveat{
+		checkers.NeedDeclaredCaveat(
+			checkers.Caveat{
+				Location:  url,
+				Condition: cond,
+			},
+			"username",
+			"groups",
+		),
+	}
+}
+
 // UserDeclaration returns a first party caveat that can be used
 // by an identity manager to declare an identity on a discharge
 // macaroon.
@@ -226,4 +295,96 @@ func UserIDDeclaration(id string) checkers.Caveat {
 	return checkers.DeclaredCaveat("userid", id)
 }
 
+// RolesDeclaration returns a first party caveat that can be used by an
+// identity manager to declare the tenant-scoped roles of an identity
+// on a discharge macaroon. Each role should be of the form
+// "tenant:role".
+func RolesDeclaration(roles []string) checkers.Caveat {
+	return checkers.DeclaredCaveat("roles", strings.Join(roles, ","))
+}
+
+// GroupsDeclaration returns a first party caveat that can be used by
+// an identity manager to declare the groups a user is a member of on a
+// discharge macaroon.
+func GroupsDeclaration(groups []string) checkers.Caveat {
+	return checkers.DeclaredCaveat("groups", strings.Join(groups, ","))
+}
+
+// DeclaredGroups returns the groups from the given declarations. If no
+// groups were declared then nil is returned.
+func DeclaredGroups(declared map[string]string) []string {
+	if declared["groups"] == "" {
+		return nil
+	}
+	return strings.Split(declared["groups"], ",")
+}
+
+// AuthTimeDeclaration returns a first party caveat that can be used by
+// an identity manager to declare the time at which a user
+// authenticated on a discharge macaroon.
+func AuthTimeDeclaration(t time.Time) checkers.Caveat {
+	return checkers.DeclaredCaveat("auth-time", t.UTC().Format(time.RFC3339))
+}
+
+// DeclaredAuthTime returns the time at which the user authenticated
+// from the given declarations. A relying party can use this to require
+// that the user logged in recently, for example before a sensitive
+// operation. If no valid authentication time was declared then false is
+// returned.
+func DeclaredAuthTime(declared map[string]string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, declared["auth-time"])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// LoginIDPDeclaration returns a first party caveat that can be used by
+// an identity manager to declare the name of the identity provider a
+// user authenticated with on a discharge macaroon.
+func LoginIDPDeclaration(idp string) checkers.Caveat {
+	return checkers.DeclaredCaveat("login-idp", idp)
+}
+
+// DeclaredLoginIDP returns the name of the identity provider the user
+// authenticated with from the given declarations. If no identity
+// provider was declared then an empty string is returned.
+func DeclaredLoginIDP(declared map[string]string) string {
+	return declared["login-idp"]
+}
+
+// SessionDeclaration returns a first party caveat that can be used by
+// an identity manager to declare the session correlation ID of an
+// anonymous session on a macaroon. The declaration is carried forward
+// when the anonymous session is upgraded by logging in.
+func SessionDeclaration(id string) checkers.Caveat {
+	return checkers.DeclaredCaveat("session-id", id)
+}
+
+// DeclaredSessionID returns the session correlation ID from the given
+// declarations. A relying party can use this to associate a login with
+// the anonymous session that preceded it. If no session was declared
+// then an empty string is returned.
+func DeclaredSessionID(declared map[string]string) string {
+	return declared["session-id"]
+}
+
+// DeclaredRoles returns the tenant-scoped roles from the given
+// declarations, keyed by tenant. If no roles were declared then nil is
+// returned.
+func DeclaredRoles(declared map[string]string) map[string][]string {
+	if declared["roles"] == "" {
+		return nil
+	}
+	roles := make(map[string][]string)
+	for _, r := range strings.Split(declared["roles"], ",") {
+		i := strings.Index(r, ":")
+		if i < 0 {
+			continue
+		}
+		roles[r[:i]] = append(roles[r[:i]], r[i+1:])
+	}
+	return roles
+}
+
 //go:generate httprequest-generate-client ../internal/v1 handler client
@@ -14,6 +14,14 @@ type client struct {
 	Client httprequest.Client
 }
 
+// BackupCodes returns the number of unused backup codes the given user
+// has. The user's identity provider must support backup codes.
+func (c *client) BackupCodes(ctx context.Context, p *params.BackupCodesRequest) (*params.BackupCodesResponse, error) {
+	var r *params.BackupCodesResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
 // CreateAgent creates a new agent and returns the newly chosen username
 // for the agent.
 func (c *client) CreateAgent(ctx context.Context, p *params.CreateAgentRequest) (*params.CreateAgentResponse, error) {
@@ -22,6 +30,20 @@ func (c *client) CreateAgent(ctx context.Context, p *params.CreateAgentRequest)
 	return r, err
 }
 
+// CreateAPIToken creates a new API token that authenticates as the
+// given user. The token is returned only in this response.
+func (c *client) CreateAPIToken(ctx context.Context, p *params.CreateAPITokenRequest) (*params.APIToken, error) {
+	var r *params.APIToken
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// DeleteGroup removes the record of a group. Any identities that are
+// members of the group remain members.
+func (c *client) DeleteGroup(ctx context.Context, p *params.DeleteGroupRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
 // DeleteSSHKeys removes all of the ssh keys specified from the keys
 // stored for the given user. It is not an error to attempt to remove a
 // key that is not associated with the user.
@@ -37,6 +59,30 @@ func (c *client) DischargeTokenForUser(ctx context.Context, p *params.DischargeT
 	return r, err
 }
 
+// DisplayNameDuplicates returns the display names that are shared by
+// more than one identity, after normalizing them as requested.
+func (c *client) DisplayNameDuplicates(ctx context.Context, p *params.DisplayNameDuplicatesRequest) (*params.DisplayNameDuplicatesResponse, error) {
+	var r *params.DisplayNameDuplicatesResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// ExpirePassword requires the given user to choose a new password the
+// next time they log in. The user's identity provider must support
+// password expiry.
+func (c *client) ExpirePassword(ctx context.Context, p *params.ExpirePasswordRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
+// GenerateBackupCodes creates a new set of single-use backup codes for
+// the given user, replacing any they already have. The user's identity
+// provider must support backup codes.
+func (c *client) GenerateBackupCodes(ctx context.Context, p *params.GenerateBackupCodesRequest) (*params.GenerateBackupCodesResponse, error) {
+	var r *params.GenerateBackupCodesResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
 // GetSSHKeys returns any SSH keys stored for the given user.
 func (c *client) GetSSHKeys(ctx context.Context, p *params.SSHKeysRequest) (params.SSHKeysResponse, error) {
 	var r params.SSHKeysResponse
@@ -58,6 +104,46 @@ func (c *client) GetUserWithID(ctx context.Context, p *params.GetUserWithIDReque
 	return r, err
 }
 
+// Group returns the record of a group.
+func (c *client) Group(ctx context.Context, p *params.GroupRequest) (*params.Group, error) {
+	var r *params.Group
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// IDPConfig returns the configuration of the identity providers the
+// server is running with. The values of any secret parameters are
+// redacted.
+func (c *client) IDPConfig(ctx context.Context, p *params.IDPConfigRequest) (*params.IDPConfigResponse, error) {
+	var r *params.IDPConfigResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// IntrospectToken returns information about the given token. A token
+// that is not a valid macaroon generated by this service is reported
+// as inactive rather than as an error.
+func (c *client) IntrospectToken(ctx context.Context, p *params.IntrospectTokenRequest) (*params.IntrospectTokenResponse, error) {
+	var r *params.IntrospectTokenResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// ListGroups returns the records of all groups.
+func (c *client) ListGroups(ctx context.Context, p *params.ListGroupsRequest) (*params.ListGroupsResponse, error) {
+	var r *params.ListGroupsResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// ListIDPs returns the identity providers the server is running with
+// and whether each is enabled.
+func (c *client) ListIDPs(ctx context.Context, p *params.ListIDPsRequest) (*params.ListIDPsResponse, error) {
+	var r *params.ListIDPsResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
 // ModifyUserGroups updates the groups stored for the given user. Groups
 // can be either added or removed in a single query. It is an error to
 // try and both add and remove groups at the same time.
@@ -65,6 +151,13 @@ func (c *client) ModifyUserGroups(ctx context.Context, p *params.ModifyUserGroup
 	return c.Client.Call(ctx, p, nil)
 }
 
+// ProvisionUser creates a user that has not yet logged in, so that
+// groups may be assigned to them in advance. The user will be linked
+// to their identity provider account using the given external ID.
+func (c *client) ProvisionUser(ctx context.Context, p *params.ProvisionUserRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
 // PutSSHKeys updates the set of SSH keys stored for the given user. If
 // the add parameter is set to true then keys that are already stored
 // will be added to, otherwise they will be replaced.
@@ -80,6 +173,46 @@ func (c *client) QueryUsers(ctx context.Context, p *params.QueryUsersRequest) ([
 	return r, err
 }
 
+// RenewToken renews the given token, which must be a valid macaroon
+// generated by this service, by returning a new macaroon for the same
+// user with a fresh expiry time. Renewed macaroons never remain valid
+// beyond the configured maximum lifetime, after which the user must
+// re-authenticate.
+func (c *client) RenewToken(ctx context.Context, p *params.RenewTokenRequest) (*bakery.Macaroon, error) {
+	var r *bakery.Macaroon
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// ResetPassword creates a single-use token that can be used to set a
+// new password for the given user. The user's identity provider must
+// support password resets.
+func (c *client) ResetPassword(ctx context.Context, p *params.ResetPasswordRequest) (*params.ResetPasswordResponse, error) {
+	var r *params.ResetPasswordResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
+// RevokeAPIToken revokes one of the given user's API tokens. The token
+// can no longer be used to authenticate.
+func (c *client) RevokeAPIToken(ctx context.Context, p *params.RevokeAPITokenRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
+// SetGroup creates or replaces the record of a group. The membership
+// of the group is not changed.
+func (c *client) SetGroup(ctx context.Context, p *params.SetGroupRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
+// SetIDPEnabled enables, or disables, one of the identity providers. A
+// disabled identity provider is not offered as a login choice and
+// rejects new logins. Identities that have already logged in with it
+// are not affected.
+func (c *client) SetIDPEnabled(ctx context.Context, p *params.SetIDPEnabledRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
 // SetUserDeprecated creates or updates the user with the given username. If the
 // user already exists then any IDPGroups or SSHKeys specified in the
 // request will be ignored. See SetUserGroups, ModifyUserGroups,
@@ -109,6 +242,21 @@ func (c *client) SetUserGroups(ctx context.Context, p *params.SetUserGroupsReque
 	return c.Client.Call(ctx, p, nil)
 }
 
+// SetUserRoles replaces the tenant-scoped roles stored for the given
+// user. Each role must be of the form "tenant:role".
+func (c *client) SetUserRoles(ctx context.Context, p *params.SetUserRolesRequest) error {
+	return c.Client.Call(ctx, p, nil)
+}
+
+// SimulateLogin reports the username, groups and discharge caveats
+// that the given user would receive on logging in. No credentials are
+// checked and no macaroon is issued.
+func (c *client) SimulateLogin(ctx context.Context, p *params.SimulateLoginRequest) (*params.SimulateLoginResponse, error) {
+	var r *params.SimulateLoginResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
 // User returns the user information for the request user.
 func (c *client) User(ctx context.Context, p *params.UserRequest) (*params.User, error) {
 	var r *params.User
@@ -147,6 +295,13 @@ func (c *client) UserIDPGroups(ctx context.Context, p *params.UserIDPGroupsReque
 	return r, err
 }
 
+// UserRoles returns any tenant-scoped roles stored for the given user.
+func (c *client) UserRoles(ctx context.Context, p *params.UserRolesRequest) (params.RolesResponse, error) {
+	var r params.RolesResponse
+	err := c.Client.Call(ctx, p, &r)
+	return r, err
+}
+
 // UserToken returns a token, in the form of a macaroon, identifying
 // the user. This token can only be generated by an administrator.
 func (c *client) UserToken(ctx context.Context, p *params.UserTokenRequest) (*bakery.Macaroon, error) {
@@ -34,7 +34,27 @@ func (i InteractionInfo) RedirectURL(returnTo, state string) string {
 	v := make(url.Values, 2)
 	v.Set("return_to", returnTo)
 	v.Set("state", state)
+	return i.redirectURL(v)
+}
+
+// RedirectURLWithCodeChallenge is like RedirectURL except that the
+// login is protected with PKCE (see RFC 7636). The code returned at the
+// end of the login can only be exchanged for a discharge token using
+// GetDischargeTokenWithCodeVerifier with the code verifier from which
+// the given challenge was derived using the given method ("S256" or
+// "plain").
+func (i InteractionInfo) RedirectURLWithCodeChallenge(returnTo, state, challenge, method string) string {
+	v := make(url.Values, 4)
+	v.Set("return_to", returnTo)
+	v.Set("state", state)
+	v.Set("code_challenge", challenge)
+	v.Set("code_challenge_method", method)
+	return i.redirectURL(v)
+}
 
+// redirectURL returns the login URL with the given query parameters
+// added.
+func (i InteractionInfo) redirectURL(v url.Values) string {
 	var sb strings.Builder
 	sb.WriteString(i.LoginURL)
 	if strings.Contains(i.LoginURL, "?") {
@@ -59,6 +79,14 @@ type DischargeTokenRequest struct {
 	httprequest.Route `httprequest:"POST"`
 	Body              struct {
 		Code string `json:"code"`
+
+		// CodeVerifier holds the PKCE code verifier matching the
+		// code_challenge sent when the login was started, if any.
+		CodeVerifier string `json:"code_verifier,omitempty"`
+
+		// ReturnTo holds the return_to address the login was
+		// started with, to which the code was sent.
+		ReturnTo string `json:"return_to"`
 	} `httprequest:",body"`
 }
 
@@ -68,11 +96,24 @@ type DischargeTokenResponse struct {
 }
 
 // GetDischargeToken retrieves the discharge token associated with the
-// given code.
-func (i InteractionInfo) GetDischargeToken(ctx context.Context, code string) (*httpbakery.DischargeToken, error) {
+// given code, which was sent to the given returnTo address. The
+// returnTo address must be the same as that the login was started
+// with.
+func (i InteractionInfo) GetDischargeToken(ctx context.Context, returnTo, code string) (*httpbakery.DischargeToken, error) {
+	dt, err := i.GetDischargeTokenWithCodeVerifier(ctx, returnTo, code, "")
+	return dt, errgo.Mask(err, errgo.Any)
+}
+
+// GetDischargeTokenWithCodeVerifier retrieves the discharge token
+// associated with the given code, which was obtained from a login
+// started with RedirectURLWithCodeChallenge, using the given code
+// verifier.
+func (i InteractionInfo) GetDischargeTokenWithCodeVerifier(ctx context.Context, returnTo, code, verifier string) (*httpbakery.DischargeToken, error) {
 	client := new(httprequest.Client)
 	var req DischargeTokenRequest
 	req.Body.Code = code
+	req.Body.CodeVerifier = verifier
+	req.Body.ReturnTo = returnTo
 
 	var resp DischargeTokenResponse
 	if err := client.CallURL(ctx, i.DischargeTokenURL, &req, &resp); err != nil {
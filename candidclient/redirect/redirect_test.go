@@ -32,6 +32,16 @@ func TestRedirectURL(t *testing.T) {
 	c.Assert(rurl, qt.Equals, "https://www.example.com/login?domain=test&return_to=https%3A%2F%2Fwww.example.com%2Fcallback&state=12345")
 }
 
+func TestRedirectURLWithCodeChallenge(t *testing.T) {
+	c := qt.New(t)
+
+	info := redirect.InteractionInfo{
+		LoginURL: "https://www.example.com/login",
+	}
+	rurl := info.RedirectURLWithCodeChallenge("https://www.example.com/callback", "12345", "challenge", "S256")
+	c.Assert(rurl, qt.Equals, "https://www.example.com/login?code_challenge=challenge&code_challenge_method=S256&return_to=https%3A%2F%2Fwww.example.com%2Fcallback&state=12345")
+}
+
 func TestInteractor(t *testing.T) {
 	c := qt.New(t)
 	ctx := context.Background()
@@ -81,6 +81,9 @@ func initServer(t Testing, p candid.ServerParams, versions ...string) candid.Han
 	if p.ACLStore == nil {
 		p.ACLStore = aclstore.NewACLStore(memsimplekv.NewStore())
 	}
+	if p.GroupStore == nil {
+		p.GroupStore = memstore.NewGroupStore()
+	}
 	if p.PrivateAddr == "" {
 		p.PrivateAddr = "127.0.0.1"
 	}
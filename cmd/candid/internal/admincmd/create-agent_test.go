@@ -77,7 +77,7 @@ func (s *createAgentSuite) TestCreateAgentWithGeneratedKeyAndAgentFileNotSpecifi
 func (s *createAgentSuite) TestCreateAgentWithNonExistentAgentsFileSpecified(c *qt.C) {
 	agentFile := filepath.Join(c.Mkdir(), ".agents")
 	out := s.fixture.CheckSuccess(c, "create-agent", "-a", "admin.agent", "-f", agentFile)
-	c.Assert(out, qt.Matches, `added agent a-[0-9a-f]+@candid for http://.* to .+\n`)
+	c.Assert(out, qt.Matches, `added agent a-[0-9a-z]+@candid for http://.* to .+\n`)
 
 	v, err := admincmd.ReadAgentFile(agentFile)
 	c.Assert(err, qt.IsNil)
@@ -96,7 +96,7 @@ func (s *createAgentSuite) TestCreateAgentWithNonExistentAgentsFileSpecified(c *
 
 func (s *createAgentSuite) TestCreateAgentWithExistingAgentsFile(c *qt.C) {
 	out := s.fixture.CheckSuccess(c, "create-agent", "-a", "admin.agent", "-f", "admin.agent", "somegroup")
-	c.Assert(out, qt.Matches, `added agent a-[0-9a-f]+@candid for http://.* to .+\n`)
+	c.Assert(out, qt.Matches, `added agent a-[0-9a-z]+@candid for http://.* to .+\n`)
 
 	v, err := admincmd.ReadAgentFile(filepath.Join(s.fixture.Dir, "admin.agent"))
 	c.Assert(err, qt.IsNil)
@@ -0,0 +1,219 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/gnuflag"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/candid/params"
+)
+
+type syncGroupsCommand struct {
+	*candidCommand
+
+	file        string
+	dryRun      bool
+	createUsers bool
+}
+
+func newSyncGroupsCommand(cc *candidCommand) cmd.Command {
+	return &syncGroupsCommand{
+		candidCommand: cc,
+	}
+}
+
+var syncGroupsDoc = `
+The sync-groups command reconciles the groups of users with those
+listed in an authoritative file. For each user in the file, the groups
+stored for the user are replaced with the listed groups. Groups that a
+user gets from their identity provider or from group rules are not
+affected. Users that are not in the file are not changed, and running
+the command again with the same file makes no further changes.
+
+The file is in YAML format and maps usernames to their groups, for
+example:
+
+    bob:
+        groups: [group-1, group-2]
+    alice:
+        external-id: static:alice
+        groups: [group-1]
+
+Users in the file that do not yet exist are skipped, unless the
+--create-users flag is specified, in which case any such user with an
+external-id will be created with the listed groups.
+
+Each change made is reported, the --dry-run flag can be used to
+report the changes that would be made without making them.
+
+    candid sync-groups --dry-run groups.yaml
+`
+
+func (c *syncGroupsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "sync-groups",
+		Args:    "file",
+		Purpose: "synchronize user groups from a file",
+		Doc:     syncGroupsDoc,
+	}
+}
+
+func (c *syncGroupsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.candidCommand.SetFlags(f)
+
+	f.BoolVar(&c.dryRun, "dry-run", false, "report the changes that would be made without making them")
+	f.BoolVar(&c.createUsers, "create-users", false, "create users in the file that do not yet exist")
+}
+
+func (c *syncGroupsCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errgo.New("no file specified")
+	}
+	c.file, args = args[0], args[1:]
+	return errgo.Mask(c.candidCommand.Init(args))
+}
+
+// syncGroupsEntry holds the entry for a single user in a sync-groups
+// file.
+type syncGroupsEntry struct {
+	ExternalID string   `yaml:"external-id"`
+	Groups     []string `yaml:"groups"`
+}
+
+func (c *syncGroupsCommand) Run(ctxt *cmd.Context) error {
+	defer c.Close(ctxt)
+	ctx := context.Background()
+	data, err := ioutil.ReadFile(ctxt.AbsPath(c.file))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var entries map[string]syncGroupsEntry
+	if err := yaml.UnmarshalStrict(data, &entries); err != nil {
+		return errgo.Notef(err, "cannot parse %q", c.file)
+	}
+	client, err := c.Client(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	usernames := make([]string, 0, len(entries))
+	for u := range entries {
+		usernames = append(usernames, u)
+	}
+	sort.Strings(usernames)
+	for _, u := range usernames {
+		username := params.Username(u)
+		entry := entries[u]
+		want := uniqueGroups(entry.Groups)
+		// Only the stored groups are compared, groups that the
+		// user gets from their identity provider or from group
+		// rules can't be changed here.
+		current, err := client.UserGroups(ctx, &params.UserGroupsRequest{
+			Username: username,
+			Stored:   true,
+		})
+		if errgo.Cause(err) == params.ErrNotFound {
+			if !c.createUsers || entry.ExternalID == "" {
+				fmt.Fprintf(ctxt.Stdout, "%s: not found\n", username)
+				continue
+			}
+			if !c.dryRun {
+				err := client.ProvisionUser(ctx, &params.ProvisionUserRequest{
+					Username: username,
+					Body: params.ProvisionUserBody{
+						ExternalID: entry.ExternalID,
+						Groups:     want,
+					},
+				})
+				if err != nil {
+					return errgo.Notef(err, "cannot create user %q", username)
+				}
+			}
+			fmt.Fprintf(ctxt.Stdout, "%s: created%s\n", username, formatGroupChanges(want, nil))
+			continue
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		add, remove := groupChanges(current, want)
+		if len(add) == 0 && len(remove) == 0 {
+			continue
+		}
+		if !c.dryRun {
+			// Replace the stored groups in a single operation
+			// so that repeating the sync, even after a partial
+			// failure, always converges on the same result.
+			err := client.SetUserGroups(ctx, &params.SetUserGroupsRequest{
+				Username: username,
+				Groups: params.Groups{
+					Groups: want,
+				},
+			})
+			if err != nil {
+				return errgo.Notef(err, "cannot update groups for %q", username)
+			}
+		}
+		fmt.Fprintf(ctxt.Stdout, "%s:%s\n", username, formatGroupChanges(add, remove))
+	}
+	return nil
+}
+
+// uniqueGroups returns the given groups sorted with any duplicates
+// removed.
+func uniqueGroups(groups []string) []string {
+	seen := make(map[string]bool, len(groups))
+	unique := make([]string, 0, len(groups))
+	for _, g := range groups {
+		if !seen[g] {
+			unique = append(unique, g)
+		}
+		seen[g] = true
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// groupChanges returns the groups that need to be added to, and
+// removed from, current to make it the same as want. Both returned
+// lists are sorted.
+func groupChanges(current, want []string) (add, remove []string) {
+	have := make(map[string]bool, len(current))
+	for _, g := range current {
+		have[g] = true
+	}
+	wanted := make(map[string]bool, len(want))
+	for _, g := range want {
+		if !wanted[g] && !have[g] {
+			add = append(add, g)
+		}
+		wanted[g] = true
+	}
+	for _, g := range uniqueGroups(current) {
+		if !wanted[g] {
+			remove = append(remove, g)
+		}
+	}
+	sort.Strings(add)
+	return add, remove
+}
+
+// formatGroupChanges formats the given group changes for reporting.
+func formatGroupChanges(add, remove []string) string {
+	var buf strings.Builder
+	for _, g := range add {
+		buf.WriteString(" +" + g)
+	}
+	for _, g := range remove {
+		buf.WriteString(" -" + g)
+	}
+	return buf.String()
+}
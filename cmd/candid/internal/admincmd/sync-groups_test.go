@@ -0,0 +1,125 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package admincmd_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+
+	"github.com/canonical/candid/candidtest"
+	"github.com/canonical/candid/store"
+)
+
+type syncGroupsSuite struct {
+	fixture *fixture
+}
+
+func TestSyncGroups(t *testing.T) {
+	qtsuite.Run(qt.New(t), &syncGroupsSuite{})
+}
+
+func (s *syncGroupsSuite) Init(c *qt.C) {
+	s.fixture = newFixture(c)
+}
+
+const syncGroupsFile = `
+bob:
+    groups: [test2, test3]
+alice:
+    external-id: test:alice
+    groups: [test1]
+`
+
+func (s *syncGroupsSuite) TestSyncGroups(c *qt.C) {
+	ctx := context.Background()
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"test1", "test2"},
+	})
+	s.writeFile(c, syncGroupsFile)
+	stdout := s.fixture.CheckSuccess(c, "sync-groups", "-a", "admin.agent", "groups.yaml")
+	c.Assert(stdout, qt.Equals, "alice: not found\nbob: +test3 -test1\n")
+	c.Assert(s.groups(c, "bob"), qt.DeepEquals, []string{"test2", "test3"})
+
+	// Running the sync again makes no further changes.
+	stdout = s.fixture.CheckSuccess(c, "sync-groups", "-a", "admin.agent", "groups.yaml")
+	c.Assert(stdout, qt.Equals, "alice: not found\n")
+	c.Assert(s.groups(c, "bob"), qt.DeepEquals, []string{"test2", "test3"})
+}
+
+func (s *syncGroupsSuite) TestSyncGroupsDuplicates(c *qt.C) {
+	ctx := context.Background()
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"test1"},
+	})
+	s.writeFile(c, "bob:\n    groups: [test2, test1, test2]\n")
+	stdout := s.fixture.CheckSuccess(c, "sync-groups", "-a", "admin.agent", "groups.yaml")
+	c.Assert(stdout, qt.Equals, "bob: +test2\n")
+	c.Assert(s.groups(c, "bob"), qt.DeepEquals, []string{"test1", "test2"})
+
+	stdout = s.fixture.CheckSuccess(c, "sync-groups", "-a", "admin.agent", "groups.yaml")
+	c.Assert(stdout, qt.Equals, "")
+	c.Assert(s.groups(c, "bob"), qt.DeepEquals, []string{"test1", "test2"})
+}
+
+func (s *syncGroupsSuite) TestSyncGroupsDryRun(c *qt.C) {
+	ctx := context.Background()
+	candidtest.AddIdentity(ctx, s.fixture.store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"test1", "test2"},
+	})
+	s.writeFile(c, syncGroupsFile)
+	stdout := s.fixture.CheckSuccess(c, "sync-groups", "-a", "admin.agent", "--dry-run", "--create-users", "groups.yaml")
+	c.Assert(stdout, qt.Equals, "alice: created +test1\nbob: +test3 -test1\n")
+	c.Assert(s.groups(c, "bob"), qt.DeepEquals, []string{"test1", "test2"})
+	err := s.fixture.store.Identity(ctx, &store.Identity{
+		Username: "alice",
+	})
+	c.Assert(err, qt.ErrorMatches, `user alice not found`)
+}
+
+func (s *syncGroupsSuite) TestSyncGroupsCreateUsers(c *qt.C) {
+	s.writeFile(c, syncGroupsFile)
+	stdout := s.fixture.CheckSuccess(c, "sync-groups", "-a", "admin.agent", "--create-users", "groups.yaml")
+	c.Assert(stdout, qt.Equals, "alice: created +test1\nbob: not found\n")
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+	}
+	err := s.fixture.store.Identity(context.Background(), &identity)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity.Username, qt.Equals, "alice")
+	c.Assert(identity.Groups, qt.DeepEquals, []string{"test1"})
+}
+
+func (s *syncGroupsSuite) TestSyncGroupsNoFile(c *qt.C) {
+	s.fixture.CheckError(c, 2, `no file specified`, "sync-groups", "-a", "admin.agent")
+}
+
+func (s *syncGroupsSuite) TestSyncGroupsInvalidFile(c *qt.C) {
+	s.writeFile(c, "bob: [test1]\n")
+	s.fixture.CheckError(c, 1, `cannot parse "groups.yaml": .*`, "sync-groups", "-a", "admin.agent", "groups.yaml")
+}
+
+func (s *syncGroupsSuite) writeFile(c *qt.C, data string) {
+	err := ioutil.WriteFile(filepath.Join(s.fixture.Dir, "groups.yaml"), []byte(data), 0600)
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *syncGroupsSuite) groups(c *qt.C, username string) []string {
+	identity := store.Identity{
+		Username: username,
+	}
+	err := s.fixture.store.Identity(context.Background(), &identity)
+	c.Assert(err, qt.IsNil)
+	return identity.Groups
+}
@@ -20,17 +20,31 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 
 	"github.com/canonical/candid"
+	"github.com/canonical/candid/attrschema"
+	"github.com/canonical/candid/audit"
+	"github.com/canonical/candid/breakglass"
 	"github.com/canonical/candid/config"
+	"github.com/canonical/candid/events"
+	"github.com/canonical/candid/groupwebhook"
 	"github.com/canonical/candid/idp"
 	_ "github.com/canonical/candid/idp/agent"
 	_ "github.com/canonical/candid/idp/azure"
+	_ "github.com/canonical/candid/idp/candid"
+	_ "github.com/canonical/candid/idp/emaillink"
 	_ "github.com/canonical/candid/idp/google"
+	"github.com/canonical/candid/idp/idputil"
 	_ "github.com/canonical/candid/idp/keystone"
 	_ "github.com/canonical/candid/idp/ldap"
 	_ "github.com/canonical/candid/idp/static"
 	"github.com/canonical/candid/idp/usso"
 	_ "github.com/canonical/candid/idp/usso/ussodischarge"
 	_ "github.com/canonical/candid/idp/usso/ussooauth"
+	"github.com/canonical/candid/loginhours"
+	"github.com/canonical/candid/loginpolicy"
+	"github.com/canonical/candid/maintenance"
+	"github.com/canonical/candid/onboarding"
+	"github.com/canonical/candid/ratelimit"
+	"github.com/canonical/candid/store"
 	_ "github.com/canonical/candid/store/memstore"
 	_ "github.com/canonical/candid/store/mgostore"
 	_ "github.com/canonical/candid/store/sqlstore"
@@ -97,10 +111,11 @@ func serve(conf *config.Config) error {
 		RootKeyStore:            backend.BakeryRootKeyStore(),
 		DebugStatusCheckerFuncs: backend.DebugStatusCheckerFuncs(),
 		ACLStore:                backend.ACLStore(),
-	})
+		GroupStore:              backend.GroupStore(),
+	}, backend.OutboxStore())
 }
 
-func serveIdentity(conf *config.Config, params candid.ServerParams) error {
+func serveIdentity(conf *config.Config, params candid.ServerParams, outboxStore store.OutboxStore) error {
 	logger.Infof("setting up the identity server")
 	params.IdentityProviders = defaultIDPs
 	if len(conf.IdentityProviders) > 0 {
@@ -123,6 +138,7 @@ func serveIdentity(conf *config.Config, params candid.ServerParams) error {
 		Public:  *conf.PublicKey,
 	}
 	params.RendezvousTimeout = conf.RendezvousTimeout.Duration
+	params.RendezvousExpiry = conf.RendezvousExpiry.Duration
 	params.Location = conf.Location
 	params.PrivateAddr = conf.PrivateAddr
 	params.AdminAgentPublicKey = conf.AdminAgentPublicKey
@@ -130,11 +146,168 @@ func serveIdentity(conf *config.Config, params candid.ServerParams) error {
 	params.APIMacaroonTimeout = conf.APIMacaroonTimeout.Duration
 	params.DischargeMacaroonTimeout = conf.DischargeMacaroonTimeout.Duration
 	params.DischargeTokenTimeout = conf.DischargeTokenTimeout.Duration
+	params.MaxPendingRegistrationsPerEmail = conf.MaxPendingRegistrationsPerEmail
+	params.MaxPendingRegistrationsPerIP = conf.MaxPendingRegistrationsPerIP
+	params.PendingRegistrationTimeout = conf.PendingRegistrationTimeout.Duration
+	params.RestrictLastLogin = conf.RestrictLastLogin
+	params.EmptyUsernameFallback = conf.EmptyUsernameFallback
+	params.RolesCaveat = conf.RolesCaveat
+	params.FailedLoginDelay = conf.FailedLoginDelay.Duration
+	params.MaxFailedLoginDelay = conf.MaxFailedLoginDelay.Duration
+	params.FailedLoginDedupWindow = conf.FailedLoginDedupWindow.Duration
+	params.MaxMacaroonLifetime = conf.MaxMacaroonLifetime.Duration
+	params.GroupRules = conf.GroupRules
+	params.DeletedUserResponse = conf.DeletedUserResponse
+	params.RedirectLoginParams = conf.RedirectLoginParams
+	params.RememberLastIDP = conf.RememberLastIDP
+	params.StrictExternalIDs = conf.StrictExternalIDs
+	params.BindUserAgent = conf.BindUserAgent
+	params.MaxConcurrentLogins = conf.MaxConcurrentLogins
+	params.UnknownAgentLogin = conf.UnknownAgentLogin
+	params.UnknownAgentOwner = conf.UnknownAgentOwner
+	params.UnknownAgentGroups = conf.UnknownAgentGroups
+	params.AuthTimeCaveat = conf.AuthTimeCaveat
+	params.DefaultGroups = conf.DefaultGroups
+	params.AgentRequiredCaveats = conf.AgentCaveats()
+	params.AgentOwnerRequiredCaveats = conf.AgentOwnerCaveats()
+	params.AgentCaveatThirdParties = conf.AgentCaveatThirdParties()
+	params.Deprecations = apiDeprecations(conf.Deprecations)
+	params.EmailValidation = conf.EmailValidation
+	params.DeferUnavailableWrites = conf.DeferUnavailableWrites
+	params.MaxDeferredWrites = conf.MaxDeferredWrites
+	params.MinMacaroonVersion = conf.MinMacaroonVersion
+	params.MaxMacaroonVersion = conf.MaxMacaroonVersion
+	params.AdminAllowedNetworks = config.IPNets(conf.AdminAllowedNetworks)
+	params.AdminDeniedNetworks = config.IPNets(conf.AdminDeniedNetworks)
+	params.TrustedProxies = config.IPNets(conf.TrustedProxies)
+	params.LoginIDPCaveat = conf.LoginIDPCaveat
+	params.DeviceSessionLifetimes = conf.SessionLifetimes()
+	params.IDPSessionLifetimes = conf.IDPLifetimes()
+	params.RelyingPartyRules = conf.RelyingPartyRules
+	params.DisableLegacyLogin = conf.DisableLegacyLogin
+	params.UsernameCasePolicy = conf.UsernameCasePolicy
+	params.UsernameFormat = conf.UsernameFormat
+	params.ExportRedactFields = conf.ExportRedactFields
+	params.AdminAccounts = conf.AdminAccounts
+	params.LimitToIDPTokenExpiry = conf.LimitToIDPTokenExpiry
+	params.NonInteractiveLoginChain = conf.NonInteractiveLoginChain
+	params.SlowStoreOperationThreshold = conf.SlowStoreOperationThreshold.Duration
+	params.IdentitySources = conf.IdentitySources
+	params.IdempotencyKeyTTL = conf.IdempotencyKeyTTL.Duration
+	params.APITokenLifetime = conf.APITokenLifetime.Duration
+	params.MinLoginGroups = conf.MinLoginGroups
+	params.RequestAuthCache = conf.RequestAuthCache
+	params.AnonymousSessionLifetime = conf.AnonymousSessionLifetime.Duration
+	params.UniqueDisplayNames = conf.UniqueDisplayNames
+	params.RelyingPartyGroups = conf.RelyingPartyGroups
+	params.ConditionalUserRequests = conf.ConditionalUserRequests
+	params.RequireTLS = conf.RequireTLS
+	params.RedirectToTLS = conf.RedirectToTLS
+	params.TLSExemptPaths = conf.TLSExemptPaths
+	params.LoginHandoffTimeout = conf.LoginHandoffTimeout.Duration
+	params.TokenGenerator, err = idputil.NewTokenGenerator(conf.TokenLength, conf.TokenCharset)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if conf.EventWebhookURL != "" {
+		var outbox store.OutboxStore
+		if conf.EventQueueDurable {
+			outbox = outboxStore
+		}
+		params.EventDispatcher = events.NewDispatcher(events.DispatcherParams{
+			Sink: &events.Webhook{
+				URL: conf.EventWebhookURL,
+			},
+			Capacity:     conf.EventQueueCapacity,
+			Overflow:     conf.EventQueueOverflow,
+			BlockTimeout: conf.EventQueueBlockTimeout.Duration,
+			Outbox:       outbox,
+			RetryBackoff: conf.EventRetryBackoff.Duration,
+			MaxAge:       conf.EventMaxAge.Duration,
+		})
+		defer params.EventDispatcher.Close()
+		params.DebugStatusCheckerFuncs = append(params.DebugStatusCheckerFuncs, params.EventDispatcher.CheckerFunc())
+	}
+	if len(conf.MaintenanceWindows) > 0 {
+		params.MaintenanceSchedule, err = maintenance.NewSchedule(conf.MaintenanceWindows)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		params.DebugStatusCheckerFuncs = append(params.DebugStatusCheckerFuncs, params.MaintenanceSchedule.CheckerFunc())
+	}
+	if len(conf.LoginHours) > 0 {
+		params.LoginHours, err = loginhours.NewPolicy(conf.LoginHours)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if conf.BreakGlass != nil {
+		params.BreakGlass, err = breakglass.New(*conf.BreakGlass)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if params.BreakGlass != nil {
+			params.DebugStatusCheckerFuncs = append(params.DebugStatusCheckerFuncs, params.BreakGlass.CheckerFunc())
+		}
+	}
+	if conf.LoginRateLimit != nil {
+		params.LoginRateLimiter, err = ratelimit.New(*conf.LoginRateLimit)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if c := conf.LoginClientRateLimitConfig(); c != nil {
+		params.LoginClientRateLimiter, err = ratelimit.New(*c)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if conf.AuditLog != "" {
+		f, err := os.OpenFile(conf.AuditLog, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return errgo.Notef(err, "cannot open audit log")
+		}
+		defer f.Close()
+		// Continue the hash chain from the existing log. A broken
+		// chain is reported but does not stop the server.
+		prevHash, err := audit.Verify(f)
+		if errgo.Cause(err) == audit.ErrBrokenChain {
+			logger.Errorf("audit log %s may have been tampered with: %s", conf.AuditLog, err)
+		} else if err != nil {
+			return errgo.Mask(err)
+		}
+		params.AuditLogger = audit.NewJSONLogger(f, prevHash)
+	}
+	if conf.IdentityAttributeSchema != nil {
+		params.IdentityAttributeSchema, err = attrschema.New(*conf.IdentityAttributeSchema)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if conf.GroupWebhook != nil {
+		params.GroupWebhook, err = groupwebhook.NewResolver(*conf.GroupWebhook)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if conf.LoginPolicyURL != "" {
+		params.LoginPolicy = &loginpolicy.HTTPPolicy{
+			URL:     conf.LoginPolicyURL,
+			Timeout: conf.LoginPolicyTimeout.Duration,
+		}
+	}
+	if conf.OnboardingURL != "" {
+		params.Onboarding = &onboarding.RedirectHandler{
+			URL: conf.OnboardingURL,
+		}
+		params.OnboardingAgent = conf.OnboardingAgent
+	}
 	srv, err := candid.NewServer(
 		params,
 		candid.V1,
 		candid.Debug,
 		candid.Discharger,
+		candid.SCIM,
 	)
 	if err != nil {
 		return errgo.Notef(err, "cannot create new server at %q", conf.ListenAddress)
@@ -172,3 +345,22 @@ func serveIdentity(conf *config.Config, params candid.ServerParams) error {
 var defaultIDPs = []idp.IdentityProvider{
 	usso.NewIdentityProvider(usso.Params{}),
 }
+
+// apiDeprecations returns the given configured deprecations in the
+// form used by the server.
+func apiDeprecations(ds map[string]config.Deprecation) map[string]candid.Deprecation {
+	if len(ds) == 0 {
+		return nil
+	}
+	apiDs := make(map[string]candid.Deprecation, len(ds))
+	for path, d := range ds {
+		apiDs[path] = candid.Deprecation{
+			Since:       d.Since.Time,
+			Sunset:      d.Sunset.Time,
+			Link:        d.Link,
+			Message:     d.Message,
+			BodyWarning: d.BodyWarning,
+		}
+	}
+	return apiDs
+}
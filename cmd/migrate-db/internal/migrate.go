@@ -54,6 +54,9 @@ func Copy(ctx context.Context, dst store.Store, src Source) error {
 		store.ProviderInfo:  store.Set,
 		store.ExtraInfo:     store.Set,
 		store.Owner:         store.Set,
+		store.Source:        store.Set,
+		store.Roles:         store.Set,
+		store.AdminDisabled: store.Set,
 	}
 	for src.Next() {
 		identity := src.Identity()
@@ -127,6 +127,10 @@ func (s errorStore) UpdateIdentity(_ context.Context, _ *store.Identity, _ store
 	return s.err
 }
 
+func (s errorStore) RemoveIdentity(_ context.Context, _ *store.Identity) error {
+	return s.err
+}
+
 func (s errorStore) IdentityCounts(_ context.Context) (map[string]int, error) {
 	return nil, s.err
 }
@@ -201,6 +205,8 @@ func TestCopy(t *testing.T) {
 
 func normalize(identity *store.Identity) {
 	identity.ID = ""
+	identity.Version = 0
+	identity.Modified = time.Time{}
 	if len(identity.Groups) == 0 {
 		identity.Groups = nil
 	}
@@ -7,6 +7,7 @@ package config
 import (
 	"crypto/tls"
 	"io/ioutil"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -14,9 +15,20 @@ import (
 	"github.com/juju/loggo"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/yaml.v2"
 
+	"github.com/canonical/candid/attrschema"
+	"github.com/canonical/candid/breakglass"
+	"github.com/canonical/candid/displayname"
+	"github.com/canonical/candid/events"
+	"github.com/canonical/candid/groupwebhook"
 	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/loginhours"
+	"github.com/canonical/candid/maintenance"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/ratelimit"
 	"github.com/canonical/candid/store"
 )
 
@@ -45,8 +57,13 @@ type Config struct {
 	// AccessLog holds the name of a file to use to write logs of API accesses.
 	AccessLog string `yaml:"access-log"`
 
-	// RendezvousTimeout holds length of time that an interactive authentication
-	// request can be active before it is forgotten.
+	// AuditLog holds the name of a file to which a record of every
+	// login attempt is appended.
+	AuditLog string `yaml:"audit-log"`
+
+	// RendezvousTimeout holds the maximum length of time that a
+	// single request waiting for an interactive authentication to
+	// complete will block. See also RendezvousExpiry.
 	RendezvousTimeout DurationString `yaml:"rendezvous-timeout"`
 
 	// PrivateAddr holds the hostname where this instance of the Candid server
@@ -108,6 +125,412 @@ type Config struct {
 	// DischargeTokenTimeout is the maximum age a discharge token can
 	// get before it becomes invalid.
 	DischargeTokenTimeout DurationString `yaml:"discharge-token-timeout"`
+
+	// MaxPendingRegistrationsPerEmail holds the maximum number of
+	// pending (unverified) registrations that may be outstanding for
+	// a single email address. If this is zero there is no limit.
+	MaxPendingRegistrationsPerEmail int `yaml:"max-pending-registrations-per-email"`
+
+	// MaxPendingRegistrationsPerIP holds the maximum number of
+	// pending (unverified) registrations that may be outstanding for
+	// a single source IP address. If this is zero there is no limit.
+	MaxPendingRegistrationsPerIP int `yaml:"max-pending-registrations-per-ip"`
+
+	// PendingRegistrationTimeout holds the length of time after
+	// which a pending registration expires and no longer counts
+	// against the limits.
+	PendingRegistrationTimeout DurationString `yaml:"pending-registration-timeout"`
+
+	// RestrictLastLogin, if set, causes the last login and last
+	// discharge times of a user to only be returned to users with
+	// administrative read access (those in the read-user ACL).
+	RestrictLastLogin bool `yaml:"restrict-last-login"`
+
+	// EmptyUsernameFallback holds the method used to derive a
+	// username when an identity provider returns an empty one. The
+	// only supported value is "email", which uses the local part of
+	// the user's email address. If this is empty then logins that
+	// result in an empty username are rejected.
+	EmptyUsernameFallback string `yaml:"empty-username-fallback"`
+
+	// RolesCaveat, if set, causes discharge macaroons to include a
+	// "roles" declaration listing the tenant-scoped roles of the
+	// user (for example "tenantA:admin,tenantB:viewer"). Roles are
+	// set using the /v1/u/:username/roles endpoint.
+	RolesCaveat bool `yaml:"roles-caveat"`
+
+	// FailedLoginDelay holds the delay applied to the response
+	// after a failed password login. The delay doubles with each
+	// consecutive failure for an account, and is reset by a
+	// successful login. If this is not set no delay is applied.
+	FailedLoginDelay DurationString `yaml:"failed-login-delay"`
+
+	// MaxFailedLoginDelay holds the maximum delay applied after a
+	// failed password login. If this is not set the delay is not
+	// capped.
+	MaxFailedLoginDelay DurationString `yaml:"max-failed-login-delay"`
+
+	// FailedLoginDedupWindow holds the length of time for which a
+	// repeated identical failed login, with the same username and
+	// password, is not counted as a further failure. If this is
+	// not set every failed login is counted.
+	FailedLoginDedupWindow DurationString `yaml:"failed-login-dedup-window"`
+
+	// MaxMacaroonLifetime holds the maximum time for which an
+	// identity macaroon can be kept valid by renewing it, after
+	// which the user must log in again. If this is not set macaroon
+	// renewal is disabled.
+	MaxMacaroonLifetime DurationString `yaml:"max-macaroon-lifetime"`
+
+	// LoginPolicyURL holds the URL of an HTTP policy engine that is
+	// consulted before a login completes. The engine is expected to
+	// implement the Open Policy Agent data API. If this is empty all
+	// logins are allowed.
+	LoginPolicyURL string `yaml:"login-policy-url"`
+
+	// LoginPolicyTimeout holds the maximum time to wait for the
+	// login policy engine to respond. If the engine does not respond
+	// in time the login fails. If this is not set a default of ten
+	// seconds is used.
+	LoginPolicyTimeout DurationString `yaml:"login-policy-timeout"`
+
+	// RendezvousExpiry holds the length of time after which an
+	// interactive login that has not been completed times out. This
+	// should be long enough for a user to complete the login. If
+	// this is not set a default of one hour is used.
+	RendezvousExpiry DurationString `yaml:"rendezvous-expiry"`
+
+	// GroupRules holds rules that add identities to groups based
+	// on their attributes.
+	GroupRules []store.GroupRule `yaml:"group-rules"`
+
+	// EventWebhookURL holds the URL that identity events are POSTed
+	// to. If this is empty then no events are sent.
+	EventWebhookURL string `yaml:"event-webhook-url"`
+
+	// EventQueueCapacity holds the maximum number of events waiting
+	// to be delivered.
+	EventQueueCapacity int `yaml:"event-queue-capacity"`
+
+	// EventQueueOverflow holds the policy applied when an event is
+	// sent while the event queue is full.
+	EventQueueOverflow events.OverflowPolicy `yaml:"event-queue-overflow"`
+
+	// EventQueueBlockTimeout holds the maximum time to wait for room
+	// in the event queue when the overflow policy is "block".
+	EventQueueBlockTimeout DurationString `yaml:"event-queue-block-timeout"`
+
+	// EventQueueDurable holds whether the queue of events waiting to
+	// be delivered is held in the store, so that events survive
+	// restarts and failed deliveries are retried.
+	EventQueueDurable bool `yaml:"event-queue-durable"`
+
+	// EventRetryBackoff holds the time to wait before first retrying
+	// a failed delivery from the durable event queue.
+	EventRetryBackoff DurationString `yaml:"event-retry-backoff"`
+
+	// EventMaxAge holds the time after which an event in the durable
+	// event queue is discarded if it has not been delivered.
+	EventMaxAge DurationString `yaml:"event-max-age"`
+
+	// DeletedUserResponse determines how a discharge request
+	// authenticated as a user that no longer exists is handled. This
+	// may be "error" (the default) or "interact".
+	DeletedUserResponse string `yaml:"deleted-user-response"`
+
+	// RedirectLoginParams holds, for each identity provider name,
+	// additional query parameters to add to the return_to address
+	// when a redirect login using that identity provider succeeds.
+	RedirectLoginParams map[string]idputil.RedirectParams `yaml:"redirect-login-params"`
+
+	// RememberLastIDP, if set, causes the identity provider chooser
+	// to list first the identity provider most recently used to log
+	// in from the same browser.
+	RememberLastIDP bool `yaml:"remember-last-idp"`
+
+	// StrictExternalIDs, if set, requires every external ID given to
+	// the API to be prefixed with the name of a configured identity
+	// provider.
+	StrictExternalIDs bool `yaml:"strict-external-ids"`
+
+	// BindUserAgent, if set, restricts the discharge tokens given to
+	// interactive clients so that they can only be used by a user
+	// agent with the same fingerprint as the one that received them.
+	BindUserAgent bool `yaml:"bind-user-agent"`
+
+	// MaxConcurrentLogins holds the maximum number of login requests
+	// to each identity provider that may be in progress at the same
+	// time. If this is zero the number of logins is not limited.
+	MaxConcurrentLogins int `yaml:"max-concurrent-logins"`
+
+	// UnknownAgentLogin determines what happens when an agent login
+	// is attempted for an agent that does not exist, either "reject"
+	// (the default) or "create".
+	UnknownAgentLogin string `yaml:"unknown-agent-login"`
+
+	// UnknownAgentOwner holds the username of the owner of agents
+	// created when UnknownAgentLogin is "create".
+	UnknownAgentOwner string `yaml:"unknown-agent-owner"`
+
+	// UnknownAgentGroups holds the groups given to agents created
+	// when UnknownAgentLogin is "create".
+	UnknownAgentGroups []string `yaml:"unknown-agent-groups"`
+
+	// AuthTimeCaveat, if set, causes discharge macaroons to include
+	// an "auth-time" declaration holding the time at which the user
+	// authenticated.
+	AuthTimeCaveat bool `yaml:"auth-time-caveat"`
+
+	// DefaultGroups holds groups that are added to every identity
+	// when it is first created.
+	DefaultGroups []string `yaml:"default-groups"`
+
+	// AgentRequiredCaveats holds third-party caveats that every
+	// agent must discharge in order to log in.
+	AgentRequiredCaveats []AgentCaveat `yaml:"agent-required-caveats"`
+
+	// AgentOwnerRequiredCaveats holds third-party caveats that
+	// agents owned by a particular user must discharge in order to
+	// log in, keyed by the owner's username.
+	AgentOwnerRequiredCaveats map[string][]AgentCaveat `yaml:"agent-owner-required-caveats"`
+
+	// Deprecations holds the deprecation details of any deprecated
+	// API endpoints, keyed by the path of the endpoint (for example
+	// "/login-legacy").
+	Deprecations map[string]Deprecation `yaml:"deprecations"`
+
+	// EmailValidation holds the validation applied to email
+	// addresses before they are stored. This can be "lenient" (the
+	// default), "strict" or "none".
+	EmailValidation store.EmailValidation `yaml:"email-validation"`
+
+	// DeferUnavailableWrites allows logins to continue while the
+	// store is temporarily read-only, deferring updates to the last
+	// login and last discharge times of existing identities until it
+	// is writable again.
+	DeferUnavailableWrites bool `yaml:"defer-unavailable-writes"`
+
+	// MaxDeferredWrites holds the maximum number of updates that
+	// will be deferred while the store is read-only.
+	MaxDeferredWrites int `yaml:"max-deferred-writes"`
+
+	// MinMacaroonVersion and MaxMacaroonVersion hold the range of
+	// macaroon versions that will be minted in response to
+	// requests. Clients that do not support the minimum version are
+	// rejected. If MaxMacaroonVersion is zero the latest version is
+	// used.
+	MinMacaroonVersion bakery.Version `yaml:"min-macaroon-version"`
+	MaxMacaroonVersion bakery.Version `yaml:"max-macaroon-version"`
+
+	// OnboardingURL holds the URL of an external service that users
+	// are sent to the first time they log in. The service must
+	// return the user to the URL given in the return_to query
+	// parameter once onboarding is complete. If this is empty no
+	// onboarding is performed.
+	OnboardingURL string `yaml:"onboarding-url"`
+
+	// OnboardingAgent holds the username of the agent that the
+	// onboarding service authenticates as when confirming that a
+	// user has completed onboarding. This must be set if
+	// OnboardingURL is set.
+	OnboardingAgent string `yaml:"onboarding-agent"`
+
+	// AdminAllowedNetworks holds the networks, in CIDR notation, from
+	// which requests to admin endpoints are allowed. If this is
+	// empty admin requests are allowed from any network that is not
+	// in AdminDeniedNetworks.
+	AdminAllowedNetworks []CIDRString `yaml:"admin-allowed-networks"`
+
+	// AdminDeniedNetworks holds the networks, in CIDR notation, from
+	// which requests to admin endpoints are always rejected.
+	AdminDeniedNetworks []CIDRString `yaml:"admin-denied-networks"`
+
+	// TrustedProxies holds the networks, in CIDR notation, of
+	// reverse proxies that are trusted to report the client address
+	// in the X-Forwarded-For header.
+	TrustedProxies []CIDRString `yaml:"trusted-proxies"`
+
+	// LoginIDPCaveat, if set, causes discharge macaroons to include
+	// a "login-idp" declaration holding the name of the identity
+	// provider the user authenticated with.
+	LoginIDPCaveat bool `yaml:"login-idp-caveat"`
+
+	// MaintenanceWindows holds recurring windows during which new
+	// logins are refused, for example while the database is being
+	// maintained.
+	MaintenanceWindows []maintenance.Window `yaml:"maintenance-windows"`
+
+	// LoginHours holds rules restricting the times at which users
+	// with particular groups or identity attributes may log in.
+	LoginHours []loginhours.Rule `yaml:"login-hours"`
+
+	// GroupWebhook holds the configuration of an HTTP service that
+	// is called to get the groups of users when they log in.
+	GroupWebhook *groupwebhook.Config `yaml:"group-webhook"`
+
+	// DeviceSessionLifetimes holds the maximum life of the discharge
+	// token created when a user logs in, keyed by the class of device
+	// ("mobile" or "desktop") the user logs in from. Logins from
+	// devices that are not listed use DischargeTokenTimeout.
+	DeviceSessionLifetimes map[string]DurationString `yaml:"device-session-lifetimes"`
+
+	// RelyingPartyRules holds, for each relying party host name, the
+	// rule that a user must satisfy to complete a redirect login
+	// whose return_to address is on that host. Host names are
+	// canonicalized with idputil.RelyingPartyHost.
+	RelyingPartyRules map[string]idputil.RelyingPartyRule `yaml:"relying-party-rules"`
+
+	// DisableLegacyLogin, if set, disables the endpoints used by the
+	// legacy visit-wait and agent login protocols.
+	DisableLegacyLogin bool `yaml:"disable-legacy-login"`
+
+	// UsernameCasePolicy holds the policy applied at login to
+	// usernames that differ only in case. This may be "sensitive"
+	// (the default), which treats them as distinct identities, or
+	// "insensitive", which reuses the existing identity.
+	UsernameCasePolicy string `yaml:"username-case-policy"`
+
+	// UsernameFormat, if set, holds a template used to derive the
+	// username of each new identity from the information supplied
+	// by the identity provider.
+	UsernameFormat string `yaml:"username-format"`
+
+	// ExportRedactFields holds the names of the user fields that are
+	// redacted when users are exported.
+	ExportRedactFields []string `yaml:"export-redact-fields"`
+
+	// AdminAccounts holds additional administrator accounts, each
+	// with its own username and public key.
+	AdminAccounts []params.AdminAccount `yaml:"admin-accounts"`
+
+	// LimitToIDPTokenExpiry holds whether the lifetime of discharge
+	// tokens is limited to the expiry time of the token issued by
+	// the identity provider.
+	LimitToIDPTokenExpiry bool `yaml:"limit-to-idp-token-expiry"`
+
+	// NonInteractiveLoginChain holds the login methods tried, in
+	// order, for non-interactive clients.
+	NonInteractiveLoginChain []string `yaml:"non-interactive-login-chain"`
+
+	// SlowStoreOperationThreshold holds the duration above which
+	// identity store operations are logged as slow. If this is not
+	// set slow operations are not logged.
+	SlowStoreOperationThreshold DurationString `yaml:"slow-store-operation-threshold"`
+
+	// IdentitySources maps identity provider names to the source
+	// tag recorded on the identities they create.
+	IdentitySources map[string]string `yaml:"identity-sources"`
+
+	// IdempotencyKeyTTL holds how long the response to a write
+	// request made with an Idempotency-Key header is kept. If this
+	// is not set idempotency keys are not supported.
+	IdempotencyKeyTTL DurationString `yaml:"idempotency-key-ttl"`
+
+	// APITokenLifetime holds the maximum lifetime of API tokens. If
+	// this is not set API tokens are disabled.
+	APITokenLifetime DurationString `yaml:"api-token-lifetime"`
+
+	// MinLoginGroups holds the minimum number of groups that a user
+	// must be a member of to complete a login. If this is not set
+	// no minimum is applied.
+	MinLoginGroups int `yaml:"min-login-groups"`
+
+	// TokenLength holds the number of characters in the random tokens
+	// and identifiers generated by the server, such as password
+	// reset tokens and API tokens. If this is zero 32 characters are
+	// used.
+	TokenLength int `yaml:"token-length"`
+
+	// TokenCharset holds the characters used in generated tokens. If
+	// this is empty the URL-safe base64 alphabet is used. The length
+	// and charset together must give at least 128 bits of entropy.
+	TokenCharset string `yaml:"token-charset"`
+
+	// RequestAuthCache, if set, causes the identity, group and ACL
+	// lookups made while authorizing a single API request to be
+	// remembered for the rest of that request.
+	RequestAuthCache bool `yaml:"request-auth-cache"`
+
+	// AnonymousSessionLifetime holds the lifetime of anonymous
+	// session macaroons. If this is not set anonymous sessions are
+	// disabled.
+	AnonymousSessionLifetime DurationString `yaml:"anonymous-session-lifetime"`
+
+	// UniqueDisplayNames, if set, requires every identity to have a
+	// different display name. Display names are normalized as
+	// specified before they are compared.
+	UniqueDisplayNames *displayname.Params `yaml:"unique-display-names"`
+
+	// RelyingPartyGroups holds, for each relying party that needs
+	// one, the mask that determines the groups declared to it.
+	RelyingPartyGroups []idputil.GroupMask `yaml:"relying-party-groups"`
+
+	// ConditionalUserRequests holds whether requests for a single
+	// user support conditional requests.
+	ConditionalUserRequests bool `yaml:"conditional-user-requests"`
+
+	// RequireTLS holds whether requests must be made over TLS.
+	RequireTLS bool `yaml:"require-tls"`
+
+	// RedirectToTLS holds whether GET and HEAD requests made without
+	// TLS are redirected to the https location when RequireTLS is set.
+	RedirectToTLS bool `yaml:"redirect-to-tls"`
+
+	// TLSExemptPaths holds paths that may be requested without TLS
+	// when RequireTLS is set.
+	TLSExemptPaths []string `yaml:"tls-exempt-paths"`
+
+	// LoginHandoffTimeout holds how long a login may be continued on
+	// another device. If this is zero login hand-off is disabled.
+	LoginHandoffTimeout DurationString `yaml:"login-handoff-timeout"`
+
+	// IdentityAttributeSchema, if set, holds a schema that the
+	// extra-info attributes of identities must conform to. Writes of
+	// attributes that do not conform are rejected.
+	IdentityAttributeSchema *attrschema.Config `yaml:"identity-attribute-schema"`
+
+	// BreakGlass holds the configuration of an emergency credential
+	// that grants admin access when the usual means of
+	// authentication are unavailable. It is only accepted when
+	// explicitly enabled.
+	BreakGlass *breakglass.Config `yaml:"break-glass"`
+
+	// IDPSessionLifetimes holds the maximum life of the discharge
+	// token created when a user logs in, keyed by the name of the
+	// identity provider the user logs in with. Identity providers
+	// that are not listed, or have a zero lifetime, use
+	// DischargeTokenTimeout.
+	IDPSessionLifetimes map[string]DurationString `yaml:"idp-session-lifetimes"`
+
+	// LoginRateLimit holds the limit on the rate of requests that
+	// each client may make to the identity provider login handlers.
+	// If this is not set the rate is not limited.
+	LoginRateLimit *ratelimit.Config `yaml:"login-rate-limit"`
+
+	// LoginClientRateLimit holds the limit on the rate of requests
+	// that each client may make to the identity provider login
+	// handlers, whatever username they submit. If this is not set
+	// and LoginRateLimit is, it is DefaultLoginClientRateFactor
+	// times LoginRateLimit.
+	LoginClientRateLimit *ratelimit.Config `yaml:"login-client-rate-limit"`
+}
+
+// DefaultLoginClientRateFactor holds the factor by which
+// LoginRateLimit is multiplied to give the limit for each client when
+// LoginClientRateLimit is not set.
+const DefaultLoginClientRateFactor = 5
+
+// LoginClientRateLimitConfig returns the limit on the rate of requests
+// that each client may make to the identity provider login handlers,
+// or nil if the rate is not limited.
+func (c *Config) LoginClientRateLimitConfig() *ratelimit.Config {
+	if c.LoginClientRateLimit != nil || c.LoginRateLimit == nil {
+		return c.LoginClientRateLimit
+	}
+	return &ratelimit.Config{
+		RequestsPerMinute: c.LoginRateLimit.RequestsPerMinute * DefaultLoginClientRateFactor,
+		Burst:             c.LoginRateLimit.Burst * DefaultLoginClientRateFactor,
+	}
 }
 
 // TLSConfig returns a TLS configuration to be used for serving
@@ -145,7 +568,6 @@ func (c *Config) validate() error {
 		missing = append(missing, "public-key")
 	}
 	if c.Location == "" {
-		// TODO check it's a valid URL
 		missing = append(missing, "location")
 	}
 	if c.PrivateAddr == "" {
@@ -154,6 +576,199 @@ func (c *Config) validate() error {
 	if len(missing) != 0 {
 		return errgo.Newf("missing fields %s in config file", strings.Join(missing, ", "))
 	}
+	location, err := idputil.CanonicalLocation(c.Location)
+	if err != nil {
+		return errgo.Notef(err, "invalid location")
+	}
+	c.Location = location
+	if c.OnboardingURL != "" && c.OnboardingAgent == "" {
+		return errgo.Newf("onboarding-agent must be set when onboarding-url is set")
+	}
+	switch c.EmptyUsernameFallback {
+	case "", "email":
+	default:
+		return errgo.Newf("invalid empty-username-fallback %q", c.EmptyUsernameFallback)
+	}
+	switch c.UsernameCasePolicy {
+	case "", "sensitive", "insensitive":
+	default:
+		return errgo.Newf("invalid username-case-policy %q", c.UsernameCasePolicy)
+	}
+	switch c.DeletedUserResponse {
+	case "", "error", "interact":
+	default:
+		return errgo.Newf("invalid deleted-user-response %q", c.DeletedUserResponse)
+	}
+	switch c.UnknownAgentLogin {
+	case "", "reject":
+	case "create":
+		if c.UnknownAgentOwner == "" {
+			return errgo.Newf("unknown-agent-owner must be set when unknown-agent-login is \"create\"")
+		}
+	default:
+		return errgo.Newf("invalid unknown-agent-login %q", c.UnknownAgentLogin)
+	}
+	if err := c.EventQueueOverflow.Validate(); err != nil {
+		return errgo.Notef(err, "invalid event-queue-overflow")
+	}
+	if err := c.EmailValidation.Validate(); err != nil {
+		return errgo.Mask(err)
+	}
+	if c.MinMacaroonVersion < 0 || c.MinMacaroonVersion > bakery.LatestVersion {
+		return errgo.Newf("invalid min-macaroon-version %d", c.MinMacaroonVersion)
+	}
+	if c.MaxMacaroonVersion < 0 || c.MaxMacaroonVersion > bakery.LatestVersion {
+		return errgo.Newf("invalid max-macaroon-version %d", c.MaxMacaroonVersion)
+	}
+	if c.MaxMacaroonVersion != 0 && c.MinMacaroonVersion > c.MaxMacaroonVersion {
+		return errgo.Newf("min-macaroon-version %d is greater than max-macaroon-version %d", c.MinMacaroonVersion, c.MaxMacaroonVersion)
+	}
+	for name, p := range c.RedirectLoginParams {
+		if err := p.Validate(); err != nil {
+			return errgo.Notef(err, "invalid redirect-login-params for %q", name)
+		}
+	}
+	for _, r := range c.GroupRules {
+		if err := r.Validate(); err != nil {
+			return errgo.Notef(err, "invalid group-rules")
+		}
+	}
+	if c.UsernameFormat != "" {
+		if _, err := idputil.NewUsernameFormat(c.UsernameFormat); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if len(c.RelyingPartyRules) > 0 {
+		rules := make(map[string]idputil.RelyingPartyRule, len(c.RelyingPartyRules))
+		for host, r := range c.RelyingPartyRules {
+			if err := r.Validate(); err != nil {
+				return errgo.Notef(err, "invalid relying-party-rules for %q", host)
+			}
+			if strings.ContainsAny(host, ":/") {
+				return errgo.Newf("invalid relying-party-rules host %q: must be a host name without a port", host)
+			}
+			canonical := idputil.RelyingPartyHost(host)
+			if _, ok := rules[canonical]; ok {
+				return errgo.Newf("invalid relying-party-rules host %q: duplicate rule for %q", host, canonical)
+			}
+			rules[canonical] = r
+		}
+		c.RelyingPartyRules = rules
+	}
+	maskKeys := make(map[bakery.Key]bool)
+	for i, m := range c.RelyingPartyGroups {
+		if err := m.Validate(); err != nil {
+			return errgo.Notef(err, "invalid relying-party-groups entry %d", i)
+		}
+		if maskKeys[m.PublicKey.Key] {
+			return errgo.Newf("invalid relying-party-groups entry %d: duplicate public key %s", i, m.PublicKey.Key)
+		}
+		maskKeys[m.PublicKey.Key] = true
+	}
+	agentCaveatKeys := make(map[string]*bakery.PublicKey)
+	checkAgentCaveats := func(cavs []AgentCaveat) error {
+		for _, cav := range cavs {
+			if err := cav.Validate(); err != nil {
+				return errgo.Mask(err)
+			}
+			if pk := agentCaveatKeys[cav.Location]; pk != nil && pk.Key != cav.PublicKey.Key {
+				return errgo.Newf("conflicting public keys for agent caveat location %q", cav.Location)
+			}
+			agentCaveatKeys[cav.Location] = cav.PublicKey
+		}
+		return nil
+	}
+	if err := checkAgentCaveats(c.AgentRequiredCaveats); err != nil {
+		return errgo.Notef(err, "invalid agent-required-caveats")
+	}
+	for owner, cavs := range c.AgentOwnerRequiredCaveats {
+		if err := checkAgentCaveats(cavs); err != nil {
+			return errgo.Notef(err, "invalid agent-owner-required-caveats for %q", owner)
+		}
+	}
+	for path := range c.Deprecations {
+		if !strings.HasPrefix(path, "/") {
+			return errgo.Newf("invalid deprecations: endpoint path %q does not start with /", path)
+		}
+	}
+	if c.SlowStoreOperationThreshold.Duration < 0 {
+		return errgo.Newf("invalid slow-store-operation-threshold: must not be negative")
+	}
+	if c.IdempotencyKeyTTL.Duration < 0 {
+		return errgo.Newf("invalid idempotency-key-ttl: must not be negative")
+	}
+	if c.APITokenLifetime.Duration < 0 {
+		return errgo.Newf("invalid api-token-lifetime: must not be negative")
+	}
+	if c.MinLoginGroups < 0 {
+		return errgo.Newf("invalid min-login-groups: must not be negative")
+	}
+	if c.AnonymousSessionLifetime.Duration < 0 {
+		return errgo.Newf("invalid anonymous-session-lifetime: must not be negative")
+	}
+	if c.LoginHandoffTimeout.Duration < 0 {
+		return errgo.Newf("invalid login-handoff-timeout: must not be negative")
+	}
+	if c.LoginPolicyTimeout.Duration < 0 {
+		return errgo.Newf("invalid login-policy-timeout: must not be negative")
+	}
+	adminAccounts := make(map[params.Username]bool)
+	for _, acc := range c.AdminAccounts {
+		if !strings.HasSuffix(string(acc.Username), "@candid") || acc.Username == "@candid" || acc.Username == "admin@candid" {
+			return errgo.Newf("invalid admin-accounts: invalid username %q", acc.Username)
+		}
+		if adminAccounts[acc.Username] {
+			return errgo.Newf("invalid admin-accounts: duplicate username %q", acc.Username)
+		}
+		adminAccounts[acc.Username] = true
+		if acc.PublicKey == nil {
+			return errgo.Newf("invalid admin-accounts: no public key for %q", acc.Username)
+		}
+	}
+	for class, d := range c.DeviceSessionLifetimes {
+		if d.Duration <= 0 {
+			return errgo.Newf("invalid device-session-lifetimes: lifetime for %q must be positive", class)
+		}
+	}
+	for name, d := range c.IDPSessionLifetimes {
+		if d.Duration < 0 {
+			return errgo.Newf("invalid idp-session-lifetimes: lifetime for %q must not be negative", name)
+		}
+	}
+	if _, err := maintenance.NewSchedule(c.MaintenanceWindows); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := loginhours.NewPolicy(c.LoginHours); err != nil {
+		return errgo.Notef(err, "invalid login-hours")
+	}
+	if c.GroupWebhook != nil {
+		if err := c.GroupWebhook.Validate(); err != nil {
+			return errgo.Notef(err, "invalid group-webhook")
+		}
+	}
+	if _, err := idputil.NewTokenGenerator(c.TokenLength, c.TokenCharset); err != nil {
+		return errgo.Notef(err, "invalid token configuration")
+	}
+	if c.BreakGlass != nil {
+		if err := c.BreakGlass.Validate(); err != nil {
+			return errgo.Notef(err, "invalid break-glass")
+		}
+	}
+	if c.LoginRateLimit != nil {
+		if err := c.LoginRateLimit.Validate(); err != nil {
+			return errgo.Notef(err, "invalid login-rate-limit")
+		}
+	}
+	if c.LoginClientRateLimit != nil {
+		if err := c.LoginClientRateLimit.Validate(); err != nil {
+			return errgo.Notef(err, "invalid login-client-rate-limit")
+		}
+	}
+	if c.IdentityAttributeSchema != nil {
+		if _, err := attrschema.New(*c.IdentityAttributeSchema); err != nil {
+			return errgo.Notef(err, "invalid identity-attribute-schema")
+		}
+	}
 	return nil
 }
 
@@ -193,3 +808,180 @@ func (dp *DurationString) UnmarshalText(data []byte) error {
 	dp.Duration = d
 	return nil
 }
+
+// Deprecation holds the configuration of a deprecated API endpoint.
+type Deprecation struct {
+	// Since holds the time at which the endpoint was deprecated.
+	Since TimeString `yaml:"since"`
+
+	// Sunset holds the time after which the endpoint may be
+	// removed.
+	Sunset TimeString `yaml:"sunset"`
+
+	// Link holds the URL of documentation describing the
+	// deprecation.
+	Link string `yaml:"link"`
+
+	// Message holds a warning message to send to clients.
+	Message string `yaml:"message"`
+
+	// BodyWarning, if set, causes the message to also be added to
+	// JSON object response bodies.
+	BodyWarning bool `yaml:"body-warning"`
+}
+
+// SessionLifetimes returns the configured DeviceSessionLifetimes in the
+// form used by the server.
+func (c *Config) SessionLifetimes() map[string]time.Duration {
+	if len(c.DeviceSessionLifetimes) == 0 {
+		return nil
+	}
+	ls := make(map[string]time.Duration, len(c.DeviceSessionLifetimes))
+	for class, d := range c.DeviceSessionLifetimes {
+		ls[class] = d.Duration
+	}
+	return ls
+}
+
+// IDPLifetimes returns the configured IDPSessionLifetimes in the form
+// used by the server.
+func (c *Config) IDPLifetimes() map[string]time.Duration {
+	if len(c.IDPSessionLifetimes) == 0 {
+		return nil
+	}
+	ls := make(map[string]time.Duration, len(c.IDPSessionLifetimes))
+	for name, d := range c.IDPSessionLifetimes {
+		ls[name] = d.Duration
+	}
+	return ls
+}
+
+// TimeString holds a time that unmarshals from a string holding either
+// an RFC 3339 time or a date in the form "2006-01-02".
+type TimeString struct {
+	time.Time
+}
+
+func (tp *TimeString) UnmarshalText(data []byte) error {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, string(data)); err == nil {
+			tp.Time = t
+			return nil
+		}
+	}
+	return errgo.Newf("invalid time %q", data)
+}
+
+// AgentCaveat holds a third-party caveat that agents are required to
+// discharge in order to log in.
+type AgentCaveat struct {
+	// Location holds the location of the third party that
+	// discharges the caveat.
+	Location string `yaml:"location"`
+
+	// PublicKey holds the public key of the third party.
+	PublicKey *bakery.PublicKey `yaml:"public-key"`
+
+	// Condition holds the condition that the third party checks.
+	Condition string `yaml:"condition"`
+}
+
+// Validate checks that the caveat is fully specified.
+func (cav AgentCaveat) Validate() error {
+	if cav.Location == "" {
+		return errgo.Newf("caveat %q has no location", cav.Condition)
+	}
+	if cav.PublicKey == nil {
+		return errgo.Newf("caveat %q has no public-key", cav.Condition)
+	}
+	if cav.Condition == "" {
+		return errgo.Newf("caveat at %q has no condition", cav.Location)
+	}
+	return nil
+}
+
+func (cav AgentCaveat) caveat() checkers.Caveat {
+	return checkers.Caveat{
+		Location:  cav.Location,
+		Condition: cav.Condition,
+	}
+}
+
+// AgentCaveats returns the configured AgentRequiredCaveats in the form
+// used by the server.
+func (c *Config) AgentCaveats() []checkers.Caveat {
+	return agentCaveats(c.AgentRequiredCaveats)
+}
+
+// AgentOwnerCaveats returns the configured AgentOwnerRequiredCaveats in
+// the form used by the server.
+func (c *Config) AgentOwnerCaveats() map[string][]checkers.Caveat {
+	if len(c.AgentOwnerRequiredCaveats) == 0 {
+		return nil
+	}
+	cs := make(map[string][]checkers.Caveat, len(c.AgentOwnerRequiredCaveats))
+	for owner, cavs := range c.AgentOwnerRequiredCaveats {
+		cs[owner] = agentCaveats(cavs)
+	}
+	return cs
+}
+
+// AgentCaveatThirdParties returns information about the third parties
+// addressed by the configured agent caveats, keyed by location.
+func (c *Config) AgentCaveatThirdParties() map[string]bakery.ThirdPartyInfo {
+	infos := make(map[string]bakery.ThirdPartyInfo)
+	add := func(cavs []AgentCaveat) {
+		for _, cav := range cavs {
+			infos[cav.Location] = bakery.ThirdPartyInfo{
+				PublicKey: *cav.PublicKey,
+				Version:   bakery.LatestVersion,
+			}
+		}
+	}
+	add(c.AgentRequiredCaveats)
+	for _, cavs := range c.AgentOwnerRequiredCaveats {
+		add(cavs)
+	}
+	if len(infos) == 0 {
+		return nil
+	}
+	return infos
+}
+
+func agentCaveats(cavs []AgentCaveat) []checkers.Caveat {
+	if len(cavs) == 0 {
+		return nil
+	}
+	cs := make([]checkers.Caveat, len(cavs))
+	for i, cav := range cavs {
+		cs[i] = cav.caveat()
+	}
+	return cs
+}
+
+// CIDRString holds a network that unmarshals from a string in CIDR
+// notation, for example "10.0.0.0/8".
+type CIDRString struct {
+	*net.IPNet
+}
+
+func (cp *CIDRString) UnmarshalText(data []byte) error {
+	_, n, err := net.ParseCIDR(string(data))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	cp.IPNet = n
+	return nil
+}
+
+// IPNets returns the networks held in the given CIDRStrings.
+func IPNets(cs []CIDRString) []*net.IPNet {
+	if len(cs) == 0 {
+		return nil
+	}
+	nets := make([]*net.IPNet, len(cs))
+	for i, c := range cs {
+		nets[i] = c.IPNet
+	}
+	return nets
+}
@@ -5,15 +5,27 @@ package config_test
 
 import (
 	"io/ioutil"
+	"net"
 	"path"
+	"strings"
 	"testing"
 	"time"
 
 	qt "github.com/frankban/quicktest"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 
+	"github.com/canonical/candid/attrschema"
+	"github.com/canonical/candid/breakglass"
 	"github.com/canonical/candid/config"
+	"github.com/canonical/candid/displayname"
+	"github.com/canonical/candid/events"
+	"github.com/canonical/candid/groupwebhook"
 	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/loginhours"
+	"github.com/canonical/candid/maintenance"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/ratelimit"
 	"github.com/canonical/candid/store"
 	_ "github.com/canonical/candid/store/memstore"
 )
@@ -94,6 +106,157 @@ redirect-login-whitelist:
 api-macaroon-timeout: 2h
 discharge-macaroon-timeout: 24h
 discharge-token-timeout: 6h
+max-pending-registrations-per-email: 3
+max-pending-registrations-per-ip: 10
+pending-registration-timeout: 30m
+restrict-last-login: true
+empty-username-fallback: email
+roles-caveat: true
+failed-login-delay: 1s
+max-failed-login-delay: 1m
+failed-login-dedup-window: 2s
+max-macaroon-lifetime: 720h
+login-policy-url: http://localhost:8181/v1/data/candid/login
+login-policy-timeout: 5s
+rendezvous-expiry: 15m
+group-rules:
+ - group: staff
+   attribute: email-domain
+   value: example.com
+event-webhook-url: https://events.example.com/candid
+event-queue-capacity: 500
+event-queue-overflow: drop-newest
+event-queue-block-timeout: 2s
+event-queue-durable: true
+event-retry-backoff: 5s
+event-max-age: 12h
+deleted-user-response: interact
+redirect-login-params:
+  oidc:
+    session_state: idp:session_state
+    login_hint: email
+remember-last-idp: true
+strict-external-ids: true
+bind-user-agent: true
+max-concurrent-logins: 20
+unknown-agent-login: create
+unknown-agent-owner: provisioner
+unknown-agent-groups: [bootstrap]
+auth-time-caveat: true
+default-groups: [everyone]
+agent-required-caveats:
+  - location: https://attest.example.com
+    public-key: dUnC8p9p3nygtE2h92a47Ooq0rXg0fVSm3YBWou5/UQ=
+    condition: environment production
+agent-owner-required-caveats:
+  alice:
+    - location: https://attest.example.com
+      public-key: dUnC8p9p3nygtE2h92a47Ooq0rXg0fVSm3YBWou5/UQ=
+      condition: build-provenance ci
+deprecations:
+  /login-legacy:
+    sunset: "2021-06-30"
+    link: https://example.com/deprecations
+    message: use /login instead
+    body-warning: true
+email-validation: strict
+defer-unavailable-writes: true
+max-deferred-writes: 500
+min-macaroon-version: 1
+max-macaroon-version: 2
+onboarding-url: https://onboarding.example.com/welcome
+onboarding-agent: onboarder@candid
+admin-allowed-networks:
+- 10.0.0.0/8
+- 192.168.1.0/24
+admin-denied-networks:
+- 10.1.0.0/16
+trusted-proxies:
+- 127.0.0.1/32
+login-idp-caveat: true
+maintenance-windows:
+- days: [saturday, sunday]
+  start: "02:00"
+  duration: 2h
+  timezone: Europe/London
+  message: database maintenance
+login-hours:
+- group: contractors
+  days: [mon, tue, wed, thu, fri]
+  start: "09:00"
+  end: "17:00"
+  timezone: Europe/London
+group-webhook:
+  url: http://groups.example.com/resolve
+  mode: replace
+  timeout: 5s
+  cache-ttl: 1m
+  identity-providers: [ldap]
+device-session-lifetimes:
+  mobile: 1h
+  desktop: 12h
+relying-party-rules:
+  rp.example.com:
+    allow-groups: [ops]
+    allow-attributes:
+      - attribute: email-domain
+        value: example.com
+disable-legacy-login: true
+username-case-policy: insensitive
+username-format: '{{.EmailLocal}}@example'
+export-redact-fields: [email, ssh_keys]
+admin-accounts:
+  - username: alice@candid
+    public-key: dUnC8p9p3nygtE2h92a47Ooq0rXg0fVSm3YBWou5/UQ=
+limit-to-idp-token-expiry: true
+non-interactive-login-chain: [agent, test]
+slow-store-operation-threshold: 500ms
+identity-sources:
+  ldap-corp: corporate-directory
+idempotency-key-ttl: 24h
+api-token-lifetime: 720h
+min-login-groups: 1
+token-length: 40
+token-charset: 0123456789abcdef
+request-auth-cache: true
+anonymous-session-lifetime: 2h
+unique-display-names:
+  trim-space: true
+  case-insensitive: true
+relying-party-groups:
+  - public-key: dUnC8p9p3nygtE2h92a47Ooq0rXg0fVSm3YBWou5/UQ=
+    groups:
+      internal-ops: ops
+      admins:
+conditional-user-requests: true
+require-tls: true
+redirect-to-tls: true
+tls-exempt-paths:
+  - /debug/status
+login-handoff-timeout: 5m
+identity-attribute-schema:
+  version: 2
+  attributes:
+    department:
+      type: string
+      required: true
+      values: [engineering, sales]
+    employee-number:
+      type: integer
+break-glass:
+  enabled: true
+  username: emergency-admin
+  password-hash: $2a$12$0qb4eJxc3SOrtYMHDNUEcO1zX6kb4XT0Dsg/GbLUUJ.2ufyh6mWOC
+  expires: 2020-06-01T00:00:00Z
+idp-session-lifetimes:
+  agent: 720h
+  google: 1h
+login-rate-limit:
+  requests-per-minute: 10
+  burst: 5
+login-client-rate-limit:
+  requests-per-minute: 100
+audit-log: /var/log/candid/audit.log
 `
 
 func readConfig(c *qt.C, content string) (*config.Config, error) {
@@ -170,12 +333,210 @@ func TestRead(t *testing.T) {
 			"https://example.com/1",
 			"https://example.com/2",
 		},
-		APIMacaroonTimeout:       config.DurationString{Duration: 2 * time.Hour},
-		DischargeMacaroonTimeout: config.DurationString{Duration: 24 * time.Hour},
-		DischargeTokenTimeout:    config.DurationString{Duration: 6 * time.Hour},
+		APIMacaroonTimeout:              config.DurationString{Duration: 2 * time.Hour},
+		DischargeMacaroonTimeout:        config.DurationString{Duration: 24 * time.Hour},
+		DischargeTokenTimeout:           config.DurationString{Duration: 6 * time.Hour},
+		MaxPendingRegistrationsPerEmail: 3,
+		MaxPendingRegistrationsPerIP:    10,
+		PendingRegistrationTimeout:      config.DurationString{Duration: 30 * time.Minute},
+		RestrictLastLogin:               true,
+		EmptyUsernameFallback:           "email",
+		RolesCaveat:                     true,
+		FailedLoginDelay:                config.DurationString{Duration: time.Second},
+		MaxFailedLoginDelay:             config.DurationString{Duration: time.Minute},
+		FailedLoginDedupWindow:          config.DurationString{Duration: 2 * time.Second},
+		MaxMacaroonLifetime:             config.DurationString{Duration: 720 * time.Hour},
+		LoginPolicyURL:                  "http://localhost:8181/v1/data/candid/login",
+		LoginPolicyTimeout:              config.DurationString{Duration: 5 * time.Second},
+		RendezvousExpiry:                config.DurationString{Duration: 15 * time.Minute},
+		GroupRules: []store.GroupRule{{
+			Group:     "staff",
+			Attribute: "email-domain",
+			Value:     "example.com",
+		}},
+		EventWebhookURL:        "https://events.example.com/candid",
+		EventQueueCapacity:     500,
+		EventQueueOverflow:     events.DropNewest,
+		EventQueueBlockTimeout: config.DurationString{Duration: 2 * time.Second},
+		EventQueueDurable:      true,
+		EventRetryBackoff:      config.DurationString{Duration: 5 * time.Second},
+		EventMaxAge:            config.DurationString{Duration: 12 * time.Hour},
+		DeletedUserResponse:    "interact",
+		RedirectLoginParams: map[string]idputil.RedirectParams{
+			"oidc": {
+				"session_state": "idp:session_state",
+				"login_hint":    "email",
+			},
+		},
+		RememberLastIDP:     true,
+		StrictExternalIDs:   true,
+		BindUserAgent:       true,
+		MaxConcurrentLogins: 20,
+		UnknownAgentLogin:   "create",
+		UnknownAgentOwner:   "provisioner",
+		UnknownAgentGroups:  []string{"bootstrap"},
+		AuthTimeCaveat:      true,
+		DefaultGroups:       []string{"everyone"},
+		AgentRequiredCaveats: []config.AgentCaveat{{
+			Location:  "https://attest.example.com",
+			PublicKey: &adminPubKey,
+			Condition: "environment production",
+		}},
+		AgentOwnerRequiredCaveats: map[string][]config.AgentCaveat{
+			"alice": {{
+				Location:  "https://attest.example.com",
+				PublicKey: &adminPubKey,
+				Condition: "build-provenance ci",
+			}},
+		},
+		Deprecations: map[string]config.Deprecation{
+			"/login-legacy": {
+				Sunset:      config.TimeString{time.Date(2021, 6, 30, 0, 0, 0, 0, time.UTC)},
+				Link:        "https://example.com/deprecations",
+				Message:     "use /login instead",
+				BodyWarning: true,
+			},
+		},
+		EmailValidation:        store.EmailStrict,
+		DeferUnavailableWrites: true,
+		MaxDeferredWrites:      500,
+		MinMacaroonVersion:     1,
+		MaxMacaroonVersion:     2,
+		OnboardingURL:          "https://onboarding.example.com/welcome",
+		OnboardingAgent:        "onboarder@candid",
+		AdminAllowedNetworks: []config.CIDRString{{
+			IPNet: mustParseCIDR("10.0.0.0/8"),
+		}, {
+			IPNet: mustParseCIDR("192.168.1.0/24"),
+		}},
+		AdminDeniedNetworks: []config.CIDRString{{
+			IPNet: mustParseCIDR("10.1.0.0/16"),
+		}},
+		TrustedProxies: []config.CIDRString{{
+			IPNet: mustParseCIDR("127.0.0.1/32"),
+		}},
+		LoginIDPCaveat: true,
+		MaintenanceWindows: []maintenance.Window{{
+			Days:     []string{"saturday", "sunday"},
+			Start:    "02:00",
+			Duration: "2h",
+			Timezone: "Europe/London",
+			Message:  "database maintenance",
+		}},
+		LoginHours: []loginhours.Rule{{
+			Group:    "contractors",
+			Days:     []string{"mon", "tue", "wed", "thu", "fri"},
+			Start:    "09:00",
+			End:      "17:00",
+			Timezone: "Europe/London",
+		}},
+		GroupWebhook: &groupwebhook.Config{
+			URL:               "http://groups.example.com/resolve",
+			Mode:              groupwebhook.ModeReplace,
+			Timeout:           5 * time.Second,
+			CacheTTL:          time.Minute,
+			IdentityProviders: []string{"ldap"},
+		},
+		DeviceSessionLifetimes: map[string]config.DurationString{
+			"mobile":  {Duration: time.Hour},
+			"desktop": {Duration: 12 * time.Hour},
+		},
+		RelyingPartyRules: map[string]idputil.RelyingPartyRule{
+			"rp.example.com": {
+				AllowGroups: []string{"ops"},
+				AllowAttributes: []idputil.AttributeValue{{
+					Attribute: "email-domain",
+					Value:     "example.com",
+				}},
+			},
+		},
+		DisableLegacyLogin: true,
+		UsernameCasePolicy: "insensitive",
+		UsernameFormat:     "{{.EmailLocal}}@example",
+		ExportRedactFields: []string{"email", "ssh_keys"},
+		AdminAccounts: []params.AdminAccount{{
+			Username:  "alice@candid",
+			PublicKey: &adminPubKey,
+		}},
+		LimitToIDPTokenExpiry:       true,
+		NonInteractiveLoginChain:    []string{"agent", "test"},
+		SlowStoreOperationThreshold: config.DurationString{Duration: 500 * time.Millisecond},
+		IdentitySources: map[string]string{
+			"ldap-corp": "corporate-directory",
+		},
+		IdempotencyKeyTTL:        config.DurationString{Duration: 24 * time.Hour},
+		APITokenLifetime:         config.DurationString{Duration: 720 * time.Hour},
+		MinLoginGroups:           1,
+		TokenLength:              40,
+		TokenCharset:             "0123456789abcdef",
+		RequestAuthCache:         true,
+		AnonymousSessionLifetime: config.DurationString{Duration: 2 * time.Hour},
+		UniqueDisplayNames: &displayname.Params{
+			TrimSpace:       true,
+			CaseInsensitive: true,
+		},
+		RelyingPartyGroups: []idputil.GroupMask{{
+			PublicKey: &adminPubKey,
+			Groups: map[string]string{
+				"internal-ops": "ops",
+				"admins":       "",
+			},
+		}},
+		ConditionalUserRequests: true,
+		RequireTLS:              true,
+		RedirectToTLS:           true,
+		TLSExemptPaths:          []string{"/debug/status"},
+		LoginHandoffTimeout:     config.DurationString{Duration: 5 * time.Minute},
+		IdentityAttributeSchema: &attrschema.Config{
+			Version: 2,
+			Attributes: map[string]attrschema.Attribute{
+				"department": {
+					Type:     "string",
+					Required: true,
+					Values:   []string{"engineering", "sales"},
+				},
+				"employee-number": {
+					Type: "integer",
+				},
+			},
+		},
+		BreakGlass: &breakglass.Config{
+			Enabled:      true,
+			Username:     "emergency-admin",
+			PasswordHash: "$2a$12$0qb4eJxc3SOrtYMHDNUEcO1zX6kb4XT0Dsg/GbLUUJ.2ufyh6mWOC",
+			Expires:      time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC),
+		},
+		IDPSessionLifetimes: map[string]config.DurationString{
+			"agent":  {Duration: 720 * time.Hour},
+			"google": {Duration: time.Hour},
+		},
+		LoginRateLimit: &ratelimit.Config{
+			RequestsPerMinute: 10,
+			Burst:             5,
+		},
+		LoginClientRateLimit: &ratelimit.Config{
+			RequestsPerMinute: 100,
+		},
+		AuditLog: "/var/log/candid/audit.log",
 	})
 }
 
+func TestReadErrorConflictingAgentCaveatKeys(t *testing.T) {
+	c := qt.New(t)
+	_, err := readConfig(c, strings.Replace(testConfig, "      condition: build-provenance ci", `      condition: build-provenance ci
+  bob:
+    - location: https://attest.example.com
+      public-key: CIdWcEUN+0OZnKW9KwruRQnQDY/qqzVdD30CijwiWCk=
+      condition: environment staging`, 1))
+	c.Assert(err, qt.ErrorMatches, `invalid agent-owner-required-caveats for "bob": conflicting public keys for agent caveat location "https://attest.example.com"`)
+}
+
+func TestReadErrorInvalidDeprecationPath(t *testing.T) {
+	c := qt.New(t)
+	_, err := readConfig(c, strings.Replace(testConfig, "  /login-legacy:", "  login-legacy:", 1))
+	c.Assert(err, qt.ErrorMatches, `invalid deprecations: endpoint path "login-legacy" does not start with /`)
+}
+
 func TestReadErrorNotFound(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
@@ -194,6 +555,75 @@ func TestReadErrorEmpty(t *testing.T) {
 	c.Assert(cfg, qt.IsNil)
 }
 
+func TestReadErrorOnboardingWithoutAgent(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	cfg, err := readConfig(c, strings.Replace(testConfig, "onboarding-agent: onboarder@candid\n", "", 1))
+	c.Assert(err, qt.ErrorMatches, "onboarding-agent must be set when onboarding-url is set")
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadCanonicalizesRelyingPartyRules(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	cfg, err := readConfig(c, strings.Replace(testConfig, "  rp.example.com:\n", "  RP.Example.com.:\n", 1))
+	c.Assert(err, qt.IsNil)
+	_, ok := cfg.RelyingPartyRules["rp.example.com"]
+	c.Assert(ok, qt.IsTrue)
+}
+
+func TestReadErrorRelyingPartyRuleWithPort(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	cfg, err := readConfig(c, strings.Replace(testConfig, "  rp.example.com:\n", "  rp.example.com:8443:\n", 1))
+	c.Assert(err, qt.ErrorMatches, `invalid relying-party-rules host "rp.example.com:8443": must be a host name without a port`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestReadCanonicalizesLocation(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	cfg, err := readConfig(c, strings.Replace(testConfig, "location: http://foo.com:1234", "location: HTTP://Foo.com:1234/candid/", 1))
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Location, qt.Equals, "http://foo.com:1234/candid")
+}
+
+func TestReadErrorInvalidLocation(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	cfg, err := readConfig(c, strings.Replace(testConfig, "location: http://foo.com:1234", "location: foo.com:1234", 1))
+	c.Assert(err, qt.ErrorMatches, `invalid location: "foo.com:1234" is not an absolute http or https URL`)
+	c.Assert(cfg, qt.IsNil)
+}
+
+func TestLoginClientRateLimitConfig(t *testing.T) {
+	c := qt.New(t)
+
+	var conf config.Config
+	c.Assert(conf.LoginClientRateLimitConfig(), qt.IsNil)
+
+	conf.LoginRateLimit = &ratelimit.Config{
+		RequestsPerMinute: 10,
+		Burst:             2,
+	}
+	c.Assert(conf.LoginClientRateLimitConfig(), qt.DeepEquals, &ratelimit.Config{
+		RequestsPerMinute: 50,
+		Burst:             10,
+	})
+
+	conf.LoginClientRateLimit = &ratelimit.Config{
+		RequestsPerMinute: 30,
+	}
+	c.Assert(conf.LoginClientRateLimitConfig(), qt.DeepEquals, &ratelimit.Config{
+		RequestsPerMinute: 30,
+	})
+}
+
 func TestReadErrorInvalidYAML(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
@@ -244,3 +674,11 @@ func testStorageBackend(unmarshal func(interface{}) error) (store.BackendFactory
 	}
 	return backend, nil
 }
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package device classifies the devices from which users log in so
+// that different policies can be applied to each class of device.
+package device
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Classes of device returned by DefaultClassifier.
+const (
+	Mobile  = "mobile"
+	Desktop = "desktop"
+)
+
+// A Classifier determines the class of device that is making a login
+// request.
+type Classifier interface {
+	// Classify returns the class of the device that made the given
+	// request. An empty string is returned if the device cannot be
+	// classified.
+	Classify(req *http.Request) string
+}
+
+// ClassifierFunc is a Classifier implemented as a function.
+type ClassifierFunc func(req *http.Request) string
+
+// Classify implements Classifier.Classify.
+func (f ClassifierFunc) Classify(req *http.Request) string {
+	return f(req)
+}
+
+// DefaultClassifier classifies devices as either Mobile or Desktop. The
+// Sec-CH-UA-Mobile client hint is used if the client supplied it,
+// otherwise the device is classified using the User-Agent header.
+// Requests with no User-Agent header are not classified.
+var DefaultClassifier Classifier = ClassifierFunc(defaultClassify)
+
+// mobileUserAgentTokens holds strings that indicate a mobile browser
+// when found in a User-Agent header.
+var mobileUserAgentTokens = []string{
+	"Mobi",
+	"Android",
+	"iPhone",
+	"iPad",
+	"iPod",
+}
+
+func defaultClassify(req *http.Request) string {
+	switch req.Header.Get("Sec-CH-UA-Mobile") {
+	case "?1":
+		return Mobile
+	case "?0":
+		return Desktop
+	}
+	ua := req.UserAgent()
+	if ua == "" {
+		return ""
+	}
+	for _, token := range mobileUserAgentTokens {
+		if strings.Contains(ua, token) {
+			return Mobile
+		}
+	}
+	return Desktop
+}
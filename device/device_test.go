@@ -0,0 +1,62 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package device_test
+
+import (
+	"net/http"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/device"
+)
+
+var classifyTests = []struct {
+	about       string
+	header      http.Header
+	expectClass string
+}{{
+	about: "no user agent",
+}, {
+	about: "mobile hint",
+	header: http.Header{
+		"Sec-Ch-Ua-Mobile": {"?1"},
+		"User-Agent":       {"Mozilla/5.0 (X11; Linux x86_64) Firefox/78.0"},
+	},
+	expectClass: device.Mobile,
+}, {
+	about: "desktop hint",
+	header: http.Header{
+		"Sec-Ch-Ua-Mobile": {"?0"},
+		"User-Agent":       {"Mozilla/5.0 (Linux; Android 10) Mobile Safari/537.36"},
+	},
+	expectClass: device.Desktop,
+}, {
+	about: "mobile user agent",
+	header: http.Header{
+		"User-Agent": {"Mozilla/5.0 (iPhone; CPU iPhone OS 13_5 like Mac OS X) Version/13.1.1 Mobile/15E148 Safari/604.1"},
+	},
+	expectClass: device.Mobile,
+}, {
+	about: "desktop user agent",
+	header: http.Header{
+		"User-Agent": {"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:78.0) Gecko/20100101 Firefox/78.0"},
+	},
+	expectClass: device.Desktop,
+}}
+
+func TestDefaultClassifier(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range classifyTests {
+		c.Run(test.about, func(c *qt.C) {
+			req, err := http.NewRequest("GET", "/login", nil)
+			c.Assert(err, qt.IsNil)
+			req.Header = test.header
+			if req.Header == nil {
+				req.Header = make(http.Header)
+			}
+			c.Assert(device.DefaultClassifier.Classify(req), qt.Equals, test.expectClass)
+		})
+	}
+}
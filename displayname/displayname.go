@@ -0,0 +1,142 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package displayname provides support for requiring the display names
+// of identities to be unique.
+package displayname
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// batchSize holds the number of identities read from the store at a
+// time when searching all identities.
+var batchSize = 100
+
+// Params holds how display names are normalized before they are
+// compared. Two display names conflict if they are the same after
+// normalization.
+type Params struct {
+	// TrimSpace is set if leading and trailing white space is
+	// ignored.
+	TrimSpace bool `yaml:"trim-space"`
+
+	// CaseInsensitive is set if differences in case are ignored.
+	CaseInsensitive bool `yaml:"case-insensitive"`
+}
+
+// Normalize returns the normalized form of the given display name.
+func (p Params) Normalize(name string) string {
+	if p.TrimSpace {
+		name = strings.TrimSpace(name)
+	}
+	if p.CaseInsensitive {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// FindConflict returns the username of an identity, other than the
+// identity with the given ID, whose display name is the same as the
+// given name after normalization. If there is no such identity an
+// empty string is returned.
+func FindConflict(ctx context.Context, st store.Store, p Params, name string, id string) (string, error) {
+	name = p.Normalize(name)
+	// Display names that are the same after normalization are also
+	// the same after folding, so only the identities with the same
+	// folded name need to be compared. When there is no
+	// normalization the store can make the comparison itself.
+	var filter store.Filter
+	limit := 0
+	if p == (Params{}) {
+		filter[store.Name] = store.Equal
+		limit = 2
+	} else {
+		filter[store.FoldedName] = store.Equal
+	}
+	ids, err := st.FindIdentities(ctx, &store.Identity{Name: name}, filter, nil, 0, limit)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	for _, identity := range ids {
+		if identity.ID != id && p.Normalize(identity.Name) == name {
+			return identity.Username, nil
+		}
+	}
+	return "", nil
+}
+
+// A Duplicate holds a display name that is shared by more than one
+// identity.
+type Duplicate struct {
+	// Name holds the normalized display name.
+	Name string
+
+	// Usernames holds the usernames of the identities with the
+	// display name, in username order.
+	Usernames []string
+}
+
+// Duplicates returns all the display names in the given store that are
+// shared by more than one identity after normalization, in order of
+// normalized name. Identities without a display name are ignored. This
+// can be used to find the identities that need to be changed before
+// unique display names are enforced.
+func Duplicates(ctx context.Context, st store.Store, p Params) ([]Duplicate, error) {
+	usernames := make(map[string][]string)
+	err := forEach(ctx, st, func(identity *store.Identity) bool {
+		if name := p.Normalize(identity.Name); name != "" {
+			usernames[name] = append(usernames[name], identity.Username)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var duplicates []Duplicate
+	for name, us := range usernames {
+		if len(us) < 2 {
+			continue
+		}
+		duplicates = append(duplicates, Duplicate{
+			Name:      name,
+			Usernames: us,
+		})
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i].Name < duplicates[j].Name
+	})
+	return duplicates, nil
+}
+
+// forEach calls f for every identity in the given store, in username
+// order, until f returns false. Identities are read from the store in
+// batches so the memory used does not depend on the number of
+// identities.
+func forEach(ctx context.Context, st store.Store, f func(*store.Identity) bool) error {
+	var ref store.Identity
+	var filter store.Filter
+	sort := []store.Sort{{Field: store.Username}}
+	for {
+		ids, err := st.FindIdentities(ctx, &ref, filter, sort, 0, batchSize)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for i := range ids {
+			if !f(&ids[i]) {
+				return nil
+			}
+		}
+		if len(ids) < batchSize {
+			return nil
+		}
+		ref.Username = ids[len(ids)-1].Username
+		filter[store.Username] = store.GreaterThan
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package displayname_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/displayname"
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/memstore"
+)
+
+var normalizeTests = []struct {
+	params displayname.Params
+	name   string
+	expect string
+}{{
+	name:   " Bob Smith ",
+	expect: " Bob Smith ",
+}, {
+	params: displayname.Params{TrimSpace: true},
+	name:   " Bob Smith ",
+	expect: "Bob Smith",
+}, {
+	params: displayname.Params{CaseInsensitive: true},
+	name:   " Bob Smith ",
+	expect: " bob smith ",
+}, {
+	params: displayname.Params{TrimSpace: true, CaseInsensitive: true},
+	name:   " Bob Smith ",
+	expect: "bob smith",
+}}
+
+func TestNormalize(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range normalizeTests {
+		c.Check(test.params.Normalize(test.name), qt.Equals, test.expect)
+	}
+}
+
+func newStore(c *qt.C, names map[string]string) store.Store {
+	st := memstore.NewStore()
+	for username, name := range names {
+		err := st.UpdateIdentity(context.Background(), &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", username),
+			Username:   username,
+			Name:       name,
+		}, store.Update{
+			store.Username: store.Set,
+			store.Name:     store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	return st
+}
+
+func TestFindConflict(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := newStore(c, map[string]string{
+		"alice": "Alice",
+		"bob":   "Bob",
+	})
+	bob := store.Identity{Username: "bob"}
+	err := st.Identity(ctx, &bob)
+	c.Assert(err, qt.IsNil)
+
+	username, err := displayname.FindConflict(ctx, st, displayname.Params{}, "Bob", "")
+	c.Assert(err, qt.IsNil)
+	c.Assert(username, qt.Equals, "bob")
+
+	// An identity does not conflict with itself.
+	username, err = displayname.FindConflict(ctx, st, displayname.Params{}, "Bob", bob.ID)
+	c.Assert(err, qt.IsNil)
+	c.Assert(username, qt.Equals, "")
+
+	username, err = displayname.FindConflict(ctx, st, displayname.Params{}, "bob", "")
+	c.Assert(err, qt.IsNil)
+	c.Assert(username, qt.Equals, "")
+
+	username, err = displayname.FindConflict(ctx, st, displayname.Params{CaseInsensitive: true}, "bob", "")
+	c.Assert(err, qt.IsNil)
+	c.Assert(username, qt.Equals, "bob")
+}
+
+func TestDuplicates(t *testing.T) {
+	c := qt.New(t)
+	c.Patch(displayname.BatchSize, 2)
+	ctx := context.Background()
+	names := map[string]string{
+		"alice":  "Alice",
+		"alice2": "alice ",
+		"bob":    "Bob",
+		"bob2":   "Bob",
+		"empty1": "",
+		"empty2": "",
+	}
+	for i := 0; i < 5; i++ {
+		names[fmt.Sprintf("user%d", i)] = fmt.Sprintf("User %d", i)
+	}
+	st := newStore(c, names)
+
+	duplicates, err := displayname.Duplicates(ctx, st, displayname.Params{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(duplicates, qt.DeepEquals, []displayname.Duplicate{{
+		Name:      "Bob",
+		Usernames: []string{"bob", "bob2"},
+	}})
+
+	duplicates, err = displayname.Duplicates(ctx, st, displayname.Params{
+		TrimSpace:       true,
+		CaseInsensitive: true,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(duplicates, qt.DeepEquals, []displayname.Duplicate{{
+		Name:      "alice",
+		Usernames: []string{"alice", "alice2"},
+	}, {
+		Name:      "bob",
+		Usernames: []string{"bob", "bob2"},
+	}})
+}
@@ -0,0 +1,547 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package events provides asynchronous delivery of identity events,
+// such as logins, to external consumers.
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/juju/utils/debugstatus"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/internal/monitoring"
+	"github.com/canonical/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.events")
+
+// Event types sent by the identity manager.
+const (
+	// Login is sent when a user completes an interactive login.
+	Login = "login"
+
+	// BreakGlass is sent whenever the break-glass credential is used
+	// to gain admin access.
+	BreakGlass = "break-glass"
+
+	// BreakGlassFailure is sent whenever an attempt to use the
+	// break-glass credential is rejected.
+	BreakGlassFailure = "break-glass-failure"
+)
+
+// An Event holds an event to be delivered to a Sink.
+type Event struct {
+	// Type holds the type of the event.
+	Type string `json:"type"`
+
+	// Time holds the time the event occurred.
+	Time time.Time `json:"time"`
+
+	// Username holds the username of the identity the event
+	// refers to.
+	Username string `json:"username,omitempty"`
+
+	// ProviderID holds the provider ID of the identity the event
+	// refers to.
+	ProviderID string `json:"provider-id,omitempty"`
+
+	// Data holds any additional event specific information.
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// A Sink delivers events to a consumer.
+type Sink interface {
+	// Send delivers the given event.
+	Send(ctx context.Context, e *Event) error
+}
+
+// Webhook is a Sink that POSTs each event as a JSON object to a URL.
+// Any response status other than 2xx is considered a failure.
+type Webhook struct {
+	// URL holds the URL to send events to.
+	URL string
+
+	// Client holds the HTTP client to use to send events. If this
+	// is nil then http.DefaultClient will be used.
+	Client *http.Client
+}
+
+// Send implements Sink.Send.
+func (w *Webhook) Send(ctx context.Context, e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errgo.Notef(err, "cannot send event")
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errgo.Newf("cannot send event: unexpected status %q", resp.Status)
+	}
+	return nil
+}
+
+// An OverflowPolicy determines what happens when an event is
+// dispatched to a full queue.
+type OverflowPolicy string
+
+const (
+	// DropOldest discards the oldest queued event to make room for
+	// the new one.
+	DropOldest OverflowPolicy = "drop-oldest"
+
+	// DropNewest discards the new event.
+	DropNewest OverflowPolicy = "drop-newest"
+
+	// Block waits for room in the queue, up to the configured block
+	// timeout, before discarding the new event.
+	Block OverflowPolicy = "block"
+)
+
+// Validate checks that the policy is one of the known policies. The
+// empty policy is valid and is equivalent to DropOldest.
+func (p OverflowPolicy) Validate() error {
+	switch p {
+	case "", DropOldest, DropNewest, Block:
+		return nil
+	}
+	return errgo.Newf("invalid overflow policy %q", p)
+}
+
+// DispatcherParams holds the parameters for a Dispatcher.
+type DispatcherParams struct {
+	// Sink holds the sink that events are delivered to.
+	Sink Sink
+
+	// Capacity holds the maximum number of events that can be
+	// queued waiting for delivery. If this is zero a capacity of
+	// 1000 is used.
+	Capacity int
+
+	// Overflow holds the policy applied when the queue is full. If
+	// this is empty DropOldest is used.
+	Overflow OverflowPolicy
+
+	// BlockTimeout holds the maximum time Dispatch will wait for
+	// room in the queue when the Overflow policy is Block. If this
+	// is zero a timeout of one second is used.
+	BlockTimeout time.Duration
+
+	// SendTimeout holds the maximum time allowed for the delivery
+	// of a single event. If this is zero a timeout of ten seconds
+	// is used.
+	SendTimeout time.Duration
+
+	// BreakerThreshold holds the number of consecutive delivery
+	// failures after which delivery is paused. If this is zero a
+	// threshold of 5 is used.
+	BreakerThreshold int
+
+	// BreakerTimeout holds the length of time for which delivery
+	// is paused once the BreakerThreshold has been reached. If
+	// this is zero a timeout of 30 seconds is used.
+	BreakerTimeout time.Duration
+
+	// Outbox, if set, holds the store used to hold the queue of
+	// events waiting for delivery. Events held in the
+	// outbox survive restarts, and failed deliveries are retried
+	// until they succeed or the event expires. If this is nil the
+	// queue is held in memory and events are discarded if their
+	// delivery fails.
+	Outbox store.OutboxStore
+
+	// RetryBackoff holds the time to wait before retrying the first
+	// failed delivery of an event held in the outbox. The wait
+	// doubles with each further failure, up to a maximum of ten
+	// minutes. If this is zero a backoff of one second is used.
+	RetryBackoff time.Duration
+
+	// MaxAge holds the length of time after which an event held in
+	// the outbox is discarded if it has not been delivered. If this
+	// is zero a maximum age of 24 hours is used.
+	MaxAge time.Duration
+
+	// PollInterval holds how often the outbox is checked for events
+	// that are due to be retried, and for delivered and expired
+	// events that can be purged. If this is zero an interval of ten
+	// seconds is used.
+	PollInterval time.Duration
+}
+
+// maxRetryBackoff holds the maximum time to wait before retrying the
+// delivery of an event held in the outbox.
+const maxRetryBackoff = 10 * time.Minute
+
+// A Dispatcher queues events and delivers them in the background to a
+// Sink. The queue is bounded, and persistent delivery failures pause
+// delivery so that a slow or unavailable consumer cannot affect the
+// rest of the service. If DispatcherParams.Outbox is set the queue is
+// held in the store instead of in memory. A nil Dispatcher discards all
+// events.
+type Dispatcher struct {
+	params  DispatcherParams
+	queue   chan Event
+	outbox  *outbox
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+
+	// mu protects the fields below it.
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	openUntil time.Time
+}
+
+// NewDispatcher creates a new Dispatcher and starts delivering
+// events. The Dispatcher should be closed when it is no longer
+// required.
+func NewDispatcher(p DispatcherParams) *Dispatcher {
+	if p.Capacity <= 0 {
+		p.Capacity = 1000
+	}
+	if p.Overflow == "" {
+		p.Overflow = DropOldest
+	}
+	if p.BlockTimeout <= 0 {
+		p.BlockTimeout = time.Second
+	}
+	if p.SendTimeout <= 0 {
+		p.SendTimeout = 10 * time.Second
+	}
+	if p.BreakerThreshold <= 0 {
+		p.BreakerThreshold = 5
+	}
+	if p.BreakerTimeout <= 0 {
+		p.BreakerTimeout = 30 * time.Second
+	}
+	if p.RetryBackoff <= 0 {
+		p.RetryBackoff = time.Second
+	}
+	if p.MaxAge <= 0 {
+		p.MaxAge = 24 * time.Hour
+	}
+	if p.PollInterval <= 0 {
+		p.PollInterval = 10 * time.Second
+	}
+	d := &Dispatcher{
+		params:  p,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if p.Outbox != nil {
+		d.outbox = &outbox{
+			store:    p.Outbox,
+			capacity: p.Capacity,
+			overflow: p.Overflow,
+		}
+		d.wake = make(chan struct{}, 1)
+		go d.runOutbox()
+		return d
+	}
+	d.queue = make(chan Event, p.Capacity)
+	go d.run()
+	return d
+}
+
+// Dispatch queues the given event for delivery. If the event has no
+// time then the current time is used. Dispatch never returns an error,
+// events that cannot be queued are counted and discarded.
+func (d *Dispatcher) Dispatch(e Event) {
+	if d == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if d.outbox != nil {
+		d.store(e)
+		return
+	}
+	select {
+	case <-d.done:
+		return
+	case d.queue <- e:
+		monitoring.EventQueueDepth(len(d.queue))
+		return
+	default:
+	}
+	switch d.params.Overflow {
+	case DropNewest:
+		d.drop(e, "queue full")
+	case Block:
+		t := time.NewTimer(d.params.BlockTimeout)
+		defer t.Stop()
+		select {
+		case d.queue <- e:
+			monitoring.EventQueueDepth(len(d.queue))
+		case <-t.C:
+			d.drop(e, "queue full")
+		case <-d.done:
+		}
+	default:
+		for {
+			select {
+			case d.queue <- e:
+				monitoring.EventQueueDepth(len(d.queue))
+				return
+			default:
+			}
+			select {
+			case old := <-d.queue:
+				d.drop(old, "queue full")
+			default:
+			}
+		}
+	}
+}
+
+// Ready returns an error if event delivery is currently paused
+// because of persistent delivery failures.
+func (d *Dispatcher) Ready() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.open {
+		return errgo.Newf("event delivery paused after %d consecutive failures", d.failures)
+	}
+	return nil
+}
+
+// CheckerFunc returns a debugstatus.CheckerFunc that reports the
+// state of event delivery.
+func (d *Dispatcher) CheckerFunc() debugstatus.CheckerFunc {
+	return func(context.Context) (key string, result debugstatus.CheckResult) {
+		result.Name = "Event delivery"
+		if err := d.Ready(); err != nil {
+			result.Value = err.Error()
+			return "event_delivery", result
+		}
+		result.Value = "delivering"
+		result.Passed = true
+		return "event_delivery", result
+	}
+}
+
+// Close stops the dispatcher. Any events that have not been delivered
+// are discarded, unless they are held in the outbox.
+func (d *Dispatcher) Close() {
+	if d == nil {
+		return
+	}
+	close(d.done)
+	<-d.stopped
+}
+
+// run delivers events from the queue until the dispatcher is closed.
+func (d *Dispatcher) run() {
+	defer close(d.stopped)
+	for {
+		if wait := d.pause(); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-d.done:
+				t.Stop()
+				return
+			}
+		}
+		select {
+		case e := <-d.queue:
+			monitoring.EventQueueDepth(len(d.queue))
+			d.deliver(e)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// deliver sends a single event from the in-memory queue to the sink.
+// Events that cannot be delivered are discarded.
+func (d *Dispatcher) deliver(e Event) {
+	if err := d.send(e); err != nil {
+		monitoring.EventDropped("delivery failed")
+	}
+}
+
+// send sends a single event to the sink, updating the circuit breaker
+// with the result.
+func (d *Dispatcher) send(e Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.params.SendTimeout)
+	defer cancel()
+	err := d.params.Sink.Send(ctx, &e)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		if d.open {
+			logger.Infof("event delivery resumed")
+		}
+		d.failures = 0
+		d.open = false
+		monitoring.EventDeliveryPaused(false)
+		return nil
+	}
+	d.failures++
+	logger.Warningf("cannot deliver %s event: %s", e.Type, err)
+	if d.failures >= d.params.BreakerThreshold {
+		if !d.open {
+			logger.Errorf("pausing event delivery after %d consecutive failures", d.failures)
+		}
+		d.open = true
+		d.openUntil = time.Now().Add(d.params.BreakerTimeout)
+		monitoring.EventDeliveryPaused(true)
+	}
+	return errgo.Mask(err, errgo.Any)
+}
+
+// store adds the given event to the outbox and wakes the delivery
+// loop.
+func (d *Dispatcher) store(e Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.params.SendTimeout)
+	defer cancel()
+	dropped, err := d.outbox.add(ctx, e, e.Time.Add(d.params.MaxAge))
+	if err != nil {
+		logger.Errorf("cannot store %s event: %s", e.Type, err)
+		d.drop(e, "store failed")
+		return
+	}
+	if dropped != nil {
+		d.drop(*dropped, "queue full")
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runOutbox delivers events from the outbox until the dispatcher is
+// closed.
+func (d *Dispatcher) runOutbox() {
+	defer close(d.stopped)
+	var lastReap time.Time
+	for {
+		select {
+		case <-d.done:
+			return
+		default:
+		}
+		if wait := d.pause(); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-d.done:
+				t.Stop()
+				return
+			}
+		}
+		now := time.Now()
+		if now.Sub(lastReap) >= d.params.PollInterval {
+			d.reap(now)
+			lastReap = now
+		}
+		if d.deliverNext(now) {
+			continue
+		}
+		t := time.NewTimer(d.params.PollInterval)
+		select {
+		case <-t.C:
+		case <-d.wake:
+			t.Stop()
+		case <-d.done:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// deliverNext delivers the next event in the outbox that is due for
+// delivery at the given time. Events that cannot be delivered are
+// scheduled to be retried. It returns false if no event was due.
+func (d *Dispatcher) deliverNext(now time.Time) bool {
+	ctx := context.Background()
+	// Lease the event for long enough to deliver it, so that other
+	// servers sharing the outbox do not deliver it too. If this
+	// server stops before the delivery is recorded the event will
+	// be delivered again once the lease expires.
+	ent, err := d.outbox.claim(ctx, now, 2*d.params.SendTimeout)
+	if err != nil {
+		logger.Errorf("cannot read event outbox: %s", err)
+		return false
+	}
+	if ent == nil {
+		return false
+	}
+	if err := d.send(ent.Event); err != nil {
+		if err := d.outbox.retry(ctx, ent, time.Now().Add(d.backoff(ent.Attempts))); err != nil {
+			logger.Errorf("cannot update event outbox: %s", err)
+		}
+		return true
+	}
+	if err := d.outbox.ack(ctx, ent.ID); err != nil {
+		logger.Errorf("cannot update event outbox: %s", err)
+	}
+	return true
+}
+
+// backoff returns the time to wait before retrying the delivery of an
+// event that has already failed the given number of times.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.params.RetryBackoff
+	for i := 0; i < attempts && wait < maxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxRetryBackoff {
+		wait = maxRetryBackoff
+	}
+	return wait
+}
+
+// reap purges expired events from the outbox.
+func (d *Dispatcher) reap(now time.Time) {
+	expired, err := d.outbox.reap(context.Background(), now)
+	if err != nil {
+		logger.Errorf("cannot purge event outbox: %s", err)
+		return
+	}
+	for _, e := range expired {
+		d.drop(e, "expired")
+	}
+}
+
+// pause returns the length of time for which delivery should be
+// paused.
+func (d *Dispatcher) pause() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.open {
+		return 0
+	}
+	return time.Until(d.openUntil)
+}
+
+// drop records that the given event has been discarded.
+func (d *Dispatcher) drop(e Event, reason string) {
+	logger.Debugf("discarding %s event: %s", e.Type, reason)
+	monitoring.EventDropped(reason)
+}
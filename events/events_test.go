@@ -0,0 +1,193 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package events_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/events"
+)
+
+// testSink is a Sink that records the events it receives. If release
+// is non-nil each send waits for, and returns, a value received from
+// it.
+type testSink struct {
+	release chan error
+
+	mu      sync.Mutex
+	waiting int
+	events  []string
+}
+
+func (s *testSink) Send(ctx context.Context, e *events.Event) error {
+	var err error
+	if s.release != nil {
+		s.mu.Lock()
+		s.waiting++
+		s.mu.Unlock()
+		err = <-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.events = append(s.events, e.Username)
+	}
+	return err
+}
+
+func (s *testSink) numWaiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiting
+}
+
+func (s *testSink) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.events...)
+}
+
+func waitFor(c *qt.C, f func() bool) {
+	for i := 0; i < 200; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for condition")
+}
+
+func TestDispatch(t *testing.T) {
+	c := qt.New(t)
+	sink := &testSink{}
+	d := events.NewDispatcher(events.DispatcherParams{Sink: sink})
+	defer d.Close()
+	d.Dispatch(events.Event{Type: events.Login, Username: "bob"})
+	d.Dispatch(events.Event{Type: events.Login, Username: "alice"})
+	waitFor(c, func() bool { return len(sink.received()) == 2 })
+	c.Assert(sink.received(), qt.DeepEquals, []string{"bob", "alice"})
+}
+
+var overflowTests = []struct {
+	policy       events.OverflowPolicy
+	expectEvents []string
+}{{
+	policy:       events.DropOldest,
+	expectEvents: []string{"0", "3", "4"},
+}, {
+	policy:       events.DropNewest,
+	expectEvents: []string{"0", "1", "2"},
+}, {
+	policy:       events.Block,
+	expectEvents: []string{"0", "1", "2"},
+}}
+
+func TestOverflow(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range overflowTests {
+		c.Run(string(test.policy), func(c *qt.C) {
+			sink := &testSink{release: make(chan error)}
+			d := events.NewDispatcher(events.DispatcherParams{
+				Sink:         sink,
+				Capacity:     2,
+				Overflow:     test.policy,
+				BlockTimeout: 10 * time.Millisecond,
+			})
+			defer d.Close()
+			// The first event is taken off the queue and blocks
+			// in the sink, leaving the queue empty.
+			d.Dispatch(events.Event{Username: "0"})
+			waitFor(c, func() bool { return sink.numWaiting() == 1 })
+			for _, u := range []string{"1", "2", "3", "4"} {
+				d.Dispatch(events.Event{Username: u})
+			}
+			close(sink.release)
+			waitFor(c, func() bool { return len(sink.received()) == 3 })
+			time.Sleep(10 * time.Millisecond)
+			c.Assert(sink.received(), qt.DeepEquals, test.expectEvents)
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	c := qt.New(t)
+	release := make(chan error, 10)
+	sink := &testSink{release: release}
+	d := events.NewDispatcher(events.DispatcherParams{
+		Sink:             sink,
+		BreakerThreshold: 2,
+		BreakerTimeout:   50 * time.Millisecond,
+	})
+	defer d.Close()
+	c.Assert(d.Ready(), qt.IsNil)
+	release <- errgo.New("failure 1")
+	release <- errgo.New("failure 2")
+	d.Dispatch(events.Event{Username: "1"})
+	d.Dispatch(events.Event{Username: "2"})
+	waitFor(c, func() bool { return d.Ready() != nil })
+	c.Assert(d.Ready(), qt.ErrorMatches, `event delivery paused after 2 consecutive failures`)
+	_, result := d.CheckerFunc()(context.Background())
+	c.Assert(result.Passed, qt.Equals, false)
+
+	// Delivery resumes after the breaker timeout.
+	release <- nil
+	d.Dispatch(events.Event{Username: "3"})
+	waitFor(c, func() bool { return len(sink.received()) == 1 })
+	c.Assert(sink.received(), qt.DeepEquals, []string{"3"})
+	c.Assert(d.Ready(), qt.IsNil)
+	_, result = d.CheckerFunc()(context.Background())
+	c.Assert(result.Passed, qt.Equals, true)
+}
+
+func TestNilDispatcher(t *testing.T) {
+	c := qt.New(t)
+	var d *events.Dispatcher
+	d.Dispatch(events.Event{Type: events.Login})
+	c.Assert(d.Ready(), qt.IsNil)
+	d.Close()
+}
+
+func TestOverflowPolicyValidate(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(events.OverflowPolicy("").Validate(), qt.IsNil)
+	c.Assert(events.Block.Validate(), qt.IsNil)
+	c.Assert(events.OverflowPolicy("drop-all").Validate(), qt.ErrorMatches, `invalid overflow policy "drop-all"`)
+}
+
+func TestWebhook(t *testing.T) {
+	c := qt.New(t)
+	var received events.Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, qt.Equals, "POST")
+		c.Check(req.Header.Get("Content-Type"), qt.Equals, "application/json")
+		err := json.NewDecoder(req.Body).Decode(&received)
+		c.Check(err, qt.IsNil)
+		if received.Username == "fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	w := &events.Webhook{URL: srv.URL}
+	err := w.Send(context.Background(), &events.Event{
+		Type:     events.Login,
+		Username: "bob",
+		Data:     map[string]string{"idp": "test"},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(received.Type, qt.Equals, events.Login)
+	c.Assert(received.Username, qt.Equals, "bob")
+	c.Assert(received.Data, qt.DeepEquals, map[string]string{"idp": "test"})
+
+	err = w.Send(context.Background(), &events.Event{Username: "fail"})
+	c.Assert(err, qt.ErrorMatches, `cannot send event: unexpected status "503 Service Unavailable"`)
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/canonical/candid/store"
+)
+
+// OutboxUsernames returns the usernames of the events held in the
+// given outbox store, oldest first. The messages are read by removing
+// them and then adding them back in the same order, so this must not
+// be called while a dispatcher is using the store.
+func OutboxUsernames(s store.OutboxStore) ([]string, error) {
+	ctx := context.Background()
+	var ms []store.OutboxMessage
+	for {
+		m, err := s.RemoveOldest(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			break
+		}
+		ms = append(ms, *m)
+	}
+	var usernames []string
+	for i := range ms {
+		var e Event
+		if err := json.Unmarshal(ms[i].Data, &e); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, e.Username)
+		if err := s.Add(ctx, &ms[i]); err != nil {
+			return nil, err
+		}
+	}
+	return usernames, nil
+}
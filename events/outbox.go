@@ -0,0 +1,147 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// An outboxEntry is an event waiting for delivery.
+type outboxEntry struct {
+	// ID identifies the entry within the outbox.
+	ID string
+
+	// Event holds the event to deliver.
+	Event Event
+
+	// Attempts holds the number of failed delivery attempts.
+	Attempts int
+}
+
+// An outbox is a durable queue of events held in a store.OutboxStore.
+// Each event is held as a separate message, so any number of servers
+// sharing the store can claim and remove events individually.
+type outbox struct {
+	store    store.OutboxStore
+	capacity int
+	overflow OverflowPolicy
+}
+
+// add adds the given event to the outbox, to be discarded if it has not
+// been delivered by the given expiry time. If the outbox is full the
+// overflow policy determines which event is discarded; the Block policy
+// cannot wait for room in a durable queue and so discards the new
+// event. The discarded event, if any, is returned.
+//
+// The capacity is checked before the event is added, so servers adding
+// events to the same outbox at the same time may briefly exceed it.
+func (o *outbox) add(ctx context.Context, e Event, expires time.Time) (*Event, error) {
+	n, err := o.store.Count(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var dropped *Event
+	if n >= o.capacity {
+		if o.overflow != DropOldest {
+			return &e, nil
+		}
+		m, err := o.store.RemoveOldest(ctx)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if m != nil {
+			ent, err := decodeEntry(m)
+			if err != nil {
+				logger.Errorf("cannot decode discarded event: %s", err)
+			} else {
+				dropped = &ent.Event
+			}
+		}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := o.store.Add(ctx, &store.OutboxMessage{
+		Data:    data,
+		Expires: expires,
+	}); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return dropped, nil
+}
+
+// claim returns the oldest unexpired entry that is due for delivery at
+// the given time, and leases it until now+lease. If no entry is due
+// claim returns nil.
+func (o *outbox) claim(ctx context.Context, now time.Time, lease time.Duration) (*outboxEntry, error) {
+	for {
+		m, err := o.store.Claim(ctx, now, now.Add(lease))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if m == nil {
+			return nil, nil
+		}
+		ent, err := decodeEntry(m)
+		if err == nil {
+			return ent, nil
+		}
+		// An event that cannot be decoded can never be
+		// delivered, so discard it and try the next one.
+		logger.Errorf("discarding undecodable event %s: %s", m.ID, err)
+		if err := o.store.Remove(ctx, m.ID); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+}
+
+// ack records that the entry with the given ID has been delivered by
+// removing it from the outbox.
+func (o *outbox) ack(ctx context.Context, id string) error {
+	return errgo.Mask(o.store.Remove(ctx, id))
+}
+
+// retry records a failed delivery of the given entry, which will next
+// be attempted at the given time.
+func (o *outbox) retry(ctx context.Context, ent *outboxEntry, next time.Time) error {
+	return errgo.Mask(o.store.Retry(ctx, ent.ID, ent.Attempts+1, next))
+}
+
+// reap removes all entries that have expired at the given time from
+// the outbox and returns their events.
+func (o *outbox) reap(ctx context.Context, now time.Time) ([]Event, error) {
+	ms, err := o.store.RemoveExpired(ctx, now)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	expired := make([]Event, 0, len(ms))
+	for i := range ms {
+		ent, err := decodeEntry(&ms[i])
+		if err != nil {
+			logger.Errorf("cannot decode expired event: %s", err)
+			continue
+		}
+		expired = append(expired, ent.Event)
+	}
+	return expired, nil
+}
+
+// decodeEntry decodes the outbox entry held in the given message.
+func decodeEntry(m *store.OutboxMessage) (*outboxEntry, error) {
+	ent := outboxEntry{
+		ID:       m.ID,
+		Attempts: m.Attempts,
+	}
+	if err := json.Unmarshal(m.Data, &ent.Event); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal event")
+	}
+	return &ent, nil
+}
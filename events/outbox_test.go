@@ -0,0 +1,170 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package events_test
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/events"
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/memstore"
+)
+
+// flakySink is a Sink that fails the given number of sends before
+// recording the events it receives.
+type flakySink struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	events   []string
+}
+
+func (s *flakySink) Send(ctx context.Context, e *events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.failures != 0 {
+		if s.failures > 0 {
+			s.failures--
+		}
+		return errgo.New("sink unavailable")
+	}
+	s.events = append(s.events, e.Username)
+	return nil
+}
+
+func (s *flakySink) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := append([]string(nil), s.events...)
+	sort.Strings(events)
+	return events
+}
+
+func (s *flakySink) numAttempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+func outboxEmpty(c *qt.C, s store.OutboxStore) func() bool {
+	return func() bool {
+		n, err := s.Count(context.Background())
+		c.Assert(err, qt.IsNil)
+		return n == 0
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	c := qt.New(t)
+	s := memstore.NewOutboxStore()
+
+	// The first dispatcher cannot deliver any events.
+	sink1 := &flakySink{failures: -1}
+	d1 := events.NewDispatcher(events.DispatcherParams{
+		Sink:         sink1,
+		Outbox:       s,
+		RetryBackoff: time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+	})
+	d1.Dispatch(events.Event{Type: events.Login, Username: "bob"})
+	d1.Dispatch(events.Event{Type: events.Login, Username: "alice"})
+	waitFor(c, func() bool { return sink1.numAttempts() >= 2 })
+	d1.Close()
+	usernames, err := events.OutboxUsernames(s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(usernames, qt.DeepEquals, []string{"bob", "alice"})
+
+	// A dispatcher started with the same store delivers the events
+	// persisted by the first.
+	sink2 := &flakySink{}
+	d2 := events.NewDispatcher(events.DispatcherParams{
+		Sink:         sink2,
+		Outbox:       s,
+		RetryBackoff: time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+	})
+	defer d2.Close()
+	waitFor(c, func() bool { return len(sink2.received()) == 2 })
+	c.Assert(sink2.received(), qt.DeepEquals, []string{"alice", "bob"})
+
+	// The delivered events are purged from the outbox.
+	waitFor(c, outboxEmpty(c, s))
+}
+
+func TestOutboxRetry(t *testing.T) {
+	c := qt.New(t)
+	s := memstore.NewOutboxStore()
+	sink := &flakySink{failures: 3}
+	d := events.NewDispatcher(events.DispatcherParams{
+		Sink:             sink,
+		Outbox:           s,
+		BreakerThreshold: 10,
+		RetryBackoff:     time.Millisecond,
+		PollInterval:     10 * time.Millisecond,
+	})
+	defer d.Close()
+	d.Dispatch(events.Event{Type: events.Login, Username: "bob"})
+	waitFor(c, func() bool { return len(sink.received()) == 1 })
+	c.Assert(sink.received(), qt.DeepEquals, []string{"bob"})
+	c.Assert(sink.numAttempts(), qt.Equals, 4)
+	waitFor(c, outboxEmpty(c, s))
+}
+
+func TestOutboxExpiry(t *testing.T) {
+	c := qt.New(t)
+	s := memstore.NewOutboxStore()
+	sink := &flakySink{}
+	d := events.NewDispatcher(events.DispatcherParams{
+		Sink:         sink,
+		Outbox:       s,
+		MaxAge:       time.Hour,
+		PollInterval: 10 * time.Millisecond,
+	})
+	defer d.Close()
+	// An event older than the maximum age is purged without being
+	// delivered.
+	d.Dispatch(events.Event{
+		Type:     events.Login,
+		Time:     time.Now().Add(-2 * time.Hour),
+		Username: "bob",
+	})
+	waitFor(c, outboxEmpty(c, s))
+	c.Assert(sink.numAttempts(), qt.Equals, 0)
+}
+
+func TestOutboxOverflow(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range overflowTests {
+		c.Run(string(test.policy), func(c *qt.C) {
+			s := memstore.NewOutboxStore()
+			sink := &flakySink{failures: -1}
+			d := events.NewDispatcher(events.DispatcherParams{
+				Sink:         sink,
+				Outbox:       s,
+				Capacity:     3,
+				Overflow:     test.policy,
+				RetryBackoff: time.Hour,
+			})
+			defer d.Close()
+			for _, u := range []string{"0", "1", "2", "3", "4"} {
+				d.Dispatch(events.Event{Username: u})
+			}
+			usernames, err := events.OutboxUsernames(s)
+			c.Assert(err, qt.IsNil)
+			expect := []string{"0", "1", "2"}
+			if test.policy == events.DropOldest {
+				expect = []string{"2", "3", "4"}
+			}
+			c.Assert(usernames, qt.DeepEquals, expect)
+		})
+	}
+}
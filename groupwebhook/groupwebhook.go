@@ -0,0 +1,228 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package groupwebhook provides a way for an external HTTP service to
+// supply the groups of a user when they log in.
+package groupwebhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/juju/utils/cache"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// Modes in which the groups returned by the webhook are combined with
+// the groups supplied by the identity provider.
+const (
+	ModeMerge   = "merge"
+	ModeReplace = "replace"
+)
+
+// DefaultTimeout is the timeout used for webhook requests when none
+// is configured.
+const DefaultTimeout = 10 * time.Second
+
+// Config holds the configuration of a group webhook.
+type Config struct {
+	// URL holds the URL of the webhook.
+	URL string `yaml:"url"`
+
+	// Mode holds how the returned groups are combined with the
+	// groups supplied by the identity provider, either "merge" or
+	// "replace". If this is empty "merge" is used.
+	Mode string `yaml:"mode"`
+
+	// Timeout holds the maximum time to wait for the webhook to
+	// respond. If this is zero DefaultTimeout is used.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// CacheTTL holds the length of time for which the groups
+	// returned for a user are remembered. If this is zero the
+	// webhook is called on every login.
+	CacheTTL time.Duration `yaml:"cache-ttl"`
+
+	// IdentityProviders holds the names of the identity providers
+	// whose logins the webhook is called for. If this is empty the
+	// webhook is called for logins with all identity providers.
+	IdentityProviders []string `yaml:"identity-providers"`
+}
+
+// Validate checks that the configuration is valid.
+func (c *Config) Validate() error {
+	if c.URL == "" {
+		return errgo.Newf("no url specified")
+	}
+	switch c.Mode {
+	case "", ModeMerge, ModeReplace:
+	default:
+		return errgo.Newf("invalid mode %q", c.Mode)
+	}
+	if c.Timeout < 0 {
+		return errgo.Newf("timeout must not be negative")
+	}
+	if c.CacheTTL < 0 {
+		return errgo.Newf("cache-ttl must not be negative")
+	}
+	return nil
+}
+
+// Request holds the information about a login that is sent to the
+// webhook.
+type Request struct {
+	Username   string   `json:"username"`
+	ProviderID string   `json:"provider-id"`
+	Groups     []string `json:"groups,omitempty"`
+}
+
+// Response holds the response expected from the webhook.
+type Response struct {
+	Groups []string `json:"groups"`
+}
+
+// A Resolver resolves the groups of users as they log in by calling a
+// webhook.
+type Resolver struct {
+	url     string
+	replace bool
+	timeout time.Duration
+	idps    map[string]bool
+	cache   *cache.Cache
+
+	// Client holds the HTTP client to use to contact the webhook. If
+	// this is nil then http.DefaultClient will be used.
+	Client *http.Client
+}
+
+// NewResolver returns a new Resolver using the given configuration.
+func NewResolver(c Config) (*Resolver, error) {
+	if err := c.Validate(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	r := &Resolver{
+		url:     c.URL,
+		replace: c.Mode == ModeReplace,
+		timeout: c.Timeout,
+	}
+	if r.timeout == 0 {
+		r.timeout = DefaultTimeout
+	}
+	if len(c.IdentityProviders) > 0 {
+		r.idps = make(map[string]bool)
+		for _, idp := range c.IdentityProviders {
+			r.idps[idp] = true
+		}
+	}
+	if c.CacheTTL > 0 {
+		r.cache = cache.New(c.CacheTTL)
+	}
+	return r, nil
+}
+
+// AppliesTo reports whether the resolver should be used for logins
+// with the identity provider with the given name. A nil Resolver
+// applies to no logins.
+func (r *Resolver) AppliesTo(idp string) bool {
+	if r == nil {
+		return false
+	}
+	return r.idps == nil || r.idps[idp]
+}
+
+// Replaces reports whether the groups returned by the webhook replace
+// those of users that log in with the identity provider with the given
+// name. When they do, the groups that the identity provider reports
+// should not be added to them. A nil Resolver replaces no groups.
+func (r *Resolver) Replaces(idp string) bool {
+	return r.AppliesTo(idp) && r.replace
+}
+
+// Groups returns the groups of the given identity, which has just
+// logged in, as determined by the webhook. Depending on the
+// configured mode the result either includes or replaces the groups
+// already held in the identity. If the webhook cannot be queried an
+// error is returned, callers should not allow the login to proceed.
+func (r *Resolver) Groups(ctx context.Context, id *store.Identity) ([]string, error) {
+	var groups []string
+	if r.cache != nil {
+		groups0, err := r.cache.Get(string(id.ProviderID), func() (interface{}, error) {
+			return r.query(ctx, id)
+		})
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		groups = groups0.([]string)
+	} else {
+		var err error
+		groups, err = r.query(ctx, id)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if r.replace {
+		return append([]string(nil), groups...), nil
+	}
+	return mergeGroups(id.Groups, groups), nil
+}
+
+// query calls the webhook to get the groups for the given identity.
+func (r *Resolver) query(ctx context.Context, id *store.Identity) ([]string, error) {
+	body, err := json.Marshal(Request{
+		Username:   id.Username,
+		ProviderID: string(id.ProviderID),
+		Groups:     id.Groups,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	req, err := http.NewRequest("POST", r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot query group webhook")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errgo.Newf("cannot query group webhook: unexpected status %q", resp.Status)
+	}
+	var result Response
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errgo.Notef(err, "cannot decode group webhook response")
+	}
+	if result.Groups == nil {
+		return nil, errgo.Newf("invalid group webhook response: no groups")
+	}
+	return result.Groups, nil
+}
+
+// mergeGroups returns the union of the given sets of groups, in the
+// order first seen.
+func mergeGroups(gs1, gs2 []string) []string {
+	seen := make(map[string]bool)
+	var groups []string
+	for _, gs := range [][]string{gs1, gs2} {
+		for _, g := range gs {
+			if seen[g] {
+				continue
+			}
+			seen[g] = true
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package groupwebhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/groupwebhook"
+	"github.com/canonical/candid/store"
+)
+
+// newWebhook starts a webhook server that returns the given groups for
+// every request, and counts the requests it receives.
+func newWebhook(c *qt.C, groups []string, calls *int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*calls++
+		c.Check(req.Method, qt.Equals, "POST")
+		var body groupwebhook.Request
+		err := json.NewDecoder(req.Body).Decode(&body)
+		c.Check(err, qt.IsNil)
+		c.Check(body.Username, qt.Equals, "bob")
+		c.Check(body.ProviderID, qt.Equals, "test:bob")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groupwebhook.Response{Groups: groups})
+	}))
+	c.Defer(srv.Close)
+	return srv
+}
+
+var testIdentity = store.Identity{
+	ProviderID: "test:bob",
+	Username:   "bob",
+	Groups:     []string{"idp-group"},
+}
+
+func TestGroupsMerge(t *testing.T) {
+	c := qt.New(t)
+	var calls int
+	srv := newWebhook(c, []string{"g1", "g2", "idp-group"}, &calls)
+	r, err := groupwebhook.NewResolver(groupwebhook.Config{
+		URL: srv.URL,
+	})
+	c.Assert(err, qt.IsNil)
+	id := testIdentity
+	groups, err := r.Groups(context.Background(), &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"idp-group", "g1", "g2"})
+	c.Assert(calls, qt.Equals, 1)
+
+	// Without a cache every login calls the webhook.
+	_, err = r.Groups(context.Background(), &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(calls, qt.Equals, 2)
+}
+
+func TestGroupsReplace(t *testing.T) {
+	c := qt.New(t)
+	var calls int
+	srv := newWebhook(c, []string{"g1", "g2"}, &calls)
+	r, err := groupwebhook.NewResolver(groupwebhook.Config{
+		URL:  srv.URL,
+		Mode: groupwebhook.ModeReplace,
+	})
+	c.Assert(err, qt.IsNil)
+	id := testIdentity
+	groups, err := r.Groups(context.Background(), &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1", "g2"})
+}
+
+func TestGroupsCache(t *testing.T) {
+	c := qt.New(t)
+	var calls int
+	srv := newWebhook(c, []string{"g1"}, &calls)
+	r, err := groupwebhook.NewResolver(groupwebhook.Config{
+		URL:      srv.URL,
+		CacheTTL: time.Minute,
+	})
+	c.Assert(err, qt.IsNil)
+	id := testIdentity
+	for i := 0; i < 2; i++ {
+		groups, err := r.Groups(context.Background(), &id)
+		c.Assert(err, qt.IsNil)
+		c.Assert(groups, qt.DeepEquals, []string{"idp-group", "g1"})
+	}
+	c.Assert(calls, qt.Equals, 1)
+}
+
+func TestGroupsError(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	r, err := groupwebhook.NewResolver(groupwebhook.Config{
+		URL:      srv.URL,
+		CacheTTL: time.Minute,
+	})
+	c.Assert(err, qt.IsNil)
+	id := testIdentity
+	_, err = r.Groups(context.Background(), &id)
+	c.Assert(err, qt.ErrorMatches, `cannot query group webhook: unexpected status "500 Internal Server Error"`)
+}
+
+func TestGroupsNoGroups(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	r, err := groupwebhook.NewResolver(groupwebhook.Config{
+		URL: srv.URL,
+	})
+	c.Assert(err, qt.IsNil)
+	id := testIdentity
+	_, err = r.Groups(context.Background(), &id)
+	c.Assert(err, qt.ErrorMatches, `invalid group webhook response: no groups`)
+}
+
+func TestGroupsTimeout(t *testing.T) {
+	c := qt.New(t)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-done:
+		case <-req.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+	r, err := groupwebhook.NewResolver(groupwebhook.Config{
+		URL:     srv.URL,
+		Timeout: 50 * time.Millisecond,
+	})
+	c.Assert(err, qt.IsNil)
+	id := testIdentity
+	_, err = r.Groups(context.Background(), &id)
+	c.Assert(err, qt.ErrorMatches, `cannot query group webhook: .*`)
+}
+
+func TestAppliesTo(t *testing.T) {
+	c := qt.New(t)
+	var r *groupwebhook.Resolver
+	c.Assert(r.AppliesTo("test"), qt.IsFalse)
+
+	r, err := groupwebhook.NewResolver(groupwebhook.Config{
+		URL: "http://example.com",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.AppliesTo("test"), qt.IsTrue)
+
+	r, err = groupwebhook.NewResolver(groupwebhook.Config{
+		URL:               "http://example.com",
+		IdentityProviders: []string{"ldap"},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.AppliesTo("test"), qt.IsFalse)
+	c.Assert(r.AppliesTo("ldap"), qt.IsTrue)
+}
+
+func TestReplaces(t *testing.T) {
+	c := qt.New(t)
+	var r *groupwebhook.Resolver
+	c.Assert(r.Replaces("test"), qt.IsFalse)
+
+	r, err := groupwebhook.NewResolver(groupwebhook.Config{
+		URL: "http://example.com",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.Replaces("test"), qt.IsFalse)
+
+	r, err = groupwebhook.NewResolver(groupwebhook.Config{
+		URL:               "http://example.com",
+		Mode:              groupwebhook.ModeReplace,
+		IdentityProviders: []string{"ldap"},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.Replaces("test"), qt.IsFalse)
+	c.Assert(r.Replaces("ldap"), qt.IsTrue)
+}
+
+var newResolverErrorTests = []struct {
+	about       string
+	config      groupwebhook.Config
+	expectError string
+}{{
+	about:       "no url",
+	expectError: `no url specified`,
+}, {
+	about: "invalid mode",
+	config: groupwebhook.Config{
+		URL:  "http://example.com",
+		Mode: "union",
+	},
+	expectError: `invalid mode "union"`,
+}, {
+	about: "negative timeout",
+	config: groupwebhook.Config{
+		URL:     "http://example.com",
+		Timeout: -time.Second,
+	},
+	expectError: `timeout must not be negative`,
+}}
+
+func TestNewResolverErrors(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range newResolverErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			_, err := groupwebhook.NewResolver(test.config)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
@@ -62,6 +62,16 @@ func (*identityProvider) Hidden() bool {
 	return false
 }
 
+// Category specifies that this identity provider is not grouped.
+func (*identityProvider) Category() string {
+	return ""
+}
+
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (*identityProvider) ConfigParams() (string, interface{}) {
+	return "agent", nil
+}
+
 // Init implements idp.IdentityProvider.Init by doing nothing.
 func (*identityProvider) Init(context.Context, idp.InitParams) error {
 	return errgo.New("agent login IDP no longer supported")
@@ -0,0 +1,386 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package candid contains an identity provider that delegates logins
+// to another Candid server, allowing identity providers to be chained.
+package candid
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon.v2"
+
+	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/candidclient/redirect"
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.idp.candid")
+
+// DefaultMaxChainLength holds the maximum number of Candid identity
+// providers a login may be delegated through when none is configured.
+const DefaultMaxChainLength = 3
+
+// chainStatePrefix is added to the state sent to the upstream server,
+// along with the number of Candid identity providers the login has
+// been delegated through, so that delegation loops can be detected.
+const chainStatePrefix = "candid-chain."
+
+func init() {
+	idp.Register("candid", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
+		var p Params
+		if err := unmarshal(&p); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal candid parameters")
+		}
+		if p.Name == "" {
+			p.Name = "candid"
+		}
+		if p.URL == "" {
+			return nil, errgo.Newf("url not specified")
+		}
+		if p.MaxChainLength < 0 {
+			return nil, errgo.Newf("max-chain-length must not be negative")
+		}
+		if err := checkDomain(p.Domain); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return NewIdentityProvider(p), nil
+	})
+}
+
+type Params struct {
+	// Name is the name that will be given to the identity provider.
+	Name string `yaml:"name" redact:"show"`
+
+	// Description is the description of the IDP shown to the user on
+	// the IDP selection page. If this is not set then Name will be
+	// used.
+	Description string `yaml:"description" redact:"show"`
+
+	// Icon contains the URL or path of an icon.
+	Icon string `yaml:"icon" redact:"show"`
+
+	// Domain is the domain with which all identities created by this
+	// identity provider will be tagged (not including the @
+	// separator). The groups of the user on the upstream server are
+	// tagged with the same domain. It must be set, and must not be
+	// "candid".
+	Domain string `yaml:"domain" redact:"show"`
+
+	// URL is the location of the upstream Candid server. The
+	// callback URL of this identity provider must be in the
+	// redirect-login-whitelist of the upstream server.
+	URL string `yaml:"url" redact:"show"`
+
+	// MaxChainLength holds the maximum number of Candid identity
+	// providers a login may be delegated through, including this
+	// one, before it is assumed to be looping. If this is zero
+	// DefaultMaxChainLength is used.
+	MaxChainLength int `yaml:"max-chain-length" redact:"show"`
+
+	// Hidden is set if the IDP should be hidden from interactive
+	// prompts.
+	Hidden bool `yaml:"hidden" redact:"show"`
+
+	// Category is the category in which the IDP is grouped in
+	// interactive prompts.
+	Category string `yaml:"category" redact:"show"`
+
+	// StoreState is set if the state of each login is held in the
+	// identity provider's key-value store while the user is
+	// redirected to the upstream server, so that each callback can
+	// only be used once, see openid.OpenIDConnectParams.StoreState.
+	StoreState bool `yaml:"store-state" redact:"show"`
+}
+
+// NewIdentityProvider creates a new identity provider that delegates
+// logins to the Candid server at params.URL.
+func NewIdentityProvider(params Params) idp.IdentityProvider {
+	if params.Description == "" {
+		params.Description = params.Name
+	}
+	if params.MaxChainLength == 0 {
+		params.MaxChainLength = DefaultMaxChainLength
+	}
+	params.URL = strings.TrimSuffix(params.URL, "/")
+	return &identityProvider{
+		params: params,
+	}
+}
+
+type identityProvider struct {
+	params     Params
+	initParams idp.InitParams
+
+	// states holds the stored login states, if StoreState is set.
+	states *idputil.StateStore
+}
+
+// Name implements idp.IdentityProvider.Name.
+func (idp *identityProvider) Name() string {
+	return idp.params.Name
+}
+
+// Domain implements idp.IdentityProvider.Domain.
+func (idp *identityProvider) Domain() string {
+	return idp.params.Domain
+}
+
+// Description implements idp.IdentityProvider.Description.
+func (idp *identityProvider) Description() string {
+	return idp.params.Description
+}
+
+// IconURL returns the URL of an icon for the identity provider.
+func (idp *identityProvider) IconURL() string {
+	return idputil.ServiceURL(idp.initParams.Location, idp.params.Icon)
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*identityProvider) Interactive() bool {
+	return true
+}
+
+// Hidden implements idp.IdentityProvider.Hidden.
+func (idp *identityProvider) Hidden() bool {
+	return idp.params.Hidden
+}
+
+// Category implements idp.IdentityProvider.Category.
+func (idp *identityProvider) Category() string {
+	return idp.params.Category
+}
+
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (idp *identityProvider) ConfigParams() (string, interface{}) {
+	return "candid", idp.params
+}
+
+// Init implements idp.IdentityProvider.Init.
+func (idp *identityProvider) Init(ctx context.Context, params idp.InitParams) error {
+	if params.Location != "" && idp.params.URL == strings.TrimSuffix(params.Location, "/") {
+		return errgo.Newf("cannot delegate logins to %s: that is this server", idp.params.URL)
+	}
+	if err := checkDomain(idp.params.Domain); err != nil {
+		return errgo.Mask(err)
+	}
+	idp.initParams = params
+	if idp.params.StoreState {
+		idp.states = idputil.NewStateStore(params.KeyValueStore, 0, params.TokenGenerator)
+	}
+	return nil
+}
+
+// checkDomain checks that the given domain may be used for the
+// identities created by the identity provider. A domain is required so
+// that upstream users and groups, such as "admin", cannot be imported
+// unqualified, and the "candid" domain is reserved for identities
+// created by this server.
+func checkDomain(domain string) error {
+	switch domain {
+	case "":
+		return errgo.Newf("domain not specified")
+	case "candid":
+		return errgo.Newf("domain %q is reserved", domain)
+	}
+	return nil
+}
+
+// URL implements idp.IdentityProvider.URL.
+func (idp *identityProvider) URL(state string) string {
+	return idputil.RedirectURL(idp.initParams.URLPrefix, "/login", state)
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
+func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups by returning the
+// groups the user had on the upstream server when they last logged
+// in.
+func (*identityProvider) GetGroups(_ context.Context, id *store.Identity) ([]string, error) {
+	groups := make([]string, len(id.ProviderInfo["groups"]))
+	copy(groups, id.ProviderInfo["groups"])
+	return groups, nil
+}
+
+// Handle implements idp.IdentityProvider.Handle.
+func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	_, state := parseChainState(req.Form.Get("state"))
+	path := strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix)
+	cookieName := idputil.LoginStateCookieName(idp.initParams.CookieNamePrefix)
+	var ls *idputil.LoginState
+	var err error
+	if path == "/callback" && idp.states != nil {
+		ls, err = idp.states.TakeLogin(ctx, req, idp.initParams.Codec, cookieName, state, nil)
+	} else {
+		ls = new(idputil.LoginState)
+		err = idp.initParams.Codec.Cookie(req, cookieName, state, ls)
+	}
+	if err != nil {
+		logger.Infof("Invalid login state: %s", err)
+		idputil.BadRequestf(w, "Login failed: invalid login state")
+		return
+	}
+	switch path {
+	case "/callback":
+		if err := idp.callback(ctx, w, req, *ls); err != nil {
+			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		}
+	default:
+		idp.login(ctx, w, req, *ls)
+	}
+}
+
+// login starts a login by redirecting to the upstream server.
+func (idp *identityProvider) login(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) {
+	// If this login was itself delegated by a Candid identity
+	// provider the login state will record how many times the login
+	// has already been delegated.
+	hops, _ := parseChainState(ls.State)
+	hops++
+	if hops > idp.params.MaxChainLength {
+		logger.Warningf("login delegated through more than %d candid identity providers", idp.params.MaxChainLength)
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, errgo.WithCausef(nil, params.ErrForbidden, "login delegated through too many identity providers, check for a delegation loop"))
+		return
+	}
+	state := idputil.State(req)
+	if idp.states != nil {
+		var err error
+		state, err = idp.states.PutLogin(ctx, state, nil)
+		if err != nil {
+			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, errgo.Notef(err, "cannot store login state"))
+			return
+		}
+	}
+	u := idp.interactionInfo().RedirectURL(idputil.LocationURL(idp.initParams.URLPrefix, "/callback"), chainState(hops, state))
+	http.Redirect(w, req, u, http.StatusFound)
+}
+
+// callback completes a login when the upstream server redirects back.
+func (idp *identityProvider) callback(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) error {
+	_, code, err := redirect.ParseLoginResult(req.URL.String())
+	if err != nil {
+		return errgo.NoteMask(err, "upstream login failed", errgo.Any)
+	}
+	dt, err := idp.interactionInfo().GetDischargeToken(ctx, idputil.LocationURL(idp.initParams.URLPrefix, "/callback"), code)
+	if err != nil {
+		return errgo.Notef(err, "cannot get discharge token")
+	}
+	id, err := idp.upstreamIdentity(ctx, dt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := idp.initParams.Store.UpdateIdentity(ctx, id, store.Update{
+		store.Username:     store.Set,
+		store.Name:         store.Set,
+		store.Email:        store.Set,
+		store.ProviderInfo: store.Set,
+	}); err != nil {
+		return errgo.Mask(err)
+	}
+	idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, id)
+	return nil
+}
+
+// upstreamIdentity uses the given discharge token, obtained from the
+// upstream server, to retrieve the details of the user from the
+// upstream server. It returns the local identity for the user.
+func (idp *identityProvider) upstreamIdentity(ctx context.Context, dt *httpbakery.DischargeToken) (*store.Identity, error) {
+	if dt == nil || dt.Kind != "macaroon" {
+		return nil, errgo.Newf("unsupported discharge token")
+	}
+	var m macaroon.Macaroon
+	if err := m.UnmarshalBinary(dt.Value); err != nil {
+		return nil, errgo.Notef(err, "invalid discharge token")
+	}
+	cookie, err := httpbakery.NewCookie(nil, macaroon.Slice{&m})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	cookie.Path = "/"
+	u, err := url.Parse(idp.params.URL)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	bclient := httpbakery.NewClient()
+	bclient.Client.Jar.SetCookies(u, []*http.Cookie{cookie})
+	client, err := candidclient.New(candidclient.NewParams{
+		BaseURL: idp.params.URL,
+		Client:  bclient,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp, err := client.WhoAmI(ctx, &params.WhoAmIRequest{})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get upstream user")
+	}
+	username := params.Username(resp.User)
+	user, err := client.User(ctx, &params.UserRequest{
+		Username: username,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get upstream user")
+	}
+	groups, err := client.UserGroups(ctx, &params.UserGroupsRequest{
+		Username: username,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get upstream groups")
+	}
+	return &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, resp.User),
+		Username:   idputil.NameWithDomain(resp.User, idp.params.Domain),
+		Name:       user.FullName,
+		Email:      user.Email,
+		ProviderInfo: map[string][]string{
+			"groups": groups,
+		},
+	}, nil
+}
+
+// interactionInfo returns the redirect login endpoints of the upstream
+// server.
+func (idp *identityProvider) interactionInfo() redirect.InteractionInfo {
+	return redirect.InteractionInfo{
+		LoginURL:          idp.params.URL + "/login-redirect",
+		DischargeTokenURL: idp.params.URL + "/discharge-token",
+	}
+}
+
+// chainState returns the state to send to the upstream server for a
+// login that has been delegated through the given number of Candid
+// identity providers.
+func chainState(hops int, state string) string {
+	return chainStatePrefix + strconv.Itoa(hops) + "." + state
+}
+
+// parseChainState parses a state created by chainState, returning the
+// number of hops and the original state. If the state was not created
+// by chainState then the number of hops is zero and the state is
+// returned unchanged.
+func parseChainState(s string) (int, string) {
+	if !strings.HasPrefix(s, chainStatePrefix) {
+		return 0, s
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, chainStatePrefix), ".", 2)
+	if len(parts) != 2 {
+		return 0, s
+	}
+	hops, err := strconv.Atoi(parts[0])
+	if err != nil || hops < 0 {
+		return 0, s
+	}
+	return hops, parts[1]
+}
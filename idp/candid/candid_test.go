@@ -0,0 +1,150 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package candid_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/candid"
+	"github.com/canonical/candid/idp/idptest"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/idp/static"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/internal/v1"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+const idpPrefix = "https://idp.example.com"
+
+type candidSuite struct {
+	idptest  *idptest.Fixture
+	upstream *candidtest.Server
+}
+
+func TestCandid(t *testing.T) {
+	qtsuite.Run(qt.New(t), &candidSuite{})
+}
+
+func (s *candidSuite) Init(c *qt.C) {
+	s.idptest = idptest.NewFixture(c, candidtest.NewStore())
+
+	sp := candidtest.NewStore().ServerParams()
+	sp.RedirectLoginWhitelist = []string{
+		idpPrefix + "/callback",
+	}
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"bob": {
+			Password: "bobpassword",
+			Name:     "Bob Upstream",
+			Email:    "bob@example.com",
+			Groups:   []string{"g1", "g2"},
+		},
+	}))
+	s.upstream = candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+}
+
+func (s *candidSuite) setupIdp(c *qt.C, p candid.Params) idp.IdentityProvider {
+	i := candid.NewIdentityProvider(p)
+	err := i.Init(context.Background(), s.idptest.InitParams(c, idpPrefix))
+	c.Assert(err, qt.IsNil)
+	return i
+}
+
+func (s *candidSuite) TestName(c *qt.C) {
+	i := candid.NewIdentityProvider(candid.Params{Name: "upstream"})
+	c.Assert(i.Name(), qt.Equals, "upstream")
+	c.Assert(i.Description(), qt.Equals, "upstream")
+	c.Assert(i.Interactive(), qt.Equals, true)
+}
+
+func (s *candidSuite) TestHandle(c *qt.C) {
+	i := s.setupIdp(c, candid.Params{
+		Name:   "upstream",
+		Domain: "up",
+		URL:    s.upstream.URL,
+	})
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.SelectInteractiveLogin(candidtest.PostLoginForm("bob", "bobpassword")))
+	c.Assert(err, qt.IsNil)
+	expect := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("upstream", "bob"),
+		Username:   "bob@up",
+		Name:       "Bob Upstream",
+		Email:      "bob@example.com",
+		ProviderInfo: map[string][]string{
+			"groups": {"g1", "g2"},
+		},
+	}
+	candidtest.AssertEqualIdentity(c, id, expect)
+	s.idptest.Store.AssertUser(c, expect)
+
+	groups, err := i.GetGroups(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1", "g2"})
+}
+
+func (s *candidSuite) TestDelegationLoop(c *qt.C) {
+	i := s.setupIdp(c, candid.Params{
+		Name:           "upstream",
+		Domain:         "up",
+		URL:            s.upstream.URL,
+		MaxChainLength: 2,
+	})
+	// A login state that has already been delegated twice by
+	// Candid identity providers.
+	cookie, state := s.idptest.LoginState(c, idputil.LoginState{
+		ReturnTo: "http://result.example.com/callback",
+		State:    "candid-chain.2.1234",
+		Expires:  time.Now().Add(10 * time.Minute),
+	})
+	req := httptest.NewRequest("GET", idpPrefix+"/login?state="+state, nil)
+	req.AddCookie(cookie)
+	req.ParseForm()
+	rr := httptest.NewRecorder()
+	i.Handle(s.idptest.Ctx, rr, req)
+	resp := rr.Result()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+	_, err := s.idptest.ParseResponse(c, resp)
+	c.Assert(err, qt.ErrorMatches, `login delegated through too many identity providers, check for a delegation loop`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+}
+
+func (s *candidSuite) TestInitSelf(c *qt.C) {
+	i := candid.NewIdentityProvider(candid.Params{
+		Name: "upstream",
+		URL:  "https://candid.example.com/",
+	})
+	err := i.Init(context.Background(), idp.InitParams{
+		Location: "https://candid.example.com",
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot delegate logins to https://candid.example.com: that is this server`)
+}
+
+func (s *candidSuite) TestInitDomain(c *qt.C) {
+	for _, domain := range []string{"", "candid"} {
+		i := candid.NewIdentityProvider(candid.Params{
+			Name:   "upstream",
+			Domain: domain,
+			URL:    "https://candid.example.com/",
+		})
+		err := i.Init(context.Background(), idp.InitParams{
+			Location: "https://downstream.example.com",
+		})
+		c.Assert(err, qt.ErrorMatches, `domain not specified|domain "candid" is reserved`)
+	}
+}
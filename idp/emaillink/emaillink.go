@@ -0,0 +1,480 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package emaillink contains an identity provider that logs users in
+// by sending them an email containing a single-use login link.
+package emaillink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/internal/auth/httpauth"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+var logger = loggo.GetLogger("candid.idp.emaillink")
+
+const (
+	// defaultLinkTimeout holds the length of time for which a login
+	// link is valid if no timeout has been configured.
+	defaultLinkTimeout = 15 * time.Minute
+
+	// defaultSubject holds the subject of the login emails if none
+	// has been configured.
+	defaultSubject = "Your login link"
+)
+
+func init() {
+	idp.Register("email-link", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
+		var p Params
+		if err := unmarshal(&p); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal email-link parameters")
+		}
+		if p.Name == "" {
+			p.Name = "email"
+		}
+		if p.LinkTimeout < 0 {
+			return nil, errgo.Newf("link-timeout must not be negative")
+		}
+		var err error
+		p.Mailer, err = NewSMTPMailer(p.SMTP)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return NewIdentityProvider(p), nil
+	})
+}
+
+type Params struct {
+	// Name is the name that will be given to the identity provider.
+	Name string `yaml:"name" redact:"show"`
+
+	// Description is the description of the IDP shown to the user on
+	// the IDP selection page. If this is not set then Name will be
+	// used.
+	Description string `yaml:"description" redact:"show"`
+
+	// Icon contains the URL or path of an icon.
+	Icon string `yaml:"icon" redact:"show"`
+
+	// Hidden is set if the IDP should be hidden from interactive
+	// prompts.
+	Hidden bool `yaml:"hidden" redact:"show"`
+
+	// Category is the category in which the IDP is grouped in
+	// interactive prompts.
+	Category string `yaml:"category" redact:"show"`
+
+	// AllowedDomains holds the email domains from which users may
+	// log in. If this is empty users with any email address may log
+	// in.
+	AllowedDomains []string `yaml:"allowed-domains" redact:"show"`
+
+	// LinkTimeout holds the length of time for which a login link
+	// is valid. If this is zero a default of 15 minutes is used.
+	LinkTimeout time.Duration `yaml:"link-timeout" redact:"show"`
+
+	// Subject holds the subject of the login emails. If this is
+	// empty a default subject is used.
+	Subject string `yaml:"subject" redact:"show"`
+
+	// SMTP holds the parameters of the SMTP server used to send the
+	// login emails.
+	SMTP SMTPParams `yaml:"smtp" redact:"show"`
+
+	// Mailer holds the Mailer used to send the login emails. When
+	// the identity provider is created from a configuration file it
+	// is an SMTP mailer using the parameters in SMTP.
+	Mailer Mailer `yaml:"-"`
+}
+
+// NewIdentityProvider creates a new identity provider that logs users
+// in by sending them a login link using params.Mailer.
+func NewIdentityProvider(params Params) idp.IdentityProvider {
+	if params.Description == "" {
+		params.Description = params.Name
+	}
+	if params.LinkTimeout == 0 {
+		params.LinkTimeout = defaultLinkTimeout
+	}
+	if params.Subject == "" {
+		params.Subject = defaultSubject
+	}
+	for i, d := range params.AllowedDomains {
+		params.AllowedDomains[i] = strings.ToLower(d)
+	}
+	return &identityProvider{
+		params: params,
+	}
+}
+
+type identityProvider struct {
+	params     Params
+	initParams idp.InitParams
+}
+
+// Name implements idp.IdentityProvider.Name.
+func (idp *identityProvider) Name() string {
+	return idp.params.Name
+}
+
+// Domain implements idp.IdentityProvider.Domain. Users are identified
+// by their email addresses, so no domain is added to their usernames.
+func (*identityProvider) Domain() string {
+	return ""
+}
+
+// Description implements idp.IdentityProvider.Description.
+func (idp *identityProvider) Description() string {
+	return idp.params.Description
+}
+
+// IconURL returns the URL of an icon for the identity provider.
+func (idp *identityProvider) IconURL() string {
+	return idputil.ServiceURL(idp.initParams.Location, idp.params.Icon)
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*identityProvider) Interactive() bool {
+	return true
+}
+
+// Hidden implements idp.IdentityProvider.Hidden.
+func (idp *identityProvider) Hidden() bool {
+	return idp.params.Hidden
+}
+
+// Category implements idp.IdentityProvider.Category.
+func (idp *identityProvider) Category() string {
+	return idp.params.Category
+}
+
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (idp *identityProvider) ConfigParams() (string, interface{}) {
+	return "email-link", idp.params
+}
+
+// Init implements idp.IdentityProvider.Init.
+func (idp *identityProvider) Init(ctx context.Context, params idp.InitParams) error {
+	if idp.params.Mailer == nil {
+		return errgo.Newf("no mailer configured")
+	}
+	idp.initParams = params
+	return nil
+}
+
+// URL implements idp.IdentityProvider.URL.
+func (idp *identityProvider) URL(state string) string {
+	return idputil.RedirectURL(idp.initParams.URLPrefix, "/login", state)
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
+func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups. The identity
+// provider does not supply any groups.
+func (*identityProvider) GetGroups(context.Context, *store.Identity) ([]string, error) {
+	return []string{}, nil
+}
+
+// Handle implements idp.IdentityProvider.Handle.
+func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var ls idputil.LoginState
+	lsErr := idp.initParams.Codec.Cookie(req, idputil.LoginStateCookieName(idp.initParams.CookieNamePrefix), req.Form.Get("state"), &ls)
+	switch strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix) {
+	case "/login":
+		if lsErr != nil {
+			logger.Infof("Invalid login state: %s", lsErr)
+			idputil.BadRequestf(w, "Login failed: invalid login state")
+			return
+		}
+		switch req.Method {
+		case "GET":
+			idp.writeForm(w, req, "", "")
+		case "POST":
+			email, err := idp.sendLink(ctx, req, ls.WaitID)
+			if err != nil {
+				idp.writeForm(w, req, err.Error(), "")
+				return
+			}
+			idp.writeForm(w, req, "", email)
+		default:
+			idputil.BadRequestf(w, "unsupported method %q", req.Method)
+		}
+	case "/verify":
+		var t linkToken
+		if err := idp.initParams.Codec.Decode(req.Form.Get("token"), &t); err != nil {
+			// The invalid link is reported by verify.
+			t = linkToken{}
+		}
+		if lsErr != nil {
+			// The link has been followed in a different browser
+			// from the one that asked for it. The login can only
+			// be completed if it was started to satisfy a
+			// discharge wait, which is then resolved directly.
+			if t.WaitID == "" {
+				logger.Infof("Invalid login state: %s", lsErr)
+				idputil.BadRequestf(w, "Login failed: invalid login state")
+				return
+			}
+			id, err := idp.verify(ctx, t)
+			if err != nil {
+				idp.initParams.VisitCompleter.Failure(ctx, w, req, t.WaitID, err)
+				return
+			}
+			idp.initParams.VisitCompleter.Success(ctx, w, req, t.WaitID, id)
+			return
+		}
+		id, err := idp.verify(ctx, t)
+		if err != nil {
+			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+			return
+		}
+		idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, id)
+	}
+}
+
+// linkToken holds the contents of the token in a login link. The token
+// is encrypted with the server's key, so that it cannot be forged.
+type linkToken struct {
+	// Nonce identifies the link. It must match the nonce held in
+	// the pending login for the link to be used.
+	Nonce string `json:"nonce"`
+
+	// Email holds the email address to which the link was sent.
+	Email string `json:"email"`
+
+	// WaitID holds the ID of the discharge wait that the login
+	// completes, if any.
+	WaitID string `json:"wait-id,omitempty"`
+
+	// Expires holds the time at which the link expires.
+	Expires time.Time `json:"expires"`
+}
+
+// pendingLogin holds a login for which a link has been sent. It is
+// held in the key-value store until the link is used.
+type pendingLogin struct {
+	// Nonce holds the nonce of the most recent link sent for the
+	// login.
+	Nonce string `json:"nonce"`
+
+	// Email holds the email address to which the link was sent.
+	Email string `json:"email"`
+
+	// IP holds the address of the client that asked for the link.
+	// It is used to release the pending registration entry for the
+	// link, as the link may be followed from elsewhere.
+	IP string `json:"ip"`
+}
+
+// sendLink sends a login link to the email address in the given
+// request and returns the address. The link completes the discharge
+// wait with the given ID, if any.
+func (idp *identityProvider) sendLink(ctx context.Context, req *http.Request, waitID string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(req.Form.Get("email")))
+	if err != nil {
+		return "", errgo.WithCausef(nil, params.ErrBadRequest, "invalid email address")
+	}
+	email := strings.ToLower(addr.Address)
+	if !idp.domainAllowed(email) {
+		return "", errgo.WithCausef(nil, params.ErrForbidden, "cannot log in with an email address in that domain")
+	}
+	ip := idp.clientIP(req)
+	if err := idp.initParams.PendingRegistrations.Add(ctx, email, ip); err != nil {
+		return "", errgo.Mask(err, errgo.Is(params.ErrTooManyRequests))
+	}
+	if err := idp.mailLink(ctx, req, waitID, email, ip); err != nil {
+		// No usable link has been sent, so the attempt must not
+		// count against the pending registration limits.
+		idp.initParams.PendingRegistrations.Done(ctx, email, ip)
+		return "", errgo.Mask(err)
+	}
+	logger.Debugf("sent login link to %s", email)
+	return email, nil
+}
+
+// mailLink records a pending login for the given email address,
+// requested from the given client address, and emails a link that
+// completes it.
+func (idp *identityProvider) mailLink(ctx context.Context, req *http.Request, waitID, email, ip string) error {
+	nonce, err := idp.initParams.TokenGenerator.Generate()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	t := linkToken{
+		Nonce:   nonce,
+		Email:   email,
+		WaitID:  waitID,
+		Expires: time.Now().Add(idp.params.LinkTimeout),
+	}
+	var replaced pendingLogin
+	err = idp.initParams.KeyValueStore.Update(ctx, pendingKey(t), t.Expires, func(old []byte) ([]byte, error) {
+		replaced = pendingLogin{}
+		if len(old) > 0 {
+			if err := json.Unmarshal(old, &replaced); err != nil {
+				logger.Errorf("cannot unmarshal pending login: %s", err)
+			}
+		}
+		return json.Marshal(pendingLogin{
+			Nonce: nonce,
+			Email: email,
+			IP:    ip,
+		})
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if replaced.Email != "" {
+		// The previous link sent for the discharge wait can no
+		// longer be used.
+		idp.initParams.PendingRegistrations.Done(ctx, replaced.Email, replaced.IP)
+	}
+	token, err := idp.initParams.Codec.Encode(t)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	link := idputil.RedirectURL(idp.initParams.URLPrefix, "/verify", idputil.State(req)) + "&" + url.Values{"token": {token}}.Encode()
+	body := fmt.Sprintf("Follow the link below to log in. The link can only be used once and expires in %v.\n\n%s\n\nIf you did not ask to log in you can ignore this email.\n", idp.params.LinkTimeout, link)
+	if err := idp.params.Mailer.SendMail(ctx, email, idp.params.Subject, body); err != nil {
+		logger.Errorf("cannot send login link: %s", err)
+		// Discard the pending login so that it is not released
+		// again if it is replaced.
+		if err := idp.initParams.KeyValueStore.Set(ctx, pendingKey(t), []byte{}, t.Expires); err != nil {
+			logger.Errorf("cannot discard pending login: %s", err)
+		}
+		return errgo.Newf("cannot send login link, please try again later")
+	}
+	return nil
+}
+
+// verify checks the login link with the given token and returns the
+// identity of the user it was sent to. Each link can only be used
+// once. If the link is not valid an error with a cause of
+// params.ErrUnauthorized is returned.
+func (idp *identityProvider) verify(ctx context.Context, t linkToken) (*store.Identity, error) {
+	if t.Nonce == "" {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid login link")
+	}
+	if time.Now().After(t.Expires) {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "login link has expired")
+	}
+	var pl pendingLogin
+	err := idp.initParams.KeyValueStore.Update(ctx, pendingKey(t), t.Expires, func(old []byte) ([]byte, error) {
+		if len(old) == 0 {
+			return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "login link has already been used")
+		}
+		if err := json.Unmarshal(old, &pl); err != nil || pl.Nonce != t.Nonce || pl.Email != t.Email {
+			return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid login link")
+		}
+		// Mark the link as used.
+		return []byte{}, nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	idp.initParams.PendingRegistrations.Done(ctx, pl.Email, pl.IP)
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, t.Email),
+		Username:   t.Email,
+		Email:      t.Email,
+	}
+	if err := idp.initParams.Store.UpdateIdentity(ctx, id, store.Update{
+		store.Username: store.Set,
+		store.Email:    store.Set,
+	}); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return id, nil
+}
+
+// clientIP returns the address of the client that made the given
+// request, or the empty string if it cannot be determined.
+func (idp *identityProvider) clientIP(req *http.Request) string {
+	filter := httpauth.IPFilter{
+		TrustedProxies: idp.initParams.TrustedProxies,
+	}
+	if ip := filter.ClientIP(req); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// domainAllowed reports whether users with the given email address are
+// allowed to log in.
+func (idp *identityProvider) domainAllowed(email string) bool {
+	if len(idp.params.AllowedDomains) == 0 {
+		return true
+	}
+	domain := email[strings.LastIndex(email, "@")+1:]
+	for _, d := range idp.params.AllowedDomains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// emailLinkFormParams holds the parameters sent to the email-link-form
+// template.
+type emailLinkFormParams struct {
+	params.IDPChoiceDetails
+
+	// Action contains the action parameter for the form.
+	Action string
+
+	// Error contains an error message from the previous, failed,
+	// attempt to send a login link.
+	Error string
+
+	// Email contains the address to which a login link has been
+	// sent, if any.
+	Email string
+}
+
+// writeForm writes a form asking the user for their email address.
+// If a login link has been sent, email holds the address it was sent
+// to.
+func (idp *identityProvider) writeForm(w http.ResponseWriter, req *http.Request, errorMessage, email string) {
+	data := emailLinkFormParams{
+		IDPChoiceDetails: params.IDPChoiceDetails{
+			Description: idp.params.Description,
+			Name:        idp.params.Name,
+			URL:         idp.URL(idputil.State(req)),
+		},
+		Action: idp.URL(idputil.State(req)),
+		Error:  errorMessage,
+		Email:  email,
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	if err := idp.initParams.Template.ExecuteTemplate(w, "email-link-form", data); err != nil {
+		logger.Errorf("cannot process email link template: %s", err)
+	}
+}
+
+// pendingKey returns the key under which the pending login for the
+// link with the given token is held. Logins that complete a discharge
+// wait are keyed by the wait ID, so that only the most recent link
+// sent for a wait can complete it. Other logins are keyed by the
+// link's nonce.
+func pendingKey(t linkToken) string {
+	if t.WaitID != "" {
+		return "wait:" + t.WaitID
+	}
+	return "pending:" + t.Nonce
+}
@@ -0,0 +1,530 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package emaillink_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/emaillink"
+	"github.com/canonical/candid/idp/idptest"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/store"
+)
+
+const idpPrefix = "https://idp.example.com"
+
+type emailLinkSuite struct {
+	idptest *idptest.Fixture
+	mailer  *testMailer
+}
+
+func TestEmailLink(t *testing.T) {
+	qtsuite.Run(qt.New(t), &emailLinkSuite{})
+}
+
+func (s *emailLinkSuite) Init(c *qt.C) {
+	s.idptest = idptest.NewFixture(c, candidtest.NewStore())
+	s.mailer = new(testMailer)
+}
+
+func (s *emailLinkSuite) setupIdp(c *qt.C, p emaillink.Params) idp.IdentityProvider {
+	return s.setupIdpWithInitParams(c, p, s.idptest.InitParams(c, idpPrefix))
+}
+
+func (s *emailLinkSuite) setupIdpWithInitParams(c *qt.C, p emaillink.Params, ip idp.InitParams) idp.IdentityProvider {
+	p.Mailer = s.mailer
+	i := emaillink.NewIdentityProvider(p)
+	err := i.Init(context.Background(), ip)
+	c.Assert(err, qt.IsNil)
+	return i
+}
+
+func (s *emailLinkSuite) TestName(c *qt.C) {
+	i := emaillink.NewIdentityProvider(emaillink.Params{Name: "email"})
+	c.Assert(i.Name(), qt.Equals, "email")
+	c.Assert(i.Description(), qt.Equals, "email")
+	c.Assert(i.Domain(), qt.Equals, "")
+	c.Assert(i.Interactive(), qt.Equals, true)
+}
+
+func (s *emailLinkSuite) TestInitWithoutMailer(c *qt.C) {
+	i := emaillink.NewIdentityProvider(emaillink.Params{Name: "email"})
+	err := i.Init(context.Background(), s.idptest.InitParams(c, idpPrefix))
+	c.Assert(err, qt.ErrorMatches, `no mailer configured`)
+}
+
+func (s *emailLinkSuite) TestHandle(c *qt.C) {
+	i := s.setupIdp(c, emaillink.Params{
+		Name:    "email",
+		Subject: "Log in to Example",
+	})
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		requestLink("Bob@Example.com"),
+		s.followLink(nil),
+	))
+	c.Assert(err, qt.IsNil)
+	candidtest.AssertEqualIdentity(c, id, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("email", "bob@example.com"),
+		Username:   "bob@example.com",
+		Email:      "bob@example.com",
+	})
+	s.idptest.Store.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("email", "bob@example.com"),
+		Username:   "bob@example.com",
+		Email:      "bob@example.com",
+	})
+	c.Assert(s.mailer.messages, qt.HasLen, 1)
+	c.Assert(s.mailer.messages[0].to, qt.Equals, "bob@example.com")
+	c.Assert(s.mailer.messages[0].subject, qt.Equals, "Log in to Example")
+}
+
+func (s *emailLinkSuite) TestLinkSingleUse(c *qt.C) {
+	i := s.setupIdp(c, emaillink.Params{Name: "email"})
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		requestLink("bob@example.com"),
+		s.followLink(nil),
+		s.followLink(nil),
+	))
+	c.Assert(err, qt.ErrorMatches, `login link has already been used`)
+}
+
+func (s *emailLinkSuite) TestLinkExpired(c *qt.C) {
+	i := s.setupIdp(c, emaillink.Params{
+		Name:        "email",
+		LinkTimeout: time.Millisecond,
+	})
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		requestLink("bob@example.com"),
+		s.followLink(func(link string) string {
+			time.Sleep(10 * time.Millisecond)
+			return link
+		}),
+	))
+	c.Assert(err, qt.ErrorMatches, `login link has expired`)
+}
+
+func (s *emailLinkSuite) TestLinkInvalid(c *qt.C) {
+	i := s.setupIdp(c, emaillink.Params{Name: "email"})
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		requestLink("bob@example.com"),
+		s.followLink(func(link string) string {
+			u, err := url.Parse(link)
+			c.Assert(err, qt.IsNil)
+			v := u.Query()
+			v.Set("token", "x"+v.Get("token"))
+			u.RawQuery = v.Encode()
+			return u.String()
+		}),
+	))
+	c.Assert(err, qt.ErrorMatches, `invalid login link`)
+}
+
+func (s *emailLinkSuite) TestInvalidEmail(c *qt.C) {
+	i := s.setupIdp(c, emaillink.Params{Name: "email"})
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", requestLink("not an email"))
+	c.Assert(err, qt.ErrorMatches, `invalid email address`)
+	c.Assert(s.mailer.messages, qt.HasLen, 0)
+}
+
+func (s *emailLinkSuite) TestAllowedDomains(c *qt.C) {
+	i := s.setupIdp(c, emaillink.Params{
+		Name:           "email",
+		AllowedDomains: []string{"Example.com"},
+	})
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", requestLink("bob@example.net"))
+	c.Assert(err, qt.ErrorMatches, `cannot log in with an email address in that domain`)
+	c.Assert(s.mailer.messages, qt.HasLen, 0)
+
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		requestLink("bob@example.com"),
+		s.followLink(nil),
+	))
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "bob@example.com")
+}
+
+func (s *emailLinkSuite) TestLinkOtherBrowser(c *qt.C) {
+	i := s.setupIdp(c, emaillink.Params{Name: "email"})
+	srv := newServer(i)
+	defer srv.Close()
+	s.requestLinkForWait(c, srv, "bob@example.com", "wait-1")
+	link, err := s.mailer.link()
+	c.Assert(err, qt.IsNil)
+
+	// The link completes the discharge wait when it is followed in
+	// a browser that does not hold the login state.
+	resp, err := s.idptest.Client(c, idpPrefix, srv.URL, "http://result.example.com").Get(link)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	s.idptest.AssertLoginSuccess(c, "bob@example.com")
+	s.idptest.AssertLoginDischargeID(c, "wait-1")
+}
+
+func (s *emailLinkSuite) TestLinkOtherBrowserReplaced(c *qt.C) {
+	i := s.setupIdp(c, emaillink.Params{Name: "email"})
+	srv := newServer(i)
+	defer srv.Close()
+	s.requestLinkForWait(c, srv, "bob@example.com", "wait-1")
+	link, err := s.mailer.link()
+	c.Assert(err, qt.IsNil)
+	s.requestLinkForWait(c, srv, "bob@example.com", "wait-1")
+
+	// Only the most recent link sent for a wait can be used.
+	resp, err := s.idptest.Client(c, idpPrefix, srv.URL, "http://result.example.com").Get(link)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	s.idptest.AssertLoginFailureMatches(c, `invalid login link`)
+	s.idptest.AssertLoginDischargeID(c, "wait-1")
+}
+
+func (s *emailLinkSuite) TestLinkOtherBrowserWithoutWait(c *qt.C) {
+	i := s.setupIdp(c, emaillink.Params{Name: "email"})
+	srv := newServer(i)
+	defer srv.Close()
+	s.requestLinkForWait(c, srv, "bob@example.com", "")
+	link, err := s.mailer.link()
+	c.Assert(err, qt.IsNil)
+
+	// Without a discharge wait there is nothing to complete the
+	// login in another browser.
+	resp, err := s.idptest.Client(c, idpPrefix, srv.URL, "http://result.example.com").Get(link)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+	s.idptest.AssertLoginNotComplete(c)
+}
+
+func (s *emailLinkSuite) TestSendFailureReleasesPendingRegistration(c *qt.C) {
+	ip := s.idptest.InitParams(c, idpPrefix)
+	ip.PendingRegistrations = idputil.NewPendingLimiter(memsimplekv.NewStore(), idputil.PendingLimitParams{
+		MaxPerEmail: 1,
+		MaxPerIP:    1,
+	})
+	i := s.setupIdpWithInitParams(c, emaillink.Params{Name: "email"}, ip)
+
+	// Links that could not be sent do not count against the limits.
+	s.mailer.err = errgo.New("connection refused")
+	for j := 0; j < 2; j++ {
+		_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", requestLink("bob@example.com"))
+		c.Assert(err, qt.ErrorMatches, `cannot send login link, please try again later`)
+	}
+	s.mailer.err = nil
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		requestLink("bob@example.com"),
+		s.followLink(nil),
+	))
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "bob@example.com")
+}
+
+func (s *emailLinkSuite) TestPendingRegistrationClientIP(c *qt.C) {
+	ip := s.idptest.InitParams(c, idpPrefix)
+	ip.PendingRegistrations = idputil.NewPendingLimiter(memsimplekv.NewStore(), idputil.PendingLimitParams{
+		MaxPerIP: 1,
+	})
+	_, localhost, err := net.ParseCIDR("127.0.0.0/8")
+	c.Assert(err, qt.IsNil)
+	ip.TrustedProxies = []*net.IPNet{localhost}
+	i := s.setupIdpWithInitParams(c, emaillink.Params{Name: "email"}, ip)
+	srv := newServer(i)
+	defer srv.Close()
+
+	// Clients behind a trusted proxy are limited by their own
+	// address.
+	c.Assert(s.sendLink(c, srv, "bob@example.com", "", "10.0.0.1"), qt.Equals, "")
+	c.Assert(s.sendLink(c, srv, "alice@example.com", "", "10.0.0.2"), qt.Equals, "")
+	c.Assert(s.sendLink(c, srv, "carol@example.com", "", "10.0.0.1"), qt.Equals, "too many pending requests for 10.0.0.1, please try again later")
+	c.Assert(s.mailer.messages, qt.HasLen, 2)
+}
+
+// requestLinkForWait asks the identity provider served by srv to send
+// a login link to the given email address for a login that completes
+// the discharge wait with the given ID.
+func (s *emailLinkSuite) requestLinkForWait(c *qt.C, srv *httptest.Server, email, waitID string) {
+	c.Assert(s.sendLink(c, srv, email, waitID, ""), qt.Equals, "")
+}
+
+// sendLink asks the identity provider served by srv to send a login
+// link to the given email address for a login that completes the
+// discharge wait with the given ID, if any. If forwardedFor is not
+// empty the request appears to have been forwarded by a proxy for a
+// client with that address. The error message shown on the returned
+// form, if any, is returned.
+func (s *emailLinkSuite) sendLink(c *qt.C, srv *httptest.Server, email, waitID, forwardedFor string) string {
+	cookie, state := s.idptest.LoginState(c, idputil.LoginState{
+		ReturnTo: "http://result.example.com/callback",
+		State:    "1234",
+		Expires:  time.Now().Add(10 * time.Minute),
+		WaitID:   waitID,
+	})
+	client := s.idptest.Client(c, idpPrefix, srv.URL, "http://result.example.com")
+	u, err := url.Parse(idpPrefix)
+	c.Assert(err, qt.IsNil)
+	client.Jar.SetCookies(u, []*http.Cookie{cookie})
+	req, err := http.NewRequest("POST", idpPrefix+"/login?"+url.Values{"state": {state}}.Encode(), strings.NewReader(url.Values{
+		"email": {email},
+	}.Encode()))
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	resp, err := client.Do(req)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	lines := strings.Split(string(body), "\n")
+	c.Assert(len(lines) > 1, qt.Equals, true)
+	return lines[1]
+}
+
+// newServer returns a server that handles requests with the given
+// identity provider.
+func newServer(i idp.IdentityProvider) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		i.Handle(req.Context(), w, req)
+	}))
+}
+
+type responseHandler func(*http.Client, *http.Response) (*http.Response, error)
+
+// then returns a response handler that calls each of the given
+// handlers in turn.
+func (s *emailLinkSuite) TestSMTPMailerTimeout(c *qt.C) {
+	// Accept connections but never respond to them.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	m, err := emaillink.NewSMTPMailer(emaillink.SMTPParams{
+		Address: l.Addr().String(),
+		From:    "candid@example.com",
+		Timeout: 100 * time.Millisecond,
+	})
+	c.Assert(err, qt.IsNil)
+	err = m.SendMail(context.Background(), "test@example.com", "subject", "body")
+	c.Assert(err, qt.ErrorMatches, `cannot send mail to test@example.com: context deadline exceeded`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = m.SendMail(ctx, "test@example.com", "subject", "body")
+	c.Assert(err, qt.ErrorMatches, `cannot send mail to test@example.com: context canceled`)
+}
+
+func (s *emailLinkSuite) TestRateLimitedMailer(c *qt.C) {
+	m := emaillink.NewRateLimitedMailer(s.mailer, emaillink.RateLimitParams{
+		MessagesPerMinute: 600,
+	})
+
+	// Messages are spaced at the configured rate.
+	t0 := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := m.SendMail(context.Background(), "bob@example.com", "subject", "body")
+			c.Check(err, qt.IsNil)
+		}()
+	}
+	wg.Wait()
+	c.Assert(time.Since(t0) >= 200*time.Millisecond, qt.Equals, true)
+	c.Assert(s.mailer.messages, qt.HasLen, 3)
+}
+
+func (s *emailLinkSuite) TestRateLimitedMailerUnlimited(c *qt.C) {
+	m := emaillink.NewRateLimitedMailer(s.mailer, emaillink.RateLimitParams{})
+	c.Assert(m, qt.Equals, emaillink.Mailer(s.mailer))
+}
+
+func (s *emailLinkSuite) TestRateLimitedMailerQueueFull(c *qt.C) {
+	bm := &blockingMailer{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	m := emaillink.NewRateLimitedMailer(bm, emaillink.RateLimitParams{
+		MessagesPerMinute: 600,
+		QueueSize:         1,
+	})
+	done := make(chan error, 2)
+	send := func() {
+		done <- m.SendMail(context.Background(), "bob@example.com", "subject", "body")
+	}
+
+	// The first message is being sent and the second fills the
+	// queue.
+	go send()
+	<-bm.started
+	go send()
+	for emaillink.QueueLen(m) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	err := m.SendMail(context.Background(), "alice@example.com", "subject", "body")
+	c.Assert(errgo.Cause(err), qt.Equals, emaillink.ErrQueueFull)
+	c.Assert(err, qt.ErrorMatches, `cannot send mail to alice@example.com: mail queue is full`)
+	close(bm.release)
+	c.Assert(<-done, qt.IsNil)
+	c.Assert(<-done, qt.IsNil)
+}
+
+func (s *emailLinkSuite) TestRateLimitedMailerContextDone(c *qt.C) {
+	m := emaillink.NewRateLimitedMailer(s.mailer, emaillink.RateLimitParams{
+		MessagesPerMinute: 1,
+	})
+	err := m.SendMail(context.Background(), "bob@example.com", "subject", "body")
+	c.Assert(err, qt.IsNil)
+
+	// The next message must wait a minute, so it is abandoned when
+	// the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = m.SendMail(ctx, "bob@example.com", "subject", "body")
+	c.Assert(err, qt.ErrorMatches, `cannot send mail to bob@example.com: context deadline exceeded`)
+	c.Assert(s.mailer.messages, qt.HasLen, 1)
+}
+
+func (s *emailLinkSuite) TestSMTPMailerInvalidRateLimit(c *qt.C) {
+	_, err := emaillink.NewSMTPMailer(emaillink.SMTPParams{
+		Address: "smtp.example.com:587",
+		From:    "candid@example.com",
+		RateLimit: emaillink.RateLimitParams{
+			MessagesPerMinute: -1,
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `invalid smtp rate-limit: messages-per-minute must not be negative`)
+}
+
+func then(fs ...responseHandler) responseHandler {
+	return func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		for _, f := range fs {
+			var err error
+			resp, err = f(client, resp)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return resp, nil
+	}
+}
+
+// requestLink returns a response handler that completes the form in
+// the response with the given email address.
+func requestLink(email string) responseHandler {
+	return func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		action, err := candidtest.LoginFormAction(resp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return client.PostForm(action, url.Values{
+			"email": {email},
+		})
+	}
+}
+
+// followLink returns a response handler that follows the link in the
+// last email sent. If modify is not nil it is called to modify the link
+// before it is followed.
+func (s *emailLinkSuite) followLink(modify func(string) string) responseHandler {
+	return func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		link, err := s.mailer.link()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if modify != nil {
+			link = modify(link)
+		}
+		return client.Get(link)
+	}
+}
+
+type message struct {
+	to, subject, body string
+}
+
+// testMailer is an emaillink.Mailer that records the messages it is
+// asked to send.
+type testMailer struct {
+	mu       sync.Mutex
+	messages []message
+
+	// err holds the error returned when sending a message, if any.
+	err error
+}
+
+func (m *testMailer) SendMail(_ context.Context, to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.messages = append(m.messages, message{
+		to:      to,
+		subject: subject,
+		body:    body,
+	})
+	return nil
+}
+
+// blockingMailer is an emaillink.Mailer that signals on started when
+// it is asked to send a message, and then waits for release to be
+// closed.
+type blockingMailer struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingMailer) SendMail(context.Context, string, string, string) error {
+	select {
+	case m.started <- struct{}{}:
+	case <-m.release:
+	}
+	<-m.release
+	return nil
+}
+
+// link returns the link in the last message sent.
+func (m *testMailer) link() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.messages) == 0 {
+		return "", errgo.New("no messages sent")
+	}
+	for _, line := range strings.Split(m.messages[len(m.messages)-1].body, "\n") {
+		if strings.HasPrefix(line, idpPrefix) {
+			return line, nil
+		}
+	}
+	return "", errgo.New("no link in message")
+}
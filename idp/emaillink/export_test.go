@@ -0,0 +1,10 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package emaillink
+
+// QueueLen returns the number of messages waiting to be sent by the
+// given rate-limited Mailer.
+func QueueLen(m Mailer) int {
+	return len(m.(*rateLimitedMailer).queue)
+}
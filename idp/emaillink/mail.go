@@ -0,0 +1,183 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package emaillink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/internal/monitoring"
+)
+
+// A Mailer sends email messages.
+type Mailer interface {
+	// SendMail sends a plain text message with the given subject and
+	// body to the given address.
+	SendMail(ctx context.Context, to, subject, body string) error
+}
+
+// SMTPParams holds the parameters of an SMTP server used to send mail.
+type SMTPParams struct {
+	// Address holds the host:port address of the SMTP server.
+	Address string `yaml:"address" redact:"show"`
+
+	// Username holds the username used to authenticate to the SMTP
+	// server. If this is empty no authentication is used.
+	Username string `yaml:"username" redact:"show"`
+
+	// Password holds the password used to authenticate to the SMTP
+	// server.
+	Password string `yaml:"password"`
+
+	// From holds the address that messages are sent from.
+	From string `yaml:"from" redact:"show"`
+
+	// Timeout holds the time allowed to connect to the SMTP server
+	// and send a message. If this is zero defaultSMTPTimeout is
+	// used.
+	Timeout time.Duration `yaml:"timeout" redact:"show"`
+
+	// RateLimit holds the limit on the rate at which messages are
+	// sent to the SMTP server.
+	RateLimit RateLimitParams `yaml:"rate-limit" redact:"show"`
+}
+
+// defaultSMTPTimeout holds the time allowed to connect to the SMTP
+// server and send a message if no timeout is configured.
+const defaultSMTPTimeout = 30 * time.Second
+
+// NewSMTPMailer returns a Mailer that sends mail through the SMTP
+// server with the given parameters.
+func NewSMTPMailer(p SMTPParams) (Mailer, error) {
+	if p.Address == "" {
+		return nil, errgo.Newf("smtp address not specified")
+	}
+	host, _, err := net.SplitHostPort(p.Address)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid smtp address")
+	}
+	if p.From == "" {
+		return nil, errgo.Newf("smtp from address not specified")
+	}
+	if p.Timeout < 0 {
+		return nil, errgo.Newf("smtp timeout must not be negative")
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaultSMTPTimeout
+	}
+	if err := p.RateLimit.Validate(); err != nil {
+		return nil, errgo.Notef(err, "invalid smtp rate-limit")
+	}
+	m := &smtpMailer{
+		params: p,
+		host:   host,
+	}
+	if p.Username != "" {
+		m.auth = smtp.PlainAuth("", p.Username, p.Password, host)
+	}
+	return NewRateLimitedMailer(m, p.RateLimit), nil
+}
+
+// smtpMailer is a Mailer that sends mail through an SMTP server.
+type smtpMailer struct {
+	params SMTPParams
+	host   string
+	auth   smtp.Auth
+}
+
+// SendMail implements Mailer.SendMail. The message must be sent within
+// the configured timeout and before the given context is done.
+func (m *smtpMailer) SendMail(ctx context.Context, to, subject, body string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.params.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n")
+	buf.WriteString(body)
+	ctx, cancel := context.WithTimeout(ctx, m.params.Timeout)
+	defer cancel()
+	err := m.send(ctx, to, buf.Bytes())
+	monitoring.MailSent(err)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return errgo.Notef(err, "cannot send mail to %s", to)
+	}
+	return nil
+}
+
+// send sends the given message to the given address in the same way as
+// smtp.SendMail, except that the connection to the server is abandoned
+// when the given context is done.
+func (m *smtpMailer) send(ctx context.Context, to string, msg []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.params.Address)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	// Close the connection if the context is done first, so that
+	// any read or write that is blocked returns.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if m.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errgo.Newf("smtp server does not support authentication")
+		}
+		if err := c.Auth(m.auth); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := c.Mail(m.params.From); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		return errgo.Mask(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := w.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(c.Quit())
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package emaillink
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/internal/monitoring"
+)
+
+// ErrQueueFull is the cause of the error returned by a rate-limited
+// Mailer when a message cannot be sent because too many messages are
+// already waiting.
+var ErrQueueFull = errgo.New("mail queue is full")
+
+// defaultQueueSize holds the number of messages that may wait to be
+// sent by a rate-limited Mailer if no queue size is configured.
+const defaultQueueSize = 100
+
+// RateLimitParams holds the parameters of a rate-limited Mailer.
+type RateLimitParams struct {
+	// MessagesPerMinute holds the maximum rate at which messages
+	// are sent. If this is zero the rate is not limited.
+	MessagesPerMinute int `yaml:"messages-per-minute" redact:"show"`
+
+	// QueueSize holds the maximum number of messages that may be
+	// waiting to be sent. If this is zero a default of 100 is used.
+	QueueSize int `yaml:"queue-size" redact:"show"`
+}
+
+// Validate checks that the parameters are valid.
+func (p RateLimitParams) Validate() error {
+	if p.MessagesPerMinute < 0 {
+		return errgo.Newf("messages-per-minute must not be negative")
+	}
+	if p.QueueSize < 0 {
+		return errgo.Newf("queue-size must not be negative")
+	}
+	return nil
+}
+
+// NewRateLimitedMailer returns a Mailer that sends messages with m, but
+// evenly spaced so that no more than the configured number are sent
+// each minute. Messages waiting to be sent are held in a queue;
+// SendMail waits until its message has been sent, but fails
+// immediately, with an error with a cause of ErrQueueFull, if the queue
+// is full. If the rate is not limited, m is returned unchanged.
+func NewRateLimitedMailer(m Mailer, p RateLimitParams) Mailer {
+	if p.MessagesPerMinute <= 0 {
+		return m
+	}
+	if p.QueueSize <= 0 {
+		p.QueueSize = defaultQueueSize
+	}
+	rm := &rateLimitedMailer{
+		mailer:   m,
+		interval: time.Minute / time.Duration(p.MessagesPerMinute),
+		queue:    make(chan *mailRequest, p.QueueSize),
+	}
+	go rm.run()
+	return rm
+}
+
+// A rateLimitedMailer is a Mailer that limits the rate at which
+// messages are sent by another Mailer.
+type rateLimitedMailer struct {
+	mailer   Mailer
+	interval time.Duration
+	queue    chan *mailRequest
+}
+
+// A mailRequest holds a message waiting to be sent.
+type mailRequest struct {
+	ctx               context.Context
+	to, subject, body string
+	result            chan error
+}
+
+// SendMail implements Mailer.SendMail.
+func (m *rateLimitedMailer) SendMail(ctx context.Context, to, subject, body string) error {
+	req := &mailRequest{
+		ctx:     ctx,
+		to:      to,
+		subject: subject,
+		body:    body,
+		result:  make(chan error, 1),
+	}
+	select {
+	case m.queue <- req:
+		monitoring.MailQueued(len(m.queue))
+	default:
+		monitoring.MailRejected()
+		return errgo.WithCausef(nil, ErrQueueFull, "cannot send mail to %s: %s", to, ErrQueueFull)
+	}
+	select {
+	case err := <-req.result:
+		return errgo.Mask(err, errgo.Any)
+	case <-ctx.Done():
+		return errgo.Notef(ctx.Err(), "cannot send mail to %s", to)
+	}
+}
+
+// run sends the queued messages, waiting for the configured interval
+// between each one. Messages whose context is done before they are
+// sent are discarded without using up the rate.
+func (m *rateLimitedMailer) run() {
+	var next time.Time
+	for req := range m.queue {
+		monitoring.MailDequeued(len(m.queue))
+		if err := wait(req.ctx, time.Until(next)); err != nil {
+			req.result <- errgo.Notef(err, "cannot send mail to %s", req.to)
+			continue
+		}
+		next = time.Now().Add(m.interval)
+		req.result <- m.mailer.SendMail(req.ctx, req.to, req.subject, req.body)
+	}
+}
+
+// wait waits for the given duration, returning an error if the given
+// context is done first.
+func wait(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil || d <= 0 {
+		return err
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
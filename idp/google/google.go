@@ -9,6 +9,7 @@ import (
 	"gopkg.in/errgo.v1"
 
 	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/idp/openid"
 )
 
@@ -56,6 +57,39 @@ type Params struct {
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
 	Hidden bool `yaml:"hidden"`
+
+	// Category is the category in which the IDP is grouped in
+	// interactive prompts.
+	Category string `yaml:"category"`
+
+	// RequireVerifiedEmail is set if logins should only succeed
+	// when the user's email address has been verified.
+	RequireVerifiedEmail bool `yaml:"require-verified-email"`
+
+	// AssumeEmailVerified is set if an email address should be
+	// treated as verified when no verification status is supplied.
+	AssumeEmailVerified bool `yaml:"assume-email-verified"`
+
+	// PinnedKeys holds the fingerprints of the keys that may be used
+	// to sign ID tokens, see openid.KeyFingerprint.
+	PinnedKeys []string `yaml:"pinned-keys"`
+
+	// CaptureClaims, if set, configures the capture of the raw claims
+	// in the ID token on each login, see
+	// openid.OpenIDConnectParams.CaptureClaims.
+	CaptureClaims *idputil.ClaimCaptureParams `yaml:"capture-claims"`
+
+	// Suspension, if set, configures the claim that reports that an
+	// account is suspended, see openid.OpenIDConnectParams.Suspension.
+	Suspension *idputil.SuspensionParams `yaml:"suspension"`
+
+	// RequestSigning, if set, configures the signing of authorization
+	// requests, see openid.OpenIDConnectParams.RequestSigning.
+	RequestSigning *openid.RequestSigningParams `yaml:"request-signing"`
+
+	// StoreState is set if login state is held in the store rather
+	// than a browser cookie, see openid.OpenIDConnectParams.StoreState.
+	StoreState bool `yaml:"store-state"`
 }
 
 // NewIdentityProvider creates a google identity provider with the
@@ -77,5 +111,14 @@ func NewIdentityProvider(p Params) idp.IdentityProvider {
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
 		Hidden:       p.Hidden,
+		Category:     p.Category,
+
+		RequireVerifiedEmail: p.RequireVerifiedEmail,
+		AssumeEmailVerified:  p.AssumeEmailVerified,
+		PinnedKeys:           p.PinnedKeys,
+		CaptureClaims:        p.CaptureClaims,
+		Suspension:           p.Suspension,
+		RequestSigning:       p.RequestSigning,
+		StoreState:           p.StoreState,
 	})
 }
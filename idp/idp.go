@@ -7,12 +7,15 @@ package idp
 import (
 	"context"
 	"html/template"
+	"net"
 	"net/http"
 
 	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/idp/idputil/secret"
 	"github.com/canonical/candid/store"
 )
@@ -81,6 +84,40 @@ type InitParams struct {
 
 	// Template contains the templates loaded in the identity server.
 	Template *template.Template
+
+	// PendingRegistrations contains the limiter that the identity
+	// provider should use to restrict the number of outstanding
+	// unverified registrations. This may be nil, in which case no
+	// limits apply.
+	PendingRegistrations *idputil.PendingLimiter
+
+	// FailedLoginDelay contains the delay that the identity provider
+	// should apply to failed password logins. This may be nil, in
+	// which case no delay is applied.
+	FailedLoginDelay *idputil.FailedLoginDelay
+
+	// CookieNamePrefix contains the prefix that the identity
+	// provider should add to the names of any cookies it sets
+	// during its login flow.
+	CookieNamePrefix string
+
+	// CookiePath contains the path that any cookies set by the
+	// identity provider during its login flow should be scoped to.
+	// Cookies with this path are not sent to the handlers of other
+	// identity providers.
+	CookiePath string
+
+	// TokenGenerator contains the generator that the identity
+	// provider should use for any random tokens it issues, such as
+	// password reset tokens. This may be nil, in which case the
+	// default generator is used.
+	TokenGenerator *idputil.TokenGenerator
+
+	// TrustedProxies contains the networks containing reverse
+	// proxies that are trusted to report the address of the client
+	// in the X-Forwarded-For header. Identity providers that record
+	// client addresses should use these to determine them.
+	TrustedProxies []*net.IPNet
 }
 
 // IdentityProvider is the interface that is satisfied by all identity providers.
@@ -111,6 +148,12 @@ type IdentityProvider interface {
 	// requested (via a domain).
 	Hidden() bool
 
+	// Category returns the category of the identity provider, which
+	// may be used by the interactive login page to group related
+	// identity providers. Identity providers with an empty category
+	// are not grouped.
+	Category() string
+
 	// Init is used to perform any one time initialization tasks that
 	// are needed for the identity provider. Init is called once by
 	// the identity manager once it has determined the identity
@@ -143,3 +186,68 @@ type IdentityProvider interface {
 	// TODO define what happens when the identity doesn't exist.
 	GetGroups(ctx context.Context, id *store.Identity) (groups []string, err error)
 }
+
+// A ConfigReporter is an IdentityProvider that can report the
+// configuration it is running with.
+type ConfigReporter interface {
+	// ConfigParams returns the type of the identity provider and the
+	// parameters it is running with. The parameters may contain
+	// secrets, so they must be redacted (see
+	// idputil.RedactConfig) before they are shown to anyone. Only
+	// fields tagged redact:"show" are shown.
+	ConfigParams() (string, interface{})
+}
+
+// A PasswordResetter is an IdentityProvider that allows administrators
+// to reset the passwords of its users.
+type PasswordResetter interface {
+	// ResetPassword creates a single-use token that can be used to
+	// set a new password for the given identity. The token should be
+	// POSTed, along with the new password, to the identity
+	// provider's reset-password endpoint.
+	ResetPassword(ctx context.Context, id *store.Identity) (token string, err error)
+}
+
+// A PasswordExpirer is an IdentityProvider that allows administrators
+// to require its users to choose a new password.
+type PasswordExpirer interface {
+	// ExpirePassword marks the password of the given identity as
+	// expired, so that the user must choose a new password the next
+	// time they log in.
+	ExpirePassword(ctx context.Context, id *store.Identity) error
+}
+
+// A BackupCodeManager is an IdentityProvider that requires a one-time
+// code when logging in and allows administrators to issue its users
+// with single-use backup codes, which may be entered in place of a
+// one-time code.
+type BackupCodeManager interface {
+	// GenerateBackupCodes creates a new set of backup codes for the
+	// given identity, replacing any that it already has.
+	GenerateBackupCodes(ctx context.Context, id *store.Identity) ([]string, error)
+
+	// BackupCodesRemaining returns the number of unused backup
+	// codes the given identity has.
+	BackupCodesRemaining(ctx context.Context, id *store.Identity) (int, error)
+}
+
+// ErrLoginDeclined is the cause of the error returned by
+// NonInteractiveAuthenticator.AuthenticateRequest when the request does
+// not hold credentials for the identity provider.
+var ErrLoginDeclined = errgo.New("login declined")
+
+// A NonInteractiveAuthenticator is an IdentityProvider that can
+// authenticate a non-interactive client using only the credentials in
+// a single request. Such identity providers can be used in the
+// non-interactive login chain.
+type NonInteractiveAuthenticator interface {
+	// AuthenticateRequest checks the credentials held in the given
+	// request. If the request holds no credentials for the identity
+	// provider then an error with a cause of ErrLoginDeclined is
+	// returned so that the next method in the chain can be tried.
+	// AuthenticateRequest must not have any side effects. If the
+	// credentials are valid it returns a function that completes
+	// the login, for example by updating the stored identity, and
+	// returns the authenticated identity.
+	AuthenticateRequest(ctx context.Context, req *http.Request) (commit func(context.Context) (*store.Identity, error), err error)
+}
@@ -206,6 +206,13 @@ func (s *Fixture) AssertLoginSuccess(c *qt.C, username string) {
 	c.Assert(s.visitCompleter.id.Username, qt.Equals, username)
 }
 
+// AssertLoginDischargeID asserts that the login test completed the
+// discharge wait with the given ID.
+func (s *Fixture) AssertLoginDischargeID(c *qt.C, dischargeID string) {
+	c.Assert(s.visitCompleter.called, qt.Equals, true)
+	c.Assert(s.visitCompleter.dischargeID, qt.Equals, dischargeID)
+}
+
 // AssertLoginRedirectSuccess asserts that the given redirect URL is for
 // a successful login of the given user.
 func (s *Fixture) AssertLoginRedirectSuccess(c *qt.C, rurl, returnTo, state string, username string) {
@@ -0,0 +1,101 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// ClaimsExtraInfoKey is the extra-info key under which claims captured
+// from an identity provider are stored on an identity.
+const ClaimsExtraInfoKey = "idp-claims"
+
+// DefaultMaxClaimsSize is the maximum size of the captured claims used
+// when ClaimCaptureParams.MaxSize is zero.
+const DefaultMaxClaimsSize = 2048
+
+// Redacted is the value that replaces the value of any redacted claim.
+const Redacted = "REDACTED"
+
+// ClaimCaptureParams holds the configuration for capturing the raw
+// claims returned by an identity provider when a user logs in. The
+// captured claims are only stored for audit purposes, they are never
+// used to make authorization decisions.
+type ClaimCaptureParams struct {
+	// Claims holds the names of the claims to capture. If this is
+	// empty then all claims are captured.
+	Claims []string `yaml:"claims" redact:"show"`
+
+	// Redact holds the names of claims whose values must not be
+	// stored. A redacted claim is recorded as being present, but its
+	// value is replaced by Redacted.
+	Redact []string `yaml:"redact" redact:"show"`
+
+	// MaxSize holds the maximum size, in bytes, of the encoded
+	// claims. Claims that would take the encoded claims over this
+	// size are omitted. If this is zero DefaultMaxClaimsSize is
+	// used.
+	MaxSize int `yaml:"max-size" redact:"show"`
+}
+
+// Capture returns the JSON encoding of the claims in the given set
+// that should be captured according to p. If p is nil, or no claims
+// are captured, Capture returns an empty string.
+func (p *ClaimCaptureParams) Capture(claims map[string]interface{}) string {
+	if p == nil {
+		return ""
+	}
+	maxSize := p.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxClaimsSize
+	}
+	redact := make(map[string]bool, len(p.Redact))
+	for _, name := range p.Redact {
+		redact[name] = true
+	}
+	names := p.Claims
+	if len(names) == 0 {
+		names = make([]string, 0, len(claims))
+		for name := range claims {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	captured := make(map[string]json.RawMessage)
+	// size starts at the size of the enclosing braces.
+	size := 2
+	for _, name := range names {
+		v, ok := claims[name]
+		if !ok {
+			continue
+		}
+		if redact[name] {
+			v = Redacted
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			logger.Infof("cannot capture claim %q: %s", name, err)
+			continue
+		}
+		// Allow for the quoted name, colon and separating comma.
+		n := len(name) + len(data) + 4
+		if size+n > maxSize {
+			logger.Infof("not capturing claim %q: claims too large", name)
+			continue
+		}
+		size += n
+		captured[name] = data
+	}
+	if len(captured) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(captured)
+	if err != nil {
+		// This should not be possible as all the values have
+		// already been marshaled.
+		panic(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/idp/idputil"
+)
+
+var testClaims = map[string]interface{}{
+	"sub":    "1234",
+	"email":  "bob@example.com",
+	"name":   "Bob Example",
+	"groups": []string{"a", "b"},
+	"dept":   "finance",
+}
+
+var captureTests = []struct {
+	about  string
+	params *idputil.ClaimCaptureParams
+	expect string
+}{{
+	about:  "not enabled",
+	expect: "",
+}, {
+	about:  "all claims",
+	params: &idputil.ClaimCaptureParams{},
+	expect: `{"dept":"finance","email":"bob@example.com","groups":["a","b"],"name":"Bob Example","sub":"1234"}`,
+}, {
+	about: "subset of claims",
+	params: &idputil.ClaimCaptureParams{
+		Claims: []string{"sub", "dept", "missing"},
+	},
+	expect: `{"dept":"finance","sub":"1234"}`,
+}, {
+	about: "redacted claims",
+	params: &idputil.ClaimCaptureParams{
+		Redact: []string{"email", "name"},
+	},
+	expect: `{"dept":"finance","email":"REDACTED","groups":["a","b"],"name":"REDACTED","sub":"1234"}`,
+}, {
+	about: "redacted subset of claims",
+	params: &idputil.ClaimCaptureParams{
+		Claims: []string{"sub", "email"},
+		Redact: []string{"email"},
+	},
+	expect: `{"email":"REDACTED","sub":"1234"}`,
+}, {
+	about: "size limit",
+	params: &idputil.ClaimCaptureParams{
+		MaxSize: 50,
+	},
+	expect: `{"dept":"finance","email":"bob@example.com"}`,
+}, {
+	about: "size limit skips large claims",
+	params: &idputil.ClaimCaptureParams{
+		MaxSize: 40,
+	},
+	expect: `{"dept":"finance","groups":["a","b"]}`,
+}, {
+	about: "nothing captured",
+	params: &idputil.ClaimCaptureParams{
+		Claims: []string{"missing"},
+	},
+	expect: "",
+}}
+
+func TestCapture(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range captureTests {
+		c.Run(test.about, func(c *qt.C) {
+			got := test.params.Capture(testClaims)
+			c.Assert(got, qt.Equals, test.expect)
+		})
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// failedLoginTimeout is the length of time, from the first failure,
+// for which consecutive failed logins for an account are counted.
+const failedLoginTimeout = time.Hour
+
+// FailedLoginDelayParams holds the parameters for a FailedLoginDelay.
+type FailedLoginDelayParams struct {
+	// Delay holds the delay applied after the first failed login for
+	// an account. The delay doubles for each subsequent consecutive
+	// failure. If this is zero then no delay is applied.
+	Delay time.Duration
+
+	// MaxDelay holds the maximum delay that will be applied. If this
+	// is zero then the delay is not capped.
+	MaxDelay time.Duration
+
+	// DedupWindow holds the length of time for which a repeated
+	// failed login with the same username and password is treated
+	// as a retry of the first, and so is delayed but not counted as
+	// a further failure. If this is zero every failure is counted.
+	DedupWindow time.Duration
+}
+
+// A FailedLoginDelay slows down responses to failed password logins
+// in order to hinder online password guessing. The delay increases
+// exponentially with the number of consecutive failures for an
+// account and is reset by a successful login. A nil FailedLoginDelay
+// applies no delay.
+type FailedLoginDelay struct {
+	store  simplekv.Store
+	params FailedLoginDelayParams
+
+	// mu protects the fields below it.
+	mu sync.Mutex
+
+	// recent holds the time at which each recently counted failed
+	// login was first seen, keyed by a hash of its username and
+	// password. It is only held in memory so that the hashes of
+	// attempted passwords are never stored.
+	recent map[[sha256.Size]byte]time.Time
+}
+
+// NewFailedLoginDelay creates a new FailedLoginDelay that stores the
+// failure counts in the given store. If the configured delay is zero
+// then nil is returned.
+func NewFailedLoginDelay(store simplekv.Store, p FailedLoginDelayParams) *FailedLoginDelay {
+	if p.Delay <= 0 {
+		return nil
+	}
+	return &FailedLoginDelay{
+		store:  store,
+		params: p,
+		recent: make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// LoginUser wraps the given login function so that any failed login,
+// that is one with an error cause of params.ErrUnauthorized, is
+// delayed before returning. The delay stops early if the context is
+// cancelled. Any login slot recorded in the context is released
+// before the delay starts.
+func (d *FailedLoginDelay) LoginUser(f func(ctx context.Context, username, password string) (*store.Identity, error)) func(ctx context.Context, username, password string) (*store.Identity, error) {
+	if d == nil {
+		return f
+	}
+	return func(ctx context.Context, username, password string) (*store.Identity, error) {
+		id, err := f(ctx, username, password)
+		key := "failed-login:" + username
+		if err == nil {
+			if err := store.ResetCounter(ctx, d.store, key); err != nil {
+				logger.Errorf("cannot reset failed login count for %q: %s", username, err)
+			}
+			return id, nil
+		}
+		if errgo.Cause(err) != params.ErrUnauthorized {
+			return nil, err
+		}
+		var n int
+		var err1 error
+		if d.isRetry(username, password) {
+			n, err1 = store.CounterValue(ctx, d.store, key)
+		} else {
+			n, err1 = store.IncrementCounter(ctx, d.store, key, failedLoginTimeout)
+		}
+		if err1 != nil {
+			logger.Errorf("cannot update failed login count for %q: %s", username, err1)
+		}
+		if n < 1 {
+			n = 1
+		}
+		releaseLoginSlot(ctx)
+		sleep(ctx, d.delay(n))
+		return nil, err
+	}
+}
+
+type loginSlotKey struct{}
+
+// ContextWithLoginSlot returns a context recording a function that
+// releases the slot reserved for the login being processed by a limit
+// on concurrent logins. A FailedLoginDelay calls the function before
+// delaying a failed login, so that delayed failures do not prevent
+// other logins from proceeding. The function may be called more than
+// once.
+func ContextWithLoginSlot(ctx context.Context, release func()) context.Context {
+	return context.WithValue(ctx, loginSlotKey{}, release)
+}
+
+// releaseLoginSlot releases the login slot recorded in the given
+// context, if any.
+func releaseLoginSlot(ctx context.Context) {
+	if release, _ := ctx.Value(loginSlotKey{}).(func()); release != nil {
+		release()
+	}
+}
+
+// isRetry reports whether a failed login with the given username and
+// password has already been counted within the dedup window. If it has
+// not, the attempt is recorded so that identical attempts within the
+// window are treated as retries of it.
+func (d *FailedLoginDelay) isRetry(username, password string) bool {
+	if d.params.DedupWindow <= 0 {
+		return false
+	}
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k, t := range d.recent {
+		if now.Sub(t) >= d.params.DedupWindow {
+			delete(d.recent, k)
+		}
+	}
+	if _, ok := d.recent[key]; ok {
+		return true
+	}
+	d.recent[key] = now
+	return false
+}
+
+// delay calculates the delay to apply after n consecutive failures.
+func (d *FailedLoginDelay) delay(n int) time.Duration {
+	delay := d.params.Delay
+	for i := 1; i < n; i++ {
+		if d.params.MaxDelay > 0 && delay >= d.params.MaxDelay {
+			break
+		}
+		if delay > time.Duration(1<<62) {
+			// Avoid overflow.
+			break
+		}
+		delay *= 2
+	}
+	if d.params.MaxDelay > 0 && delay > d.params.MaxDelay {
+		delay = d.params.MaxDelay
+	}
+	return delay
+}
+
+// sleep waits for the given duration, or until the given context is
+// done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
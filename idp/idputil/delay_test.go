@@ -0,0 +1,162 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+func testLoginUser(ctx context.Context, username, password string) (*store.Identity, error) {
+	if password != "pass" {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "authentication failed for user %q", username)
+	}
+	return &store.Identity{Username: username}, nil
+}
+
+func TestFailedLoginDelay(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	d := idputil.NewFailedLoginDelay(memsimplekv.NewStore(), idputil.FailedLoginDelayParams{
+		Delay:    10 * time.Millisecond,
+		MaxDelay: 40 * time.Millisecond,
+	})
+	loginUser := d.LoginUser(testLoginUser)
+
+	// Each consecutive failure increases the delay up to the maximum.
+	for _, expect := range []time.Duration{10, 20, 40, 40} {
+		t0 := time.Now()
+		_, err := loginUser(ctx, "bob", "wrong")
+		c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+		c.Assert(err, qt.ErrorMatches, `authentication failed for user "bob"`)
+		c.Assert(time.Since(t0) >= expect*time.Millisecond, qt.Equals, true)
+	}
+
+	// Other accounts are not affected, and successful logins are not
+	// delayed.
+	t0 := time.Now()
+	id, err := loginUser(ctx, "alice", "pass")
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "alice")
+	c.Assert(time.Since(t0) < 10*time.Millisecond, qt.Equals, true)
+
+	// A successful login resets the delay.
+	_, err = loginUser(ctx, "bob", "pass")
+	c.Assert(err, qt.IsNil)
+	t0 = time.Now()
+	_, err = loginUser(ctx, "bob", "wrong")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	elapsed := time.Since(t0)
+	c.Assert(elapsed >= 10*time.Millisecond, qt.Equals, true)
+	c.Assert(elapsed < 40*time.Millisecond, qt.Equals, true)
+}
+
+func TestFailedLoginDelayDedup(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	d := idputil.NewFailedLoginDelay(kv, idputil.FailedLoginDelayParams{
+		Delay:       time.Millisecond,
+		DedupWindow: time.Hour,
+	})
+	loginUser := d.LoginUser(testLoginUser)
+	count := func() int {
+		n, err := store.CounterValue(ctx, kv, "failed-login:bob")
+		c.Assert(err, qt.IsNil)
+		return n
+	}
+
+	// Rapid identical submissions count as a single failure.
+	for i := 0; i < 3; i++ {
+		_, err := loginUser(ctx, "bob", "wrong")
+		c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	}
+	c.Assert(count(), qt.Equals, 1)
+
+	// A different password is a new attempt.
+	_, err := loginUser(ctx, "bob", "wrong2")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	c.Assert(count(), qt.Equals, 2)
+	_, err = loginUser(ctx, "bob", "wrong2")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	c.Assert(count(), qt.Equals, 2)
+}
+
+func TestFailedLoginDelayNoDedup(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	d := idputil.NewFailedLoginDelay(kv, idputil.FailedLoginDelayParams{
+		Delay: time.Millisecond,
+	})
+	loginUser := d.LoginUser(testLoginUser)
+	for i := 0; i < 3; i++ {
+		_, err := loginUser(ctx, "bob", "wrong")
+		c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	}
+	n, err := store.CounterValue(ctx, kv, "failed-login:bob")
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 3)
+}
+
+func TestFailedLoginDelayContextCancelled(t *testing.T) {
+	c := qt.New(t)
+	d := idputil.NewFailedLoginDelay(memsimplekv.NewStore(), idputil.FailedLoginDelayParams{
+		Delay: time.Hour,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := d.LoginUser(testLoginUser)(ctx, "bob", "wrong")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+}
+
+func TestFailedLoginDelayReleasesLoginSlot(t *testing.T) {
+	c := qt.New(t)
+	d := idputil.NewFailedLoginDelay(memsimplekv.NewStore(), idputil.FailedLoginDelayParams{
+		Delay: time.Hour,
+	})
+	released := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = idputil.ContextWithLoginSlot(ctx, func() {
+		released <- struct{}{}
+	})
+	loginUser := d.LoginUser(testLoginUser)
+
+	// A successful login does not release the slot.
+	_, err := loginUser(ctx, "bob", "pass")
+	c.Assert(err, qt.IsNil)
+	c.Assert(len(released), qt.Equals, 0)
+
+	// A failed login releases the slot before it is delayed.
+	done := make(chan error)
+	go func() {
+		_, err := loginUser(ctx, "bob", "wrong")
+		done <- err
+	}()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("login slot not released")
+	}
+	cancel()
+	c.Assert(errgo.Cause(<-done), qt.Equals, params.ErrUnauthorized)
+}
+
+func TestFailedLoginDelayDisabled(t *testing.T) {
+	c := qt.New(t)
+	d := idputil.NewFailedLoginDelay(memsimplekv.NewStore(), idputil.FailedLoginDelayParams{})
+	c.Assert(d, qt.IsNil)
+	_, err := d.LoginUser(testLoginUser)(context.Background(), "bob", "wrong")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+}
@@ -0,0 +1,31 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"context"
+	"time"
+)
+
+type tokenExpiryKey struct{}
+
+// ContextWithTokenExpiry returns a context recording the time at which
+// the token that the identity provider issued for the authenticated
+// user expires. Identity providers that receive such a token should
+// use the returned context when calling the VisitCompleter so that, if
+// the identity manager has been configured to do so, the discharge
+// token does not outlive it.
+func ContextWithTokenExpiry(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, tokenExpiryKey{}, t)
+}
+
+// TokenExpiryFromContext returns the token expiry time recorded in the
+// given context, if any.
+func TokenExpiryFromContext(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(tokenExpiryKey{}).(time.Time)
+	if !ok || t.IsZero() {
+		return time.Time{}, false
+	}
+	return t, true
+}
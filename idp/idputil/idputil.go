@@ -61,7 +61,7 @@ func DischargeID(req *http.Request) string {
 // URL creates a URL addressed to the given path within the IDP handler
 // and adds the given dischargeID (when specified).
 func URL(prefix, path, dischargeID string) string {
-	callback := prefix + path
+	callback := LocationURL(prefix, path)
 	v := make(url.Values)
 	if dischargeID != "" {
 		v.Set("id", dischargeID)
@@ -84,7 +84,7 @@ func RedirectURL(prefix, path, state string) string {
 	v := url.Values{
 		"state": {state},
 	}
-	return prefix + path + "?" + v.Encode()
+	return LocationURL(prefix, path) + "?" + v.Encode()
 }
 
 type RegistrationParams struct {
@@ -144,6 +144,33 @@ const LoginCookieName = "candid-login"
 // current login state.
 const LoginCookiePath = "/login"
 
+// IDPCookieNamePrefix returns the prefix added to the names of cookies
+// set by the identity provider with the given name, so that they
+// cannot collide with those set by other identity providers.
+func IDPCookieNamePrefix(idpName string) string {
+	return LoginCookieName + "-" + idpName + "-"
+}
+
+// IDPCookiePath returns the path to which cookies set by the identity
+// provider with the given name are scoped, so that they are only sent
+// to that identity provider's handlers.
+func IDPCookiePath(idpName string) string {
+	return LoginCookiePath + "/" + idpName
+}
+
+// LoginStateCookieName returns the name of the cookie that holds the
+// LoginState for an identity provider whose cookies are given the
+// given name prefix (see IDPCookieNamePrefix). Each identity provider
+// is sent its own copy of the login state, so that one identity
+// provider cannot read the login state of another. If the prefix is
+// empty the shared LoginCookieName is used.
+func LoginStateCookieName(prefix string) string {
+	if prefix == "" {
+		return LoginCookieName
+	}
+	return prefix + "login"
+}
+
 // LoginState holds the state of the current loging process.
 type LoginState struct {
 	// ReturnTo holds the address to return to after the login has
@@ -162,6 +189,39 @@ type LoginState struct {
 	// only used when the user that has authenticaated requires
 	// registration.
 	ProviderID store.ProviderIdentity
+
+	// Claims holds any claims captured from the identity provider
+	// for an authenticated user. It is only used when the user
+	// requires registration.
+	Claims string `json:",omitempty"`
+
+	// Email holds the email address that the identity provider
+	// reported for an authenticated user. It is only used when the
+	// user requires registration.
+	Email string `json:",omitempty"`
+
+	// ClientIP holds the address of the client recorded with the
+	// pending registration for an authenticated user. It is only
+	// used when the user requires registration.
+	ClientIP string `json:",omitempty"`
+
+	// TokenExpiry holds the time at which the token issued by the
+	// identity provider for an authenticated user expires. It is
+	// only used when the user that has authenticated requires
+	// registration.
+	TokenExpiry time.Time
+
+	// CodeChallenge holds the PKCE code challenge sent by the
+	// relying party that started the login, if any.
+	CodeChallenge *CodeChallenge `json:",omitempty"`
+
+	// SessionID holds the correlation ID of the anonymous session
+	// that the login upgrades, if any.
+	SessionID string `json:",omitempty"`
+
+	// WaitID holds the ID of the discharge wait that the login
+	// completes, if any.
+	WaitID string `json:",omitempty"`
 }
 
 // BadRequestf writes the given bad request message to the given
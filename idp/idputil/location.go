@@ -0,0 +1,53 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"net/url"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// CanonicalLocation checks that the given location, which is the
+// externally visible URL of the server, is an absolute http or https
+// URL and returns it in canonical form. In canonical form the scheme
+// and host are lower case and there is no trailing slash, so that paths
+// can be appended to it with LocationURL.
+func CanonicalLocation(location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot parse %q", location)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errgo.Newf("%q is not an absolute http or https URL", location)
+	}
+	if u.Host == "" {
+		return "", errgo.Newf("%q has no host", location)
+	}
+	if u.User != nil {
+		return "", errgo.Newf("%q must not contain user information", location)
+	}
+	if u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return "", errgo.Newf("%q must not contain a query or fragment", location)
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// LocationURL returns the URL of the given path relative to the given
+// location. Exactly one slash separates the location and the path,
+// whether or not the location has a trailing slash or the path has a
+// leading one. All URLs that refer to the server's own endpoints should
+// be constructed with LocationURL.
+func LocationURL(location, path string) string {
+	location = strings.TrimRight(location, "/")
+	if path == "" {
+		return location
+	}
+	return location + "/" + strings.TrimLeft(path, "/")
+}
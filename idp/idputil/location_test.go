@@ -0,0 +1,126 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/idp/idputil"
+)
+
+var canonicalLocationTests = []struct {
+	about       string
+	location    string
+	expect      string
+	expectError string
+}{{
+	about:    "already canonical",
+	location: "https://candid.example.com",
+	expect:   "https://candid.example.com",
+}, {
+	about:    "trailing slash",
+	location: "https://candid.example.com/",
+	expect:   "https://candid.example.com",
+}, {
+	about:    "path with trailing slashes",
+	location: "https://candid.example.com/candid//",
+	expect:   "https://candid.example.com/candid",
+}, {
+	about:    "upper case scheme and host",
+	location: "HTTPS://Candid.Example.COM:8443/Candid",
+	expect:   "https://candid.example.com:8443/Candid",
+}, {
+	about:    "http",
+	location: "http://127.0.0.1:8081",
+	expect:   "http://127.0.0.1:8081",
+}, {
+	about:       "empty",
+	location:    "",
+	expectError: `"" is not an absolute http or https URL`,
+}, {
+	about:       "no scheme",
+	location:    "candid.example.com",
+	expectError: `"candid.example.com" is not an absolute http or https URL`,
+}, {
+	about:       "relative path",
+	location:    "/candid",
+	expectError: `"/candid" is not an absolute http or https URL`,
+}, {
+	about:       "unsupported scheme",
+	location:    "ftp://candid.example.com",
+	expectError: `"ftp://candid.example.com" is not an absolute http or https URL`,
+}, {
+	about:       "no host",
+	location:    "https:///candid",
+	expectError: `"https:///candid" has no host`,
+}, {
+	about:       "user information",
+	location:    "https://bob@candid.example.com",
+	expectError: `"https://bob@candid.example.com" must not contain user information`,
+}, {
+	about:       "query",
+	location:    "https://candid.example.com/?a=b",
+	expectError: `"https://candid.example.com/\?a=b" must not contain a query or fragment`,
+}, {
+	about:       "fragment",
+	location:    "https://candid.example.com/#top",
+	expectError: `"https://candid.example.com/#top" must not contain a query or fragment`,
+}, {
+	about:       "unparsable",
+	location:    "https://candid.example.com:port",
+	expectError: `cannot parse "https://candid.example.com:port": .*`,
+}}
+
+func TestCanonicalLocation(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range canonicalLocationTests {
+		c.Run(test.about, func(c *qt.C) {
+			location, err := idputil.CanonicalLocation(test.location)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(location, qt.Equals, test.expect)
+		})
+	}
+}
+
+func TestLocationURLConsistent(t *testing.T) {
+	c := qt.New(t)
+	// Every spelling of the same location must produce the same URLs
+	// for the server's endpoints, for both the login chooser and the
+	// identity provider paths.
+	locations := []string{
+		"https://candid.example.com/candid",
+		"https://candid.example.com/candid/",
+		"HTTPS://CANDID.example.com/candid//",
+	}
+	paths := map[string]string{
+		"/login":                 "https://candid.example.com/candid/login",
+		"login-complete":         "https://candid.example.com/candid/login-complete",
+		"/login/test/callback":   "https://candid.example.com/candid/login/test/callback",
+		"/wait-token?did=1234":   "https://candid.example.com/candid/wait-token?did=1234",
+		"/login-redirect?id=abc": "https://candid.example.com/candid/login-redirect?id=abc",
+		"":                       "https://candid.example.com/candid",
+	}
+	for _, location := range locations {
+		canonical, err := idputil.CanonicalLocation(location)
+		c.Assert(err, qt.IsNil)
+		for path, expect := range paths {
+			c.Check(idputil.LocationURL(canonical, path), qt.Equals, expect, qt.Commentf("location %q, path %q", location, path))
+		}
+		idpPrefix := idputil.LocationURL(canonical, "/login/test")
+		c.Check(idputil.RedirectURL(idpPrefix, "/login", "xyz"), qt.Equals, "https://candid.example.com/candid/login/test/login?state=xyz")
+		c.Check(idputil.URL(idpPrefix, "/interact", "1234"), qt.Equals, "https://candid.example.com/candid/login/test/interact?id=1234")
+	}
+}
+
+func TestLocationURLWithoutCanonicalLocation(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(idputil.LocationURL("https://candid.example.com/", "/login"), qt.Equals, "https://candid.example.com/login")
+	c.Assert(idputil.LocationURL("https://candid.example.com", "login"), qt.Equals, "https://candid.example.com/login")
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// MaxLoginCacheTTL is the longest time for which a LoginCache will
+// remember a successful login.
+const MaxLoginCacheTTL = 15 * time.Minute
+
+// A LoginCache remembers the results of successful password logins
+// for a short time, so that a client that logs in again with the same
+// credentials does not cause another round-trip to the upstream
+// identity provider. Failed logins are never cached. A nil LoginCache
+// caches nothing.
+type LoginCache struct {
+	store simplekv.Store
+	ttl   time.Duration
+
+	// key is used to derive the cache key from the credentials
+	// presented. It is chosen at random when the cache is created,
+	// so the stored keys cannot be used to recover the credentials,
+	// and cached logins do not survive a server restart.
+	key []byte
+}
+
+// loginCacheRecord is the stored form of a cached login.
+type loginCacheRecord struct {
+	Identity *store.Identity `json:"identity"`
+	Expires  time.Time       `json:"expires"`
+}
+
+// NewLoginCache creates a new LoginCache that stores cached logins in
+// the given store for the given duration, which is limited to
+// MaxLoginCacheTTL. If ttl is zero then nil is returned.
+func NewLoginCache(store simplekv.Store, ttl time.Duration) *LoginCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if ttl > MaxLoginCacheTTL {
+		ttl = MaxLoginCacheTTL
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		// Without a key the cache cannot be used safely.
+		logger.Errorf("cannot create login cache key: %s", err)
+		return nil
+	}
+	return &LoginCache{
+		store: store,
+		ttl:   ttl,
+		key:   key,
+	}
+}
+
+// LoginUser wraps the given login function so that a successful login
+// is cached, and a subsequent login with the same username and
+// password within the cache TTL returns the cached identity without
+// calling f.
+func (c *LoginCache) LoginUser(f func(ctx context.Context, username, password string) (*store.Identity, error)) func(ctx context.Context, username, password string) (*store.Identity, error) {
+	if c == nil {
+		return f
+	}
+	return func(ctx context.Context, username, password string) (*store.Identity, error) {
+		key := c.cacheKey(username, password)
+		if id := c.get(ctx, key); id != nil {
+			logger.Debugf("using cached login for %q", username)
+			return id, nil
+		}
+		id, err := f(ctx, username, password)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.set(ctx, key, id); err != nil {
+			logger.Errorf("cannot cache login for %q: %s", username, err)
+		}
+		return id, nil
+	}
+}
+
+// get returns the identity cached under the given key, or nil if there
+// is no unexpired cached login.
+func (c *LoginCache) get(ctx context.Context, key string) *store.Identity {
+	b, err := c.store.Get(ctx, key)
+	if err != nil {
+		if errgo.Cause(err) != simplekv.ErrNotFound {
+			logger.Errorf("cannot get cached login: %s", err)
+		}
+		return nil
+	}
+	var rec loginCacheRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		logger.Errorf("invalid cached login: %s", err)
+		return nil
+	}
+	if rec.Identity == nil || !rec.Expires.After(time.Now()) {
+		return nil
+	}
+	return rec.Identity
+}
+
+// set caches the given identity under the given key.
+func (c *LoginCache) set(ctx context.Context, key string, id *store.Identity) error {
+	rec := loginCacheRecord{
+		Identity: id,
+		Expires:  time.Now().Add(c.ttl),
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(c.store.Set(ctx, key, b, rec.Expires))
+}
+
+// cacheKey returns the key under which a login with the given
+// credentials is cached.
+func (c *LoginCache) cacheKey(username, password string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return "login-cache:" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// countingLoginUser returns a login function that behaves like
+// testLoginUser and counts the number of times it is called.
+func countingLoginUser(n *int) func(ctx context.Context, username, password string) (*store.Identity, error) {
+	return func(ctx context.Context, username, password string) (*store.Identity, error) {
+		*n++
+		return testLoginUser(ctx, username, password)
+	}
+}
+
+func TestLoginCache(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	var calls int
+	loginUser := idputil.NewLoginCache(memsimplekv.NewStore(), time.Minute).LoginUser(countingLoginUser(&calls))
+
+	id, err := loginUser(ctx, "bob", "pass")
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "bob")
+	c.Assert(calls, qt.Equals, 1)
+
+	// A second login with the same credentials is served from the
+	// cache.
+	id, err = loginUser(ctx, "bob", "pass")
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "bob")
+	c.Assert(calls, qt.Equals, 1)
+
+	// Different credentials are not served from the cache.
+	_, err = loginUser(ctx, "bob", "wrong")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	c.Assert(calls, qt.Equals, 2)
+	id, err = loginUser(ctx, "alice", "pass")
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "alice")
+	c.Assert(calls, qt.Equals, 3)
+}
+
+func TestLoginCacheDoesNotCacheFailures(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	var calls int
+	loginUser := idputil.NewLoginCache(memsimplekv.NewStore(), time.Minute).LoginUser(countingLoginUser(&calls))
+
+	for i := 1; i <= 2; i++ {
+		_, err := loginUser(ctx, "bob", "wrong")
+		c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+		c.Assert(calls, qt.Equals, i)
+	}
+}
+
+func TestLoginCacheExpiry(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	var calls int
+	loginUser := idputil.NewLoginCache(memsimplekv.NewStore(), 50*time.Millisecond).LoginUser(countingLoginUser(&calls))
+
+	_, err := loginUser(ctx, "bob", "pass")
+	c.Assert(err, qt.IsNil)
+	_, err = loginUser(ctx, "bob", "pass")
+	c.Assert(err, qt.IsNil)
+	c.Assert(calls, qt.Equals, 1)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = loginUser(ctx, "bob", "pass")
+	c.Assert(err, qt.IsNil)
+	c.Assert(calls, qt.Equals, 2)
+}
+
+func TestLoginCacheDisabled(t *testing.T) {
+	c := qt.New(t)
+	lc := idputil.NewLoginCache(memsimplekv.NewStore(), 0)
+	c.Assert(lc, qt.IsNil)
+	var calls int
+	loginUser := lc.LoginUser(countingLoginUser(&calls))
+	for i := 1; i <= 2; i++ {
+		_, err := loginUser(context.Background(), "bob", "pass")
+		c.Assert(err, qt.IsNil)
+		c.Assert(calls, qt.Equals, i)
+	}
+}
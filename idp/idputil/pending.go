@@ -0,0 +1,147 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+// defaultPendingTimeout is the length of time a pending entry will be
+// counted against a limit if no timeout has been configured.
+const defaultPendingTimeout = time.Hour
+
+// PendingLimitParams holds the parameters for a PendingLimiter.
+type PendingLimitParams struct {
+	// MaxPerEmail holds the maximum number of pending entries that
+	// may be outstanding for a single email address. If this is
+	// zero then there is no limit.
+	MaxPerEmail int
+
+	// MaxPerIP holds the maximum number of pending entries that may
+	// be outstanding for a single source IP address. If this is
+	// zero then there is no limit.
+	MaxPerIP int
+
+	// Timeout holds the length of time after which a pending entry
+	// expires and no longer counts against the limits. If this is
+	// zero then a default of one hour is used.
+	Timeout time.Duration
+}
+
+// A PendingLimiter limits the number of pending (unverified)
+// operations, such as registrations, that can be outstanding for a
+// given email address or source IP address. A nil PendingLimiter
+// imposes no limits.
+type PendingLimiter struct {
+	store  simplekv.Store
+	params PendingLimitParams
+}
+
+// NewPendingLimiter creates a new PendingLimiter that stores its state
+// in the given store.
+func NewPendingLimiter(store simplekv.Store, p PendingLimitParams) *PendingLimiter {
+	if p.Timeout == 0 {
+		p.Timeout = defaultPendingTimeout
+	}
+	return &PendingLimiter{
+		store:  store,
+		params: p,
+	}
+}
+
+// Add records a new pending entry for the given email address and IP
+// address, either of which may be empty. If adding the entry would
+// exceed either of the configured limits then no entry is recorded and
+// an error with a cause of params.ErrTooManyRequests is returned.
+func (l *PendingLimiter) Add(ctx context.Context, email, ip string) error {
+	if l == nil {
+		return nil
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	if err := l.add(ctx, "email:"+email, email, l.params.MaxPerEmail); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrTooManyRequests))
+	}
+	if err := l.add(ctx, "ip:"+ip, ip, l.params.MaxPerIP); err != nil {
+		// Give back the email entry so that it is not counted
+		// against a request that never happened.
+		l.remove(ctx, "email:"+email, email, l.params.MaxPerEmail)
+		return errgo.Mask(err, errgo.Is(params.ErrTooManyRequests))
+	}
+	return nil
+}
+
+// Done removes a pending entry previously recorded with Add for the
+// given email address and IP address. It should be called once the
+// pending operation has completed so that it no longer counts against
+// the limits. It is not an error if there is no matching entry.
+func (l *PendingLimiter) Done(ctx context.Context, email, ip string) {
+	if l == nil {
+		return
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	l.remove(ctx, "email:"+email, email, l.params.MaxPerEmail)
+	l.remove(ctx, "ip:"+ip, ip, l.params.MaxPerIP)
+}
+
+func (l *PendingLimiter) add(ctx context.Context, key, value string, max int) error {
+	if value == "" || max <= 0 {
+		return nil
+	}
+	now := time.Now()
+	expire := now.Add(l.params.Timeout)
+	err := l.store.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		entries := unexpiredEntries(old, now)
+		if len(entries) >= max {
+			return nil, errgo.WithCausef(nil, params.ErrTooManyRequests, "too many pending requests for %s, please try again later", value)
+		}
+		return json.Marshal(append(entries, expire))
+	})
+	return errgo.Mask(err, errgo.Is(params.ErrTooManyRequests))
+}
+
+func (l *PendingLimiter) remove(ctx context.Context, key, value string, max int) {
+	if value == "" || max <= 0 {
+		return
+	}
+	now := time.Now()
+	err := l.store.Update(ctx, key, now.Add(l.params.Timeout), func(old []byte) ([]byte, error) {
+		entries := unexpiredEntries(old, now)
+		if len(entries) > 0 {
+			entries = entries[1:]
+		}
+		return json.Marshal(entries)
+	})
+	if err != nil {
+		logger.Errorf("cannot remove pending entry for %s: %s", value, err)
+	}
+}
+
+// unexpiredEntries decodes the given stored list of expiry times and
+// returns those that have not expired at the given time.
+func unexpiredEntries(b []byte, now time.Time) []time.Time {
+	var entries []time.Time
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &entries); err != nil {
+			// A corrupt entry is treated as empty, it will be
+			// overwritten by the update.
+			logger.Errorf("cannot unmarshal pending entries: %s", err)
+			return nil
+		}
+	}
+	unexpired := entries[:0]
+	for _, t := range entries {
+		if t.After(now) {
+			unexpired = append(unexpired, t)
+		}
+	}
+	return unexpired
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/params"
+)
+
+func TestPendingLimiterEmail(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	l := idputil.NewPendingLimiter(memsimplekv.NewStore(), idputil.PendingLimitParams{
+		MaxPerEmail: 2,
+	})
+	err := l.Add(ctx, "bob@example.com", "1.2.3.4")
+	c.Assert(err, qt.IsNil)
+	err = l.Add(ctx, "Bob@Example.com", "1.2.3.5")
+	c.Assert(err, qt.IsNil)
+	err = l.Add(ctx, "bob@example.com", "1.2.3.6")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrTooManyRequests)
+	c.Assert(err, qt.ErrorMatches, `too many pending requests for bob@example.com, please try again later`)
+
+	// Other addresses are unaffected.
+	err = l.Add(ctx, "alice@example.com", "1.2.3.6")
+	c.Assert(err, qt.IsNil)
+
+	// Completing a pending entry frees up capacity.
+	l.Done(ctx, "bob@example.com", "1.2.3.4")
+	err = l.Add(ctx, "bob@example.com", "1.2.3.6")
+	c.Assert(err, qt.IsNil)
+}
+
+func TestPendingLimiterIP(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	l := idputil.NewPendingLimiter(memsimplekv.NewStore(), idputil.PendingLimitParams{
+		MaxPerEmail: 2,
+		MaxPerIP:    1,
+	})
+	err := l.Add(ctx, "bob@example.com", "1.2.3.4")
+	c.Assert(err, qt.IsNil)
+	err = l.Add(ctx, "alice@example.com", "1.2.3.4")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrTooManyRequests)
+	c.Assert(err, qt.ErrorMatches, `too many pending requests for 1.2.3.4, please try again later`)
+
+	// The failed attempt must not have counted against the email
+	// address.
+	err = l.Add(ctx, "alice@example.com", "1.2.3.5")
+	c.Assert(err, qt.IsNil)
+	err = l.Add(ctx, "alice@example.com", "1.2.3.6")
+	c.Assert(err, qt.IsNil)
+}
+
+func TestPendingLimiterExpiry(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	l := idputil.NewPendingLimiter(memsimplekv.NewStore(), idputil.PendingLimitParams{
+		MaxPerEmail: 1,
+		Timeout:     10 * time.Millisecond,
+	})
+	err := l.Add(ctx, "bob@example.com", "")
+	c.Assert(err, qt.IsNil)
+	err = l.Add(ctx, "bob@example.com", "")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrTooManyRequests)
+	time.Sleep(20 * time.Millisecond)
+	err = l.Add(ctx, "bob@example.com", "")
+	c.Assert(err, qt.IsNil)
+}
+
+func TestPendingLimiterNil(t *testing.T) {
+	c := qt.New(t)
+	var l *idputil.PendingLimiter
+	c.Assert(l.Add(context.Background(), "bob@example.com", "1.2.3.4"), qt.IsNil)
+	l.Done(context.Background(), "bob@example.com", "1.2.3.4")
+}
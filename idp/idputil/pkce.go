@@ -0,0 +1,98 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"regexp"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// Code challenge methods supported for PKCE (see RFC 7636).
+const (
+	CodeChallengeMethodPlain = "plain"
+	CodeChallengeMethodS256  = "S256"
+)
+
+// codeChallengePattern matches valid code challenges and code
+// verifiers.
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// A CodeChallenge holds a PKCE code challenge sent by a relying party
+// that starts a redirect login. The code returned at the end of the
+// login can only be exchanged for a discharge token by presenting the
+// matching code verifier.
+type CodeChallenge struct {
+	// Challenge holds the code challenge.
+	Challenge string `json:",omitempty"`
+
+	// Method holds the method used to derive the challenge from the
+	// verifier.
+	Method string `json:",omitempty"`
+}
+
+// NewCodeChallenge validates the given code challenge and method and
+// returns the CodeChallenge they represent. If challenge is empty then
+// nil is returned. If method is empty the "plain" method is used.
+func NewCodeChallenge(challenge, method string) (*CodeChallenge, error) {
+	if challenge == "" {
+		if method != "" {
+			return nil, errgo.Newf("code_challenge_method specified without code_challenge")
+		}
+		return nil, nil
+	}
+	switch method {
+	case "":
+		method = CodeChallengeMethodPlain
+	case CodeChallengeMethodPlain, CodeChallengeMethodS256:
+	default:
+		return nil, errgo.Newf("unsupported code_challenge_method %q", method)
+	}
+	if !codeChallengePattern.MatchString(challenge) {
+		return nil, errgo.Newf("invalid code_challenge")
+	}
+	return &CodeChallenge{
+		Challenge: challenge,
+		Method:    method,
+	}, nil
+}
+
+// Verify reports whether the given code verifier matches the
+// challenge.
+func (cc *CodeChallenge) Verify(verifier string) bool {
+	if !codeChallengePattern.MatchString(verifier) {
+		return false
+	}
+	if cc.Method == CodeChallengeMethodS256 {
+		hash := sha256.Sum256([]byte(verifier))
+		verifier = base64.RawURLEncoding.EncodeToString(hash[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(verifier), []byte(cc.Challenge)) == 1
+}
+
+type codeChallengeKey struct{}
+
+// ContextWithCodeChallenge returns a context recording the PKCE code
+// challenge of the redirect login being processed. The identity
+// manager records the challenge for requests to identity providers
+// that carry the standard login state; identity providers that keep
+// the login state elsewhere should use the returned context when
+// calling the VisitCompleter.
+func ContextWithCodeChallenge(ctx context.Context, cc *CodeChallenge) context.Context {
+	if cc == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, codeChallengeKey{}, cc)
+}
+
+// CodeChallengeFromContext returns the PKCE code challenge recorded in
+// the given context, if any.
+func CodeChallengeFromContext(ctx context.Context) *CodeChallenge {
+	cc, _ := ctx.Value(codeChallengeKey{}).(*CodeChallenge)
+	return cc
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/idp/idputil"
+)
+
+const (
+	testCodeVerifier      = "dBjftJeZ4CVP-mJ0kZ8Ci0Eoqz9WBA5gBiIcCeQKp4Q"
+	testCodeChallengeS256 = "cCJ2Vc8c_2zB2MUH6jtXnhsknY2UALxnYfUVJki1uJo"
+	otherTestCodeVerifier = "Wv3yzHcRzAq4PTvmXqWrFn3xKtnjYy0r0zHpPvKmUsY"
+)
+
+var newCodeChallengeTests = []struct {
+	about       string
+	challenge   string
+	method      string
+	expect      *idputil.CodeChallenge
+	expectError string
+}{{
+	about: "no challenge",
+}, {
+	about:     "S256",
+	challenge: testCodeChallengeS256,
+	method:    "S256",
+	expect: &idputil.CodeChallenge{
+		Challenge: testCodeChallengeS256,
+		Method:    "S256",
+	},
+}, {
+	about:     "default method",
+	challenge: testCodeVerifier,
+	expect: &idputil.CodeChallenge{
+		Challenge: testCodeVerifier,
+		Method:    "plain",
+	},
+}, {
+	about:       "method without challenge",
+	method:      "S256",
+	expectError: `code_challenge_method specified without code_challenge`,
+}, {
+	about:       "unsupported method",
+	challenge:   testCodeChallengeS256,
+	method:      "S512",
+	expectError: `unsupported code_challenge_method "S512"`,
+}, {
+	about:       "challenge too short",
+	challenge:   "abc",
+	method:      "plain",
+	expectError: `invalid code_challenge`,
+}, {
+	about:       "challenge too long",
+	challenge:   strings.Repeat("a", 129),
+	method:      "plain",
+	expectError: `invalid code_challenge`,
+}, {
+	about:       "invalid characters",
+	challenge:   testCodeVerifier[:42] + "+",
+	method:      "plain",
+	expectError: `invalid code_challenge`,
+}}
+
+func TestNewCodeChallenge(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range newCodeChallengeTests {
+		c.Run(test.about, func(c *qt.C) {
+			cc, err := idputil.NewCodeChallenge(test.challenge, test.method)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(cc, qt.DeepEquals, test.expect)
+		})
+	}
+}
+
+func TestCodeChallengeVerify(t *testing.T) {
+	c := qt.New(t)
+	cc, err := idputil.NewCodeChallenge(testCodeChallengeS256, "S256")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cc.Verify(testCodeVerifier), qt.Equals, true)
+	c.Assert(cc.Verify(otherTestCodeVerifier), qt.Equals, false)
+	c.Assert(cc.Verify(testCodeChallengeS256), qt.Equals, false)
+	c.Assert(cc.Verify(""), qt.Equals, false)
+
+	cc, err = idputil.NewCodeChallenge(testCodeVerifier, "plain")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cc.Verify(testCodeVerifier), qt.Equals, true)
+	c.Assert(cc.Verify(otherTestCodeVerifier), qt.Equals, false)
+}
+
+func TestCodeChallengeContext(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	c.Assert(idputil.CodeChallengeFromContext(ctx), qt.IsNil)
+	c.Assert(idputil.ContextWithCodeChallenge(ctx, nil), qt.Equals, ctx)
+	cc := &idputil.CodeChallenge{
+		Challenge: testCodeChallengeS256,
+		Method:    "S256",
+	}
+	ctx = idputil.ContextWithCodeChallenge(ctx, cc)
+	c.Assert(idputil.CodeChallengeFromContext(ctx), qt.Equals, cc)
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// RedactConfig returns the given identity provider parameters in the
+// form they would be written in the configuration file, with the
+// values of all settings that are not known to be safe to show replaced
+// by Redacted. A setting is only shown if the struct field holding it
+// has the tag redact:"show"; fields without the tag are always
+// redacted so that new settings are hidden unless they are explicitly
+// marked as safe. Any passwords included in shown URLs are also
+// redacted.
+func RedactConfig(params interface{}) (map[string]interface{}, error) {
+	if params == nil {
+		return nil, nil
+	}
+	data, err := yaml.Marshal(params)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal configuration")
+	}
+	var v map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal configuration")
+	}
+	m, _ := redactValue(reflect.TypeOf(params), v).(map[string]interface{})
+	return m, nil
+}
+
+// redactValue redacts the given value decoded from YAML, which was
+// encoded from a value of type t, converting any maps to
+// map[string]interface{} so that they can be encoded as JSON.
+func redactValue(t reflect.Type, v interface{}) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		if t.Kind() == reflect.Map {
+			for k, val := range v {
+				m[fmt.Sprint(k)] = redactValue(t.Elem(), val)
+			}
+			return m
+		}
+		fields := shownFields(t)
+		for k, val := range v {
+			key := fmt.Sprint(k)
+			ft, ok := fields[key]
+			if !ok {
+				m[key] = Redacted
+				continue
+			}
+			m[key] = redactValue(ft, val)
+		}
+		return m
+	case []interface{}:
+		vs := make([]interface{}, len(v))
+		for i, val := range v {
+			if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+				vs[i] = redactValue(t.Elem(), val)
+			} else {
+				vs[i] = Redacted
+			}
+		}
+		return vs
+	case string:
+		return redactURL(v)
+	}
+	return v
+}
+
+// shownFields returns the types of the fields of the struct type t
+// that are tagged as safe to show, keyed by their names in the YAML
+// encoding.
+func shownFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	if t.Kind() != reflect.Struct {
+		return fields
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("redact") != "show" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// redactURL redacts the password in s if s is a URL that contains
+// one.
+func redactURL(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	u.User = url.UserPassword(u.User.Username(), Redacted)
+	return u.String()
+}
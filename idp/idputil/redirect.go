@@ -0,0 +1,99 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// reservedRedirectParams holds the query parameters that are set by
+// the identity manager itself on redirect login responses. These may
+// not be overridden by RedirectParams.
+var reservedRedirectParams = map[string]bool{
+	"code":       true,
+	"state":      true,
+	"error":      true,
+	"error_code": true,
+}
+
+// RedirectParams holds additional query parameters to add to the
+// return_to address when a redirect login completes successfully.
+// Each key is the name of a query parameter and the associated value
+// is the source of the parameter value, which may be one of:
+//
+//	username    the username of the identity
+//	name        the display name of the identity
+//	email       the email address of the identity
+//	idp         the name of the identity provider used to log in
+//	idp:<name>  the value named <name> supplied by the identity
+//	            provider, see ContextWithRedirectParams
+//
+// Parameters that have no value are omitted.
+type RedirectParams map[string]string
+
+// Validate checks that none of the parameters override a reserved
+// parameter and that all the value sources are known.
+func (p RedirectParams) Validate() error {
+	for k, v := range p {
+		if k == "" || reservedRedirectParams[k] {
+			return errgo.Newf("cannot set redirect parameter %q", k)
+		}
+		switch {
+		case v == "username", v == "name", v == "email", v == "idp":
+		case strings.HasPrefix(v, "idp:") && len(v) > len("idp:"):
+		default:
+			return errgo.Newf("invalid source %q for redirect parameter %q", v, k)
+		}
+	}
+	return nil
+}
+
+// Values returns the query parameters to add to the redirect for a
+// login as the given identity. Values supplied by the identity provider
+// are taken from the given context.
+func (p RedirectParams) Values(ctx context.Context, id *store.Identity) url.Values {
+	v := make(url.Values)
+	idpValues, _ := ctx.Value(redirectParamsKey{}).(url.Values)
+	for k, src := range p {
+		if reservedRedirectParams[k] {
+			continue
+		}
+		var val string
+		switch src {
+		case "username":
+			val = id.Username
+		case "name":
+			val = id.Name
+		case "email":
+			val = id.Email
+		case "idp":
+			val = id.ProviderID.Provider()
+		default:
+			if strings.HasPrefix(src, "idp:") {
+				val = idpValues.Get(strings.TrimPrefix(src, "idp:"))
+			}
+		}
+		if val != "" {
+			v.Set(k, val)
+		}
+	}
+	return v
+}
+
+type redirectParamsKey struct{}
+
+// ContextWithRedirectParams returns a context containing the given
+// values supplied by an identity provider. Identity providers should
+// use the returned context when calling VisitCompleter.RedirectSuccess
+// so that the values can be passed on to the requesting service if
+// the identity manager has been configured to do so.
+func ContextWithRedirectParams(ctx context.Context, v url.Values) context.Context {
+	return context.WithValue(ctx, redirectParamsKey{}, v)
+}
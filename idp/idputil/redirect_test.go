@@ -0,0 +1,83 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/store"
+)
+
+var redirectParamsValidateTests = []struct {
+	params      idputil.RedirectParams
+	expectError string
+}{{
+	params: idputil.RedirectParams{
+		"user":  "username",
+		"name":  "name",
+		"email": "email",
+		"idp":   "idp",
+		"ss":    "idp:session_state",
+	},
+}, {
+	params:      idputil.RedirectParams{"code": "username"},
+	expectError: `cannot set redirect parameter "code"`,
+}, {
+	params:      idputil.RedirectParams{"state": "username"},
+	expectError: `cannot set redirect parameter "state"`,
+}, {
+	params:      idputil.RedirectParams{"x": "groups"},
+	expectError: `invalid source "groups" for redirect parameter "x"`,
+}, {
+	params:      idputil.RedirectParams{"x": "idp:"},
+	expectError: `invalid source "idp:" for redirect parameter "x"`,
+}}
+
+func TestRedirectParamsValidate(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range redirectParamsValidateTests {
+		err := test.params.Validate()
+		if test.expectError == "" {
+			c.Check(err, qt.IsNil)
+		} else {
+			c.Check(err, qt.ErrorMatches, test.expectError)
+		}
+	}
+}
+
+func TestRedirectParamsValues(t *testing.T) {
+	c := qt.New(t)
+	p := idputil.RedirectParams{
+		"user":  "username",
+		"email": "email",
+		"name":  "name",
+		"idp":   "idp",
+		"ss":    "idp:session_state",
+		"nonce": "idp:nonce",
+		"state": "username",
+	}
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Email:      "bob@example.com",
+	}
+	ctx := idputil.ContextWithRedirectParams(context.Background(), url.Values{
+		"session_state": {"abc"},
+	})
+	c.Assert(p.Values(ctx, id), qt.DeepEquals, url.Values{
+		"user":  {"bob"},
+		"email": {"bob@example.com"},
+		"idp":   {"test"},
+		"ss":    {"abc"},
+	})
+	c.Assert(p.Values(context.Background(), id)["ss"], qt.IsNil)
+
+	var nilParams idputil.RedirectParams
+	c.Assert(nilParams.Values(ctx, id), qt.DeepEquals, url.Values{})
+}
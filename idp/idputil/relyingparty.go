@@ -0,0 +1,126 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"sort"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/canonical/candid/store"
+)
+
+// A RelyingPartyRule restricts which users may complete a redirect
+// login to a relying party. A user is allowed if they are a member of
+// any of AllowGroups or match any of AllowAttributes. A rule with no
+// groups or attributes allows every user.
+type RelyingPartyRule struct {
+	// AllowGroups holds the groups whose members are allowed to log
+	// in to the relying party.
+	AllowGroups []string `yaml:"allow-groups"`
+
+	// AllowAttributes holds identity attribute values that allow a
+	// user to log in to the relying party.
+	AllowAttributes []AttributeValue `yaml:"allow-attributes"`
+
+	// RequirePKCE is set if redirect logins to the relying party
+	// must use PKCE, that is they must send a code_challenge.
+	RequirePKCE bool `yaml:"require-pkce"`
+}
+
+// RelyingPartyHost returns the canonical form of the given relying
+// party host name, as used for the keys of relying party rules. Host
+// names are not case sensitive and any port is ignored, so that a rule
+// applies to every service on the host.
+func RelyingPartyHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// An AttributeValue holds a value that an identity attribute must
+// have. The attributes are the same as those supported by
+// store.GroupRule.
+type AttributeValue struct {
+	Attribute string `yaml:"attribute"`
+	Value     string `yaml:"value"`
+}
+
+// Validate checks that all the attributes in the rule are known.
+func (r RelyingPartyRule) Validate() error {
+	for _, a := range r.AllowAttributes {
+		if !store.ValidAttribute(a.Attribute) {
+			return errgo.Newf("invalid attribute %q", a.Attribute)
+		}
+	}
+	return nil
+}
+
+// Allow reports whether the given identity, which is a member of the
+// given groups, is allowed to log in to the relying party.
+func (r RelyingPartyRule) Allow(id *store.Identity, groups []string) bool {
+	if len(r.AllowGroups) == 0 && len(r.AllowAttributes) == 0 {
+		return true
+	}
+	for _, g := range r.AllowGroups {
+		for _, ug := range groups {
+			if g == ug {
+				return true
+			}
+		}
+	}
+	for _, a := range r.AllowAttributes {
+		if store.MatchAttribute(id, a.Attribute, a.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// A GroupMask limits the groups declared to a relying party in
+// discharge macaroons, so that a relying party need not learn the names
+// of all the groups a user is a member of. The relying party is
+// identified by the public key with which it adds third party caveats.
+type GroupMask struct {
+	// PublicKey holds the public key of the relying party.
+	PublicKey *bakery.PublicKey `yaml:"public-key"`
+
+	// Groups maps each group that may be declared to the relying
+	// party to the name by which the relying party knows it. If the
+	// alias is empty the group is declared with its own name. Groups
+	// that are not in the map are not declared to the relying party.
+	Groups map[string]string `yaml:"groups"`
+}
+
+// Validate checks that the mask has a public key.
+func (m GroupMask) Validate() error {
+	if m.PublicKey == nil {
+		return errgo.Newf("public-key not specified")
+	}
+	return nil
+}
+
+// Apply returns the names by which the relying party knows those of
+// the given groups that may be declared to it, in sorted order. Groups
+// that share an alias are only included once.
+func (m GroupMask) Apply(groups []string) []string {
+	seen := make(map[string]bool)
+	masked := make([]string, 0, len(groups))
+	for _, g := range groups {
+		alias, ok := m.Groups[g]
+		if !ok {
+			continue
+		}
+		if alias == "" {
+			alias = g
+		}
+		if seen[alias] {
+			continue
+		}
+		seen[alias] = true
+		masked = append(masked, alias)
+	}
+	sort.Strings(masked)
+	return masked
+}
@@ -0,0 +1,26 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/idp/idputil"
+)
+
+func TestGroupMaskApply(t *testing.T) {
+	c := qt.New(t)
+	m := idputil.GroupMask{
+		Groups: map[string]string{
+			"internal-ops": "ops",
+			"sre":          "ops",
+			"admins":       "",
+			"users":        "a-users",
+		},
+	}
+	c.Assert(m.Apply([]string{"admins", "internal-ops", "secret", "sre", "users"}), qt.DeepEquals, []string{"a-users", "admins", "ops"})
+	c.Assert(m.Apply(nil), qt.DeepEquals, []string{})
+}
@@ -0,0 +1,28 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import "context"
+
+type sessionIDKey struct{}
+
+// ContextWithSessionID returns a context recording the correlation ID
+// of the anonymous session that the login being processed upgrades.
+// As with ContextWithCodeChallenge, the identity manager records the
+// session for requests that carry the standard login state; identity
+// providers that keep the login state elsewhere should use the
+// returned context when calling the VisitCompleter.
+func ContextWithSessionID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, sessionIDKey{}, id)
+}
+
+// SessionIDFromContext returns the anonymous session correlation ID
+// recorded in the given context, if any.
+func SessionIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey{}).(string)
+	return id
+}
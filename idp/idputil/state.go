@@ -0,0 +1,168 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp/idputil/secret"
+	"github.com/canonical/candid/store"
+)
+
+// defaultStateTimeout is the length of time a stored state can be used
+// if no timeout has been configured.
+const defaultStateTimeout = 15 * time.Minute
+
+// A StateStore holds the state of logins between redirecting the user
+// to an external identity provider and handling the provider's
+// callback. The state is held in a key-value store, so when the store
+// is shared between servers the callback can be handled by a different
+// server from the one that made the redirect. Each state can only be
+// used once.
+type StateStore struct {
+	store          simplekv.Store
+	timeout        time.Duration
+	tokenGenerator *TokenGenerator
+}
+
+// NewStateStore creates a new StateStore that holds state in the given
+// store for the given length of time. If timeout is zero a default of
+// 15 minutes is used. The keys of the stored states are generated with
+// the given TokenGenerator, which may be nil.
+func NewStateStore(store simplekv.Store, timeout time.Duration, tokenGenerator *TokenGenerator) *StateStore {
+	if timeout == 0 {
+		timeout = defaultStateTimeout
+	}
+	return &StateStore{
+		store:          store,
+		timeout:        timeout,
+		tokenGenerator: tokenGenerator,
+	}
+}
+
+// A stateEntry is the stored form of a state.
+type stateEntry struct {
+	Value   json.RawMessage
+	Expires time.Time
+}
+
+// Put stores the given value, which must be marshalable as JSON, and
+// returns the random key with which it can be retrieved. The key is
+// suitable for use as an OAuth2 state parameter.
+func (s *StateStore) Put(ctx context.Context, v interface{}) (string, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	key, err := s.tokenGenerator.Generate()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	entry := stateEntry{
+		Value:   value,
+		Expires: time.Now().Add(s.timeout),
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		// This should be impossible.
+		panic(err)
+	}
+	if err := s.store.Set(ctx, stateKey(key), b, entry.Expires); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return key, nil
+}
+
+// Take retrieves the value stored with the given key into v and marks
+// it as used. If there is no such value, or it has expired or has
+// already been taken, an error with a cause of store.ErrNotFound is
+// returned.
+func (s *StateStore) Take(ctx context.Context, key string, v interface{}) error {
+	if key == "" {
+		return errgo.WithCausef(nil, store.ErrNotFound, "state not found")
+	}
+	var entry stateEntry
+	err := s.store.Update(ctx, stateKey(key), time.Now(), func(old []byte) ([]byte, error) {
+		if len(old) == 0 {
+			return nil, errgo.WithCausef(nil, store.ErrNotFound, "state not found")
+		}
+		if err := json.Unmarshal(old, &entry); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return []byte{}, nil
+	})
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			err = errgo.WithCausef(err, store.ErrNotFound, "state not found")
+		}
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	if entry.Expires.Before(time.Now()) {
+		return errgo.WithCausef(nil, store.ErrNotFound, "state expired")
+	}
+	return errgo.Mask(json.Unmarshal(entry.Value, v))
+}
+
+// A loginEntry is the stored form of a value added with PutLogin.
+type loginEntry struct {
+	// CookieState holds the verification string of the login state
+	// cookie held by the browser that started the login.
+	CookieState string
+
+	// Value holds the stored value.
+	Value json.RawMessage
+}
+
+// PutLogin stores the given value, as Put does, for a login started by
+// a browser holding a login state cookie with the given verification
+// string, normally the state parameter of the request that started the
+// login (see State). The value can only be retrieved by TakeLogin with
+// a request from that browser. If v is nil only the binding to the
+// browser is stored.
+func (s *StateStore) PutLogin(ctx context.Context, cookieState string, v interface{}) (string, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	key, err := s.Put(ctx, loginEntry{
+		CookieState: cookieState,
+		Value:       value,
+	})
+	return key, errgo.Mask(err)
+}
+
+// TakeLogin retrieves the value stored by PutLogin with the given key
+// into v, which may be nil, and marks it as used, as Take does. It
+// also checks that the given request was made by the browser that
+// started the login by decoding that browser's login state cookie,
+// which has the given name, with the given codec. The decoded login
+// state is returned.
+func (s *StateStore) TakeLogin(ctx context.Context, req *http.Request, codec *secret.Codec, cookieName, key string, v interface{}) (*LoginState, error) {
+	var entry loginEntry
+	if err := s.Take(ctx, key, &entry); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	var ls LoginState
+	if err := codec.Cookie(req, cookieName, entry.CookieState, &ls); err != nil {
+		return nil, errgo.Notef(err, "login not started by this browser")
+	}
+	if v != nil {
+		if err := json.Unmarshal(entry.Value, v); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return &ls, nil
+}
+
+// stateKey returns the key used to hold the state with the given key in
+// the key-value store, which may also be used for other purposes.
+func stateKey(key string) string {
+	return "state#" + key
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/idp/idputil/secret"
+	"github.com/canonical/candid/store"
+)
+
+type testState struct {
+	ReturnTo string
+	Nonce    string
+}
+
+func TestStateStoreSharedBetweenServers(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	// Two servers sharing the same backing store.
+	server1 := idputil.NewStateStore(kv, time.Minute, nil)
+	server2 := idputil.NewStateStore(kv, time.Minute, nil)
+
+	key, err := server1.Put(ctx, testState{ReturnTo: "https://example.com/callback", Nonce: "1234"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(key, qt.Not(qt.Equals), "")
+
+	var st testState
+	err = server2.Take(ctx, key, &st)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st, qt.DeepEquals, testState{ReturnTo: "https://example.com/callback", Nonce: "1234"})
+
+	// The state can only be used once, on any server.
+	err = server2.Take(ctx, key, &st)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	err = server1.Take(ctx, key, &st)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func TestStateStoreUniqueKeys(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := idputil.NewStateStore(memsimplekv.NewStore(), 0, nil)
+	key1, err := s.Put(ctx, testState{Nonce: "1"})
+	c.Assert(err, qt.IsNil)
+	key2, err := s.Put(ctx, testState{Nonce: "2"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(key1, qt.Not(qt.Equals), key2)
+
+	var st testState
+	err = s.Take(ctx, key2, &st)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Nonce, qt.Equals, "2")
+	err = s.Take(ctx, key1, &st)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Nonce, qt.Equals, "1")
+}
+
+func TestStateStoreExpired(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := idputil.NewStateStore(memsimplekv.NewStore(), time.Millisecond, nil)
+	key, err := s.Put(ctx, testState{Nonce: "1"})
+	c.Assert(err, qt.IsNil)
+	time.Sleep(10 * time.Millisecond)
+	var st testState
+	err = s.Take(ctx, key, &st)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func TestStateStoreNotFound(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := idputil.NewStateStore(memsimplekv.NewStore(), 0, nil)
+	var st testState
+	err := s.Take(ctx, "unknown", &st)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	err = s.Take(ctx, "", &st)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func TestStateStoreLoginBoundToBrowser(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	key, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	codec := secret.NewCodec(key)
+	s := idputil.NewStateStore(memsimplekv.NewStore(), 0, nil)
+
+	// The browser that starts the login holds the login state
+	// cookie.
+	rr := httptest.NewRecorder()
+	cookieState, err := codec.SetCookie(rr, "candid-login", "/", idputil.LoginState{
+		ReturnTo: "https://example.com/callback",
+	})
+	c.Assert(err, qt.IsNil)
+	cookies := rr.Result().Cookies()
+
+	// A request from another browser cannot use the stored state.
+	state, err := s.PutLogin(ctx, cookieState, testState{Nonce: "1"})
+	c.Assert(err, qt.IsNil)
+	req := httptest.NewRequest("GET", "/callback", nil)
+	var st testState
+	_, err = s.TakeLogin(ctx, req, codec, "candid-login", state, &st)
+	c.Assert(err, qt.ErrorMatches, `login not started by this browser: .*`)
+
+	state, err = s.PutLogin(ctx, cookieState, testState{Nonce: "2"})
+	c.Assert(err, qt.IsNil)
+	req = httptest.NewRequest("GET", "/callback", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	ls, err := s.TakeLogin(ctx, req, codec, "candid-login", state, &st)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ls.ReturnTo, qt.Equals, "https://example.com/callback")
+	c.Assert(st.Nonce, qt.Equals, "2")
+
+	// The state can still only be used once.
+	_, err = s.TakeLogin(ctx, req, codec, "candid-login", state, &st)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+
+	// Only the binding need be stored.
+	state, err = s.PutLogin(ctx, cookieState, nil)
+	c.Assert(err, qt.IsNil)
+	ls, err = s.TakeLogin(ctx, req, codec, "candid-login", state, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ls.ReturnTo, qt.Equals, "https://example.com/callback")
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"context"
+	"fmt"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// SuspendedExtraInfoKey is the extra-info key used to mark an identity
+// that has been deactivated because its identity provider reported
+// that the account is suspended. Deactivated identities cannot log in
+// or have macaroons discharged.
+const SuspendedExtraInfoKey = "idp-suspended"
+
+// InactiveExtraInfoKey is the extra-info key used to mark an identity
+// that has been made inactive through the SCIM API. It is separate from
+// SuspendedExtraInfoKey so that an identity provider reactivating an
+// account does not undo a deactivation made by the provisioning system,
+// and vice versa.
+const InactiveExtraInfoKey = "scim-inactive"
+
+// SuspensionParams holds the configuration for detecting accounts that
+// an identity provider reports as suspended.
+type SuspensionParams struct {
+	// Claim holds the name of the claim that indicates whether the
+	// account is suspended.
+	Claim string `yaml:"claim" redact:"show"`
+
+	// Values holds the values of the claim that indicate that the
+	// account is suspended. If this is empty the account is
+	// suspended when the claim is true or "true". If the claim is a
+	// list the account is suspended when any element matches.
+	Values []string `yaml:"values" redact:"show"`
+
+	// Deactivate is set if the identity should be deactivated when
+	// the identity provider reports the account as suspended.
+	Deactivate bool `yaml:"deactivate" redact:"show"`
+
+	// Reactivate is set if a deactivated identity should be
+	// reactivated when the identity provider reports the account as
+	// not suspended.
+	Reactivate bool `yaml:"reactivate" redact:"show"`
+}
+
+// Suspended reports whether the given claims indicate that the account
+// is suspended. If p is nil Suspended always returns false.
+func (p *SuspensionParams) Suspended(claims map[string]interface{}) bool {
+	if p == nil || p.Claim == "" {
+		return false
+	}
+	values := p.Values
+	if len(values) == 0 {
+		values = []string{"true"}
+	}
+	v, ok := claims[p.Claim]
+	if !ok {
+		return false
+	}
+	vs, ok := v.([]interface{})
+	if !ok {
+		vs = []interface{}{v}
+	}
+	for _, v := range vs {
+		s := fmt.Sprint(v)
+		for _, value := range values {
+			if s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsSuspended reports whether the given identity has been deactivated,
+// either because its identity provider reported the account as
+// suspended or because it was made inactive through the SCIM API.
+func IsSuspended(id *store.Identity) bool {
+	return len(id.ExtraInfo[SuspendedExtraInfoKey]) > 0 || len(id.ExtraInfo[InactiveExtraInfoKey]) > 0
+}
+
+// SetSuspended marks the identity with the given provider ID as
+// deactivated, or not, in the given store.
+func SetSuspended(ctx context.Context, st store.Store, pid store.ProviderIdentity, suspended bool) error {
+	op := store.Clear
+	var value []string
+	if suspended {
+		op = store.Set
+		value = []string{"true"}
+	}
+	err := st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: pid,
+		ExtraInfo: map[string][]string{
+			SuspendedExtraInfoKey: value,
+		},
+	}, store.Update{
+		store.ExtraInfo: op,
+	})
+	return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/idp/idputil"
+)
+
+var suspendedTests = []struct {
+	about  string
+	params *idputil.SuspensionParams
+	claims map[string]interface{}
+	expect bool
+}{{
+	about:  "not configured",
+	claims: map[string]interface{}{"suspended": true},
+}, {
+	about:  "boolean true",
+	params: &idputil.SuspensionParams{Claim: "suspended"},
+	claims: map[string]interface{}{"suspended": true},
+	expect: true,
+}, {
+	about:  "boolean false",
+	params: &idputil.SuspensionParams{Claim: "suspended"},
+	claims: map[string]interface{}{"suspended": false},
+}, {
+	about:  "string true",
+	params: &idputil.SuspensionParams{Claim: "suspended"},
+	claims: map[string]interface{}{"suspended": "true"},
+	expect: true,
+}, {
+	about:  "missing claim",
+	params: &idputil.SuspensionParams{Claim: "suspended"},
+	claims: map[string]interface{}{"other": true},
+}, {
+	about: "configured value",
+	params: &idputil.SuspensionParams{
+		Claim:  "status",
+		Values: []string{"locked", "suspended"},
+	},
+	claims: map[string]interface{}{"status": "suspended"},
+	expect: true,
+}, {
+	about: "other value",
+	params: &idputil.SuspensionParams{
+		Claim:  "status",
+		Values: []string{"locked", "suspended"},
+	},
+	claims: map[string]interface{}{"status": "active"},
+}, {
+	about: "list value",
+	params: &idputil.SuspensionParams{
+		Claim:  "flags",
+		Values: []string{"suspended"},
+	},
+	claims: map[string]interface{}{"flags": []interface{}{"mfa", "suspended"}},
+	expect: true,
+}}
+
+func TestSuspended(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range suspendedTests {
+		c.Run(test.about, func(c *qt.C) {
+			c.Assert(test.params.Suspended(test.claims), qt.Equals, test.expect)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"crypto/rand"
+	"math"
+	"math/big"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+const (
+	// DefaultTokenCharset holds the characters used in generated
+	// tokens when no charset is configured.
+	DefaultTokenCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+	// DefaultTokenLength holds the length of generated tokens when
+	// no length is configured.
+	DefaultTokenLength = 32
+
+	// MinTokenEntropy holds the minimum number of bits of entropy a
+	// TokenGenerator may be configured to produce.
+	MinTokenEntropy = 128
+)
+
+// validTokenChar reports whether the given character may be used in
+// a token charset. Only URL-safe characters are allowed, and "." is
+// excluded because it is used to separate the parts of some tokens.
+func validTokenChar(c byte) bool {
+	switch {
+	case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		return true
+	case c == '-', c == '_', c == '~':
+		return true
+	}
+	return false
+}
+
+// A TokenGenerator generates the random tokens and identifiers used by
+// the identity manager, such as password reset tokens and API tokens.
+// Tokens are drawn uniformly from a configured charset using
+// crypto/rand. A nil TokenGenerator generates tokens of
+// DefaultTokenLength characters from DefaultTokenCharset.
+type TokenGenerator struct {
+	length  int
+	charset string
+}
+
+// NewTokenGenerator returns a TokenGenerator that generates tokens of
+// the given length using characters from the given charset. If length
+// is zero DefaultTokenLength is used, if charset is empty
+// DefaultTokenCharset is used. An error is returned if the charset is
+// invalid or the resulting tokens would have fewer than
+// MinTokenEntropy bits of entropy.
+func NewTokenGenerator(length int, charset string) (*TokenGenerator, error) {
+	if length == 0 {
+		length = DefaultTokenLength
+	}
+	if charset == "" {
+		charset = DefaultTokenCharset
+	}
+	if length < 0 {
+		return nil, errgo.Newf("invalid token length %d", length)
+	}
+	seen := make(map[byte]bool)
+	for i := 0; i < len(charset); i++ {
+		c := charset[i]
+		if !validTokenChar(c) {
+			return nil, errgo.Newf("invalid character %q in token charset", c)
+		}
+		if seen[c] {
+			return nil, errgo.Newf("duplicate character %q in token charset", c)
+		}
+		seen[c] = true
+	}
+	if len(charset) < 2 {
+		return nil, errgo.Newf("token charset must contain at least two characters")
+	}
+	g := &TokenGenerator{
+		length:  length,
+		charset: charset,
+	}
+	if e := g.Entropy(); e < MinTokenEntropy {
+		return nil, errgo.Newf("tokens of %d characters from a charset of %d characters have %.0f bits of entropy, at least %d are required", length, len(charset), math.Floor(e), MinTokenEntropy)
+	}
+	return g, nil
+}
+
+// params returns the length and charset used by the generator.
+func (g *TokenGenerator) params() (int, string) {
+	if g == nil {
+		return DefaultTokenLength, DefaultTokenCharset
+	}
+	return g.length, g.charset
+}
+
+// Entropy returns the number of bits of entropy in each generated
+// token.
+func (g *TokenGenerator) Entropy() float64 {
+	length, charset := g.params()
+	return float64(length) * math.Log2(float64(len(charset)))
+}
+
+// Generate returns a new random token.
+func (g *TokenGenerator) Generate() (string, error) {
+	length, charset := g.params()
+	return generate(length, charset)
+}
+
+// nameCharset holds the characters used in tokens returned by
+// GenerateName.
+const nameCharset = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// GenerateName returns a new random token that contains only lower
+// case letters and digits, for use in identifiers with a restricted
+// character set, such as user names. The token has at least as much
+// entropy as one returned by Generate.
+func (g *TokenGenerator) GenerateName() (string, error) {
+	length := int(math.Ceil(g.Entropy() / math.Log2(float64(len(nameCharset)))))
+	return generate(length, nameCharset)
+}
+
+// generate returns a token of the given length drawn uniformly from
+// the given charset.
+func generate(length int, charset string) (string, error) {
+	max := big.NewInt(int64(len(charset)))
+	buf := make([]byte, length)
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", errgo.Notef(err, "cannot generate token")
+		}
+		buf[i] = charset[n.Int64()]
+	}
+	return string(buf), nil
+}
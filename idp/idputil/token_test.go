@@ -0,0 +1,135 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/idp/idputil"
+)
+
+var tokenGeneratorTests = []struct {
+	about         string
+	length        int
+	charset       string
+	expectLength  int
+	expectCharset string
+}{{
+	about:         "defaults",
+	expectLength:  idputil.DefaultTokenLength,
+	expectCharset: idputil.DefaultTokenCharset,
+}, {
+	about:         "custom length",
+	length:        64,
+	expectLength:  64,
+	expectCharset: idputil.DefaultTokenCharset,
+}, {
+	about:         "custom charset",
+	length:        40,
+	charset:       "0123456789abcdef",
+	expectLength:  40,
+	expectCharset: "0123456789abcdef",
+}}
+
+func TestTokenGenerator(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range tokenGeneratorTests {
+		c.Run(test.about, func(c *qt.C) {
+			g, err := idputil.NewTokenGenerator(test.length, test.charset)
+			c.Assert(err, qt.IsNil)
+			seen := make(map[string]bool)
+			for i := 0; i < 100; i++ {
+				tok, err := g.Generate()
+				c.Assert(err, qt.IsNil)
+				c.Assert(tok, qt.HasLen, test.expectLength)
+				for _, r := range tok {
+					c.Assert(strings.ContainsRune(test.expectCharset, r), qt.IsTrue, qt.Commentf("unexpected character %q in %q", r, tok))
+				}
+				c.Assert(seen[tok], qt.IsFalse)
+				seen[tok] = true
+			}
+		})
+	}
+}
+
+func TestNilTokenGenerator(t *testing.T) {
+	c := qt.New(t)
+	var g *idputil.TokenGenerator
+	tok, err := g.Generate()
+	c.Assert(err, qt.IsNil)
+	c.Assert(tok, qt.HasLen, idputil.DefaultTokenLength)
+	c.Assert(g.Entropy(), qt.Equals, float64(idputil.DefaultTokenLength*6))
+}
+
+func TestTokenGeneratorGenerateName(t *testing.T) {
+	c := qt.New(t)
+	g, err := idputil.NewTokenGenerator(22, "")
+	c.Assert(err, qt.IsNil)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		name, err := g.GenerateName()
+		c.Assert(err, qt.IsNil)
+		// 22 characters from the default charset hold 132 bits
+		// of entropy, which needs 26 characters from [a-z0-9].
+		c.Assert(name, qt.HasLen, 26)
+		for _, r := range name {
+			c.Assert(strings.ContainsRune("abcdefghijklmnopqrstuvwxyz0123456789", r), qt.IsTrue, qt.Commentf("unexpected character %q in %q", r, name))
+		}
+		c.Assert(seen[name], qt.IsFalse)
+		seen[name] = true
+	}
+}
+
+func TestTokenGeneratorEntropy(t *testing.T) {
+	c := qt.New(t)
+	g, err := idputil.NewTokenGenerator(32, "0123456789abcdef")
+	c.Assert(err, qt.IsNil)
+	c.Assert(g.Entropy(), qt.Equals, float64(128))
+}
+
+var newTokenGeneratorErrorTests = []struct {
+	about       string
+	length      int
+	charset     string
+	expectError string
+}{{
+	about:       "negative length",
+	length:      -1,
+	expectError: `invalid token length -1`,
+}, {
+	about:       "invalid character",
+	charset:     "abc.def",
+	expectError: `invalid character '.' in token charset`,
+}, {
+	about:       "duplicate character",
+	charset:     "abca",
+	expectError: `duplicate character 'a' in token charset`,
+}, {
+	about:       "single character",
+	length:      200,
+	charset:     "a",
+	expectError: `token charset must contain at least two characters`,
+}, {
+	about:       "insufficient entropy",
+	length:      16,
+	expectError: `tokens of 16 characters from a charset of 64 characters have 96 bits of entropy, at least 128 are required`,
+}, {
+	about:       "insufficient entropy with small charset",
+	length:      100,
+	charset:     "01",
+	expectError: `tokens of 100 characters from a charset of 2 characters have 100 bits of entropy, at least 128 are required`,
+}}
+
+func TestNewTokenGeneratorErrors(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range newTokenGeneratorErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			_, err := idputil.NewTokenGenerator(test.length, test.charset)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/juju/names"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// usernameFormatFuncs holds the functions available to username
+// format templates.
+var usernameFormatFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"trim":    strings.TrimSpace,
+	"replace": func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+}
+
+// A UsernameFormat derives the username of a new identity from the
+// information supplied by the identity provider.
+type UsernameFormat struct {
+	tmpl *template.Template
+}
+
+// usernameFormatData holds the values available to username format
+// templates.
+type usernameFormatData struct {
+	// Username holds the username supplied by the identity
+	// provider.
+	Username string
+
+	// Name, FirstName and LastName hold the display name of the
+	// identity and its first and last words. LastName is empty if
+	// the name has only one word.
+	Name      string
+	FirstName string
+	LastName  string
+
+	// Email, EmailLocal and EmailDomain hold the email address of
+	// the identity and the parts before and after the @.
+	Email       string
+	EmailLocal  string
+	EmailDomain string
+
+	// Provider holds the name of the identity provider.
+	Provider string
+}
+
+// NewUsernameFormat parses the given username format, which is a
+// text/template template. The template is executed with the fields
+// Username, Name, FirstName, LastName, Email, EmailLocal, EmailDomain
+// and Provider, and the functions lower, upper, trim and replace
+// (replace old new s). For example:
+//
+//	{{.FirstName | lower}}.{{.LastName | lower}}@example
+func NewUsernameFormat(format string) (*UsernameFormat, error) {
+	tmpl, err := template.New("username-format").Funcs(usernameFormatFuncs).Parse(format)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid username format")
+	}
+	return &UsernameFormat{tmpl: tmpl}, nil
+}
+
+// Format returns the username for the given identity. An error is
+// returned if the format produces an empty username.
+func (f *UsernameFormat) Format(id *store.Identity) (string, error) {
+	d := usernameFormatData{
+		Username: id.Username,
+		Name:     id.Name,
+		Email:    id.Email,
+		Provider: id.ProviderID.Provider(),
+	}
+	if words := strings.Fields(id.Name); len(words) > 0 {
+		d.FirstName = words[0]
+		if len(words) > 1 {
+			d.LastName = words[len(words)-1]
+		}
+	}
+	if i := strings.LastIndex(id.Email, "@"); i >= 0 {
+		d.EmailLocal = id.Email[:i]
+		d.EmailDomain = id.Email[i+1:]
+	}
+	var buf bytes.Buffer
+	if err := f.tmpl.Execute(&buf, d); err != nil {
+		return "", errgo.Notef(err, "cannot format username")
+	}
+	username := strings.TrimSpace(buf.String())
+	if isEmptyName(username) {
+		return "", errgo.Newf("username format produced an empty username for %q", id.ProviderID)
+	}
+	if err := checkFormattedUsername(username); err != nil {
+		return "", errgo.Notef(err, "username format produced an invalid username for %q", id.ProviderID)
+	}
+	return username, nil
+}
+
+// checkFormattedUsername checks that the given username, produced by a
+// username format, is one that an identity provider may create. It
+// must be a valid username, must not be reserved and must not be in
+// the namespace of the identities managed by candid itself.
+func checkFormattedUsername(username string) error {
+	if !names.IsValidUser(username) {
+		return errgo.Newf("invalid username %q", username)
+	}
+	name, domain := username, ""
+	if i := strings.Index(username, "@"); i >= 0 {
+		name, domain = username[:i], username[i+1:]
+	}
+	if ReservedUsernames[name] {
+		return errgo.Newf("username %q is reserved", username)
+	}
+	if domain == "candid" {
+		return errgo.Newf("username %q is in the candid namespace", username)
+	}
+	return nil
+}
+
+// isEmptyName reports whether the name part (before any @domain) of
+// the given username is empty.
+func isEmptyName(username string) bool {
+	if i := strings.Index(username, "@"); i >= 0 {
+		username = username[:i]
+	}
+	return username == ""
+}
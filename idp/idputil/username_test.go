@@ -0,0 +1,114 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package idputil_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/store"
+)
+
+var usernameFormatTests = []struct {
+	about          string
+	format         string
+	id             store.Identity
+	expectUsername string
+	expectError    string
+}{{
+	about:  "first and last name",
+	format: `{{.FirstName | lower}}.{{.LastName | lower}}@{{.EmailDomain}}`,
+	id: store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "1234"),
+		Username:   "asmith",
+		Name:       "Alice Jane Smith",
+		Email:      "asmith@example.com",
+	},
+	expectUsername: "alice.smith@example.com",
+}, {
+	about:  "email local part",
+	format: `{{.EmailLocal | replace "+" "-"}}@{{.Provider}}`,
+	id: store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "1234"),
+		Email:      "bob+candid@example.com",
+	},
+	expectUsername: "bob-candid@test",
+}, {
+	about:  "surrounding space trimmed",
+	format: ` {{.Username | upper}} `,
+	id: store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "1234"),
+		Username:   "bob",
+	},
+	expectUsername: "BOB",
+}, {
+	about:  "empty username",
+	format: `{{.LastName}}@example`,
+	id: store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "1234"),
+		Name:       "Bob",
+	},
+	expectError: `username format produced an empty username for "test:1234"`,
+}, {
+	about:  "invalid characters",
+	format: `{{.Name}}`,
+	id: store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "1234"),
+		Name:       "Bob Smith",
+	},
+	expectError: `username format produced an invalid username for "test:1234": invalid username "Bob Smith"`,
+}, {
+	about:  "reserved username",
+	format: `{{.Username}}`,
+	id: store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "1234"),
+		Username:   "admin",
+	},
+	expectError: `username format produced an invalid username for "test:1234": username "admin" is reserved`,
+}, {
+	about:  "candid namespace",
+	format: `{{.EmailLocal}}@candid`,
+	id: store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "1234"),
+		Email:      "bob@example.com",
+	},
+	expectError: `username format produced an invalid username for "test:1234": username "bob@candid" is in the candid namespace`,
+}, {
+	about:  "unknown field",
+	format: `{{.Surname}}`,
+	id: store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "1234"),
+	},
+	expectError: `cannot format username: .*`,
+}}
+
+func TestUsernameFormat(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range usernameFormatTests {
+		c.Run(test.about, func(c *qt.C) {
+			f, err := idputil.NewUsernameFormat(test.format)
+			c.Assert(err, qt.IsNil)
+			username, err := f.Format(&test.id)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(username, qt.Equals, test.expectUsername)
+
+			// The format is deterministic.
+			username, err = f.Format(&test.id)
+			c.Assert(err, qt.IsNil)
+			c.Assert(username, qt.Equals, test.expectUsername)
+		})
+	}
+}
+
+func TestNewUsernameFormatInvalid(t *testing.T) {
+	c := qt.New(t)
+	_, err := idputil.NewUsernameFormat(`{{.FirstName`)
+	c.Assert(err, qt.ErrorMatches, `invalid username format: .*`)
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/juju/loggo"
 	errgo "gopkg.in/errgo.v1"
@@ -51,26 +52,36 @@ type Params struct {
 	// Name is the name that the identity provider will have within
 	// the identity manager. The name is used as part of the url for
 	// communicating with the identity provider.
-	Name string `yaml:"name"`
+	Name string `yaml:"name" redact:"show"`
 
 	// If Domain is set it will be appended to any usernames or
 	// groups provided by the identity provider. A user created by
 	// this identity provide would be username@domain.
-	Domain string `yaml:"domain"`
+	Domain string `yaml:"domain" redact:"show"`
 
 	// Description is a human readable description that will be used
 	// if a list of providers is shown for a user to choose.
-	Description string `yaml:"description"`
+	Description string `yaml:"description" redact:"show"`
 
 	// Icon contains the URL or path of an icon.
-	Icon string `yaml:"icon"`
+	Icon string `yaml:"icon" redact:"show"`
 
 	// URL is the address of the keystone server.
-	URL string `yaml:"url"`
+	URL string `yaml:"url" redact:"show"`
 
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
-	Hidden bool `yaml:"hidden"`
+	Hidden bool `yaml:"hidden" redact:"show"`
+
+	// Category is the category in which the IDP is grouped in
+	// interactive prompts.
+	Category string `yaml:"category" redact:"show"`
+
+	// LoginCacheTTL holds the length of time for which a successful
+	// username and password login is remembered, so that logging in
+	// again with the same credentials does not contact the keystone
+	// server. If this is zero then logins are not cached.
+	LoginCacheTTL time.Duration `yaml:"login-cache-ttl" redact:"show"`
 }
 
 // NewIdentityProvider creates an interactive keystone identity provider
@@ -98,6 +109,7 @@ type identityProvider struct {
 	params     Params
 	initParams idp.InitParams
 	client     *keystone.Client
+	loginCache *idputil.LoginCache
 }
 
 // Name implements idp.IdentityProvider.Name.
@@ -130,9 +142,20 @@ func (idp *identityProvider) Hidden() bool {
 	return idp.params.Hidden
 }
 
+// Category implements idp.IdentityProvider.Category.
+func (idp *identityProvider) Category() string {
+	return idp.params.Category
+}
+
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (idp *identityProvider) ConfigParams() (string, interface{}) {
+	return "keystone", idp.params
+}
+
 // Init implements idp.IdentityProvider.Init.
 func (idp *identityProvider) Init(_ context.Context, params idp.InitParams) error {
 	idp.initParams = params
+	idp.loginCache = idputil.NewLoginCache(params.KeyValueStore, idp.params.LoginCacheTTL)
 	return nil
 }
 
@@ -155,7 +178,7 @@ func (*identityProvider) GetGroups(ctx context.Context, identity *store.Identity
 // Handle implements idp.IdentityProvider.Handle.
 func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var ls idputil.LoginState
-	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
+	if err := idp.initParams.Codec.Cookie(req, idputil.LoginStateCookieName(idp.initParams.CookieNamePrefix), req.Form.Get("state"), &ls); err != nil {
 		logger.Infof("Invalid login state: %s", err)
 		idputil.BadRequestf(w, "Login failed: invalid login state")
 		return
@@ -169,7 +192,7 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 			Name:        idp.params.Name,
 			URL:         idp.URL(req.Form.Get("state")),
 		}
-		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Template, idp.loginUser)
+		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Template, idp.initParams.FailedLoginDelay.LoginUser(idp.loginCache.LoginUser(idp.loginUser)))
 		if err != nil {
 			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
 		}
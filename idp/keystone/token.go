@@ -42,6 +42,11 @@ func (*tokenIdentityProvider) Interactive() bool {
 	return false
 }
 
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (idp *tokenIdentityProvider) ConfigParams() (string, interface{}) {
+	return "keystone_token", idp.params
+}
+
 // SetInteraction implements idp.IdentityProvider.SetInteraction.
 func (idp *tokenIdentityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
 	ierr.SetInteraction("token", TokenInteractionInfo{
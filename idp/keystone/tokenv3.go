@@ -42,6 +42,11 @@ func (*v3tokenIdentityProvider) Interactive() bool {
 	return false
 }
 
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (idp *v3tokenIdentityProvider) ConfigParams() (string, interface{}) {
+	return "keystonev3_token", idp.params
+}
+
 // Handle implements idp.IdentityProvider.Handle.
 func (idp *v3tokenIdentityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var lr TokenLoginRequest
@@ -18,7 +18,6 @@ import (
 
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/idp/idputil"
-	"github.com/canonical/candid/idp/keystone/internal/keystone"
 	"github.com/canonical/candid/params"
 )
 
@@ -47,6 +46,11 @@ func (*userpassIdentityProvider) Interactive() bool {
 	return false
 }
 
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (idp *userpassIdentityProvider) ConfigParams() (string, interface{}) {
+	return "keystone_userpass", idp.params
+}
+
 // SetInteraction implements idp.IdentityProvider.SetInteraction.
 func (idp *userpassIdentityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID string) {
 	ierr.SetInteraction(form.InteractionMethod, form.InteractionInfo{
@@ -71,12 +75,7 @@ func (idp *userpassIdentityProvider) Handle(ctx context.Context, w http.Response
 		return
 	}
 	m := frm.(map[string]interface{})
-	user, err := idp.doLogin(ctx, keystone.Auth{
-		PasswordCredentials: &keystone.PasswordCredentials{
-			Username: m["username"].(string),
-			Password: m["password"].(string),
-		},
-	})
+	user, err := idp.loginCache.LoginUser(idp.loginUser)(ctx, m["username"].(string), m["password"].(string))
 	if err != nil {
 		idp.initParams.VisitCompleter.Failure(ctx, w, req, idputil.DischargeID(req), errgo.Notef(err, "cannot validate form"))
 		return
@@ -9,13 +9,11 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"net"
 	"net/http"
-	"net/url"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/juju/loggo"
 	"gopkg.in/errgo.v1"
@@ -24,6 +22,7 @@ import (
 
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/internal/monitoring"
 	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
 )
@@ -50,65 +49,96 @@ func init() {
 
 type Params struct {
 	// Name is the name that will be given to the identity provider.
-	Name string `yaml:"name"`
+	Name string `yaml:"name" redact:"show"`
 
 	// Description is the description that will be used with the
 	// identity provider. If this is not set then Name will be used.
-	Description string `yaml:"description"`
+	Description string `yaml:"description" redact:"show"`
 
 	// Icon contains the URL or path of an icon.
-	Icon string `yaml:"icon"`
+	Icon string `yaml:"icon" redact:"show"`
 
 	// Domain is the domain with which all identities created by this
 	// identity provider will be tagged (not including the @ separator).
-	Domain string `yaml:"domain"`
+	Domain string `yaml:"domain" redact:"show"`
 
 	// URL contains an LDAP URL indicating the server to connect to.
-	URL string `yaml:"url"`
+	// If Servers is specified then URL need not be set, if it is set
+	// it will be added to the servers with a weight of 1.
+	URL string `yaml:"url" redact:"show"`
+
+	// Servers contains the LDAP servers that may be connected to,
+	// for example replicas of the same directory. Each login uses a
+	// server selected by weighted round-robin and a server that
+	// cannot be connected to is skipped until it recovers. All
+	// servers must use the same base DN.
+	Servers []Server `yaml:"servers" redact:"show"`
 
 	// CACertificate contains a PEM encoded CA certificate to verify
 	// the ldap connection against.
-	CACertificate string `yaml:"ca-cert"`
+	CACertificate string `yaml:"ca-cert" redact:"show"`
 
 	// DN contains the distinguished name that is used to bind to the
 	// LDAP server to perform searches. If this is empty then the IDP
 	// will bind anonymously and Password will be ignored.
-	DN string `yaml:"dn"`
+	DN string `yaml:"dn" redact:"show"`
 
 	// Password contains the password to use to when binding to the
 	// LDAP server as DN.
 	Password string `yaml:"password"`
 
 	// UserQueryFilter defines the filter for searching users.
-	UserQueryFilter string `yaml:"user-query-filter"`
+	UserQueryFilter string `yaml:"user-query-filter" redact:"show"`
 
 	// UserQueryAttrs defines how user attributes are mapped to attributes in
 	// the LDAP entry.
-	UserQueryAttrs UserQueryAttrs `yaml:"user-query-attrs"`
+	UserQueryAttrs UserQueryAttrs `yaml:"user-query-attrs" redact:"show"`
 
 	// GroupQueryFilter defines the template for the LDAP filter to search for
 	// the groups that a user belongs to. The .User value is defined to hold
 	// the user id being searched for - e.g.
 	//    (&(objectClass=groupOfNames)(member={{.User}}))
-	GroupQueryFilter string `yaml:"group-query-filter"`
+	GroupQueryFilter string `yaml:"group-query-filter" redact:"show"`
 
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
-	Hidden bool `yaml:"hidden"`
+	Hidden bool `yaml:"hidden" redact:"show"`
+
+	// Category is the category in which the IDP is grouped in
+	// interactive prompts.
+	Category string `yaml:"category" redact:"show"`
+
+	// LoginCacheTTL holds the length of time for which a successful
+	// login is remembered, so that logging in again with the same
+	// username and password does not contact the LDAP server. If
+	// this is zero then logins are not cached.
+	LoginCacheTTL time.Duration `yaml:"login-cache-ttl" redact:"show"`
+}
+
+// Server holds the details of one of the LDAP servers used by an
+// identity provider.
+type Server struct {
+	// URL contains an LDAP URL indicating the server to connect to.
+	URL string `yaml:"url" redact:"show"`
+
+	// Weight contains the relative weight of the server when
+	// distributing logins between servers. If this is zero a weight
+	// of 1 is used.
+	Weight int `yaml:"weight" redact:"show"`
 }
 
 // UserQueryAttrs defines how user attributes are mapped to attributes in the
 // LDAP entry.
 type UserQueryAttrs struct {
 	// ID defines the attribute used to identify a user.
-	ID string `yaml:"id"`
+	ID string `yaml:"id" redact:"show"`
 
 	// UserQueryEmailAttr defines the attribute for a user e-mail.
-	Email string `yaml:"email"`
+	Email string `yaml:"email" redact:"show"`
 
 	// UserQueryDisplayNameAttr defines the attribute for a user display name.
 	// If not specified, "displayName" is used.
-	DisplayName string `yaml:"display-name"`
+	DisplayName string `yaml:"display-name" redact:"show"`
 }
 
 type groupQueryArg struct {
@@ -159,31 +189,27 @@ func NewIdentityProvider(p Params) (idp.IdentityProvider, error) {
 		groupQueryFilterTemplate: groupQueryFilterTemplate,
 	}
 
-	u, err := url.Parse(p.URL)
-	if err != nil {
-		return nil, errgo.Notef(err, "cannot parse URL")
-	}
-	switch u.Scheme {
-	case "ldap":
-		idp.network = "tcp"
-		// It would be nice to use u.Host and u.Port here, but
-		// these aren't available in go 1.6.
-		host, port, _ := net.SplitHostPort(u.Host)
-		if host == "" {
-			// Asume that the URL didn't specify a port.
-			host = u.Host
-			port = "ldap"
+	servers := p.Servers
+	if p.URL != "" {
+		servers = append([]Server{{URL: p.URL}}, servers...)
+	}
+	if len(servers) == 0 {
+		return nil, errgo.Newf("no LDAP server URL specified")
+	}
+	for i, srv := range servers {
+		s, baseDN, err := newServer(srv, p.CACertificate)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if i == 0 {
+			idp.baseDN = baseDN
+		} else if baseDN != idp.baseDN {
+			return nil, errgo.Newf("server %q has different base DN to %q", srv.URL, servers[0].URL)
 		}
-		idp.address = net.JoinHostPort(host, port)
-		idp.tlsConfig.ServerName = host
-	default:
-		// No other schemes are currently supported.
-		return nil, errgo.Newf("unsupported scheme %q", u.Scheme)
+		idp.servers.servers = append(idp.servers.servers, s)
 	}
-	idp.baseDN = strings.TrimPrefix(u.Path, "/")
-	if p.CACertificate != "" {
-		idp.tlsConfig.RootCAs = x509.NewCertPool()
-		idp.tlsConfig.RootCAs.AppendCertsFromPEM([]byte(p.CACertificate))
+	for _, s := range idp.servers.servers {
+		monitoring.LDAPServerUp(p.Name, s.address, true)
 	}
 	return idp, nil
 }
@@ -192,14 +218,14 @@ type identityProvider struct {
 	params     Params
 	initParams idp.InitParams
 
-	dialLDAP  func(network, addr string) (ldapConn, error)
-	network   string
-	address   string
-	baseDN    string
-	tlsConfig tls.Config
+	dialLDAP func(network, addr string) (ldapConn, error)
+	servers  serverPool
+	baseDN   string
 
 	userQueryAttrs           []string
 	groupQueryFilterTemplate *template.Template
+
+	loginCache *idputil.LoginCache
 }
 
 // Name implements idp.IdentityProvider.Name.
@@ -232,9 +258,20 @@ func (idp *identityProvider) Hidden() bool {
 	return idp.params.Hidden
 }
 
+// Category implements idp.IdentityProvider.Category.
+func (idp *identityProvider) Category() string {
+	return idp.params.Category
+}
+
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (idp *identityProvider) ConfigParams() (string, interface{}) {
+	return "ldap", idp.params
+}
+
 // Init implements idp.IdentityProvider.Init.
 func (idp *identityProvider) Init(ctx context.Context, params idp.InitParams) error {
 	idp.initParams = params
+	idp.loginCache = idputil.NewLoginCache(params.KeyValueStore, idp.params.LoginCacheTTL)
 	return nil
 }
 
@@ -290,7 +327,7 @@ func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Iden
 // Handle implements idp.IdentityProvider.Handle.
 func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var ls idputil.LoginState
-	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
+	if err := idp.initParams.Codec.Cookie(req, idputil.LoginStateCookieName(idp.initParams.CookieNamePrefix), req.Form.Get("state"), &ls); err != nil {
 		logger.Infof("Invalid login state: %s", err)
 		idputil.BadRequestf(w, "Login failed: invalid login state")
 		return
@@ -303,7 +340,7 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 			Name:        idp.params.Name,
 			URL:         idp.URL(req.Form.Get("state")),
 		}
-		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Template, idp.loginUser)
+		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Template, idp.initParams.FailedLoginDelay.LoginUser(idp.loginCache.LoginUser(idp.loginUser)))
 		if err != nil {
 			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
 		}
@@ -418,17 +455,25 @@ func (idp *identityProvider) resolveUsername(conn ldapConn, username string) (st
 // dial establishes a connection to the LDAP server and binds as the
 // search user (if specified).
 func (idp *identityProvider) dial() (ldapConn, error) {
-	conn, err := idp.dialLDAP(idp.network, idp.address)
-	if err != nil {
-		return nil, errgo.Mask(err)
+	var conn ldapConn
+	var err error
+	for _, srv := range idp.servers.order() {
+		conn, err = idp.connect(srv)
+		if err == nil {
+			idp.setServerUp(srv, true)
+			break
+		}
+		logger.Warningf("cannot connect to LDAP server %s: %s", srv.address, err)
+		idp.setServerUp(srv, false)
 	}
-	if err = conn.StartTLS(&idp.tlsConfig); err != nil {
+	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 	if idp.params.DN != "" {
 		logger.Tracef("LDAP bind: dn=%s", idp.params.DN)
 		if err := conn.Bind(idp.params.DN, idp.params.Password); err != nil {
 			logger.Tracef("LDAP bind error: %s", err)
+			conn.Close()
 			return nil, errgo.Mask(err)
 		}
 		logger.Tracef("LDAP bind success", err)
@@ -436,6 +481,26 @@ func (idp *identityProvider) dial() (ldapConn, error) {
 	return conn, nil
 }
 
+// connect makes a connection to the given server.
+func (idp *identityProvider) connect(srv *server) (ldapConn, error) {
+	conn, err := idp.dialLDAP(srv.network, srv.address)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err = conn.StartTLS(&srv.tlsConfig); err != nil {
+		conn.Close()
+		return nil, errgo.Mask(err)
+	}
+	return conn, nil
+}
+
+// setServerUp records whether the given server is healthy.
+func (idp *identityProvider) setServerUp(srv *server, up bool) {
+	if idp.servers.setUp(srv, up) {
+		monitoring.LDAPServerUp(idp.params.Name, srv.address, up)
+	}
+}
+
 func renderTemplate(tmpl *template.Template, ctx interface{}) (string, error) {
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, ctx); err != nil {
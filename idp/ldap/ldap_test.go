@@ -6,9 +6,11 @@ package ldap_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
 
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/idp/idptest"
@@ -44,6 +46,42 @@ var newTests = []struct {
 		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
 		GroupQueryFilter: "(groupAttr=val)",
 	},
+}, {
+	about: "multiple servers",
+	params: ldap.Params{
+		Name: "ldap",
+		Servers: []ldap.Server{{
+			URL:    "ldap://ldap1/dc=example,dc=com",
+			Weight: 2,
+		}, {
+			URL: "ldap://ldap2/dc=example,dc=com",
+		}},
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+}, {
+	about: "no servers",
+	params: ldap.Params{
+		Name:             "ldap",
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+	expectError: `no LDAP server URL specified`,
+}, {
+	about: "servers with different base DNs",
+	params: ldap.Params{
+		Name: "ldap",
+		URL:  "ldap://ldap1/dc=example,dc=com",
+		Servers: []ldap.Server{{
+			URL: "ldap://ldap2/dc=example,dc=org",
+		}},
+		UserQueryFilter:  "(userAttr=val)",
+		UserQueryAttrs:   ldap.UserQueryAttrs{ID: "uid"},
+		GroupQueryFilter: "(groupAttr=val)",
+	},
+	expectError: `server "ldap://ldap2/dc=example,dc=org" has different base DN to "ldap://ldap1/dc=example,dc=com"`,
 }, {
 	about: "unparsable url",
 	params: ldap.Params{
@@ -403,3 +441,127 @@ func (s *ldapSuite) TestHandleUserFilterNoMatch(c *qt.C) {
 	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
 	c.Assert(err, qt.ErrorMatches, `user &#34;user1&#34; not found: not found`)
 }
+
+func (s *ldapSuite) TestHandleLoginCache(c *qt.C) {
+	params := getSampleParams()
+	params.LoginCacheTTL = 100 * time.Millisecond
+	i, err := ldap.NewIdentityProvider(params)
+	c.Assert(err, qt.IsNil)
+	dialer := newMockLDAPDialer(getSampleLdapDB())
+	var dials int
+	ldap.SetLDAP(i, func(network, address string) (ldap.LDAPConn, error) {
+		dials++
+		return dialer.Dial(network, address)
+	})
+	i.Init(context.TODO(), s.idptest.InitParams(c, idpPrefix))
+
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "user1")
+	c.Assert(dials, qt.Equals, 1)
+
+	// Logging in again within the cache TTL does not contact the
+	// LDAP server.
+	id, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "user1")
+	c.Assert(dials, qt.Equals, 1)
+
+	// Failed logins are not cached.
+	for n := 2; n <= 3; n++ {
+		_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "wrong"))
+		c.Assert(err, qt.ErrorMatches, `invalid username or password`)
+		c.Assert(dials, qt.Equals, n)
+	}
+
+	// Once the cached login has expired the LDAP server is
+	// contacted again.
+	time.Sleep(200 * time.Millisecond)
+	id, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "user1")
+	c.Assert(dials, qt.Equals, 4)
+}
+
+func (s *ldapSuite) TestServerWeights(c *qt.C) {
+	params := getSampleParams()
+	params.URL = ""
+	params.Servers = []ldap.Server{{
+		URL:    "ldap://ldap1",
+		Weight: 3,
+	}, {
+		URL: "ldap://ldap2",
+	}}
+	i, err := ldap.NewIdentityProvider(params)
+	c.Assert(err, qt.IsNil)
+	dialer := newMockLDAPDialer(getSampleLdapDB())
+	ldap.SetLDAP(i, dialer.Dial)
+	i.Init(context.TODO(), s.idptest.InitParams(c, idpPrefix))
+
+	for n := 0; n < 8; n++ {
+		_, err := i.GetGroups(s.idptest.Ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	counts := make(map[string]int)
+	for _, conn := range dialer.conns {
+		counts[conn.address]++
+	}
+	c.Assert(counts, qt.DeepEquals, map[string]int{
+		"ldap1:ldap": 6,
+		"ldap2:ldap": 2,
+	})
+}
+
+func (s *ldapSuite) TestServerFailover(c *qt.C) {
+	params := getSampleParams()
+	params.URL = ""
+	params.Servers = []ldap.Server{{
+		URL:    "ldap://ldap1",
+		Weight: 10,
+	}, {
+		URL: "ldap://ldap2",
+	}}
+	i, err := ldap.NewIdentityProvider(params)
+	c.Assert(err, qt.IsNil)
+	dialer := newMockLDAPDialer(getSampleLdapDB())
+	var attempts []string
+	ldap.SetLDAP(i, func(network, address string) (ldap.LDAPConn, error) {
+		attempts = append(attempts, address)
+		if address == "ldap1:ldap" {
+			return nil, errgo.New("connection refused")
+		}
+		return dialer.Dial(network, address)
+	})
+	i.Init(context.TODO(), s.idptest.InitParams(c, idpPrefix))
+
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "user1")
+
+	// The failed server is tried first, then skipped for subsequent
+	// connections.
+	c.Assert(attempts[0], qt.Equals, "ldap1:ldap")
+	for _, a := range attempts[1:] {
+		c.Assert(a, qt.Equals, "ldap2:ldap")
+	}
+}
+
+func (s *ldapSuite) TestAllServersFail(c *qt.C) {
+	params := getSampleParams()
+	params.Servers = []ldap.Server{{
+		URL: "ldap://ldap2",
+	}}
+	i, err := ldap.NewIdentityProvider(params)
+	c.Assert(err, qt.IsNil)
+	ldap.SetLDAP(i, func(network, address string) (ldap.LDAPConn, error) {
+		return nil, errgo.Newf("cannot connect to %s", address)
+	})
+	i.Init(context.TODO(), s.idptest.InitParams(c, idpPrefix))
+
+	_, err = i.GetGroups(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "uid=user1,ou=users,dc=example,dc=com"),
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot connect to .*`)
+}
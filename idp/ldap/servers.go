@@ -0,0 +1,138 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// serverRetryInterval is the length of time after which a server that
+// could not be connected to will be tried again.
+const serverRetryInterval = 30 * time.Second
+
+// A server holds the connection details of an LDAP server.
+type server struct {
+	network   string
+	address   string
+	tlsConfig tls.Config
+	weight    int
+
+	// The following fields are guarded by the serverPool mutex.
+
+	// currentWeight holds the server's current weight in the smooth
+	// weighted round-robin selection.
+	currentWeight int
+
+	// failedAt holds the time of the most recent failure to
+	// connect to the server, it is zero if the server is healthy.
+	failedAt time.Time
+}
+
+// newServer creates a new server from the given configuration. The
+// base DN specified in the server's URL is also returned.
+func newServer(p Server, caCert string) (*server, string, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, "", errgo.Notef(err, "cannot parse URL")
+	}
+	s := &server{
+		weight: p.Weight,
+	}
+	if s.weight <= 0 {
+		s.weight = 1
+	}
+	switch u.Scheme {
+	case "ldap":
+		s.network = "tcp"
+		// It would be nice to use u.Host and u.Port here, but
+		// these aren't available in go 1.6.
+		host, port, _ := net.SplitHostPort(u.Host)
+		if host == "" {
+			// Asume that the URL didn't specify a port.
+			host = u.Host
+			port = "ldap"
+		}
+		s.address = net.JoinHostPort(host, port)
+		s.tlsConfig.ServerName = host
+	default:
+		// No other schemes are currently supported.
+		return nil, "", errgo.Newf("unsupported scheme %q", u.Scheme)
+	}
+	if caCert != "" {
+		s.tlsConfig.RootCAs = x509.NewCertPool()
+		s.tlsConfig.RootCAs.AppendCertsFromPEM([]byte(caCert))
+	}
+	return s, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// A serverPool selects between a number of LDAP servers.
+type serverPool struct {
+	mu      sync.Mutex
+	servers []*server
+}
+
+// order returns the servers in the order in which connections should
+// be attempted. The first server is selected from the healthy servers
+// using smooth weighted round-robin, it is followed by the remaining
+// healthy servers in order of weight. Unhealthy servers are placed
+// last, unless their retry interval has passed in which case they are
+// treated as healthy.
+func (p *serverPool) order() []*server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var healthy, unhealthy []*server
+	for _, s := range p.servers {
+		if s.failedAt.IsZero() || now.Sub(s.failedAt) >= serverRetryInterval {
+			healthy = append(healthy, s)
+		} else {
+			unhealthy = append(unhealthy, s)
+		}
+	}
+	if len(healthy) > 0 {
+		var best *server
+		total := 0
+		for _, s := range healthy {
+			s.currentWeight += s.weight
+			total += s.weight
+			if best == nil || s.currentWeight > best.currentWeight {
+				best = s
+			}
+		}
+		best.currentWeight -= total
+		sort.SliceStable(healthy, func(i, j int) bool {
+			if healthy[i] == best || healthy[j] == best {
+				return healthy[i] == best
+			}
+			return healthy[i].weight > healthy[j].weight
+		})
+	}
+	sort.SliceStable(unhealthy, func(i, j int) bool {
+		return unhealthy[i].failedAt.Before(unhealthy[j].failedAt)
+	})
+	return append(healthy, unhealthy...)
+}
+
+// setUp records whether the given server is healthy. It reports
+// whether the health of the server has changed.
+func (p *serverPool) setUp(s *server, up bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wasUp := s.failedAt.IsZero()
+	if up {
+		s.failedAt = time.Time{}
+	} else {
+		s.failedAt = time.Now()
+	}
+	return wasUp != up
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/store"
+)
+
+type Claims = claims
+
+func CheckEmailVerified(i idp.IdentityProvider, c *Claims) error {
+	return i.(*openidConnectIdentityProvider).checkEmailVerified(c)
+}
+
+func RegistrationEmail(i idp.IdentityProvider, req *http.Request, ls idputil.LoginState) string {
+	return i.(*openidConnectIdentityProvider).registrationEmail(req, ls)
+}
+
+type KeyPinner = keyPinner
+
+var NewKeyPinner = newKeyPinner
+
+func (p *KeyPinner) Check(ctx context.Context, token string) error {
+	return p.check(ctx, token)
+}
+
+func CheckSuspension(i idp.IdentityProvider, ctx context.Context, st store.Store, pid store.ProviderIdentity, claims map[string]interface{}) error {
+	oidp := i.(*openidConnectIdentityProvider)
+	oidp.initParams.Store = st
+	return oidp.checkSuspension(ctx, pid, claims)
+}
+
+func AuthCodeURL(i idp.IdentityProvider, authURL, redirectURL, state, nonce string, now time.Time) (string, error) {
+	oidp := i.(*openidConnectIdentityProvider)
+	oidp.config = &oauth2.Config{
+		ClientID:    oidp.params.ClientID,
+		Endpoint:    oauth2.Endpoint{AuthURL: authURL},
+		RedirectURL: redirectURL,
+		Scopes:      oidp.params.Scopes,
+	}
+	if oidp.params.RequestSigning != nil {
+		var err error
+		oidp.signer, err = newRequestSigner(oidp.params.RequestSigning)
+		if err != nil {
+			return "", err
+		}
+	}
+	return oidp.authCodeURL(state, nonce, now)
+}
+
+func AddPendingRegistration(i idp.IdentityProvider, ctx context.Context, params idp.InitParams, req *http.Request, ls idputil.LoginState) error {
+	oidp := i.(*openidConnectIdentityProvider)
+	oidp.initParams = params
+	return oidp.addPendingRegistration(ctx, req, ls)
+}
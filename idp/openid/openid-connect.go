@@ -9,16 +9,22 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc"
 	"github.com/juju/loggo"
 	"golang.org/x/oauth2"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
 	"gopkg.in/juju/names.v2"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/internal/auth/httpauth"
+	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
 )
 
@@ -42,41 +48,95 @@ func init() {
 		if p.ClientSecret == "" {
 			return nil, errgo.Newf("client-secret not specified")
 		}
+		if p.RequestSigning != nil {
+			if _, err := newRequestSigner(p.RequestSigning); err != nil {
+				return nil, errgo.Notef(err, "invalid request-signing")
+			}
+		}
 		return NewOpenIDConnectIdentityProvider(p), nil
 	})
 }
 
 type OpenIDConnectParams struct {
 	// Name is the name that will be given to the identity provider.
-	Name string `yaml:"name"`
+	Name string `yaml:"name" redact:"show"`
 
 	// Description is the description that will be used with the
 	// identity provider. If this is not set then Name will be used.
-	Description string `yaml:"description"`
+	Description string `yaml:"description" redact:"show"`
 
 	// Icon contains the URL or path of an icon.
-	Icon string `yaml:"icon"`
+	Icon string `yaml:"icon" redact:"show"`
 
 	// Domain is the domain with which all identities created by this
 	// identity provider will be tagged (not including the @ separator).
-	Domain string `yaml:"domain"`
+	Domain string `yaml:"domain" redact:"show"`
 
 	// Issuer is the OpenID connect issuer for the identity provider.
 	// Discovery will be performed for this issuer.
-	Issuer string `yaml:"issuer"`
+	Issuer string `yaml:"issuer" redact:"show"`
 
 	// Scopes contains the OAuth scopes to request.
-	Scopes []string `yaml:"scopes"`
+	Scopes []string `yaml:"scopes" redact:"show"`
 
 	// ClientID is the ID of the client as registered with the issuer.
-	ClientID string `yaml:"client-id"`
+	ClientID string `yaml:"client-id" redact:"show"`
 
 	// ClientSecret is a client specific secret agreed with the issuer.
 	ClientSecret string `yaml:"client-secret"`
 
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
-	Hidden bool `yaml:"hidden"`
+	Hidden bool `yaml:"hidden" redact:"show"`
+
+	// Category is the category in which the IDP is grouped in
+	// interactive prompts.
+	Category string `yaml:"category" redact:"show"`
+
+	// RequireVerifiedEmail is set if logins should only succeed
+	// when the issuer asserts that the user's email address has
+	// been verified.
+	RequireVerifiedEmail bool `yaml:"require-verified-email" redact:"show"`
+
+	// AssumeEmailVerified is set if an email address should be
+	// treated as verified when the issuer does not include an
+	// email_verified claim. It only has an effect when
+	// RequireVerifiedEmail is set.
+	AssumeEmailVerified bool `yaml:"assume-email-verified" redact:"show"`
+
+	// PinnedKeys holds the fingerprints, as returned by
+	// KeyFingerprint, of the keys that the issuer may use to sign ID
+	// tokens. If this is set then ID tokens signed by any other key
+	// are rejected, even if the key is published by the issuer. To
+	// rotate keys add the fingerprint of the new key before the
+	// issuer starts using it.
+	PinnedKeys []string `yaml:"pinned-keys" redact:"show"`
+
+	// CaptureClaims, if set, configures the capture of the raw claims
+	// in the ID token on each login. The captured claims are stored
+	// with the identity as extra-info for later audit.
+	CaptureClaims *idputil.ClaimCaptureParams `yaml:"capture-claims" redact:"show"`
+
+	// Suspension, if set, configures the claim that the issuer uses
+	// to report that an account is suspended. Logins to suspended
+	// accounts are rejected.
+	Suspension *idputil.SuspensionParams `yaml:"suspension" redact:"show"`
+
+	// RequestSigning, if set, configures the signing of authorization
+	// requests sent to the issuer. Signed requests are sent as JWT
+	// request objects and the public keys are published at the
+	// "/jwks" path of the identity provider.
+	RequestSigning *RequestSigningParams `yaml:"request-signing" redact:"show"`
+
+	// StoreState is set if the state of each login, and a nonce
+	// that the issuer must include in the ID token, are held in the
+	// identity provider's key-value store while the user is
+	// redirected to the issuer. The stored state is bound to the
+	// browser's login state cookie, so the callback must still come
+	// from the browser that started the login, but it can be handled
+	// by a different server when the store is shared, and each
+	// callback can only be used once.
+	StoreState bool `yaml:"store-state" redact:"show"`
 }
 
 // NewOpenIDConnectIdentityProvider creates a new identity provider using
@@ -98,6 +158,11 @@ type openidConnectIdentityProvider struct {
 	initParams idp.InitParams
 	provider   *oidc.Provider
 	config     *oauth2.Config
+	pinner     *keyPinner
+	signer     *requestSigner
+
+	// states holds the stored login states, if StoreState is set.
+	states *idputil.StateStore
 }
 
 // Name implements idp.IdentityProvider.Name.
@@ -130,6 +195,16 @@ func (idp *openidConnectIdentityProvider) Hidden() bool {
 	return idp.params.Hidden
 }
 
+// Category implements idp.IdentityProvider.Category.
+func (idp *openidConnectIdentityProvider) Category() string {
+	return idp.params.Category
+}
+
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (idp *openidConnectIdentityProvider) ConfigParams() (string, interface{}) {
+	return "openid-connect", idp.params
+}
+
 // Init implements idp.IdentityProvider.Init by performing discovery on
 // the issuer and set up the identity provider.
 func (idp *openidConnectIdentityProvider) Init(ctx context.Context, params idp.InitParams) error {
@@ -143,9 +218,30 @@ func (idp *openidConnectIdentityProvider) Init(ctx context.Context, params idp.I
 		ClientID:     idp.params.ClientID,
 		ClientSecret: idp.params.ClientSecret,
 		Endpoint:     idp.provider.Endpoint(),
-		RedirectURL:  idp.initParams.URLPrefix + "/callback",
+		RedirectURL:  idputil.LocationURL(idp.initParams.URLPrefix, "/callback"),
 		Scopes:       idp.params.Scopes,
 	}
+	if len(idp.params.PinnedKeys) > 0 {
+		var discovery struct {
+			JWKSURL string `json:"jwks_uri"`
+		}
+		if err := idp.provider.Claims(&discovery); err != nil {
+			return errgo.Mask(err)
+		}
+		if discovery.JWKSURL == "" {
+			return errgo.Newf("cannot pin keys: issuer %q has no jwks_uri", idp.params.Issuer)
+		}
+		idp.pinner = newKeyPinner(discovery.JWKSURL, idp.params.PinnedKeys)
+	}
+	if idp.params.RequestSigning != nil {
+		idp.signer, err = newRequestSigner(idp.params.RequestSigning)
+		if err != nil {
+			return errgo.Notef(err, "invalid request-signing")
+		}
+	}
+	if idp.params.StoreState {
+		idp.states = idputil.NewStateStore(idp.initParams.KeyValueStore, 0, idp.initParams.TokenGenerator)
+	}
 	return nil
 }
 
@@ -165,15 +261,36 @@ func (*openidConnectIdentityProvider) GetGroups(context.Context, *store.Identity
 
 // Handle implements idp.IdentityProvider.Handle.
 func (idp *openidConnectIdentityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/jwks" {
+		idp.jwks(w, req)
+		return
+	}
+	cookieName := idputil.LoginStateCookieName(idp.initParams.CookieNamePrefix)
+	if req.URL.Path == "/callback" && idp.states != nil {
+		var st storedState
+		ls, err := idp.states.TakeLogin(ctx, req, idp.initParams.Codec, cookieName, req.Form.Get("state"), &st)
+		if err != nil {
+			logger.Infof("Invalid login state: %s", err)
+			idputil.BadRequestf(w, "Login failed: invalid login state")
+			return
+		}
+		if err := idp.callback(ctx, w, req, *ls, st.Nonce); err != nil {
+			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		}
+		return
+	}
+	if req.URL.Path == "/register" {
+		cookieName, _ = idp.registrationCookie()
+	}
 	var ls idputil.LoginState
-	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
+	if err := idp.initParams.Codec.Cookie(req, cookieName, req.Form.Get("state"), &ls); err != nil {
 		logger.Infof("Invalid login state: %s", err)
 		idputil.BadRequestf(w, "Login failed: invalid login state")
 		return
 	}
 	switch req.URL.Path {
 	case "/callback":
-		if err := idp.callback(ctx, w, req, ls); err != nil {
+		if err := idp.callback(ctx, w, req, ls, ""); err != nil {
 			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
 		}
 	case "/register":
@@ -181,15 +298,96 @@ func (idp *openidConnectIdentityProvider) Handle(ctx context.Context, w http.Res
 			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
 		}
 	default:
-		idp.login(ctx, w, req)
+		idp.login(ctx, w, req, ls)
+	}
+}
+
+// A storedState holds the state of a login that is held in the
+// identity provider's key-value store.
+type storedState struct {
+	// Nonce holds the nonce that the issuer must include in the ID
+	// token.
+	Nonce string
+}
+
+func (idp *openidConnectIdentityProvider) login(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) {
+	state, nonce := idputil.State(req), ""
+	if idp.states != nil {
+		var err error
+		state, nonce, err = idp.storeState(ctx, req)
+		if err != nil {
+			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+			return
+		}
 	}
+	u, err := idp.authCodeURL(state, nonce, time.Now())
+	if err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		return
+	}
+	http.Redirect(w, req, u, http.StatusFound)
+}
+
+// storeState stores a new nonce for the login started by the given
+// request, and returns the OAuth2 state parameter that identifies it
+// and the nonce.
+func (idp *openidConnectIdentityProvider) storeState(ctx context.Context, req *http.Request) (state, nonce string, err error) {
+	nonce, err = idp.initParams.TokenGenerator.Generate()
+	if err != nil {
+		return "", "", errgo.Mask(err)
+	}
+	state, err = idp.states.PutLogin(ctx, idputil.State(req), storedState{
+		Nonce: nonce,
+	})
+	if err != nil {
+		return "", "", errgo.Notef(err, "cannot store login state")
+	}
+	return state, nonce, nil
+}
+
+// authCodeURL returns the URL of the issuer's authorization endpoint
+// for a login with the given state and nonce. The nonce is omitted if
+// it is empty. If request signing is configured the request parameters
+// are also included in a signed request object.
+func (idp *openidConnectIdentityProvider) authCodeURL(state, nonce string, now time.Time) (string, error) {
+	var opts []oauth2.AuthCodeOption
+	if nonce != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", nonce))
+	}
+	if idp.signer == nil {
+		return idp.config.AuthCodeURL(state, opts...), nil
+	}
+	requestParams := map[string]string{
+		"response_type": "code",
+		"client_id":     idp.config.ClientID,
+		"redirect_uri":  idp.config.RedirectURL,
+		"scope":         strings.Join(idp.config.Scopes, " "),
+		"state":         state,
+	}
+	if nonce != "" {
+		requestParams["nonce"] = nonce
+	}
+	request, err := idp.signer.sign(idp.config.ClientID, idp.params.Issuer, requestParams, now)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	opts = append(opts, oauth2.SetAuthURLParam("request", request))
+	return idp.config.AuthCodeURL(state, opts...), nil
 }
 
-func (idp *openidConnectIdentityProvider) login(ctx context.Context, w http.ResponseWriter, req *http.Request) {
-	http.Redirect(w, req, idp.config.AuthCodeURL(idputil.State(req)), http.StatusFound)
+// jwks serves the public keys used to sign authorization requests.
+func (idp *openidConnectIdentityProvider) jwks(w http.ResponseWriter, req *http.Request) {
+	if idp.signer == nil {
+		http.NotFound(w, req)
+		return
+	}
+	httprequest.WriteJSON(w, http.StatusOK, idp.signer.publicKeys())
 }
 
-func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) error {
+// callback handles the issuer redirecting back after the user has
+// authenticated. If nonce is not empty the ID token must contain the
+// same nonce.
+func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState, nonce string) error {
 	tok, err := idp.config.Exchange(ctx, req.Form.Get("code"))
 	if err != nil {
 		return errgo.Mask(err)
@@ -206,11 +404,47 @@ func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.R
 	if err != nil {
 		return errgo.Mask(err)
 	}
+	if nonce != "" && id.Nonce != nonce {
+		return errgo.Newf("invalid nonce in ID token")
+	}
+	// Record when the ID token expires so that the discharge token
+	// can be limited to it.
+	ctx = idputil.ContextWithTokenExpiry(ctx, id.Expiry)
+	if idp.pinner != nil {
+		if err := idp.pinner.check(ctx, idtoks); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+		}
+	}
+	var claims claims
+	if err := id.Claims(&claims); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := idp.checkEmailVerified(&claims); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+	var raw map[string]interface{}
+	if err := id.Claims(&raw); err != nil {
+		return errgo.Mask(err)
+	}
+	captured := idp.params.CaptureClaims.Capture(raw)
 	user := store.Identity{
 		ProviderID: store.MakeProviderIdentity(idp.Name(), fmt.Sprintf("%s:%s", id.Issuer, id.Subject)),
 	}
+	if err := idp.checkSuspension(ctx, user.ProviderID, raw); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+	if ss := req.Form.Get("session_state"); ss != "" {
+		ctx = idputil.ContextWithRedirectParams(ctx, url.Values{
+			"session_state": {ss},
+		})
+	}
 	err = idp.initParams.Store.Identity(ctx, &user)
 	if err == nil {
+		if captured != "" {
+			if err := idp.storeClaims(ctx, user.ProviderID, captured); err != nil {
+				return errgo.Mask(err)
+			}
+		}
 		idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, &user)
 		return nil
 	}
@@ -218,12 +452,16 @@ func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.R
 	if errgo.Cause(err) != store.ErrNotFound {
 		return errgo.Mask(err)
 	}
-	var claims claims
-	if err := id.Claims(&claims); err != nil {
-		return errgo.Mask(err)
-	}
 	ls.ProviderID = user.ProviderID
-	state, err := idp.initParams.Codec.SetCookie(w, idputil.LoginCookieName, idputil.LoginCookiePath, ls)
+	ls.Claims = captured
+	ls.Email = claims.Email
+	ls.TokenExpiry = id.Expiry
+	ls.ClientIP = idp.clientIP(req)
+	if err := idp.addPendingRegistration(ctx, req, ls); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrTooManyRequests))
+	}
+	cookieName, cookiePath := idp.registrationCookie()
+	state, err := idp.initParams.Codec.SetCookie(w, cookieName, cookiePath, ls)
 	if err != nil {
 		return errgo.Mask(err)
 	}
@@ -241,13 +479,25 @@ func (idp *openidConnectIdentityProvider) callback(ctx context.Context, w http.R
 }
 
 func (idp *openidConnectIdentityProvider) register(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) error {
+	ctx = idputil.ContextWithTokenExpiry(ctx, ls.TokenExpiry)
+	ctx = idputil.ContextWithCodeChallenge(ctx, ls.CodeChallenge)
+	ctx = idputil.ContextWithSessionID(ctx, ls.SessionID)
 	u := &store.Identity{
 		ProviderID: ls.ProviderID,
 		Name:       req.Form.Get("fullname"),
-		Email:      req.Form.Get("email"),
+		Email:      idp.registrationEmail(req, ls),
+	}
+	if ls.Claims != "" {
+		u.ExtraInfo = map[string][]string{
+			idputil.ClaimsExtraInfoKey: {ls.Claims},
+		}
 	}
 	err := idp.registerUser(ctx, req.Form.Get("username"), u)
 	if err == nil {
+		// The pending entry was recorded against the email
+		// address reported by the provider, not the one that the
+		// user entered.
+		idp.initParams.PendingRegistrations.Done(ctx, ls.Email, ls.ClientIP)
 		idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, u)
 		return nil
 	}
@@ -260,10 +510,73 @@ func (idp *openidConnectIdentityProvider) register(ctx context.Context, w http.R
 		Username: req.Form.Get("username"),
 		Domain:   idp.params.Domain,
 		FullName: req.Form.Get("fullname"),
-		Email:    req.Form.Get("email"),
+		Email:    u.Email,
 	}, idp.initParams.Template))
 }
 
+// registrationEmail returns the email address to store for a user
+// registering with the given request. When verified email addresses
+// are required, the address verified by the provider is always used,
+// so that the user cannot substitute an unverified address in the
+// registration form.
+func (idp *openidConnectIdentityProvider) registrationEmail(req *http.Request, ls idputil.LoginState) string {
+	if idp.params.RequireVerifiedEmail {
+		return ls.Email
+	}
+	return req.Form.Get("email")
+}
+
+// addPendingRegistration records a pending registration for the user
+// in the given login state, which is about to be stored in the
+// registration cookie. If the registration cookie in the given request
+// already holds a pending registration for the same user, for example
+// because the issuer's callback has been repeated, no new entry is
+// recorded, so that each registration counts only once against the
+// limits. A different pending registration in the cookie is released,
+// as it is replaced.
+func (idp *openidConnectIdentityProvider) addPendingRegistration(ctx context.Context, req *http.Request, ls idputil.LoginState) error {
+	var prev idputil.LoginState
+	cookieName, _ := idp.registrationCookie()
+	if cookie, err := req.Cookie(cookieName); err == nil {
+		if err := idp.initParams.Codec.Decode(cookie.Value, &prev); err != nil {
+			prev = idputil.LoginState{}
+		}
+	}
+	if prev.ProviderID != "" && prev.ProviderID == ls.ProviderID && prev.Email == ls.Email && prev.ClientIP == ls.ClientIP {
+		return nil
+	}
+	if err := idp.initParams.PendingRegistrations.Add(ctx, ls.Email, ls.ClientIP); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrTooManyRequests))
+	}
+	if prev.ProviderID != "" {
+		idp.initParams.PendingRegistrations.Done(ctx, prev.Email, prev.ClientIP)
+	}
+	return nil
+}
+
+// clientIP returns the address of the client that made the given
+// request, or the empty string if it cannot be determined.
+func (idp *openidConnectIdentityProvider) clientIP(req *http.Request) string {
+	filter := httpauth.IPFilter{
+		TrustedProxies: idp.initParams.TrustedProxies,
+	}
+	if ip := filter.ClientIP(req); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// registrationCookie returns the name and path of the cookie used to
+// hold the login state while a new user registers. The cookie is
+// private to the identity provider so that it does not replace the
+// login state shared with other identity providers.
+func (idp *openidConnectIdentityProvider) registrationCookie() (name, path string) {
+	if idp.initParams.CookiePath == "" {
+		return idputil.LoginCookieName, idputil.LoginCookiePath
+	}
+	return idp.initParams.CookieNamePrefix + "register", idp.initParams.CookiePath
+}
+
 var errInvalidUser = errgo.New("invalid user")
 
 func (idp *openidConnectIdentityProvider) registerUser(ctx context.Context, username string, u *store.Identity) error {
@@ -274,11 +587,15 @@ func (idp *openidConnectIdentityProvider) registerUser(ctx context.Context, user
 		return errgo.WithCausef(nil, errInvalidUser, "username %s is not allowed, please choose another.", username)
 	}
 	u.Username = joinDomain(username, idp.params.Domain)
-	err := idp.initParams.Store.UpdateIdentity(ctx, u, store.Update{
+	update := store.Update{
 		store.Username: store.Set,
 		store.Name:     store.Set,
 		store.Email:    store.Set,
-	})
+	}
+	if len(u.ExtraInfo) > 0 {
+		update[store.ExtraInfo] = store.Set
+	}
+	err := idp.initParams.Store.UpdateIdentity(ctx, u, update)
 	if err == nil {
 		return nil
 	}
@@ -288,11 +605,78 @@ func (idp *openidConnectIdentityProvider) registerUser(ctx context.Context, user
 	return errgo.WithCausef(nil, errInvalidUser, "Username already taken, please pick a different one.")
 }
 
+// checkEmailVerified checks that the given claims satisfy the
+// identity provider's email verification requirements.
+func (idp *openidConnectIdentityProvider) checkEmailVerified(c *claims) error {
+	if !idp.params.RequireVerifiedEmail {
+		return nil
+	}
+	verified := idp.params.AssumeEmailVerified
+	if c.EmailVerified != nil {
+		verified = *c.EmailVerified
+	}
+	if c.Email == "" || !verified {
+		return errgo.WithCausef(nil, params.ErrForbidden, "login denied: your email address has not been verified by %s", idp.params.Description)
+	}
+	return nil
+}
+
+// checkSuspension checks whether the given claims indicate that the
+// account with the given provider ID has been suspended by the
+// identity provider, updating the stored identity as configured. An
+// error with a cause of params.ErrForbidden is returned if the login
+// should not proceed.
+func (idp *openidConnectIdentityProvider) checkSuspension(ctx context.Context, pid store.ProviderIdentity, claims map[string]interface{}) error {
+	p := idp.params.Suspension
+	if p.Suspended(claims) {
+		if p.Deactivate {
+			err := idputil.SetSuspended(ctx, idp.initParams.Store, pid, true)
+			if err != nil && errgo.Cause(err) != store.ErrNotFound {
+				return errgo.Mask(err)
+			}
+		}
+		return errgo.WithCausef(nil, params.ErrForbidden, "account suspended by provider")
+	}
+	user := store.Identity{
+		ProviderID: pid,
+	}
+	if err := idp.initParams.Store.Identity(ctx, &user); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return nil
+		}
+		return errgo.Mask(err)
+	}
+	if !idputil.IsSuspended(&user) {
+		return nil
+	}
+	// Only a suspension reported by the identity provider can be
+	// undone by it, not a deactivation made through the SCIM API.
+	if p == nil || !p.Reactivate || len(user.ExtraInfo[idputil.InactiveExtraInfoKey]) > 0 {
+		return errgo.WithCausef(nil, params.ErrForbidden, "account deactivated")
+	}
+	return errgo.Mask(idputil.SetSuspended(ctx, idp.initParams.Store, pid, false))
+}
+
+// storeClaims stores the given captured claims with the identity with
+// the given provider ID.
+func (idp *openidConnectIdentityProvider) storeClaims(ctx context.Context, pid store.ProviderIdentity, claims string) error {
+	err := idp.initParams.Store.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: pid,
+		ExtraInfo: map[string][]string{
+			idputil.ClaimsExtraInfoKey: {claims},
+		},
+	}, store.Update{
+		store.ExtraInfo: store.Set,
+	})
+	return errgo.Mask(err)
+}
+
 // claims contains the set of claims possibly returned in the OpenID
 // token.
 type claims struct {
 	FullName          string `json:"name"`
 	Email             string `json:"email"`
+	EmailVerified     *bool  `json:"email_verified"`
 	PreferredUsername string `json:"preferred_username"`
 }
 
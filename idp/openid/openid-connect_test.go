@@ -0,0 +1,273 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/idp/idputil/secret"
+	"github.com/canonical/candid/idp/openid"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/memstore"
+)
+
+var (
+	verified   = true
+	unverified = false
+)
+
+var checkEmailVerifiedTests = []struct {
+	about       string
+	params      openid.OpenIDConnectParams
+	claims      openid.Claims
+	expectError string
+}{{
+	about: "not required",
+	claims: openid.Claims{
+		Email:         "bob@example.com",
+		EmailVerified: &unverified,
+	},
+}, {
+	about: "verified email accepted",
+	params: openid.OpenIDConnectParams{
+		RequireVerifiedEmail: true,
+	},
+	claims: openid.Claims{
+		Email:         "bob@example.com",
+		EmailVerified: &verified,
+	},
+}, {
+	about: "unverified email rejected",
+	params: openid.OpenIDConnectParams{
+		RequireVerifiedEmail: true,
+	},
+	claims: openid.Claims{
+		Email:         "bob@example.com",
+		EmailVerified: &unverified,
+	},
+	expectError: `login denied: your email address has not been verified by test`,
+}, {
+	about: "missing indicator rejected by default",
+	params: openid.OpenIDConnectParams{
+		RequireVerifiedEmail: true,
+	},
+	claims: openid.Claims{
+		Email: "bob@example.com",
+	},
+	expectError: `login denied: your email address has not been verified by test`,
+}, {
+	about: "missing indicator accepted when assumed verified",
+	params: openid.OpenIDConnectParams{
+		RequireVerifiedEmail: true,
+		AssumeEmailVerified:  true,
+	},
+	claims: openid.Claims{
+		Email: "bob@example.com",
+	},
+}, {
+	about: "explicitly unverified rejected when assumed verified",
+	params: openid.OpenIDConnectParams{
+		RequireVerifiedEmail: true,
+		AssumeEmailVerified:  true,
+	},
+	claims: openid.Claims{
+		Email:         "bob@example.com",
+		EmailVerified: &unverified,
+	},
+	expectError: `login denied: your email address has not been verified by test`,
+}, {
+	about: "missing email rejected",
+	params: openid.OpenIDConnectParams{
+		RequireVerifiedEmail: true,
+		AssumeEmailVerified:  true,
+	},
+	expectError: `login denied: your email address has not been verified by test`,
+}}
+
+func TestCheckEmailVerified(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range checkEmailVerifiedTests {
+		c.Run(test.about, func(c *qt.C) {
+			test.params.Name = "test"
+			i := openid.NewOpenIDConnectIdentityProvider(test.params)
+			err := openid.CheckEmailVerified(i, &test.claims)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+		})
+	}
+}
+
+func TestRegistrationEmail(t *testing.T) {
+	c := qt.New(t)
+	req, err := http.NewRequest("POST", "/register", nil)
+	c.Assert(err, qt.IsNil)
+	req.Form = url.Values{"email": {"unverified@example.com"}}
+	ls := idputil.LoginState{Email: "verified@example.com"}
+
+	i := openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{Name: "test"})
+	c.Assert(openid.RegistrationEmail(i, req, ls), qt.Equals, "unverified@example.com")
+
+	// When verified email addresses are required the address from
+	// the registration form is ignored.
+	i = openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name:                 "test",
+		RequireVerifiedEmail: true,
+	})
+	c.Assert(openid.RegistrationEmail(i, req, ls), qt.Equals, "verified@example.com")
+}
+
+func TestAddPendingRegistration(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	key, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	codec := secret.NewCodec(key)
+	initParams := idp.InitParams{
+		Codec: codec,
+		PendingRegistrations: idputil.NewPendingLimiter(memsimplekv.NewStore(), idputil.PendingLimitParams{
+			MaxPerEmail: 1,
+		}),
+		CookieNamePrefix: "test-",
+		CookiePath:       "/login/test",
+	}
+	i := openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{Name: "test"})
+	ls := idputil.LoginState{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Email:      "bob@example.com",
+		ClientIP:   "1.2.3.4",
+	}
+	newRequest := func(ls *idputil.LoginState) *http.Request {
+		req, err := http.NewRequest("GET", "/callback", nil)
+		c.Assert(err, qt.IsNil)
+		if ls != nil {
+			value, err := codec.Encode(*ls)
+			c.Assert(err, qt.IsNil)
+			req.AddCookie(&http.Cookie{
+				Name:  "test-register",
+				Value: value,
+			})
+		}
+		return req
+	}
+
+	err = openid.AddPendingRegistration(i, ctx, initParams, newRequest(nil), ls)
+	c.Assert(err, qt.IsNil)
+
+	// A repeated callback for the same registration does not record
+	// another entry.
+	err = openid.AddPendingRegistration(i, ctx, initParams, newRequest(&ls), ls)
+	c.Assert(err, qt.IsNil)
+
+	// A new registration is limited.
+	err = openid.AddPendingRegistration(i, ctx, initParams, newRequest(nil), ls)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrTooManyRequests)
+
+	// A registration replacing an existing one releases it.
+	ls1 := ls
+	ls1.ClientIP = "5.6.7.8"
+	err = openid.AddPendingRegistration(i, ctx, initParams, newRequest(&ls), ls1)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrTooManyRequests)
+	ls2 := idputil.LoginState{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Email:      "alice@example.com",
+	}
+	err = openid.AddPendingRegistration(i, ctx, initParams, newRequest(&ls), ls2)
+	c.Assert(err, qt.IsNil)
+	err = openid.AddPendingRegistration(i, ctx, initParams, newRequest(nil), ls)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestCheckSuspension(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := memstore.NewStore()
+	pid := store.MakeProviderIdentity("test", "https://example.com:bob")
+	err := st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: pid,
+		Username:   "bob@test",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	isSuspended := func() bool {
+		id := store.Identity{ProviderID: pid}
+		err := st.Identity(ctx, &id)
+		c.Assert(err, qt.IsNil)
+		return idputil.IsSuspended(&id)
+	}
+	suspended := map[string]interface{}{"status": "suspended"}
+	active := map[string]interface{}{"status": "active"}
+
+	// Without suspension configured the claim is ignored.
+	i := openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{Name: "test"})
+	err = openid.CheckSuspension(i, ctx, st, pid, suspended)
+	c.Assert(err, qt.IsNil)
+
+	// A suspended account is rejected without changing the identity.
+	i = openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name: "test",
+		Suspension: &idputil.SuspensionParams{
+			Claim:  "status",
+			Values: []string{"suspended"},
+		},
+	})
+	err = openid.CheckSuspension(i, ctx, st, pid, suspended)
+	c.Assert(err, qt.ErrorMatches, `account suspended by provider`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+	c.Assert(isSuspended(), qt.Equals, false)
+	err = openid.CheckSuspension(i, ctx, st, pid, active)
+	c.Assert(err, qt.IsNil)
+
+	// A suspended account can deactivate the identity.
+	i = openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name: "test",
+		Suspension: &idputil.SuspensionParams{
+			Claim:      "status",
+			Values:     []string{"suspended"},
+			Deactivate: true,
+		},
+	})
+	err = openid.CheckSuspension(i, ctx, st, pid, suspended)
+	c.Assert(err, qt.ErrorMatches, `account suspended by provider`)
+	c.Assert(isSuspended(), qt.Equals, true)
+
+	// A deactivated identity stays deactivated unless reactivation
+	// is configured.
+	err = openid.CheckSuspension(i, ctx, st, pid, active)
+	c.Assert(err, qt.ErrorMatches, `account deactivated`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+	c.Assert(isSuspended(), qt.Equals, true)
+
+	i = openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name: "test",
+		Suspension: &idputil.SuspensionParams{
+			Claim:      "status",
+			Values:     []string{"suspended"},
+			Deactivate: true,
+			Reactivate: true,
+		},
+	})
+	err = openid.CheckSuspension(i, ctx, st, pid, active)
+	c.Assert(err, qt.IsNil)
+	c.Assert(isSuspended(), qt.Equals, false)
+
+	// Suspended accounts that have no identity are rejected.
+	err = openid.CheckSuspension(i, ctx, st, store.MakeProviderIdentity("test", "https://example.com:alice"), suspended)
+	c.Assert(err, qt.ErrorMatches, `account suspended by provider`)
+}
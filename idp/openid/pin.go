@@ -0,0 +1,132 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/canonical/candid/params"
+)
+
+// KeyFingerprint returns the fingerprint of the given public key as
+// used in the pinned-keys configuration. This is the base64 encoded
+// SHA-256 hash of the DER encoded SubjectPublicKeyInfo of the key, the
+// same value used for HTTP public key pinning. The fingerprint of the
+// key in an X.509 certificate can be found with:
+//
+//	openssl x509 -in cert.pem -pubkey -noout |
+//		openssl pkey -pubin -outform der |
+//		openssl dgst -sha256 -binary | base64
+func KeyFingerprint(key interface{}) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	sum := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// A keyPinner checks that ID tokens are signed by one of a set of
+// pinned keys. The keys themselves are fetched from the JWKS endpoint
+// of the issuer, but only those with a pinned fingerprint are used, so
+// a compromised discovery or JWKS endpoint cannot introduce a new
+// signing key.
+type keyPinner struct {
+	jwksURL string
+	pins    map[string]bool
+
+	// mu protects the fields below it.
+	mu   sync.Mutex
+	keys []interface{}
+}
+
+// newKeyPinner creates a keyPinner that fetches keys from the given
+// JWKS URL and only trusts those with one of the given fingerprints.
+func newKeyPinner(jwksURL string, fingerprints []string) *keyPinner {
+	pins := make(map[string]bool, len(fingerprints))
+	for _, fp := range fingerprints {
+		pins[fp] = true
+	}
+	return &keyPinner{
+		jwksURL: jwksURL,
+		pins:    pins,
+	}
+}
+
+// check checks that the given ID token is signed by a pinned key. If
+// none of the currently known pinned keys verify the token the keys
+// are fetched again, to allow for key rotation.
+func (p *keyPinner) check(ctx context.Context, token string) error {
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return errgo.Notef(err, "cannot parse id_token")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if verifyWithAny(jws, p.keys) {
+		return nil
+	}
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	p.keys = keys
+	if verifyWithAny(jws, p.keys) {
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrForbidden, "id_token not signed by a pinned key")
+}
+
+// fetchKeys fetches the key set from the JWKS URL and returns the keys
+// that have a pinned fingerprint.
+func (p *keyPinner) fetchKeys(ctx context.Context) ([]interface{}, error) {
+	req, err := http.NewRequest("GET", p.jwksURL, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot fetch keys")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errgo.Newf("cannot fetch keys: unexpected status %q", resp.Status)
+	}
+	var ks jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&ks); err != nil {
+		return nil, errgo.Notef(err, "cannot decode keys")
+	}
+	var keys []interface{}
+	for _, k := range ks.Keys {
+		fp, err := KeyFingerprint(k.Key)
+		if err != nil {
+			logger.Debugf("ignoring key %q: %s", k.KeyID, err)
+			continue
+		}
+		if !p.pins[fp] {
+			logger.Warningf("ignoring unpinned key %q from %s", k.KeyID, p.jwksURL)
+			continue
+		}
+		keys = append(keys, k.Key)
+	}
+	return keys, nil
+}
+
+func verifyWithAny(jws *jose.JSONWebSignature, keys []interface{}) bool {
+	for _, k := range keys {
+		if _, err := jws.Verify(k); err == nil {
+			return true
+		}
+	}
+	return false
+}
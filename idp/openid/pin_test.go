@@ -0,0 +1,110 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/canonical/candid/idp/openid"
+	"github.com/canonical/candid/params"
+)
+
+// jwksServer serves a JSON web key set that can be changed by the test.
+type jwksServer struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	keys []*rsa.PrivateKey
+}
+
+func newJWKSServer(keys ...*rsa.PrivateKey) *jwksServer {
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var ks jose.JSONWebKeySet
+		for _, k := range s.keys {
+			ks.Keys = append(ks.Keys, jose.JSONWebKey{
+				Key:       &k.PublicKey,
+				Algorithm: string(jose.RS256),
+				Use:       "sig",
+			})
+		}
+		json.NewEncoder(w).Encode(ks)
+	}))
+	return s
+}
+
+func (s *jwksServer) setKeys(keys ...*rsa.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func newKey(c *qt.C) *rsa.PrivateKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, qt.IsNil)
+	return k
+}
+
+func fingerprint(c *qt.C, k *rsa.PrivateKey) string {
+	fp, err := openid.KeyFingerprint(&k.PublicKey)
+	c.Assert(err, qt.IsNil)
+	return fp
+}
+
+func signToken(c *qt.C, k *rsa.PrivateKey) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: k}, nil)
+	c.Assert(err, qt.IsNil)
+	jws, err := signer.Sign([]byte(`{"sub":"test"}`))
+	c.Assert(err, qt.IsNil)
+	token, err := jws.CompactSerialize()
+	c.Assert(err, qt.IsNil)
+	return token
+}
+
+func TestPinnedKeyRotation(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	oldKey, newKey := newKey(c), newKey(c)
+	srv := newJWKSServer(oldKey)
+	defer srv.Close()
+
+	// Both keys are pinned before the issuer rotates.
+	p := openid.NewKeyPinner(srv.URL, []string{fingerprint(c, oldKey), fingerprint(c, newKey)})
+	c.Assert(p.Check(ctx, signToken(c, oldKey)), qt.IsNil)
+
+	// The issuer rotates to the new key, which is picked up without
+	// any configuration change because it is already pinned.
+	srv.setKeys(newKey)
+	c.Assert(p.Check(ctx, signToken(c, newKey)), qt.IsNil)
+}
+
+func TestUnpinnedKeyRejected(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	pinned, rogue := newKey(c), newKey(c)
+
+	// The JWKS endpoint has been compromised and publishes the rogue
+	// key alongside the pinned one.
+	srv := newJWKSServer(pinned, rogue)
+	defer srv.Close()
+
+	p := openid.NewKeyPinner(srv.URL, []string{fingerprint(c, pinned)})
+	err := p.Check(ctx, signToken(c, rogue))
+	c.Assert(err, qt.ErrorMatches, `id_token not signed by a pinned key`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+	c.Assert(p.Check(ctx, signToken(c, pinned)), qt.IsNil)
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// requestObjectExpiry holds the time for which a signed authorization
+// request is valid.
+const requestObjectExpiry = 5 * time.Minute
+
+// RequestSigningParams holds the parameters used to sign authorization
+// requests sent to the issuer.
+type RequestSigningParams struct {
+	// PrivateKeys holds the PEM encoded RSA or P-256 ECDSA private
+	// keys used to sign requests. The first key is used to sign
+	// requests, the public parts of all the keys are published so
+	// that the issuer can verify requests. To rotate keys add the
+	// new key to the start of the list and remove the old key once
+	// the issuer has fetched the new key set.
+	PrivateKeys []string `yaml:"private-keys"`
+}
+
+// A requestSigner signs authorization requests as JWT request
+// objects, as described in RFC 9101.
+type requestSigner struct {
+	signer jose.Signer
+	keys   []jose.JSONWebKey
+	public jose.JSONWebKeySet
+}
+
+// newRequestSigner creates a requestSigner using the keys in the given
+// parameters.
+func newRequestSigner(p *RequestSigningParams) (*requestSigner, error) {
+	if len(p.PrivateKeys) == 0 {
+		return nil, errgo.Newf("no private keys specified")
+	}
+	s := new(requestSigner)
+	for i, data := range p.PrivateKeys {
+		k, err := parseSigningKey(data)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid private key %d", i)
+		}
+		s.keys = append(s.keys, k)
+		s.public.Keys = append(s.public.Keys, jose.JSONWebKey{
+			Key:       publicKey(k.Key),
+			KeyID:     k.KeyID,
+			Algorithm: k.Algorithm,
+			Use:       k.Use,
+		})
+	}
+	var err error
+	s.signer, err = jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(s.keys[0].Algorithm),
+		Key:       s.keys[0],
+	}, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return s, nil
+}
+
+// parseSigningKey parses a PEM encoded private key and returns it as a
+// JSON web key with the algorithm and key ID set.
+func parseSigningKey(data string) (jose.JSONWebKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return jose.JSONWebKey{}, errgo.Newf("no PEM data found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return jose.JSONWebKey{}, errgo.Mask(err)
+	}
+	var alg jose.SignatureAlgorithm
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		alg = jose.RS256
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return jose.JSONWebKey{}, errgo.Newf("unsupported elliptic curve %s", key.Curve.Params().Name)
+		}
+		alg = jose.ES256
+	default:
+		return jose.JSONWebKey{}, errgo.Newf("unsupported key type %T", key)
+	}
+	kid, err := KeyFingerprint(publicKey(key))
+	if err != nil {
+		return jose.JSONWebKey{}, errgo.Mask(err)
+	}
+	return jose.JSONWebKey{
+		Key:       key,
+		KeyID:     kid,
+		Algorithm: string(alg),
+		Use:       "sig",
+	}, nil
+}
+
+// sign returns a signed request object containing the given
+// authorization request parameters. The clientID and audience are used
+// for the iss and aud claims respectively.
+func (s *requestSigner) sign(clientID, audience string, params map[string]string, now time.Time) (string, error) {
+	var jti [16]byte
+	if _, err := rand.Read(jti[:]); err != nil {
+		return "", errgo.Mask(err)
+	}
+	claims := map[string]interface{}{
+		"iss": clientID,
+		"aud": audience,
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(requestObjectExpiry).Unix(),
+		"jti": hex.EncodeToString(jti[:]),
+	}
+	for k, v := range params {
+		claims[k] = v
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	jws, err := s.signer.Sign(payload)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot sign request")
+	}
+	return jws.CompactSerialize()
+}
+
+// publicKeys returns the key set holding the public parts of all the
+// signing keys.
+func (s *requestSigner) publicKeys() jose.JSONWebKeySet {
+	return s.public
+}
+
+// publicKey returns the public part of the given private key.
+func publicKey(key interface{}) interface{} {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey
+	case *ecdsa.PrivateKey:
+		return &key.PublicKey
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package openid_test
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	jose "gopkg.in/square/go-jose.v2"
+
+	"github.com/canonical/candid/idp/openid"
+)
+
+func pemKey(k *rsa.PrivateKey) string {
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(k),
+	}))
+}
+
+func TestSignedAuthorizationRequest(t *testing.T) {
+	c := qt.New(t)
+	key := newKey(c)
+	i := openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name:     "test",
+		Issuer:   "https://issuer.example.com",
+		ClientID: "candid",
+		Scopes:   []string{"openid", "email"},
+		RequestSigning: &openid.RequestSigningParams{
+			PrivateKeys: []string{pemKey(key)},
+		},
+	})
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s, err := openid.AuthCodeURL(i, "https://issuer.example.com/auth", "https://candid.example.com/login/test/callback", "state-1", "", now)
+	c.Assert(err, qt.IsNil)
+	u, err := url.Parse(s)
+	c.Assert(err, qt.IsNil)
+	q := u.Query()
+	// The plain parameters are still sent, as required by RFC 9101.
+	c.Assert(q.Get("client_id"), qt.Equals, "candid")
+	c.Assert(q.Get("response_type"), qt.Equals, "code")
+
+	jws, err := jose.ParseSigned(q.Get("request"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(jws.Signatures, qt.HasLen, 1)
+	c.Assert(jws.Signatures[0].Header.Algorithm, qt.Equals, string(jose.RS256))
+	c.Assert(jws.Signatures[0].Header.KeyID, qt.Equals, fingerprint(c, key))
+	payload, err := jws.Verify(&key.PublicKey)
+	c.Assert(err, qt.IsNil)
+	var claims map[string]interface{}
+	err = json.Unmarshal(payload, &claims)
+	c.Assert(err, qt.IsNil)
+	c.Assert(claims["jti"], qt.Not(qt.Equals), "")
+	delete(claims, "jti")
+	c.Assert(claims, qt.DeepEquals, map[string]interface{}{
+		"iss":           "candid",
+		"aud":           "https://issuer.example.com",
+		"iat":           float64(now.Unix()),
+		"nbf":           float64(now.Unix()),
+		"exp":           float64(now.Add(5 * time.Minute).Unix()),
+		"response_type": "code",
+		"client_id":     "candid",
+		"redirect_uri":  "https://candid.example.com/login/test/callback",
+		"scope":         "openid email",
+		"state":         "state-1",
+	})
+
+	// The signature does not verify with any other key.
+	_, err = jws.Verify(&newKey(c).PublicKey)
+	c.Assert(err, qt.Not(qt.IsNil))
+}
+
+func TestUnsignedAuthorizationRequest(t *testing.T) {
+	c := qt.New(t)
+	i := openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name:     "test",
+		Issuer:   "https://issuer.example.com",
+		ClientID: "candid",
+	})
+	s, err := openid.AuthCodeURL(i, "https://issuer.example.com/auth", "https://candid.example.com/login/test/callback", "state-1", "", time.Now())
+	c.Assert(err, qt.IsNil)
+	u, err := url.Parse(s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.Query()["request"], qt.IsNil)
+}
+
+func TestAuthorizationRequestNonce(t *testing.T) {
+	c := qt.New(t)
+	key := newKey(c)
+	i := openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name:     "test",
+		Issuer:   "https://issuer.example.com",
+		ClientID: "candid",
+	})
+	s, err := openid.AuthCodeURL(i, "https://issuer.example.com/auth", "https://candid.example.com/login/test/callback", "state-1", "nonce-1", time.Now())
+	c.Assert(err, qt.IsNil)
+	u, err := url.Parse(s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.Query().Get("nonce"), qt.Equals, "nonce-1")
+
+	// The nonce is also included in signed requests.
+	i = openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name:     "test",
+		Issuer:   "https://issuer.example.com",
+		ClientID: "candid",
+		RequestSigning: &openid.RequestSigningParams{
+			PrivateKeys: []string{pemKey(key)},
+		},
+	})
+	s, err = openid.AuthCodeURL(i, "https://issuer.example.com/auth", "https://candid.example.com/login/test/callback", "state-1", "nonce-1", time.Now())
+	c.Assert(err, qt.IsNil)
+	u, err = url.Parse(s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.Query().Get("nonce"), qt.Equals, "nonce-1")
+	jws, err := jose.ParseSigned(u.Query().Get("request"))
+	c.Assert(err, qt.IsNil)
+	payload, err := jws.Verify(&key.PublicKey)
+	c.Assert(err, qt.IsNil)
+	var claims map[string]interface{}
+	err = json.Unmarshal(payload, &claims)
+	c.Assert(err, qt.IsNil)
+	c.Assert(claims["nonce"], qt.Equals, "nonce-1")
+}
+
+func TestRequestSigningKeyRotation(t *testing.T) {
+	c := qt.New(t)
+	current, previous := newKey(c), newKey(c)
+	i := openid.NewOpenIDConnectIdentityProvider(openid.OpenIDConnectParams{
+		Name:     "test",
+		Issuer:   "https://issuer.example.com",
+		ClientID: "candid",
+		RequestSigning: &openid.RequestSigningParams{
+			PrivateKeys: []string{pemKey(current), pemKey(previous)},
+		},
+	})
+	s, err := openid.AuthCodeURL(i, "https://issuer.example.com/auth", "https://candid.example.com/login/test/callback", "state-1", "", time.Now())
+	c.Assert(err, qt.IsNil)
+	u, err := url.Parse(s)
+	c.Assert(err, qt.IsNil)
+
+	// Requests are signed with the first key.
+	jws, err := jose.ParseSigned(u.Query().Get("request"))
+	c.Assert(err, qt.IsNil)
+	_, err = jws.Verify(&current.PublicKey)
+	c.Assert(err, qt.IsNil)
+
+	// Both keys are published.
+	req, err := http.NewRequest("GET", "/jwks", nil)
+	c.Assert(err, qt.IsNil)
+	rr := httptest.NewRecorder()
+	i.Handle(context.Background(), rr, req)
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+	var ks jose.JSONWebKeySet
+	err = json.Unmarshal(rr.Body.Bytes(), &ks)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ks.Keys, qt.HasLen, 2)
+	c.Assert(ks.Keys[0].KeyID, qt.Equals, fingerprint(c, current))
+	_, ok := ks.Keys[0].Key.(*rsa.PublicKey)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(ks.Keys[1].KeyID, qt.Equals, fingerprint(c, previous))
+	_, ok = ks.Keys[1].Key.(*rsa.PublicKey)
+	c.Assert(ok, qt.IsTrue)
+}
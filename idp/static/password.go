@@ -0,0 +1,398 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package static
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+const (
+	defaultMinPasswordLength = 8
+	defaultResetTokenTimeout = time.Hour
+)
+
+// checkPassword reports whether the given password is correct for the
+// given user. If the user has changed their password then the stored
+// hash is used, otherwise the password is compared to the configured
+// one.
+func (idp *identityProvider) checkPassword(ctx context.Context, user string, userData UserInfo, password string) (bool, error) {
+	if idp.params.AllowPasswordChange {
+		hash, err := idp.initParams.KeyValueStore.Get(ctx, passwordKey(user))
+		if err == nil {
+			return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil, nil
+		}
+		if errgo.Cause(err) != simplekv.ErrNotFound {
+			return false, errgo.Mask(err)
+		}
+	}
+	return userData.Password == password, nil
+}
+
+// checkPasswordPolicy checks that the given password for the given
+// user satisfies the password policy.
+func (idp *identityProvider) checkPasswordPolicy(user, password string) error {
+	if len(password) < idp.params.MinPasswordLength {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "password must be at least %d characters", idp.params.MinPasswordLength)
+	}
+	if strings.EqualFold(password, user) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "password must not be the same as the username")
+	}
+	return nil
+}
+
+// setPassword validates the given password against the password policy
+// and stores its hash as the password for the given user.
+func (idp *identityProvider) setPassword(ctx context.Context, user, password string) error {
+	hash, err := idp.hashPassword(user, password)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	return errgo.Mask(idp.storePassword(ctx, user, hash))
+}
+
+// hashPassword validates the given password against the password
+// policy and returns the hash to store for it.
+func (idp *identityProvider) hashPassword(user, password string) ([]byte, error) {
+	if err := idp.checkPasswordPolicy(user, password); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), idp.params.PasswordHashCost)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return hash, nil
+}
+
+// storePassword stores the given password hash for the given user.
+func (idp *identityProvider) storePassword(ctx context.Context, user string, hash []byte) error {
+	if err := idp.initParams.KeyValueStore.Set(ctx, passwordKey(user), hash, time.Time{}); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(idp.setPasswordTime(ctx, user, time.Now()))
+}
+
+// tokenUser returns the user that the single-use token stored at the
+// given key was issued for. An error with a cause of
+// params.ErrUnauthorized is returned if the token is not valid; kind
+// describes the token in the error message.
+func (idp *identityProvider) tokenUser(ctx context.Context, key, kind string) (string, error) {
+	user, err := idp.initParams.KeyValueStore.Get(ctx, key)
+	if errgo.Cause(err) == simplekv.ErrNotFound || err == nil && len(user) == 0 {
+		return "", errgo.WithCausef(nil, params.ErrUnauthorized, "invalid or expired %s token", kind)
+	}
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return string(user), nil
+}
+
+// setPasswordWithToken uses up the single-use token stored at the
+// given key, which must have been issued for the given user, and sets
+// the password hash for that user. The hash must already have been
+// validated so that a bad password does not use up the token. If the
+// password cannot be stored the token is restored so that it can be
+// used again.
+func (idp *identityProvider) setPasswordWithToken(ctx context.Context, key, kind, user string, hash []byte) error {
+	expire := time.Now().Add(idp.params.ResetTokenTimeout)
+	err := idp.initParams.KeyValueStore.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		if len(old) == 0 || string(old) != user {
+			return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid or expired %s token", kind)
+		}
+		// Mark the token as used.
+		return []byte{}, nil
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	if err := idp.storePassword(ctx, user, hash); err != nil {
+		if err1 := idp.initParams.KeyValueStore.Set(ctx, key, []byte(user), expire); err1 != nil {
+			logger.Errorf("cannot restore password token for %q: %s", user, err1)
+		}
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// handleChangePassword handles a request from a user to change their
+// own password. The request must be a POST containing the form values
+// "username", "password" (the current password) and "new-password".
+func (idp *identityProvider) handleChangePassword(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if err := idp.checkPasswordRequest(req); err != nil {
+		writeError(w, err)
+		return
+	}
+	user := req.Form.Get("username")
+	if _, err := idp.initParams.FailedLoginDelay.LoginUser(idp.loginUser)(ctx, user, req.Form.Get("password")); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := idp.setPassword(ctx, user, req.Form.Get("new-password")); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "password changed for %s", user)
+}
+
+// handleResetPassword handles a request to set a new password using a
+// reset token previously created by ResetPassword. The request must be
+// a POST containing the form values "token" and "new-password".
+func (idp *identityProvider) handleResetPassword(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if err := idp.checkPasswordRequest(req); err != nil {
+		writeError(w, err)
+		return
+	}
+	token := req.Form.Get("token")
+	if token == "" {
+		writeError(w, errgo.WithCausef(nil, params.ErrBadRequest, "token not specified"))
+		return
+	}
+	user, err := idp.tokenUser(ctx, resetTokenKey(token), "reset")
+	if err != nil {
+		writeError(w, errgo.Mask(err, errgo.Is(params.ErrUnauthorized)))
+		return
+	}
+	// Validate the password before the token is used up, so that
+	// the user can try again with a better password.
+	hash, err := idp.hashPassword(user, req.Form.Get("new-password"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := idp.setPasswordWithToken(ctx, resetTokenKey(token), "reset", user, hash); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "password changed for %s", user)
+}
+
+// checkPasswordRequest checks that a password change or reset request
+// can be processed.
+func (idp *identityProvider) checkPasswordRequest(req *http.Request) error {
+	if !idp.params.AllowPasswordChange {
+		return errgo.WithCausef(nil, params.ErrNotFound, "password changes not enabled")
+	}
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "unsupported method %q", req.Method)
+	}
+	return nil
+}
+
+// ResetPassword implements idp.PasswordResetter.ResetPassword by
+// creating a single-use token that can be used to set a new password
+// for the given identity.
+func (idp *identityProvider) ResetPassword(ctx context.Context, id *store.Identity) (string, error) {
+	if !idp.params.AllowPasswordChange {
+		return "", errgo.WithCausef(nil, params.ErrForbidden, "password reset not enabled")
+	}
+	user := userFromIdentity(id)
+	if _, ok := idp.params.Users[user]; !ok {
+		return "", errgo.WithCausef(nil, params.ErrNotFound, "user %q not found", user)
+	}
+	token, err := idp.initParams.TokenGenerator.Generate()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if err := idp.initParams.KeyValueStore.Set(ctx, resetTokenKey(token), []byte(user), time.Now().Add(idp.params.ResetTokenTimeout)); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return token, nil
+}
+
+// ExpirePassword implements idp.PasswordExpirer.ExpirePassword by
+// requiring the user to choose a new password the next time they log
+// in.
+func (idp *identityProvider) ExpirePassword(ctx context.Context, id *store.Identity) error {
+	if !idp.params.AllowPasswordChange {
+		return errgo.WithCausef(nil, params.ErrForbidden, "password changes not enabled")
+	}
+	user := userFromIdentity(id)
+	if _, ok := idp.params.Users[user]; !ok {
+		return errgo.WithCausef(nil, params.ErrNotFound, "user %q not found", user)
+	}
+	return errgo.Mask(idp.setPasswordTime(ctx, user, time.Time{}))
+}
+
+// passwordExpired reports whether the user must choose a new password
+// before their login can complete. This is the case if an
+// administrator has expired the password, or if it is older than the
+// configured maximum age. A password that has not been seen before is
+// treated as being set now.
+func (idp *identityProvider) passwordExpired(ctx context.Context, user string) (bool, error) {
+	if !idp.params.AllowPasswordChange {
+		return false, nil
+	}
+	buf, err := idp.initParams.KeyValueStore.Get(ctx, passwordTimeKey(user))
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		if idp.params.PasswordMaxAge == 0 {
+			return false, nil
+		}
+		return false, errgo.Mask(idp.setPasswordTime(ctx, user, time.Now()))
+	}
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	var t time.Time
+	if err := t.UnmarshalText(buf); err != nil {
+		return false, errgo.Notef(err, "cannot parse password time for %q", user)
+	}
+	if t.IsZero() {
+		return true, nil
+	}
+	return idp.params.PasswordMaxAge > 0 && time.Since(t) > idp.params.PasswordMaxAge, nil
+}
+
+// setPasswordTime records the time at which the given user's password
+// was set. A zero time marks the password as expired.
+func (idp *identityProvider) setPasswordTime(ctx context.Context, user string, t time.Time) error {
+	buf, err := t.MarshalText()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(idp.initParams.KeyValueStore.Set(ctx, passwordTimeKey(user), buf, time.Time{}))
+}
+
+// passwordChangeFormParams holds the parameters sent to the
+// password-change-form template.
+type passwordChangeFormParams struct {
+	params.IDPChoiceDetails
+
+	// Action contains the action parameter for the form.
+	Action string
+
+	// Token contains the token that must be posted with the new
+	// password.
+	Token string
+
+	// MinPasswordLength contains the minimum length of the new
+	// password.
+	MinPasswordLength int
+
+	// Error contains an error message from the previous, failed,
+	// attempt to set a password.
+	Error string
+}
+
+// startPasswordRotation is called when the given user has logged in
+// with an expired password. It writes a form asking for a new
+// password, which must be set before the login completes.
+func (idp *identityProvider) startPasswordRotation(ctx context.Context, w http.ResponseWriter, req *http.Request, user string) {
+	token, err := idp.initParams.TokenGenerator.Generate()
+	if err != nil {
+		idputil.BadRequestf(w, "Login failed: %s", err)
+		return
+	}
+	if err := idp.initParams.KeyValueStore.Set(ctx, rotateTokenKey(token), []byte(user), time.Now().Add(idp.params.ResetTokenTimeout)); err != nil {
+		idputil.BadRequestf(w, "Login failed: %s", err)
+		return
+	}
+	idp.writePasswordChangeForm(w, req, token, "")
+}
+
+// handleRotatePassword handles the form written by
+// startPasswordRotation. When a valid new password has been set the
+// login completes.
+func (idp *identityProvider) handleRotatePassword(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) {
+	if req.Method != "POST" {
+		idputil.BadRequestf(w, "unsupported method %q", req.Method)
+		return
+	}
+	token := req.Form.Get("token")
+	password := req.Form.Get("new-password")
+	user, err := idp.tokenUser(ctx, rotateTokenKey(token), "password change")
+	if err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		return
+	}
+	// Check the new password before the token is used up, so that
+	// the user can try again with a better password.
+	hash, err := idp.hashPassword(user, password)
+	if err != nil {
+		idp.writePasswordChangeForm(w, req, token, err.Error())
+		return
+	}
+	same, err := idp.checkPassword(ctx, user, idp.params.Users[user], password)
+	if err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		return
+	}
+	if same {
+		idp.writePasswordChangeForm(w, req, token, "new password must be different from the current password")
+		return
+	}
+	if err := idp.setPasswordWithToken(ctx, rotateTokenKey(token), "password change", user, hash); err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		return
+	}
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, idputil.NameWithDomain(user, idp.params.Domain)),
+	}
+	if err := idp.initParams.Store.Identity(ctx, id); err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		return
+	}
+	idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, id)
+}
+
+// writePasswordChangeForm writes a form asking the user to choose a
+// new password.
+func (idp *identityProvider) writePasswordChangeForm(w http.ResponseWriter, req *http.Request, token, errorMessage string) {
+	data := passwordChangeFormParams{
+		IDPChoiceDetails: params.IDPChoiceDetails{
+			Domain:      idp.params.Domain,
+			Description: idp.params.Description,
+			Name:        idp.params.Name,
+		},
+		Action:            idputil.RedirectURL(idp.initParams.URLPrefix, "/login-change-password", req.Form.Get("state")),
+		Token:             token,
+		MinPasswordLength: idp.params.MinPasswordLength,
+		Error:             errorMessage,
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	if err := idp.initParams.Template.ExecuteTemplate(w, "password-change-form", data); err != nil {
+		logger.Errorf("cannot process password change template: %s", err)
+	}
+}
+
+func passwordKey(user string) string {
+	return "password:" + user
+}
+
+func passwordTimeKey(user string) string {
+	return "password-time:" + user
+}
+
+func resetTokenKey(token string) string {
+	return "reset-token:" + token
+}
+
+func rotateTokenKey(token string) string {
+	return "rotate-token:" + token
+}
+
+// writeError writes the given error as a plain text response with an
+// appropriate status code.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch errgo.Cause(err) {
+	case params.ErrBadRequest:
+		status = http.StatusBadRequest
+	case params.ErrUnauthorized:
+		status = http.StatusUnauthorized
+	case params.ErrNotFound:
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -9,8 +9,10 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/juju/loggo"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
@@ -22,6 +24,10 @@ import (
 
 var logger = loggo.GetLogger("candid.idp.static")
 
+// errLoginDeclined is idp.ErrLoginDeclined, which cannot be referred
+// to directly in methods with an idp receiver.
+var errLoginDeclined = idp.ErrLoginDeclined
+
 func init() {
 	idp.Register("static", func(unmarshal func(interface{}) error) (idp.IdentityProvider, error) {
 		var p Params
@@ -31,6 +37,17 @@ func init() {
 		if p.Name == "" {
 			p.Name = "static"
 		}
+		if p.PasswordMaxAge != 0 && !p.AllowPasswordChange {
+			return nil, errgo.Newf("password-max-age requires allow-password-change")
+		}
+		for user, info := range p.Users {
+			if info.TOTPSecret == "" {
+				continue
+			}
+			if _, err := parseTOTPSecret(info.TOTPSecret); err != nil {
+				return nil, errgo.Notef(err, "user %q", user)
+			}
+		}
 
 		return NewIdentityProvider(p), nil
 	})
@@ -38,37 +55,73 @@ func init() {
 
 type Params struct {
 	// Name is the name that will be given to the identity provider.
-	Name string `yaml:"name"`
+	Name string `yaml:"name" redact:"show"`
 
 	// Description is the description of the IDP shown to the user on
 	// the IDP selection page.
-	Description string `yaml:"description"`
+	Description string `yaml:"description" redact:"show"`
 
 	// Icon contains the URL or path of an icon.
-	Icon string `yaml:"icon"`
+	Icon string `yaml:"icon" redact:"show"`
 
 	// Domain is the domain with which all identities created by this
 	// identity provider will be tagged (not including the @ separator).
-	Domain string `yaml:"domain"`
+	Domain string `yaml:"domain" redact:"show"`
 
 	// Users is the set of users that are allowed to authenticate, with their
 	// passwords and list of groups.
-	Users map[string]UserInfo `yaml:"users"`
+	Users map[string]UserInfo `yaml:"users" redact:"show"`
 
 	// Hidden is set if the IDP should be hidden from interactive
 	// prompts.
-	Hidden bool `yaml:"hidden"`
+	Hidden bool `yaml:"hidden" redact:"show"`
+
+	// Category is the category in which the IDP is grouped in
+	// interactive prompts.
+	Category string `yaml:"category" redact:"show"`
+
+	// AllowPasswordChange, if set, allows users to change their own
+	// passwords and administrators to reset them. Changed passwords
+	// are stored hashed and take precedence over the passwords in
+	// Users.
+	AllowPasswordChange bool `yaml:"allow-password-change" redact:"show"`
+
+	// MinPasswordLength holds the minimum length of a changed
+	// password. If this is zero, a default of 8 is used.
+	MinPasswordLength int `yaml:"min-password-length" redact:"show"`
+
+	// PasswordHashCost holds the bcrypt cost used to hash changed
+	// passwords. If this is zero, bcrypt.DefaultCost is used.
+	PasswordHashCost int `yaml:"password-hash-cost" redact:"show"`
+
+	// ResetTokenTimeout holds the length of time for which a
+	// password reset token is valid. If this is zero, a default of
+	// one hour is used.
+	ResetTokenTimeout time.Duration `yaml:"reset-token-timeout" redact:"show"`
+
+	// PasswordMaxAge holds the maximum age of a password. A user
+	// logging in with an older password must choose a new one
+	// before the login completes. The age of a password from Users
+	// is counted from the first time it is used to log in. If this
+	// is zero, passwords do not expire. Password expiry requires
+	// AllowPasswordChange.
+	PasswordMaxAge time.Duration `yaml:"password-max-age" redact:"show"`
 }
 
 type UserInfo struct {
 	// Password is the password for the user.
 	Password string `yaml:"password"`
 	// Name is the full name of the user.
-	Name string `yaml:"name"`
+	Name string `yaml:"name" redact:"show"`
 	// Email is the user e-mail.
-	Email string `yaml:"email"`
+	Email string `yaml:"email" redact:"show"`
 	// Groups is the list of groups the user belongs to.
-	Groups []string `yaml:"groups"`
+	Groups []string `yaml:"groups" redact:"show"`
+	// TOTPSecret, if set, holds the base32 encoded secret used to
+	// generate the user's time-based one-time codes (RFC 6238). A
+	// user with a secret must give a one-time code as well as their
+	// password to log in.
+	TOTPSecret string `yaml:"totp-secret"`
 }
 
 // NewIdentityProvider creates a new static identity provider.
@@ -76,6 +129,15 @@ func NewIdentityProvider(p Params) idp.IdentityProvider {
 	if p.Description == "" {
 		p.Description = p.Name
 	}
+	if p.MinPasswordLength == 0 {
+		p.MinPasswordLength = defaultMinPasswordLength
+	}
+	if p.PasswordHashCost == 0 {
+		p.PasswordHashCost = bcrypt.DefaultCost
+	}
+	if p.ResetTokenTimeout == 0 {
+		p.ResetTokenTimeout = defaultResetTokenTimeout
+	}
 	return &identityProvider{params: p}
 
 }
@@ -115,6 +177,16 @@ func (idp *identityProvider) Hidden() bool {
 	return idp.params.Hidden
 }
 
+// Category implements idp.IdentityProvider.Category.
+func (idp *identityProvider) Category() string {
+	return idp.params.Category
+}
+
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (idp *identityProvider) ConfigParams() (string, interface{}) {
+	return "static", idp.params
+}
+
 // Init implements idp.IdentityProvider.Init.
 func (idp *identityProvider) Init(ctx context.Context, params idp.InitParams) error {
 	idp.initParams = params
@@ -132,9 +204,7 @@ func (idp *identityProvider) SetInteraction(ierr *httpbakery.Error, dischargeID
 
 //  GetGroups implements idp.IdentityProvider.GetGroups.
 func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Identity) ([]string, error) {
-	_, fulluser := identity.ProviderID.Split()
-	username := strings.SplitN(fulluser, "@", 2)[0]
-	if user, ok := idp.params.Users[username]; ok {
+	if user, ok := idp.params.Users[userFromIdentity(identity)]; ok {
 		groups := make([]string, len(user.Groups))
 		copy(groups, user.Groups)
 		return groups, nil
@@ -144,8 +214,16 @@ func (idp *identityProvider) GetGroups(ctx context.Context, identity *store.Iden
 
 // Handle implements idp.IdentityProvider.Handle.
 func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	switch strings.TrimPrefix(req.URL.Path, idp.initParams.URLPrefix) {
+	case "/change-password":
+		idp.handleChangePassword(ctx, w, req)
+		return
+	case "/reset-password":
+		idp.handleResetPassword(ctx, w, req)
+		return
+	}
 	var ls idputil.LoginState
-	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
+	if err := idp.initParams.Codec.Cookie(req, idputil.LoginStateCookieName(idp.initParams.CookieNamePrefix), req.Form.Get("state"), &ls); err != nil {
 		logger.Infof("Invalid login state: %s", err)
 		idputil.BadRequestf(w, "Login failed: invalid login state")
 		return
@@ -159,36 +237,129 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 			Name:        idp.params.Name,
 			URL:         idp.URL(req.Form.Get("state")),
 		}
-		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Template, idp.loginUser)
+		id, err := idputil.HandleLoginForm(ctx, w, req, idpChoice, idp.initParams.Template, idp.initParams.FailedLoginDelay.LoginUser(idp.loginUser))
 		if err != nil {
 			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
 		}
-		if id != nil {
-			idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, id)
+		if id == nil {
+			return
+		}
+		if user := userFromIdentity(id); idp.params.Users[user].TOTPSecret != "" {
+			idp.startOneTimeCode(ctx, w, req, user)
+			return
 		}
+		idp.completeLogin(ctx, w, req, ls, id)
+	case "/login-code":
+		idp.handleOneTimeCode(ctx, w, req, ls)
+	case "/login-change-password":
+		idp.handleRotatePassword(ctx, w, req, ls)
+	}
+}
+
+// completeLogin completes the login of the given identity, which has
+// been authenticated, unless its password has expired, in which case
+// the user is first asked to choose a new one.
+func (idp *identityProvider) completeLogin(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState, id *store.Identity) {
+	expired, err := idp.passwordExpired(ctx, userFromIdentity(id))
+	if err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		return
+	}
+	if expired {
+		idp.startPasswordRotation(ctx, w, req, userFromIdentity(id))
+		return
 	}
+	idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, id)
 }
 
 func (idp *identityProvider) loginUser(ctx context.Context, user, password string) (*store.Identity, error) {
+	id, err := idp.checkUser(ctx, user, password)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	if err := idp.updateIdentity(ctx, id); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return id, nil
+}
+
+// checkUser checks the given user's password and returns the identity
+// of the user, without storing it. If the password is not correct an
+// error with a cause of params.ErrUnauthorized is returned.
+func (idp *identityProvider) checkUser(ctx context.Context, user, password string) (*store.Identity, error) {
 	if userData, ok := idp.params.Users[user]; ok {
-		if userData.Password == password {
+		ok, err := idp.checkPassword(ctx, user, userData, password)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if ok {
 			username := idputil.NameWithDomain(user, idp.params.Domain)
-			id := &store.Identity{
+			return &store.Identity{
 				ProviderID: store.MakeProviderIdentity(idp.params.Name, username),
 				Username:   username,
 				Name:       userData.Name,
 				Email:      userData.Email,
-			}
-			err := idp.initParams.Store.UpdateIdentity(ctx, id, store.Update{
-				store.Username: store.Set,
-				store.Name:     store.Set,
-				store.Email:    store.Set,
-			})
-			if err != nil {
-				return nil, errgo.Mask(err)
-			}
-			return id, nil
+			}, nil
 		}
 	}
 	return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "authentication failed for user %q", user)
 }
+
+// updateIdentity stores the details of the given identity.
+func (idp *identityProvider) updateIdentity(ctx context.Context, id *store.Identity) error {
+	return errgo.Mask(idp.initParams.Store.UpdateIdentity(ctx, id, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+		store.Email:    store.Set,
+	}))
+}
+
+// AuthenticateRequest implements idp.NonInteractiveAuthenticator by
+// checking the HTTP basic authentication credentials in the request.
+// Users whose passwords have expired cannot log in this way as they
+// must choose a new password interactively, nor can users that must
+// give a one-time code.
+func (idp *identityProvider) AuthenticateRequest(ctx context.Context, req *http.Request) (func(context.Context) (*store.Identity, error), error) {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, errgo.WithCausef(nil, errLoginDeclined, "no basic authentication credentials")
+	}
+	id, err := idp.initParams.FailedLoginDelay.LoginUser(idp.checkNonInteractiveUser)(ctx, user, password)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	return func(ctx context.Context) (*store.Identity, error) {
+		if err := idp.updateIdentity(ctx, id); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return id, nil
+	}, nil
+}
+
+// checkNonInteractiveUser checks the given user's password as
+// checkUser does, and also checks that the user can log in without
+// interacting.
+func (idp *identityProvider) checkNonInteractiveUser(ctx context.Context, user, password string) (*store.Identity, error) {
+	id, err := idp.checkUser(ctx, user, password)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	if idp.params.Users[user].TOTPSecret != "" {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "user %q requires a one-time code and must log in interactively", user)
+	}
+	expired, err := idp.passwordExpired(ctx, user)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if expired {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "password for user %q has expired", user)
+	}
+	return id, nil
+}
+
+// userFromIdentity returns the name of the user in Users that
+// corresponds to the given identity.
+func userFromIdentity(id *store.Identity) string {
+	_, fulluser := id.ProviderID.Split()
+	return strings.SplitN(fulluser, "@", 2)[0]
+}
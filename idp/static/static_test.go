@@ -4,16 +4,26 @@
 package static_test
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
 
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/idp/idptest"
 	"github.com/canonical/candid/idp/static"
 	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
 )
 
@@ -199,3 +209,493 @@ func (s *staticSuite) TestHandleFailedLoginUnknownUser(c *qt.C) {
 	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("unknown", "pass"))
 	c.Assert(err, qt.ErrorMatches, `authentication failed for user &#34;unknown&#34;`)
 }
+
+func (s *staticSuite) TestChangePassword(c *qt.C) {
+	p := getSampleParams()
+	p.AllowPasswordChange = true
+	p.PasswordHashCost = 4
+	i := s.setupIdp(c, p)
+
+	resp := s.postForm(c, i, "/change-password", url.Values{
+		"username":     {"user1"},
+		"password":     {"pass1"},
+		"new-password": {"short"},
+	})
+	c.Assert(resp.Code, qt.Equals, http.StatusBadRequest)
+	c.Assert(resp.Body.String(), qt.Equals, "password must be at least 8 characters\n")
+
+	resp = s.postForm(c, i, "/change-password", url.Values{
+		"username":     {"user1"},
+		"password":     {"wrong-pass"},
+		"new-password": {"new-password1"},
+	})
+	c.Assert(resp.Code, qt.Equals, http.StatusUnauthorized)
+
+	resp = s.postForm(c, i, "/change-password", url.Values{
+		"username":     {"user1"},
+		"password":     {"pass1"},
+		"new-password": {"new-password1"},
+	})
+	c.Assert(resp.Code, qt.Equals, http.StatusOK, qt.Commentf("%s", resp.Body))
+
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.ErrorMatches, `authentication failed for user &#34;user1&#34;`)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "new-password1"))
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *staticSuite) TestChangePasswordNotEnabled(c *qt.C) {
+	i := s.setupIdp(c, getSampleParams())
+	resp := s.postForm(c, i, "/change-password", url.Values{
+		"username":     {"user1"},
+		"password":     {"pass1"},
+		"new-password": {"new-password1"},
+	})
+	c.Assert(resp.Code, qt.Equals, http.StatusNotFound)
+}
+
+func (s *staticSuite) TestResetPassword(c *qt.C) {
+	p := getSampleParams()
+	p.AllowPasswordChange = true
+	p.PasswordHashCost = 4
+	i := s.setupIdp(c, p)
+
+	token, err := i.(idp.PasswordResetter).ResetPassword(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+	})
+	c.Assert(err, qt.IsNil)
+
+	resp := s.postForm(c, i, "/reset-password", url.Values{
+		"token":        {token},
+		"new-password": {"new-password1"},
+	})
+	c.Assert(resp.Code, qt.Equals, http.StatusOK, qt.Commentf("%s", resp.Body))
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "new-password1"))
+	c.Assert(err, qt.IsNil)
+
+	// The token can only be used once.
+	resp = s.postForm(c, i, "/reset-password", url.Values{
+		"token":        {token},
+		"new-password": {"new-password2"},
+	})
+	c.Assert(resp.Code, qt.Equals, http.StatusUnauthorized)
+	c.Assert(resp.Body.String(), qt.Equals, "invalid or expired reset token\n")
+}
+
+func (s *staticSuite) TestResetPasswordBadPasswordKeepsToken(c *qt.C) {
+	p := getSampleParams()
+	p.AllowPasswordChange = true
+	p.PasswordHashCost = 4
+	i := s.setupIdp(c, p)
+
+	token, err := i.(idp.PasswordResetter).ResetPassword(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+	})
+	c.Assert(err, qt.IsNil)
+
+	// A password that breaks the policy does not use up the token.
+	resp := s.postForm(c, i, "/reset-password", url.Values{
+		"token":        {token},
+		"new-password": {"USER1"},
+	})
+	c.Assert(resp.Code, qt.Equals, http.StatusBadRequest)
+
+	resp = s.postForm(c, i, "/reset-password", url.Values{
+		"token":        {token},
+		"new-password": {"new-password1"},
+	})
+	c.Assert(resp.Code, qt.Equals, http.StatusOK, qt.Commentf("%s", resp.Body))
+}
+
+func (s *staticSuite) TestResetPasswordExpired(c *qt.C) {
+	p := getSampleParams()
+	p.AllowPasswordChange = true
+	p.ResetTokenTimeout = time.Millisecond
+	i := s.setupIdp(c, p)
+
+	token, err := i.(idp.PasswordResetter).ResetPassword(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+	})
+	c.Assert(err, qt.IsNil)
+	time.Sleep(10 * time.Millisecond)
+
+	resp := s.postForm(c, i, "/reset-password", url.Values{
+		"token":        {token},
+		"new-password": {"new-password1"},
+	})
+	c.Assert(resp.Code, qt.Equals, http.StatusUnauthorized)
+}
+
+func (s *staticSuite) TestResetPasswordNotEnabled(c *qt.C) {
+	i := s.setupIdp(c, getSampleParams())
+	_, err := i.(idp.PasswordResetter).ResetPassword(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+}
+
+func (s *staticSuite) TestPasswordMaxAge(c *qt.C) {
+	p := getSampleParams()
+	p.AllowPasswordChange = true
+	p.PasswordHashCost = 4
+	p.PasswordMaxAge = 100 * time.Millisecond
+	i := s.setupIdp(c, p)
+
+	// The first login starts the clock on the configured password.
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+	time.Sleep(150 * time.Millisecond)
+
+	// Once the password has expired, logging in requires a new
+	// password that satisfies the password policy.
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		candidtest.PostLoginForm("user1", "pass1"),
+		changeExpiredPassword("short"),
+	))
+	c.Assert(err, qt.ErrorMatches, `password must be at least 8 characters`)
+
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		candidtest.PostLoginForm("user1", "pass1"),
+		changeExpiredPassword("new-password1"),
+	))
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "user1")
+
+	// The new password is within its rotation window, so it can
+	// be used to log in normally.
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "new-password1"))
+	c.Assert(err, qt.IsNil)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.ErrorMatches, `authentication failed for user &#34;user1&#34;`)
+}
+
+func (s *staticSuite) TestExpirePassword(c *qt.C) {
+	p := getSampleParams()
+	p.AllowPasswordChange = true
+	p.PasswordHashCost = 4
+	i := s.setupIdp(c, p)
+
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "pass1"))
+	c.Assert(err, qt.IsNil)
+
+	err = i.(idp.PasswordExpirer).ExpirePassword(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+	})
+	c.Assert(err, qt.IsNil)
+
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		candidtest.PostLoginForm("user1", "pass1"),
+		changeExpiredPassword("new-password1"),
+	))
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "user1")
+
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", candidtest.PostLoginForm("user1", "new-password1"))
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *staticSuite) TestExpirePasswordNotEnabled(c *qt.C) {
+	i := s.setupIdp(c, getSampleParams())
+	err := i.(idp.PasswordExpirer).ExpirePassword(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+}
+
+// totpSecret holds the base32 encoding of the secret used in the
+// RFC 6238 test vectors.
+const totpSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func (s *staticSuite) TestOneTimeCode(c *qt.C) {
+	p := getSampleParams()
+	u := p.Users["user1"]
+	u.TOTPSecret = totpSecret
+	p.Users["user1"] = u
+	i := s.setupIdp(c, p)
+
+	code := currentCode(c)
+	id, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		candidtest.PostLoginForm("user1", "pass1"),
+		enterOneTimeCode(code),
+	))
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "user1")
+
+	// The same code cannot be used twice.
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		candidtest.PostLoginForm("user1", "pass1"),
+		enterOneTimeCode(code),
+	))
+	c.Assert(err, qt.ErrorMatches, `one-time code has already been used`)
+}
+
+func (s *staticSuite) TestOneTimeCodeInvalid(c *qt.C) {
+	p := getSampleParams()
+	u := p.Users["user1"]
+	u.TOTPSecret = totpSecret
+	p.Users["user1"] = u
+	i := s.setupIdp(c, p)
+
+	_, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		candidtest.PostLoginForm("user1", "pass1"),
+		enterOneTimeCode(""),
+	))
+	c.Assert(err, qt.ErrorMatches, `one-time code required`)
+
+	// Only one code is accepted in 10^6, and only three are valid at
+	// any time.
+	code := "000000"
+	if ok := isValidCode(c, code); ok {
+		code = "000001"
+	}
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		candidtest.PostLoginForm("user1", "pass1"),
+		enterOneTimeCode(code),
+	))
+	c.Assert(err, qt.ErrorMatches, `invalid one-time code`)
+}
+
+func (s *staticSuite) TestOneTimeCodeNotInteractive(c *qt.C) {
+	p := getSampleParams()
+	u := p.Users["user1"]
+	u.TOTPSecret = totpSecret
+	p.Users["user1"] = u
+	i := s.setupIdp(c, p)
+
+	req, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, qt.IsNil)
+	req.SetBasicAuth("user1", "pass1")
+	_, err = i.(idp.NonInteractiveAuthenticator).AuthenticateRequest(s.idptest.Ctx, req)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	c.Assert(err, qt.ErrorMatches, `user "user1" requires a one-time code and must log in interactively`)
+}
+
+func (s *staticSuite) TestBackupCode(c *qt.C) {
+	p := getSampleParams()
+	u := p.Users["user1"]
+	u.TOTPSecret = totpSecret
+	p.Users["user1"] = u
+	i := s.setupIdp(c, p)
+	bm := i.(idp.BackupCodeManager)
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+	}
+
+	n, err := bm.BackupCodesRemaining(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+
+	codes, err := bm.GenerateBackupCodes(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(codes, qt.HasLen, 10)
+	n, err = bm.BackupCodesRemaining(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 10)
+
+	// A backup code can be used in place of a one-time code.
+	id1, err := s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		candidtest.PostLoginForm("user1", "pass1"),
+		expectBackupCodes(10),
+		enterOneTimeCode(codes[0]),
+	))
+	c.Assert(err, qt.IsNil)
+	c.Assert(id1.Username, qt.Equals, "user1")
+	n, err = bm.BackupCodesRemaining(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 9)
+
+	// The same backup code cannot be used twice.
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		candidtest.PostLoginForm("user1", "pass1"),
+		expectBackupCodes(9),
+		enterOneTimeCode(codes[0]),
+	))
+	c.Assert(err, qt.ErrorMatches, `invalid one-time code`)
+	n, err = bm.BackupCodesRemaining(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 9)
+
+	// Generating new codes replaces the old ones.
+	newCodes, err := bm.GenerateBackupCodes(s.idptest.Ctx, id)
+	c.Assert(err, qt.IsNil)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		candidtest.PostLoginForm("user1", "pass1"),
+		enterOneTimeCode(codes[1]),
+	))
+	c.Assert(err, qt.ErrorMatches, `invalid one-time code`)
+	_, err = s.idptest.DoInteractiveLogin(c, i, idpPrefix+"/login", then(
+		candidtest.PostLoginForm("user1", "pass1"),
+		enterOneTimeCode(strings.ToUpper(newCodes[0])),
+	))
+	c.Assert(err, qt.IsNil)
+}
+
+func (s *staticSuite) TestGenerateBackupCodesWithoutOneTimeCodes(c *qt.C) {
+	i := s.setupIdp(c, getSampleParams())
+	_, err := i.(idp.BackupCodeManager).GenerateBackupCodes(s.idptest.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "user1"),
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+	c.Assert(err, qt.ErrorMatches, `user "user1" does not use one-time codes`)
+}
+
+func TestTOTPCode(t *testing.T) {
+	c := qt.New(t)
+	key, err := static.ParseTOTPSecret(strings.ToLower(totpSecret) + "====")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(key), qt.Equals, "12345678901234567890")
+
+	// The test vectors from RFC 6238, truncated to six digits.
+	tests := []struct {
+		t    int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		c.Check(static.TOTPCode(key, test.t/30), qt.Equals, test.code, qt.Commentf("time %d", test.t))
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	c := qt.New(t)
+	key := []byte("12345678901234567890")
+	now := time.Unix(1111111109, 0)
+
+	counter, ok := static.CheckTOTP(key, "081804", now)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(counter, qt.Equals, int64(1111111109/30))
+
+	// Codes from adjacent time steps are accepted.
+	_, ok = static.CheckTOTP(key, "081804", now.Add(30*time.Second))
+	c.Assert(ok, qt.IsTrue)
+	_, ok = static.CheckTOTP(key, "081804", now.Add(-30*time.Second))
+	c.Assert(ok, qt.IsTrue)
+
+	// Codes from other time steps are not.
+	_, ok = static.CheckTOTP(key, "081804", now.Add(90*time.Second))
+	c.Assert(ok, qt.IsFalse)
+	_, ok = static.CheckTOTP(key, "000000", now)
+	c.Assert(ok, qt.IsFalse)
+}
+
+func TestParseTOTPSecretInvalid(t *testing.T) {
+	c := qt.New(t)
+	_, err := static.ParseTOTPSecret("not base32!")
+	c.Assert(err, qt.ErrorMatches, `invalid TOTP secret: .*`)
+	_, err = static.ParseTOTPSecret("")
+	c.Assert(err, qt.ErrorMatches, `invalid TOTP secret: empty secret`)
+}
+
+// currentCode returns the one-time code for totpSecret at the current
+// time.
+func currentCode(c *qt.C) string {
+	key, err := static.ParseTOTPSecret(totpSecret)
+	c.Assert(err, qt.IsNil)
+	return static.TOTPCode(key, time.Now().Unix()/30)
+}
+
+// isValidCode reports whether the given code is currently valid for
+// totpSecret.
+func isValidCode(c *qt.C, code string) bool {
+	key, err := static.ParseTOTPSecret(totpSecret)
+	c.Assert(err, qt.IsNil)
+	_, ok := static.CheckTOTP(key, code, time.Now())
+	return ok
+}
+
+func (s *staticSuite) postForm(c *qt.C, i idp.IdentityProvider, path string, v url.Values) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", path, strings.NewReader(v.Encode()))
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ParseForm()
+	rr := httptest.NewRecorder()
+	i.Handle(s.idptest.Ctx, rr, req)
+	return rr
+}
+
+// then returns a response handler that calls each of the given
+// handlers in turn.
+func then(fs ...candidtest.ResponseHandler) candidtest.ResponseHandler {
+	return func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		for _, f := range fs {
+			var err error
+			resp, err = f(client, resp)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return resp, nil
+	}
+}
+
+// enterOneTimeCode returns a response handler that completes the
+// one-time code form in the response with the given code.
+func enterOneTimeCode(code string) candidtest.ResponseHandler {
+	return func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		// The one-time-code-form template in the candidtest
+		// package puts the action and token on separate lines.
+		parts := strings.Split(string(buf), "\n")
+		if len(parts) < 2 || parts[1] == "" {
+			return nil, errgo.Newf("unexpected response %q", buf)
+		}
+		return client.PostForm(parts[0], url.Values{
+			"token": {parts[1]},
+			"code":  {code},
+		})
+	}
+}
+
+// expectBackupCodes returns a response handler that checks that the
+// one-time code form in the response shows the given number of unused
+// backup codes.
+func expectBackupCodes(n int) candidtest.ResponseHandler {
+	return func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		// The one-time-code-form template in the candidtest
+		// package puts the number of backup codes on the third
+		// line.
+		parts := strings.Split(string(buf), "\n")
+		if len(parts) < 3 || parts[2] != strconv.Itoa(n) {
+			return nil, errgo.Newf("unexpected response %q", buf)
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(buf))
+		return resp, nil
+	}
+}
+
+// changeExpiredPassword returns a response handler that completes the
+// password change form in the response with the given new password.
+func changeExpiredPassword(password string) candidtest.ResponseHandler {
+	return func(client *http.Client, resp *http.Response) (*http.Response, error) {
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		// The password-change-form template in the candidtest
+		// package puts the action, error and token on
+		// separate lines.
+		parts := strings.Split(string(buf), "\n")
+		if len(parts) < 3 || parts[2] == "" {
+			return nil, errgo.Newf("unexpected response %q", buf)
+		}
+		return client.PostForm(parts[0], url.Values{
+			"token":        {parts[2]},
+			"new-password": {password},
+		})
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package static
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+const (
+	// totpStep holds the time step of the one-time codes, as
+	// recommended by RFC 6238.
+	totpStep = 30 * time.Second
+
+	// totpSkew holds the number of time steps either side of the
+	// current one for which a code is accepted, to allow for clock
+	// differences between the server and the user's device.
+	totpSkew = 1
+
+	// oneTimeCodeTimeout holds how long a user has to enter a
+	// one-time code after entering their password.
+	oneTimeCodeTimeout = 5 * time.Minute
+
+	// numBackupCodes holds the number of backup codes created for a
+	// user by GenerateBackupCodes.
+	numBackupCodes = 10
+
+	// backupCodeLength holds the length of each backup code.
+	backupCodeLength = 10
+
+	// backupCodeCharset holds the characters used in backup codes.
+	// Characters that are easily confused with one another are
+	// omitted.
+	backupCodeCharset = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// parseTOTPSecret parses a TOTP secret in the base32 encoding used by
+// authenticator apps. Spaces, padding and the case of the letters are
+// ignored.
+func parseTOTPSecret(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Replace(s, " ", "", -1))
+	s = strings.TrimRight(s, "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil {
+		return nil, errgo.Newf("invalid TOTP secret: %s", err)
+	}
+	if len(key) == 0 {
+		return nil, errgo.Newf("invalid TOTP secret: empty secret")
+	}
+	return key, nil
+}
+
+// totpCode returns the six digit one-time code for the given key and
+// time step counter, as defined in RFC 4226.
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", n%1000000)
+}
+
+// checkTOTP checks the given code against the given key at time t. If
+// the code is valid the time step counter it was generated for is
+// returned.
+func checkTOTP(key []byte, code string, t time.Time) (int64, bool) {
+	now := t.Unix() / int64(totpStep/time.Second)
+	for counter := now - totpSkew; counter <= now+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// checkOneTimeCode checks that the given code is a valid one-time code
+// for the given user and that it has not been used before. If it is
+// not an error with a cause of params.ErrUnauthorized is returned.
+func (idp *identityProvider) checkOneTimeCode(ctx context.Context, user, code string) error {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return errgo.WithCausef(nil, params.ErrUnauthorized, "one-time code required")
+	}
+	key, err := parseTOTPSecret(idp.params.Users[user].TOTPSecret)
+	if err != nil {
+		return errgo.Notef(err, "cannot check one-time code for %q", user)
+	}
+	counter, ok := checkTOTP(key, code, time.Now())
+	if !ok {
+		// The user may have entered one of their backup codes
+		// instead.
+		return errgo.Mask(idp.useBackupCode(ctx, user, code), errgo.Is(params.ErrUnauthorized))
+	}
+	// Record the time step of the code so that neither it, nor any
+	// earlier code, can be used again. The record is not needed once
+	// the code would have expired anyway.
+	expire := time.Unix((counter+totpSkew+1)*int64(totpStep/time.Second), 0)
+	err = idp.initParams.KeyValueStore.Update(ctx, totpCounterKey(user), expire, func(old []byte) ([]byte, error) {
+		if len(old) > 0 {
+			last, err := strconv.ParseInt(string(old), 10, 64)
+			if err == nil && counter <= last {
+				return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "one-time code has already been used")
+			}
+		}
+		return []byte(strconv.FormatInt(counter, 10)), nil
+	})
+	return errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+}
+
+// oneTimeCodeFormParams holds the parameters sent to the
+// one-time-code-form template.
+type oneTimeCodeFormParams struct {
+	params.IDPChoiceDetails
+
+	// Action contains the action parameter for the form.
+	Action string
+
+	// Token contains the token that must be posted with the code.
+	Token string
+
+	// BackupCodes contains the number of unused backup codes the
+	// user has, any of which may be entered instead of a one-time
+	// code.
+	BackupCodes int
+}
+
+// startOneTimeCode is called when the given user, who has a TOTP
+// secret, has logged in with their password. It writes a form asking
+// for a one-time code, which must be given before the login completes.
+func (idp *identityProvider) startOneTimeCode(ctx context.Context, w http.ResponseWriter, req *http.Request, user string) {
+	token, err := idp.initParams.TokenGenerator.Generate()
+	if err != nil {
+		idputil.BadRequestf(w, "Login failed: %s", err)
+		return
+	}
+	hashes, err := idp.backupCodes(ctx, user)
+	if err != nil {
+		idputil.BadRequestf(w, "Login failed: %s", err)
+		return
+	}
+	if err := idp.initParams.KeyValueStore.Set(ctx, codeTokenKey(token), []byte(user), time.Now().Add(oneTimeCodeTimeout)); err != nil {
+		idputil.BadRequestf(w, "Login failed: %s", err)
+		return
+	}
+	data := oneTimeCodeFormParams{
+		IDPChoiceDetails: params.IDPChoiceDetails{
+			Domain:      idp.params.Domain,
+			Description: idp.params.Description,
+			Name:        idp.params.Name,
+		},
+		Action:      idputil.RedirectURL(idp.initParams.URLPrefix, "/login-code", req.Form.Get("state")),
+		Token:       token,
+		BackupCodes: len(hashes),
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	if err := idp.initParams.Template.ExecuteTemplate(w, "one-time-code-form", data); err != nil {
+		logger.Errorf("cannot process one-time code template: %s", err)
+	}
+}
+
+// handleOneTimeCode handles the form written by startOneTimeCode. The
+// token in the form can only be used once, so a missing or invalid
+// code fails the login.
+func (idp *identityProvider) handleOneTimeCode(ctx context.Context, w http.ResponseWriter, req *http.Request, ls idputil.LoginState) {
+	if req.Method != "POST" {
+		idputil.BadRequestf(w, "unsupported method %q", req.Method)
+		return
+	}
+	var user string
+	err := idp.initParams.KeyValueStore.Update(ctx, codeTokenKey(req.Form.Get("token")), time.Now().Add(oneTimeCodeTimeout), func(old []byte) ([]byte, error) {
+		if len(old) == 0 {
+			return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid or expired login token")
+		}
+		user = string(old)
+		// Mark the token as used.
+		return []byte{}, nil
+	})
+	if err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		return
+	}
+	if err := idp.checkOneTimeCode(ctx, user, req.Form.Get("code")); err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		return
+	}
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity(idp.params.Name, idputil.NameWithDomain(user, idp.params.Domain)),
+	}
+	if err := idp.initParams.Store.Identity(ctx, id); err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, err)
+		return
+	}
+	idp.completeLogin(ctx, w, req, ls, id)
+}
+
+// GenerateBackupCodes implements
+// idp.BackupCodeManager.GenerateBackupCodes by creating a new set of
+// single-use backup codes for the given identity, replacing any it
+// already has. Only hashes of the codes are stored, so they cannot be
+// retrieved again.
+func (idp *identityProvider) GenerateBackupCodes(ctx context.Context, id *store.Identity) ([]string, error) {
+	user := userFromIdentity(id)
+	info, ok := idp.params.Users[user]
+	if !ok {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "user %q not found", user)
+	}
+	if info.TOTPSecret == "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "user %q does not use one-time codes", user)
+	}
+	codes := make([]string, numBackupCodes)
+	hashes := make([]string, numBackupCodes)
+	for i := range codes {
+		code, err := generateBackupCode()
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		codes[i] = code
+		hashes[i] = hashBackupCode(code)
+	}
+	buf, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := idp.initParams.KeyValueStore.Set(ctx, backupCodesKey(user), buf, time.Time{}); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return codes, nil
+}
+
+// BackupCodesRemaining implements
+// idp.BackupCodeManager.BackupCodesRemaining.
+func (idp *identityProvider) BackupCodesRemaining(ctx context.Context, id *store.Identity) (int, error) {
+	user := userFromIdentity(id)
+	if _, ok := idp.params.Users[user]; !ok {
+		return 0, errgo.WithCausef(nil, params.ErrNotFound, "user %q not found", user)
+	}
+	hashes, err := idp.backupCodes(ctx, user)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return len(hashes), nil
+}
+
+// backupCodes returns the hashes of the given user's unused backup
+// codes.
+func (idp *identityProvider) backupCodes(ctx context.Context, user string) ([]string, error) {
+	buf, err := idp.initParams.KeyValueStore.Get(ctx, backupCodesKey(user))
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return parseBackupCodes(buf)
+}
+
+// useBackupCode checks that the given code is one of the given user's
+// unused backup codes and removes it so that it cannot be used again.
+// If it is not an error with a cause of params.ErrUnauthorized is
+// returned.
+func (idp *identityProvider) useBackupCode(ctx context.Context, user, code string) error {
+	hash := hashBackupCode(code)
+	err := idp.initParams.KeyValueStore.Update(ctx, backupCodesKey(user), time.Time{}, func(old []byte) ([]byte, error) {
+		hashes, err := parseBackupCodes(old)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		for i, h := range hashes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				return json.Marshal(append(hashes[:i], hashes[i+1:]...))
+			}
+		}
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid one-time code")
+	})
+	return errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+}
+
+// parseBackupCodes parses the backup code hashes stored for a user.
+func parseBackupCodes(buf []byte) ([]string, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	var hashes []string
+	if err := json.Unmarshal(buf, &hashes); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal backup codes")
+	}
+	return hashes, nil
+}
+
+// generateBackupCode returns a new random backup code.
+func generateBackupCode() (string, error) {
+	max := big.NewInt(int64(len(backupCodeCharset)))
+	buf := make([]byte, backupCodeLength)
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", errgo.Notef(err, "cannot generate backup code")
+		}
+		buf[i] = backupCodeCharset[n.Int64()]
+	}
+	return string(buf), nil
+}
+
+// hashBackupCode returns the hash of the given backup code that is
+// stored in place of the code itself. The case of the code, and any
+// spaces or hyphens in it, are ignored.
+func hashBackupCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, " ", "", -1)
+	code = strings.Replace(code, "-", "", -1)
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func codeTokenKey(token string) string {
+	return "code-token:" + token
+}
+
+func totpCounterKey(user string) string {
+	return "totp-counter:" + user
+}
+
+func backupCodesKey(user string) string {
+	return "backup-codes:" + user
+}
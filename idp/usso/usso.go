@@ -42,16 +42,22 @@ func init() {
 
 type Params struct {
 	// LaunchpadTeams contains any private teams that the system needs to know about.
-	LaunchpadTeams []string `yaml:"launchpad-teams"`
+	LaunchpadTeams []string `yaml:"launchpad-teams" redact:"show"`
 
 	// Domain contains the domain that the identities are created in.
-	Domain string
+	Domain string `redact:"show"`
 
 	// Icon contains the URL or path of an icon.
-	Icon string `yaml:"icon"`
+	Icon string `yaml:"icon" redact:"show"`
 
 	// Staging enables using the staging login and launchpad servers.
-	Staging bool
+	Staging bool `redact:"show"`
+
+	// StoreState is set if the state of each login is held in the
+	// identity provider's key-value store while the user is
+	// redirected to Ubuntu SSO, so that each callback can only be
+	// used once, see openid.OpenIDConnectParams.StoreState.
+	StoreState bool `yaml:"store-state" redact:"show"`
 }
 
 // NewIdentityProvider creates a new LDAP identity provider.
@@ -75,6 +81,9 @@ type identityProvider struct {
 	groupCache   *cache.Cache
 	groupMonitor prometheus.Summary
 	params       Params
+
+	// states holds the stored login states, if StoreState is set.
+	states *idputil.StateStore
 }
 
 // Name gives the name of the identity provider (usso).
@@ -107,9 +116,22 @@ func (*identityProvider) Hidden() bool {
 	return false
 }
 
+// Category implements idp.IdentityProvider.Category.
+func (*identityProvider) Category() string {
+	return ""
+}
+
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (idp *identityProvider) ConfigParams() (string, interface{}) {
+	return "usso", idp.params
+}
+
 // Init initialises this identity provider
 func (idp *identityProvider) Init(_ context.Context, params idp.InitParams) error {
 	idp.initParams = params
+	if idp.params.StoreState {
+		idp.states = idputil.NewStateStore(params.KeyValueStore, 0, params.TokenGenerator)
+	}
 	srv := usso.ProductionUbuntuSSOServer
 	if idp.params.Staging {
 		srv = usso.StagingUbuntuSSOServer
@@ -142,8 +164,23 @@ func (idp *identityProvider) Handle(ctx context.Context, w http.ResponseWriter,
 }
 
 func (idp *identityProvider) login(ctx context.Context, w http.ResponseWriter, req *http.Request) {
-	query := "?state=" + idputil.State(req)
-	realm := idp.initParams.URLPrefix + "/callback"
+	state := idputil.State(req)
+	if idp.states != nil {
+		var ls idputil.LoginState
+		if err := idp.initParams.Codec.Cookie(req, idputil.LoginStateCookieName(idp.initParams.CookieNamePrefix), state, &ls); err != nil {
+			logger.Infof("Invalid login state: %s", err)
+			idputil.BadRequestf(w, "Login failed: invalid login state")
+			return
+		}
+		var err error
+		state, err = idp.states.PutLogin(ctx, state, nil)
+		if err != nil {
+			idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, errgo.Notef(err, "cannot store login state"))
+			return
+		}
+	}
+	query := "?state=" + state
+	realm := idputil.LocationURL(idp.initParams.URLPrefix, "/callback")
 	callback := realm + query
 	url := idp.client.RedirectURL(&openid.Request{
 		ReturnTo:     callback,
@@ -155,8 +192,8 @@ func (idp *identityProvider) login(ctx context.Context, w http.ResponseWriter, r
 }
 
 func (idp *identityProvider) callback(ctx context.Context, w http.ResponseWriter, req *http.Request) {
-	var ls idputil.LoginState
-	if err := idp.initParams.Codec.Cookie(req, idputil.LoginCookieName, req.Form.Get("state"), &ls); err != nil {
+	ls, err := idp.loginState(ctx, req)
+	if err != nil {
 		logger.Infof("Invalid login state: %s", err)
 		idputil.BadRequestf(w, "Login failed: invalid login state")
 		return
@@ -231,6 +268,22 @@ func (idp *identityProvider) callback(ctx context.Context, w http.ResponseWriter
 	successf(&identity)
 }
 
+// loginState returns the state of the login completed by the given
+// callback request. If state is being stored it is taken from the store,
+// so that it can only be used once.
+func (idp *identityProvider) loginState(ctx context.Context, req *http.Request) (*idputil.LoginState, error) {
+	cookieName := idputil.LoginStateCookieName(idp.initParams.CookieNamePrefix)
+	if idp.states != nil {
+		ls, err := idp.states.TakeLogin(ctx, req, idp.initParams.Codec, cookieName, idputil.State(req), nil)
+		return ls, errgo.Mask(err)
+	}
+	var ls idputil.LoginState
+	if err := idp.initParams.Codec.Cookie(req, cookieName, idputil.State(req), &ls); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &ls, nil
+}
+
 // GetGroups implements idp.IdentityProvider.GetGroups by fetching group
 // information from launchpad.
 func (idp *identityProvider) GetGroups(_ context.Context, id *store.Identity) ([]string, error) {
@@ -64,10 +64,10 @@ type Params struct {
 	// Domain will be appended to any usernames or groups provided by
 	// the identity provider. A user created by this identity provide
 	// will be openid@domain.
-	Domain string `yaml:"domain"`
+	Domain string `yaml:"domain" redact:"show"`
 
 	// URL is the address of the Ubuntu SSO server.
-	URL string `yaml:"url"`
+	URL string `yaml:"url" redact:"show"`
 
 	// PublicKey is the RSA public key used to encrypt caveats for
 	// UbuntuSSO third party caveats.
@@ -98,6 +98,22 @@ func (k *PublicKey) UnmarshalText(text []byte) error {
 	return nil
 }
 
+// MarshalText implements encoding.TextMarshaler by marshaling the
+// RSA public key in PEM format.
+func (k PublicKey) MarshalText() ([]byte, error) {
+	if k.N == nil {
+		return nil, nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal public key")
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}), nil
+}
+
 // NewIdentityProvider creates an idp.IdentityProvider that uses Ubuntu
 // SSO macaroon authentication, with the configuration defined by p.
 func NewIdentityProvider(p Params) (idp.IdentityProvider, error) {
@@ -156,6 +172,16 @@ func (*identityProvider) Hidden() bool {
 	return false
 }
 
+// Category implements idp.IdentityProvider.Category.
+func (*identityProvider) Category() string {
+	return ""
+}
+
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (idp *identityProvider) ConfigParams() (string, interface{}) {
+	return "usso_macaroon", idp.params
+}
+
 // Init initialises the identity provider.
 func (idp *identityProvider) Init(_ context.Context, params idp.InitParams) error {
 	idp.initParams = params
@@ -76,6 +76,16 @@ func (*identityProvider) Hidden() bool {
 	return false
 }
 
+// Category implements idp.IdentityProvider.Category.
+func (*identityProvider) Category() string {
+	return ""
+}
+
+// ConfigParams implements idp.ConfigReporter.ConfigParams.
+func (*identityProvider) ConfigParams() (string, interface{}) {
+	return "usso_oauth", nil
+}
+
 // Init initialises the identity provider.
 func (idp *identityProvider) Init(_ context.Context, params idp.InitParams) error {
 	idp.initParams = params
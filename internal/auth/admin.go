@@ -0,0 +1,117 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth
+
+import (
+	"context"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// AdminAccountProviderID returns the provider ID used for the
+// additional admin account with the given username.
+func AdminAccountProviderID(username params.Username) store.ProviderIdentity {
+	return store.MakeProviderIdentity("idm", string(username))
+}
+
+// validateAdminAccounts checks that the given admin accounts are
+// valid. Every account must have a unique username in the candid
+// domain, other than that of the admin user, and a public key.
+func validateAdminAccounts(accounts []params.AdminAccount) error {
+	seen := make(map[params.Username]bool)
+	for _, acc := range accounts {
+		if !strings.HasSuffix(string(acc.Username), "@candid") || acc.Username == "@candid" {
+			return errgo.Newf("invalid admin account username %q: must be in the candid domain", acc.Username)
+		}
+		if acc.Username == AdminUsername {
+			return errgo.Newf("invalid admin account username %q: reserved for the admin user", acc.Username)
+		}
+		if seen[acc.Username] {
+			return errgo.Newf("duplicate admin account %q", acc.Username)
+		}
+		seen[acc.Username] = true
+		if acc.PublicKey == nil {
+			return errgo.Newf("admin account %q has no public key", acc.Username)
+		}
+	}
+	return nil
+}
+
+// SetAdminAccounts configures the additional admin accounts. Each
+// account is stored as an agent identity with its public key so that
+// it can log in as an agent. Only the accounts in the most recent call
+// are treated as admin. Whether an account has been disabled is
+// retained.
+func (a *Authorizer) SetAdminAccounts(ctx context.Context, accounts []params.AdminAccount) error {
+	if err := validateAdminAccounts(accounts); err != nil {
+		return errgo.Mask(err)
+	}
+	adminAccounts := make(map[string]bool, len(accounts))
+	for _, acc := range accounts {
+		err := a.store.UpdateIdentity(
+			ctx,
+			&store.Identity{
+				ProviderID: AdminAccountProviderID(acc.Username),
+				Username:   string(acc.Username),
+				PublicKeys: []bakery.PublicKey{*acc.PublicKey},
+			},
+			store.Update{
+				store.Username:   store.Set,
+				store.PublicKeys: store.Set,
+			},
+		)
+		if err != nil {
+			return errgo.Notef(err, "cannot store admin account %q", acc.Username)
+		}
+		adminAccounts[string(acc.Username)] = true
+	}
+	a.adminAccounts = adminAccounts
+	return nil
+}
+
+// SetAdminAccountDisabled disables, or re-enables, the configured admin
+// account with the given username. The change takes effect for all
+// subsequent requests. If there is no such admin account an error with
+// a cause of params.ErrNotFound is returned.
+func (a *Authorizer) SetAdminAccountDisabled(ctx context.Context, username params.Username, disabled bool) error {
+	if !a.adminAccounts[string(username)] {
+		return errgo.WithCausef(nil, params.ErrNotFound, "admin account %q not found", username)
+	}
+	err := a.store.UpdateIdentity(ctx, &store.Identity{
+		ProviderID:    AdminAccountProviderID(username),
+		AdminDisabled: disabled,
+	}, store.Update{
+		store.AdminDisabled: store.Set,
+	})
+	if errgo.Cause(err) == store.ErrNotFound {
+		return errgo.WithCausef(err, params.ErrNotFound, "admin account %q not found", username)
+	}
+	return errgo.Mask(err)
+}
+
+// isAdminAccount reports whether the given identity is one of the
+// configured additional admin accounts.
+func (a *Authorizer) isAdminAccount(id *store.Identity) bool {
+	return a.adminAccounts[id.Username] && id.ProviderID == AdminAccountProviderID(params.Username(id.Username))
+}
+
+// adminAccountDisabled reports whether the given identity is a
+// configured admin account that has been disabled.
+func (a *Authorizer) adminAccountDisabled(id *store.Identity) bool {
+	return a.isAdminAccount(id) && id.AdminDisabled
+}
+
+// IsAdmin reports whether the identity is the admin user or one of the
+// configured admin accounts that has not been disabled.
+func (id *Identity) IsAdmin() bool {
+	if id.Username == AdminUsername {
+		return true
+	}
+	return id.authorizer.isAdminAccount(&id.Identity) && !id.authorizer.adminAccountDisabled(&id.Identity)
+}
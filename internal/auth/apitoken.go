@@ -0,0 +1,169 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// apiTokenRecord is the stored form of an API token. Only a hash of
+// the token's secret is stored.
+type apiTokenRecord struct {
+	Username string    `json:"username"`
+	Hash     []byte    `json:"hash"`
+	Expires  time.Time `json:"expires"`
+}
+
+// CreateAPIToken creates a new API token that authenticates as the
+// given user until the given expiry time. If expires is zero the token
+// expires after the maximum API token lifetime. The returned token is
+// the only copy of its secret.
+//
+// If API tokens are not enabled, or there is no such user, an error
+// with a cause of params.ErrNotFound is returned. An expiry time after
+// the maximum lifetime results in an error with a cause of
+// params.ErrBadRequest.
+func (a *Authorizer) CreateAPIToken(ctx context.Context, username params.Username, expires time.Time) (*params.APIToken, error) {
+	if a.apiTokens == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "API tokens are not enabled")
+	}
+	now := time.Now()
+	maxExpires := now.Add(a.apiTokenLifetime)
+	switch {
+	case expires.IsZero():
+		expires = maxExpires
+	case expires.After(maxExpires):
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "API token expiry must not be more than %v in the future", a.apiTokenLifetime)
+	case !expires.After(now):
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "API token expiry must be in the future")
+	}
+	id := store.Identity{
+		Username: string(username),
+	}
+	if err := a.store.Identity(ctx, &id); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return nil, errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		return nil, errgo.Mask(err)
+	}
+	tokenID, err := a.tokenGenerator.Generate()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	secret, err := a.tokenGenerator.Generate()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	hash := sha256.Sum256([]byte(secret))
+	b, err := json.Marshal(apiTokenRecord{
+		Username: id.Username,
+		Hash:     hash[:],
+		Expires:  expires,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := simplekv.SetKeyOnce(ctx, a.apiTokens, tokenID, b, expires); err != nil {
+		return nil, errgo.Notef(err, "cannot store API token")
+	}
+	return &params.APIToken{
+		ID:      tokenID,
+		Token:   tokenID + "." + secret,
+		Expires: expires,
+	}, nil
+}
+
+// RevokeAPIToken revokes the API token with the given ID belonging to
+// the given user. If there is no such token an error with a cause of
+// params.ErrNotFound is returned.
+func (a *Authorizer) RevokeAPIToken(ctx context.Context, username params.Username, tokenID string) error {
+	if a.apiTokens == nil {
+		return errgo.WithCausef(nil, params.ErrNotFound, "API tokens are not enabled")
+	}
+	rec, err := a.apiTokenRecord(ctx, tokenID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if rec == nil || rec.Username != string(username) || !rec.Expires.After(time.Now()) {
+		return errgo.WithCausef(nil, params.ErrNotFound, "API token %q not found", tokenID)
+	}
+	// Storing the token with an expiry time that has already passed
+	// removes it.
+	now := time.Now()
+	rec.Expires = now
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(a.apiTokens.Set(ctx, tokenID, b, now))
+}
+
+// identityFromAPIToken returns the identity that the given API token
+// authenticates. If the token is not valid an error with a cause of
+// params.ErrUnauthorized is returned.
+func (a *Authorizer) identityFromAPIToken(ctx context.Context, token string) (*Identity, error) {
+	if a.apiTokens == nil {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "API token authentication is not enabled")
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid API token")
+	}
+	rec, err := a.apiTokenRecord(ctx, parts[0])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if rec == nil {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid API token")
+	}
+	hash := sha256.Sum256([]byte(parts[1]))
+	if subtle.ConstantTimeCompare(hash[:], rec.Hash) != 1 {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid API token")
+	}
+	if !rec.Expires.After(time.Now()) {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "API token has expired")
+	}
+	id, err := a.Identity(ctx, &store.Identity{
+		Username: rec.Username,
+	})
+	if err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return nil, errgo.WithCausef(err, params.ErrUnauthorized, "API token user no longer exists")
+		}
+		return nil, errgo.Mask(err)
+	}
+	if idputil.IsSuspended(&id.Identity) {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "API token user %s has been deactivated", id.Id())
+	}
+	return id, nil
+}
+
+// apiTokenRecord retrieves the record of the API token with the given
+// ID. If there is no such token a nil record is returned.
+func (a *Authorizer) apiTokenRecord(ctx context.Context, tokenID string) (*apiTokenRecord, error) {
+	b, err := a.apiTokens.Get(ctx, tokenID)
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	var rec apiTokenRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, errgo.Notef(err, "invalid API token record")
+	}
+	return &rec, nil
+}
@@ -5,19 +5,29 @@ package auth
 
 import (
 	"context"
+	"net"
+	"net/http"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/juju/aclstore/v2"
 	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 	macaroon "gopkg.in/macaroon.v2"
 
+	"github.com/canonical/candid/audit"
+	"github.com/canonical/candid/breakglass"
+	"github.com/canonical/candid/events"
+	"github.com/canonical/candid/groupwebhook"
 	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/ratelimit"
 	"github.com/canonical/candid/store"
 )
 
@@ -82,6 +92,28 @@ type Authorizer struct {
 	store          store.Store
 	groupResolvers map[string]groupResolver
 	aclManager     *aclstore.Manager
+	groupRules     []store.GroupRule
+
+	// macaroonVerifier verifies macaroons minted by the service.
+	macaroonVerifier bakery.MacaroonVerifier
+
+	// adminAccounts holds the usernames of the configured
+	// additional admin accounts.
+	adminAccounts map[string]bool
+
+	// apiTokens holds the store of API tokens. It is nil if API
+	// tokens are not enabled.
+	apiTokens        simplekv.Store
+	apiTokenLifetime time.Duration
+	tokenGenerator   *idputil.TokenGenerator
+
+	// breakGlass holds the break-glass credential. It is nil if
+	// break-glass access is not enabled.
+	breakGlass      *breakglass.Credential
+	eventDispatcher *events.Dispatcher
+	breakGlassLimit ratelimit.Limiter
+	auditLogger     audit.Logger
+	clientIP        func(*http.Request) net.IP
 }
 
 // Params specifify the configuration parameters for a new Authroizer.
@@ -109,6 +141,50 @@ type Params struct {
 
 	// ACLStore is the acl store.
 	ACLManager *aclstore.Manager
+
+	// GroupRules contains rules that add groups to identities based
+	// on their attributes.
+	GroupRules []store.GroupRule
+
+	// APITokenStore holds the store used for API tokens. If this is
+	// nil API tokens are not enabled.
+	APITokenStore simplekv.Store
+
+	// APITokenLifetime holds the maximum lifetime of an API token.
+	APITokenLifetime time.Duration
+
+	// TokenGenerator holds the generator used for the IDs and
+	// secrets of API tokens. If this is nil the default generator is
+	// used.
+	TokenGenerator *idputil.TokenGenerator
+
+	// BreakGlass holds the emergency credential that grants admin
+	// access. If this is nil break-glass access is not enabled.
+	BreakGlass *breakglass.Credential
+
+	// EventDispatcher holds the dispatcher that is sent an event
+	// whenever the break-glass credential is used, successfully or
+	// not.
+	EventDispatcher *events.Dispatcher
+
+	// LoginRateLimiter, if set, limits the rate at which each client
+	// may attempt to use the break-glass credential.
+	LoginRateLimiter ratelimit.Limiter
+
+	// AuditLogger, if set, records every attempt to use the
+	// break-glass credential.
+	AuditLogger audit.Logger
+
+	// ClientIP returns the address of the client that made the given
+	// request. If this is nil the address the request was received
+	// from is used.
+	ClientIP func(*http.Request) net.IP
+
+	// GroupWebhook holds the group webhook resolver, if any. The
+	// groups of users of identity providers whose groups are
+	// replaced by the webhook are those stored by the webhook when
+	// they logged in, not those reported by the identity provider.
+	GroupWebhook *groupwebhook.Resolver
 }
 
 // New creates a new Authorizer for authorizing identity server
@@ -124,10 +200,27 @@ func New(params Params) (*Authorizer, error) {
 		location:      params.Location,
 		store:         params.Store,
 		aclManager:    params.ACLManager,
+		groupRules:    params.GroupRules,
+
+		macaroonVerifier: params.MacaroonVerifier,
+
+		apiTokens:        params.APITokenStore,
+		apiTokenLifetime: params.APITokenLifetime,
+		tokenGenerator:   params.TokenGenerator,
+
+		breakGlass:      params.BreakGlass,
+		eventDispatcher: params.EventDispatcher,
+		breakGlassLimit: params.LoginRateLimiter,
+		auditLogger:     params.AuditLogger,
+		clientIP:        params.ClientIP,
 	}
 	resolvers := make(map[string]groupResolver)
 	for _, idp := range params.IdentityProviders {
 		idp := idp
+		if params.GroupWebhook.Replaces(idp.Name()) {
+			resolvers[idp.Name()] = storedGroupResolver{}
+			continue
+		}
 		resolvers[idp.Name()] = idpGroupResolver{idp}
 	}
 	// Add a group resolver for the built-in candid provider.
@@ -150,20 +243,67 @@ func New(params Params) (*Authorizer, error) {
 	return a, nil
 }
 
+// aclForOp returns the ACL for the given operation, and whether the
+// operation is public. If the context holds a request cache the result
+// is cached there.
 func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string, public bool, _ error) {
+	rc := requestCacheFromContext(ctx)
+	if r, ok := rc.acl(op); ok {
+		return r.acl, r.public, nil
+	}
+	acl, public, err := a.aclForOpNoCache(ctx, op)
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	rc.setACL(op, aclResult{acl: acl, public: public})
+	return acl, public, nil
+}
+
+// privilegedACL returns the name of the ACL that is the only source of
+// access to the given operation. The boolean result is false if the
+// operation is public or may also be performed by the user it
+// concerns.
+func privilegedACL(op bakery.Op) (string, bool) {
 	kind, name := splitEntity(op.Entity)
 	switch kind {
 	case kindGlobal:
 		if name != "" {
-			return nil, false, nil
+			return "", false
 		}
 		switch op.Action {
 		case ActionRead:
-			acl, err := a.aclManager.ACL(ctx, readUserACL)
-			return acl, false, errgo.Mask(err)
+			return readUserACL, true
 		case ActionDischargeFor:
-			acl, err := a.aclManager.ACL(ctx, dischargeForUserACL)
-			return acl, false, errgo.Mask(err)
+			return dischargeForUserACL, true
+		case ActionCreateParentAgent, ActionReadAdmin, ActionWriteAdmin:
+			return writeUserACL, true
+		}
+	case kindUser:
+		if name == "" {
+			return "", false
+		}
+		switch op.Action {
+		case ActionReadAdmin:
+			return readUserACL, true
+		case ActionWriteAdmin, ActionWriteGroups:
+			return writeUserACL, true
+		}
+	}
+	return "", false
+}
+
+func (a *Authorizer) aclForOpNoCache(ctx context.Context, op bakery.Op) (acl []string, public bool, _ error) {
+	if aclName, ok := privilegedACL(op); ok {
+		acl, err := a.aclManager.ACL(ctx, aclName)
+		return acl, false, errgo.Mask(err)
+	}
+	kind, name := splitEntity(op.Entity)
+	switch kind {
+	case kindGlobal:
+		if name != "" {
+			return nil, false, nil
+		}
+		switch op.Action {
 		case ActionVerify:
 			// Everyone is allowed to verify a macaroon.
 			return []string{identchecker.Everyone}, true, nil
@@ -178,9 +318,6 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 			// Anyone can create an agent, as long as they've authenticated
 			// themselves.
 			return []string{identchecker.Everyone}, false, nil
-		case ActionCreateParentAgent:
-			acl, err := a.aclManager.ACL(ctx, writeUserACL)
-			return acl, false, errgo.Mask(err)
 		}
 	case kindUser:
 		if name == "" {
@@ -191,18 +328,9 @@ func (a *Authorizer) aclForOp(ctx context.Context, op bakery.Op) (acl []string,
 		case ActionRead:
 			acl, err := a.aclManager.ACL(ctx, readUserACL)
 			return append(acl, username), false, errgo.Mask(err)
-		case ActionReadAdmin:
-			acl, err := a.aclManager.ACL(ctx, readUserACL)
-			return acl, false, errgo.Mask(err)
-		case ActionWriteAdmin:
-			acl, err := a.aclManager.ACL(ctx, writeUserACL)
-			return acl, false, errgo.Mask(err)
 		case ActionReadGroups:
 			acl, err := a.aclManager.ACL(ctx, readUserGroupsACL)
 			return append(acl, username), false, errgo.Mask(err)
-		case ActionWriteGroups:
-			acl, err := a.aclManager.ACL(ctx, writeUserACL)
-			return acl, false, errgo.Mask(err)
 		case ActionReadSSHKeys:
 			acl, err := a.aclManager.ACL(ctx, readUserSSHKeysACL)
 			return append(acl, username), false, errgo.Mask(err)
@@ -288,6 +416,9 @@ func (a *Authorizer) Auth(ctx context.Context, mss []macaroon.Slice, ops ...bake
 		}
 		return nil, errgo.Mask(err, isDischargeRequiredError)
 	}
+	if id, ok := authInfo.Identity.(*Identity); ok && a.adminAccountDisabled(&id.Identity) {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "admin account %q is disabled", id.Username)
+	}
 	return authInfo, nil
 }
 
@@ -296,6 +427,24 @@ func isDischargeRequiredError(err error) bool {
 	return ok
 }
 
+// Allowed reports whether the given identity is allowed to perform the
+// given operation. Unlike Auth, no macaroons are checked, the identity
+// must already have been authenticated.
+func (a *Authorizer) Allowed(ctx context.Context, id *Identity, op bakery.Op) (bool, error) {
+	acl, public, err := a.aclForOp(ctx, op)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	if public {
+		return true, nil
+	}
+	if id == nil || a.adminAccountDisabled(&id.Identity) {
+		return false, nil
+	}
+	ok, err := id.Allow(ctx, acl)
+	return ok, errgo.Mask(err)
+}
+
 // Identity creates a new identity for the user identified by the given
 // store.Identity.
 func (a *Authorizer) Identity(ctx context.Context, id *store.Identity) (*Identity, error) {
@@ -304,6 +453,15 @@ func (a *Authorizer) Identity(ctx context.Context, id *store.Identity) (*Identit
 		authorizer: a,
 	}
 	if aid.Identity.ID == "" {
+		rc := requestCacheFromContext(ctx)
+		key := identityLookup{
+			providerID: id.ProviderID,
+			username:   id.Username,
+		}
+		if cached, ok := rc.identity(key); ok {
+			aid.Identity = cached
+			return aid, nil
+		}
 		// Get the complete identity information from the store.
 		if err := a.store.Identity(ctx, &aid.Identity); err != nil {
 			if errgo.Cause(err) == store.ErrNotFound {
@@ -311,6 +469,7 @@ func (a *Authorizer) Identity(ctx context.Context, id *store.Identity) (*Identit
 			}
 			return nil, errgo.Mask(err)
 		}
+		rc.setIdentity(key, aid.Identity)
 	}
 	return aid, nil
 }
@@ -331,7 +490,21 @@ func (a *Authorizer) IdentityFromContext(ctx context.Context) (identchecker.Iden
 		}
 		return id, nil, nil
 	}
+	if token, ok := bearerTokenFromContext(ctx); ok {
+		id, err := a.identityFromAPIToken(ctx, token)
+		if err != nil {
+			return nil, nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+		}
+		return id, nil, nil
+	}
 	if username, password, ok := userCredentialsFromContext(ctx); ok {
+		if a.breakGlass != nil && username == a.breakGlass.Username() {
+			id, err := a.breakGlassIdentity(ctx, username, password)
+			if err != nil {
+				return nil, nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized), errgo.Is(params.ErrTooManyRequests))
+			}
+			return id, nil, nil
+		}
 		// TODO the mismatch between the username in the basic auth
 		// credentials and the admin username is unfortunate but we'll
 		// leave it for now. We should probably remove basic-auth authentication
@@ -438,21 +611,40 @@ func (id *Identity) Allow(ctx context.Context, acl []string) (bool, error) {
 // Groups returns all the groups associated with the user. The groups
 // include those stored in the identity server's database along with any
 // retrieved by the relevent identity provider's GetGroups method. Once
-// the set of groups has been determined it is cached in the Identity.
+// the set of groups has been determined it is cached in the Identity,
+// and in the request cache if the context holds one.
 func (id *Identity) Groups(ctx context.Context) ([]string, error) {
 	if id.resolvedGroups != nil {
 		return id.resolvedGroups, nil
 	}
+	rc := requestCacheFromContext(ctx)
+	if groups, ok := rc.resolvedGroups(id.ProviderID); ok {
+		id.resolvedGroups = groups
+		return groups, nil
+	}
 	groups := id.Identity.Groups
+	resolved := false
 	if gr := id.authorizer.groupResolvers[id.ProviderID.Provider()]; gr != nil {
 		var err error
 		groups, err = gr.resolveGroups(ctx, &id.Identity)
 		if err != nil {
 			logger.Warningf("error resolving groups: %s", err)
 		} else {
-			id.resolvedGroups = groups
+			resolved = true
 		}
 	}
+	if ruleGroups := store.RuleGroups(id.authorizer.groupRules, &id.Identity); len(ruleGroups) > 0 {
+		// Don't modify the slice returned by the resolver.
+		groups = uniqueStrings(append(append([]string(nil), groups...), ruleGroups...))
+	}
+	if id.Username != AdminUsername && id.IsAdmin() {
+		// Configured admin accounts are members of the admin group.
+		groups = uniqueStrings(append(append([]string(nil), groups...), AdminUsername))
+	}
+	if resolved {
+		id.resolvedGroups = groups
+		rc.setResolvedGroups(id.ProviderID, groups)
+	}
 	return groups, nil
 }
 
@@ -499,6 +691,20 @@ func GlobalOp(action string) bakery.Op {
 	return op(kindGlobal, action)
 }
 
+// AnonymousSessionOp is the operation authorized by anonymous session
+// macaroons. No ACL grants this operation, so an anonymous session
+// macaroon cannot be used to authenticate to any part of the API; it
+// can only be upgraded by logging in.
+var AnonymousSessionOp = op("anonymous-session", "anonymous")
+
+// IsAdminOp reports whether the given operation is one that can only be
+// performed by administrators, that is one that is neither public nor
+// allowed for the user it concerns.
+func IsAdminOp(op bakery.Op) bool {
+	_, ok := privilegedACL(op)
+	return ok
+}
+
 func op(entity, action string) bakery.Op {
 	return bakery.Op{
 		Entity: entity,
@@ -576,6 +782,16 @@ func (r candidGroupResolver) resolveGroups(ctx context.Context, identity *store.
 	return allowedGroups, nil
 }
 
+// storedGroupResolver is the group resolver used for identity
+// providers whose groups are replaced by the group webhook. It returns
+// only the groups stored with the identity.
+type storedGroupResolver struct{}
+
+// resolveGroups implements groupResolver.
+func (storedGroupResolver) resolveGroups(ctx context.Context, id *store.Identity) ([]string, error) {
+	return id.Groups, nil
+}
+
 type idpGroupResolver struct {
 	idp idp.IdentityProvider
 }
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"sort"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
@@ -19,6 +20,7 @@ import (
 	macaroon "gopkg.in/macaroon.v2"
 
 	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/groupwebhook"
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/idp/static"
 	"github.com/canonical/candid/internal/auth"
@@ -82,6 +84,15 @@ func (s *authSuite) Init(c *qt.C) {
 			}),
 		},
 		ACLManager: aclManager,
+		GroupRules: []store.GroupRule{{
+			Group:     "example-staff",
+			Attribute: "email-domain",
+			Value:     "example.com",
+		}, {
+			Group:     "test-group1",
+			Attribute: "email-domain",
+			Value:     "example.com",
+		}},
 	})
 	c.Assert(err, qt.IsNil)
 	s.adminAgentKey, err = bakery.GenerateKey()
@@ -287,6 +298,98 @@ func (s *authSuite) TestAdminUserGroups(c *qt.C) {
 	assertAuthorizedGroups(c, authInfo, nil)
 }
 
+func (s *authSuite) TestAdminAccounts(c *qt.C) {
+	alice, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	bob, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	err = s.authorizer.SetAdminAccounts(s.context, []params.AdminAccount{{
+		Username:  "alice@candid",
+		PublicKey: &alice.Public,
+	}, {
+		Username:  "bob@candid",
+		PublicKey: &bob.Public,
+	}})
+	c.Assert(err, qt.IsNil)
+
+	checker := auth.NewChecker(s.authorizer)
+	checkCaveat := func(cav checkers.Caveat) error {
+		cav = checker.Namespace().ResolveCaveat(cav)
+		return checker.CheckFirstPartyCaveat(s.context, cav.Condition)
+	}
+	adminOp := auth.GlobalOp(auth.ActionWriteAdmin)
+	for username, key := range map[string]*bakery.KeyPair{"alice@candid": alice, "bob@candid": bob} {
+		// Each account can log in as an agent with its own key.
+		err := checkCaveat(auth.UserHasPublicKeyCaveat(params.Username(username), &key.Public))
+		c.Assert(err, qt.IsNil)
+		m := s.identityMacaroon(c, username)
+		authInfo, err := s.authorizer.Auth(s.context, []macaroon.Slice{{m.M()}}, adminOp)
+		c.Assert(err, qt.IsNil, qt.Commentf("%s", username))
+		c.Assert(authInfo.Identity.Id(), qt.Equals, username)
+		c.Assert(authInfo.Identity.(*auth.Identity).IsAdmin(), qt.Equals, true)
+	}
+	err = checkCaveat(auth.UserHasPublicKeyCaveat("alice@candid", &bob.Public))
+	c.Assert(err, qt.ErrorMatches, "caveat.*not satisfied: public key not valid for user")
+
+	// Disabling one account does not affect the other.
+	err = s.authorizer.SetAdminAccountDisabled(s.context, "alice@candid", true)
+	c.Assert(err, qt.IsNil)
+	m := s.identityMacaroon(c, "alice@candid")
+	_, err = s.authorizer.Auth(s.context, []macaroon.Slice{{m.M()}}, identchecker.LoginOp)
+	c.Assert(err, qt.ErrorMatches, `admin account "alice@candid" is disabled`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	m = s.identityMacaroon(c, "bob@candid")
+	_, err = s.authorizer.Auth(s.context, []macaroon.Slice{{m.M()}}, adminOp)
+	c.Assert(err, qt.IsNil)
+
+	// Re-enabling the account allows it to log in again.
+	err = s.authorizer.SetAdminAccountDisabled(s.context, "alice@candid", false)
+	c.Assert(err, qt.IsNil)
+	m = s.identityMacaroon(c, "alice@candid")
+	_, err = s.authorizer.Auth(s.context, []macaroon.Slice{{m.M()}}, adminOp)
+	c.Assert(err, qt.IsNil)
+
+	// The disabled flag is not held in the extra-info.
+	err = s.store.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: auth.AdminAccountProviderID("alice@candid"),
+		ExtraInfo: map[string][]string{
+			"admin-disabled": {"false"},
+		},
+	}, store.Update{
+		store.ExtraInfo: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.authorizer.SetAdminAccountDisabled(s.context, "alice@candid", true)
+	c.Assert(err, qt.IsNil)
+	id := store.Identity{ProviderID: auth.AdminAccountProviderID("alice@candid")}
+	err = s.store.Store.Identity(s.context, &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.AdminDisabled, qt.IsTrue)
+	c.Assert(id.ExtraInfo["admin-disabled"], qt.DeepEquals, []string{"false"})
+	err = s.authorizer.SetAdminAccountDisabled(s.context, "alice@candid", false)
+	c.Assert(err, qt.IsNil)
+
+	// Only configured admin accounts can be disabled.
+	err = s.authorizer.SetAdminAccountDisabled(s.context, "test@candid", true)
+	c.Assert(err, qt.ErrorMatches, `admin account "test@candid" not found`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+}
+
+func (s *authSuite) TestAdminAccountsAreNotAdminOnceRemoved(c *qt.C) {
+	key, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	err = s.authorizer.SetAdminAccounts(s.context, []params.AdminAccount{{
+		Username:  "alice@candid",
+		PublicKey: &key.Public,
+	}})
+	c.Assert(err, qt.IsNil)
+	err = s.authorizer.SetAdminAccounts(s.context, nil)
+	c.Assert(err, qt.IsNil)
+	m := s.identityMacaroon(c, "alice@candid")
+	_, err = s.authorizer.Auth(s.context, []macaroon.Slice{{m.M()}}, auth.GlobalOp(auth.ActionWriteAdmin))
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+}
+
 func (s *authSuite) TestNonExistentUser(c *qt.C) {
 	m := s.identityMacaroon(c, "noone")
 	_, err := s.authorizer.Auth(s.context, []macaroon.Slice{{m.M()}}, identchecker.LoginOp)
@@ -302,6 +405,29 @@ func (s *authSuite) TestExistingUserGroups(c *qt.C) {
 	assertAuthorizedGroups(c, authInfo, []string{"test-group1", "test-group2"})
 }
 
+func (s *authSuite) TestGroupRules(c *qt.C) {
+	err := s.store.Store.UpdateIdentity(s.context, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "ruled"),
+		Username:   "ruled",
+		Email:      "ruled@example.com",
+		Groups:     []string{"test-group2", "test-group1"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Email:    store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	m := s.identityMacaroon(c, "ruled")
+	authInfo, err := s.authorizer.Auth(s.context, []macaroon.Slice{{m.M()}}, identchecker.LoginOp)
+	c.Assert(err, qt.IsNil)
+	assertAuthorizedGroups(c, authInfo, []string{"example-staff", "test-group1", "test-group2"})
+
+	// The rule groups are used when checking ACLs.
+	ok, err := authInfo.Identity.(*auth.Identity).Allow(s.context, []string{"example-staff"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.Equals, true)
+}
+
 func assertAuthorizedGroups(c *qt.C, authInfo *identchecker.AuthInfo, expectGroups []string) {
 	c.Assert(authInfo.Identity, qt.Not(qt.IsNil))
 	ident := authInfo.Identity.(*auth.Identity)
@@ -403,3 +529,256 @@ type testGroupGetter struct {
 func (t testGroupGetter) GetGroups(_ context.Context, id *store.Identity) ([]string, error) {
 	return t.groups, t.error
 }
+
+func TestUserAgentFingerprint(t *testing.T) {
+	c := qt.New(t)
+	firefox78 := auth.UserAgentFingerprint("Mozilla/5.0 (X11; Linux x86_64; rv:78.0) Gecko/20100101 Firefox/78.0")
+	firefox79 := auth.UserAgentFingerprint("Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0")
+	chrome := auth.UserAgentFingerprint("Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/84.0.4147.89 Safari/537.36")
+	c.Assert(firefox78, qt.Equals, firefox79)
+	c.Assert(firefox78, qt.Not(qt.Equals), chrome)
+}
+
+var isAdminOpTests = []struct {
+	op     bakery.Op
+	expect bool
+}{
+	{auth.GlobalOp(auth.ActionRead), true},
+	{auth.GlobalOp(auth.ActionDischargeFor), true},
+	{auth.GlobalOp(auth.ActionCreateParentAgent), true},
+	{auth.GlobalOp(auth.ActionReadAdmin), true},
+	{auth.GlobalOp(auth.ActionWriteAdmin), true},
+	{auth.UserOp("bob", auth.ActionReadAdmin), true},
+	{auth.UserOp("bob", auth.ActionWriteAdmin), true},
+	{auth.UserOp("bob", auth.ActionWriteGroups), true},
+	{auth.GlobalOp(auth.ActionLogin), false},
+	{auth.GlobalOp(auth.ActionCreateAgent), false},
+	{auth.UserOp("bob", auth.ActionRead), false},
+	{auth.UserOp("bob", auth.ActionReadGroups), false},
+	{auth.UserOp("bob", auth.ActionWriteSSHKeys), false},
+	{auth.UserIDOp("test:bob", auth.ActionRead), false},
+}
+
+func TestIsAdminOp(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range isAdminOpTests {
+		c.Check(auth.IsAdminOp(test.op), qt.Equals, test.expect, qt.Commentf("%#v", test.op))
+	}
+}
+
+func (s *authSuite) TestAuthTime(c *qt.C) {
+	t0 := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	mint := func(oven *bakery.Oven, ops ...bakery.Op) macaroon.Slice {
+		m, err := oven.NewMacaroon(s.context, bakery.LatestVersion, nil, append([]bakery.Op{identchecker.LoginOp}, ops...)...)
+		c.Assert(err, qt.IsNil)
+		return macaroon.Slice{m.M()}
+	}
+
+	_, ok := s.authorizer.AuthTime(s.context, []macaroon.Slice{mint(s.oven)})
+	c.Assert(ok, qt.Equals, false)
+
+	authTime, ok := s.authorizer.AuthTime(s.context, []macaroon.Slice{mint(s.oven, auth.AuthTimeOp(t0))})
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(authTime.Equal(t0), qt.Equals, true)
+
+	// The earliest time is used.
+	authTime, ok = s.authorizer.AuthTime(s.context, []macaroon.Slice{
+		mint(s.oven, auth.AuthTimeOp(t0)),
+		mint(s.oven, auth.AuthTimeOp(t0.Add(-time.Minute))),
+	})
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(authTime.Equal(t0.Add(-time.Minute)), qt.Equals, true)
+
+	// A declaration added by the holder of the macaroon is ignored.
+	ms := mint(s.oven)
+	err := ms[0].AddFirstPartyCaveat([]byte(candidclient.AuthTimeDeclaration(t0).Condition))
+	c.Assert(err, qt.IsNil)
+	_, ok = s.authorizer.AuthTime(s.context, []macaroon.Slice{ms})
+	c.Assert(ok, qt.Equals, false)
+
+	// Macaroons not minted by the service are ignored.
+	forger := bakery.NewOven(bakery.OvenParams{
+		Key:      bakery.MustGenerateKey(),
+		Location: "identity",
+	})
+	_, ok = s.authorizer.AuthTime(s.context, []macaroon.Slice{mint(forger, auth.AuthTimeOp(t0))})
+	c.Assert(ok, qt.Equals, false)
+}
+
+func (s *authSuite) TestLoginIDP(c *qt.C) {
+	mint := func(ops ...bakery.Op) macaroon.Slice {
+		m, err := s.oven.NewMacaroon(s.context, bakery.LatestVersion, nil, append([]bakery.Op{identchecker.LoginOp}, ops...)...)
+		c.Assert(err, qt.IsNil)
+		return macaroon.Slice{m.M()}
+	}
+
+	_, ok := s.authorizer.LoginIDP(s.context, []macaroon.Slice{mint()})
+	c.Assert(ok, qt.Equals, false)
+
+	idp, ok := s.authorizer.LoginIDP(s.context, []macaroon.Slice{mint(auth.LoginIDPOp("test"))})
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(idp, qt.Equals, "test")
+
+	// A declaration added by the holder of the macaroon is ignored.
+	ms := mint()
+	err := ms[0].AddFirstPartyCaveat([]byte(candidclient.LoginIDPDeclaration("test").Condition))
+	c.Assert(err, qt.IsNil)
+	_, ok = s.authorizer.LoginIDP(s.context, []macaroon.Slice{ms})
+	c.Assert(ok, qt.Equals, false)
+}
+
+func (s *authSuite) TestSessionID(c *qt.C) {
+	mint := func(ops ...bakery.Op) macaroon.Slice {
+		m, err := s.oven.NewMacaroon(s.context, bakery.LatestVersion, nil, append([]bakery.Op{identchecker.LoginOp}, ops...)...)
+		c.Assert(err, qt.IsNil)
+		return macaroon.Slice{m.M()}
+	}
+
+	_, ok := s.authorizer.SessionID(s.context, []macaroon.Slice{mint()})
+	c.Assert(ok, qt.Equals, false)
+
+	sid, ok := s.authorizer.SessionID(s.context, []macaroon.Slice{mint(auth.SessionIDOp("1234"))})
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(sid, qt.Equals, "1234")
+
+	// A declaration added by the holder of the macaroon is ignored.
+	ms := mint()
+	err := ms[0].AddFirstPartyCaveat([]byte(candidclient.SessionDeclaration("1234").Condition))
+	c.Assert(err, qt.IsNil)
+	_, ok = s.authorizer.SessionID(s.context, []macaroon.Slice{ms})
+	c.Assert(ok, qt.Equals, false)
+}
+
+// countingStore is a store.Store that counts the number of identity
+// lookups made.
+type countingStore struct {
+	store.Store
+	identityCalls int
+}
+
+func (s *countingStore) Identity(ctx context.Context, id *store.Identity) error {
+	s.identityCalls++
+	return s.Store.Identity(ctx, id)
+}
+
+func TestGroupWebhookReplacesIDPGroups(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := candidtest.NewStore()
+	aclManager, err := aclstore.NewManager(ctx, aclstore.Params{
+		Store:             st.ACLStore,
+		InitialAdminUsers: []string{auth.AdminUsername},
+	})
+	c.Assert(err, qt.IsNil)
+	webhook, err := groupwebhook.NewResolver(groupwebhook.Config{
+		URL:  "http://example.com",
+		Mode: groupwebhook.ModeReplace,
+	})
+	c.Assert(err, qt.IsNil)
+	authorizer, err := auth.New(auth.Params{
+		Location: identityLocation,
+		MacaroonVerifier: bakery.NewOven(bakery.OvenParams{
+			Key:      bakery.MustGenerateKey(),
+			Location: "identity",
+		}),
+		Store: st.Store,
+		IdentityProviders: []idp.IdentityProvider{
+			static.NewIdentityProvider(static.Params{
+				Name: "test",
+				Users: map[string]static.UserInfo{
+					"bob": {
+						Password: "bobpass",
+						Groups:   []string{"idp-group"},
+					},
+				},
+			}),
+		},
+		ACLManager:   aclManager,
+		GroupWebhook: webhook,
+	})
+	c.Assert(err, qt.IsNil)
+	err = st.Store.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"webhook-group"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// Only the groups stored by the webhook are used, not those
+	// reported by the identity provider.
+	authInfo, err := authorizer.Auth(auth.ContextWithUsername(ctx, "bob"), nil, auth.UserOp("bob", auth.ActionRead))
+	c.Assert(err, qt.IsNil)
+	assertAuthorizedGroups(c, authInfo, []string{"webhook-group"})
+}
+
+func TestRequestCache(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := candidtest.NewStore()
+	cst := &countingStore{Store: st.Store}
+	aclManager, err := aclstore.NewManager(ctx, aclstore.Params{
+		Store:             st.ACLStore,
+		InitialAdminUsers: []string{auth.AdminUsername},
+	})
+	c.Assert(err, qt.IsNil)
+	authorizer, err := auth.New(auth.Params{
+		Location: identityLocation,
+		MacaroonVerifier: bakery.NewOven(bakery.OvenParams{
+			Key:      bakery.MustGenerateKey(),
+			Location: "identity",
+		}),
+		Store:      cst,
+		ACLManager: aclManager,
+	})
+	c.Assert(err, qt.IsNil)
+	err = st.Store.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"g1"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	ops := []bakery.Op{
+		auth.UserOp("bob", auth.ActionRead),
+		auth.UserOp("bob", auth.ActionReadGroups),
+		auth.UserOp("bob", auth.ActionReadSSHKeys),
+	}
+	authorizeAll := func(ctx context.Context) {
+		ctx = auth.ContextWithUsername(ctx, "bob")
+		for _, op := range ops {
+			authInfo, err := authorizer.Auth(ctx, nil, op)
+			c.Assert(err, qt.IsNil)
+			assertAuthorizedGroups(c, authInfo, []string{"g1"})
+		}
+	}
+
+	// Without a request cache every check looks up the identity.
+	authorizeAll(ctx)
+	c.Assert(cst.identityCalls, qt.Equals, len(ops))
+
+	// With a request cache the identity is only looked up once.
+	cst.identityCalls = 0
+	authorizeAll(auth.ContextWithRequestCache(ctx))
+	c.Assert(cst.identityCalls, qt.Equals, 1)
+
+	// Results are not shared between requests.
+	err = st.Store.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Groups:     []string{"g2"},
+	}, store.Update{
+		store.Groups: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	cst.identityCalls = 0
+	rctx := auth.ContextWithUsername(auth.ContextWithRequestCache(ctx), "bob")
+	authInfo, err := authorizer.Auth(rctx, nil, ops[0])
+	c.Assert(err, qt.IsNil)
+	assertAuthorizedGroups(c, authInfo, []string{"g2"})
+	c.Assert(cst.identityCalls, qt.Equals, 1)
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/audit"
+	"github.com/canonical/candid/events"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// breakGlassLogger is the logger used to record every attempt to use
+// the break-glass credential. It is separate from the package logger
+// so that it can be directed to a dedicated audit log.
+var breakGlassLogger = loggo.GetLogger("candid.breakglass")
+
+// breakGlassIDP is the identity provider name recorded in the audit
+// log for attempts to use the break-glass credential.
+const breakGlassIDP = "break-glass"
+
+// breakGlassIdentity checks the given break-glass credentials and
+// returns the admin identity if they are valid. The identity is not
+// read from the store, so that break-glass access works when the store
+// or identity providers are unavailable. Attempts are subject to the
+// login rate limit for the client, and every attempt is logged,
+// audited and sent as an event.
+func (a *Authorizer) breakGlassIdentity(ctx context.Context, username, password string) (*Identity, error) {
+	var remoteAddr, clientIP, method, path string
+	if req := requestFromContext(ctx); req != nil {
+		remoteAddr, method, path = req.RemoteAddr, req.Method, req.URL.Path
+		clientIP = a.requestClientIP(req)
+	}
+	data := map[string]string{
+		"credential-username": username,
+		"remote-addr":         remoteAddr,
+		"method":              method,
+		"path":                path,
+	}
+	if err := a.checkBreakGlassRate(ctx, clientIP); err != nil {
+		breakGlassLogger.Warningf("rejected break-glass access by %q from %s to %s %s: %s", username, remoteAddr, method, path, err)
+		a.breakGlassFailed(ctx, username, clientIP, data, err)
+		return nil, errgo.Mask(err, errgo.Is(params.ErrTooManyRequests))
+	}
+	ok, err := a.breakGlass.Match(username, password, time.Now())
+	if err == nil && !ok {
+		err = errgo.New("invalid password")
+	}
+	if err != nil {
+		breakGlassLogger.Warningf("rejected break-glass access by %q from %s to %s %s: %s", username, remoteAddr, method, path, err)
+		a.breakGlassFailed(ctx, username, clientIP, data, err)
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "invalid credentials")
+	}
+	breakGlassLogger.Warningf("BREAK-GLASS ADMIN ACCESS by %q from %s to %s %s", username, remoteAddr, method, path)
+	a.eventDispatcher.Dispatch(events.Event{
+		Type:       events.BreakGlass,
+		Username:   AdminUsername,
+		ProviderID: string(AdminProviderID),
+		Data:       data,
+	})
+	a.auditBreakGlass(ctx, &audit.Event{
+		Outcome:  audit.Success,
+		Username: username,
+		ClientIP: clientIP,
+	})
+	return &Identity{
+		Identity: store.Identity{
+			ProviderID: AdminProviderID,
+			Username:   AdminUsername,
+		},
+		authorizer:     a,
+		resolvedGroups: []string{},
+	}, nil
+}
+
+// checkBreakGlassRate checks that the client with the given address
+// has not exceeded the login rate limit, if one is configured. If it
+// has then an error with a cause of params.ErrTooManyRequests is
+// returned.
+func (a *Authorizer) checkBreakGlassRate(ctx context.Context, clientIP string) error {
+	if a.breakGlassLimit == nil {
+		return nil
+	}
+	ok, err := a.breakGlassLimit.Allow(ctx, "break-glass "+clientIP)
+	if err != nil {
+		logger.Errorf("cannot check break-glass rate limit: %s", err)
+		return nil
+	}
+	if !ok {
+		return errgo.WithCausef(nil, params.ErrTooManyRequests, "too many login attempts, try again later")
+	}
+	return nil
+}
+
+// breakGlassFailed records a failed attempt to use the break-glass
+// credential in the audit log and sends it as an event with the given
+// data and the reason for the failure.
+func (a *Authorizer) breakGlassFailed(ctx context.Context, username, clientIP string, data map[string]string, err error) {
+	data["error"] = err.Error()
+	a.eventDispatcher.Dispatch(events.Event{
+		Type: events.BreakGlassFailure,
+		Data: data,
+	})
+	a.auditBreakGlass(ctx, &audit.Event{
+		Outcome:  audit.Failure,
+		Username: username,
+		ClientIP: clientIP,
+		Error:    err.Error(),
+	})
+}
+
+// auditBreakGlass completes the given event and writes it to the
+// configured audit log, if any. Failing to write the event does not
+// fail the attempt.
+func (a *Authorizer) auditBreakGlass(ctx context.Context, e *audit.Event) {
+	if a.auditLogger == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.IDP = breakGlassIDP
+	if err := a.auditLogger.Log(ctx, e); err != nil {
+		logger.Errorf("cannot write audit event: %s", err)
+	}
+}
+
+// requestClientIP returns the address of the client that made the
+// given request.
+func (a *Authorizer) requestClientIP(req *http.Request) string {
+	if a.clientIP != nil {
+		if ip := a.clientIP(req); ip != nil {
+			return ip.String()
+		}
+		return ""
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,320 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/aclstore/v2"
+	"github.com/juju/loggo"
+	"golang.org/x/crypto/bcrypt"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+
+	"github.com/canonical/candid/audit"
+	"github.com/canonical/candid/breakglass"
+	"github.com/canonical/candid/events"
+	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/ratelimit"
+)
+
+func TestBreakGlass(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	candidtest.LogTo(c)
+	w := new(loggo.TestWriter)
+	loggo.RegisterWriter("test", w)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("emergency"), breakglass.MinCost)
+	c.Assert(err, qt.IsNil)
+	enabled := breakglass.Config{
+		Enabled:      true,
+		PasswordHash: string(hash),
+	}
+	expired := enabled
+	expired.Expires = time.Now().Add(-time.Minute)
+	disabled := enabled
+	disabled.Enabled = false
+
+	tests := []struct {
+		about       string
+		config      breakglass.Config
+		username    string
+		password    string
+		expectError string
+		expectLog   string
+	}{{
+		about:     "enabled",
+		config:    enabled,
+		username:  breakglass.DefaultUsername,
+		password:  "emergency",
+		expectLog: `BREAK-GLASS ADMIN ACCESS by "break-glass" from 192.0.2.1:1234 to GET /v1/u`,
+	}, {
+		about:       "disabled",
+		config:      disabled,
+		username:    breakglass.DefaultUsername,
+		password:    "emergency",
+		expectError: `could not determine identity: invalid credentials`,
+	}, {
+		about:       "wrong password",
+		config:      enabled,
+		username:    breakglass.DefaultUsername,
+		password:    "guess",
+		expectError: `could not determine identity: invalid credentials`,
+		expectLog:   `rejected break-glass access by "break-glass" from 192.0.2.1:1234 to GET /v1/u: invalid password`,
+	}, {
+		about:       "expired",
+		config:      expired,
+		username:    breakglass.DefaultUsername,
+		password:    "emergency",
+		expectError: `could not determine identity: invalid credentials`,
+		expectLog:   `rejected break-glass access by "break-glass" from 192.0.2.1:1234 to GET /v1/u: break-glass credential expired at .*`,
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			w.Clear()
+			ctx := context.Background()
+			// The identity store is not used to authenticate the
+			// break-glass credential.
+			st := candidtest.NewStore()
+			aclManager, err := aclstore.NewManager(ctx, aclstore.Params{
+				Store:             st.ACLStore,
+				InitialAdminUsers: []string{auth.AdminUsername},
+			})
+			c.Assert(err, qt.IsNil)
+			cred, err := breakglass.New(test.config)
+			c.Assert(err, qt.IsNil)
+			sink := make(eventSink, 1)
+			dispatcher := events.NewDispatcher(events.DispatcherParams{
+				Sink: sink,
+			})
+			defer dispatcher.Close()
+			authorizer, err := auth.New(auth.Params{
+				Location: identityLocation,
+				MacaroonVerifier: bakery.NewOven(bakery.OvenParams{
+					Key:      bakery.MustGenerateKey(),
+					Location: "identity",
+				}),
+				Store:           st.Store,
+				ACLManager:      aclManager,
+				BreakGlass:      cred,
+				EventDispatcher: dispatcher,
+			})
+			c.Assert(err, qt.IsNil)
+
+			req, err := http.NewRequest("GET", "/v1/u", nil)
+			c.Assert(err, qt.IsNil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			ctx = auth.ContextWithUserCredentials(ctx, test.username, test.password)
+			ctx = auth.ContextWithRequest(ctx, req)
+			authInfo, err := authorizer.Auth(ctx, nil, auth.GlobalOp(auth.ActionWriteAdmin))
+			if test.expectLog != "" {
+				c.Assert(w.Log(), qt.Not(qt.HasLen), 0)
+				found := false
+				for _, e := range w.Log() {
+					if e.Module == "candid.breakglass" && e.Level == loggo.WARNING {
+						c.Assert(e.Message, qt.Matches, test.expectLog)
+						found = true
+					}
+				}
+				c.Assert(found, qt.IsTrue)
+			}
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+				c.Assert(authInfo, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(authInfo.Identity.Id(), qt.Equals, auth.AdminUsername)
+			select {
+			case e := <-sink:
+				c.Assert(e.Type, qt.Equals, events.BreakGlass)
+				c.Assert(e.Username, qt.Equals, auth.AdminUsername)
+				c.Assert(e.Data, qt.DeepEquals, map[string]string{
+					"credential-username": "break-glass",
+					"remote-addr":         "192.0.2.1:1234",
+					"method":              "GET",
+					"path":                "/v1/u",
+				})
+			case <-time.After(5 * time.Second):
+				c.Fatalf("no break-glass event sent")
+			}
+		})
+	}
+}
+
+// eventSink is an events.Sink that sends events on a channel.
+type eventSink chan events.Event
+
+func (s eventSink) Send(_ context.Context, e *events.Event) error {
+	s <- *e
+	return nil
+}
+
+// auditLog is an audit.Logger that records events in memory.
+type auditLog []audit.Event
+
+func (l *auditLog) Log(_ context.Context, e *audit.Event) error {
+	*l = append(*l, *e)
+	return nil
+}
+
+func TestBreakGlassFailuresAuditedAndRateLimited(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := candidtest.NewStore()
+	aclManager, err := aclstore.NewManager(ctx, aclstore.Params{
+		Store:             st.ACLStore,
+		InitialAdminUsers: []string{auth.AdminUsername},
+	})
+	c.Assert(err, qt.IsNil)
+	hash, err := bcrypt.GenerateFromPassword([]byte("emergency"), breakglass.MinCost)
+	c.Assert(err, qt.IsNil)
+	cred, err := breakglass.New(breakglass.Config{
+		Enabled:      true,
+		PasswordHash: string(hash),
+	})
+	c.Assert(err, qt.IsNil)
+	limiter, err := ratelimit.New(ratelimit.Config{
+		RequestsPerMinute: 1,
+		Burst:             2,
+	})
+	c.Assert(err, qt.IsNil)
+	sink := make(eventSink, 4)
+	dispatcher := events.NewDispatcher(events.DispatcherParams{
+		Sink: sink,
+	})
+	defer dispatcher.Close()
+	var log auditLog
+	authorizer, err := auth.New(auth.Params{
+		Location: identityLocation,
+		MacaroonVerifier: bakery.NewOven(bakery.OvenParams{
+			Key:      bakery.MustGenerateKey(),
+			Location: "identity",
+		}),
+		Store:            st.Store,
+		ACLManager:       aclManager,
+		BreakGlass:       cred,
+		EventDispatcher:  dispatcher,
+		LoginRateLimiter: limiter,
+		AuditLogger:      &log,
+	})
+	c.Assert(err, qt.IsNil)
+
+	login := func(remoteAddr, password string) error {
+		req, err := http.NewRequest("GET", "/v1/u", nil)
+		c.Assert(err, qt.IsNil)
+		req.RemoteAddr = remoteAddr
+		ctx := auth.ContextWithUserCredentials(ctx, breakglass.DefaultUsername, password)
+		ctx = auth.ContextWithRequest(ctx, req)
+		_, err = authorizer.Auth(ctx, nil, identchecker.LoginOp)
+		return err
+	}
+
+	err = login("192.0.2.1:1234", "guess")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	select {
+	case e := <-sink:
+		c.Assert(e.Type, qt.Equals, events.BreakGlassFailure)
+		c.Assert(e.Username, qt.Equals, "")
+		c.Assert(e.Data, qt.DeepEquals, map[string]string{
+			"credential-username": "break-glass",
+			"remote-addr":         "192.0.2.1:1234",
+			"method":              "GET",
+			"path":                "/v1/u",
+			"error":               "invalid password",
+		})
+	case <-time.After(5 * time.Second):
+		c.Fatalf("no break-glass-failure event sent")
+	}
+
+	// The correct password is rejected once the client has
+	// exceeded the rate limit, without affecting other clients.
+	err = login("192.0.2.1:1235", "guess")
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+	err = login("192.0.2.1:1236", "emergency")
+	c.Assert(err, qt.ErrorMatches, `could not determine identity: too many login attempts, try again later`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrTooManyRequests)
+	err = login("192.0.2.2:1234", "emergency")
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(log, qt.HasLen, 4)
+	for i, e := range log {
+		c.Assert(e.Time.IsZero(), qt.IsFalse)
+		log[i].Time = time.Time{}
+	}
+	c.Assert(log, qt.DeepEquals, auditLog{{
+		Outcome:  audit.Failure,
+		Username: "break-glass",
+		IDP:      "break-glass",
+		ClientIP: "192.0.2.1",
+		Error:    "invalid password",
+	}, {
+		Outcome:  audit.Failure,
+		Username: "break-glass",
+		IDP:      "break-glass",
+		ClientIP: "192.0.2.1",
+		Error:    "invalid password",
+	}, {
+		Outcome:  audit.Failure,
+		Username: "break-glass",
+		IDP:      "break-glass",
+		ClientIP: "192.0.2.1",
+		Error:    "too many login attempts, try again later",
+	}, {
+		Outcome:  audit.Success,
+		Username: "break-glass",
+		IDP:      "break-glass",
+		ClientIP: "192.0.2.2",
+	}})
+}
+
+func TestBreakGlassDoesNotAffectAdminPassword(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := candidtest.NewStore()
+	aclManager, err := aclstore.NewManager(ctx, aclstore.Params{
+		Store:             st.ACLStore,
+		InitialAdminUsers: []string{auth.AdminUsername},
+	})
+	c.Assert(err, qt.IsNil)
+	hash, err := bcrypt.GenerateFromPassword([]byte("emergency"), breakglass.MinCost)
+	c.Assert(err, qt.IsNil)
+	cred, err := breakglass.New(breakglass.Config{
+		Enabled:      true,
+		Username:     "emergency-admin",
+		PasswordHash: string(hash),
+	})
+	c.Assert(err, qt.IsNil)
+	authorizer, err := auth.New(auth.Params{
+		Location: identityLocation,
+		MacaroonVerifier: bakery.NewOven(bakery.OvenParams{
+			Key:      bakery.MustGenerateKey(),
+			Location: "identity",
+		}),
+		Store:      st.Store,
+		ACLManager: aclManager,
+		BreakGlass: cred,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// The break-glass password is not accepted for other users.
+	_, err = authorizer.Auth(auth.ContextWithUserCredentials(ctx, "admin", "emergency"), nil, identchecker.LoginOp)
+	c.Assert(err, qt.ErrorMatches, `could not determine identity: invalid credentials`)
+	_, err = authorizer.Auth(auth.ContextWithUserCredentials(ctx, breakglass.DefaultUsername, "emergency"), nil, identchecker.LoginOp)
+	c.Assert(err, qt.ErrorMatches, `could not determine identity: invalid credentials`)
+
+	// The configured username is accepted, without a dispatcher.
+	authInfo, err := authorizer.Auth(auth.ContextWithUserCredentials(ctx, "emergency-admin", "emergency"), nil, identchecker.LoginOp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(authInfo.Identity.Id(), qt.Equals, auth.AdminUsername)
+}
@@ -6,13 +6,20 @@ package auth
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
 	"strings"
+	"time"
 
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	macaroon "gopkg.in/macaroon.v2"
 
+	"github.com/canonical/candid/candidclient"
 	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
 )
@@ -20,6 +27,7 @@ import (
 const (
 	checkersNamespace         = "jujucharms.com/identity"
 	userHasPublicKeyCondition = "user-has-public-key"
+	userAgentCondition        = "user-agent"
 )
 
 // Namespace contains the checkers.Namespace supported by the identity
@@ -34,6 +42,7 @@ func NewChecker(a *Authorizer) *checkers.Checker {
 	checker := httpbakery.NewChecker()
 	checker.Namespace().Register(checkersNamespace, "")
 	checker.Register(userHasPublicKeyCondition, checkersNamespace, a.checkUserHasPublicKey)
+	checker.Register(userAgentCondition, checkersNamespace, checkUserAgent)
 	return checker
 }
 
@@ -46,6 +55,190 @@ func UserHasPublicKeyCaveat(user params.Username, pk *bakery.PublicKey) checkers
 	}
 }
 
+// DischargeCaveats returns the caveats added to the discharge of a
+// third party caveat with the given condition ("is-authenticated-user"
+// or "is-authenticated-userid") for the given identity. The discharge
+// will expire at the given time. If rolesCaveat is true then any roles
+// held by the identity are also declared.
+func DischargeCaveats(identity identchecker.Identity, cond string, expires time.Time, rolesCaveat bool) ([]checkers.Caveat, error) {
+	var declaration checkers.Caveat
+	switch cond {
+	case "is-authenticated-user":
+		declaration = candidclient.UserDeclaration(identity.Id())
+	case "is-authenticated-userid":
+		id, ok := identity.(*Identity)
+		if !ok {
+			return nil, errgo.Newf("unexpected identity type %T", identity)
+		}
+		declaration = candidclient.UserIDDeclaration(string(id.ProviderID))
+	default:
+		return nil, errgo.Newf("unsupported condition %q", cond)
+	}
+
+	caveats := []checkers.Caveat{
+		declaration,
+		checkers.TimeBeforeCaveat(expires),
+	}
+	if rolesCaveat {
+		if id, ok := identity.(*Identity); ok && len(id.Roles) > 0 {
+			caveats = append(caveats, candidclient.RolesDeclaration(id.Roles))
+		}
+	}
+	return caveats, nil
+}
+
+// authTimeEntity is the entity of the operation used to record the
+// time at which the user authenticated in an identity macaroon.
+const authTimeEntity = "auth-time"
+
+// AuthTimeOp returns an operation that records the given
+// authentication time when it is used, alongside identchecker.LoginOp,
+// to mint an identity macaroon. Operations are held in the macaroon
+// ID, so unlike declared caveats they cannot be added by the holder of
+// the macaroon.
+func AuthTimeOp(t time.Time) bakery.Op {
+	return bakery.Op{
+		Entity: authTimeEntity,
+		Action: t.UTC().Format(time.RFC3339),
+	}
+}
+
+// AuthTime returns the time at which the user authenticated, as
+// recorded by an AuthTimeOp operation when the given macaroons were
+// minted. If more than one time is recorded the earliest is used. If
+// there is no recorded time then false is returned.
+func (a *Authorizer) AuthTime(ctx context.Context, mss []macaroon.Slice) (time.Time, bool) {
+	var authTime time.Time
+	found := false
+	for _, v := range a.mintedValues(ctx, mss, authTimeEntity) {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			continue
+		}
+		if !found || t.Before(authTime) {
+			authTime = t
+			found = true
+		}
+	}
+	return authTime, found
+}
+
+// mintedValues returns the actions of all the operations with the
+// given entity that are recorded in the IDs of the given macaroons.
+// Macaroons that were not minted by this service are ignored.
+func (a *Authorizer) mintedValues(ctx context.Context, mss []macaroon.Slice, entity string) []string {
+	var values []string
+	for _, ms := range mss {
+		ops, _, err := a.macaroonVerifier.VerifyMacaroon(ctx, ms)
+		if err != nil {
+			continue
+		}
+		for _, op := range ops {
+			if op.Entity == entity {
+				values = append(values, op.Action)
+			}
+		}
+	}
+	return values
+}
+
+// loginIDPEntity is the entity of the operation used to record the
+// identity provider the user authenticated with in an identity
+// macaroon.
+const loginIDPEntity = "login-idp"
+
+// LoginIDPOp returns an operation that records the name of the
+// identity provider the user authenticated with when it is used,
+// alongside identchecker.LoginOp, to mint an identity macaroon.
+func LoginIDPOp(idp string) bakery.Op {
+	return bakery.Op{
+		Entity: loginIDPEntity,
+		Action: idp,
+	}
+}
+
+// LoginIDP returns the name of the identity provider the user
+// authenticated with, as recorded by a LoginIDPOp operation when the
+// given macaroons were minted. If there is no recorded identity
+// provider then false is returned.
+func (a *Authorizer) LoginIDP(ctx context.Context, mss []macaroon.Slice) (string, bool) {
+	for _, v := range a.mintedValues(ctx, mss, loginIDPEntity) {
+		if v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// sessionIDEntity is the entity of the operation used to record the
+// correlation ID of the anonymous session that was upgraded to create
+// a macaroon.
+const sessionIDEntity = "session-id"
+
+// SessionIDOp returns an operation that records the correlation ID of
+// an anonymous session when it is used to mint a macaroon.
+func SessionIDOp(id string) bakery.Op {
+	return bakery.Op{
+		Entity: sessionIDEntity,
+		Action: id,
+	}
+}
+
+// SessionID returns the correlation ID of the anonymous session that
+// was upgraded to create the given macaroons, as recorded by a
+// SessionIDOp operation when they were minted. If there is no recorded
+// session ID then false is returned.
+func (a *Authorizer) SessionID(ctx context.Context, mss []macaroon.Slice) (string, bool) {
+	for _, v := range a.mintedValues(ctx, mss, sessionIDEntity) {
+		if v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// versionPattern matches the version numbers in a User-Agent header.
+var versionPattern = regexp.MustCompile(`[0-9][0-9._]*`)
+
+// UserAgentFingerprint returns a coarse fingerprint of the given
+// User-Agent header value. Version numbers are ignored so that the
+// fingerprint does not change when the user agent is upgraded.
+func UserAgentFingerprint(userAgent string) string {
+	sum := sha256.Sum256([]byte(versionPattern.ReplaceAllString(userAgent, "")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// UserAgentCaveat creates a first-party caveat that ensures that a
+// macaroon is only used by a user agent with the same fingerprint as
+// the given User-Agent header value.
+func UserAgentCaveat(userAgent string) checkers.Caveat {
+	return checkers.Caveat{
+		Namespace: checkersNamespace,
+		Condition: checkers.Condition(userAgentCondition, UserAgentFingerprint(userAgent)),
+	}
+}
+
+type userAgentKey struct{}
+
+// ContextWithUserAgent returns a context that holds the User-Agent
+// header value of the request being authorized, for checking
+// user-agent caveats.
+func ContextWithUserAgent(ctx context.Context, userAgent string) context.Context {
+	return context.WithValue(ctx, userAgentKey{}, userAgent)
+}
+
+// checkUserAgent checks the "user-agent" caveat.
+func checkUserAgent(ctx context.Context, cond, arg string) error {
+	userAgent, ok := ctx.Value(userAgentKey{}).(string)
+	if !ok {
+		return errgo.New("user agent not known")
+	}
+	if UserAgentFingerprint(userAgent) != arg {
+		return errgo.New("user agent mismatch")
+	}
+	return nil
+}
+
 // checkUserHasPublicKey checks the "user-has-public-key" caveat.
 func (a *Authorizer) checkUserHasPublicKey(ctx context.Context, cond, arg string) error {
 	parts := strings.Fields(arg)
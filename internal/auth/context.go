@@ -5,6 +5,7 @@ package auth
 
 import (
 	"context"
+	"net/http"
 )
 
 type contextKey int
@@ -14,6 +15,8 @@ const (
 	requiredDomainKey
 	dischargeIDKey
 	usernameKey
+	bearerTokenKey
+	requestKey
 )
 
 type userCredentials struct {
@@ -66,3 +69,27 @@ func usernameFromContext(ctx context.Context) string {
 	username, _ := ctx.Value(usernameKey).(string)
 	return username
 }
+
+// ContextWithBearerToken returns a context with the given bearer token
+// attached. The token will be checked as an API token when performing
+// authorizations.
+func ContextWithBearerToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, bearerTokenKey, token)
+}
+
+func bearerTokenFromContext(ctx context.Context) (string, bool) {
+	token, ok := ctx.Value(bearerTokenKey).(string)
+	return token, ok
+}
+
+// ContextWithRequest returns a context with the given HTTP request
+// attached. The request is used to record where a request using the
+// break-glass credential came from.
+func ContextWithRequest(ctx context.Context, req *http.Request) context.Context {
+	return context.WithValue(ctx, requestKey, req)
+}
+
+func requestFromContext(ctx context.Context) *http.Request {
+	req, _ := ctx.Value(requestKey).(*http.Request)
+	return req
+}
@@ -6,6 +6,7 @@ package httpauth
 import (
 	"context"
 	"net/http"
+	"strings"
 	"time"
 
 	errgo "gopkg.in/errgo.v1"
@@ -23,16 +24,19 @@ type Authorizer struct {
 	authorizer *auth.Authorizer
 	oven       *bakery.Oven
 	timeout    time.Duration
+	versions   VersionRange
 }
 
 // New creates a new Authorizer for authorizing HTTP requests made to the
-// identity server. The given oven is used to make new macaroons; the
-// given authorizer is used as the underlying authorizer.
-func New(o *bakery.Oven, a *auth.Authorizer, timeout time.Duration) *Authorizer {
+// identity server. The given oven is used to make new macaroons, with
+// a version in the given range; the given authorizer is used as the
+// underlying authorizer.
+func New(o *bakery.Oven, a *auth.Authorizer, timeout time.Duration, versions VersionRange) *Authorizer {
 	return &Authorizer{
 		authorizer: a,
 		oven:       o,
 		timeout:    timeout,
+		versions:   versions,
 	}
 }
 
@@ -44,6 +48,10 @@ func (a *Authorizer) Auth(ctx context.Context, req *http.Request, ops ...bakery.
 	ctx = httpbakery.ContextWithRequest(ctx, req)
 	if username, password, ok := req.BasicAuth(); ok {
 		ctx = auth.ContextWithUserCredentials(ctx, username, password)
+		ctx = auth.ContextWithRequest(ctx, req)
+	}
+	if token, ok := bearerToken(req); ok {
+		ctx = auth.ContextWithBearerToken(ctx, token)
 	}
 	authInfo, err := a.authorizer.Auth(ctx, httpbakery.RequestMacaroons(req), ops...)
 	if err == nil {
@@ -53,10 +61,14 @@ func (a *Authorizer) Auth(ctx context.Context, req *http.Request, ops ...bakery.
 	if !ok {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
 	}
+	version, err := a.versions.RequestVersion(req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 	caveats := append(derr.Caveats, checkers.TimeBeforeCaveat(time.Now().Add(a.timeout)))
 	m, err := a.oven.NewMacaroon(
 		ctx,
-		httpbakery.RequestVersion(req),
+		version,
 		caveats,
 		derr.Ops...,
 	)
@@ -70,3 +82,14 @@ func (a *Authorizer) Auth(ctx context.Context, req *http.Request, ops ...bakery.
 		CookieNameSuffix: "candid",
 	})
 }
+
+// bearerToken returns the token from an "Authorization: Bearer" header
+// in the given request, if there is one.
+func bearerToken(req *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
+	}
+	return h[len(prefix):], true
+}
@@ -103,7 +103,7 @@ func (s *authSuite) TestAuthorizeWithAdminCredentials(c *qt.C) {
 			c.Assert(err, qt.IsNil)
 			err = authorizer.SetAdminPublicKey(context.Background(), &bakery.PublicKey{})
 			c.Assert(err, qt.IsNil)
-			httpAuthorizer := httpauth.New(s.oven, authorizer, 0)
+			httpAuthorizer := httpauth.New(s.oven, authorizer, 0, httpauth.VersionRange{})
 			req, _ := http.NewRequest("GET", "/", nil)
 			for attr, val := range test.header {
 				req.Header[attr] = val
@@ -128,7 +128,7 @@ func (s *authSuite) TestAuthorizeMacaroonRequired(c *qt.C) {
 		MacaroonVerifier: s.oven,
 		ACLManager:       s.aclManager,
 	})
-	httpAuthorizer := httpauth.New(s.oven, authorizer, 0)
+	httpAuthorizer := httpauth.New(s.oven, authorizer, 0, httpauth.VersionRange{})
 	req, err := http.NewRequest("GET", "http://example.com/v1/test", nil)
 	c.Assert(err, qt.IsNil)
 	authInfo, err := httpAuthorizer.Auth(context.Background(), req, identchecker.LoginOp)
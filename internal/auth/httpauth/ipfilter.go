@@ -0,0 +1,100 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package httpauth
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+// An IPFilter restricts the client addresses from which requests are
+// accepted.
+type IPFilter struct {
+	// Allow holds the networks from which requests are allowed. If
+	// this is empty requests are allowed from any address that is
+	// not denied.
+	Allow []*net.IPNet
+
+	// Deny holds the networks from which requests are always
+	// denied.
+	Deny []*net.IPNet
+
+	// TrustedProxies holds the networks containing proxies that are
+	// trusted to report the client address in the X-Forwarded-For
+	// header.
+	TrustedProxies []*net.IPNet
+}
+
+// ClientIP returns the address of the client that made the given
+// request. If the request came through trusted proxies the address is
+// taken from the X-Forwarded-For header, otherwise the remote address
+// of the connection is used. ClientIP returns nil if the address
+// cannot be determined.
+func (f *IPFilter) ClientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || f == nil {
+		return ip
+	}
+	var forwarded []string
+	for _, h := range req.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+	// Walk back through the proxies until we find the first
+	// address that was not added by a trusted proxy.
+	for i := len(forwarded) - 1; i >= 0 && contains(f.TrustedProxies, ip); i-- {
+		fip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if fip == nil {
+			break
+		}
+		ip = fip
+	}
+	return ip
+}
+
+// Allowed reports whether requests from the given address are allowed.
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return len(f.Allow) == 0 && len(f.Deny) == 0
+	}
+	if contains(f.Deny, ip) {
+		return false
+	}
+	return len(f.Allow) == 0 || contains(f.Allow, ip)
+}
+
+// Check checks that the given request was made from an allowed
+// address. If it was not, an error with a cause of params.ErrForbidden
+// is returned.
+func (f *IPFilter) Check(req *http.Request) error {
+	if f == nil || len(f.Allow) == 0 && len(f.Deny) == 0 {
+		return nil
+	}
+	ip := f.ClientIP(req)
+	if f.Allowed(ip) {
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrForbidden, "access not allowed from %s", ip)
+}
+
+// contains reports whether any of the given networks contains ip.
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
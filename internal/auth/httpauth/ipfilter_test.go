@@ -0,0 +1,125 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package httpauth_test
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/internal/auth/httpauth"
+	"github.com/canonical/candid/params"
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+var ipFilterTests = []struct {
+	about          string
+	filter         *httpauth.IPFilter
+	remoteAddr     string
+	forwardedFor   []string
+	expectClientIP string
+	expectError    string
+}{{
+	about:          "no filter",
+	remoteAddr:     "192.0.2.1:1234",
+	expectClientIP: "192.0.2.1",
+}, {
+	about: "allowed",
+	filter: &httpauth.IPFilter{
+		Allow: mustParseCIDRs("10.0.0.0/8"),
+	},
+	remoteAddr:     "10.1.2.3:1234",
+	expectClientIP: "10.1.2.3",
+}, {
+	about: "not allowed",
+	filter: &httpauth.IPFilter{
+		Allow: mustParseCIDRs("10.0.0.0/8"),
+	},
+	remoteAddr:     "192.0.2.1:1234",
+	expectClientIP: "192.0.2.1",
+	expectError:    `access not allowed from 192.0.2.1`,
+}, {
+	about: "denied",
+	filter: &httpauth.IPFilter{
+		Allow: mustParseCIDRs("10.0.0.0/8"),
+		Deny:  mustParseCIDRs("10.1.0.0/16"),
+	},
+	remoteAddr:     "10.1.2.3:1234",
+	expectClientIP: "10.1.2.3",
+	expectError:    `access not allowed from 10.1.2.3`,
+}, {
+	about: "untrusted proxy",
+	filter: &httpauth.IPFilter{
+		Allow: mustParseCIDRs("10.0.0.0/8"),
+	},
+	remoteAddr:     "192.0.2.1:1234",
+	forwardedFor:   []string{"10.1.2.3"},
+	expectClientIP: "192.0.2.1",
+	expectError:    `access not allowed from 192.0.2.1`,
+}, {
+	about: "trusted proxy",
+	filter: &httpauth.IPFilter{
+		Allow:          mustParseCIDRs("10.0.0.0/8"),
+		TrustedProxies: mustParseCIDRs("192.0.2.0/24"),
+	},
+	remoteAddr:     "192.0.2.1:1234",
+	forwardedFor:   []string{"10.1.2.3"},
+	expectClientIP: "10.1.2.3",
+}, {
+	about: "spoofed address before trusted proxies",
+	filter: &httpauth.IPFilter{
+		Allow:          mustParseCIDRs("10.0.0.0/8"),
+		TrustedProxies: mustParseCIDRs("192.0.2.0/24"),
+	},
+	remoteAddr:     "192.0.2.1:1234",
+	forwardedFor:   []string{"10.1.2.3, 198.51.100.1", "192.0.2.2"},
+	expectClientIP: "198.51.100.1",
+	expectError:    `access not allowed from 198.51.100.1`,
+}, {
+	about: "invalid forwarded address",
+	filter: &httpauth.IPFilter{
+		Allow:          mustParseCIDRs("10.0.0.0/8"),
+		TrustedProxies: mustParseCIDRs("192.0.2.0/24"),
+	},
+	remoteAddr:     "192.0.2.1:1234",
+	forwardedFor:   []string{"10.1.2.3, unknown"},
+	expectClientIP: "192.0.2.1",
+	expectError:    `access not allowed from 192.0.2.1`,
+}}
+
+func TestIPFilter(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range ipFilterTests {
+		c.Run(test.about, func(c *qt.C) {
+			req, err := http.NewRequest("GET", "/v1/u/bob/extra-info", nil)
+			c.Assert(err, qt.IsNil)
+			req.RemoteAddr = test.remoteAddr
+			for _, h := range test.forwardedFor {
+				req.Header.Add("X-Forwarded-For", h)
+			}
+			c.Assert(test.filter.ClientIP(req).String(), qt.Equals, test.expectClientIP)
+			err = test.filter.Check(req)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package httpauth
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+// A TLSRequirement requires requests to have been made over TLS.
+type TLSRequirement struct {
+	// TrustedProxies holds the networks containing proxies that are
+	// trusted to report the protocol used by the client in the
+	// X-Forwarded-Proto header.
+	TrustedProxies []*net.IPNet
+
+	// ExemptPaths holds the paths that may be requested without TLS.
+	// A path ending in "/" also exempts all paths below it.
+	ExemptPaths []string
+
+	// Redirect holds whether GET and HEAD requests made without TLS
+	// should be redirected to the equivalent https URL rather than
+	// rejected.
+	Redirect bool
+
+	// Location holds the public URL of the server. Redirects are
+	// made to this URL rather than the host given in the request,
+	// and only if it is an https URL.
+	Location string
+}
+
+// Secure reports whether the given request was made over TLS. If the
+// request came from a trusted proxy the protocol reported in the last
+// X-Forwarded-Proto header value is used.
+func (r *TLSRequirement) Secure(req *http.Request) bool {
+	if req.TLS != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !contains(r.TrustedProxies, ip) {
+		return false
+	}
+	protos := req.Header["X-Forwarded-Proto"]
+	if len(protos) == 0 {
+		return false
+	}
+	proto := protos[len(protos)-1]
+	if i := strings.LastIndex(proto, ","); i >= 0 {
+		proto = proto[i+1:]
+	}
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// Exempt reports whether the given request may be made without TLS
+// because its path is exempt.
+func (r *TLSRequirement) Exempt(req *http.Request) bool {
+	for _, p := range r.ExemptPaths {
+		if req.URL.Path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(req.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedirectURL returns the https URL that the given request, made
+// without TLS, should be redirected to. It returns the empty string if
+// the request should not be redirected.
+func (r *TLSRequirement) RedirectURL(req *http.Request) string {
+	if !r.Redirect || req.Method != "GET" && req.Method != "HEAD" {
+		return ""
+	}
+	u, err := url.Parse(r.Location)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return ""
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + req.URL.Path
+	u.RawPath = ""
+	u.RawQuery = req.URL.RawQuery
+	u.Fragment = ""
+	return u.String()
+}
+
+// Check checks that the given request was made over TLS, or is exempt
+// from the requirement. If it was not, an error with a cause of
+// params.ErrForbidden is returned.
+func (r *TLSRequirement) Check(req *http.Request) error {
+	if r == nil || r.Secure(req) || r.Exempt(req) {
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrForbidden, "TLS is required")
+}
@@ -0,0 +1,233 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package httpauth_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/internal/auth/httpauth"
+	"github.com/canonical/candid/params"
+)
+
+var tlsRequirementTests = []struct {
+	about          string
+	requirement    *httpauth.TLSRequirement
+	path           string
+	tls            bool
+	remoteAddr     string
+	forwardedFor   []string
+	forwardedProto []string
+	expectError    string
+}{{
+	about:      "no requirement",
+	remoteAddr: "192.0.2.1:1234",
+}, {
+	about:       "plain HTTP",
+	requirement: &httpauth.TLSRequirement{},
+	remoteAddr:  "192.0.2.1:1234",
+	expectError: `TLS is required`,
+}, {
+	about:       "TLS",
+	requirement: &httpauth.TLSRequirement{},
+	tls:         true,
+	remoteAddr:  "192.0.2.1:1234",
+}, {
+	about:       "local client",
+	requirement: &httpauth.TLSRequirement{},
+	remoteAddr:  "127.0.0.1:1234",
+	expectError: `TLS is required`,
+}, {
+	about:       "local IPv6 client",
+	requirement: &httpauth.TLSRequirement{},
+	remoteAddr:  "[::1]:1234",
+	expectError: `TLS is required`,
+}, {
+	about:          "local untrusted proxy reports https",
+	requirement:    &httpauth.TLSRequirement{},
+	remoteAddr:     "127.0.0.1:1234",
+	forwardedFor:   []string{"198.51.100.1"},
+	forwardedProto: []string{"https"},
+	expectError:    `TLS is required`,
+}, {
+	about: "exempt path",
+	requirement: &httpauth.TLSRequirement{
+		ExemptPaths: []string{"/debug/status"},
+	},
+	path:       "/debug/status",
+	remoteAddr: "192.0.2.1:1234",
+}, {
+	about: "exempt path prefix",
+	requirement: &httpauth.TLSRequirement{
+		ExemptPaths: []string{"/static/"},
+	},
+	path:       "/static/images/logo.png",
+	remoteAddr: "192.0.2.1:1234",
+}, {
+	about: "path is not a prefix without trailing slash",
+	requirement: &httpauth.TLSRequirement{
+		ExemptPaths: []string{"/debug"},
+	},
+	path:        "/debug/status",
+	remoteAddr:  "192.0.2.1:1234",
+	expectError: `TLS is required`,
+}, {
+	about: "trusted proxy reports https",
+	requirement: &httpauth.TLSRequirement{
+		TrustedProxies: mustParseCIDRs("192.0.2.0/24"),
+	},
+	remoteAddr:     "192.0.2.1:1234",
+	forwardedFor:   []string{"198.51.100.1"},
+	forwardedProto: []string{"https"},
+}, {
+	about: "trusted proxy reports http",
+	requirement: &httpauth.TLSRequirement{
+		TrustedProxies: mustParseCIDRs("192.0.2.0/24"),
+	},
+	remoteAddr:     "192.0.2.1:1234",
+	forwardedFor:   []string{"198.51.100.1"},
+	forwardedProto: []string{"http"},
+	expectError:    `TLS is required`,
+}, {
+	about: "trusted proxy reports http after https",
+	requirement: &httpauth.TLSRequirement{
+		TrustedProxies: mustParseCIDRs("192.0.2.0/24"),
+	},
+	remoteAddr:     "192.0.2.1:1234",
+	forwardedFor:   []string{"198.51.100.1"},
+	forwardedProto: []string{"https, http"},
+	expectError:    `TLS is required`,
+}, {
+	about:          "untrusted proxy reports https",
+	requirement:    &httpauth.TLSRequirement{},
+	remoteAddr:     "192.0.2.1:1234",
+	forwardedProto: []string{"https"},
+	expectError:    `TLS is required`,
+}, {
+	about:          "untrusted proxy reports local client",
+	requirement:    &httpauth.TLSRequirement{},
+	remoteAddr:     "192.0.2.1:1234",
+	forwardedFor:   []string{"127.0.0.1"},
+	forwardedProto: []string{"http"},
+	expectError:    `TLS is required`,
+}, {
+	about: "trusted proxy reports local client",
+	requirement: &httpauth.TLSRequirement{
+		TrustedProxies: mustParseCIDRs("192.0.2.0/24"),
+	},
+	remoteAddr:     "192.0.2.1:1234",
+	forwardedFor:   []string{"127.0.0.1"},
+	forwardedProto: []string{"http"},
+	expectError:    `TLS is required`,
+}}
+
+func TestTLSRequirement(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range tlsRequirementTests {
+		c.Run(test.about, func(c *qt.C) {
+			path := test.path
+			if path == "" {
+				path = "/v1/u/bob"
+			}
+			req, err := http.NewRequest("GET", path, nil)
+			c.Assert(err, qt.IsNil)
+			req.RemoteAddr = test.remoteAddr
+			if test.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for _, h := range test.forwardedFor {
+				req.Header.Add("X-Forwarded-For", h)
+			}
+			for _, h := range test.forwardedProto {
+				req.Header.Add("X-Forwarded-Proto", h)
+			}
+			err = test.requirement.Check(req)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+		})
+	}
+}
+
+var tlsRedirectURLTests = []struct {
+	about       string
+	requirement *httpauth.TLSRequirement
+	method      string
+	url         string
+	expectURL   string
+}{{
+	about: "redirect to location",
+	requirement: &httpauth.TLSRequirement{
+		Redirect: true,
+		Location: "https://candid.example.com",
+	},
+	url:       "http://attacker.example.com/v1/u/bob?x=1",
+	expectURL: "https://candid.example.com/v1/u/bob?x=1",
+}, {
+	about: "location with path",
+	requirement: &httpauth.TLSRequirement{
+		Redirect: true,
+		Location: "https://example.com/candid/",
+	},
+	url:       "http://example.com/v1/u/bob",
+	expectURL: "https://example.com/candid/v1/u/bob",
+}, {
+	about: "HEAD request",
+	requirement: &httpauth.TLSRequirement{
+		Redirect: true,
+		Location: "https://candid.example.com",
+	},
+	method:    "HEAD",
+	url:       "http://candid.example.com/v1/u/bob",
+	expectURL: "https://candid.example.com/v1/u/bob",
+}, {
+	about: "POST request",
+	requirement: &httpauth.TLSRequirement{
+		Redirect: true,
+		Location: "https://candid.example.com",
+	},
+	method: "POST",
+	url:    "http://candid.example.com/v1/u/bob",
+}, {
+	about: "redirect not enabled",
+	requirement: &httpauth.TLSRequirement{
+		Location: "https://candid.example.com",
+	},
+	url: "http://candid.example.com/v1/u/bob",
+}, {
+	about: "location not https",
+	requirement: &httpauth.TLSRequirement{
+		Redirect: true,
+		Location: "http://candid.example.com",
+	},
+	url: "http://candid.example.com/v1/u/bob",
+}, {
+	about: "no location",
+	requirement: &httpauth.TLSRequirement{
+		Redirect: true,
+	},
+	url: "http://candid.example.com/v1/u/bob",
+}}
+
+func TestTLSRedirectURL(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range tlsRedirectURLTests {
+		c.Run(test.about, func(c *qt.C) {
+			method := test.method
+			if method == "" {
+				method = "GET"
+			}
+			req, err := http.NewRequest(method, test.url, nil)
+			c.Assert(err, qt.IsNil)
+			c.Assert(test.requirement.RedirectURL(req), qt.Equals, test.expectURL)
+		})
+	}
+}
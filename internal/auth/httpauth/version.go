@@ -0,0 +1,63 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package httpauth
+
+import (
+	"net/http"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/canonical/candid/params"
+)
+
+// A VersionRange holds the range of macaroon versions that will be
+// minted in response to requests.
+type VersionRange struct {
+	// Min holds the minimum version. Requests from clients that only
+	// support earlier versions are rejected.
+	Min bakery.Version
+
+	// Max holds the maximum version. Clients that support later
+	// versions are given macaroons with this version. If this is
+	// zero bakery.LatestVersion is used.
+	Max bakery.Version
+}
+
+// RequestVersion returns the macaroon version to use when minting a
+// macaroon in response to the given request. If the client making the
+// request does not support the minimum version then an error with a
+// cause of params.ErrBadRequest is returned.
+func (r VersionRange) RequestVersion(req *http.Request) (bakery.Version, error) {
+	v := httpbakery.RequestVersion(req)
+	if v < r.Min {
+		return 0, errgo.WithCausef(nil, params.ErrBadRequest, "bakery protocol version %d is not supported, version %d or later is required", v, r.Min)
+	}
+	if r.Max != 0 && v > r.Max {
+		v = r.Max
+	}
+	return v, nil
+}
+
+// MaxVersion returns the version to use when minting a macaroon that is
+// not in response to a particular request, which is the maximum
+// version in the range.
+func (r VersionRange) MaxVersion() bakery.Version {
+	if r.Max == 0 {
+		return bakery.LatestVersion
+	}
+	return r.Max
+}
+
+// Validate checks that the version range is valid.
+func (r VersionRange) Validate() error {
+	if r.Min > bakery.LatestVersion || r.Max > bakery.LatestVersion {
+		return errgo.Newf("invalid macaroon version range %d-%d, the latest version is %d", r.Min, r.Max, bakery.LatestVersion)
+	}
+	if r.Max != 0 && r.Min > r.Max {
+		return errgo.Newf("invalid macaroon version range %d-%d", r.Min, r.Max)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package httpauth_test
+
+import (
+	"net/http"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/canonical/candid/internal/auth/httpauth"
+	"github.com/canonical/candid/params"
+)
+
+var requestVersionTests = []struct {
+	about         string
+	versions      httpauth.VersionRange
+	header        string
+	expectVersion bakery.Version
+	expectError   string
+}{{
+	about:         "no header",
+	expectVersion: bakery.Version1,
+}, {
+	about:         "unrestricted",
+	header:        "3",
+	expectVersion: bakery.Version3,
+}, {
+	about:         "unrestricted version 0",
+	header:        "0",
+	expectVersion: bakery.Version0,
+}, {
+	about:         "at minimum",
+	versions:      httpauth.VersionRange{Min: bakery.Version2},
+	header:        "2",
+	expectVersion: bakery.Version2,
+}, {
+	about:       "below minimum",
+	versions:    httpauth.VersionRange{Min: bakery.Version2},
+	header:      "1",
+	expectError: `bakery protocol version 1 is not supported, version 2 or later is required`,
+}, {
+	about:       "no header below minimum",
+	versions:    httpauth.VersionRange{Min: bakery.Version2},
+	expectError: `bakery protocol version 1 is not supported, version 2 or later is required`,
+}, {
+	about:         "at maximum",
+	versions:      httpauth.VersionRange{Max: bakery.Version2},
+	header:        "2",
+	expectVersion: bakery.Version2,
+}, {
+	about:         "above maximum",
+	versions:      httpauth.VersionRange{Max: bakery.Version2},
+	header:        "3",
+	expectVersion: bakery.Version2,
+}, {
+	about:         "below maximum",
+	versions:      httpauth.VersionRange{Max: bakery.Version2},
+	header:        "1",
+	expectVersion: bakery.Version1,
+}, {
+	about:         "single version",
+	versions:      httpauth.VersionRange{Min: bakery.Version2, Max: bakery.Version2},
+	header:        "3",
+	expectVersion: bakery.Version2,
+}}
+
+func TestRequestVersion(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range requestVersionTests {
+		c.Run(test.about, func(c *qt.C) {
+			req, err := http.NewRequest("GET", "/", nil)
+			c.Assert(err, qt.IsNil)
+			if test.header != "" {
+				req.Header.Set(httpbakery.BakeryProtocolHeader, test.header)
+			}
+			v, err := test.versions.RequestVersion(req)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(v, qt.Equals, test.expectVersion)
+		})
+	}
+}
+
+func TestVersionRangeValidate(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(httpauth.VersionRange{}.Validate(), qt.IsNil)
+	c.Assert(httpauth.VersionRange{Min: bakery.Version1, Max: bakery.LatestVersion}.Validate(), qt.IsNil)
+	c.Assert(httpauth.VersionRange{Min: bakery.Version3, Max: bakery.Version2}.Validate(), qt.ErrorMatches, `invalid macaroon version range 3-2`)
+	c.Assert(httpauth.VersionRange{Max: bakery.LatestVersion + 1}.Validate(), qt.ErrorMatches, `invalid macaroon version range 0-4, the latest version is 3`)
+}
+
+func TestVersionRangeMaxVersion(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(httpauth.VersionRange{}.MaxVersion(), qt.Equals, bakery.LatestVersion)
+	c.Assert(httpauth.VersionRange{Min: bakery.Version1, Max: bakery.Version2}.MaxVersion(), qt.Equals, bakery.Version2)
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package auth
+
+import (
+	"context"
+	"sync"
+
+	"gopkg.in/macaroon-bakery.v2/bakery"
+
+	"github.com/canonical/candid/store"
+)
+
+type requestCacheKey struct{}
+
+// ContextWithRequestCache returns a context that memoizes the identity
+// lookups, group resolution and ACL lookups made by the Authorizer, so
+// that authorizing several operations for the same user only consults
+// the store, identity providers and ACL manager once. The returned
+// context must only be used for a single request: changes made to
+// identities or ACLs after a result has been cached are not seen by
+// later checks made with the same context.
+func ContextWithRequestCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestCacheKey{}, &requestCache{
+		identities: make(map[identityLookup]store.Identity),
+		groups:     make(map[store.ProviderIdentity][]string),
+		acls:       make(map[bakery.Op]aclResult),
+	})
+}
+
+func requestCacheFromContext(ctx context.Context) *requestCache {
+	rc, _ := ctx.Value(requestCacheKey{}).(*requestCache)
+	return rc
+}
+
+// identityLookup holds the fields used to look up an identity in the
+// store.
+type identityLookup struct {
+	providerID store.ProviderIdentity
+	username   string
+}
+
+// aclResult holds the result of an ACL lookup.
+type aclResult struct {
+	acl    []string
+	public bool
+}
+
+// A requestCache holds the results cached for a single request. A nil
+// requestCache caches nothing.
+type requestCache struct {
+	mu         sync.Mutex
+	identities map[identityLookup]store.Identity
+	groups     map[store.ProviderIdentity][]string
+	acls       map[bakery.Op]aclResult
+}
+
+func (rc *requestCache) identity(key identityLookup) (store.Identity, bool) {
+	if rc == nil {
+		return store.Identity{}, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	id, ok := rc.identities[key]
+	return id, ok
+}
+
+func (rc *requestCache) setIdentity(key identityLookup, id store.Identity) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.identities[key] = id
+}
+
+func (rc *requestCache) resolvedGroups(id store.ProviderIdentity) ([]string, bool) {
+	if rc == nil {
+		return nil, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	groups, ok := rc.groups[id]
+	return groups, ok
+}
+
+func (rc *requestCache) setResolvedGroups(id store.ProviderIdentity, groups []string) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.groups[id] = groups
+}
+
+func (rc *requestCache) acl(op bakery.Op) (aclResult, bool) {
+	if rc == nil {
+		return aclResult{}, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	r, ok := rc.acls[op]
+	return r, ok
+}
+
+func (rc *requestCache) setACL(op bakery.Op, r aclResult) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.acls[op] = r
+}
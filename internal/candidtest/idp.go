@@ -0,0 +1,214 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package candidtest
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/idp/static"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/store"
+)
+
+// StaticIDP returns a static identity provider with the given name
+// that allows the given users to log in.
+func StaticIDP(name string, users map[string]static.UserInfo) idp.IdentityProvider {
+	return static.NewIdentityProvider(static.Params{
+		Name:  name,
+		Users: users,
+	})
+}
+
+// DomainIDP returns a static identity provider with the given name
+// that allows the given users to log in. Identities created by the
+// identity provider are in the given domain.
+func DomainIDP(name, domain string, users map[string]static.UserInfo) idp.IdentityProvider {
+	return static.NewIdentityProvider(static.Params{
+		Name:   name,
+		Domain: domain,
+		Users:  users,
+	})
+}
+
+// HiddenIDP returns a static identity provider with the given name
+// and domain that is not listed in interactive login choices.
+func HiddenIDP(name, domain string, users map[string]static.UserInfo) idp.IdentityProvider {
+	return static.NewIdentityProvider(static.Params{
+		Name:   name,
+		Domain: domain,
+		Users:  users,
+		Hidden: true,
+	})
+}
+
+// OIDCUser holds the details of the user that a stub OpenID Connect
+// identity provider logs in.
+type OIDCUser struct {
+	// Subject holds the subject identifier of the user. If this is
+	// empty the Username is used.
+	Subject string
+
+	// Username holds the username of the user, without any domain.
+	Username string
+
+	// Name holds the display name of the user.
+	Name string
+
+	// Email holds the email address of the user.
+	Email string
+
+	// Groups holds the groups the identity provider reports for
+	// the user.
+	Groups []string
+
+	// SessionState holds the session_state value the identity
+	// provider supplies when the login completes, if any.
+	SessionState string
+}
+
+// StubOIDC returns an interactive identity provider that behaves like
+// an OpenID Connect provider that has already authenticated the given
+// user. Visiting the login URL of the identity provider immediately
+// completes the login as that user, creating the identity if necessary.
+func StubOIDC(name, domain string, user OIDCUser) idp.IdentityProvider {
+	if user.Subject == "" {
+		user.Subject = user.Username
+	}
+	return &stubOIDCIdentityProvider{
+		name:   name,
+		domain: domain,
+		user:   user,
+	}
+}
+
+type stubOIDCIdentityProvider struct {
+	name       string
+	domain     string
+	user       OIDCUser
+	initParams idp.InitParams
+}
+
+// Name implements idp.IdentityProvider.Name.
+func (idp *stubOIDCIdentityProvider) Name() string {
+	return idp.name
+}
+
+// Domain implements idp.IdentityProvider.Domain.
+func (idp *stubOIDCIdentityProvider) Domain() string {
+	return idp.domain
+}
+
+// Description implements idp.IdentityProvider.Description.
+func (idp *stubOIDCIdentityProvider) Description() string {
+	return idp.name
+}
+
+// IconURL implements idp.IdentityProvider.IconURL.
+func (*stubOIDCIdentityProvider) IconURL() string {
+	return ""
+}
+
+// Interactive implements idp.IdentityProvider.Interactive.
+func (*stubOIDCIdentityProvider) Interactive() bool {
+	return true
+}
+
+// Hidden implements idp.IdentityProvider.Hidden.
+func (*stubOIDCIdentityProvider) Hidden() bool {
+	return false
+}
+
+// Category implements idp.IdentityProvider.Category.
+func (*stubOIDCIdentityProvider) Category() string {
+	return ""
+}
+
+// Init implements idp.IdentityProvider.Init.
+func (idp *stubOIDCIdentityProvider) Init(ctx context.Context, params idp.InitParams) error {
+	idp.initParams = params
+	return nil
+}
+
+// URL implements idp.IdentityProvider.URL.
+func (idp *stubOIDCIdentityProvider) URL(state string) string {
+	return idputil.RedirectURL(idp.initParams.URLPrefix, "/login", state)
+}
+
+// SetInteraction implements idp.IdentityProvider.SetInteraction.
+func (*stubOIDCIdentityProvider) SetInteraction(*httpbakery.Error, string) {
+}
+
+// GetGroups implements idp.IdentityProvider.GetGroups.
+func (idp *stubOIDCIdentityProvider) GetGroups(_ context.Context, id *store.Identity) ([]string, error) {
+	if id.ProviderID != idp.providerID() {
+		return nil, nil
+	}
+	return append([]string(nil), idp.user.Groups...), nil
+}
+
+// Handle implements idp.IdentityProvider.Handle.
+func (idp *stubOIDCIdentityProvider) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var ls idputil.LoginState
+	if err := idp.initParams.Codec.Cookie(req, idputil.LoginStateCookieName(idp.initParams.CookieNamePrefix), req.Form.Get("state"), &ls); err != nil {
+		idputil.BadRequestf(w, "Login failed: invalid login state")
+		return
+	}
+	if req.URL.Path != "/login" {
+		http.NotFound(w, req)
+		return
+	}
+	id := &store.Identity{
+		ProviderID: idp.providerID(),
+		Username:   idputil.NameWithDomain(idp.user.Username, idp.domain),
+		Name:       idp.user.Name,
+		Email:      idp.user.Email,
+	}
+	err := idp.initParams.Store.UpdateIdentity(ctx, id, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+		store.Email:    store.Set,
+	})
+	if err != nil {
+		idp.initParams.VisitCompleter.RedirectFailure(ctx, w, req, ls.ReturnTo, ls.State, errgo.Mask(err))
+		return
+	}
+	if idp.user.SessionState != "" {
+		ctx = idputil.ContextWithRedirectParams(ctx, url.Values{
+			"session_state": {idp.user.SessionState},
+		})
+	}
+	idp.initParams.VisitCompleter.RedirectSuccess(ctx, w, req, ls.ReturnTo, ls.State, id)
+}
+
+// providerID returns the provider ID of the stub user, formatted as
+// the openid-connect provider would.
+func (idp *stubOIDCIdentityProvider) providerID() store.ProviderIdentity {
+	return store.MakeProviderIdentity(idp.name, "https://oidc.example.com:"+idp.user.Subject)
+}
+
+// WithIDPs returns a copy of sp with the given identity providers
+// added. Any existing identity provider with the same name as one of
+// the given identity providers is replaced, keeping its position.
+func WithIDPs(sp identity.ServerParams, idps ...idp.IdentityProvider) identity.ServerParams {
+	all := append([]idp.IdentityProvider(nil), sp.IdentityProviders...)
+Outer:
+	for _, ip := range idps {
+		for i, existing := range all {
+			if existing.Name() == ip.Name() {
+				all[i] = ip
+				continue Outer
+			}
+		}
+		all = append(all, ip)
+	}
+	sp.IdentityProviders = all
+	return sp
+}
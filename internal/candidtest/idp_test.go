@@ -0,0 +1,93 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package candidtest_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/canonical/candid/idp/static"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/store"
+)
+
+func TestWithIDPs(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp = candidtest.WithIDPs(sp,
+		candidtest.StaticIDP("test", nil),
+		candidtest.DomainIDP("test2", "test2", nil),
+	)
+	c.Assert(sp.IdentityProviders, qt.HasLen, 2)
+
+	hidden := candidtest.HiddenIDP("test2", "hidden", nil)
+	sp1 := candidtest.WithIDPs(sp, hidden, candidtest.StaticIDP("test3", nil))
+	c.Assert(sp1.IdentityProviders, qt.HasLen, 3)
+	c.Assert(sp1.IdentityProviders[0].Name(), qt.Equals, "test")
+	c.Assert(sp1.IdentityProviders[1], qt.Equals, hidden)
+	c.Assert(sp1.IdentityProviders[1].Hidden(), qt.Equals, true)
+	c.Assert(sp1.IdentityProviders[1].Domain(), qt.Equals, "hidden")
+	c.Assert(sp1.IdentityProviders[2].Name(), qt.Equals, "test3")
+
+	// The original parameters are not modified.
+	c.Assert(sp.IdentityProviders, qt.HasLen, 2)
+	c.Assert(sp.IdentityProviders[1].Hidden(), qt.Equals, false)
+}
+
+func TestStaticIDPLogin(t *testing.T) {
+	c := qt.New(t)
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"bob": {
+			Password: "bobpassword",
+			Email:    "bob@example.com",
+		},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "bob", "bobpassword"),
+	})
+	ms, err := dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	dc.AssertMacaroon(c, ms, identchecker.LoginOp, "bob")
+}
+
+func TestStubOIDCLogin(t *testing.T) {
+	c := qt.New(t)
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.StubOIDC("oidc", "example", candidtest.OIDCUser{
+		Username: "alice",
+		Name:     "Alice",
+		Email:    "alice@example.com",
+		Groups:   []string{"group1"},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.OpenWebBrowser(c, candidtest.SelectInteractiveLogin(nil)),
+	})
+	ms, err := dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	dc.AssertMacaroon(c, ms, identchecker.LoginOp, "alice@example")
+
+	id := store.Identity{
+		ProviderID: store.MakeProviderIdentity("oidc", "https://oidc.example.com:alice"),
+	}
+	err = st.Store.Identity(context.Background(), &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "alice@example")
+	c.Assert(id.Name, qt.Equals, "Alice")
+	c.Assert(id.Email, qt.Equals, "alice@example.com")
+}
@@ -31,6 +31,9 @@ func init() {
 	template.Must(DefaultTemplate.New("authentication-required").Parse(authenticationRequiredTemplate))
 	template.Must(DefaultTemplate.New("login").Parse(loginTemplate))
 	template.Must(DefaultTemplate.New("login-form").Parse(loginFormTemplate))
+	template.Must(DefaultTemplate.New("password-change-form").Parse(passwordChangeFormTemplate))
+	template.Must(DefaultTemplate.New("one-time-code-form").Parse(oneTimeCodeFormTemplate))
+	template.Must(DefaultTemplate.New("email-link-form").Parse(emailLinkFormTemplate))
 }
 
 const (
@@ -38,6 +41,9 @@ const (
 	authenticationRequiredTemplate = "{{range .IDPs}}{{.URL}}\n{{end}}"
 	loginTemplate                  = "login successful as user {{.Username}}\n"
 	loginFormTemplate              = "{{.Action}}\n{{.Error}}\n"
+	passwordChangeFormTemplate     = "{{.Action}}\n{{.Error}}\n{{.Token}}\n"
+	oneTimeCodeFormTemplate        = "{{.Action}}\n{{.Token}}\n{{.BackupCodes}}\n"
+	emailLinkFormTemplate          = "{{.Action}}\n{{.Error}}\n{{.Email}}\n"
 )
 
 // Server implements a test fixture that contains a candid server.
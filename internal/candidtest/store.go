@@ -5,6 +5,7 @@ package candidtest
 
 import (
 	"context"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/google/go-cmp/cmp"
@@ -27,6 +28,7 @@ type Store struct {
 	MeetingStore       meeting.Store
 	BakeryRootKeyStore bakery.RootKeyStore
 	ACLStore           aclstore.ACLStore
+	GroupStore         store.GroupStore
 }
 
 // NewStore returns a new Store that uses in-memory storage.
@@ -37,6 +39,7 @@ func NewStore() *Store {
 		MeetingStore:       memstore.NewMeetingStore(),
 		BakeryRootKeyStore: bakery.NewMemRootKeyStore(),
 		ACLStore:           aclstore.NewACLStore(memsimplekv.NewStore()),
+		GroupStore:         memstore.NewGroupStore(),
 	}
 }
 
@@ -49,6 +52,7 @@ func (s *Store) ServerParams() identity.ServerParams {
 		MeetingStore:      s.MeetingStore,
 		RootKeyStore:      s.BakeryRootKeyStore,
 		ACLStore:          s.ACLStore,
+		GroupStore:        s.GroupStore,
 	}
 }
 
@@ -71,6 +75,12 @@ func AssertEqualIdentity(c *qt.C, obtained, expected *store.Identity) {
 	if expected.ID == "" {
 		obtained.ID = ""
 	}
+	if expected.Version == 0 {
+		obtained.Version = 0
+	}
+	if expected.Modified.IsZero() {
+		obtained.Modified = time.Time{}
+	}
 	normalizeInfoMap(obtained.ProviderInfo)
 	normalizeInfoMap(obtained.ExtraInfo)
 	normalizeInfoMap(expected.ProviderInfo)
@@ -0,0 +1,120 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package debug
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/juju/utils/debugstatus"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/internal/monitoring"
+)
+
+// dashboardIDP holds the information displayed on the dashboard for a
+// single identity provider.
+type dashboardIDP struct {
+	Name   string
+	Domain string
+	monitoring.IDPStatus
+
+	// Successes and Failures hold the number of the recent logins
+	// with the identity provider that succeeded and failed.
+	Successes int
+	Failures  int
+}
+
+// dashboardCheck holds the result of a single status check.
+type dashboardCheck struct {
+	Key string
+	debugstatus.CheckResult
+}
+
+// dashboardData holds the data used to render the dashboard.
+type dashboardData struct {
+	Time   time.Time
+	Checks []dashboardCheck
+	IDPs   []dashboardIDP
+	Logins []monitoring.LoginOutcome
+}
+
+// dashboard serves a human readable summary of the status of the
+// server.
+func (h *debugAPIHandler) dashboard(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	if err := h.checkLogin(r); err != nil {
+		identity.WriteError(ctx, w, err)
+		return
+	}
+	data := h.dashboardData(ctx)
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		logger.Errorf("cannot render dashboard: %s", err)
+	}
+}
+
+// dashboardData collects the current status of the server.
+func (h *debugAPIHandler) dashboardData(ctx context.Context) *dashboardData {
+	data := &dashboardData{
+		Time:   time.Now(),
+		Logins: monitoring.RecentLogins(),
+	}
+	for k, r := range h.check(ctx) {
+		data.Checks = append(data.Checks, dashboardCheck{
+			Key:         k,
+			CheckResult: r,
+		})
+	}
+	sort.Slice(data.Checks, func(i, j int) bool {
+		return data.Checks[i].Key < data.Checks[j].Key
+	})
+	for _, ip := range h.idps {
+		d := dashboardIDP{
+			Name:      ip.Name(),
+			Domain:    ip.Domain(),
+			IDPStatus: monitoring.GetIDPStatus(ip.Name()),
+		}
+		for _, l := range data.Logins {
+			switch {
+			case l.IDP != d.Name:
+			case l.Error == "":
+				d.Successes++
+			default:
+				d.Failures++
+			}
+		}
+		data.IDPs = append(data.IDPs, d)
+	}
+	return data
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Candid status</title></head>
+<body>
+<h1>Candid status</h1>
+<p>Generated at {{.Time.Format "2006-01-02 15:04:05 MST"}}</p>
+<h2>Status checks</h2>
+<table>
+<tr><th>Check</th><th>Value</th><th>Passed</th></tr>
+{{range .Checks}}<tr><td>{{.Name}}</td><td>{{.Value}}</td><td>{{.Passed}}</td></tr>
+{{end}}</table>
+<h2>Identity providers</h2>
+<table>
+<tr><th>Name</th><th>Domain</th><th>In progress</th><th>Rejected</th><th>Recent successes</th><th>Recent failures</th><th>Servers</th></tr>
+{{range .IDPs}}<tr><td>{{.Name}}</td><td>{{.Domain}}</td><td>{{.LoginsInProgress}}</td><td>{{.LoginsRejected}}</td><td>{{.Successes}}</td><td>{{.Failures}}</td><td>{{range .Servers}}{{.Address}} ({{if .Up}}up{{else}}down{{end}}) {{end}}</td></tr>
+{{end}}</table>
+<h2>Recent logins</h2>
+<table>
+<tr><th>Time</th><th>Identity provider</th><th>User</th><th>Error</th></tr>
+{{range .Logins}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.IDP}}</td><td>{{.Username}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,63 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package debug_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/qthttptest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/debug"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/internal/monitoring"
+)
+
+func TestDashboard(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp.DebugTeams = []string{"debuggers"}
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("dashboard-test", nil))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		version: debug.NewAPIHandler,
+	})
+	monitoring.LoginSucceeded("dashboard-test", "dashboard-bob")
+	monitoring.LoginFailed("dashboard-test", errgo.New("dashboard test failure"))
+
+	// Without a login cookie the user is redirected to log in.
+	resp := qthttptest.Do(c, qthttptest.DoRequestParams{
+		URL: srv.URL + "/debug/dashboard",
+		Do:  doNoRedirect,
+	})
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusFound)
+
+	value, err := cookieEncode(debug.Cookie{
+		ExpireTime: time.Now().Add(time.Hour),
+		Teams:      []string{"debuggers"},
+	})(srv.Key)
+	c.Assert(err, qt.IsNil)
+	resp = qthttptest.Do(c, qthttptest.DoRequestParams{
+		URL: srv.URL + "/debug/dashboard",
+		Do:  doNoRedirect,
+		Cookies: []*http.Cookie{{
+			Name:  "debug-login",
+			Value: value,
+		}},
+	})
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Content-Type"), qt.Equals, "text/html;charset=utf-8")
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(body), qt.Contains, "Server started")
+	c.Assert(string(body), qt.Contains, "<td>dashboard-test</td>")
+	c.Assert(string(body), qt.Contains, "<td>dashboard-bob</td>")
+	c.Assert(string(body), qt.Contains, "dashboard test failure")
+}
@@ -12,6 +12,7 @@ import (
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 
+	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/internal/identity"
 	"github.com/canonical/candid/version"
 )
@@ -32,6 +33,10 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 		Method: "POST",
 		Path:   "/debug/login",
 		Handle: h.login,
+	}, {
+		Method: "GET",
+		Path:   "/debug/dashboard",
+		Handle: h.dashboard,
 	}}
 	for _, hnd := range identity.ReqServer.Handlers(h.handler) {
 		handlers = append(handlers, hnd)
@@ -44,13 +49,15 @@ func newDebugAPIHandler(params identity.HandlerParams) *debugAPIHandler {
 		key:      params.Key,
 		location: params.Location,
 		teams:    params.DebugTeams,
+		idps:     params.IdentityProviders,
 	}
 	checkerFuncs := append(stdCheckers, params.DebugStatusCheckerFuncs...)
+	h.check = func(ctx context.Context) map[string]debugstatus.CheckResult {
+		// TODO (mhilton) re-instate meeting status checks.
+		return debugstatus.Check(ctx, checkerFuncs...)
+	}
 	h.hnd = debugstatus.Handler{
-		Check: func(ctx context.Context) map[string]debugstatus.CheckResult {
-			// TODO (mhilton) re-instate meeting status checks.
-			return debugstatus.Check(ctx, checkerFuncs...)
-		},
+		Check:             h.check,
 		Version:           debugstatus.Version(version.VersionInfo),
 		CheckPprofAllowed: h.checkLogin,
 		CheckTraceAllowed: func(r *http.Request) (bool, error) {
@@ -64,6 +71,8 @@ type debugAPIHandler struct {
 	key      *bakery.KeyPair
 	location string
 	teams    []string
+	idps     []idp.IdentityProvider
+	check    func(context.Context) map[string]debugstatus.CheckResult
 	hnd      debugstatus.Handler
 }
 
@@ -52,11 +52,13 @@ func (s *debugSuite) TestServeDebugStatus(c *qt.C) {
 		"server_started":    "Server started",
 		"mongo_collections": "MongoDB collections",
 		"meeting_count":     "count of meeting collection",
+		"mongo_servers":     "MongoDB servers",
 	}
 	expectValues := map[string]string{
 		"server_started":    regexp.QuoteMeta(startTime.String()),
 		"mongo_collections": "All required collections exist",
 		"meeting_count":     "0",
+		"mongo_servers":     ".+",
 	}
 	qthttptest.AssertJSONCall(c, qthttptest.JSONCallParams{
 		URL: s.srv.URL + "/debug/status",
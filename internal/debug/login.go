@@ -19,6 +19,7 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/internal/identity"
 	"github.com/canonical/candid/params"
 )
@@ -126,8 +127,8 @@ var ussoClient = openid.NewClient(usso.ProductionUbuntuSSOServer, nil, nil)
 func (h *debugAPIHandler) loginRequired(r *http.Request) *loginRequiredError {
 	return &loginRequiredError{
 		redirectURL: ussoClient.RedirectURL(&openid.Request{
-			ReturnTo: h.location + "/debug/login?return_to=" + url.QueryEscape(h.location+r.URL.String()),
-			Realm:    h.location + "/debug",
+			ReturnTo: idputil.LocationURL(h.location, "/debug/login?return_to="+url.QueryEscape(idputil.LocationURL(h.location, r.URL.String()))),
+			Realm:    idputil.LocationURL(h.location, "/debug"),
 			Teams:    h.teams,
 		}),
 	}
@@ -135,7 +136,7 @@ func (h *debugAPIHandler) loginRequired(r *http.Request) *loginRequiredError {
 
 // login handles callbacks from an Ubuntu SSO login attempt.
 func (h *debugAPIHandler) login(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	url := h.location + r.URL.String()
+	url := idputil.LocationURL(h.location, r.URL.String())
 	resp, err := ussoClient.Verify(url)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
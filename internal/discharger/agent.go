@@ -6,17 +6,21 @@ package discharger
 import (
 	"context"
 	"net/http"
+	"strings"
 	"time"
 
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
+	"gopkg.in/juju/names.v2"
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
 
+	"github.com/canonical/candid/audit"
 	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/internal/auth"
 	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
@@ -33,6 +37,11 @@ const (
 	agentLoginMacaroonDuration = 10 * time.Second
 )
 
+// agentIDP is the identity provider name recorded for logins made
+// with the agent login endpoints. It is the name of the agent identity
+// provider and of the agent method in the non-interactive login chain.
+const agentIDP = "agent"
+
 func loginOp(user string) bakery.Op {
 	return bakery.Op{
 		Entity: "agent-" + user,
@@ -48,6 +57,10 @@ type agentLoginRequest struct {
 	DischargeID       string            `httprequest:"did,form"`
 	Username          string            `httprequest:"username,form"`
 	PublicKey         *bakery.PublicKey `httprequest:"public-key,form"`
+
+	// Groups holds the groups requested for the agent if it is
+	// created on login. See handler.createAgent.
+	Groups []string `httprequest:"groups,form"`
 }
 
 type agentMacaroonResponse struct {
@@ -57,7 +70,7 @@ type agentMacaroonResponse struct {
 // agentURL returns the URL path for the agent-login endpoint for the
 // candid service at the given location.
 func agentURL(location string, dischargeID string) string {
-	p := location + "/login/agent"
+	p := idputil.LocationURL(location, "/login/agent")
 	if dischargeID != "" {
 		p += "?did=" + dischargeID
 	}
@@ -67,13 +80,24 @@ func agentURL(location string, dischargeID string) string {
 // AgentLogin is the endpoint used to acquire an agent macaroon
 // as part of a discharge request.
 func (h *handler) AgentLogin(p httprequest.Params, req *agentLoginRequest) (*agentMacaroonResponse, error) {
+	if err := h.params.IDPStatus.CheckEnabled(p.Context, agentIDP); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrServiceUnavailable))
+	}
 	if req.Username == "" {
 		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "username not specified")
 	}
 	if req.PublicKey == nil {
 		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "public-key not specified")
 	}
-	m, err := h.agentMacaroon(p.Context, httpbakery.RequestVersion(p.Request), identchecker.LoginOp, req.Username, req.PublicKey)
+	if err := h.checkAgent(p.Context, p.Request, req.Username, req.PublicKey, req.Groups); err != nil {
+		h.auditAgentFailure(p.Context, p.Request, req.DischargeID, req.Username, err)
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	vers, err := h.params.MacaroonVersions().RequestVersion(p.Request)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	m, err := h.agentMacaroon(p.Context, vers, identchecker.LoginOp, req.Username, req.PublicKey)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -81,32 +105,162 @@ func (h *handler) AgentLogin(p httprequest.Params, req *agentLoginRequest) (*age
 }
 
 // agentMacaroon creates a new macaroon containing a local third-party
-// caveat addressed to the specified agent.
+// caveat addressed to the specified agent, along with any third-party
+// caveats the agent is required to discharge.
 func (h *handler) agentMacaroon(ctx context.Context, vers bakery.Version, op bakery.Op, user string, key *bakery.PublicKey) (*bakery.Macaroon, error) {
-	m, err := h.params.Oven.NewMacaroon(
-		ctx,
-		vers,
-		[]checkers.Caveat{
-			checkers.TimeBeforeCaveat(time.Now().Add(agentLoginMacaroonDuration)),
-			candidclient.UserDeclaration(user),
-			bakery.LocalThirdPartyCaveat(key, vers),
-			auth.UserHasPublicKeyCaveat(params.Username(user), key),
-		},
-		op,
-	)
+	caveats := []checkers.Caveat{
+		checkers.TimeBeforeCaveat(time.Now().Add(agentLoginMacaroonDuration)),
+		candidclient.UserDeclaration(user),
+		bakery.LocalThirdPartyCaveat(key, vers),
+		auth.UserHasPublicKeyCaveat(params.Username(user), key),
+	}
+	required, err := h.agentRequiredCaveats(ctx, user)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	m, err := h.params.Oven.NewMacaroon(ctx, vers, append(caveats, required...), op)
 	return m, errgo.Mask(err)
 }
 
+// agentRequiredCaveats returns the third-party caveats that must be
+// discharged by the agent with the given username before it can log
+// in. These are the globally configured caveats along with any
+// configured for the owner of the agent.
+func (h *handler) agentRequiredCaveats(ctx context.Context, user string) ([]checkers.Caveat, error) {
+	required := append([]checkers.Caveat(nil), h.params.AgentRequiredCaveats...)
+	if len(h.params.AgentOwnerRequiredCaveats) == 0 {
+		return required, nil
+	}
+	agent := store.Identity{
+		Username: user,
+	}
+	if err := h.params.Store.Identity(ctx, &agent); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if agent.Owner == "" {
+		return required, nil
+	}
+	owner := store.Identity{
+		ProviderID: agent.Owner,
+	}
+	if err := h.params.Store.Identity(ctx, &owner); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			// No caveats can be configured for an owner
+			// that does not exist.
+			return required, nil
+		}
+		return nil, errgo.Notef(err, "cannot get owner of agent %q", user)
+	}
+	return append(required, h.params.AgentOwnerRequiredCaveats[owner.Username]...), nil
+}
+
+// checkAgent checks that the agent logging in with the given username
+// exists. If it does not and unknown agents are configured to be
+// created, then a new agent is created with the given public key and
+// groups. Otherwise an error with a cause of params.ErrNotFound is
+// returned.
+func (h *handler) checkAgent(ctx context.Context, req *http.Request, user string, key *bakery.PublicKey, groups []string) error {
+	err := h.params.Store.Identity(ctx, &store.Identity{Username: user})
+	if err == nil {
+		return nil
+	}
+	if errgo.Cause(err) != store.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	if h.params.UnknownAgentLogin != "create" {
+		return errgo.WithCausef(nil, params.ErrNotFound, "agent %q does not exist", user)
+	}
+	return errgo.Mask(h.createAgent(ctx, req, user, key, groups), errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrForbidden), errgo.Is(params.ErrUnauthorized))
+}
+
+// createAgent creates a new agent with the given username and public
+// key, owned by the configured UnknownAgentOwner. The request must be
+// authenticated as the owner. The agent is a member of the given
+// groups, which must all be in the configured UnknownAgentGroups; if
+// no groups are given the agent is a member of all of them. As for any
+// other agent, the groups the agent is actually a member of are
+// limited to those that the owner is also a member of.
+func (h *handler) createAgent(ctx context.Context, req *http.Request, user string, key *bakery.PublicKey, groups []string) error {
+	name := strings.TrimSuffix(user, "@candid")
+	if name == user {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot create agent %q: agent usernames must end in @candid", user)
+	}
+	if !names.IsValidUserName(name) || idputil.ReservedUsernames[name] {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot create agent %q: invalid agent name", user)
+	}
+	if len(groups) == 0 {
+		groups = h.params.UnknownAgentGroups
+	}
+	for _, g := range groups {
+		if !stringInSlice(g, h.params.UnknownAgentGroups) {
+			return errgo.WithCausef(nil, params.ErrForbidden, "cannot create agent %q: group %q not allowed", user, g)
+		}
+	}
+	owner := store.Identity{
+		Username: h.params.UnknownAgentOwner,
+	}
+	authInfo, err := h.params.Authorizer.Auth(ctx, httpbakery.RequestMacaroons(req), identchecker.LoginOp)
+	if err != nil || authInfo.Identity == nil || authInfo.Identity.Id() != owner.Username {
+		return errgo.WithCausef(nil, params.ErrUnauthorized, "cannot create agent %q: request not authenticated as %q", user, owner.Username)
+	}
+	if err := h.params.Store.Identity(ctx, &owner); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrForbidden, "cannot create agent %q: owner %q does not exist", user, owner.Username)
+		}
+		return errgo.Mask(err)
+	}
+	if owner.ProviderID.Provider() == "idm" && owner.Owner != "" {
+		// Agents, other than parent agents, cannot own other
+		// agents.
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot create agent %q: owner %q is an agent", user, owner.Username)
+	}
+	identity := &store.Identity{
+		Username:   user,
+		ProviderID: store.MakeProviderIdentity("idm", name),
+		Groups:     groups,
+		PublicKeys: []bakery.PublicKey{*key},
+		Owner:      owner.ProviderID,
+		ProviderInfo: map[string][]string{
+			"creator": {string(owner.ProviderID)},
+		},
+	}
+	err = h.params.Store.UpdateIdentity(ctx, identity, store.Update{
+		store.Username:     store.Set,
+		store.Groups:       store.Set,
+		store.PublicKeys:   store.Set,
+		store.Owner:        store.Set,
+		store.ProviderInfo: store.Set,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot create agent %q", user)
+	}
+	logger.Infof("created agent %q owned by %q on first login", user, owner.Username)
+	return nil
+}
+
+func stringInSlice(s string, ss []string) bool {
+	for _, s1 := range ss {
+		if s1 == s {
+			return true
+		}
+	}
+	return false
+}
+
 // legacyAgentLoginRequest is the expected GET request to the agent-login
 // endpoint.
 type legacyAgentLoginRequest struct {
 	httprequest.Route `httprequest:"GET /login/legacy-agent"`
-	DischargeID       string `httprequest:"did,form"`
+	DischargeID       string   `httprequest:"did,form"`
+	Groups            []string `httprequest:"groups,form"`
 }
 
 // LegacyAgentLogin is the endpoint used when performing agent login
 // using the legacy agent-login cookie based protocols.
 func (h *handler) LegacyAgentLogin(p httprequest.Params, req *legacyAgentLoginRequest) (interface{}, error) {
+	if err := h.checkLegacyLogin(); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
 	user, key, err := agent.LoginCookie(p.Request)
 	if err != nil {
 		if errgo.Cause(err) == agent.ErrNoAgentLoginCookie {
@@ -114,7 +268,7 @@ func (h *handler) LegacyAgentLogin(p httprequest.Params, req *legacyAgentLoginRe
 		}
 		return nil, errgo.Mask(err)
 	}
-	resp, err := h.legacyAgentLogin(p.Context, p.Request, req.DischargeID, user, key)
+	resp, err := h.legacyAgentLogin(p.Context, p.Request, req.DischargeID, user, key, req.Groups)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
@@ -126,13 +280,17 @@ func (h *handler) LegacyAgentLogin(p httprequest.Params, req *legacyAgentLoginRe
 type legacyAgentLoginPostRequest struct {
 	httprequest.Route `httprequest:"POST /login/legacy-agent"`
 	DischargeID       string            `httprequest:"did,form"`
+	Groups            []string          `httprequest:"groups,form"`
 	AgentLogin        params.AgentLogin `httprequest:",body"`
 }
 
 // LegacyAgentLoginPost is the endpoint used when performing an agent login
 // using the POST protocol.
 func (h *handler) LegacyAgentLoginPost(p httprequest.Params, req *legacyAgentLoginPostRequest) (*agent.LegacyAgentResponse, error) {
-	resp, err := h.legacyAgentLogin(p.Context, p.Request, req.DischargeID, string(req.AgentLogin.Username), req.AgentLogin.PublicKey)
+	if err := h.checkLegacyLogin(); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	resp, err := h.legacyAgentLogin(p.Context, p.Request, req.DischargeID, string(req.AgentLogin.Username), req.AgentLogin.PublicKey, req.Groups)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
@@ -140,19 +298,28 @@ func (h *handler) LegacyAgentLoginPost(p httprequest.Params, req *legacyAgentLog
 }
 
 // legacyAgentLogin handles the common parts of the legacy agent login protocols.
-func (h *handler) legacyAgentLogin(ctx context.Context, req *http.Request, dischargeID string, user string, key *bakery.PublicKey) (*agent.LegacyAgentResponse, error) {
+func (h *handler) legacyAgentLogin(ctx context.Context, req *http.Request, dischargeID string, user string, key *bakery.PublicKey, groups []string) (*agent.LegacyAgentResponse, error) {
+	if err := h.params.IDPStatus.CheckEnabled(ctx, agentIDP); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrServiceUnavailable))
+	}
 	loginOp := loginOp(user)
-	vers := httpbakery.RequestVersion(req)
+	vers, err := h.params.MacaroonVersions().RequestVersion(req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 	ctx = httpbakery.ContextWithRequest(ctx, req)
 	ctx = auth.ContextWithDischargeID(ctx, dischargeID)
-	_, err := h.params.Authorizer.Auth(ctx, httpbakery.RequestMacaroons(req), loginOp)
+	ctx = contextWithIDP(ctx, agentIDP)
+	_, err = h.params.Authorizer.Auth(ctx, httpbakery.RequestMacaroons(req), loginOp)
 	if err == nil {
-		dt, err := h.params.dischargeTokenCreator.DischargeToken(ctx, &store.Identity{
+		id := &store.Identity{
 			Username: user,
-		})
+		}
+		dt, expires, err := h.params.dischargeTokenCreator.dischargeToken(ctx, id)
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
+		h.params.visitCompleter.auditSuccess(ctx, req, dischargeID, id, expires)
 		h.params.place.Done(ctx, dischargeID, &loginInfo{
 			DischargeToken: dt,
 		})
@@ -162,6 +329,11 @@ func (h *handler) legacyAgentLogin(ctx context.Context, req *http.Request, disch
 	}
 	// TODO fail harder if the error isn't because of a verification error?
 
+	if err := h.checkAgent(ctx, req, user, key, groups); err != nil {
+		h.auditAgentFailure(ctx, req, dischargeID, user, err)
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+
 	// Verification has failed. The bakery checker will want us to
 	// discharge a macaroon to prove identity, but we're already
 	// part of the discharge process so we can't do that here.
@@ -178,10 +350,26 @@ func (h *handler) legacyAgentLogin(ctx context.Context, req *http.Request, disch
 	})
 }
 
+// auditAgentFailure records in the audit log, if configured, that the
+// agent with the given username could not log in to complete the
+// discharge wait with the given ID.
+func (h *handler) auditAgentFailure(ctx context.Context, req *http.Request, waitID, user string, err error) {
+	if h.params.AuditLogger == nil {
+		return
+	}
+	h.params.visitCompleter.audit(ctx, req, &audit.Event{
+		Outcome:  audit.Failure,
+		Username: user,
+		IDP:      agentIDP,
+		WaitID:   waitID,
+		Error:    err.Error(),
+	})
+}
+
 // legacyAgentURL returns the URL path for the legacy agent login endpoint
 // for the candid service at the given location.
 func legacyAgentURL(location string, dischargeID string) string {
-	p := location + "/login/legacy-agent"
+	p := idputil.LocationURL(location, "/login/legacy-agent")
 	if dischargeID != "" {
 		p += "?did=" + dischargeID
 	}
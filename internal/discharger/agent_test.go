@@ -12,19 +12,31 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/bakerytest"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
+	"gopkg.in/macaroon.v2"
 
+	"github.com/canonical/candid/audit"
+	"github.com/canonical/candid/candidclient"
+	agentidp "github.com/canonical/candid/idp/agent"
+	"github.com/canonical/candid/idp/static"
+	"github.com/canonical/candid/internal/auth"
 	"github.com/canonical/candid/internal/candidtest"
 	"github.com/canonical/candid/internal/discharger"
 	"github.com/canonical/candid/internal/identity"
+	v1 "github.com/canonical/candid/internal/v1"
 	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
 )
 
 type agentSuite struct {
@@ -142,6 +154,336 @@ func (s *agentSuite) TestLegacyCookieAgentDischarge(c *qt.C) {
 	c.Assert(visitCalled, qt.Equals, true)
 }
 
+func TestAgentLoginUnknownAgent(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	srv := candidtest.NewMemServer(c, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	key, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	_, err = candidtest.NewDischargeCreator(srv).Discharge(c, "is-authenticated-user", agentClient(c, srv, "unknown@candid", key))
+	c.Assert(err, qt.ErrorMatches, `.*agent "unknown@candid" does not exist`)
+}
+
+func TestAgentLoginCreateUnknownAgent(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"provisioner": {Groups: []string{"bootstrap"}},
+	}))
+	sp.UnknownAgentLogin = "create"
+	sp.UnknownAgentOwner = "provisioner"
+	sp.UnknownAgentGroups = []string{"bootstrap", "other"}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	key, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+
+	// The request must be authenticated as the owner.
+	_, err = dc.Discharge(c, "is-authenticated-user", agentClient(c, srv, "new@candid", key))
+	c.Assert(err, qt.ErrorMatches, `.*cannot create agent "new@candid": request not authenticated as "provisioner"`)
+
+	srv.CreateUser(c, "provisioner")
+	client := agentClient(c, srv, "new@candid", key)
+	addOwnerCookie(c, st, srv, client, "provisioner")
+	ms, err := dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	dc.AssertMacaroon(c, ms, identchecker.LoginOp, "new@candid")
+	st.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "new"),
+		Username:   "new@candid",
+		Groups:     []string{"bootstrap", "other"},
+		PublicKeys: []bakery.PublicKey{key.Public},
+		Owner:      store.MakeProviderIdentity("test", "provisioner"),
+		ProviderInfo: map[string][]string{
+			"creator": {"test:provisioner"},
+		},
+	})
+
+	// Only valid agent usernames can be created.
+	for _, username := range []string{"bob", "bad_name@candid", "admin@candid"} {
+		client := agentClient(c, srv, username, key)
+		addOwnerCookie(c, st, srv, client, "provisioner")
+		_, err = dc.Discharge(c, "is-authenticated-user", client)
+		c.Assert(err, qt.ErrorMatches, `.*cannot create agent "`+username+`": .*`)
+	}
+}
+
+func TestAgentLoginCreateUnknownAgentGroups(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.StaticIDP("test", nil))
+	sp.UnknownAgentLogin = "create"
+	sp.UnknownAgentOwner = "provisioner"
+	sp.UnknownAgentGroups = []string{"bootstrap", "other"}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	srv.CreateUser(c, "provisioner")
+	key, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	client := srv.Client(nil)
+	addOwnerCookie(c, st, srv, client, "provisioner")
+	login := func(username string, groups ...string) error {
+		v := url.Values{
+			"username":   {username},
+			"public-key": {key.Public.String()},
+			"groups":     groups,
+		}
+		req, err := http.NewRequest("GET", srv.URL+"/login/agent?"+v.Encode(), nil)
+		c.Assert(err, qt.IsNil)
+		resp, err := client.Do(req)
+		c.Assert(err, qt.IsNil)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		var perr params.Error
+		err = json.NewDecoder(resp.Body).Decode(&perr)
+		c.Assert(err, qt.IsNil)
+		return &perr
+	}
+
+	// Groups not in the configured list cannot be requested.
+	err = login("a1@candid", "bootstrap", "admins")
+	c.Assert(err, qt.ErrorMatches, `cannot create agent "a1@candid": group "admins" not allowed`)
+
+	err = login("a2@candid", "other")
+	c.Assert(err, qt.IsNil)
+	id := store.Identity{Username: "a2@candid"}
+	err = st.Store.Identity(context.Background(), &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Groups, qt.DeepEquals, []string{"other"})
+}
+
+func TestLegacyAgentDischargeLoginIDPCaveat(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.LoginIDPCaveat = true
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	key := srv.CreateAgent(c, "bob@candid")
+	client := srv.Client(nil)
+	client.Key = key
+	client.Transport = fakeLegacyServerTransport{client.Transport}
+	err := agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: client.Key,
+		Agents: []agent.Agent{{
+			URL:      srv.URL,
+			Username: "bob@candid",
+		}},
+	})
+	c.Assert(err, qt.IsNil)
+	ms, err := dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	declared := checkers.InferDeclared(checkers.New(nil).Namespace(), ms)
+	c.Assert(candidclient.DeclaredLoginIDP(declared), qt.Equals, "agent")
+}
+
+func TestAgentLoginAudit(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	log := new(auditLog)
+	sp := candidtest.NewStore().ServerParams()
+	sp.AuditLogger = log
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	key := srv.CreateAgent(c, "bob@candid")
+	client := srv.Client(nil)
+	client.Key = key
+	client.Transport = fakeLegacyServerTransport{client.Transport}
+	err := agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: client.Key,
+		Agents: []agent.Agent{{
+			URL:      srv.URL,
+			Username: "bob@candid",
+		}},
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+
+	logged := log.Events()
+	c.Assert(logged, qt.HasLen, 1)
+	e := logged[0]
+	c.Assert(e.WaitID, qt.Not(qt.Equals), "")
+	c.Assert(e.Expires, qt.Not(qt.IsNil))
+	e.Time = time.Time{}
+	e.WaitID = ""
+	e.Expires = nil
+	// The identity provider recorded is the one used to log in,
+	// not the one that created the agent.
+	c.Assert(e, qt.DeepEquals, audit.Event{
+		Outcome:  audit.Success,
+		Username: "bob@candid",
+		IDP:      "agent",
+		ClientIP: "127.0.0.1",
+	})
+
+	// An agent that does not exist is recorded as failing.
+	unknown, err := bakery.GenerateKey()
+	c.Assert(err, qt.IsNil)
+	_, err = dc.Discharge(c, "is-authenticated-user", agentClient(c, srv, "unknown@candid", unknown))
+	c.Assert(err, qt.ErrorMatches, `.*agent "unknown@candid" does not exist`)
+	logged = log.Events()
+	c.Assert(logged, qt.HasLen, 2)
+	e = logged[1]
+	c.Assert(e.WaitID, qt.Not(qt.Equals), "")
+	e.Time = time.Time{}
+	e.WaitID = ""
+	c.Assert(e, qt.DeepEquals, audit.Event{
+		Outcome:  audit.Failure,
+		Username: "unknown@candid",
+		IDP:      "agent",
+		ClientIP: "127.0.0.1",
+		Error:    `agent "unknown@candid" does not exist`,
+	})
+}
+
+func TestAgentLoginIDPDisabled(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	sp := candidtest.NewStore().ServerParams()
+	sp = candidtest.WithIDPs(sp, agentidp.IdentityProvider)
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	key := srv.CreateAgent(c, "bob@candid")
+	err := srv.AdminIdentityClient(false).SetIDPEnabled(srv.Ctx, &params.SetIDPEnabledRequest{
+		IDP: "agent",
+	})
+	c.Assert(err, qt.IsNil)
+
+	_, err = dc.Discharge(c, "is-authenticated-user", agentClient(c, srv, "bob@candid", key))
+	c.Assert(err, qt.ErrorMatches, `.*login with agent is currently disabled`)
+
+	client := srv.Client(nil)
+	client.Key = key
+	client.Transport = fakeLegacyServerTransport{client.Transport}
+	err = agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: client.Key,
+		Agents: []agent.Agent{{
+			URL:      srv.URL,
+			Username: "bob@candid",
+		}},
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.ErrorMatches, `.*login with agent is currently disabled`)
+}
+
+// addOwnerCookie adds a cookie to the given client that authenticates
+// requests to the given server as the given user.
+func addOwnerCookie(c *qt.C, st *candidtest.Store, srv *candidtest.Server, client *httpbakery.Client, username string) {
+	oven := bakery.NewOven(bakery.OvenParams{
+		Namespace: auth.Namespace,
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return st.BakeryRootKeyStore
+		},
+	})
+	m, err := oven.NewMacaroon(context.Background(), bakery.LatestVersion, []checkers.Caveat{
+		candidclient.UserDeclaration(username),
+	}, identchecker.LoginOp)
+	c.Assert(err, qt.IsNil)
+	cookie, err := httpbakery.NewCookie(nil, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, qt.IsNil)
+	client.Client.Jar.SetCookies(u, []*http.Cookie{cookie})
+}
+
+func TestAgentLoginRequiredCaveats(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	attest := bakerytest.NewDischarger(nil)
+	defer attest.Close()
+	attest.CheckerP = bakerytest.ConditionParser(func(cond, arg string) ([]checkers.Caveat, error) {
+		if cond == "environment" && arg == "production" {
+			return nil, nil
+		}
+		return nil, errgo.Newf("%s %s not attested", cond, arg)
+	})
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.AgentRequiredCaveats = []checkers.Caveat{{
+		Location:  attest.Location(),
+		Condition: "environment production",
+	}}
+	sp.AgentOwnerRequiredCaveats = map[string][]checkers.Caveat{
+		"alice": {{
+			Location:  attest.Location(),
+			Condition: "environment staging",
+		}},
+	}
+	sp.AgentCaveatThirdParties = map[string]bakery.ThirdPartyInfo{
+		attest.Location(): {
+			PublicKey: attest.Key.Public,
+			Version:   bakery.LatestVersion,
+		},
+	}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+
+	// An agent that obtains a discharge for every required caveat
+	// can log in.
+	key := srv.CreateAgent(c, "bob@candid")
+	ms, err := dc.Discharge(c, "is-authenticated-user", agentClient(c, srv, "bob@candid", key))
+	c.Assert(err, qt.IsNil)
+	dc.AssertMacaroon(c, ms, identchecker.LoginOp, "bob@candid")
+
+	// An agent that cannot obtain a discharge for a caveat required
+	// by its owner cannot log in.
+	srv.CreateUser(c, "alice")
+	err = st.Store.UpdateIdentity(context.Background(), &store.Identity{
+		ProviderID: store.MakeProviderIdentity("idm", "alicebot"),
+		Username:   "alicebot@candid",
+		PublicKeys: []bakery.PublicKey{key.Public},
+		Owner:      store.MakeProviderIdentity("test", "alice"),
+	}, store.Update{
+		store.Username:   store.Set,
+		store.PublicKeys: store.Set,
+		store.Owner:      store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = dc.Discharge(c, "is-authenticated-user", agentClient(c, srv, "alicebot@candid", key))
+	c.Assert(err, qt.ErrorMatches, `.*environment staging not attested.*`)
+}
+
+// agentClient returns a client that logs in to the given server as
+// the given agent.
+func agentClient(c *qt.C, srv *candidtest.Server, username string, key *bakery.KeyPair) *httpbakery.Client {
+	client := srv.Client(nil)
+	client.Key = key
+	err := agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: key,
+		Agents: []agent.Agent{{
+			URL:      srv.URL,
+			Username: username,
+		}},
+	})
+	c.Assert(err, qt.IsNil)
+	return client
+}
+
 func (s *agentSuite) setAgentCookie(jar http.CookieJar, username string, pk *bakery.PublicKey) {
 	u, err := url.Parse(s.srv.URL)
 	if err != nil {
@@ -0,0 +1,140 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon.v2"
+
+	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/params"
+)
+
+// anonymousSessionRequest is a request to start an anonymous session.
+type anonymousSessionRequest struct {
+	httprequest.Route `httprequest:"POST /anonymous-session"`
+}
+
+// anonymousSessionResponse holds the response to a successful
+// anonymous session request.
+type anonymousSessionResponse struct {
+	// Macaroon holds the anonymous session macaroon. It declares
+	// the session ID but no user, and cannot be used to
+	// authenticate. It can be upgraded by passing it as the
+	// anonymous_session parameter of a redirect login.
+	Macaroon *bakery.Macaroon `json:"macaroon"`
+
+	// SessionID holds the correlation ID of the session. The
+	// identity macaroon obtained by upgrading the session declares
+	// the same ID.
+	SessionID string `json:"session-id"`
+}
+
+// AnonymousSession starts a new anonymous session, returning a
+// macaroon that can later be upgraded to an identity macaroon by
+// logging in.
+func (h *handler) AnonymousSession(p httprequest.Params, req *anonymousSessionRequest) (*anonymousSessionResponse, error) {
+	if h.params.AnonymousSessionLifetime == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "anonymous sessions are not enabled")
+	}
+	vers, err := h.params.MacaroonVersions().RequestVersion(p.Request)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	sessionID, err := h.params.TokenGenerator.Generate()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	m, err := h.params.Oven.NewMacaroon(
+		p.Context,
+		vers,
+		[]checkers.Caveat{
+			checkers.TimeBeforeCaveat(time.Now().Add(h.params.AnonymousSessionLifetime)),
+			candidclient.SessionDeclaration(sessionID),
+		},
+		auth.AnonymousSessionOp,
+		auth.SessionIDOp(sessionID),
+	)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot mint macaroon")
+	}
+	return &anonymousSessionResponse{
+		Macaroon:  m,
+		SessionID: sessionID,
+	}, nil
+}
+
+// anonymousSessionID verifies the given anonymous session macaroon,
+// which is encoded in base64 binary format, and returns the session ID
+// that was recorded when it was minted. If s is empty the returned ID
+// is empty.
+func (h *handler) anonymousSessionID(ctx context.Context, s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if h.params.AnonymousSessionLifetime == 0 {
+		return "", errgo.WithCausef(nil, params.ErrBadRequest, "anonymous sessions are not enabled")
+	}
+	b, err := macaroon.Base64Decode([]byte(s))
+	if err != nil {
+		return "", errgo.WithCausef(err, params.ErrBadRequest, "invalid anonymous session")
+	}
+	var ms macaroon.Slice
+	if err := ms.UnmarshalBinary(b); err != nil {
+		return "", errgo.WithCausef(err, params.ErrBadRequest, "invalid anonymous session")
+	}
+	ops, conditions, err := h.params.Oven.VerifyMacaroon(ctx, ms)
+	if err != nil {
+		return "", errgo.WithCausef(err, params.ErrBadRequest, "invalid anonymous session")
+	}
+	// The session ID is taken from the operations recorded when the
+	// macaroon was minted, not from any declaration, which could
+	// have been added by the holder of the macaroon.
+	isAnonymous := false
+	sessionID := ""
+	for _, op := range ops {
+		switch op {
+		case auth.AnonymousSessionOp:
+			isAnonymous = true
+		case auth.SessionIDOp(op.Action):
+			sessionID = op.Action
+		default:
+			return "", errgo.WithCausef(nil, params.ErrBadRequest, "invalid anonymous session: not an anonymous session macaroon")
+		}
+	}
+	if !isAnonymous {
+		return "", errgo.WithCausef(nil, params.ErrBadRequest, "invalid anonymous session: not an anonymous session macaroon")
+	}
+	for _, cond := range conditions {
+		name, arg, err := checkers.ParseCaveat(cond)
+		if err != nil {
+			return "", errgo.WithCausef(err, params.ErrBadRequest, "invalid anonymous session")
+		}
+		switch name {
+		case checkers.CondTimeBefore:
+			t, err := time.Parse(time.RFC3339Nano, arg)
+			if err != nil {
+				return "", errgo.WithCausef(err, params.ErrBadRequest, "invalid anonymous session")
+			}
+			if !time.Now().Before(t) {
+				return "", errgo.WithCausef(nil, params.ErrBadRequest, "anonymous session has expired")
+			}
+		case checkers.CondDeclared:
+			// Declarations are informational only.
+		default:
+			return "", errgo.WithCausef(nil, params.ErrBadRequest, "invalid anonymous session: unexpected caveat %q", cond)
+		}
+	}
+	if sessionID == "" {
+		return "", errgo.WithCausef(nil, params.ErrBadRequest, "invalid anonymous session: no session ID")
+	}
+	return sessionID, nil
+}
@@ -9,12 +9,15 @@ import (
 	"context"
 
 	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
 	"golang.org/x/net/trace"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/idp/idputil/secret"
+	"github.com/canonical/candid/internal/auth"
 	"github.com/canonical/candid/internal/auth/httpauth"
 	"github.com/canonical/candid/internal/discharger/internal"
 	"github.com/canonical/candid/internal/identity"
@@ -26,7 +29,7 @@ var logger = loggo.GetLogger("candid.internal.discharger")
 
 // NewAPIHandler is an identity.NewAPIHandlerFunc.
 func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error) {
-	reqAuth := httpauth.New(params.Oven, params.Authorizer, params.APIMacaroonTimeout)
+	reqAuth := httpauth.New(params.Oven, params.Authorizer, params.APIMacaroonTimeout, params.MacaroonVersions())
 	place := &place{params.MeetingPlace}
 	dt := &dischargeTokenCreator{
 		params: params,
@@ -36,22 +39,45 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 		return nil, errgo.Mask(err)
 	}
 	dts := internal.NewDischargeTokenStore(dtks)
+	oks, err := params.ProviderDataStore.KeyValueStore(context.Background(), "_onboarding")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
 	vc := &visitCompleter{
 		params:                params,
 		dischargeTokenCreator: dt,
 		dischargeTokenStore:   dts,
 		place:                 place,
+		onboardingStore:       oks,
+	}
+	hks, err := params.ProviderDataStore.KeyValueStore(context.Background(), "_login_handoffs")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	prks, err := params.ProviderDataStore.KeyValueStore(context.Background(), "_pending_registrations")
+	if err != nil {
+		return nil, errgo.Mask(err)
 	}
+	pendingRegistrations := idputil.NewPendingLimiter(prks, idputil.PendingLimitParams{
+		MaxPerEmail: params.MaxPendingRegistrationsPerEmail,
+		MaxPerIP:    params.MaxPendingRegistrationsPerIP,
+		Timeout:     params.PendingRegistrationTimeout,
+	})
 	codec := secret.NewCodec(params.Key)
 	err = initIDPs(context.Background(), initIDPParams{
 		HandlerParams:         params,
 		Codec:                 codec,
 		DischargeTokenCreator: dt,
 		VisitCompleter:        vc,
+		PendingRegistrations:  pendingRegistrations,
 	})
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	nonInteractiveLoginChain, err := newNonInteractiveLoginChain(params)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid non-interactive login chain")
+	}
 	checker := &thirdPartyCaveatChecker{
 		params:  params,
 		place:   place,
@@ -66,6 +92,9 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 		place:                 place,
 		reqAuth:               reqAuth,
 		codec:                 codec,
+		handoffStore:          hks,
+
+		nonInteractiveLoginChain: nonInteractiveLoginChain,
 	}))
 	d := httpbakery.NewDischarger(httpbakery.DischargerParams{
 		CheckerP:        checker,
@@ -82,7 +111,7 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 			Handle: h.Handle,
 		})
 	}
-	handlers = append(handlers, idpHandlers(params)...)
+	handlers = append(handlers, idpHandlers(params, codec)...)
 	return handlers, nil
 }
 
@@ -95,6 +124,14 @@ type handlerParams struct {
 	place                 *place
 	reqAuth               *httpauth.Authorizer
 	codec                 *secret.Codec
+
+	// handoffStore holds the logins that may be continued on
+	// another device.
+	handoffStore simplekv.Store
+
+	// nonInteractiveLoginChain holds the methods tried, in order,
+	// by the non-interactive login endpoint.
+	nonInteractiveLoginChain []nonInteractiveLoginMethod
 }
 
 // handlerCreator returns a function that creates new instances of the discharger API handler for a request.
@@ -104,6 +141,9 @@ func handlerCreator(hParams handlerParams) func(p httprequest.Params, arg interf
 		ctx := trace.NewContext(p.Context, t)
 		ctx, close1 := hParams.Store.Context(ctx)
 		ctx, close2 := hParams.MeetingStore.Context(ctx)
+		if hParams.RequestAuthCache {
+			ctx = auth.ContextWithRequestCache(ctx)
+		}
 		hnd := &handler{
 			params: hParams,
 			trace:  t,
@@ -146,12 +186,12 @@ func (h *handler) Close() error {
 	return nil
 }
 
-func idpHandlers(params identity.HandlerParams) []httprequest.Handler {
+func idpHandlers(params identity.HandlerParams, codec *secret.Codec) []httprequest.Handler {
 	var handlers []httprequest.Handler
 	for _, idp := range params.IdentityProviders {
 		idp := idp
 		path := "/login/" + idp.Name() + "/*path"
-		hfunc := newIDPHandler(params, idp)
+		hfunc := newIDPHandler(params, codec, idp)
 		handlers = append(handlers,
 			httprequest.Handler{
 				Method: "GET",
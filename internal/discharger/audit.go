@@ -0,0 +1,68 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/canonical/candid/audit"
+	"github.com/canonical/candid/internal/auth/httpauth"
+	"github.com/canonical/candid/store"
+)
+
+// auditSuccess records in the audit log, if configured, that the given
+// identity has logged in. The identity macaroon issued for the login
+// expires at the given time. The identity provider recorded is the one
+// used for the login, which may not be the one that created the
+// identity.
+func (c *visitCompleter) auditSuccess(ctx context.Context, req *http.Request, waitID string, id *store.Identity, expires time.Time) {
+	if c.params.AuditLogger == nil {
+		return
+	}
+	idpName := idpFromContext(ctx)
+	if idpName == "" {
+		idpName = id.ProviderID.Provider()
+	}
+	c.audit(ctx, req, &audit.Event{
+		Outcome:  audit.Success,
+		Username: id.Username,
+		IDP:      idpName,
+		WaitID:   waitID,
+		Expires:  &expires,
+	})
+}
+
+// auditFailure records in the audit log, if configured, that a login
+// failed with the given error. Any username submitted with the request
+// is recorded.
+func (c *visitCompleter) auditFailure(ctx context.Context, req *http.Request, waitID string, err error) {
+	if c.params.AuditLogger == nil {
+		return
+	}
+	c.audit(ctx, req, &audit.Event{
+		Outcome:  audit.Failure,
+		Username: req.Form.Get("username"),
+		IDP:      idpFromContext(ctx),
+		WaitID:   waitID,
+		Error:    err.Error(),
+	})
+}
+
+// audit completes the given event with the time and the address of the
+// client making the given request and writes it to the configured audit
+// log. Failing to write the event does not fail the login.
+func (c *visitCompleter) audit(ctx context.Context, req *http.Request, e *audit.Event) {
+	e.Time = time.Now()
+	filter := httpauth.IPFilter{
+		TrustedProxies: c.params.TrustedProxies,
+	}
+	if ip := filter.ClientIP(req); ip != nil {
+		e.ClientIP = ip.String()
+	}
+	if err := c.params.AuditLogger.Log(ctx, e); err != nil {
+		logger.Errorf("cannot write audit event: %s", err)
+	}
+}
@@ -5,9 +5,7 @@ package discharger
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding"
-	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
@@ -25,8 +23,10 @@ import (
 
 	"github.com/canonical/candid/candidclient"
 	"github.com/canonical/candid/candidclient/redirect"
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/internal/auth"
 	"github.com/canonical/candid/internal/auth/httpauth"
+	"github.com/canonical/candid/internal/discharger/internal"
 	"github.com/canonical/candid/internal/identity"
 	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
@@ -72,20 +72,25 @@ func (c *thirdPartyCaveatChecker) checkThirdPartyCaveat(ctx context.Context, p h
 		forceLegacy = true
 	}
 	var op bakery.Op
+	var groups groupFilter
 	switch cond {
 	case "is-authenticated-user", "is-authenticated-userid":
 		op = auth.GlobalOp(auth.ActionDischarge)
-		if len(args) == 0 {
-			break
+		fields := strings.Fields(args)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+			if !names.IsValidUserDomain(fields[0][1:]) {
+				return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid domain %q", fields[0][1:])
+			}
+			domain = fields[0][1:]
+			ctx = auth.ContextWithRequiredDomain(ctx, domain)
+			fields = fields[1:]
 		}
-		if args[0] != '@' {
-			return nil, checkers.ErrCaveatNotRecognized
+		for _, f := range fields {
+			var ok bool
+			if groups, ok = parseGroupFilter(f); !ok {
+				return nil, checkers.ErrCaveatNotRecognized
+			}
 		}
-		if !names.IsValidUserDomain(args[1:]) {
-			return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid domain %q", args[1:])
-		}
-		domain = args[1:]
-		ctx = auth.ContextWithRequiredDomain(ctx, domain)
 	case "is-member-of":
 		op = auth.GroupsDischargeOp(strings.Fields(args))
 	default:
@@ -112,8 +117,18 @@ func (c *thirdPartyCaveatChecker) checkThirdPartyCaveat(ctx context.Context, p h
 		mss = httpbakery.RequestMacaroons(p.Request)
 	}
 
+	ctx = auth.ContextWithUserAgent(ctx, p.Request.UserAgent())
 	authInfo, err := c.params.Authorizer.Auth(ctx, mss, op)
-	if _, ok := errgo.Cause(err).(*bakery.DischargeRequiredError); ok {
+	deletedUser := ""
+	if err != nil {
+		deletedUser = c.deletedUser(ctx, mss)
+	}
+	if deletedUser != "" && c.params.DeletedUserResponse != "interact" {
+		return nil, errgo.WithCausef(nil, params.ErrUserNoLongerExists, "user %s no longer exists", deletedUser)
+	}
+	if _, ok := errgo.Cause(err).(*bakery.DischargeRequiredError); ok || deletedUser != "" {
+		// Note that a user that no longer exists is asked to log
+		// in again, which may recreate their identity.
 		return nil, c.interactionRequiredError(ctx, interactionRequiredParams{
 			why:         err,
 			forceLegacy: forceLegacy,
@@ -132,6 +147,9 @@ func (c *thirdPartyCaveatChecker) checkThirdPartyCaveat(ctx context.Context, p h
 		return nil, errgo.Mask(err)
 	}
 	logger.Debugf("authorization for %#v succeeded", authInfo.Identity)
+	if id, ok := authInfo.Identity.(*auth.Identity); ok && idputil.IsSuspended(&id.Identity) {
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "account %s has been deactivated", id.Id())
+	}
 	c.updateDischargeTime(ctx, authInfo.Identity.Id())
 	if cond == "is-member-of" {
 		return nil, nil
@@ -146,22 +164,120 @@ func (c *thirdPartyCaveatChecker) checkThirdPartyCaveat(ctx context.Context, p h
 		}
 	}
 
-	var declaration checkers.Caveat
-	switch cond {
-	case "is-authenticated-user":
-		declaration = candidclient.UserDeclaration(authInfo.Identity.Id())
-	case "is-authenticated-userid":
+	caveats, err := auth.DischargeCaveats(authInfo.Identity, cond, time.Now().Add(c.params.DischargeMacaroonTimeout), c.params.RolesCaveat)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if groups != nil {
 		id, ok := authInfo.Identity.(*auth.Identity)
 		if !ok {
-			return nil, errgo.Newf("unexpected authinfo type %T", authInfo)
+			return nil, errgo.Newf("unexpected identity type %T", authInfo.Identity)
+		}
+		all, err := id.Groups(ctx)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if mask, ok := c.groupMask(p.Caveat.FirstPartyPublicKey); ok {
+			// The filter requested by the relying party uses the
+			// names by which it knows the groups.
+			all = mask.Apply(all)
+		}
+		caveats = append(caveats, candidclient.GroupsDeclaration(groups.filter(all)))
+	}
+	if c.params.AuthTimeCaveat {
+		if t, ok := c.params.Authorizer.AuthTime(ctx, authInfo.Macaroons); ok {
+			caveats = append(caveats, candidclient.AuthTimeDeclaration(t))
 		}
-		declaration = candidclient.UserIDDeclaration(string(id.ProviderID))
 	}
+	if c.params.LoginIDPCaveat {
+		if idp, ok := c.params.Authorizer.LoginIDP(ctx, authInfo.Macaroons); ok {
+			caveats = append(caveats, candidclient.LoginIDPDeclaration(idp))
+		}
+	}
+	return caveats, nil
+}
 
-	return []checkers.Caveat{
-		declaration,
-		checkers.TimeBeforeCaveat(time.Now().Add(c.params.DischargeMacaroonTimeout)),
-	}, nil
+// groupMask returns the group mask configured for the relying party
+// with the given public key, if any.
+func (c *thirdPartyCaveatChecker) groupMask(key bakery.PublicKey) (idputil.GroupMask, bool) {
+	for _, m := range c.params.RelyingPartyGroups {
+		if m.PublicKey.Key == key.Key {
+			return m, true
+		}
+	}
+	return idputil.GroupMask{}, false
+}
+
+// A groupFilter selects the groups that are declared in a discharge
+// macaroon. Each pattern either names a group or, if it ends in "*",
+// matches all groups starting with the preceding prefix.
+type groupFilter []string
+
+// parseGroupFilter parses a "groups" argument to an
+// is-authenticated-user caveat. The argument is either "groups", which
+// selects all groups, or "groups=" followed by a comma separated list
+// of patterns. It reports whether the argument was valid.
+func parseGroupFilter(arg string) (groupFilter, bool) {
+	if arg == "groups" {
+		return groupFilter{"*"}, true
+	}
+	if !strings.HasPrefix(arg, "groups=") {
+		return nil, false
+	}
+	var f groupFilter
+	for _, p := range strings.Split(strings.TrimPrefix(arg, "groups="), ",") {
+		if p != "" {
+			f = append(f, p)
+		}
+	}
+	if len(f) == 0 {
+		return nil, false
+	}
+	return f, true
+}
+
+// filter returns those of the given groups that match the filter.
+func (f groupFilter) filter(groups []string) []string {
+	matched := make([]string, 0, len(groups))
+	for _, g := range groups {
+		for _, p := range f {
+			if g == p || strings.HasSuffix(p, "*") && strings.HasPrefix(g, strings.TrimSuffix(p, "*")) {
+				matched = append(matched, g)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// deletedUser returns the name of the user declared by the given
+// macaroons if that user no longer exists. Only macaroons minted by
+// this service are considered, so that the response cannot be used to
+// find out whether arbitrary users exist. The caveats of the macaroons
+// are not checked, so this must only be used to give a more specific
+// error for a request that has already failed authorization.
+func (c *thirdPartyCaveatChecker) deletedUser(ctx context.Context, mss []macaroon.Slice) string {
+	for _, ms := range mss {
+		_, conds, err := c.params.Oven.VerifyMacaroon(ctx, ms)
+		if err != nil {
+			continue
+		}
+		declared := checkers.InferDeclaredFromConditions(auth.Namespace, conds)
+		id := store.Identity{
+			ProviderID: store.ProviderIdentity(declared["userid"]),
+			Username:   declared["username"],
+		}
+		if id.ProviderID == "" && id.Username == "" {
+			continue
+		}
+		if err := c.params.Store.Identity(ctx, &id); errgo.Cause(err) == store.ErrNotFound {
+			if id.Username != "" {
+				return id.Username
+			}
+			return string(id.ProviderID)
+		}
+	}
+	return ""
 }
 
 func macaroonsFromDischargeToken(ctx context.Context, token *httpbakery.DischargeToken) (macaroon.Slice, error) {
@@ -212,9 +328,9 @@ type interactionRequiredParams struct {
 // interactionRequiredError returns an error suitable for returning from
 // a discharge request that can only be satisfied if the user logs in.
 func (c *thirdPartyCaveatChecker) interactionRequiredError(ctx context.Context, p interactionRequiredParams) error {
-	dischargeID, err := newDischargeID()
+	dischargeID, err := c.params.TokenGenerator.Generate()
 	if err != nil {
-		return errgo.Mask(err)
+		return errgo.Notef(err, "cannot generate discharge id")
 	}
 	// TODO(rog) If the user is already logged in (username != ""),
 	// we should perhaps just return an error here.
@@ -237,16 +353,18 @@ func (c *thirdPartyCaveatChecker) interactionRequiredError(ctx context.Context,
 		visitParams += "&domain=" + url.QueryEscape(p.domain)
 		redirectVisitParams = "?domain=" + url.QueryEscape(p.domain)
 	}
-	visitURL := c.params.Location + "/login" + visitParams
-	waitTokenURL := c.params.Location + "/wait-token?did=" + dischargeID
+	visitURL := idputil.LocationURL(c.params.Location, "/login"+visitParams)
+	waitTokenURL := idputil.LocationURL(c.params.Location, "/wait-token?did="+dischargeID)
 	httpbakery.SetWebBrowserInteraction(ierr, visitURL, waitTokenURL)
 
-	redirect.SetInteraction(ierr, c.params.Location+"/login-redirect"+redirectVisitParams, c.params.Location+"/discharge-token")
+	redirect.SetInteraction(ierr, idputil.LocationURL(c.params.Location, "/login-redirect"+redirectVisitParams), idputil.LocationURL(c.params.Location, "/discharge-token"))
 
-	// Set the URLs used by old clients for backward compatibility.
-	legacyVisitURL := c.params.Location + "/login-legacy" + visitParams
-	legacyWaitURL := c.params.Location + "/wait-legacy?did=" + dischargeID
-	httpbakery.SetLegacyInteraction(ierr, legacyVisitURL, legacyWaitURL)
+	if !c.params.DisableLegacyLogin {
+		// Set the URLs used by old clients for backward compatibility.
+		legacyVisitURL := idputil.LocationURL(c.params.Location, "/login-legacy"+visitParams)
+		legacyWaitURL := idputil.LocationURL(c.params.Location, "/wait-legacy?did="+dischargeID)
+		httpbakery.SetLegacyInteraction(ierr, legacyVisitURL, legacyWaitURL)
+	}
 
 	if p.forceLegacy {
 		// Even though the client might purport to support bakery V3,
@@ -262,14 +380,6 @@ func isDischargeRequiredError(err error) bool {
 	return ok && cause.Code == httpbakery.ErrDischargeRequired
 }
 
-func newDischargeID() (string, error) {
-	var b [32]byte
-	if _, err := rand.Read(b[:]); err != nil {
-		return "", errgo.Notef(err, "cannot read random bytes for discharge id")
-	}
-	return fmt.Sprintf("%x", b[:]), nil
-}
-
 type dischargeTokenRequest struct {
 	httprequest.Route `httprequest:"POST /discharge-token"`
 	redirect.DischargeTokenRequest
@@ -278,12 +388,46 @@ type dischargeTokenRequest struct {
 // DischargeToken is used to collect a DischargeToken when redirect based
 // login is being used.
 func (h *handler) DischargeToken(p httprequest.Params, req *dischargeTokenRequest) (*redirect.DischargeTokenResponse, error) {
-	dt, err := h.params.dischargeTokenStore.Get(p.Context, req.Body.Code)
+	dt, err := h.params.dischargeTokenStore.GetWithCodeVerifier(p.Context, req.Body.Code, req.Body.CodeVerifier, req.Body.ReturnTo)
 	if err != nil {
-		if errgo.Cause(err) == store.ErrNotFound {
+		switch errgo.Cause(err) {
+		case store.ErrNotFound:
 			return nil, errgo.WithCausef(err, params.ErrNotFound, "")
+		case internal.ErrInvalidCodeVerifier, internal.ErrInvalidReturnTo:
+			return nil, errgo.WithCausef(err, params.ErrBadRequest, "")
 		}
 		return nil, errgo.Mask(err)
 	}
+	dt, err = h.bindUserAgent(dt, p.Request)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
 	return &redirect.DischargeTokenResponse{DischargeToken: dt}, nil
 }
+
+// bindUserAgent returns a copy of the given discharge token that can
+// only be used by the user agent that made the given request, if user
+// agent binding has been configured. A discharge requested by a
+// different user agent with the token will require the user to log in
+// again.
+func (h *handler) bindUserAgent(dt *httpbakery.DischargeToken, req *http.Request) (*httpbakery.DischargeToken, error) {
+	if !h.params.BindUserAgent || dt == nil || dt.Kind != "macaroon" {
+		return dt, nil
+	}
+	var m macaroon.Macaroon
+	if err := m.UnmarshalBinary(dt.Value); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal discharge token")
+	}
+	cav := auth.Namespace.ResolveCaveat(auth.UserAgentCaveat(req.UserAgent()))
+	if err := m.AddFirstPartyCaveat([]byte(cav.Condition)); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	v, err := m.MarshalBinary()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &httpbakery.DischargeToken{
+		Kind:  dt.Kind,
+		Value: v,
+	}, nil
+}
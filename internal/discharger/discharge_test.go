@@ -12,9 +12,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptest"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -31,13 +33,18 @@ import (
 
 	"github.com/canonical/candid/candidclient"
 	"github.com/canonical/candid/candidclient/redirect"
+	"github.com/canonical/candid/groupwebhook"
 	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/idp/static"
 	"github.com/canonical/candid/internal/auth"
 	"github.com/canonical/candid/internal/candidtest"
 	"github.com/canonical/candid/internal/discharger"
 	"github.com/canonical/candid/internal/identity"
 	v1 "github.com/canonical/candid/internal/v1"
+	"github.com/canonical/candid/loginhours"
+	"github.com/canonical/candid/loginpolicy"
+	"github.com/canonical/candid/maintenance"
 	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
 )
@@ -844,7 +851,7 @@ func (s *dischargeSuite) TestDischargeBrowserRedirectLogin(c *qt.C) {
 	c.Assert(err, qt.IsNil)
 	c.Assert(state, qt.Equals, "123456")
 
-	dt, err := rerr.InteractionInfo.GetDischargeToken(context.Background(), code)
+	dt, err := rerr.InteractionInfo.GetDischargeToken(context.Background(), "https://www.example.com/callback", code)
 	c.Assert(err, qt.IsNil)
 
 	interactor.SetDischargeToken(rerr.InteractionInfo.LoginURL, dt)
@@ -902,3 +909,1179 @@ func (s *dischargeSuite) TestDischargeUserID(c *qt.C) {
 	c.Assert(err, qt.IsNil)
 	c.Assert(username, qt.Equals, auth.AdminUsername)
 }
+
+func TestDischargeRolesCaveat(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.RolesCaveat = true
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	err := st.Store.UpdateIdentity(srv.Ctx, &store.Identity{
+		Username: auth.AdminUsername,
+		Roles:    []string{"tenantA:admin", "tenantB:viewer"},
+	}, store.Update{
+		store.Roles: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	dc := candidtest.NewDischargeCreator(srv)
+	ms, err := dc.Discharge(c, "is-authenticated-user", srv.AdminClient())
+	c.Assert(err, qt.IsNil)
+	declared := checkers.InferDeclared(checkers.New(nil).Namespace(), ms)
+	c.Assert(declared["username"], qt.Equals, auth.AdminUsername)
+	c.Assert(declared["roles"], qt.Equals, "tenantA:admin,tenantB:viewer")
+	c.Assert(candidclient.DeclaredRoles(declared), qt.DeepEquals, map[string][]string{
+		"tenantA": {"admin"},
+		"tenantB": {"viewer"},
+	})
+}
+
+func TestDischargeAuthTimeCaveat(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"bob": {Password: "bobpassword"},
+	}))
+	sp.AuthTimeCaveat = true
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "bob", "bobpassword"),
+	})
+	before := time.Now().Truncate(time.Second)
+	ms, err := dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	after := time.Now()
+	declared := checkers.InferDeclared(checkers.New(nil).Namespace(), ms)
+	authTime, ok := candidclient.DeclaredAuthTime(declared)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(authTime.Before(before), qt.Equals, false)
+	c.Assert(authTime.After(after), qt.Equals, false)
+
+	// A later discharge using the same login declares the time of
+	// the original authentication.
+	time.Sleep(time.Second)
+	ms, err = dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	declared = checkers.InferDeclared(checkers.New(nil).Namespace(), ms)
+	authTime1, ok := candidclient.DeclaredAuthTime(declared)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(authTime1, qt.DeepEquals, authTime)
+}
+
+func TestDischargeLoginIDPCaveat(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"bob": {Password: "bobpassword"},
+	}))
+	sp.LoginIDPCaveat = true
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "bob", "bobpassword"),
+	})
+	ms, err := dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	declared := checkers.InferDeclared(checkers.New(nil).Namespace(), ms)
+	c.Assert(declared["login-idp"], qt.Equals, "test")
+	c.Assert(candidclient.DeclaredLoginIDP(declared), qt.Equals, "test")
+}
+
+func TestLoginMaintenanceWindow(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	newServer := func(start time.Time) *candidtest.Server {
+		schedule, err := maintenance.NewSchedule([]maintenance.Window{{
+			Start:    start.UTC().Format("15:04"),
+			Duration: "10m",
+			Message:  "database maintenance",
+		}})
+		c.Assert(err, qt.IsNil)
+		st := candidtest.NewStore()
+		sp := candidtest.WithIDPs(st.ServerParams(), candidtest.StaticIDP("test", map[string]static.UserInfo{
+			"bob": {Password: "bobpassword"},
+		}))
+		sp.MaintenanceSchedule = schedule
+		return candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+			"discharger": discharger.NewAPIHandler,
+		})
+	}
+
+	// Logins are allowed outside the maintenance window.
+	srv := newServer(time.Now().Add(2 * time.Hour))
+	dc := candidtest.NewDischargeCreator(srv)
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "bob", "bobpassword"),
+	})
+	_, err := dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+
+	// Logins are refused inside the maintenance window.
+	srv = newServer(time.Now().Add(-time.Minute))
+	resp := srv.Get(c, "/login/test")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusServiceUnavailable)
+	var perr params.Error
+	err = json.NewDecoder(resp.Body).Decode(&perr)
+	c.Assert(err, qt.IsNil)
+	c.Assert(perr.Code, qt.Equals, params.ErrServiceUnavailable)
+	c.Assert(perr.Message, qt.Matches, `login is unavailable due to scheduled maintenance, please try again after .*: database maintenance`)
+}
+
+var dischargeGroupsTests = []struct {
+	about        string
+	condition    string
+	expectGroups []string
+}{{
+	about:     "no groups requested",
+	condition: "is-authenticated-user",
+}, {
+	about:        "all groups",
+	condition:    "is-authenticated-user groups",
+	expectGroups: []string{"admins", "team-a", "team-b", "users"},
+}, {
+	about:        "explicit groups",
+	condition:    "is-authenticated-user groups=users@test,other",
+	expectGroups: []string{"users"},
+}, {
+	about:        "group prefix",
+	condition:    "is-authenticated-user groups=team-*,admins@test",
+	expectGroups: []string{"admins", "team-a", "team-b"},
+}, {
+	about:        "with domain",
+	condition:    "is-authenticated-user @test groups=team-a@test",
+	expectGroups: []string{"team-a"},
+}, {
+	about:     "no matching groups",
+	condition: "is-authenticated-user groups=other-*",
+}}
+
+func TestDischargeGroups(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.DomainIDP("test", "test", map[string]static.UserInfo{
+		"bob": {
+			Password: "bobpassword",
+			Groups:   []string{"admins", "team-a", "team-b", "users"},
+		},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	for _, test := range dischargeGroupsTests {
+		c.Run(test.about, func(c *qt.C) {
+			client := srv.Client(httpbakery.WebBrowserInteractor{
+				OpenWebBrowser: candidtest.PasswordLogin(c, "bob", "bobpassword"),
+			})
+			ms, err := dc.Discharge(c, test.condition, client)
+			c.Assert(err, qt.IsNil)
+			declared := checkers.InferDeclared(checkers.New(nil).Namespace(), ms)
+			c.Assert(declared["username"], qt.Equals, "bob@test")
+			var expect []string
+			for _, g := range test.expectGroups {
+				expect = append(expect, g+"@test")
+			}
+			c.Assert(candidclient.DeclaredGroups(declared), qt.DeepEquals, expect)
+		})
+	}
+}
+
+func TestDischargeGroupsRelyingPartyMask(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.DomainIDP("test", "test", map[string]static.UserInfo{
+		"bob": {
+			Password: "bobpassword",
+			Groups:   []string{"admins", "team-a", "team-b", "users"},
+		},
+	}))
+	// The relying party keys are filled in once the discharge
+	// creators have been made.
+	key1, key2 := new(bakery.PublicKey), new(bakery.PublicKey)
+	sp.RelyingPartyGroups = []idputil.GroupMask{{
+		PublicKey: key1,
+		Groups: map[string]string{
+			"team-a@test": "developers",
+			"team-b@test": "developers",
+			"users@test":  "",
+		},
+	}, {
+		PublicKey: key2,
+		Groups: map[string]string{
+			"admins@test": "operators",
+		},
+	}}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc1 := candidtest.NewDischargeCreator(srv)
+	*key1 = dc1.Bakery.Oven.Key().Public
+	dc2 := candidtest.NewDischargeCreator(srv)
+	*key2 = dc2.Bakery.Oven.Key().Public
+	dc3 := candidtest.NewDischargeCreator(srv)
+
+	groups := func(dc *candidtest.DischargeCreator, condition string) []string {
+		client := srv.Client(httpbakery.WebBrowserInteractor{
+			OpenWebBrowser: candidtest.PasswordLogin(c, "bob", "bobpassword"),
+		})
+		ms, err := dc.Discharge(c, condition, client)
+		c.Assert(err, qt.IsNil)
+		declared := checkers.InferDeclared(checkers.New(nil).Namespace(), ms)
+		c.Assert(declared["username"], qt.Equals, "bob@test")
+		return candidclient.DeclaredGroups(declared)
+	}
+	// Each relying party sees its own aliases for the same user.
+	c.Assert(groups(dc1, "is-authenticated-user groups"), qt.DeepEquals, []string{"developers", "users@test"})
+	c.Assert(groups(dc2, "is-authenticated-user groups"), qt.DeepEquals, []string{"operators"})
+	// The filter requested by a relying party uses its aliases.
+	c.Assert(groups(dc1, "is-authenticated-user groups=dev*"), qt.DeepEquals, []string{"developers"})
+	c.Assert(groups(dc2, "is-authenticated-user groups=admins@test"), qt.IsNil)
+	// A relying party without a mask sees the real names.
+	c.Assert(groups(dc3, "is-authenticated-user groups"), qt.DeepEquals, []string{"admins@test", "team-a@test", "team-b@test", "users@test"})
+}
+
+func TestDischargeGroupsInvalidArgument(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	srv := candidtest.NewMemServer(c, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	_, err := dc.Discharge(c, "is-authenticated-user groups=", srv.AdminClient())
+	c.Assert(err, qt.ErrorMatches, `.*caveat not recognized`)
+}
+
+// deletableStore is a store.Store that can hide identities, making
+// them appear to have been deleted. Updating a hidden identity makes
+// it visible again, as if it had been recreated.
+type deletableStore struct {
+	store.Store
+
+	mu      sync.Mutex
+	deleted map[string]bool
+}
+
+func (s *deletableStore) delete(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted[username] = true
+}
+
+func (s *deletableStore) isDeleted(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleted[username]
+}
+
+func (s *deletableStore) Identity(ctx context.Context, id *store.Identity) error {
+	if err := s.Store.Identity(ctx, id); err != nil {
+		return err
+	}
+	if s.isDeleted(id.Username) {
+		return store.NotFoundError(id.ID, id.ProviderID, id.Username)
+	}
+	return nil
+}
+
+func (s *deletableStore) UpdateIdentity(ctx context.Context, id *store.Identity, update store.Update) error {
+	if err := s.Store.UpdateIdentity(ctx, id, update); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.deleted, id.Username)
+	return nil
+}
+
+var deletedUserTests = []struct {
+	about       string
+	response    string
+	expectError string
+}{{
+	about:       "default",
+	expectError: `.*user test no longer exists`,
+}, {
+	about:       "error",
+	response:    "error",
+	expectError: `.*user test no longer exists`,
+}, {
+	about:    "interact",
+	response: "interact",
+}}
+
+func TestDischargeDeletedUser(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range deletedUserTests {
+		c.Run(test.about, func(c *qt.C) {
+			st := candidtest.NewStore()
+			ds := &deletableStore{
+				Store:   st.Store,
+				deleted: make(map[string]bool),
+			}
+			sp := st.ServerParams()
+			sp.Store = ds
+			sp.DeletedUserResponse = test.response
+			sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+				"test": {
+					Password: "password",
+					Name:     "Test User",
+					Email:    "test@example.com",
+				},
+			}))
+			srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+				"discharger": discharger.NewAPIHandler,
+			})
+			dc := candidtest.NewDischargeCreator(srv)
+			logins := 0
+			client := srv.Client(httpbakery.WebBrowserInteractor{
+				OpenWebBrowser: func(u *url.URL) error {
+					logins++
+					return candidtest.PasswordLogin(c, "test", "password")(u)
+				},
+			})
+			ms, err := dc.Discharge(c, "is-authenticated-user", client)
+			c.Assert(err, qt.IsNil)
+			dc.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+			c.Assert(logins, qt.Equals, 1)
+
+			ds.delete("test")
+			ms, err = dc.Discharge(c, "is-authenticated-user", client)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				c.Assert(logins, qt.Equals, 1)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			dc.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+			c.Assert(logins, qt.Equals, 2)
+		})
+	}
+}
+
+func TestRedirectLoginParams(t *testing.T) {
+	c := qt.New(t)
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.RedirectLoginWhitelist = []string{
+		"https://www.example.com/callback?app=1",
+	}
+	sp.RedirectLoginParams = map[string]idputil.RedirectParams{
+		"oidc": {
+			"session_state": "idp:session_state",
+			"login_hint":    "email",
+			"provider":      "idp",
+			"nonce":         "idp:nonce",
+			"code":          "username",
+		},
+	}
+	sp = candidtest.WithIDPs(sp, candidtest.StubOIDC("oidc", "", candidtest.OIDCUser{
+		Username:     "alice",
+		Email:        "alice@example.com",
+		SessionState: "session-123",
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, qt.IsNil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host == "www.example.com" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	v := url.Values{
+		"return_to": {"https://www.example.com/callback?app=1"},
+		"state":     {"123456"},
+	}
+	resp, err := client.Get(srv.URL + "/login-redirect?" + v.Encode())
+	c.Assert(err, qt.IsNil)
+	resp, err = candidtest.SelectInteractiveLogin(nil)(client, resp)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+
+	u, err := url.Parse(resp.Header.Get("Location"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.Host+u.Path, qt.Equals, "www.example.com/callback")
+	q := u.Query()
+	c.Assert(q.Get("app"), qt.Equals, "1")
+	c.Assert(q.Get("session_state"), qt.Equals, "session-123")
+	c.Assert(q.Get("login_hint"), qt.Equals, "alice@example.com")
+	c.Assert(q.Get("provider"), qt.Equals, "oidc")
+	c.Assert(q["nonce"], qt.IsNil)
+	// The core parameters cannot be overridden.
+	c.Assert(q["state"], qt.DeepEquals, []string{"123456"})
+	c.Assert(q["code"], qt.HasLen, 1)
+	c.Assert(q.Get("code"), qt.Not(qt.Equals), "alice")
+}
+
+var relyingPartyRulesTests = []struct {
+	about           string
+	returnTo        string
+	username        string
+	password        string
+	expectErrorCode string
+}{{
+	about:    "group member allowed",
+	returnTo: "https://rp1.example.com/callback",
+	username: "alice",
+	password: "alicepassword",
+}, {
+	about:           "non group member denied",
+	returnTo:        "https://rp1.example.com/callback",
+	username:        "bob",
+	password:        "bobpassword",
+	expectErrorCode: "access_denied",
+}, {
+	about:    "attribute match allowed",
+	returnTo: "https://rp2.example.com/callback",
+	username: "bob",
+	password: "bobpassword",
+}, {
+	about:           "attribute mismatch denied",
+	returnTo:        "https://rp2.example.com/callback",
+	username:        "alice",
+	password:        "alicepassword",
+	expectErrorCode: "access_denied",
+}, {
+	about:    "no rule allows everyone",
+	returnTo: "https://rp3.example.com/callback",
+	username: "bob",
+	password: "bobpassword",
+}}
+
+func TestRelyingPartyRules(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp.RedirectLoginWhitelist = []string{
+		"https://rp1.example.com/callback",
+		"https://rp2.example.com/callback",
+		"https://rp3.example.com/callback",
+	}
+	sp.RelyingPartyRules = map[string]idputil.RelyingPartyRule{
+		"rp1.example.com": {
+			AllowGroups: []string{"engineering"},
+		},
+		"rp2.example.com": {
+			AllowAttributes: []idputil.AttributeValue{{
+				Attribute: "email-domain",
+				Value:     "partner.example.com",
+			}},
+		},
+	}
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"alice": {
+			Password: "alicepassword",
+			Email:    "alice@example.com",
+			Groups:   []string{"engineering"},
+		},
+		"bob": {
+			Password: "bobpassword",
+			Email:    "bob@partner.example.com",
+		},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	for _, test := range relyingPartyRulesTests {
+		c.Run(test.about, func(c *qt.C) {
+			jar, err := cookiejar.New(nil)
+			c.Assert(err, qt.IsNil)
+			client := &http.Client{
+				Jar: jar,
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					if strings.HasSuffix(req.URL.Host, ".example.com") {
+						return http.ErrUseLastResponse
+					}
+					return nil
+				},
+			}
+			v := url.Values{
+				"return_to": {test.returnTo},
+				"state":     {"123456"},
+			}
+			resp, err := client.Get(srv.URL + "/login-redirect?" + v.Encode())
+			c.Assert(err, qt.IsNil)
+			resp, err = candidtest.SelectInteractiveLogin(candidtest.PostLoginForm(test.username, test.password))(client, resp)
+			c.Assert(err, qt.IsNil)
+			defer resp.Body.Close()
+			c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+
+			u, err := url.Parse(resp.Header.Get("Location"))
+			c.Assert(err, qt.IsNil)
+			c.Assert(u.Scheme+"://"+u.Host+u.Path, qt.Equals, test.returnTo)
+			q := u.Query()
+			c.Assert(q.Get("state"), qt.Equals, "123456")
+			if test.expectErrorCode != "" {
+				c.Assert(q.Get("error_code"), qt.Equals, test.expectErrorCode)
+				c.Assert(q["code"], qt.IsNil)
+				return
+			}
+			c.Assert(q["error"], qt.IsNil)
+			c.Assert(q.Get("code"), qt.Not(qt.Equals), "")
+		})
+	}
+}
+
+var minLoginGroupsTests = []struct {
+	about         string
+	defaultGroups []string
+	username      string
+	password      string
+	expectError   string
+}{{
+	about:    "provisioned user",
+	username: "alice",
+	password: "alicepassword",
+}, {
+	about:       "user with no groups",
+	username:    "bob",
+	password:    "bobpassword",
+	expectError: `account not provisioned: user "bob" is a member of 0 groups, at least 1 are required`,
+}, {
+	about:         "default groups count",
+	defaultGroups: []string{"everyone"},
+	username:      "bob",
+	password:      "bobpassword",
+}}
+
+func TestMinLoginGroups(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range minLoginGroupsTests {
+		c.Run(test.about, func(c *qt.C) {
+			sp := candidtest.NewStore().ServerParams()
+			sp.RedirectLoginWhitelist = []string{"https://rp.example.com/callback"}
+			sp.MinLoginGroups = 1
+			sp.DefaultGroups = test.defaultGroups
+			sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+				"alice": {
+					Password: "alicepassword",
+					Groups:   []string{"engineering"},
+				},
+				"bob": {
+					Password: "bobpassword",
+				},
+			}))
+			srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+				"discharger": discharger.NewAPIHandler,
+			})
+			jar, err := cookiejar.New(nil)
+			c.Assert(err, qt.IsNil)
+			client := &http.Client{
+				Jar: jar,
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					if strings.HasSuffix(req.URL.Host, ".example.com") {
+						return http.ErrUseLastResponse
+					}
+					return nil
+				},
+			}
+			v := url.Values{
+				"return_to": {"https://rp.example.com/callback"},
+				"state":     {"123456"},
+			}
+			resp, err := client.Get(srv.URL + "/login-redirect?" + v.Encode())
+			c.Assert(err, qt.IsNil)
+			resp, err = candidtest.SelectInteractiveLogin(candidtest.PostLoginForm(test.username, test.password))(client, resp)
+			c.Assert(err, qt.IsNil)
+			defer resp.Body.Close()
+			c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+
+			u, err := url.Parse(resp.Header.Get("Location"))
+			c.Assert(err, qt.IsNil)
+			q := u.Query()
+			if test.expectError != "" {
+				c.Assert(q.Get("error_code"), qt.Equals, string(params.ErrForbidden))
+				c.Assert(q.Get("error"), qt.Equals, test.expectError)
+				c.Assert(q["code"], qt.IsNil)
+				return
+			}
+			c.Assert(q["error"], qt.IsNil)
+			c.Assert(q.Get("code"), qt.Not(qt.Equals), "")
+		})
+	}
+}
+
+// timeOfDay returns the time of day d from now in UTC, in the form
+// used by login hours rules.
+func timeOfDay(d time.Duration) string {
+	return time.Now().Add(d).UTC().Format("15:04")
+}
+
+var loginHoursTests = []struct {
+	about       string
+	rules       []loginhours.Rule
+	expectError string
+}{{
+	about: "rule does not apply",
+	rules: []loginhours.Rule{{
+		Group: "contractors",
+		Start: timeOfDay(2 * time.Hour),
+		End:   timeOfDay(3 * time.Hour),
+	}},
+}, {
+	about: "inside window",
+	rules: []loginhours.Rule{{
+		Group: "engineering",
+		Start: "00:00",
+		End:   "00:00",
+	}},
+}, {
+	about: "outside window",
+	rules: []loginhours.Rule{{
+		Group: "engineering",
+		Start: timeOfDay(2 * time.Hour),
+		End:   timeOfDay(3 * time.Hour),
+	}},
+	expectError: "login not permitted at this time",
+}}
+
+func TestLoginHours(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range loginHoursTests {
+		c.Run(test.about, func(c *qt.C) {
+			sp := candidtest.NewStore().ServerParams()
+			sp.RedirectLoginWhitelist = []string{"https://rp.example.com/callback"}
+			policy, err := loginhours.NewPolicy(test.rules)
+			c.Assert(err, qt.IsNil)
+			sp.LoginHours = policy
+			sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+				"alice": {
+					Password: "alicepassword",
+					Groups:   []string{"engineering"},
+				},
+			}))
+			srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+				"discharger": discharger.NewAPIHandler,
+			})
+			jar, err := cookiejar.New(nil)
+			c.Assert(err, qt.IsNil)
+			client := &http.Client{
+				Jar: jar,
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					if strings.HasSuffix(req.URL.Host, ".example.com") {
+						return http.ErrUseLastResponse
+					}
+					return nil
+				},
+			}
+			v := url.Values{
+				"return_to": {"https://rp.example.com/callback"},
+				"state":     {"123456"},
+			}
+			resp, err := client.Get(srv.URL + "/login-redirect?" + v.Encode())
+			c.Assert(err, qt.IsNil)
+			resp, err = candidtest.SelectInteractiveLogin(candidtest.PostLoginForm("alice", "alicepassword"))(client, resp)
+			c.Assert(err, qt.IsNil)
+			defer resp.Body.Close()
+			c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+
+			u, err := url.Parse(resp.Header.Get("Location"))
+			c.Assert(err, qt.IsNil)
+			q := u.Query()
+			if test.expectError != "" {
+				c.Assert(q.Get("error_code"), qt.Equals, string(params.ErrForbidden))
+				c.Assert(q.Get("error"), qt.Equals, test.expectError)
+				c.Assert(q["code"], qt.IsNil)
+				return
+			}
+			c.Assert(q["error"], qt.IsNil)
+			c.Assert(q.Get("code"), qt.Not(qt.Equals), "")
+		})
+	}
+}
+
+func TestGroupWebhook(t *testing.T) {
+	c := qt.New(t)
+	fail := false
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if fail {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		var body groupwebhook.Request
+		err := json.NewDecoder(req.Body).Decode(&body)
+		c.Check(err, qt.IsNil)
+		c.Check(body.Username, qt.Equals, "alice")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"groups": ["webhook-group"]}`))
+	}))
+	defer webhook.Close()
+
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.RedirectLoginWhitelist = []string{"https://rp.example.com/callback"}
+	resolver, err := groupwebhook.NewResolver(groupwebhook.Config{
+		URL: webhook.URL,
+	})
+	c.Assert(err, qt.IsNil)
+	sp.GroupWebhook = resolver
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"alice": {
+			Password: "alicepassword",
+			Groups:   []string{"engineering"},
+		},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	login := func(c *qt.C) url.Values {
+		jar, err := cookiejar.New(nil)
+		c.Assert(err, qt.IsNil)
+		client := &http.Client{
+			Jar: jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if strings.HasSuffix(req.URL.Host, ".example.com") {
+					return http.ErrUseLastResponse
+				}
+				return nil
+			},
+		}
+		v := url.Values{
+			"return_to": {"https://rp.example.com/callback"},
+			"state":     {"123456"},
+		}
+		resp, err := client.Get(srv.URL + "/login-redirect?" + v.Encode())
+		c.Assert(err, qt.IsNil)
+		resp, err = candidtest.SelectInteractiveLogin(candidtest.PostLoginForm("alice", "alicepassword"))(client, resp)
+		c.Assert(err, qt.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+		u, err := url.Parse(resp.Header.Get("Location"))
+		c.Assert(err, qt.IsNil)
+		return u.Query()
+	}
+
+	q := login(c)
+	c.Assert(q["error"], qt.IsNil)
+	c.Assert(q.Get("code"), qt.Not(qt.Equals), "")
+	id := store.Identity{
+		Username: "alice",
+	}
+	err = st.Store.Identity(context.Background(), &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Groups, qt.DeepEquals, []string{"engineering", "webhook-group"})
+
+	// A failing webhook causes the login to fail.
+	fail = true
+	q = login(c)
+	c.Assert(q.Get("error"), qt.Matches, `cannot resolve groups: cannot query group webhook: unexpected status "500 Internal Server Error"`)
+	c.Assert(q["code"], qt.IsNil)
+}
+
+func TestLoginPolicyGroups(t *testing.T) {
+	c := qt.New(t)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"groups": ["webhook-group"]}`))
+	}))
+	defer webhook.Close()
+
+	sp := candidtest.NewStore().ServerParams()
+	sp.RedirectLoginWhitelist = []string{"https://rp.example.com/callback"}
+	resolver, err := groupwebhook.NewResolver(groupwebhook.Config{
+		URL: webhook.URL,
+	})
+	c.Assert(err, qt.IsNil)
+	sp.GroupWebhook = resolver
+	sp.DefaultGroups = []string{"everyone"}
+	var policyGroups []string
+	sp.LoginPolicy = policyFunc(func(id *store.Identity) *loginpolicy.Decision {
+		policyGroups = id.Groups
+		return &loginpolicy.Decision{Allow: true}
+	})
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"alice": {
+			Password: "alicepassword",
+			Groups:   []string{"engineering"},
+		},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, qt.IsNil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasSuffix(req.URL.Host, ".example.com") {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	v := url.Values{
+		"return_to": {"https://rp.example.com/callback"},
+		"state":     {"123456"},
+	}
+	resp, err := client.Get(srv.URL + "/login-redirect?" + v.Encode())
+	c.Assert(err, qt.IsNil)
+	resp, err = candidtest.SelectInteractiveLogin(candidtest.PostLoginForm("alice", "alicepassword"))(client, resp)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+	u, err := url.Parse(resp.Header.Get("Location"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.Query()["error"], qt.IsNil)
+
+	// The policy sees the groups from the webhook and the default
+	// groups as well as those from the identity provider.
+	c.Assert(policyGroups, qt.DeepEquals, []string{"engineering", "webhook-group", "everyone"})
+}
+
+const (
+	testCodeVerifier      = "dBjftJeZ4CVP-mJ0kZ8Ci0Eoqz9WBA5gBiIcCeQKp4Q"
+	testCodeChallengeS256 = "cCJ2Vc8c_2zB2MUH6jtXnhsknY2UALxnYfUVJki1uJo"
+)
+
+func TestRedirectLoginPKCE(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp.RedirectLoginWhitelist = []string{
+		"https://rp1.example.com/callback",
+		"https://rp2.example.com/callback",
+	}
+	sp.RelyingPartyRules = map[string]idputil.RelyingPartyRule{
+		"rp1.example.com": {
+			RequirePKCE: true,
+		},
+	}
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"bob": {
+			Password: "bobpassword",
+		},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	info := redirect.InteractionInfo{
+		LoginURL:          srv.URL + "/login-redirect",
+		DischargeTokenURL: srv.URL + "/discharge-token",
+	}
+	login := func(c *qt.C, rurl string) *http.Response {
+		jar, err := cookiejar.New(nil)
+		c.Assert(err, qt.IsNil)
+		client := &http.Client{
+			Jar: jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if strings.HasSuffix(req.URL.Host, ".example.com") {
+					return http.ErrUseLastResponse
+				}
+				return nil
+			},
+		}
+		resp, err := client.Get(rurl)
+		c.Assert(err, qt.IsNil)
+		if resp.StatusCode != http.StatusOK {
+			return resp
+		}
+		resp, err = candidtest.SelectInteractiveLogin(candidtest.PostLoginForm("bob", "bobpassword"))(client, resp)
+		c.Assert(err, qt.IsNil)
+		return resp
+	}
+
+	c.Run("successful exchange", func(c *qt.C) {
+		resp := login(c, info.RedirectURLWithCodeChallenge("https://rp2.example.com/callback", "123456", testCodeChallengeS256, "S256"))
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+		state, code, err := redirect.ParseLoginResult(resp.Header.Get("Location"))
+		c.Assert(err, qt.IsNil)
+		c.Assert(state, qt.Equals, "123456")
+		dt, err := info.GetDischargeTokenWithCodeVerifier(context.Background(), "https://rp2.example.com/callback", code, testCodeVerifier)
+		c.Assert(err, qt.IsNil)
+		c.Assert(dt, qt.Not(qt.IsNil))
+	})
+
+	c.Run("verifier mismatch", func(c *qt.C) {
+		resp := login(c, info.RedirectURLWithCodeChallenge("https://rp2.example.com/callback", "123456", testCodeChallengeS256, "S256"))
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+		_, code, err := redirect.ParseLoginResult(resp.Header.Get("Location"))
+		c.Assert(err, qt.IsNil)
+		_, err = info.GetDischargeTokenWithCodeVerifier(context.Background(), "https://rp2.example.com/callback", code, "Wv3yzHcRzAq4PTvmXqWrFn3xKtnjYy0r0zHpPvKmUsY")
+		c.Assert(err, qt.ErrorMatches, `.*code verifier does not match code challenge`)
+		_, err = info.GetDischargeToken(context.Background(), "https://rp2.example.com/callback", code)
+		c.Assert(err, qt.ErrorMatches, `.*code verifier required`)
+		_, err = info.GetDischargeTokenWithCodeVerifier(context.Background(), "https://rp3.example.com/callback", code, testCodeVerifier)
+		c.Assert(err, qt.ErrorMatches, `.*return_to does not match the address the code was issued to`)
+	})
+
+	c.Run("verifier without challenge", func(c *qt.C) {
+		resp := login(c, info.RedirectURL("https://rp2.example.com/callback", "123456"))
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+		_, code, err := redirect.ParseLoginResult(resp.Header.Get("Location"))
+		c.Assert(err, qt.IsNil)
+		_, err = info.GetDischargeTokenWithCodeVerifier(context.Background(), "https://rp2.example.com/callback", code, testCodeVerifier)
+		c.Assert(err, qt.ErrorMatches, `.*code verifier given but the code was issued without a code challenge`)
+	})
+
+	c.Run("PKCE required", func(c *qt.C) {
+		resp := login(c, info.RedirectURL("https://rp1.example.com/callback", "123456"))
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+
+		resp = login(c, info.RedirectURLWithCodeChallenge("https://rp1.example.com/callback", "123456", testCodeVerifier, "plain"))
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+		_, code, err := redirect.ParseLoginResult(resp.Header.Get("Location"))
+		c.Assert(err, qt.IsNil)
+		_, err = info.GetDischargeTokenWithCodeVerifier(context.Background(), "https://rp1.example.com/callback", code, testCodeVerifier)
+		c.Assert(err, qt.IsNil)
+	})
+}
+
+func TestAnonymousSessionUpgrade(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp.AnonymousSessionLifetime = time.Hour
+	sp.RedirectLoginWhitelist = []string{
+		"https://rp.example.com/callback",
+	}
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"bob": {
+			Password: "bobpassword",
+		},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	info := redirect.InteractionInfo{
+		LoginURL:          srv.URL + "/login-redirect",
+		DischargeTokenURL: srv.URL + "/discharge-token",
+	}
+
+	// Start an anonymous session.
+	resp, err := http.Post(srv.URL+"/anonymous-session", "", nil)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	var session struct {
+		Macaroon  *bakery.Macaroon `json:"macaroon"`
+		SessionID string           `json:"session-id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&session)
+	c.Assert(err, qt.IsNil)
+	c.Assert(session.SessionID, qt.Not(qt.Equals), "")
+	anonymous := macaroon.Slice{session.Macaroon.M()}
+	declared := checkers.InferDeclared(auth.Namespace, anonymous)
+	c.Assert(candidclient.DeclaredSessionID(declared), qt.Equals, session.SessionID)
+
+	// The anonymous session macaroon does not identify a user.
+	c.Assert(declared["username"], qt.Equals, "")
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, qt.IsNil)
+	bclient := httpbakery.NewClient()
+	err = httpbakery.SetCookie(bclient.Jar, u, auth.Namespace, anonymous)
+	c.Assert(err, qt.IsNil)
+	client, err := candidclient.New(candidclient.NewParams{
+		BaseURL: srv.URL,
+		Client:  bclient,
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = client.WhoAmI(context.Background(), &params.WhoAmIRequest{})
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	login := func(c *qt.C, rurl string) *http.Response {
+		jar, err := cookiejar.New(nil)
+		c.Assert(err, qt.IsNil)
+		client := &http.Client{
+			Jar: jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if strings.HasSuffix(req.URL.Host, ".example.com") {
+					return http.ErrUseLastResponse
+				}
+				return nil
+			},
+		}
+		resp, err := client.Get(rurl)
+		c.Assert(err, qt.IsNil)
+		if resp.StatusCode != http.StatusOK {
+			return resp
+		}
+		resp, err = candidtest.SelectInteractiveLogin(candidtest.PostLoginForm("bob", "bobpassword"))(client, resp)
+		c.Assert(err, qt.IsNil)
+		return resp
+	}
+
+	c.Run("upgrade", func(c *qt.C) {
+		b, err := anonymous.MarshalBinary()
+		c.Assert(err, qt.IsNil)
+		rurl := info.RedirectURL("https://rp.example.com/callback", "123456") + "&anonymous_session=" + base64.RawURLEncoding.EncodeToString(b)
+		resp := login(c, rurl)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+		_, code, err := redirect.ParseLoginResult(resp.Header.Get("Location"))
+		c.Assert(err, qt.IsNil)
+		dt, err := info.GetDischargeToken(context.Background(), "https://rp.example.com/callback", code)
+		c.Assert(err, qt.IsNil)
+		var m macaroon.Macaroon
+		err = m.UnmarshalBinary(dt.Value)
+		c.Assert(err, qt.IsNil)
+		ms := macaroon.Slice{&m}
+		declared := checkers.InferDeclared(auth.Namespace, ms)
+		c.Assert(declared["username"], qt.Equals, "bob")
+		c.Assert(candidclient.DeclaredSessionID(declared), qt.Equals, session.SessionID)
+	})
+
+	c.Run("declared session ID ignored", func(c *qt.C) {
+		forged := macaroon.Slice{anonymous[0].Clone()}
+		err := forged[0].AddFirstPartyCaveat([]byte(candidclient.SessionDeclaration("forged").Condition))
+		c.Assert(err, qt.IsNil)
+		b, err := forged.MarshalBinary()
+		c.Assert(err, qt.IsNil)
+		rurl := info.RedirectURL("https://rp.example.com/callback", "123456") + "&anonymous_session=" + base64.RawURLEncoding.EncodeToString(b)
+		resp := login(c, rurl)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+		_, code, err := redirect.ParseLoginResult(resp.Header.Get("Location"))
+		c.Assert(err, qt.IsNil)
+		dt, err := info.GetDischargeToken(context.Background(), "https://rp.example.com/callback", code)
+		c.Assert(err, qt.IsNil)
+		var m macaroon.Macaroon
+		err = m.UnmarshalBinary(dt.Value)
+		c.Assert(err, qt.IsNil)
+		declared := checkers.InferDeclared(auth.Namespace, macaroon.Slice{&m})
+		c.Assert(candidclient.DeclaredSessionID(declared), qt.Equals, session.SessionID)
+	})
+
+	c.Run("login without session", func(c *qt.C) {
+		resp := login(c, info.RedirectURL("https://rp.example.com/callback", "123456"))
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+		_, code, err := redirect.ParseLoginResult(resp.Header.Get("Location"))
+		c.Assert(err, qt.IsNil)
+		dt, err := info.GetDischargeToken(context.Background(), "https://rp.example.com/callback", code)
+		c.Assert(err, qt.IsNil)
+		var m macaroon.Macaroon
+		err = m.UnmarshalBinary(dt.Value)
+		c.Assert(err, qt.IsNil)
+		declared := checkers.InferDeclared(auth.Namespace, macaroon.Slice{&m})
+		c.Assert(candidclient.DeclaredSessionID(declared), qt.Equals, "")
+	})
+
+	c.Run("invalid anonymous session", func(c *qt.C) {
+		rurl := info.RedirectURL("https://rp.example.com/callback", "123456") + "&anonymous_session=" + base64.RawURLEncoding.EncodeToString([]byte("not a macaroon"))
+		resp := login(c, rurl)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+	})
+}
+
+// userAgentTransport is an http.RoundTripper that sets the User-Agent
+// header of every request.
+type userAgentTransport struct {
+	userAgent *string
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req1 := *req
+	req1.Header = make(http.Header)
+	for k, v := range req.Header {
+		req1.Header[k] = v
+	}
+	req1.Header.Set("User-Agent", *t.userAgent)
+	return http.DefaultTransport.RoundTrip(&req1)
+}
+
+func TestDischargeBindUserAgent(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp.BindUserAgent = true
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"test": {Password: "password"},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	logins := 0
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: func(u *url.URL) error {
+			logins++
+			return candidtest.PasswordLogin(c, "test", "password")(u)
+		},
+	})
+	userAgent := "Mozilla/5.0 (X11; Linux x86_64; rv:78.0) Gecko/20100101 Firefox/78.0"
+	client.Client.Transport = userAgentTransport{&userAgent}
+
+	ms, err := dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	dc.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+	c.Assert(logins, qt.Equals, 1)
+
+	// The same user agent can reuse the login.
+	ms, err = dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	dc.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+	c.Assert(logins, qt.Equals, 1)
+
+	// Upgrading the user agent does not require a new login.
+	userAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0"
+	ms, err = dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	dc.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+	c.Assert(logins, qt.Equals, 1)
+
+	// A different user agent presenting the same credentials is
+	// asked to log in again.
+	userAgent = "curl/7.68.0"
+	ms, err = dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	dc.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+	c.Assert(logins, qt.Equals, 2)
+}
+
+func TestDeletedUserIgnoresForgedMacaroons(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	st := candidtest.NewStore()
+	newOven := func(rks bakery.RootKeyStore) *bakery.Oven {
+		return bakery.NewOven(bakery.OvenParams{
+			Namespace: auth.Namespace,
+			RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+				return rks
+			},
+		})
+	}
+	hp := identity.HandlerParams{
+		ServerParams: st.ServerParams(),
+		Oven:         newOven(st.BakeryRootKeyStore),
+	}
+	ctx := context.Background()
+	mint := func(oven *bakery.Oven, username string) macaroon.Slice {
+		m, err := oven.NewMacaroon(ctx, bakery.LatestVersion, []checkers.Caveat{
+			candidclient.UserDeclaration(username),
+		}, identchecker.LoginOp)
+		c.Assert(err, qt.IsNil)
+		return macaroon.Slice{m.M()}
+	}
+
+	// A macaroon minted by the service for a user that does not
+	// exist reports the user.
+	c.Assert(discharger.DeletedUser(hp, ctx, []macaroon.Slice{mint(hp.Oven, "bob")}), qt.Equals, "bob")
+
+	// A forged macaroon gives no information about whether the
+	// declared user exists.
+	forger := newOven(bakery.NewMemRootKeyStore())
+	c.Assert(discharger.DeletedUser(hp, ctx, []macaroon.Slice{mint(forger, "bob")}), qt.Equals, "")
+}
@@ -4,16 +4,28 @@
 package discharger
 
 import (
+	"context"
+	"net/http"
+
 	"github.com/juju/simplekv"
+	"gopkg.in/macaroon.v2"
 
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/internal/discharger/internal"
 	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/store"
 )
 
 var NewIDPHandler = newIDPHandler
 
-type LoginInfo loginInfo
+type (
+	IDPStoreParams idpStoreParams
+	LoginInfo      loginInfo
+)
+
+func NewIDPStore(st store.Store, p IDPStoreParams) store.Store {
+	return newIDPStore(st, idpStoreParams(p))
+}
 
 func NewVisitCompleter(params identity.HandlerParams, store simplekv.Store) idp.VisitCompleter {
 	return &visitCompleter{
@@ -21,5 +33,18 @@ func NewVisitCompleter(params identity.HandlerParams, store simplekv.Store) idp.
 		dischargeTokenCreator: &dischargeTokenCreator{params: params},
 		dischargeTokenStore:   internal.NewDischargeTokenStore(store),
 		place:                 &place{params.MeetingPlace},
+		onboardingStore:       store,
 	}
 }
+
+func DeletedUser(params identity.HandlerParams, ctx context.Context, mss []macaroon.Slice) string {
+	return (&thirdPartyCaveatChecker{params: params}).deletedUser(ctx, mss)
+}
+
+func CompleteOnboarding(vc idp.VisitCompleter, ctx context.Context, key string) error {
+	return vc.(*visitCompleter).completeOnboarding(ctx, key)
+}
+
+func Onboarded(vc idp.VisitCompleter, ctx context.Context, w http.ResponseWriter, req *http.Request, key, onboardingError string) {
+	vc.(*visitCompleter).onboarded(ctx, w, req, key, onboardingError)
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/internal/qrcode"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// A handoffState holds the state of a login that may be continued on
+// another device.
+type handoffState struct {
+	// DischargeID holds the discharge ID of the waiting login.
+	DischargeID string
+
+	// Expires holds the time after which the hand-off can no longer
+	// be used.
+	Expires time.Time
+}
+
+// newHandoff stores a hand-off for the login with the given discharge
+// ID and returns its key.
+func (h *handler) newHandoff(ctx context.Context, dischargeID string) (string, error) {
+	key, err := h.params.TokenGenerator.Generate()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	st := handoffState{
+		DischargeID: dischargeID,
+		Expires:     time.Now().Add(h.params.LoginHandoffTimeout),
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		// This should be impossible.
+		panic(err)
+	}
+	if err := h.params.handoffStore.Set(ctx, key, b, st.Expires); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return key, nil
+}
+
+// handoff retrieves the hand-off stored with the given key. If claim is
+// true the hand-off is also marked as used, so that it can only be
+// claimed once. If there is no such hand-off, or it has expired or
+// already been claimed, an error with a cause of store.ErrNotFound is
+// returned.
+func (h *handler) handoff(ctx context.Context, key string, claim bool) (*handoffState, error) {
+	if h.params.LoginHandoffTimeout <= 0 {
+		return nil, errgo.WithCausef(nil, store.ErrNotFound, "login hand-off not enabled")
+	}
+	var st handoffState
+	unmarshal := func(b []byte) error {
+		if len(b) == 0 {
+			return errgo.WithCausef(nil, store.ErrNotFound, "")
+		}
+		return errgo.Mask(json.Unmarshal(b, &st))
+	}
+	var err error
+	if claim {
+		err = h.params.handoffStore.Update(ctx, key, time.Now(), func(old []byte) ([]byte, error) {
+			if err := unmarshal(old); err != nil {
+				return nil, errgo.Mask(err, errgo.Is(store.ErrNotFound))
+			}
+			return []byte{}, nil
+		})
+	} else {
+		var b []byte
+		b, err = h.params.handoffStore.Get(ctx, key)
+		if err == nil {
+			err = unmarshal(b)
+		}
+	}
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			err = errgo.WithCausef(err, store.ErrNotFound, "")
+		}
+		return nil, errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	if st.Expires.Before(time.Now()) {
+		return nil, errgo.WithCausef(nil, store.ErrNotFound, "")
+	}
+	return &st, nil
+}
+
+// handoffURL returns the URL that continues the login with the given
+// hand-off key.
+func (h *handler) handoffURL(key string) string {
+	return idputil.LocationURL(h.params.Location, "/login-handoff?"+url.Values{"id": {key}}.Encode())
+}
+
+// loginHandoffRequest is the request made when a login is continued on
+// another device.
+type loginHandoffRequest struct {
+	httprequest.Route `httprequest:"GET /login-handoff"`
+
+	// ID holds the key of the stored hand-off.
+	ID string `httprequest:"id,form"`
+}
+
+// LoginHandoff handles a login that was started on one device being
+// continued on another, typically by scanning a QR code. The login
+// proceeds as if it had been started on this device, and when it
+// completes the client waiting on the original device is released.
+// Each hand-off can only be used once, the login it starts cannot be
+// handed off again, and it must complete before the hand-off would have
+// expired.
+func (h *handler) LoginHandoff(p httprequest.Params, req *loginHandoffRequest) error {
+	st, err := h.handoff(p.Context, req.ID, true)
+	if err != nil {
+		logger.Infof("cannot use login hand-off: %s", err)
+		idputil.BadRequestf(p.Response, "invalid or expired login")
+		return nil
+	}
+	return errgo.Mask(h.startLogin(p, &loginRequest{DischargeID: st.DischargeID}, st.Expires), errgo.Any)
+}
+
+// loginHandoffQRCodeRequest is a request for the QR code image of a
+// login hand-off.
+type loginHandoffQRCodeRequest struct {
+	httprequest.Route `httprequest:"GET /login-handoff/qrcode"`
+
+	// ID holds the key of the stored hand-off.
+	ID string `httprequest:"id,form"`
+}
+
+// LoginHandoffQRCode serves an SVG image of a QR code that encodes the
+// URL used to continue a login on another device.
+func (h *handler) LoginHandoffQRCode(p httprequest.Params, req *loginHandoffQRCodeRequest) error {
+	if _, err := h.handoff(p.Context, req.ID, false); err != nil {
+		logger.Infof("cannot find login hand-off: %s", err)
+		return errgo.WithCausef(nil, params.ErrNotFound, "login hand-off not found")
+	}
+	code, err := qrcode.Encode(h.handoffURL(req.ID))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	p.Response.Header().Set("Content-Type", "image/svg+xml")
+	p.Response.Header().Set("Cache-Control", "no-store")
+	p.Response.WriteHeader(http.StatusOK)
+	p.Response.Write(code.SVG(4))
+	return nil
+}
@@ -9,8 +9,10 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/juju/simplekv"
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/net/trace"
 	"gopkg.in/errgo.v1"
@@ -21,11 +23,14 @@ import (
 	macaroon "gopkg.in/macaroon.v2"
 
 	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/events"
 	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/idp/idputil/secret"
 	"github.com/canonical/candid/internal/auth"
 	"github.com/canonical/candid/internal/discharger/internal"
 	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/internal/monitoring"
 	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
 )
@@ -35,24 +40,49 @@ type initIDPParams struct {
 	Codec                 *secret.Codec
 	DischargeTokenCreator *dischargeTokenCreator
 	VisitCompleter        *visitCompleter
+	PendingRegistrations  *idputil.PendingLimiter
 }
 
 func initIDPs(ctx context.Context, params initIDPParams) error {
+	var usernameFormat *idputil.UsernameFormat
+	if params.UsernameFormat != "" {
+		var err error
+		usernameFormat, err = idputil.NewUsernameFormat(params.UsernameFormat)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
 	for _, ip := range params.IdentityProviders {
 		kvStore, err := params.ProviderDataStore.KeyValueStore(ctx, ip.Name())
 		if err != nil {
 			return errgo.Mask(err)
 		}
 		if err := ip.Init(ctx, idp.InitParams{
-			Store:                 params.Store,
+			Store: newIDPStore(params.Store, idpStoreParams{
+				UsernameFallback:   params.EmptyUsernameFallback,
+				UsernameCasePolicy: params.UsernameCasePolicy,
+				UsernameFormat:     usernameFormat,
+				DefaultGroups:      params.DefaultGroups,
+				EmailValidation:    params.EmailValidation,
+			}),
 			KeyValueStore:         kvStore,
 			Oven:                  params.Oven,
 			Codec:                 params.Codec,
 			Location:              params.Location,
-			URLPrefix:             params.Location + "/login/" + ip.Name(),
+			URLPrefix:             idputil.LocationURL(params.Location, "/login/"+ip.Name()),
 			DischargeTokenCreator: params.DischargeTokenCreator,
 			VisitCompleter:        params.VisitCompleter,
 			Template:              params.Template,
+			PendingRegistrations:  params.PendingRegistrations,
+			FailedLoginDelay: idputil.NewFailedLoginDelay(kvStore, idputil.FailedLoginDelayParams{
+				Delay:       params.FailedLoginDelay,
+				MaxDelay:    params.MaxFailedLoginDelay,
+				DedupWindow: params.FailedLoginDedupWindow,
+			}),
+			CookieNamePrefix: idputil.IDPCookieNamePrefix(ip.Name()),
+			CookiePath:       idputil.IDPCookiePath(ip.Name()),
+			TokenGenerator:   params.TokenGenerator,
+			TrustedProxies:   params.TrustedProxies,
 		}); err != nil {
 			return errgo.Mask(err)
 		}
@@ -60,41 +90,342 @@ func initIDPs(ctx context.Context, params initIDPParams) error {
 	return nil
 }
 
-func newIDPHandler(params identity.HandlerParams, idp idp.IdentityProvider) httprouter.Handle {
+// An idpStore is the store.Store given to identity providers. It
+// validates identities before they are written to the underlying
+// store, and adds any default groups to newly created identities.
+type idpStore struct {
+	store.Store
+	p idpStoreParams
+}
+
+// idpStoreParams holds the parameters for an idpStore.
+type idpStoreParams struct {
+	// UsernameFallback holds the method used to derive a username
+	// when an identity provider returns an empty one.
+	UsernameFallback string
+
+	// DefaultGroups holds the groups added to newly created
+	// identities.
+	DefaultGroups []string
+
+	// EmailValidation holds the validation applied to email
+	// addresses.
+	EmailValidation store.EmailValidation
+
+	// UsernameCasePolicy holds the policy used to match usernames
+	// that differ only in case. See ServerParams.UsernameCasePolicy.
+	UsernameCasePolicy string
+
+	// UsernameFormat, if set, holds the format used to derive the
+	// usernames of new identities.
+	UsernameFormat *idputil.UsernameFormat
+}
+
+// displayUsernameKey holds the provider-info key that records the
+// username, as cased by the identity provider, of the most recent
+// login when usernames are matched case-insensitively.
+const displayUsernameKey = "display-username"
+
+func newIDPStore(st store.Store, p idpStoreParams) store.Store {
+	return &idpStore{
+		Store: st,
+		p:     p,
+	}
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity by checking that
+// any username being set is not empty. If the username is empty and a
+// fallback has been configured then that is used to derive the
+// username before it is written. Any email address being set is
+// normalized and validated; an invalid address fails the login when
+// validation is strict and is otherwise not stored. If the identity is
+// being created then the default groups are added to any groups the
+// identity provider supplied.
+func (s *idpStore) UpdateIdentity(ctx context.Context, id *store.Identity, update store.Update) error {
+	if update[store.Email] == store.Set {
+		email, err := s.p.EmailValidation.Check(id.Email)
+		if err != nil {
+			if s.p.EmailValidation == store.EmailStrict {
+				return errgo.WithCausef(err, params.ErrBadRequest, "login failed")
+			}
+			// In lenient mode a malformed address is not
+			// stored, but the login is allowed to continue.
+			logger.Warningf("ignoring email address for %q: %s", id.ProviderID, err)
+			update[store.Email] = store.NoUpdate
+		}
+		id.Email = email
+	}
+	if update[store.Username] == store.Set && isEmptyUsername(id.Username) {
+		username := s.fallbackUsername(id)
+		if username == "" {
+			return errgo.WithCausef(nil, params.ErrUnauthorized, "login failed: identity provider returned an empty username")
+		}
+		logger.Infof("identity provider returned empty username for %q, using %q", id.ProviderID, username)
+		id.Username = username
+	}
+	if s.p.UsernameFormat != nil && id.ProviderID != "" && update[store.Username] == store.Set {
+		if err := s.formatUsername(ctx, id); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrAlreadyExists))
+		}
+	}
+	if s.p.UsernameCasePolicy == "insensitive" && id.ProviderID != "" && update[store.Username] == store.Set {
+		if err := s.matchUsernameCase(ctx, id, &update); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if len(s.p.DefaultGroups) > 0 && id.ProviderID != "" && update[store.Username] == store.Set {
+		err := s.Store.Identity(ctx, &store.Identity{ProviderID: id.ProviderID})
+		switch errgo.Cause(err) {
+		case store.ErrNotFound:
+			if update[store.Groups] != store.Set && update[store.Groups] != store.Push {
+				id.Groups = nil
+			}
+			id.Groups = identity.AddDefaultGroups(id.Groups, s.p.DefaultGroups)
+			update[store.Groups] = store.Set
+		case nil:
+		default:
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(s.Store.UpdateIdentity(ctx, id, update), errgo.Any)
+}
+
+// formatUsername sets the username of the given identity using the
+// configured username format. The format is only applied when the
+// identity is created, existing identities keep their stored username.
+// If the formatted username is already in use an error with a cause of
+// params.ErrAlreadyExists is returned.
+func (s *idpStore) formatUsername(ctx context.Context, id *store.Identity) error {
+	existing := store.Identity{ProviderID: id.ProviderID}
+	err := s.Store.Identity(ctx, &existing)
+	switch errgo.Cause(err) {
+	case nil:
+		id.Username = existing.Username
+		return nil
+	case store.ErrNotFound:
+	default:
+		return errgo.Mask(err)
+	}
+	username, err := s.p.UsernameFormat.Format(id)
+	if err != nil {
+		return errgo.WithCausef(err, params.ErrUnauthorized, "login failed")
+	}
+	err = s.Store.Identity(ctx, &store.Identity{Username: username})
+	switch errgo.Cause(err) {
+	case nil:
+		return errgo.WithCausef(nil, params.ErrAlreadyExists, "login failed: username %q is already in use", username)
+	case store.ErrNotFound:
+	default:
+		return errgo.Mask(err)
+	}
+	id.Username = username
+	return nil
+}
+
+// matchUsernameCase matches the username of the given identity
+// case-insensitively against the existing identities. An existing
+// identity only matches if its provider ID is the same as that of the
+// given identity, ignoring case, so a different user of the same
+// identity provider whose username differs only in case is never
+// matched. If there is a match the existing identity is updated and
+// its username is kept, so that it does not change with the case
+// returned by the identity provider. New identities are created with a
+// lower case username. The username as returned by the identity
+// provider is recorded in the provider-info.
+func (s *idpStore) matchUsernameCase(ctx context.Context, id *store.Identity, update *store.Update) error {
+	display := id.Username
+	existing := store.Identity{ProviderID: id.ProviderID}
+	err := s.Store.Identity(ctx, &existing)
+	switch errgo.Cause(err) {
+	case nil:
+		id.Username = existing.Username
+	case store.ErrNotFound:
+		existing = store.Identity{Username: strings.ToLower(id.Username)}
+		err := s.Store.Identity(ctx, &existing)
+		switch {
+		case err == nil && strings.EqualFold(string(existing.ProviderID), string(id.ProviderID)):
+			logger.Infof("matched %q to existing identity %q", id.ProviderID, existing.ProviderID)
+			id.ProviderID = existing.ProviderID
+			id.Username = existing.Username
+		case err == nil || errgo.Cause(err) == store.ErrNotFound:
+			// Either there is no identity with the username or
+			// it belongs to another user, in which case the
+			// update will fail as the username is already in
+			// use.
+			id.Username = strings.ToLower(id.Username)
+		default:
+			return errgo.Mask(err)
+		}
+	default:
+		return errgo.Mask(err)
+	}
+	if update[store.ProviderInfo] == store.NoUpdate || update[store.ProviderInfo] == store.Set {
+		if id.ProviderInfo == nil {
+			id.ProviderInfo = make(map[string][]string)
+		}
+		id.ProviderInfo[displayUsernameKey] = []string{display}
+		update[store.ProviderInfo] = store.Set
+	}
+	return nil
+}
+
+// fallbackUsername determines a username for the given identity using
+// the configured fallback. If no username can be determined then an
+// empty string is returned.
+func (s *idpStore) fallbackUsername(id *store.Identity) string {
+	switch s.p.UsernameFallback {
+	case "email":
+		i := strings.LastIndex(id.Email, "@")
+		if i <= 0 {
+			return ""
+		}
+		name := strings.TrimSpace(id.Email[:i])
+		if name == "" {
+			return ""
+		}
+		// Retain any domain that the identity provider added.
+		if j := strings.Index(id.Username, "@"); j >= 0 {
+			name += id.Username[j:]
+		}
+		return name
+	}
+	return ""
+}
+
+// isEmptyUsername determines whether the given username is empty. A
+// username is considered empty if its name part (before any @domain)
+// contains only whitespace.
+func isEmptyUsername(username string) bool {
+	if i := strings.Index(username, "@"); i >= 0 {
+		username = username[:i]
+	}
+	return strings.TrimSpace(username) == ""
+}
+
+func newIDPHandler(params identity.HandlerParams, codec *secret.Codec, idp idp.IdentityProvider) httprouter.Handle {
+	limiter := newLoginLimiter(idp.Name(), params.MaxConcurrentLogins)
 	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
 		t := trace.New("identity.internal.v1.idp", idp.Name())
 		defer t.Finish()
 		ctx := trace.NewContext(context.Background(), t)
+		if err := params.MaintenanceSchedule.CheckLogin(time.Now()); err != nil {
+			identity.WriteError(ctx, w, err)
+			return
+		}
+		if err := params.IDPStatus.CheckEnabled(ctx, idp.Name()); err != nil {
+			identity.WriteError(ctx, w, err)
+			return
+		}
+		req.ParseForm()
+		if err := checkLoginRate(ctx, params.LoginRateLimiter, params.LoginClientRateLimiter, params.TrustedProxies, idp.Name(), req); err != nil {
+			identity.WriteError(ctx, w, err)
+			return
+		}
+		if err := limiter.acquire(); err != nil {
+			identity.WriteError(ctx, w, err)
+			return
+		}
+		// The slot is released early if a failed login is delayed.
+		var once sync.Once
+		release := func() { once.Do(limiter.release) }
+		defer release()
+		ctx = idputil.ContextWithLoginSlot(ctx, release)
+		ctx = contextWithIDP(ctx, idp.Name())
+		if len(params.DeviceSessionLifetimes) > 0 {
+			ctx = contextWithDeviceClass(ctx, params.DeviceClassifier.Classify(req))
+		}
 		ctx, close := params.Store.Context(ctx)
 		defer close()
 		ctx, close = params.MeetingStore.Context(ctx)
 		defer close()
 		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/login/"+idp.Name())
-		req.ParseForm()
+		var ls idputil.LoginState
+		if err := codec.Cookie(req, idputil.LoginStateCookieName(idputil.IDPCookieNamePrefix(idp.Name())), req.Form.Get("state"), &ls); err == nil {
+			// Any error will be reported by the identity
+			// provider if it needs the login state.
+			ctx = idputil.ContextWithCodeChallenge(ctx, ls.CodeChallenge)
+			ctx = idputil.ContextWithSessionID(ctx, ls.SessionID)
+			ctx = contextWithWaitID(ctx, ls.WaitID)
+		}
 		idp.Handle(ctx, w, req)
 	}
 }
 
+type idpKey struct{}
+
+// contextWithIDP returns a context recording that it is being used to
+// handle a request for the named identity provider.
+func contextWithIDP(ctx context.Context, idp string) context.Context {
+	return context.WithValue(ctx, idpKey{}, idp)
+}
+
+// idpFromContext returns the name of the identity provider recorded in
+// the given context, if any.
+func idpFromContext(ctx context.Context) string {
+	idp, _ := ctx.Value(idpKey{}).(string)
+	return idp
+}
+
+type waitIDKey struct{}
+
+// contextWithWaitID returns a context recording the ID of the discharge
+// wait that the login being handled completes.
+func contextWithWaitID(ctx context.Context, waitID string) context.Context {
+	if waitID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, waitIDKey{}, waitID)
+}
+
+// waitIDFromContext returns the ID of the discharge wait recorded in
+// the given context, if any.
+func waitIDFromContext(ctx context.Context) string {
+	waitID, _ := ctx.Value(waitIDKey{}).(string)
+	return waitID
+}
+
 type dischargeTokenCreator struct {
 	params identity.HandlerParams
 }
 
 func (d *dischargeTokenCreator) DischargeToken(ctx context.Context, id *store.Identity) (*httpbakery.DischargeToken, error) {
+	dt, _, err := d.dischargeToken(ctx, id)
+	return dt, errgo.Mask(err)
+}
+
+// dischargeToken creates a discharge token for the given identity. The
+// time the identity macaroon in the token expires is also returned.
+func (d *dischargeTokenCreator) dischargeToken(ctx context.Context, id *store.Identity) (*httpbakery.DischargeToken, time.Time, error) {
+	authTime, expiry := d.lifetime(ctx, time.Now())
+	caveats := []checkers.Caveat{
+		checkers.TimeBeforeCaveat(expiry),
+		candidclient.UserDeclaration(id.Username),
+		candidclient.AuthTimeDeclaration(authTime),
+	}
+	ops := []bakery.Op{
+		identchecker.LoginOp,
+		auth.AuthTimeOp(authTime),
+	}
+	if idp := idpFromContext(ctx); idp != "" {
+		caveats = append(caveats, candidclient.LoginIDPDeclaration(idp))
+		ops = append(ops, auth.LoginIDPOp(idp))
+	}
+	if sid := idputil.SessionIDFromContext(ctx); sid != "" {
+		caveats = append(caveats, candidclient.SessionDeclaration(sid))
+		ops = append(ops, auth.SessionIDOp(sid))
+	}
 	m, err := d.params.Oven.NewMacaroon(
 		ctx,
-		bakery.LatestVersion,
-		[]checkers.Caveat{
-			checkers.TimeBeforeCaveat(time.Now().Add(d.params.DischargeTokenTimeout)),
-			candidclient.UserDeclaration(id.Username),
-		},
-		identchecker.LoginOp,
+		d.params.MacaroonVersions().MaxVersion(),
+		caveats,
+		ops...,
 	)
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, time.Time{}, errgo.Mask(err)
 	}
 	v, err := m.M().MarshalBinary()
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, time.Time{}, errgo.Mask(err)
 	}
 	id.LastLogin = time.Now()
 	if err := d.params.Store.UpdateIdentity(ctx, id, store.Update{
@@ -105,7 +436,7 @@ func (d *dischargeTokenCreator) DischargeToken(ctx context.Context, id *store.Id
 	return &httpbakery.DischargeToken{
 		Kind:  "macaroon",
 		Value: v,
-	}, nil
+	}, expiry, nil
 }
 
 // A visitCompleter is an implementation of idp.VisitCompleter.
@@ -114,15 +445,44 @@ type visitCompleter struct {
 	dischargeTokenCreator *dischargeTokenCreator
 	dischargeTokenStore   *internal.DischargeTokenStore
 	place                 *place
+	onboardingStore       simplekv.Store
 }
 
 // Success implements idp.VisitCompleter.Success.
 func (c *visitCompleter) Success(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, id *store.Identity) {
-	dt, err := c.dischargeTokenCreator.DischargeToken(ctx, id)
+	if err := c.checkLogin(ctx, req, id); err != nil {
+		c.Failure(ctx, w, req, dischargeID, errgo.Mask(err, errgo.Any))
+		return
+	}
+	if needs, err := c.needsOnboarding(ctx, id); err != nil {
+		c.Failure(ctx, w, req, dischargeID, errgo.Notef(err, "cannot check onboarding"))
+		return
+	} else if needs {
+		if err := c.startOnboarding(ctx, w, req, id, onboardingState{DischargeID: dischargeID}); err != nil {
+			c.Failure(ctx, w, req, dischargeID, errgo.Notef(err, "cannot start onboarding"))
+		}
+		return
+	}
+	c.success(ctx, w, req, dischargeID, id)
+}
+
+// success completes a successful login for the given identity.
+func (c *visitCompleter) success(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, id *store.Identity) {
+	if err := c.checkOnboarded(ctx, id); err != nil {
+		c.Failure(ctx, w, req, dischargeID, errgo.Mask(err, errgo.Is(params.ErrForbidden)))
+		return
+	}
+	dt, expires, err := c.dischargeTokenCreator.dischargeToken(ctx, id)
 	if err != nil {
 		c.Failure(ctx, w, req, dischargeID, errgo.Mask(err))
 		return
 	}
+	c.auditSuccess(ctx, req, dischargeID, id, expires)
+	c.sendLoginEvent(id)
+	monitoring.LoginSucceeded(id.ProviderID.Provider(), id.Username)
+	if c.params.RememberLastIDP {
+		setLastIDPCookie(w, id.ProviderID.Provider())
+	}
 	c.successToken(ctx, w, req, dischargeID, dt, id)
 }
 
@@ -155,6 +515,14 @@ func (c *visitCompleter) successToken(ctx context.Context, w http.ResponseWriter
 
 // Failure implements idp.VisitCompleter.Failure.
 func (c *visitCompleter) Failure(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, err error) {
+	c.auditFailure(ctx, req, dischargeID, err)
+	c.failure(ctx, w, req, dischargeID, err)
+}
+
+// failure completes a failed login without recording it in the audit
+// log. It is used when the failure has already been recorded.
+func (c *visitCompleter) failure(ctx context.Context, w http.ResponseWriter, req *http.Request, dischargeID string, err error) {
+	monitoring.LoginFailed(idpFromContext(ctx), err)
 	_, bakeryErr := httpbakery.ErrorToResponse(ctx, err)
 	if dischargeID != "" {
 		c.place.Done(ctx, dischargeID, &loginInfo{
@@ -166,19 +534,55 @@ func (c *visitCompleter) Failure(ctx context.Context, w http.ResponseWriter, req
 
 // RedirectSuccess implements idp.VisitCompleter.RedirectSuccess.
 func (c *visitCompleter) RedirectSuccess(ctx context.Context, w http.ResponseWriter, req *http.Request, returnTo, state string, id *store.Identity) {
-	dt, err := c.dischargeTokenCreator.DischargeToken(ctx, id)
+	if err := c.checkLogin(ctx, req, id); err != nil {
+		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Mask(err, errgo.Any))
+		return
+	}
+	if needs, err := c.needsOnboarding(ctx, id); err != nil {
+		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Notef(err, "cannot check onboarding"))
+		return
+	} else if needs {
+		st := onboardingState{
+			ReturnTo: returnTo,
+			State:    state,
+		}
+		if err := c.startOnboarding(ctx, w, req, id, st); err != nil {
+			c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Notef(err, "cannot start onboarding"))
+		}
+		return
+	}
+	c.redirectSuccess(ctx, w, req, returnTo, state, id)
+}
+
+// redirectSuccess completes a successful redirect based login for the
+// given identity.
+func (c *visitCompleter) redirectSuccess(ctx context.Context, w http.ResponseWriter, req *http.Request, returnTo, state string, id *store.Identity) {
+	if err := c.checkRelyingParty(ctx, returnTo, id); err != nil {
+		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Mask(err, errgo.Is(params.ErrAccessDenied), errgo.Is(params.ErrBadRequest)))
+		return
+	}
+	if err := c.checkOnboarded(ctx, id); err != nil {
+		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Mask(err, errgo.Is(params.ErrForbidden)))
+		return
+	}
+	dt, expires, err := c.dischargeTokenCreator.dischargeToken(ctx, id)
 	if err != nil {
 		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Mask(err))
 		return
 	}
-	code, err := c.dischargeTokenStore.Put(ctx, dt, time.Now().Add(10*time.Minute))
+	c.auditSuccess(ctx, req, waitIDFromContext(ctx), id, expires)
+	c.sendLoginEvent(id)
+	monitoring.LoginSucceeded(id.ProviderID.Provider(), id.Username)
+	if c.params.RememberLastIDP {
+		setLastIDPCookie(w, id.ProviderID.Provider())
+	}
+	code, err := c.dischargeTokenStore.PutWithCodeChallenge(ctx, dt, idputil.CodeChallengeFromContext(ctx), returnTo, time.Now().Add(10*time.Minute))
 	if err != nil {
 		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Mask(err))
 		return
 	}
-	v := url.Values{
-		"code": {code},
-	}
+	v := c.params.RedirectLoginParams[id.ProviderID.Provider()].Values(ctx, id)
+	v.Set("code", code)
 	if state != "" {
 		v.Set("state", state)
 	}
@@ -190,6 +594,8 @@ func (c *visitCompleter) RedirectSuccess(ctx context.Context, w http.ResponseWri
 
 // RedirectFailure implements idp.VisitCompleter.RedirectFailure.
 func (c *visitCompleter) RedirectFailure(ctx context.Context, w http.ResponseWriter, req *http.Request, returnTo, state string, err error) {
+	c.auditFailure(ctx, req, waitIDFromContext(ctx), err)
+	monitoring.LoginFailed(idpFromContext(ctx), err)
 	v := url.Values{
 		"error": {err.Error()},
 	}
@@ -205,6 +611,173 @@ func (c *visitCompleter) RedirectFailure(ctx context.Context, w http.ResponseWri
 	identity.WriteError(ctx, w, err)
 }
 
+// sendLoginEvent sends a login event for the given identity to the
+// configured event dispatcher, if any.
+func (c *visitCompleter) sendLoginEvent(id *store.Identity) {
+	c.params.EventDispatcher.Dispatch(events.Event{
+		Type:       events.Login,
+		Username:   id.Username,
+		ProviderID: string(id.ProviderID),
+		Data: map[string]string{
+			"idp": id.ProviderID.Provider(),
+		},
+	})
+}
+
+// checkLogin resolves the groups of the given identity and checks that
+// the configured login policy, provisioning requirement and login hours
+// all allow it to complete logging in. It is used by every login,
+// interactive or not, before the discharge token is created.
+func (c *visitCompleter) checkLogin(ctx context.Context, req *http.Request, id *store.Identity) error {
+	if err := c.resolveGroups(ctx, id); err != nil {
+		return errgo.Notef(err, "cannot resolve groups")
+	}
+	if err := c.checkLoginPolicy(ctx, req, id); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := c.checkProvisioned(ctx, id); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := c.checkLoginHours(ctx, id); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return nil
+}
+
+// checkLoginPolicy checks that the configured login policy allows the
+// given identity to complete logging in.
+func (c *visitCompleter) checkLoginPolicy(ctx context.Context, req *http.Request, id *store.Identity) error {
+	if c.params.LoginPolicy == nil {
+		return nil
+	}
+	// The policy is given the groups the user will be a member of
+	// once logged in, including those added by group rules and the
+	// default groups, not only those stored with the identity.
+	pid := *id
+	pid.Groups = identity.AddDefaultGroups(id.Groups, store.RuleGroups(c.params.GroupRules, id))
+	pid.Groups = identity.AddDefaultGroups(pid.Groups, c.params.DefaultGroups)
+	d, err := c.params.LoginPolicy.CheckLogin(ctx, req, &pid)
+	if err != nil {
+		return errgo.Notef(err, "cannot check login policy")
+	}
+	if d.Allow {
+		return nil
+	}
+	if d.Reason == "" {
+		return errgo.WithCausef(nil, params.ErrForbidden, "login denied by policy")
+	}
+	return errgo.WithCausef(nil, params.ErrForbidden, "login denied by policy: %s", d.Reason)
+}
+
+// resolveGroups updates the groups of the given identity with those
+// returned by the configured group webhook, if any. The resolved groups
+// are stored so that they are used when the user's group membership is
+// checked after the login.
+func (c *visitCompleter) resolveGroups(ctx context.Context, id *store.Identity) error {
+	if !c.params.GroupWebhook.AppliesTo(idpFromContext(ctx)) {
+		return nil
+	}
+	groups, err := c.params.GroupWebhook.Groups(ctx, id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	id.Groups = groups
+	if err := c.params.Store.UpdateIdentity(ctx, id, store.Update{
+		store.Groups: store.Set,
+	}); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// checkProvisioned checks that the given identity is a member of at
+// least the configured minimum number of groups. Default groups count
+// towards the minimum even if they have not been stored with the
+// identity.
+func (c *visitCompleter) checkProvisioned(ctx context.Context, id *store.Identity) error {
+	if c.params.MinLoginGroups <= 0 {
+		return nil
+	}
+	aid, err := c.params.Authorizer.Identity(ctx, id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	groups, err := aid.Groups(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	effective := make(map[string]bool)
+	for _, g := range groups {
+		effective[g] = true
+	}
+	for _, g := range c.params.DefaultGroups {
+		effective[g] = true
+	}
+	if len(effective) < c.params.MinLoginGroups {
+		return errgo.WithCausef(nil, params.ErrForbidden, "account not provisioned: user %q is a member of %d groups, at least %d are required", id.Username, len(effective), c.params.MinLoginGroups)
+	}
+	return nil
+}
+
+// checkLoginHours checks that the configured login hours policy allows
+// the given identity to log in now.
+func (c *visitCompleter) checkLoginHours(ctx context.Context, id *store.Identity) error {
+	if c.params.LoginHours == nil {
+		return nil
+	}
+	aid, err := c.params.Authorizer.Identity(ctx, id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	groups, err := aid.Groups(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	groups = append(groups, c.params.DefaultGroups...)
+	return errgo.Mask(c.params.LoginHours.CheckLogin(id, groups, time.Now()), errgo.Is(params.ErrForbidden))
+}
+
+// checkRelyingParty checks that the rule configured for the host of
+// the given returnTo address, if any, allows the given identity to log
+// in, and that the login used PKCE if the rule requires it.
+func (c *visitCompleter) checkRelyingParty(ctx context.Context, returnTo string, id *store.Identity) error {
+	rule, host, ok := relyingPartyRule(c.params.RelyingPartyRules, returnTo)
+	if !ok {
+		return nil
+	}
+	if rule.RequirePKCE && idputil.CodeChallengeFromContext(ctx) == nil {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "%s requires a code_challenge", host)
+	}
+	aid, err := c.params.Authorizer.Identity(ctx, id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	groups, err := aid.Groups(ctx)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !rule.Allow(id, groups) {
+		return errgo.WithCausef(nil, params.ErrAccessDenied, "user %q is not allowed to log in to %s", id.Username, host)
+	}
+	return nil
+}
+
+// relyingPartyRule returns the rule configured for the host of the
+// given returnTo address, if any.
+func relyingPartyRule(rules map[string]idputil.RelyingPartyRule, returnTo string) (rule idputil.RelyingPartyRule, host string, ok bool) {
+	if len(rules) == 0 {
+		return idputil.RelyingPartyRule{}, "", false
+	}
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		// The returnTo address will be rejected when redirecting.
+		return idputil.RelyingPartyRule{}, "", false
+	}
+	host = idputil.RelyingPartyHost(u.Hostname())
+	rule, ok = rules[host]
+	return rule, host, ok
+}
+
 // redirect writes a redirect response addressed the the given returnTo
 // address with the given query parameters. If an error is returned it
 // will be because the returnTo address is invalid and therefore it will
@@ -212,7 +785,7 @@ func (c *visitCompleter) RedirectFailure(ctx context.Context, w http.ResponseWri
 func (c *visitCompleter) redirect(w http.ResponseWriter, req *http.Request, returnTo string, query url.Values) error {
 	// Check the return to is a whitelisted address, and is a valid URL.
 	var validReturnTo bool
-	if returnTo == c.params.Location+"/login-complete" {
+	if returnTo == idputil.LocationURL(c.params.Location, "/login-complete") {
 		validReturnTo = true
 	} else {
 		for _, rurl := range c.params.RedirectLoginWhitelist {
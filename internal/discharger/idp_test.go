@@ -6,24 +6,38 @@ package discharger_test
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"html/template"
+	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
 	"time"
 
 	qt "github.com/frankban/quicktest"
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	macaroon "gopkg.in/macaroon.v2"
 
+	"github.com/canonical/candid/audit"
+	"github.com/canonical/candid/events"
 	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/idp/static"
 	"github.com/canonical/candid/internal/auth"
 	"github.com/canonical/candid/internal/candidtest"
 	"github.com/canonical/candid/internal/discharger"
 	"github.com/canonical/candid/internal/identity"
 	"github.com/canonical/candid/internal/monitoring"
+	"github.com/canonical/candid/loginpolicy"
 	"github.com/canonical/candid/meeting"
 	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/ratelimit"
 	"github.com/canonical/candid/store"
 )
 
@@ -210,3 +224,1221 @@ func (s *idpSuite) TestLoginRedirectFailureInvalidReturnTo(c *qt.C) {
 		Message: `test error`,
 	})
 }
+
+func TestIDPStoreEmptyUsername(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := candidtest.NewStore()
+	idpStore := discharger.NewIDPStore(st.Store, discharger.IDPStoreParams{})
+
+	for _, username := range []string{"", "   ", "@domain"} {
+		c.Run(username, func(c *qt.C) {
+			id := &store.Identity{
+				ProviderID: store.MakeProviderIdentity("test", "bob"),
+				Username:   username,
+				Email:      "bob@example.com",
+			}
+			err := idpStore.UpdateIdentity(ctx, id, store.Update{
+				store.Username: store.Set,
+				store.Email:    store.Set,
+			})
+			c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+			c.Assert(err, qt.ErrorMatches, `login failed: identity provider returned an empty username`)
+
+			// Nothing must have been written to the store.
+			err = st.Store.Identity(ctx, &store.Identity{
+				ProviderID: store.MakeProviderIdentity("test", "bob"),
+			})
+			c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+		})
+	}
+}
+
+func TestIDPStoreEmptyUsernameEmailFallback(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := candidtest.NewStore()
+	idpStore := discharger.NewIDPStore(st.Store, discharger.IDPStoreParams{
+		UsernameFallback: "email",
+	})
+
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   " @domain",
+		Email:      "bob@example.com",
+	}
+	err := idpStore.UpdateIdentity(ctx, id, store.Update{
+		store.Username: store.Set,
+		store.Email:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "bob@domain")
+
+	id2 := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	}
+	err = st.Store.Identity(ctx, id2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id2.Username, qt.Equals, "bob@domain")
+
+	// Without an email address the login is still rejected.
+	err = idpStore.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrUnauthorized)
+}
+
+func TestIDPStoreUsernameCaseInsensitive(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := candidtest.NewStore()
+	idpStore := discharger.NewIDPStore(st.Store, discharger.IDPStoreParams{
+		UsernameCasePolicy: "insensitive",
+	})
+
+	for _, username := range []string{"Alice", "alice", "ALICE", "Alice"} {
+		id := &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", username),
+			Username:   username,
+		}
+		err := idpStore.UpdateIdentity(ctx, id, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+		// The first identity created is always used and its
+		// username does not change.
+		c.Assert(id.ProviderID, qt.Equals, store.MakeProviderIdentity("test", "Alice"))
+		c.Assert(id.Username, qt.Equals, "alice")
+
+		id1 := store.Identity{Username: "alice"}
+		err = st.Store.Identity(ctx, &id1)
+		c.Assert(err, qt.IsNil)
+		c.Assert(id1.ProviderID, qt.Equals, store.MakeProviderIdentity("test", "Alice"))
+		c.Assert(id1.ProviderInfo["display-username"], qt.DeepEquals, []string{username})
+	}
+	ids, err := st.Store.FindIdentities(ctx, &store.Identity{}, store.Filter{}, nil, 0, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ids, qt.HasLen, 1)
+
+	// An identity from another identity provider is not matched.
+	err = idpStore.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("other", "Alice"),
+		Username:   "Alice",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrDuplicateUsername)
+
+	// A different user of the same identity provider whose username
+	// differs only in case is not matched.
+	err = idpStore.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "subject-2"),
+		Username:   "ALICE",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrDuplicateUsername)
+}
+
+func TestIDPStoreUsernameCaseSensitive(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := candidtest.NewStore()
+	idpStore := discharger.NewIDPStore(st.Store, discharger.IDPStoreParams{
+		UsernameCasePolicy: "sensitive",
+	})
+
+	for _, username := range []string{"Alice", "alice", "Alice", "alice"} {
+		id := &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", username),
+			Username:   username,
+		}
+		err := idpStore.UpdateIdentity(ctx, id, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+		c.Assert(id.Username, qt.Equals, username)
+	}
+	for _, username := range []string{"Alice", "alice"} {
+		id := store.Identity{Username: username}
+		err := st.Store.Identity(ctx, &id)
+		c.Assert(err, qt.IsNil)
+		c.Assert(id.ProviderID, qt.Equals, store.MakeProviderIdentity("test", username))
+		c.Assert(id.ProviderInfo["display-username"], qt.IsNil)
+	}
+	ids, err := st.Store.FindIdentities(ctx, &store.Identity{}, store.Filter{}, nil, 0, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ids, qt.HasLen, 2)
+}
+
+func TestIDPStoreUsernameFormat(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := candidtest.NewStore()
+	f, err := idputil.NewUsernameFormat(`{{.FirstName | lower}}.{{.LastName | lower}}@example`)
+	c.Assert(err, qt.IsNil)
+	idpStore := discharger.NewIDPStore(st.Store, discharger.IDPStoreParams{
+		UsernameFormat: f,
+	})
+
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "asmith"),
+		Username:   "asmith",
+		Name:       "Alice Smith",
+	}
+	err = idpStore.UpdateIdentity(ctx, id, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "alice.smith@example")
+
+	// The format is not applied again on later logins, even if the
+	// identity provider information has changed.
+	id = &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "asmith"),
+		Username:   "asmith",
+		Name:       "Alice Jones",
+	}
+	err = idpStore.UpdateIdentity(ctx, id, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Username, qt.Equals, "alice.smith@example")
+	id1 := store.Identity{ProviderID: store.MakeProviderIdentity("test", "asmith")}
+	err = st.Store.Identity(ctx, &id1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id1.Username, qt.Equals, "alice.smith@example")
+	c.Assert(id1.Name, qt.Equals, "Alice Jones")
+
+	// A different identity that formats to the same username is
+	// rejected.
+	err = idpStore.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+		Name:       "Alice Smith",
+	}, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrAlreadyExists)
+	c.Assert(err, qt.ErrorMatches, `login failed: username "alice.smith@example" is already in use`)
+	err = st.Store.Identity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
+func TestIDPStoreDefaultGroups(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := candidtest.NewStore()
+	idpStore := discharger.NewIDPStore(st.Store, discharger.IDPStoreParams{
+		DefaultGroups: []string{"everyone", "group1"},
+	})
+
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"group1", "group2"},
+	}
+	err := idpStore.UpdateIdentity(ctx, id, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	st.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"group1", "group2", "everyone"},
+	})
+
+	// An identity provider that does not supply groups still gets
+	// the default groups.
+	err = idpStore.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	st.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+		Groups:     []string{"everyone", "group1"},
+	})
+
+	// Once removed, a default group is not added again on subsequent
+	// logins.
+	err = st.Store.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Groups:     []string{"everyone"},
+	}, store.Update{
+		store.Groups: store.Pull,
+	})
+	c.Assert(err, qt.IsNil)
+	err = idpStore.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	st.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+		Groups:     []string{"group1"},
+	})
+}
+
+func TestIDPStoreEmailValidation(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := candidtest.NewStore()
+	idpStore := discharger.NewIDPStore(st.Store, discharger.IDPStoreParams{})
+
+	id := &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Email:      " Bob@Example.COM ",
+	}
+	err := idpStore.UpdateIdentity(ctx, id, store.Update{
+		store.Username: store.Set,
+		store.Email:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	st.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Email:      "Bob@example.com",
+	})
+
+	// A malformed email address is not stored with lenient
+	// validation, but does not stop the login.
+	err = idpStore.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Email:      "bob",
+	}, store.Update{
+		store.Username: store.Set,
+		store.Email:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	st.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Email:      "Bob@example.com",
+	})
+
+	// With strict validation the login fails.
+	strictStore := discharger.NewIDPStore(st.Store, discharger.IDPStoreParams{
+		EmailValidation: store.EmailStrict,
+	})
+	err = strictStore.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+		Email:      "alice",
+	}, store.Update{
+		store.Username: store.Set,
+		store.Email:    store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+	c.Assert(err, qt.ErrorMatches, `login failed: invalid email address "alice"`)
+
+	// Without validation the email address is stored unchanged.
+	idpStore = discharger.NewIDPStore(st.Store, discharger.IDPStoreParams{
+		EmailValidation: store.EmailNone,
+	})
+	err = idpStore.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+		Email:      "alice",
+	}, store.Update{
+		store.Username: store.Set,
+		store.Email:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	st.AssertUser(c, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+		Email:      "alice",
+	})
+}
+
+func TestLoginSuccessDeniedByPolicy(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	oven := bakery.NewOven(bakery.OvenParams{
+		Namespace: auth.Namespace,
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return st.BakeryRootKeyStore
+		},
+		Key:      bakery.MustGenerateKey(),
+		Location: "candidtest",
+	})
+	kvs, err := st.ProviderDataStore.KeyValueStore(context.Background(), "test-discharge-tokens")
+	c.Assert(err, qt.IsNil)
+	vc := discharger.NewVisitCompleter(identity.HandlerParams{
+		ServerParams: identity.ServerParams{
+			Store:        st.Store,
+			MeetingStore: st.MeetingStore,
+			RootKeyStore: st.BakeryRootKeyStore,
+			LoginPolicy: policyFunc(func(id *store.Identity) *loginpolicy.Decision {
+				return &loginpolicy.Decision{
+					Allow:  id.Username != "bob",
+					Reason: "bob is not allowed",
+				}
+			}),
+		},
+		Oven: oven,
+	}, kvs)
+
+	req, err := http.NewRequest("GET", "", nil)
+	c.Assert(err, qt.IsNil)
+	rr := httptest.NewRecorder()
+	vc.Success(context.Background(), rr, req, "", &store.Identity{
+		Username: "bob",
+	})
+	c.Assert(rr.Code, qt.Equals, http.StatusForbidden)
+	var perr params.Error
+	err = json.Unmarshal(rr.Body.Bytes(), &perr)
+	c.Assert(err, qt.IsNil)
+	c.Assert(perr, qt.DeepEquals, params.Error{
+		Code:    params.ErrForbidden,
+		Message: "login denied by policy: bob is not allowed",
+	})
+
+	rr = httptest.NewRecorder()
+	vc.Success(context.Background(), rr, req, "", &store.Identity{
+		Username: "alice",
+	})
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), qt.Equals, "Login successful as alice")
+}
+
+func TestLoginSuccessSendsEvent(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	oven := bakery.NewOven(bakery.OvenParams{
+		Namespace: auth.Namespace,
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return st.BakeryRootKeyStore
+		},
+		Key:      bakery.MustGenerateKey(),
+		Location: "candidtest",
+	})
+	kvs, err := st.ProviderDataStore.KeyValueStore(context.Background(), "test-discharge-tokens")
+	c.Assert(err, qt.IsNil)
+	sink := make(eventSink, 1)
+	d := events.NewDispatcher(events.DispatcherParams{Sink: sink})
+	defer d.Close()
+	vc := discharger.NewVisitCompleter(identity.HandlerParams{
+		ServerParams: identity.ServerParams{
+			Store:           st.Store,
+			MeetingStore:    st.MeetingStore,
+			RootKeyStore:    st.BakeryRootKeyStore,
+			EventDispatcher: d,
+		},
+		Oven: oven,
+	}, kvs)
+
+	req, err := http.NewRequest("GET", "", nil)
+	c.Assert(err, qt.IsNil)
+	rr := httptest.NewRecorder()
+	vc.Success(context.Background(), rr, req, "", &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	})
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+	select {
+	case e := <-sink:
+		c.Assert(e.Type, qt.Equals, events.Login)
+		c.Assert(e.Username, qt.Equals, "bob")
+		c.Assert(e.ProviderID, qt.Equals, "test:bob")
+		c.Assert(e.Data, qt.DeepEquals, map[string]string{"idp": "test"})
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for login event")
+	}
+}
+
+func TestLoginSuccessOnboarding(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	oven := bakery.NewOven(bakery.OvenParams{
+		Namespace: auth.Namespace,
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return st.BakeryRootKeyStore
+		},
+		Key:      bakery.MustGenerateKey(),
+		Location: "candidtest",
+	})
+	kvs, err := st.ProviderDataStore.KeyValueStore(context.Background(), "test-discharge-tokens")
+	c.Assert(err, qt.IsNil)
+	var returnTo string
+	vc := discharger.NewVisitCompleter(identity.HandlerParams{
+		ServerParams: identity.ServerParams{
+			Store:        st.Store,
+			MeetingStore: st.MeetingStore,
+			RootKeyStore: st.BakeryRootKeyStore,
+			Location:     "https://candid.example.com",
+			Onboarding: onboardingFunc(func(w http.ResponseWriter, id *store.Identity, rt string) {
+				returnTo = rt
+				fmt.Fprintf(w, "Welcome %s", id.Username)
+			}),
+		},
+		Oven: oven,
+	}, kvs)
+
+	ctx := context.Background()
+	for _, name := range []string{"alice", "bob"} {
+		err = st.Store.UpdateIdentity(ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", name),
+			Username:   name,
+		}, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	lookup := func(name string) *store.Identity {
+		id := &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", name),
+		}
+		err := st.Store.Identity(ctx, id)
+		c.Assert(err, qt.IsNil)
+		return id
+	}
+
+	// The first login is sent to onboarding and does not complete.
+	req, err := http.NewRequest("GET", "", nil)
+	c.Assert(err, qt.IsNil)
+	rr := httptest.NewRecorder()
+	vc.Success(ctx, rr, req, "", lookup("bob"))
+	c.Assert(rr.Body.String(), qt.Equals, "Welcome bob")
+	u, err := url.Parse(returnTo)
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.Path, qt.Equals, "/login-onboarded")
+	key := u.Query().Get("id")
+	c.Assert(key, qt.Not(qt.Equals), "")
+	c.Assert(lookup("bob").LastLogin.IsZero(), qt.IsTrue)
+
+	// Returning from onboarding without the onboarding service
+	// confirming completion fails the login.
+	rr = httptest.NewRecorder()
+	discharger.Onboarded(vc, ctx, rr, req, key, "")
+	c.Assert(rr.Code, qt.Equals, http.StatusForbidden)
+	var perr params.Error
+	err = json.Unmarshal(rr.Body.Bytes(), &perr)
+	c.Assert(err, qt.IsNil)
+	c.Assert(perr, qt.DeepEquals, params.Error{
+		Code:    params.ErrForbidden,
+		Message: "onboarding not completed",
+	})
+	c.Assert(lookup("bob").LastLogin.IsZero(), qt.IsTrue)
+
+	// Completion cannot be confirmed for unknown state.
+	err = discharger.CompleteOnboarding(vc, ctx, key)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+
+	// Returning from onboarding once completion has been confirmed
+	// completes the login.
+	rr = httptest.NewRecorder()
+	vc.Success(ctx, rr, req, "", lookup("bob"))
+	c.Assert(rr.Body.String(), qt.Equals, "Welcome bob")
+	u, err = url.Parse(returnTo)
+	c.Assert(err, qt.IsNil)
+	key = u.Query().Get("id")
+	err = discharger.CompleteOnboarding(vc, ctx, key)
+	c.Assert(err, qt.IsNil)
+	rr = httptest.NewRecorder()
+	discharger.Onboarded(vc, ctx, rr, req, key, "")
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+	c.Assert(rr.Body.String(), qt.Equals, "Login successful as bob")
+	c.Assert(lookup("bob").LastLogin.IsZero(), qt.IsFalse)
+
+	// The onboarding state can only be used once.
+	rr = httptest.NewRecorder()
+	discharger.Onboarded(vc, ctx, rr, req, key, "")
+	c.Assert(rr.Code, qt.Equals, http.StatusBadRequest)
+	c.Assert(rr.Body.String(), qt.Equals, "invalid onboarding state")
+
+	// Subsequent logins skip onboarding.
+	returnTo = ""
+	rr = httptest.NewRecorder()
+	vc.Success(ctx, rr, req, "", lookup("bob"))
+	c.Assert(rr.Body.String(), qt.Equals, "Login successful as bob")
+	c.Assert(returnTo, qt.Equals, "")
+
+	// Failed onboarding fails the login.
+	rr = httptest.NewRecorder()
+	vc.Success(ctx, rr, req, "", lookup("alice"))
+	c.Assert(rr.Body.String(), qt.Equals, "Welcome alice")
+	u, err = url.Parse(returnTo)
+	c.Assert(err, qt.IsNil)
+	rr = httptest.NewRecorder()
+	discharger.Onboarded(vc, ctx, rr, req, u.Query().Get("id"), "terms not accepted")
+	c.Assert(rr.Code, qt.Equals, http.StatusForbidden)
+	perr = params.Error{}
+	err = json.Unmarshal(rr.Body.Bytes(), &perr)
+	c.Assert(err, qt.IsNil)
+	c.Assert(perr, qt.DeepEquals, params.Error{
+		Code:    params.ErrForbidden,
+		Message: "onboarding failed: terms not accepted",
+	})
+	c.Assert(lookup("alice").LastLogin.IsZero(), qt.IsTrue)
+}
+
+// eventSink is an events.Sink that sends events on a channel.
+type eventSink chan events.Event
+
+func (s eventSink) Send(_ context.Context, e *events.Event) error {
+	s <- *e
+	return nil
+}
+
+type policyFunc func(id *store.Identity) *loginpolicy.Decision
+
+func (f policyFunc) CheckLogin(_ context.Context, _ *http.Request, id *store.Identity) (*loginpolicy.Decision, error) {
+	return f(id), nil
+}
+
+type onboardingFunc func(w http.ResponseWriter, id *store.Identity, returnTo string)
+
+func (f onboardingFunc) Onboard(_ context.Context, w http.ResponseWriter, _ *http.Request, id *store.Identity, returnTo string) error {
+	f(w, id, returnTo)
+	return nil
+}
+
+func TestIDPCookieIsolation(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(),
+		&cookieIDP{IdentityProvider: candidtest.StaticIDP("a", nil)},
+		&cookieIDP{IdentityProvider: candidtest.StaticIDP("b", nil)},
+	)
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, qt.IsNil)
+	client := &http.Client{Jar: jar}
+	get := func(path string, v url.Values) string {
+		resp, err := client.Get(srv.URL + path + "?" + v.Encode())
+		c.Assert(err, qt.IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, qt.IsNil)
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusOK, qt.Commentf("%s", body))
+		return string(body)
+	}
+
+	// Interleave the logins to the two identity providers.
+	stateA := get("/login/a/start", url.Values{"value": {"value-a"}})
+	stateB := get("/login/b/start", url.Values{"value": {"value-b"}})
+	c.Assert(get("/login/a/finish", url.Values{"state": {stateA}}), qt.Equals, "value-a [candid-login-a-state]")
+	c.Assert(get("/login/b/finish", url.Values{"state": {stateB}}), qt.Equals, "value-b [candid-login-b-state]")
+}
+
+// cookieIDP is an identity provider that stores a value in a cookie
+// when /start is visited and returns it, along with the names of all
+// the cookies it received, when /finish is visited.
+type cookieIDP struct {
+	idp.IdentityProvider
+	initParams idp.InitParams
+}
+
+func (i *cookieIDP) Init(ctx context.Context, params idp.InitParams) error {
+	i.initParams = params
+	return i.IdentityProvider.Init(ctx, params)
+}
+
+func (i *cookieIDP) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	name := i.initParams.CookieNamePrefix + "state"
+	switch req.URL.Path {
+	case "/start":
+		state, err := i.initParams.Codec.SetCookie(w, name, i.initParams.CookiePath, req.Form.Get("value"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, state)
+	case "/finish":
+		var v string
+		if err := i.initParams.Codec.Cookie(req, name, req.Form.Get("state"), &v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var names []string
+		for _, c := range req.Cookies() {
+			names = append(names, c.Name)
+		}
+		fmt.Fprintf(w, "%s %v", v, names)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestMaxConcurrentLogins(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	slow := &slowIDP{
+		IdentityProvider: candidtest.StaticIDP("slow", nil),
+		started:          make(chan struct{}),
+		release:          make(chan struct{}),
+	}
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), slow, candidtest.StaticIDP("other", nil))
+	sp.MaxConcurrentLogins = 2
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		c.Check(err, qt.IsNil)
+		if err != nil {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Check(err, qt.IsNil)
+		return resp.StatusCode, string(body)
+	}
+
+	// Fill the slots with logins that block in the identity provider.
+	done := make(chan int)
+	for i := 0; i < 2; i++ {
+		go func() {
+			code, _ := get("/login/slow/login")
+			done <- code
+		}()
+		<-slow.started
+	}
+
+	// Further logins to the slow identity provider are rejected.
+	code, body := get("/login/slow/login")
+	c.Assert(code, qt.Equals, http.StatusTooManyRequests)
+	var perr params.Error
+	err := json.Unmarshal([]byte(body), &perr)
+	c.Assert(err, qt.IsNil)
+	c.Assert(perr.Code, qt.Equals, params.ErrTooManyRequests)
+	c.Assert(perr.Message, qt.Equals, "too many logins in progress with slow, try again shortly")
+
+	// Other identity providers are not affected.
+	code, _ = get("/login/other/login")
+	c.Assert(code, qt.Not(qt.Equals), http.StatusTooManyRequests)
+
+	// Once the in-progress logins complete new logins are accepted.
+	close(slow.release)
+	for i := 0; i < 2; i++ {
+		c.Assert(<-done, qt.Equals, http.StatusOK)
+	}
+	code, _ = get("/login/slow/login")
+	c.Assert(code, qt.Equals, http.StatusOK)
+}
+
+func TestFailedLoginDelayReleasesLoginSlot(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	pw := &passwordIDP{
+		IdentityProvider: candidtest.StaticIDP("password", nil),
+		failed:           make(chan struct{}, 1),
+	}
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), pw)
+	sp.MaxConcurrentLogins = 1
+	sp.FailedLoginDelay = time.Second
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	login := func(password string) int {
+		resp, err := http.PostForm(srv.URL+"/login/password/login", url.Values{
+			"username": {"bob"},
+			"password": {password},
+		})
+		c.Check(err, qt.IsNil)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Start a failed login, which is delayed.
+	done := make(chan int)
+	go func() {
+		done <- login("wrong")
+	}()
+	<-pw.failed
+
+	// A valid login proceeds while the failure is being delayed.
+	code := http.StatusTooManyRequests
+	for code == http.StatusTooManyRequests {
+		select {
+		case <-done:
+			c.Fatalf("valid login blocked until the failed login completed")
+		default:
+		}
+		code = login("pass")
+	}
+	c.Assert(code, qt.Equals, http.StatusOK)
+	select {
+	case <-done:
+		c.Fatalf("failed login not delayed")
+	default:
+	}
+	c.Assert(<-done, qt.Equals, http.StatusUnauthorized)
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	limiter, err := ratelimit.New(ratelimit.Config{
+		RequestsPerMinute: 1,
+		Burst:             2,
+	})
+	c.Assert(err, qt.IsNil)
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.StaticIDP("test", nil))
+	sp.LoginRateLimiter = limiter
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	login := func(username string) (int, string) {
+		resp, err := http.PostForm(srv.URL+"/login/test/login", url.Values{
+			"username": {username},
+			"password": {"wrong"},
+		})
+		c.Check(err, qt.IsNil)
+		if err != nil {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Check(err, qt.IsNil)
+		return resp.StatusCode, string(body)
+	}
+
+	for i := 0; i < 2; i++ {
+		code, _ := login("alice")
+		c.Assert(code, qt.Not(qt.Equals), http.StatusTooManyRequests)
+	}
+	code, body := login("alice")
+	c.Assert(code, qt.Equals, http.StatusTooManyRequests)
+	var perr params.Error
+	err = json.Unmarshal([]byte(body), &perr)
+	c.Assert(err, qt.IsNil)
+	c.Assert(perr.Code, qt.Equals, params.ErrTooManyRequests)
+	c.Assert(perr.Message, qt.Equals, "too many login attempts, try again later")
+
+	// Attempts for a different username are limited separately.
+	code, _ = login("bob")
+	c.Assert(code, qt.Not(qt.Equals), http.StatusTooManyRequests)
+}
+
+func TestLoginClientRateLimit(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	limiter, err := ratelimit.New(ratelimit.Config{
+		RequestsPerMinute: 1,
+		Burst:             3,
+	})
+	c.Assert(err, qt.IsNil)
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.StaticIDP("test", nil))
+	sp.LoginClientRateLimiter = limiter
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	login := func(username string) int {
+		resp, err := http.PostForm(srv.URL+"/login/test/login", url.Values{
+			"username": {username},
+			"password": {"wrong"},
+		})
+		c.Assert(err, qt.IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Attempts for different usernames from the same client are
+	// limited together.
+	for _, username := range []string{"alice", "bob", "carol"} {
+		c.Assert(login(username), qt.Not(qt.Equals), http.StatusTooManyRequests)
+	}
+	c.Assert(login("dave"), qt.Equals, http.StatusTooManyRequests)
+}
+
+func TestLoginAudit(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	log := new(auditLog)
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"bob": {Password: "bobpassword"},
+	}))
+	sp.AuditLogger = log
+	sp.DischargeTokenTimeout = time.Hour
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+
+	t0 := time.Now()
+	_, err := dc.Discharge(c, "is-authenticated-user", srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "bob", "bobpassword"),
+	}))
+	c.Assert(err, qt.IsNil)
+	logged := log.Events()
+	c.Assert(logged, qt.HasLen, 1)
+	e := logged[0]
+	c.Assert(e.Time.Before(t0), qt.IsFalse)
+	c.Assert(e.Expires, qt.Not(qt.IsNil))
+	c.Assert(e.Expires.Sub(e.Time) > 59*time.Minute, qt.IsTrue)
+	c.Assert(e.WaitID, qt.Not(qt.Equals), "")
+	e.Time = time.Time{}
+	e.Expires = nil
+	e.WaitID = ""
+	c.Assert(e, qt.DeepEquals, audit.Event{
+		Outcome:  audit.Success,
+		Username: "bob",
+		IDP:      "test",
+		ClientIP: "127.0.0.1",
+	})
+
+	// A failed login is recorded once.
+	_, err = dc.Discharge(c, "is-authenticated-user", srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.OpenWebBrowser(c, candidtest.SelectInteractiveLogin(badLoginFormRequestMethod)),
+	}))
+	c.Assert(err, qt.ErrorMatches, `.*unsupported method "PUT"`)
+	logged = log.Events()
+	c.Assert(logged, qt.HasLen, 2)
+	e = logged[1]
+	c.Assert(e.WaitID, qt.Not(qt.Equals), "")
+	c.Assert(e.WaitID, qt.Not(qt.Equals), logged[0].WaitID)
+	e.Time = time.Time{}
+	e.WaitID = ""
+	c.Assert(e, qt.DeepEquals, audit.Event{
+		Outcome:  audit.Failure,
+		IDP:      "test",
+		ClientIP: "127.0.0.1",
+		Error:    `unsupported method "PUT"`,
+	})
+}
+
+func TestRedirectLoginAuditWaitID(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	log := new(auditLog)
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"bob": {Password: "bobpassword"},
+	}))
+	sp.AuditLogger = log
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, qt.IsNil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host == "example.com" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+
+	// A wait ID supplied by the client is not recorded.
+	v := url.Values{
+		"return_to": {"https://example.com/callback"},
+		"did":       {"forged"},
+	}
+	resp, err := client.Get(srv.URL + "/login-redirect?" + v.Encode())
+	c.Assert(err, qt.IsNil)
+	resp, err = candidtest.SelectInteractiveLogin(candidtest.PostLoginForm("bob", "bobpassword"))(client, resp)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+	logged := log.Events()
+	c.Assert(logged, qt.HasLen, 1)
+	c.Assert(logged[0].Outcome, qt.Equals, audit.Success)
+	c.Assert(logged[0].WaitID, qt.Equals, "")
+
+	// A wait state that was not sealed by the server is rejected.
+	v = url.Values{
+		"return_to": {"https://example.com/callback"},
+		"wait":      {"forged"},
+	}
+	resp, err = client.Get(srv.URL + "/login-redirect?" + v.Encode())
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+// auditLog is an audit.Logger that records the events it is given.
+type auditLog struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (l *auditLog) Log(_ context.Context, e *audit.Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, *e)
+	return nil
+}
+
+// Events returns the events that have been logged.
+func (l *auditLog) Events() []audit.Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]audit.Event(nil), l.events...)
+}
+
+// slowIDP is an identity provider that does not complete any request
+// until release is closed. It sends on started when each request
+// begins.
+type slowIDP struct {
+	idp.IdentityProvider
+	started chan struct{}
+	release chan struct{}
+}
+
+func (i *slowIDP) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	select {
+	case i.started <- struct{}{}:
+	case <-i.release:
+	}
+	<-i.release
+	fmt.Fprint(w, "done")
+}
+
+// passwordIDP is an identity provider that checks a password
+// submitted to its login endpoint, applying the failed login delay.
+type passwordIDP struct {
+	idp.IdentityProvider
+	initParams idp.InitParams
+	failed     chan struct{}
+}
+
+func (i *passwordIDP) Init(ctx context.Context, params idp.InitParams) error {
+	i.initParams = params
+	return i.IdentityProvider.Init(ctx, params)
+}
+
+func (i *passwordIDP) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	loginUser := i.initParams.FailedLoginDelay.LoginUser(func(ctx context.Context, username, password string) (*store.Identity, error) {
+		if password != "pass" {
+			i.failed <- struct{}{}
+			return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "authentication failed")
+		}
+		return &store.Identity{Username: username}, nil
+	})
+	if _, err := loginUser(ctx, req.Form.Get("username"), req.Form.Get("password")); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	fmt.Fprint(w, "done")
+}
+
+func TestDeviceSessionLifetimes(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), &tokenIDP{
+		IdentityProvider: candidtest.StaticIDP("token", nil),
+	})
+	sp.DischargeTokenTimeout = 12 * time.Hour
+	sp.DeviceSessionLifetimes = map[string]time.Duration{
+		"mobile": time.Hour,
+	}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	expiry := func(userAgent string) time.Duration {
+		req, err := http.NewRequest("GET", srv.URL+"/login/token/login", nil)
+		c.Assert(err, qt.IsNil)
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, qt.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, qt.IsNil)
+		t, err := time.Parse(time.RFC3339Nano, string(body))
+		c.Assert(err, qt.IsNil)
+		return time.Until(t)
+	}
+
+	// A login from a mobile device gets the shorter lifetime.
+	d := expiry("Mozilla/5.0 (Linux; Android 10; Pixel 3) Mobile Safari/537.36")
+	c.Assert(d > 55*time.Minute && d <= time.Hour, qt.IsTrue, qt.Commentf("expiry in %v", d))
+
+	// Other devices get the default lifetime.
+	d = expiry("Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:78.0) Gecko/20100101 Firefox/78.0")
+	c.Assert(d > 11*time.Hour && d <= 12*time.Hour, qt.IsTrue, qt.Commentf("expiry in %v", d))
+}
+
+func TestIDPSessionLifetimes(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), &tokenIDP{
+		IdentityProvider: candidtest.StaticIDP("trusted", nil),
+	}, &tokenIDP{
+		IdentityProvider: candidtest.StaticIDP("external", nil),
+	}, &tokenIDP{
+		IdentityProvider: candidtest.StaticIDP("other", nil),
+	})
+	sp.DischargeTokenTimeout = 12 * time.Hour
+	sp.IDPSessionLifetimes = map[string]time.Duration{
+		"trusted":  7 * 24 * time.Hour,
+		"external": time.Hour,
+		"other":    0,
+	}
+	sp.DeviceSessionLifetimes = map[string]time.Duration{
+		"mobile": 2 * time.Hour,
+	}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	expiry := func(idp, userAgent string) time.Duration {
+		req, err := http.NewRequest("GET", srv.URL+"/login/"+idp+"/login", nil)
+		c.Assert(err, qt.IsNil)
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, qt.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, qt.IsNil)
+		t, err := time.Parse(time.RFC3339Nano, string(body))
+		c.Assert(err, qt.IsNil)
+		return time.Until(t)
+	}
+	const desktop = "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:78.0) Gecko/20100101 Firefox/78.0"
+	const mobile = "Mozilla/5.0 (Linux; Android 10; Pixel 3) Mobile Safari/537.36"
+
+	// Each identity provider gets its own lifetime, which may be
+	// longer or shorter than the default.
+	d := expiry("trusted", desktop)
+	c.Assert(d > 167*time.Hour && d <= 168*time.Hour, qt.IsTrue, qt.Commentf("expiry in %v", d))
+	d = expiry("external", desktop)
+	c.Assert(d > 55*time.Minute && d <= time.Hour, qt.IsTrue, qt.Commentf("expiry in %v", d))
+
+	// A zero lifetime falls back to the default.
+	d = expiry("other", desktop)
+	c.Assert(d > 11*time.Hour && d <= 12*time.Hour, qt.IsTrue, qt.Commentf("expiry in %v", d))
+
+	// When a device lifetime also applies the shorter is used.
+	d = expiry("trusted", mobile)
+	c.Assert(d > 115*time.Minute && d <= 2*time.Hour, qt.IsTrue, qt.Commentf("expiry in %v", d))
+	d = expiry("external", mobile)
+	c.Assert(d > 55*time.Minute && d <= time.Hour, qt.IsTrue, qt.Commentf("expiry in %v", d))
+	d = expiry("other", mobile)
+	c.Assert(d > 115*time.Minute && d <= 2*time.Hour, qt.IsTrue, qt.Commentf("expiry in %v", d))
+}
+
+func TestLimitToIDPTokenExpiry(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	sp := candidtest.WithIDPs(st.ServerParams(), &tokenIDP{
+		IdentityProvider: candidtest.StaticIDP("token", nil),
+	})
+	sp.DischargeTokenTimeout = 12 * time.Hour
+	sp.LimitToIDPTokenExpiry = true
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	expiry := func(exp time.Time) time.Duration {
+		v := url.Values{}
+		if !exp.IsZero() {
+			v.Set("exp", exp.Format(time.RFC3339Nano))
+		}
+		resp, err := http.Get(srv.URL + "/login/token/login?" + v.Encode())
+		c.Assert(err, qt.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, qt.IsNil)
+		t, err := time.Parse(time.RFC3339Nano, string(body))
+		c.Assert(err, qt.IsNil)
+		return time.Until(t)
+	}
+
+	// A short-lived upstream token limits the discharge token.
+	d := expiry(time.Now().Add(10 * time.Minute))
+	c.Assert(d > 9*time.Minute && d <= 10*time.Minute, qt.IsTrue, qt.Commentf("expiry in %v", d))
+
+	// A long-lived upstream token does not extend it.
+	d = expiry(time.Now().Add(48 * time.Hour))
+	c.Assert(d > 11*time.Hour && d <= 12*time.Hour, qt.IsTrue, qt.Commentf("expiry in %v", d))
+
+	// Without an upstream expiry the configured lifetime is used.
+	d = expiry(time.Time{})
+	c.Assert(d > 11*time.Hour && d <= 12*time.Hour, qt.IsTrue, qt.Commentf("expiry in %v", d))
+}
+
+// tokenIDP is an identity provider that creates a discharge token for
+// a fixed user and responds with the token's expiry time. If the
+// request has an exp parameter it is used as the expiry time of the
+// identity provider's token.
+type tokenIDP struct {
+	idp.IdentityProvider
+	params idp.InitParams
+}
+
+func (i *tokenIDP) Init(ctx context.Context, params idp.InitParams) error {
+	i.params = params
+	return i.IdentityProvider.Init(ctx, params)
+}
+
+func (i *tokenIDP) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if exp := req.Form.Get("exp"); exp != "" {
+		t, err := time.Parse(time.RFC3339Nano, exp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx = idputil.ContextWithTokenExpiry(ctx, t)
+	}
+	dt, err := i.params.DischargeTokenCreator.DischargeToken(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("token", "bob"),
+		Username:   "bob",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var m macaroon.Macaroon
+	if err := m.UnmarshalBinary(dt.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t, ok := checkers.ExpiryTime(checkers.New(nil).Namespace(), m.Caveats())
+	if !ok {
+		http.Error(w, "no expiry time", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, t.Format(time.RFC3339Nano))
+}
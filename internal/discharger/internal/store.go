@@ -14,9 +14,20 @@ import (
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/store"
 )
 
+// ErrInvalidCodeVerifier is the cause of the error returned when a
+// discharge token is retrieved with a code verifier that does not
+// match the code challenge it was stored with.
+var ErrInvalidCodeVerifier = errgo.New("invalid code verifier")
+
+// ErrInvalidReturnTo is the cause of the error returned when a
+// discharge token is retrieved with a return_to address that does not
+// match the one it was stored with.
+var ErrInvalidReturnTo = errgo.New("invalid return_to")
+
 // DischargeTokenStore is a store for discharge tokens. It wraps a
 // KeyValueStore.
 type DischargeTokenStore struct {
@@ -33,8 +44,20 @@ func NewDischargeTokenStore(store simplekv.Store) *DischargeTokenStore {
 // should be used to later retrieve the token. The DischargeToken will
 // only be available in the store until the given expire time.
 func (s *DischargeTokenStore) Put(ctx context.Context, dt *httpbakery.DischargeToken, expire time.Time) (string, error) {
+	key, err := s.PutWithCodeChallenge(ctx, dt, nil, "", expire)
+	return key, errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
+}
+
+// PutWithCodeChallenge is like Put except that, if cc is not nil, the
+// token can only be retrieved by presenting a code verifier that
+// matches cc. The token can only be retrieved by presenting the
+// returnTo address that the code was sent to, which identifies the
+// relying party the code was issued to.
+func (s *DischargeTokenStore) PutWithCodeChallenge(ctx context.Context, dt *httpbakery.DischargeToken, cc *idputil.CodeChallenge, returnTo string, expire time.Time) (string, error) {
 	entry := dischargeTokenEntry{
 		DischargeToken: dt,
+		CodeChallenge:  cc,
+		ReturnTo:       returnTo,
 		Expire:         expire,
 	}
 	b, err := json.Marshal(entry)
@@ -54,6 +77,18 @@ func (s *DischargeTokenStore) Put(ctx context.Context, dt *httpbakery.DischargeT
 // there is no such token, or the token has expired, then the returned
 // error will have a cause of store.ErrNotFound.
 func (s *DischargeTokenStore) Get(ctx context.Context, key string) (*httpbakery.DischargeToken, error) {
+	dt, err := s.GetWithCodeVerifier(ctx, key, "", "")
+	return dt, errgo.Mask(err, errgo.Any)
+}
+
+// GetWithCodeVerifier is like Get except that the given code verifier
+// is checked against the code challenge, if any, that the token was
+// stored with. A verifier must be given if, and only if, the token was
+// stored with a code challenge. If they do not match the returned
+// error will have a cause of ErrInvalidCodeVerifier. The given returnTo address must be
+// the one the token was stored with, otherwise the returned error will
+// have a cause of ErrInvalidReturnTo.
+func (s *DischargeTokenStore) GetWithCodeVerifier(ctx context.Context, key, verifier, returnTo string) (*httpbakery.DischargeToken, error) {
 	b, err := s.store.Get(ctx, key)
 	if err != nil {
 		if errgo.Cause(err) == simplekv.ErrNotFound {
@@ -68,10 +103,23 @@ func (s *DischargeTokenStore) Get(ctx context.Context, key string) (*httpbakery.
 	if entry.Expire.Before(time.Now()) {
 		return nil, errgo.WithCausef(nil, store.ErrNotFound, "%q not found", key)
 	}
+	if entry.ReturnTo != returnTo {
+		return nil, errgo.WithCausef(nil, ErrInvalidReturnTo, "return_to does not match the address the code was issued to")
+	}
+	switch {
+	case entry.CodeChallenge == nil && verifier != "":
+		return nil, errgo.WithCausef(nil, ErrInvalidCodeVerifier, "code verifier given but the code was issued without a code challenge")
+	case entry.CodeChallenge != nil && verifier == "":
+		return nil, errgo.WithCausef(nil, ErrInvalidCodeVerifier, "code verifier required")
+	case entry.CodeChallenge != nil && !entry.CodeChallenge.Verify(verifier):
+		return nil, errgo.WithCausef(nil, ErrInvalidCodeVerifier, "code verifier does not match code challenge")
+	}
 	return entry.DischargeToken, nil
 }
 
 type dischargeTokenEntry struct {
 	DischargeToken *httpbakery.DischargeToken
+	CodeChallenge  *idputil.CodeChallenge `json:",omitempty"`
+	ReturnTo       string                 `json:",omitempty"`
 	Expire         time.Time
 }
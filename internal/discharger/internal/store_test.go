@@ -14,6 +14,7 @@ import (
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/internal/candidtest"
 	"github.com/canonical/candid/internal/discharger/internal"
 	"github.com/canonical/candid/store"
@@ -45,6 +46,39 @@ func (s *storeSuite) TestRoundTrip(c *qt.C) {
 	dt1, err := store.Get(ctx, key)
 	c.Assert(err, qt.IsNil)
 	c.Assert(dt1, qt.DeepEquals, &dt)
+
+	// A code verifier cannot be used with a token that was stored
+	// without a code challenge.
+	_, err = store.GetWithCodeVerifier(ctx, key, "dBjftJeZ4CVP-mJ0kZ8Ci0Eoqz9WBA5gBiIcCeQKp4Q", "")
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrInvalidCodeVerifier)
+}
+
+func (s *storeSuite) TestRoundTripWithCodeChallenge(c *qt.C) {
+	ctx := context.Background()
+	kv, err := s.store.ProviderDataStore.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+	store := internal.NewDischargeTokenStore(kv)
+	dt := httpbakery.DischargeToken{
+		Kind:  "test",
+		Value: []byte("test-value"),
+	}
+	cc, err := idputil.NewCodeChallenge("dBjftJeZ4CVP-mJ0kZ8Ci0Eoqz9WBA5gBiIcCeQKp4Q", "plain")
+	c.Assert(err, qt.IsNil)
+	key, err := store.PutWithCodeChallenge(ctx, &dt, cc, "https://rp.example.com/callback", time.Now().Add(time.Minute))
+	c.Assert(err, qt.IsNil)
+
+	_, err = store.Get(ctx, key)
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrInvalidReturnTo)
+	_, err = store.GetWithCodeVerifier(ctx, key, "", "https://rp.example.com/callback")
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrInvalidCodeVerifier)
+	_, err = store.GetWithCodeVerifier(ctx, key, "Wv3yzHcRzAq4PTvmXqWrFn3xKtnjYy0r0zHpPvKmUsY", "https://rp.example.com/callback")
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrInvalidCodeVerifier)
+	_, err = store.GetWithCodeVerifier(ctx, key, "dBjftJeZ4CVP-mJ0kZ8Ci0Eoqz9WBA5gBiIcCeQKp4Q", "https://rp.example.com:8443/callback")
+	c.Assert(errgo.Cause(err), qt.Equals, internal.ErrInvalidReturnTo)
+
+	dt1, err := store.GetWithCodeVerifier(ctx, key, "dBjftJeZ4CVP-mJ0kZ8Ci0Eoqz9WBA5gBiIcCeQKp4Q", "https://rp.example.com/callback")
+	c.Assert(err, qt.IsNil)
+	c.Assert(dt1, qt.DeepEquals, &dt)
 }
 
 func (s *storeSuite) TestPutCanceled(c *qt.C) {
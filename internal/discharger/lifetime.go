@@ -0,0 +1,87 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"time"
+
+	"github.com/canonical/candid/idp/idputil"
+)
+
+// lifetime returns the authentication time to declare in, and the
+// expiry time of, an identity macaroon created at the given time for a
+// login being handled with the given context. The lifetime is the
+// configured discharge token timeout, or the session lifetime of the
+// identity provider used, further limited by any lifetime configured
+// for the class of device being used. It is also limited by the expiry
+// of the identity provider's token, if so configured, and, when an
+// existing identity macaroon is being renewed, by the expiry of that
+// macaroon.
+func (d *dischargeTokenCreator) lifetime(ctx context.Context, now time.Time) (authTime, expiry time.Time) {
+	timeout := d.params.DischargeTokenTimeout
+	idpLifetime := d.params.IDPSessionLifetimes[idpFromContext(ctx)]
+	if idpLifetime > 0 {
+		timeout = idpLifetime
+	}
+	if t, ok := d.params.DeviceSessionLifetimes[deviceClassFromContext(ctx)]; ok && (idpLifetime <= 0 || t < timeout) {
+		timeout = t
+	}
+	expiry = now.Add(timeout)
+	if d.params.LimitToIDPTokenExpiry {
+		if t, ok := idputil.TokenExpiryFromContext(ctx); ok && t.Before(expiry) {
+			expiry = t
+		}
+	}
+	authTime, maxExpiry := authTimeFromContext(ctx)
+	if authTime.IsZero() {
+		authTime = now
+	}
+	if !maxExpiry.IsZero() && maxExpiry.Before(expiry) {
+		expiry = maxExpiry
+	}
+	return authTime, expiry
+}
+
+type authTimeKey struct{}
+
+type authTimes struct {
+	authTime time.Time
+	expiry   time.Time
+}
+
+// contextWithAuthTime returns a context recording the time at which the
+// user originally authenticated, for a login that renews an existing
+// identity macaroon, and the time at which that macaroon expires.
+// Discharge tokens created with the returned context declare the
+// original authentication time and do not outlive the macaroon.
+func contextWithAuthTime(ctx context.Context, authTime, expiry time.Time) context.Context {
+	return context.WithValue(ctx, authTimeKey{}, authTimes{
+		authTime: authTime,
+		expiry:   expiry,
+	})
+}
+
+// authTimeFromContext returns the original authentication time and the
+// maximum expiry time recorded in the given context. Either may be
+// zero.
+func authTimeFromContext(ctx context.Context) (authTime, expiry time.Time) {
+	t, _ := ctx.Value(authTimeKey{}).(authTimes)
+	return t.authTime, t.expiry
+}
+
+type deviceClassKey struct{}
+
+// contextWithDeviceClass returns a context recording the class of
+// device from which the user is logging in.
+func contextWithDeviceClass(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, deviceClassKey{}, class)
+}
+
+// deviceClassFromContext returns the class of device recorded in the
+// given context, if any.
+func deviceClassFromContext(ctx context.Context) string {
+	class, _ := ctx.Value(deviceClassKey{}).(string)
+	return class
+}
@@ -27,6 +27,9 @@ type legacyLoginRequest struct {
 // LoginLegacy handles the GET /login-legacy endpoint that is used to log in to Candid
 // when the legacy visit-wait protocol is used.
 func (h *handler) LoginLegacy(p httprequest.Params, req *legacyLoginRequest) error {
+	if err := h.checkLegacyLogin(); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
 	// We should really be parsing the accept header properly here, but
 	// it's really complicated http://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html#sec14.1
 	// perhaps use http://godoc.org/bitbucket.org/ww/goautoneg for this.
@@ -60,6 +63,15 @@ func (h *handler) LoginLegacy(p httprequest.Params, req *legacyLoginRequest) err
 	return h.Login(p, (*loginRequest)(req))
 }
 
+// checkLegacyLogin returns an error with a cause of params.ErrNotFound
+// if the legacy login endpoints have been disabled.
+func (h *handler) checkLegacyLogin() error {
+	if h.params.DisableLegacyLogin {
+		return errgo.WithCausef(nil, params.ErrNotFound, "endpoint disabled: legacy login is not supported")
+	}
+	return nil
+}
+
 // loginRequest is a request to start a login to the identity manager.
 type loginRequest struct {
 	httprequest.Route `httprequest:"GET /login"`
@@ -70,23 +82,50 @@ type loginRequest struct {
 // Login handles the GET /v1/login endpoint that is used to log in to Candid.
 // when an interactive visit-wait protocol has been chosen by the client.
 func (h *handler) Login(p httprequest.Params, req *loginRequest) error {
+	return errgo.Mask(h.startLogin(p, req, time.Time{}), errgo.Any)
+}
+
+// startLogin starts the login requested by req. If expires is not zero
+// the login is being continued from a hand-off, it must complete before
+// the given time, and it cannot be handed off again.
+func (h *handler) startLogin(p httprequest.Params, req *loginRequest, expires time.Time) error {
 	// Store the requested discharge ID in a session cookie so that
 	// when the redirect comes back to login-complete we know the
 	// login was initiated in this session.
 	state, err := h.params.codec.SetCookie(p.Response, waitCookieName, "/login-complete", waitState{
 		DischargeID: req.DischargeID,
+		Expires:     expires,
 	})
 	if err != nil {
 		return errgo.Mask(err)
 	}
 	v := url.Values{
 		"state":     {state},
-		"return_to": {h.params.Location + "/login-complete"},
+		"return_to": {idputil.LocationURL(h.params.Location, "/login-complete")},
 	}
 	if req.Domain != "" {
 		v.Set("domain", req.Domain)
 	}
-	http.Redirect(p.Response, p.Request, h.params.Location+"/login-redirect?"+v.Encode(), http.StatusTemporaryRedirect)
+	if req.DischargeID != "" {
+		// The discharge wait is passed sealed so that the wait
+		// recorded in the audit log for the login cannot be
+		// forged by the client.
+		wait, err := h.params.codec.Encode(waitState{
+			DischargeID: req.DischargeID,
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		v.Set("wait", wait)
+	}
+	if h.params.LoginHandoffTimeout > 0 && req.DischargeID != "" && expires.IsZero() {
+		key, err := h.newHandoff(p.Context, req.DischargeID)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		v.Set("handoff", key)
+	}
+	http.Redirect(p.Response, p.Request, idputil.LocationURL(h.params.Location, "/login-redirect?"+v.Encode()), http.StatusTemporaryRedirect)
 	return nil
 }
 
@@ -106,6 +145,30 @@ type redirectLoginRequest struct {
 	// requesting service so the service can check that it initiated
 	// the original login request.
 	State string `httprequest:"state,form"`
+
+	// CodeChallenge holds an optional PKCE code challenge. If this
+	// is set the code returned at the end of the login can only be
+	// exchanged for a discharge token with the matching code
+	// verifier.
+	CodeChallenge string `httprequest:"code_challenge,form"`
+
+	// CodeChallengeMethod holds the method used to derive
+	// CodeChallenge, either "S256" or "plain" (the default).
+	CodeChallengeMethod string `httprequest:"code_challenge_method,form"`
+
+	// AnonymousSession holds an optional anonymous session macaroon,
+	// in base64 binary format. If this is set the identity macaroon
+	// obtained at the end of the login declares the same session ID.
+	AnonymousSession string `httprequest:"anonymous_session,form"`
+
+	// Handoff holds the key of a login hand-off that allows the
+	// login to be continued on another device, if any.
+	Handoff string `httprequest:"handoff,form"`
+
+	// Wait holds the state of the discharge wait that the login
+	// completes, if any, as sealed by startLogin. It is only used to
+	// record the login in the audit log.
+	Wait string `httprequest:"wait,form"`
 }
 
 // RedirectLogin handles starting a redirect based login request for a
@@ -113,13 +176,30 @@ type redirectLoginRequest struct {
 // identity provider which the user must then choose to start the login
 // process.
 func (h *handler) RedirectLogin(p httprequest.Params, req *redirectLoginRequest) error {
-	state, err := h.params.codec.SetCookie(p.Response, idputil.LoginCookieName, idputil.LoginCookiePath, idputil.LoginState{
-		ReturnTo: req.ReturnTo,
-		State:    req.State,
-		Expires:  time.Now().Add(15 * time.Minute),
-	})
+	cc, err := idputil.NewCodeChallenge(req.CodeChallenge, req.CodeChallengeMethod)
 	if err != nil {
-		return errgo.Mask(err)
+		return errgo.WithCausef(err, params.ErrBadRequest, "")
+	}
+	if rule, host, ok := relyingPartyRule(h.params.RelyingPartyRules, req.ReturnTo); ok && rule.RequirePKCE && cc == nil {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "%s requires a code_challenge", host)
+	}
+	sessionID, err := h.anonymousSessionID(p.Context, req.AnonymousSession)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	var ws waitState
+	if req.Wait != "" {
+		if err := h.params.codec.Decode(req.Wait, &ws); err != nil {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid wait state")
+		}
+	}
+	ls := idputil.LoginState{
+		ReturnTo:      req.ReturnTo,
+		State:         req.State,
+		Expires:       time.Now().Add(15 * time.Minute),
+		CodeChallenge: cc,
+		SessionID:     sessionID,
+		WaitID:        ws.DischargeID,
 	}
 
 	// Find all the possible login methods.
@@ -129,12 +209,31 @@ func (h *handler) RedirectLogin(p httprequest.Params, req *redirectLoginRequest)
 		if !idp.Interactive() {
 			continue
 		}
+		enabled, err := h.params.IDPStatus.Enabled(p.Context, idp.Name())
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !enabled {
+			continue
+		}
+		// Each identity provider is given its own copy of the
+		// login state, scoped to its own path.
+		state, err := h.params.codec.SetCookie(
+			p.Response,
+			idputil.LoginStateCookieName(idputil.IDPCookieNamePrefix(idp.Name())),
+			idputil.IDPCookiePath(idp.Name()),
+			ls,
+		)
+		if err != nil {
+			return errgo.Mask(err)
+		}
 		choice := params.IDPChoiceDetails{
 			Name:        idp.Name(),
 			Domain:      idp.Domain(),
 			Description: idp.Description(),
 			Icon:        idp.IconURL(),
 			URL:         idp.URL(state),
+			Category:    idp.Category(),
 		}
 		if !idp.Hidden() {
 			allIDPs = append(allIDPs, choice)
@@ -149,7 +248,14 @@ func (h *handler) RedirectLogin(p httprequest.Params, req *redirectLoginRequest)
 	if len(idps) == 0 {
 		idps = allIDPs
 	}
+	if h.params.RememberLastIDP {
+		idps = lastUsedFirst(idps, p.Request)
+	}
 	idpChoices := params.IDPChoice{IDPs: idps}
+	if req.Handoff != "" && h.params.LoginHandoffTimeout > 0 {
+		idpChoices.HandoffURL = h.handoffURL(req.Handoff)
+		idpChoices.HandoffQRCode = idputil.LocationURL(h.params.Location, "/login-handoff/qrcode?"+url.Values{"id": {req.Handoff}}.Encode())
+	}
 	if p.Request.Header.Get("Accept") == "application/json" {
 		httprequest.WriteJSON(p.Response, http.StatusOK, idpChoices)
 		return nil
@@ -160,6 +266,45 @@ func (h *handler) RedirectLogin(p httprequest.Params, req *redirectLoginRequest)
 	return nil
 }
 
+// lastIDPCookieName holds the name of the cookie that records the
+// identity provider most recently used to log in from a browser.
+const lastIDPCookieName = "candid-last-idp"
+
+// setLastIDPCookie records in the browser that the given identity
+// provider was used to log in.
+func setLastIDPCookie(w http.ResponseWriter, idpName string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     lastIDPCookieName,
+		Value:    idpName,
+		Path:     "/",
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+	})
+}
+
+// lastUsedFirst moves the identity provider recorded in the last used
+// cookie of the given request, if any, to the front of the given
+// choices and marks it as last used. The choices are returned
+// unchanged if there is no such cookie or the identity provider is not
+// one of the choices.
+func lastUsedFirst(choices []params.IDPChoiceDetails, req *http.Request) []params.IDPChoiceDetails {
+	cookie, err := req.Cookie(lastIDPCookieName)
+	if err != nil {
+		return choices
+	}
+	for i, choice := range choices {
+		if choice.Name != cookie.Value {
+			continue
+		}
+		choice.LastUsed = true
+		reordered := make([]params.IDPChoiceDetails, 0, len(choices))
+		reordered = append(reordered, choice)
+		reordered = append(reordered, choices[:i]...)
+		return append(reordered, choices[i+1:]...)
+	}
+	return choices
+}
+
 // loginCompleteRequest is a request that completes a login attempt.
 type loginCompleteRequest struct {
 	httprequest.Route `httprequest:"GET /login-complete"`
@@ -192,17 +337,23 @@ func (h *handler) LoginComplete(p httprequest.Params, req *loginCompleteRequest)
 		idputil.BadRequestf(p.Response, "invalid login state")
 		return
 	}
+	if !ws.Expires.IsZero() && ws.Expires.Before(time.Now()) {
+		h.params.visitCompleter.Failure(ctx, p.Response, p.Request, ws.DischargeID, errgo.New("login hand-off expired"))
+		return
+	}
 
 	if req.Error != "" {
 		err := &params.Error{
 			Message: req.Error,
 			Code:    params.ErrorCode(req.ErrorCode),
 		}
-		h.params.visitCompleter.Failure(ctx, p.Response, p.Request, ws.DischargeID, err)
+		// The failure was recorded in the audit log when it was
+		// reported by the identity provider.
+		h.params.visitCompleter.failure(ctx, p.Response, p.Request, ws.DischargeID, err)
 		return
 	}
 
-	dt, err := h.params.dischargeTokenStore.Get(ctx, req.Code)
+	dt, err := h.params.dischargeTokenStore.GetWithCodeVerifier(ctx, req.Code, "", idputil.LocationURL(h.params.Location, "/login-complete"))
 	if err != nil {
 		h.params.visitCompleter.Failure(ctx, p.Response, p.Request, ws.DischargeID, err)
 		return
@@ -217,4 +368,8 @@ const waitCookieName = "candid-discharge-wait"
 // is part of a interact/wait pair.
 type waitState struct {
 	DischargeID string
+
+	// Expires holds the time by which a login continued from a
+	// hand-off must complete. It is zero for other logins.
+	Expires time.Time
 }
@@ -5,17 +5,25 @@ package discharger_test
 
 import (
 	"encoding/json"
+	"html"
+	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
 	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	macaroon "gopkg.in/macaroon.v2"
 
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/idp/static"
@@ -23,6 +31,7 @@ import (
 	"github.com/canonical/candid/internal/candidtest"
 	"github.com/canonical/candid/internal/discharger"
 	"github.com/canonical/candid/internal/identity"
+	v1 "github.com/canonical/candid/internal/v1"
 	"github.com/canonical/candid/params"
 )
 
@@ -57,9 +66,10 @@ func (s *loginSuite) Init(c *qt.C) {
 			Icon: "/static/static1.bmp",
 		}),
 		static.NewIdentityProvider(static.Params{
-			Name:   "test2",
-			Domain: "test2",
-			Icon:   "/static/static2.bmp",
+			Name:     "test2",
+			Domain:   "test2",
+			Icon:     "/static/static2.bmp",
+			Category: "organization",
 		}),
 		static.NewIdentityProvider(static.Params{
 			Name:   "test3",
@@ -85,6 +95,180 @@ func (s *loginSuite) TestLegacyInteractiveLogin(c *qt.C) {
 	s.dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
 }
 
+func TestLegacyLoginDeprecation(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"test": {Password: "testpassword"},
+	}))
+	sp.Deprecations = map[string]identity.Deprecation{
+		"/login-legacy": {
+			Sunset:      time.Date(2021, 6, 30, 0, 0, 0, 0, time.UTC),
+			Link:        "https://example.com/deprecations",
+			Message:     "use /login instead",
+			BodyWarning: true,
+		},
+	}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+
+	req, err := http.NewRequest("GET", "/login-legacy", nil)
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Accept", "application/json")
+	resp := srv.Do(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Deprecation"), qt.Equals, "true")
+	c.Assert(resp.Header.Get("Sunset"), qt.Equals, "Wed, 30 Jun 2021 00:00:00 GMT")
+	c.Assert(resp.Header.Get("Link"), qt.Equals, `<https://example.com/deprecations>; rel="deprecation"`)
+	c.Assert(resp.Header.Get("Warning"), qt.Equals, `299 - "use /login instead"`)
+	var body map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	c.Assert(err, qt.IsNil)
+	c.Assert(body["warning"], qt.Equals, "use /login instead")
+	c.Assert(body["agent"], qt.Equals, srv.URL+"/login/legacy-agent")
+
+	// Other endpoints are not marked as deprecated.
+	req, err = http.NewRequest("GET", "/login", nil)
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Accept", "application/json")
+	resp1 := srv.Do(c, req)
+	defer resp1.Body.Close()
+	c.Assert(resp1.Header.Get("Deprecation"), qt.Equals, "")
+
+	// The legacy login still works.
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "test", "testpassword"),
+	})
+	dc := candidtest.NewDischargeCreator(srv)
+	ms, err := dc.Discharge(c, "<is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	dc.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+}
+
+func TestLegacyLoginDisabled(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"test": {Password: "testpassword"},
+	}))
+	sp.DisableLegacyLogin = true
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+
+	for _, path := range []string{"/login-legacy", "/login/legacy-agent", "/wait-legacy"} {
+		req, err := http.NewRequest("GET", path, nil)
+		c.Assert(err, qt.IsNil)
+		req.Header.Set("Accept", "application/json")
+		resp := srv.Do(c, req)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusNotFound, qt.Commentf("%s", path))
+		var perr params.Error
+		err = json.NewDecoder(resp.Body).Decode(&perr)
+		c.Assert(err, qt.IsNil)
+		c.Assert(perr, qt.DeepEquals, params.Error{
+			Code:    params.ErrNotFound,
+			Message: "endpoint disabled: legacy login is not supported",
+		})
+	}
+	req, err := http.NewRequest("POST", "/login/legacy-agent", strings.NewReader(`{"username":"bob"}`))
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	resp := srv.Do(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotFound)
+
+	dc := candidtest.NewDischargeCreator(srv)
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "test", "testpassword"),
+	})
+	// Clients that can only use the legacy protocol cannot log in.
+	_, err = dc.Discharge(c, "<is-authenticated-user", client)
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	// The current login protocols are unaffected.
+	ms, err := dc.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	dc.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+}
+
+func TestNonInteractiveLoginChain(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"bob": {Password: "bobpassword"},
+	}))
+	sp.NonInteractiveLoginChain = []string{"agent", "test"}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	login := func(user, password string) *http.Response {
+		req, err := http.NewRequest("POST", "/login-non-interactive", nil)
+		c.Assert(err, qt.IsNil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		return srv.Do(c, req)
+	}
+
+	// The request holds no macaroons, so the agent method declines
+	// and the static identity provider logs the user in.
+	resp := login("bob", "bobpassword")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	var lresp struct {
+		DischargeToken *httpbakery.DischargeToken `json:"discharge-token"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&lresp)
+	c.Assert(err, qt.IsNil)
+	c.Assert(lresp.DischargeToken, qt.Not(qt.IsNil))
+	var m macaroon.Macaroon
+	err = m.UnmarshalBinary(lresp.DischargeToken.Value)
+	c.Assert(err, qt.IsNil)
+	declared := checkers.InferDeclared(auth.Namespace, macaroon.Slice{&m})
+	c.Assert(declared["username"], qt.Equals, "bob")
+	expiry, ok := checkers.ExpiryTime(auth.Namespace, m.Caveats())
+	c.Assert(ok, qt.IsTrue)
+
+	// Logging in with the resulting macaroon keeps the original
+	// authentication time and does not extend the expiry time.
+	req, err := http.NewRequest("POST", "/login-non-interactive", nil)
+	c.Assert(err, qt.IsNil)
+	cookie, err := httpbakery.NewCookie(auth.Namespace, macaroon.Slice{&m})
+	c.Assert(err, qt.IsNil)
+	req.AddCookie(cookie)
+	resp = srv.Do(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	err = json.NewDecoder(resp.Body).Decode(&lresp)
+	c.Assert(err, qt.IsNil)
+	var m2 macaroon.Macaroon
+	err = m2.UnmarshalBinary(lresp.DischargeToken.Value)
+	c.Assert(err, qt.IsNil)
+	declared2 := checkers.InferDeclared(auth.Namespace, macaroon.Slice{&m2})
+	c.Assert(declared2["username"], qt.Equals, "bob")
+	c.Assert(declared2["auth-time"], qt.Equals, declared["auth-time"])
+	expiry2, ok := checkers.ExpiryTime(auth.Namespace, m2.Caveats())
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(expiry2.After(expiry), qt.IsFalse)
+
+	// Credentials that are rejected fail the login.
+	resp = login("bob", "wrong")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+	// The login fails if every method declines.
+	resp = login("", "")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+	var perr params.Error
+	err = json.NewDecoder(resp.Body).Decode(&perr)
+	c.Assert(err, qt.IsNil)
+	c.Assert(perr.Message, qt.Equals, "no non-interactive login method accepted the request")
+}
+
 func (s *loginSuite) TestLegacyNonInteractiveLogin(c *qt.C) {
 	client := s.srv.AdminClient()
 	// Use "<is-authenticated-user" to force legacy interaction
@@ -184,6 +368,7 @@ func (s *loginSuite) TestLoginIDPChoice(c *qt.C) {
 			Icon:        s.srv.URL + "/static/static2.bmp",
 			Name:        "test2",
 			URL:         s.srv.URL + "/login/test2/login",
+			Category:    "organization",
 		}},
 	})
 }
@@ -289,3 +474,382 @@ func (s *loginSuite) TestLoginRedirect(c *qt.C) {
 	c.Assert(q.Get("state"), qt.Equals, "12345")
 	c.Assert(q.Get("code"), qt.Not(qt.Equals), "")
 }
+
+func (s *loginSuite) TestLoginRedirectLoginStateCookies(c *qt.C) {
+	req, err := http.NewRequest("GET", "/login-redirect?return_to=https://example.com/callback&state=12345", nil)
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Accept", "application/json")
+	resp := s.srv.Do(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	var choice params.IDPChoice
+	err = json.NewDecoder(resp.Body).Decode(&choice)
+	c.Assert(err, qt.IsNil)
+
+	// Each identity provider is sent its own login state cookie.
+	paths := make(map[string]string)
+	for _, cookie := range resp.Cookies() {
+		paths[cookie.Name] = cookie.Path
+	}
+	c.Assert(len(choice.IDPs) > 0, qt.IsTrue)
+	for _, idp := range choice.IDPs {
+		c.Assert(paths["candid-login-"+idp.Name+"-login"], qt.Equals, "/login/"+idp.Name)
+	}
+	_, ok := paths["candid-login"]
+	c.Assert(ok, qt.IsFalse)
+}
+
+var lastUsedIDPTests = []struct {
+	about       string
+	cookie      string
+	domain      string
+	expectNames []string
+	expectLast  string
+}{{
+	about:       "no cookie",
+	expectNames: []string{"test", "test2"},
+}, {
+	about:       "last used moved first",
+	cookie:      "test2",
+	expectNames: []string{"test2", "test"},
+	expectLast:  "test2",
+}, {
+	about:       "hidden identity provider not shown",
+	cookie:      "test3",
+	expectNames: []string{"test", "test2"},
+}, {
+	about:       "domain filtering applied",
+	cookie:      "test",
+	domain:      "test2",
+	expectNames: []string{"test2"},
+}, {
+	about:       "unknown identity provider",
+	cookie:      "no-such-idp",
+	expectNames: []string{"test", "test2"},
+}}
+
+func TestLoginIDPChoiceLastUsed(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp.RememberLastIDP = true
+	sp.RedirectLoginWhitelist = []string{
+		"https://example.com/callback",
+	}
+	sp = candidtest.WithIDPs(sp,
+		candidtest.StaticIDP("test", map[string]static.UserInfo{
+			"test": {Password: "testpassword"},
+		}),
+		candidtest.DomainIDP("test2", "test2", nil),
+		candidtest.HiddenIDP("test3", "test3", nil),
+	)
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	for _, test := range lastUsedIDPTests {
+		c.Run(test.about, func(c *qt.C) {
+			v := url.Values{
+				"return_to": {"https://example.com/callback"},
+				"state":     {"12345"},
+			}
+			if test.domain != "" {
+				v.Set("domain", test.domain)
+			}
+			req, err := http.NewRequest("GET", "/login-redirect?"+v.Encode(), nil)
+			c.Assert(err, qt.IsNil)
+			req.Header.Set("Accept", "application/json")
+			if test.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "candid-last-idp", Value: test.cookie})
+			}
+			resp := srv.Do(c, req)
+			defer resp.Body.Close()
+			c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+			var choice params.IDPChoice
+			err = json.NewDecoder(resp.Body).Decode(&choice)
+			c.Assert(err, qt.IsNil)
+			var names []string
+			last := ""
+			for _, ch := range choice.IDPs {
+				names = append(names, ch.Name)
+				if ch.LastUsed {
+					c.Assert(last, qt.Equals, "")
+					last = ch.Name
+				}
+			}
+			c.Assert(names, qt.DeepEquals, test.expectNames)
+			c.Assert(last, qt.Equals, test.expectLast)
+		})
+	}
+
+	// A successful login records the identity provider used.
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, qt.IsNil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host == "example.com" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(srv.URL + "/login-redirect?return_to=https://example.com/callback&state=12345")
+	c.Assert(err, qt.IsNil)
+	resp, err = candidtest.SelectInteractiveLogin(candidtest.PostLoginForm("test", "testpassword"))(client, resp)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+	u, err := url.Parse(srv.URL)
+	c.Assert(err, qt.IsNil)
+	var lastIDP string
+	for _, cookie := range jar.Cookies(u) {
+		if cookie.Name == "candid-last-idp" {
+			lastIDP = cookie.Value
+		}
+	}
+	c.Assert(lastIDP, qt.Equals, "test")
+}
+
+var (
+	idpLinkRE    = regexp.MustCompile(`<a href="([^"]*)"[^>]*data-idp-name="test"`)
+	formActionRE = regexp.MustCompile(`<form[^>]*method="post" action="([^"]*)"`)
+)
+
+// TestLoginWithoutJavaScript checks that a browser-redirect login can
+// be completed using the bundled templates with nothing more than
+// links and plain form posts, as a browser without JavaScript would.
+func TestLoginWithoutJavaScript(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	tmpl, err := template.New("").ParseGlob(filepath.Join("..", "..", "templates", "*"))
+	c.Assert(err, qt.IsNil)
+	sp.Template = tmpl
+	sp.RedirectLoginWhitelist = []string{
+		"https://example.com/callback",
+	}
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"test": {Password: "testpassword"},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	jar, err := cookiejar.New(nil)
+	c.Assert(err, qt.IsNil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host == "example.com" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+
+	// getPage fetches the given URL and returns the page body
+	// along with the URL it was served from.
+	getPage := func(u string) (string, *url.URL) {
+		resp, err := client.Get(u)
+		c.Assert(err, qt.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(body), qt.Not(qt.Contains), "<script")
+		return string(body), resp.Request.URL
+	}
+
+	// The chooser is a list of plain links.
+	body, pageURL := getPage(srv.URL + "/login-redirect?return_to=https://example.com/callback&state=12345")
+	m := idpLinkRE.FindStringSubmatch(body)
+	c.Assert(m, qt.Not(qt.IsNil), qt.Commentf("no link in %s", body))
+	link, err := pageURL.Parse(html.UnescapeString(m[1]))
+	c.Assert(err, qt.IsNil)
+
+	// The login form is a plain form post.
+	body, pageURL = getPage(link.String())
+	m = formActionRE.FindStringSubmatch(body)
+	c.Assert(m, qt.Not(qt.IsNil), qt.Commentf("no form in %s", body))
+	action, err := pageURL.Parse(html.UnescapeString(m[1]))
+	c.Assert(err, qt.IsNil)
+	resp, err := client.PostForm(action.String(), url.Values{
+		"username": {"test"},
+		"password": {"testpassword"},
+	})
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusSeeOther)
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(loc.Host, qt.Equals, "example.com")
+	c.Assert(loc.Query().Get("state"), qt.Equals, "12345")
+	c.Assert(loc.Query().Get("code"), qt.Not(qt.Equals), "")
+}
+
+func TestLoginHandoff(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp.LoginHandoffTimeout = time.Minute
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"test": {Password: "testpassword"},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	dischargeCreator := candidtest.NewDischargeCreator(srv)
+
+	var handoffURL, qrCodeURL string
+	client := srv.Client(httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: func(u *url.URL) error {
+			// The first device shows the identity provider
+			// choices, including the hand-off QR code, but
+			// does not log in.
+			req, err := http.NewRequest("GET", u.String(), nil)
+			c.Assert(err, qt.IsNil)
+			req.Header.Set("Accept", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			c.Assert(err, qt.IsNil)
+			defer resp.Body.Close()
+			c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+			var choice params.IDPChoice
+			err = json.NewDecoder(resp.Body).Decode(&choice)
+			c.Assert(err, qt.IsNil)
+			handoffURL, qrCodeURL = choice.HandoffURL, choice.HandoffQRCode
+			c.Assert(handoffURL, qt.Matches, regexp.QuoteMeta(srv.URL)+`/login-handoff\?id=.+`)
+
+			resp, err = http.Get(qrCodeURL)
+			c.Assert(err, qt.IsNil)
+			defer resp.Body.Close()
+			c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+			c.Assert(resp.Header.Get("Content-Type"), qt.Equals, "image/svg+xml")
+
+			// The second device opens the hand-off URL and
+			// logs in.
+			return candidtest.PasswordLogin(c, "test", "testpassword")(mustParseURL(c, handoffURL))
+		},
+	})
+	ms, err := dischargeCreator.Discharge(c, "is-authenticated-user", client)
+	c.Assert(err, qt.IsNil)
+	dischargeCreator.AssertMacaroon(c, ms, identchecker.LoginOp, "test")
+
+	// The hand-off can only be used once.
+	resp, err := http.Get(handoffURL)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+	resp, err = http.Get(qrCodeURL)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func TestLoginHandoffNotRepeated(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp.LoginHandoffTimeout = time.Minute
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"test": {Password: "testpassword"},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	choices := func(u string) params.IDPChoice {
+		req, err := http.NewRequest("GET", u, nil)
+		c.Assert(err, qt.IsNil)
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, qt.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+		var choice params.IDPChoice
+		err = json.NewDecoder(resp.Body).Decode(&choice)
+		c.Assert(err, qt.IsNil)
+		return choice
+	}
+	choice := choices(srv.URL + "/login?did=1234")
+	c.Assert(choice.HandoffURL, qt.Not(qt.Equals), "")
+
+	// The login continued on the other device cannot itself be
+	// handed off, so the hand-off cannot be renewed.
+	choice2 := choices(choice.HandoffURL)
+	c.Assert(choice2.HandoffURL, qt.Equals, "")
+	c.Assert(choice2.HandoffQRCode, qt.Equals, "")
+
+	resp, err := http.Get(choice.HandoffURL)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func TestLoginHandoffDisabled(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", map[string]static.UserInfo{
+		"test": {Password: "testpassword"},
+	}))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+	})
+	req, err := http.NewRequest("GET", "/login?did=1234", nil)
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Accept", "application/json")
+	resp := srv.Do(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	var choice params.IDPChoice
+	err = json.NewDecoder(resp.Body).Decode(&choice)
+	c.Assert(err, qt.IsNil)
+	c.Assert(choice.HandoffURL, qt.Equals, "")
+	c.Assert(choice.HandoffQRCode, qt.Equals, "")
+
+	resp = srv.Get(c, "/login-handoff?id=1234")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+func TestLoginIDPDisabled(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp = candidtest.WithIDPs(sp,
+		candidtest.StaticIDP("test", map[string]static.UserInfo{
+			"test": {Password: "testpassword"},
+		}),
+		candidtest.StaticIDP("test2", map[string]static.UserInfo{
+			"test": {Password: "testpassword"},
+		}),
+	)
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	err := srv.AdminIdentityClient(false).SetIDPEnabled(srv.Ctx, &params.SetIDPEnabledRequest{
+		IDP: "test2",
+	})
+	c.Assert(err, qt.IsNil)
+
+	// The disabled identity provider is not offered as a choice.
+	req, err := http.NewRequest("GET", "/login", nil)
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Accept", "application/json")
+	resp := srv.Do(c, req)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	var choice params.IDPChoice
+	err = json.NewDecoder(resp.Body).Decode(&choice)
+	c.Assert(err, qt.IsNil)
+	c.Assert(choice.IDPs, qt.HasLen, 1)
+	c.Assert(choice.IDPs[0].Name, qt.Equals, "test")
+
+	// Logins with the disabled identity provider are rejected.
+	resp = srv.Get(c, "/login/test2/login")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusServiceUnavailable)
+	var perr params.Error
+	err = json.NewDecoder(resp.Body).Decode(&perr)
+	c.Assert(err, qt.IsNil)
+	c.Assert(perr.Message, qt.Equals, "login with test2 is currently disabled")
+}
+
+func mustParseURL(c *qt.C, s string) *url.URL {
+	u, err := url.Parse(s)
+	c.Assert(err, qt.IsNil)
+	return u
+}
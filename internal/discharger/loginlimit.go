@@ -0,0 +1,113 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/internal/auth/httpauth"
+	"github.com/canonical/candid/internal/monitoring"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/ratelimit"
+)
+
+// checkLoginRate checks that the configured login rate limits allow
+// the given login request. The client limit is applied to each client
+// address, so that an attacker cannot avoid the limit by trying many
+// usernames. The login limit is applied to each client address
+// combined with the submitted username, if any, taken from the form or
+// from HTTP basic authentication credentials, so that an attacker
+// making requests for a username cannot prevent its owner logging in
+// from elsewhere. If either limit has been exceeded an error with a
+// cause of params.ErrTooManyRequests is returned. The request form
+// must already have been parsed.
+func checkLoginRate(ctx context.Context, limiter, clientLimiter ratelimit.Limiter, trustedProxies []*net.IPNet, idpName string, req *http.Request) error {
+	if limiter == nil && clientLimiter == nil {
+		return nil
+	}
+	filter := httpauth.IPFilter{
+		TrustedProxies: trustedProxies,
+	}
+	key := filter.ClientIP(req).String()
+	allowed := allowLogin(ctx, clientLimiter, key)
+	if allowed {
+		username := req.Form.Get("username")
+		if username == "" {
+			username, _, _ = req.BasicAuth()
+		}
+		if username != "" {
+			key += " " + username
+		}
+		allowed = allowLogin(ctx, limiter, key)
+	}
+	if !allowed {
+		monitoring.LoginRejected(idpName)
+		return errgo.WithCausef(nil, params.ErrTooManyRequests, "too many login attempts, try again later")
+	}
+	return nil
+}
+
+// allowLogin reports whether the given limiter, if any, allows a login
+// request with the given key. Requests are allowed if the limiter
+// fails.
+func allowLogin(ctx context.Context, limiter ratelimit.Limiter, key string) bool {
+	if limiter == nil {
+		return true
+	}
+	ok, err := limiter.Allow(ctx, key)
+	if err != nil {
+		logger.Errorf("cannot check login rate limit: %s", err)
+		return true
+	}
+	return ok
+}
+
+// A loginLimiter limits the number of login requests to a single
+// identity provider that can be in progress at the same time.
+type loginLimiter struct {
+	idp string
+
+	// slots holds a token for each login in progress. If this is
+	// nil the number of logins is not limited.
+	slots chan struct{}
+}
+
+func newLoginLimiter(idp string, max int) *loginLimiter {
+	l := &loginLimiter{
+		idp: idp,
+	}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+// acquire reserves a slot for a new login. If the limit has already
+// been reached then an error with a cause of params.ErrTooManyRequests
+// is returned, rather than waiting for a slot to become free. A
+// successful call to acquire must be followed by a call to release.
+func (l *loginLimiter) acquire() error {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			monitoring.LoginRejected(l.idp)
+			return errgo.WithCausef(nil, params.ErrTooManyRequests, "too many logins in progress with %s, try again shortly", l.idp)
+		}
+	}
+	monitoring.LoginStarted(l.idp)
+	return nil
+}
+
+// release frees the slot reserved by acquire.
+func (l *loginLimiter) release() {
+	monitoring.LoginFinished(l.idp)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
@@ -54,7 +54,7 @@ func (p *place) Done(ctx context.Context, id string, info *loginInfo) error {
 func (p *place) Wait(ctx context.Context, id string) (*dischargeRequestInfo, *loginInfo, error) {
 	reqData, loginData, err := p.place.Wait(ctx, id)
 	if err != nil {
-		return nil, nil, errgo.Notef(err, "cannot wait")
+		return nil, nil, errgo.NoteMask(err, "cannot wait", errgo.Is(meeting.ErrExpired))
 	}
 	var info dischargeRequestInfo
 	if err := json.Unmarshal(reqData, &info); err != nil {
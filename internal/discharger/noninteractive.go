@@ -0,0 +1,205 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/internal/monitoring"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// agentLoginMethod is the name of the built-in method in the
+// non-interactive login chain that accepts a login macaroon held in
+// the request, such as one obtained by an agent login.
+const agentLoginMethod = agentIDP
+
+// A nonInteractiveLoginMethod is a single method in the non-interactive
+// login chain. The authenticate function behaves like
+// idp.NonInteractiveAuthenticator.AuthenticateRequest, but also
+// returns the context in which the login should be completed.
+type nonInteractiveLoginMethod struct {
+	name         string
+	authenticate func(ctx context.Context, req *http.Request) (context.Context, func(context.Context) (*store.Identity, error), error)
+}
+
+// newNonInteractiveLoginChain creates the non-interactive login chain
+// from the names in params.NonInteractiveLoginChain. Each name must be
+// agentLoginMethod or the name of an identity provider that implements
+// idp.NonInteractiveAuthenticator.
+func newNonInteractiveLoginChain(params identity.HandlerParams) ([]nonInteractiveLoginMethod, error) {
+	var chain []nonInteractiveLoginMethod
+	for _, name := range params.NonInteractiveLoginChain {
+		if name == agentLoginMethod {
+			chain = append(chain, nonInteractiveLoginMethod{
+				name:         name,
+				authenticate: agentAuthenticator(params.Authorizer),
+			})
+			continue
+		}
+		var authenticator idp.NonInteractiveAuthenticator
+		for _, ip := range params.IdentityProviders {
+			if ip.Name() == name {
+				authenticator, _ = ip.(idp.NonInteractiveAuthenticator)
+				if authenticator == nil {
+					return nil, errgo.Newf("identity provider %q does not support non-interactive login", name)
+				}
+				break
+			}
+		}
+		if authenticator == nil {
+			return nil, errgo.Newf("unknown non-interactive login method %q", name)
+		}
+		chain = append(chain, nonInteractiveLoginMethod{
+			name: name,
+			authenticate: func(ctx context.Context, req *http.Request) (context.Context, func(context.Context) (*store.Identity, error), error) {
+				commit, err := authenticator.AuthenticateRequest(ctx, req)
+				return ctx, commit, err
+			},
+		})
+	}
+	return chain, nil
+}
+
+// agentAuthenticator returns an authentication function that accepts
+// requests holding macaroons that authenticate a user. As such a login
+// renews an existing identity macaroon, the discharge token it creates
+// keeps the time at which the user originally authenticated and does
+// not expire after the macaroons used to log in, so that repeated
+// logins cannot extend the session indefinitely.
+func agentAuthenticator(a *auth.Authorizer) func(context.Context, *http.Request) (context.Context, func(context.Context) (*store.Identity, error), error) {
+	return func(ctx context.Context, req *http.Request) (context.Context, func(context.Context) (*store.Identity, error), error) {
+		ms := httpbakery.RequestMacaroons(req)
+		if len(ms) == 0 {
+			return nil, nil, errgo.WithCausef(nil, idp.ErrLoginDeclined, "no macaroons")
+		}
+		authInfo, err := a.Auth(httpbakery.ContextWithRequest(ctx, req), ms, identchecker.LoginOp)
+		if err != nil {
+			return nil, nil, errgo.WithCausef(err, idp.ErrLoginDeclined, "macaroons do not authenticate a user")
+		}
+		id, ok := authInfo.Identity.(*auth.Identity)
+		if !ok {
+			return nil, nil, errgo.WithCausef(nil, idp.ErrLoginDeclined, "macaroons do not authenticate a user")
+		}
+		var expiry time.Time
+		for _, m := range authInfo.Macaroons {
+			if t, ok := checkers.MacaroonsExpiryTime(auth.Namespace, m); ok && (expiry.IsZero() || t.Before(expiry)) {
+				expiry = t
+			}
+		}
+		if expiry.IsZero() {
+			return nil, nil, errgo.WithCausef(nil, idp.ErrLoginDeclined, "macaroons do not expire")
+		}
+		authTime, _ := a.AuthTime(ctx, authInfo.Macaroons)
+		ctx = contextWithAuthTime(ctx, authTime, expiry)
+		return ctx, func(context.Context) (*store.Identity, error) {
+			return &id.Identity, nil
+		}, nil
+	}
+}
+
+// nonInteractiveLoginRequest is a request to log in using the
+// non-interactive login chain.
+type nonInteractiveLoginRequest struct {
+	httprequest.Route `httprequest:"POST /login-non-interactive"`
+	DischargeID       string `httprequest:"did,form"`
+}
+
+// nonInteractiveLoginResponse holds the response to a successful
+// non-interactive login.
+type nonInteractiveLoginResponse struct {
+	DischargeToken *httpbakery.DischargeToken `json:"discharge-token"`
+}
+
+// NonInteractiveLogin logs in a non-interactive client by trying each
+// method in the configured non-interactive login chain in turn. Methods
+// that find no credentials for them in the request decline, and the
+// next method is tried. The login completes with the first method that
+// accepts the request; if a method rejects the credentials it holds the
+// login fails. Methods whose identity provider has been disabled are
+// skipped.
+func (h *handler) NonInteractiveLogin(p httprequest.Params, req *nonInteractiveLoginRequest) (*nonInteractiveLoginResponse, error) {
+	if len(h.params.nonInteractiveLoginChain) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "non-interactive login is not configured")
+	}
+	ctx := p.Context
+	p.Request.ParseForm()
+	if err := checkLoginRate(ctx, h.params.LoginRateLimiter, h.params.LoginClientRateLimiter, h.params.TrustedProxies, "non-interactive", p.Request); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrTooManyRequests))
+	}
+	for _, m := range h.params.nonInteractiveLoginChain {
+		enabled, err := h.params.IDPStatus.Enabled(ctx, m.name)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if !enabled {
+			logger.Debugf("non-interactive login method %s skipped: identity provider disabled", m.name)
+			continue
+		}
+		mctx, commit, err := m.authenticate(ctx, p.Request)
+		if errgo.Cause(err) == idp.ErrLoginDeclined {
+			logger.Debugf("non-interactive login method %s declined: %s", m.name, err)
+			continue
+		}
+		var dt *httpbakery.DischargeToken
+		if err == nil {
+			dt, err = h.completeNonInteractiveLogin(contextWithIDP(mctx, m.name), p.Request, req.DischargeID, commit)
+		}
+		if err != nil {
+			h.params.visitCompleter.auditFailure(contextWithIDP(ctx, m.name), p.Request, req.DischargeID, err)
+			monitoring.LoginFailed(m.name, err)
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if req.DischargeID != "" {
+			if err := h.params.place.Done(ctx, req.DischargeID, &loginInfo{DischargeToken: dt}); err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		return &nonInteractiveLoginResponse{DischargeToken: dt}, nil
+	}
+	err := errgo.WithCausef(nil, params.ErrUnauthorized, "no non-interactive login method accepted the request")
+	h.params.visitCompleter.auditFailure(ctx, p.Request, req.DischargeID, err)
+	return nil, err
+}
+
+// completeNonInteractiveLogin commits the login accepted by a method in
+// the non-interactive login chain and creates a discharge token for the
+// authenticated identity. The login is subject to the same checks as an
+// interactive login, except that a user that has not completed
+// onboarding cannot log in as onboarding is interactive. The login is
+// recorded in the audit log as completing the discharge wait with the
+// given ID, if any.
+func (h *handler) completeNonInteractiveLogin(ctx context.Context, req *http.Request, waitID string, commit func(context.Context) (*store.Identity, error)) (*httpbakery.DischargeToken, error) {
+	id, err := commit(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	vc := h.params.visitCompleter
+	if err := vc.checkLogin(ctx, req, id); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if err := vc.checkOnboarded(ctx, id); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+	dt, expires, err := h.params.dischargeTokenCreator.dischargeToken(ctx, id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	h.params.visitCompleter.auditSuccess(ctx, req, waitID, id, expires)
+	h.params.visitCompleter.sendLoginEvent(id)
+	monitoring.LoginSucceeded(id.ProviderID.Provider(), id.Username)
+	return dt, nil
+}
@@ -0,0 +1,289 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// onboardingTimeout holds the time a user has to complete onboarding
+// before the login must be started again.
+const onboardingTimeout = 30 * time.Minute
+
+// An onboardingState holds the state of a login that is waiting for
+// the user to complete onboarding.
+type onboardingState struct {
+	// ProviderID holds the provider ID of the identity being
+	// onboarded.
+	ProviderID store.ProviderIdentity
+
+	// IDP holds the name of the identity provider the user logged
+	// in with.
+	IDP string `json:",omitempty"`
+
+	// DeviceClass holds the class of device the user logged in
+	// from.
+	DeviceClass string `json:",omitempty"`
+
+	// DischargeID holds the discharge ID of a login that will be
+	// completed with Success.
+	DischargeID string `json:",omitempty"`
+
+	// ReturnTo and State hold the parameters of a login that will
+	// be completed with RedirectSuccess.
+	ReturnTo string `json:",omitempty"`
+	State    string `json:",omitempty"`
+
+	// CodeChallenge holds the PKCE code challenge of a redirect
+	// login, if any.
+	CodeChallenge *idputil.CodeChallenge `json:",omitempty"`
+
+	// SessionID holds the correlation ID of the anonymous session
+	// upgraded by a redirect login, if any.
+	SessionID string `json:",omitempty"`
+
+	// WaitID holds the ID of the discharge wait that a redirect
+	// login completes, if any.
+	WaitID string `json:",omitempty"`
+
+	// TokenExpiry holds the expiry time of the token issued by the
+	// identity provider, if known.
+	TokenExpiry time.Time
+
+	// Completed records whether the onboarding service has
+	// confirmed that the user completed onboarding.
+	Completed bool `json:",omitempty"`
+
+	// Expires holds the time after which the onboarding can no
+	// longer be completed.
+	Expires time.Time
+}
+
+// needsOnboarding determines whether the given identity must complete
+// onboarding before the login can complete. Onboarding is only required
+// the first time the identity logs in, and not once the identity has
+// been recorded as having completed it.
+func (c *visitCompleter) needsOnboarding(ctx context.Context, id *store.Identity) (bool, error) {
+	if c.params.Onboarding == nil || !id.LastLogin.IsZero() {
+		return false, nil
+	}
+	_, err := c.onboardingStore.Get(ctx, onboardedKey(id.ProviderID))
+	if err == nil {
+		return false, nil
+	}
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return true, nil
+	}
+	return false, errgo.Mask(err)
+}
+
+// checkOnboarded checks that the given identity does not still need to
+// complete onboarding. It is called before any discharge token is
+// issued for an interactive login.
+func (c *visitCompleter) checkOnboarded(ctx context.Context, id *store.Identity) error {
+	needs, err := c.needsOnboarding(ctx, id)
+	if err != nil {
+		return errgo.Notef(err, "cannot check onboarding")
+	}
+	if needs {
+		return errgo.WithCausef(nil, params.ErrForbidden, "onboarding not completed")
+	}
+	return nil
+}
+
+// onboardedKey returns the key used to record that the identity with
+// the given provider ID has completed onboarding.
+func onboardedKey(pid store.ProviderIdentity) string {
+	return "onboarded:" + string(pid)
+}
+
+// startOnboarding saves the given login state and passes the user to
+// the configured onboarding handler. The login is completed when the
+// handler returns the user to /login-onboarded.
+func (c *visitCompleter) startOnboarding(ctx context.Context, w http.ResponseWriter, req *http.Request, id *store.Identity, st onboardingState) error {
+	key, err := c.params.TokenGenerator.Generate()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	st.ProviderID = id.ProviderID
+	st.IDP = idpFromContext(ctx)
+	st.DeviceClass = deviceClassFromContext(ctx)
+	st.CodeChallenge = idputil.CodeChallengeFromContext(ctx)
+	st.SessionID = idputil.SessionIDFromContext(ctx)
+	st.WaitID = waitIDFromContext(ctx)
+	st.TokenExpiry, _ = idputil.TokenExpiryFromContext(ctx)
+	st.Expires = time.Now().Add(onboardingTimeout)
+	b, err := json.Marshal(st)
+	if err != nil {
+		// This should be impossible.
+		panic(err)
+	}
+	if err := c.onboardingStore.Set(ctx, key, b, st.Expires); err != nil {
+		return errgo.Mask(err)
+	}
+	returnTo := idputil.LocationURL(c.params.Location, "/login-onboarded?"+url.Values{"id": {key}}.Encode())
+	return errgo.Mask(c.params.Onboarding.Onboard(ctx, w, req, id, returnTo), errgo.Any)
+}
+
+// finishOnboarding retrieves the login state stored with the given key.
+// Each state can only be retrieved once.
+func (c *visitCompleter) finishOnboarding(ctx context.Context, key string) (*onboardingState, error) {
+	var st onboardingState
+	err := c.onboardingStore.Update(ctx, key, time.Now(), func(old []byte) ([]byte, error) {
+		if len(old) == 0 {
+			return nil, errgo.WithCausef(nil, store.ErrNotFound, "")
+		}
+		if err := json.Unmarshal(old, &st); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return []byte{}, nil
+	})
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			err = errgo.WithCausef(err, store.ErrNotFound, "")
+		}
+		return nil, errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	if st.Expires.Before(time.Now()) {
+		return nil, errgo.WithCausef(nil, store.ErrNotFound, "")
+	}
+	return &st, nil
+}
+
+// completeOnboarding records that the user waiting on the onboarding
+// state stored with the given key has completed onboarding. If there
+// is no such state an error with a cause of params.ErrNotFound is
+// returned.
+func (c *visitCompleter) completeOnboarding(ctx context.Context, key string) error {
+	err := c.onboardingStore.Update(ctx, key, time.Time{}, func(old []byte) ([]byte, error) {
+		var st onboardingState
+		if len(old) == 0 {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+		}
+		if err := json.Unmarshal(old, &st); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if st.Expires.Before(time.Now()) {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+		}
+		st.Completed = true
+		return json.Marshal(st)
+	})
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			err = errgo.WithCausef(err, params.ErrNotFound, "")
+		}
+		if errgo.Cause(err) == params.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "onboarding state not found")
+		}
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// onboardingCompleteRequest is the request made by the onboarding
+// service to confirm that a user has completed onboarding.
+type onboardingCompleteRequest struct {
+	httprequest.Route `httprequest:"POST /login-onboarded"`
+
+	// ID holds the key of the stored login state, as given in the
+	// return_to address.
+	ID string `httprequest:"id,form"`
+}
+
+// OnboardingComplete records that the user has completed onboarding.
+// The request must be authenticated as the configured OnboardingAgent.
+// The login is not completed until the user returns to
+// /login-onboarded.
+func (h *handler) OnboardingComplete(p httprequest.Params, req *onboardingCompleteRequest) error {
+	if h.params.Onboarding == nil || h.params.OnboardingAgent == "" {
+		return errgo.WithCausef(nil, params.ErrNotFound, "onboarding is not enabled")
+	}
+	authInfo, err := h.params.reqAuth.Auth(p.Context, p.Request, identchecker.LoginOp)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if authInfo.Identity == nil || authInfo.Identity.Id() != h.params.OnboardingAgent {
+		return errgo.WithCausef(nil, params.ErrUnauthorized, "request not authenticated as %q", h.params.OnboardingAgent)
+	}
+	return errgo.Mask(h.params.visitCompleter.completeOnboarding(p.Context, req.ID), errgo.Is(params.ErrNotFound))
+}
+
+// onboardedRequest is the request made when the onboarding handler
+// returns the user to candid.
+type onboardedRequest struct {
+	httprequest.Route `httprequest:"GET /login-onboarded"`
+
+	// ID holds the key of the stored login state.
+	ID string `httprequest:"id,form"`
+
+	// Error holds the reason onboarding failed, if it did.
+	Error string `httprequest:"error,form"`
+}
+
+// Onboarded handles the user returning from onboarding.
+func (h *handler) Onboarded(p httprequest.Params, req *onboardedRequest) {
+	h.params.visitCompleter.onboarded(p.Context, p.Response, p.Request, req.ID, req.Error)
+}
+
+// onboarded completes the login stored with the given key once the
+// user has returned from onboarding. If onboardingError is not empty
+// onboarding failed and so the login fails.
+func (c *visitCompleter) onboarded(ctx context.Context, w http.ResponseWriter, req *http.Request, key, onboardingError string) {
+	st, err := c.finishOnboarding(ctx, key)
+	if err != nil {
+		logger.Infof("cannot complete onboarding: %s", err)
+		idputil.BadRequestf(w, "invalid onboarding state")
+		return
+	}
+	if st.IDP != "" {
+		ctx = contextWithIDP(ctx, st.IDP)
+	}
+	if st.DeviceClass != "" {
+		ctx = contextWithDeviceClass(ctx, st.DeviceClass)
+	}
+	ctx = idputil.ContextWithCodeChallenge(ctx, st.CodeChallenge)
+	ctx = idputil.ContextWithSessionID(ctx, st.SessionID)
+	ctx = contextWithWaitID(ctx, st.WaitID)
+	ctx = idputil.ContextWithTokenExpiry(ctx, st.TokenExpiry)
+	id := &store.Identity{
+		ProviderID: st.ProviderID,
+	}
+	err = c.params.Store.Identity(ctx, id)
+	if err == nil && onboardingError != "" {
+		err = errgo.WithCausef(nil, params.ErrForbidden, "onboarding failed: %s", onboardingError)
+	}
+	if err == nil && !st.Completed {
+		err = errgo.WithCausef(nil, params.ErrForbidden, "onboarding not completed")
+	}
+	if err == nil {
+		err = c.onboardingStore.Set(ctx, onboardedKey(id.ProviderID), []byte{1}, time.Time{})
+	}
+	if st.ReturnTo != "" {
+		if err != nil {
+			c.RedirectFailure(ctx, w, req, st.ReturnTo, st.State, errgo.Mask(err, errgo.Any))
+			return
+		}
+		c.redirectSuccess(ctx, w, req, st.ReturnTo, st.State, id)
+		return
+	}
+	if err != nil {
+		c.Failure(ctx, w, req, st.DischargeID, errgo.Mask(err, errgo.Any))
+		return
+	}
+	c.success(ctx, w, req, st.DischargeID, id)
+}
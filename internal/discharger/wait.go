@@ -16,6 +16,7 @@ import (
 	macaroon "gopkg.in/macaroon.v2"
 
 	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/meeting"
 	"github.com/canonical/candid/params"
 )
 
@@ -47,12 +48,19 @@ func (h *handler) waitToken(p httprequest.Params, dischargeID string) (*discharg
 	// TODO don't wait forever here.
 	reqInfo, login, err := h.params.place.Wait(p.Context, dischargeID)
 	if err != nil {
+		if errgo.Cause(err) == meeting.ErrExpired {
+			return nil, nil, errgo.WithCausef(nil, params.ErrLoginTimedOut, "login timed out")
+		}
 		return nil, nil, errgo.Notef(err, "cannot wait")
 	}
 	if login.Error != nil {
 		return nil, nil, errgo.NoteMask(login.Error, "login failed", errgo.Any)
 	}
-	return reqInfo, login.DischargeToken, nil
+	dt, err := h.bindUserAgent(login.DischargeToken, p.Request)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	return reqInfo, dt, nil
 }
 
 // waitRequest is the request sent to the server to wait for logins to
@@ -80,11 +88,18 @@ type waitResponse struct {
 // This is part of the legacy visit-wait protocol; newer clients will use WaitToken
 // instead.
 func (h *handler) WaitLegacy(p httprequest.Params, req *waitRequest) (*waitResponse, error) {
+	if err := h.checkLegacyLogin(); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
 	ctx := p.Context
 	reqInfo, dt, err := h.wait(p.Context, req.DischargeID)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
+	dt, err = h.bindUserAgent(dt, p.Request)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
 
 	// TODO we'd like to add a caveat to the discharge-token macaroon
 	// to prevent it being moved between origins, but it's too late
@@ -136,6 +151,9 @@ func (h *handler) wait(ctx context.Context, dischargeID string) (*dischargeReque
 	// TODO don't wait forever here.
 	reqInfo, login, err := h.params.place.Wait(ctx, dischargeID)
 	if err != nil {
+		if errgo.Cause(err) == meeting.ErrExpired {
+			return nil, nil, errgo.WithCausef(nil, params.ErrLoginTimedOut, "login timed out")
+		}
 		return nil, nil, errgo.Notef(err, "cannot wait")
 	}
 	if login.Error != nil {
@@ -0,0 +1,200 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+const (
+	// defaultMaxDeferredWrites holds the default number of updates
+	// that will be held while the store is read-only.
+	defaultMaxDeferredWrites = 1000
+
+	// deferredWriteInterval holds the interval between attempts to
+	// replay deferred updates.
+	deferredWriteInterval = 5 * time.Second
+)
+
+// A deferringStore is a store.Store that allows logins to continue
+// while the underlying store is temporarily read-only. Updates that
+// only record the last login or last discharge time of an existing
+// identity, and that fail because the store is read-only, are queued
+// and replayed once the store becomes writable again. All other
+// updates are written through and fail while the store is read-only.
+type deferringStore struct {
+	store.Store
+	max int
+
+	mu      sync.Mutex
+	pending []deferredUpdate
+
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// A deferredUpdate holds the arguments of an UpdateIdentity call that
+// has been deferred.
+type deferredUpdate struct {
+	identity store.Identity
+	update   store.Update
+}
+
+// newDeferringStore returns a deferringStore that wraps st and holds
+// at most max deferred updates. Deferred updates are not replayed
+// until start is called.
+func newDeferringStore(st store.Store, max int) *deferringStore {
+	if max <= 0 {
+		max = defaultMaxDeferredWrites
+	}
+	return &deferringStore{
+		Store:  st,
+		max:    max,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// start starts replaying deferred updates every interval until the
+// store is closed.
+func (s *deferringStore) start(interval time.Duration) {
+	go s.run(interval)
+}
+
+// RemoveIdentity implements store.IdentityRemover.RemoveIdentity.
+func (s *deferringStore) RemoveIdentity(ctx context.Context, identity *store.Identity) error {
+	return errgo.Mask(store.RemoveIdentity(ctx, s.Store, identity), errgo.Any)
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s *deferringStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	err := s.Store.UpdateIdentity(ctx, identity, update)
+	if errgo.Cause(err) != store.ErrReadOnly {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if !deferrable(update) {
+		return errgo.WithCausef(err, params.ErrServiceUnavailable, "cannot update identity while the store is read-only")
+	}
+	// Only updates to identities that already exist can be
+	// deferred, the identity needs to exist for the login to
+	// complete.
+	existing := store.Identity{
+		ID:         identity.ID,
+		ProviderID: identity.ProviderID,
+		Username:   identity.Username,
+	}
+	if ierr := s.Store.Identity(ctx, &existing); ierr != nil {
+		if errgo.Cause(ierr) == store.ErrNotFound {
+			return errgo.WithCausef(err, params.ErrServiceUnavailable, "cannot create identity while the store is read-only")
+		}
+		return errgo.Mask(ierr)
+	}
+	if !s.enqueue(identity, update) {
+		return errgo.WithCausef(err, params.ErrServiceUnavailable, "cannot update identity while the store is read-only")
+	}
+	logger.Infof("deferring update to %q while the store is read-only", existing.Username)
+	if identity.ID == "" {
+		identity.ID = existing.ID
+	}
+	return nil
+}
+
+// deferrable reports whether the given update may be deferred. Only
+// updates that record the last login or last discharge time are
+// deferred, as losing or delaying them does not affect the security
+// of the identity.
+func deferrable(update store.Update) bool {
+	for f, op := range update {
+		if op == store.NoUpdate {
+			continue
+		}
+		if f := store.Field(f); f != store.LastLogin && f != store.LastDischarge {
+			return false
+		}
+	}
+	return true
+}
+
+// enqueue adds the given update to the queue of deferred updates. It
+// returns false if the queue is full.
+func (s *deferringStore) enqueue(identity *store.Identity, update store.Update) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= s.max {
+		return false
+	}
+	s.pending = append(s.pending, deferredUpdate{
+		identity: *identity,
+		update:   update,
+	})
+	return true
+}
+
+// run replays deferred updates every interval until the store is
+// closed.
+func (s *deferringStore) run(interval time.Duration) {
+	defer close(s.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.replay(context.Background())
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// replay attempts to write all deferred updates in the order they
+// were made. If the store is still read-only the remaining updates
+// are kept for the next attempt.
+func (s *deferringStore) replay(ctx context.Context) {
+	ctx, close := s.Store.Context(ctx)
+	defer close()
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		u := s.pending[0]
+		s.mu.Unlock()
+		err := s.Store.UpdateIdentity(ctx, &u.identity, u.update)
+		if errgo.Cause(err) == store.ErrReadOnly {
+			return
+		}
+		if err != nil {
+			logger.Errorf("cannot replay deferred update to %q: %s", u.identity.Username, err)
+		}
+		s.mu.Lock()
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+	}
+}
+
+// numPending returns the number of deferred updates waiting to be
+// written.
+func (s *deferringStore) numPending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Close stops replaying deferred updates. Any updates that have not
+// been written are discarded.
+func (s *deferringStore) Close() {
+	close(s.closed)
+	<-s.done
+	if n := s.numPending(); n > 0 {
+		logger.Errorf("discarding %d deferred updates", n)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/memstore"
+)
+
+// readOnlyStore is a store.Store that fails all updates with an
+// ErrReadOnly cause when readOnly is set.
+type readOnlyStore struct {
+	store.Store
+	readOnly bool
+}
+
+func (s *readOnlyStore) UpdateIdentity(ctx context.Context, id *store.Identity, update store.Update) error {
+	if s.readOnly {
+		return store.ReadOnlyError(errgo.New("not master"))
+	}
+	return s.Store.UpdateIdentity(ctx, id, update)
+}
+
+func TestDeferringStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	st := &readOnlyStore{Store: memstore.NewStore()}
+	err := st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	ds := identity.NewDeferringStore(st, 1)
+
+	// Updates to existing identities are deferred while the store
+	// is read-only.
+	st.readOnly = true
+	lastLogin := time.Now().Round(time.Millisecond)
+	id := &store.Identity{
+		Username:  "bob",
+		LastLogin: lastLogin,
+	}
+	err = ds.UpdateIdentity(ctx, id, store.Update{
+		store.LastLogin: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.ID, qt.Not(qt.Equals), "")
+	c.Assert(ds.NumPending(), qt.Equals, 1)
+
+	// Other updates are not deferred.
+	err = ds.UpdateIdentity(ctx, &store.Identity{
+		Username: "bob",
+		Groups:   []string{"admin"},
+	}, store.Update{
+		store.Groups:    store.Set,
+		store.LastLogin: store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrServiceUnavailable)
+	c.Assert(err, qt.ErrorMatches, `cannot update identity while the store is read-only: store is read-only: not master`)
+	c.Assert(ds.NumPending(), qt.Equals, 1)
+
+	// Identities cannot be created.
+	err = ds.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+		LastLogin:  lastLogin,
+	}, store.Update{
+		store.LastLogin: store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrServiceUnavailable)
+	c.Assert(err, qt.ErrorMatches, `cannot create identity while the store is read-only: store is read-only: not master`)
+
+	// Once the queue is full updates fail.
+	err = ds.UpdateIdentity(ctx, &store.Identity{Username: "bob"}, store.Update{
+		store.LastDischarge: store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrServiceUnavailable)
+	c.Assert(err, qt.ErrorMatches, `cannot update identity while the store is read-only: store is read-only: not master`)
+
+	// Deferred updates are kept while the store is read-only.
+	ds.Replay(ctx)
+	c.Assert(ds.NumPending(), qt.Equals, 1)
+
+	// Deferred updates are written once the store is writable.
+	st.readOnly = false
+	ds.Replay(ctx)
+	c.Assert(ds.NumPending(), qt.Equals, 0)
+	stored := store.Identity{Username: "bob"}
+	err = st.Identity(ctx, &stored)
+	c.Assert(err, qt.IsNil)
+	c.Assert(stored.LastLogin.Equal(lastLogin), qt.Equals, true)
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Deprecation describes the deprecation of an API endpoint. Responses
+// from a deprecated endpoint include a Deprecation header and, when
+// the relevant fields are set, Sunset, Link and Warning headers.
+type Deprecation struct {
+	// Since holds the time at which the endpoint was deprecated, if
+	// known.
+	Since time.Time
+
+	// Sunset holds the time after which the endpoint may be removed,
+	// if known.
+	Sunset time.Time
+
+	// Link holds the URL of documentation describing the
+	// deprecation.
+	Link string
+
+	// Message holds a human readable warning to send to clients of
+	// the endpoint.
+	Message string
+
+	// BodyWarning, if set, causes the Message to also be included
+	// as the "warning" member of JSON object response bodies.
+	BodyWarning bool
+}
+
+// defaultDeprecationMessage is the warning sent to clients of a
+// deprecated endpoint that has no configured message.
+const defaultDeprecationMessage = "this endpoint is deprecated"
+
+// deprecatedHandle returns a handler that calls h and marks the response as
+// coming from a deprecated endpoint, as described by d.
+func deprecatedHandle(d Deprecation, h httprouter.Handle) httprouter.Handle {
+	message := d.Message
+	if message == "" {
+		message = defaultDeprecationMessage
+	}
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		setDeprecationHeaders(w.Header(), d, message)
+		if !d.BodyWarning {
+			h(w, req, p)
+			return
+		}
+		bw := &bodyWarningWriter{ResponseWriter: w}
+		h(bw, req, p)
+		bw.flush(message)
+	}
+}
+
+// setDeprecationHeaders sets the response headers that describe the
+// given deprecation.
+func setDeprecationHeaders(h http.Header, d Deprecation, message string) {
+	if d.Since.IsZero() {
+		h.Set("Deprecation", "true")
+	} else {
+		h.Set("Deprecation", d.Since.UTC().Format(http.TimeFormat))
+	}
+	if !d.Sunset.IsZero() {
+		h.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if d.Link != "" {
+		h.Add("Link", "<"+d.Link+`>; rel="deprecation"`)
+	}
+	h.Add("Warning", "299 - "+strconv.Quote(message))
+}
+
+// bodyWarningWriter is an http.ResponseWriter that buffers the response
+// so that a warning can be added to a JSON response body.
+type bodyWarningWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader.
+func (w *bodyWarningWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Write implements http.ResponseWriter.Write.
+func (w *bodyWarningWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+// flush writes the buffered response to the underlying
+// http.ResponseWriter. If the response body is a JSON object without a
+// "warning" member then the given warning is added to it.
+func (w *bodyWarningWriter) flush(warning string) {
+	body := w.buf.Bytes()
+	if mt, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type")); mt == "application/json" {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(body, &obj); err == nil && obj != nil && obj["warning"] == nil {
+			obj["warning"], _ = json.Marshal(warning)
+			if data, err := json.Marshal(obj); err == nil {
+				body = data
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+		}
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if _, err := w.ResponseWriter.Write(body); err != nil {
+		logger.Infof("cannot write response: %s", err)
+	}
+}
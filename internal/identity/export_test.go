@@ -0,0 +1,24 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity
+
+import "context"
+
+type DeferringStore = deferringStore
+
+var NewDeferringStore = newDeferringStore
+
+func (s *DeferringStore) Replay(ctx context.Context) {
+	s.replay(ctx)
+}
+
+func (s *DeferringStore) NumPending() int {
+	return s.numPending()
+}
+
+var NewSlowLoggingStore = newSlowLoggingStore
+
+var NewUniqueNameStore = newUniqueNameStore
+
+var IDPStatusCacheDuration = &idpStatusCacheDuration
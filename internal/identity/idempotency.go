@@ -0,0 +1,264 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	"github.com/julienschmidt/httprouter"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+// idempotencyKeyHeader is the request header that holds a client
+// chosen idempotency key.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyPendingTimeout is the longest time a request with an
+// idempotency key is assumed to be in progress. This stops a server
+// that fails part way through a request from blocking retries of it
+// for the whole idempotency key TTL.
+const idempotencyPendingTimeout = time.Minute
+
+// An idempotencyRecord is the stored form of a request made with an
+// idempotency key. A record without a status is for a request that
+// is still in progress.
+type idempotencyRecord struct {
+	Fingerprint string      `json:"fingerprint"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+	Expire      time.Time   `json:"expire"`
+}
+
+// idempotencyStore holds the results of requests made with an
+// idempotency key. It wraps a KeyValueStore.
+type idempotencyStore struct {
+	store simplekv.Store
+	ttl   time.Duration
+}
+
+// errIdempotencyKeyInUse is used internally by claim to abort the
+// update of a record that is still current.
+var errIdempotencyKeyInUse = errgo.New("idempotency key in use")
+
+// claim records that the request with the given key and fingerprint
+// is in progress. If there is already a current record for the key
+// then it is returned and claimed is false. Records whose expiry time
+// has passed are replaced, as the store is not guaranteed to have
+// removed them.
+func (s *idempotencyStore) claim(ctx context.Context, key, fingerprint string) (rec *idempotencyRecord, claimed bool, err error) {
+	now := time.Now()
+	pending := s.ttl
+	if pending > idempotencyPendingTimeout {
+		pending = idempotencyPendingTimeout
+	}
+	b, err := json.Marshal(idempotencyRecord{
+		Fingerprint: fingerprint,
+		Expire:      now.Add(pending),
+	})
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	err = s.store.Update(ctx, key, now.Add(pending), func(old []byte) ([]byte, error) {
+		rec = nil
+		if old == nil {
+			return b, nil
+		}
+		var oldRec idempotencyRecord
+		if err := json.Unmarshal(old, &oldRec); err != nil || !oldRec.Expire.After(now) {
+			return b, nil
+		}
+		rec = &oldRec
+		return nil, errIdempotencyKeyInUse
+	})
+	if err == nil {
+		return nil, true, nil
+	}
+	if errgo.Cause(err) != errIdempotencyKeyInUse {
+		return nil, false, errgo.Mask(err)
+	}
+	return rec, false, nil
+}
+
+// complete records the response to the request with the given key.
+func (s *idempotencyStore) complete(ctx context.Context, key string, rec *idempotencyRecord) error {
+	rec.Expire = time.Now().Add(s.ttl)
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.store.Set(ctx, key, b, rec.Expire))
+}
+
+// release removes the claim on the given key so that the request may
+// be retried. The record is marked as expired, rather than removed,
+// which claim treats in the same way as a missing record.
+func (s *idempotencyStore) release(ctx context.Context, key string) error {
+	now := time.Now()
+	b, err := json.Marshal(idempotencyRecord{Expire: now})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.store.Set(ctx, key, b, now))
+}
+
+// idempotent returns a handler that calls h at most once for each
+// idempotency key presented with a request. A successful response is
+// stored for the TTL of s and returned unchanged to any retry of the
+// request with the same key. A retry with the same key but a different
+// request is rejected with a conflict error, as is a retry while the
+// original request is still in progress. Unsuccessful responses are
+// not stored and the claim on the key is released, so that the request
+// can be retried.
+//
+// Idempotency keys are scoped to the credentials presented with the
+// request, so one client cannot obtain the response to another
+// client's request by reusing its key.
+func idempotent(s *idempotencyStore, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		ikey := req.Header.Get(idempotencyKeyHeader)
+		if ikey == "" {
+			h(w, req, p)
+			return
+		}
+		ctx := req.Context()
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			WriteError(ctx, w, errgo.WithCausef(err, params.ErrBadRequest, "cannot read request body"))
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		key := idempotencyRecordKey(req, ikey)
+		fingerprint := requestFingerprint(req, body)
+		rec, claimed, err := s.claim(ctx, key, fingerprint)
+		if err != nil {
+			WriteError(ctx, w, errgo.Notef(err, "cannot check idempotency key"))
+			return
+		}
+		if !claimed {
+			switch {
+			case rec.Fingerprint != fingerprint:
+				WriteError(ctx, w, errgo.WithCausef(nil, params.ErrConflict, "idempotency key %q has already been used for a different request", ikey))
+			case rec.Status == 0:
+				WriteError(ctx, w, errgo.WithCausef(nil, params.ErrConflict, "request with idempotency key %q is still in progress", ikey))
+			default:
+				replayResponse(w, rec)
+			}
+			return
+		}
+		// The claim is updated with a context that is not
+		// cancelled if the client goes away, otherwise it would
+		// block retries until it expires.
+		sctx, close := s.store.Context(context.Background())
+		defer close()
+		succeeded := false
+		defer func() {
+			// Release the claim if the request did not succeed,
+			// including when the handler panics.
+			if succeeded {
+				return
+			}
+			if err := s.release(sctx, key); err != nil {
+				logger.Errorf("cannot release idempotency key: %s", err)
+			}
+		}()
+		rw := &recordingWriter{ResponseWriter: w}
+		h(rw, req, p)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		if rw.status < 200 || rw.status >= 300 {
+			return
+		}
+		succeeded = true
+		err = s.complete(sctx, key, &idempotencyRecord{
+			Fingerprint: fingerprint,
+			Status:      rw.status,
+			Header: http.Header{
+				"Content-Type": w.Header()["Content-Type"],
+			},
+			Body: rw.buf.Bytes(),
+		})
+		if err != nil {
+			logger.Errorf("cannot store response for idempotency key: %s", err)
+		}
+	}
+}
+
+// replayResponse writes the response stored in rec to w.
+func replayResponse(w http.ResponseWriter, rec *idempotencyRecord) {
+	for k, v := range rec.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(rec.Status)
+	if _, err := w.Write(rec.Body); err != nil {
+		logger.Infof("cannot write response: %s", err)
+	}
+}
+
+// idempotencyRecordKey returns the key used to store the record of a
+// request with the given idempotency key. The key includes the
+// credentials presented with the request.
+func idempotencyRecordKey(req *http.Request, ikey string) string {
+	hash := sha256.New()
+	hash.Write([]byte(ikey))
+	for _, v := range req.Header["Authorization"] {
+		hash.Write([]byte("\x00" + v))
+	}
+	for _, v := range req.Header["Macaroons"] {
+		hash.Write([]byte("\x00" + v))
+	}
+	for _, c := range req.Cookies() {
+		if strings.HasPrefix(c.Name, "macaroon-") {
+			hash.Write([]byte("\x00" + c.Name + "=" + c.Value))
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// requestFingerprint returns a value that identifies the operation
+// requested by req with the given body.
+func requestFingerprint(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(req.Method + " " + req.URL.RequestURI() + "\x00"))
+	hash.Write(body)
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// recordingWriter is an http.ResponseWriter that keeps a copy of the
+// response written through it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader.
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.Write.
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.buf.Write(b)
+	return w.ResponseWriter.Write(b)
+}
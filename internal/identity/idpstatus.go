@@ -0,0 +1,127 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/params"
+)
+
+// idpDisabledValue is the value stored for an identity provider that
+// has been disabled.
+const idpDisabledValue = "disabled"
+
+// idpStatusCacheDuration is the length of time for which the status of
+// an identity provider read from the store is used before it is read
+// again. Changes made through another server sharing the store take up
+// to this long to take effect.
+var idpStatusCacheDuration = 10 * time.Second
+
+// IDPStatus records which of the configured identity providers have
+// been disabled. The status is held in a KeyValueStore so that it is
+// shared by all servers using the same store and survives restarts.
+// Identity providers are enabled unless they have been disabled. A nil
+// IDPStatus reports all identity providers as enabled and cannot be
+// changed.
+type IDPStatus struct {
+	store simplekv.Store
+	names map[string]bool
+
+	// mu protects the fields below it.
+	mu    sync.Mutex
+	cache map[string]idpStatusEntry
+}
+
+// An idpStatusEntry holds the cached status of an identity provider.
+type idpStatusEntry struct {
+	enabled bool
+	updated time.Time
+}
+
+// NewIDPStatus returns an IDPStatus for the given identity providers
+// that stores the status in the given KeyValueStore.
+func NewIDPStatus(store simplekv.Store, idps []idp.IdentityProvider) *IDPStatus {
+	names := make(map[string]bool, len(idps))
+	for _, idp := range idps {
+		names[idp.Name()] = true
+	}
+	return &IDPStatus{
+		store: store,
+		names: names,
+		cache: make(map[string]idpStatusEntry),
+	}
+}
+
+// Enabled reports whether the named identity provider is enabled. The
+// status read from the store is cached for idpStatusCacheDuration.
+func (s *IDPStatus) Enabled(ctx context.Context, name string) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+	s.mu.Lock()
+	e, ok := s.cache[name]
+	s.mu.Unlock()
+	if ok && time.Since(e.updated) < idpStatusCacheDuration {
+		return e.enabled, nil
+	}
+	v, err := s.store.Get(ctx, name)
+	if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+		return false, errgo.Notef(err, "cannot get status of identity provider %q", name)
+	}
+	enabled := string(v) != idpDisabledValue
+	s.setCache(name, enabled)
+	return enabled, nil
+}
+
+// setCache records the given status of the named identity provider in
+// the cache.
+func (s *IDPStatus) setCache(name string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache[name] = idpStatusEntry{
+		enabled: enabled,
+		updated: time.Now(),
+	}
+}
+
+// SetEnabled enables, or disables, the named identity provider. The
+// change takes effect for all subsequent logins to this server, and
+// within idpStatusCacheDuration for other servers sharing the store;
+// identities that have already logged in are not affected. If there is no such identity
+// provider an error with a cause of params.ErrNotFound is returned.
+func (s *IDPStatus) SetEnabled(ctx context.Context, name string, enabled bool) error {
+	if s == nil || !s.names[name] {
+		return errgo.WithCausef(nil, params.ErrNotFound, "identity provider %q not found", name)
+	}
+	var v []byte
+	if !enabled {
+		v = []byte(idpDisabledValue)
+	}
+	if err := s.store.Set(ctx, name, v, time.Time{}); err != nil {
+		return errgo.Notef(err, "cannot set status of identity provider %q", name)
+	}
+	s.setCache(name, enabled)
+	return nil
+}
+
+// CheckEnabled checks that the named identity provider is enabled. If
+// it is not an error with a cause of params.ErrServiceUnavailable is
+// returned.
+func (s *IDPStatus) CheckEnabled(ctx context.Context, name string) error {
+	enabled, err := s.Enabled(ctx, name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !enabled {
+		return errgo.WithCausef(nil, params.ErrServiceUnavailable, "login with %s is currently disabled", name)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/static"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/params"
+)
+
+func TestIDPStatus(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	s := identity.NewIDPStatus(kv, []idp.IdentityProvider{
+		static.NewIdentityProvider(static.Params{Name: "test1"}),
+		static.NewIdentityProvider(static.Params{Name: "test2"}),
+	})
+
+	// Identity providers are enabled by default.
+	enabled, err := s.Enabled(ctx, "test1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(enabled, qt.Equals, true)
+	c.Assert(s.CheckEnabled(ctx, "test1"), qt.IsNil)
+
+	err = s.SetEnabled(ctx, "test1", false)
+	c.Assert(err, qt.IsNil)
+	enabled, err = s.Enabled(ctx, "test1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(enabled, qt.Equals, false)
+	err = s.CheckEnabled(ctx, "test1")
+	c.Assert(err, qt.ErrorMatches, `login with test1 is currently disabled`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrServiceUnavailable)
+
+	// Other identity providers are not affected.
+	enabled, err = s.Enabled(ctx, "test2")
+	c.Assert(err, qt.IsNil)
+	c.Assert(enabled, qt.Equals, true)
+
+	// The status is shared by everything using the same store.
+	enabled, err = identity.NewIDPStatus(kv, nil).Enabled(ctx, "test1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(enabled, qt.Equals, false)
+
+	err = s.SetEnabled(ctx, "test1", true)
+	c.Assert(err, qt.IsNil)
+	enabled, err = s.Enabled(ctx, "test1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(enabled, qt.Equals, true)
+
+	err = s.SetEnabled(ctx, "test3", false)
+	c.Assert(err, qt.ErrorMatches, `identity provider "test3" not found`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+}
+
+func TestIDPStatusCached(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	idps := []idp.IdentityProvider{
+		static.NewIdentityProvider(static.Params{Name: "test1"}),
+	}
+	s1 := identity.NewIDPStatus(kv, idps)
+	s2 := identity.NewIDPStatus(kv, idps)
+
+	enabled, err := s1.Enabled(ctx, "test1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(enabled, qt.Equals, true)
+
+	// A change made through another IDPStatus is not seen while
+	// the status is cached.
+	err = s2.SetEnabled(ctx, "test1", false)
+	c.Assert(err, qt.IsNil)
+	enabled, err = s1.Enabled(ctx, "test1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(enabled, qt.Equals, true)
+
+	// Once the cached status expires the change is seen.
+	c.Patch(identity.IDPStatusCacheDuration, time.Duration(0))
+	enabled, err = s1.Enabled(ctx, "test1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(enabled, qt.Equals, false)
+}
+
+func TestNilIDPStatus(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	var s *identity.IDPStatus
+	enabled, err := s.Enabled(ctx, "test1")
+	c.Assert(err, qt.IsNil)
+	c.Assert(enabled, qt.Equals, true)
+	err = s.SetEnabled(ctx, "test1", false)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+}
@@ -44,12 +44,20 @@ func errToResp(ctx context.Context, err error) (int, interface{}) {
 		status = http.StatusForbidden
 	case params.ErrBadRequest:
 		status = http.StatusBadRequest
-	case params.ErrUnauthorized, params.ErrNoAdminCredsProvided:
+	case params.ErrUnauthorized, params.ErrNoAdminCredsProvided, params.ErrUserNoLongerExists:
 		status = http.StatusUnauthorized
 	case params.ErrMethodNotAllowed:
 		status = http.StatusMethodNotAllowed
 	case params.ErrServiceUnavailable:
 		status = http.StatusServiceUnavailable
+	case params.ErrTooManyRequests:
+		status = http.StatusTooManyRequests
+	case params.ErrConflict:
+		status = http.StatusConflict
+	case params.ErrNotModified:
+		status = http.StatusNotModified
+	case params.ErrLoginTimedOut:
+		status = http.StatusRequestTimeout
 	}
 
 	if status == http.StatusInternalServerError {
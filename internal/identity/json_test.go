@@ -27,6 +27,8 @@ func TestHandleErrors(t *testing.T) {
 		http.StatusBadRequest:         params.ErrBadRequest,
 		http.StatusUnauthorized:       params.ErrUnauthorized,
 		http.StatusServiceUnavailable: params.ErrServiceUnavailable,
+		http.StatusTooManyRequests:    params.ErrTooManyRequests,
+		http.StatusConflict:           params.ErrConflict,
 	} {
 		c.Run(string(paramsErr), func(c *qt.C) {
 			mux := httprouter.New()
@@ -7,12 +7,15 @@ import (
 	"context"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 	"runtime/debug"
+	"strings"
 	"time"
 
 	"github.com/juju/aclstore/v2"
 	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
 	"github.com/juju/utils/debugstatus"
 	"github.com/julienschmidt/httprouter"
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,14 +23,28 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 
+	"github.com/canonical/candid/attrschema"
+	"github.com/canonical/candid/audit"
+	"github.com/canonical/candid/breakglass"
+	"github.com/canonical/candid/device"
+	"github.com/canonical/candid/displayname"
+	"github.com/canonical/candid/events"
+	"github.com/canonical/candid/groupwebhook"
 	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/internal/auth"
 	"github.com/canonical/candid/internal/auth/httpauth"
 	"github.com/canonical/candid/internal/monitoring"
+	"github.com/canonical/candid/loginhours"
+	"github.com/canonical/candid/loginpolicy"
+	"github.com/canonical/candid/maintenance"
 	"github.com/canonical/candid/meeting"
+	"github.com/canonical/candid/onboarding"
 	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/ratelimit"
 	"github.com/canonical/candid/store"
 )
 
@@ -49,6 +66,13 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 	if len(versions) == 0 {
 		return nil, errgo.Newf("identity server must serve at least one version of the API")
 	}
+	if sp.Location != "" {
+		location, err := idputil.CanonicalLocation(sp.Location)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid location")
+		}
+		sp.Location = location
+	}
 
 	// Create the bakery parts.
 	if sp.Key == nil {
@@ -63,6 +87,17 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		PublicKey: sp.Key.Public,
 		Version:   bakery.LatestVersion,
 	})
+	for loc, info := range sp.AgentCaveatThirdParties {
+		locator.AddInfo(loc, info)
+	}
+	if err := checkAgentCaveats(sp.AgentRequiredCaveats, sp.AgentCaveatThirdParties); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, caveats := range sp.AgentOwnerRequiredCaveats {
+		if err := checkAgentCaveats(caveats, sp.AgentCaveatThirdParties); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
 	var rksf func([]bakery.Op) bakery.RootKeyStore
 	if sp.RootKeyStore != nil {
 		rksf = func([]bakery.Op) bakery.RootKeyStore {
@@ -76,6 +111,9 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		Locator:            locator,
 		Location:           "identity",
 	})
+	if err := sp.MacaroonVersions().Validate(); err != nil {
+		return nil, errgo.Mask(err)
+	}
 	if sp.APIMacaroonTimeout == 0 {
 		sp.APIMacaroonTimeout = defaultAPIMacaroonTimeout
 	}
@@ -85,6 +123,31 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 	if sp.DischargeTokenTimeout == 0 {
 		sp.DischargeTokenTimeout = defaultDischargeTokenTimeout
 	}
+	if sp.DeviceClassifier == nil {
+		sp.DeviceClassifier = device.DefaultClassifier
+	}
+	sp.Store = newSourceTaggingStore(sp.Store, sp.IdentitySources)
+	if sp.UniqueDisplayNames != nil {
+		sp.Store = newUniqueNameStore(sp.Store, *sp.UniqueDisplayNames)
+	}
+	if sp.BreakGlass != nil {
+		if expires := sp.BreakGlass.Expires(); !expires.IsZero() {
+			logger.Warningf("break-glass admin access is ENABLED for user %q until %s", sp.BreakGlass.Username(), expires.Format(time.RFC3339))
+		} else {
+			logger.Warningf("break-glass admin access is ENABLED for user %q", sp.BreakGlass.Username())
+		}
+	}
+	if sp.RequireTLS && sp.RedirectToTLS && !strings.HasPrefix(sp.Location, "https://") {
+		logger.Warningf("requests without TLS will be rejected, not redirected, because location %q is not an https URL", sp.Location)
+	}
+	if sp.SlowStoreOperationThreshold > 0 {
+		sp.Store = newSlowLoggingStore(sp.Store, sp.SlowStoreOperationThreshold)
+	}
+	var deferred *deferringStore
+	if sp.DeferUnavailableWrites {
+		deferred = newDeferringStore(sp.Store, sp.MaxDeferredWrites)
+		sp.Store = deferred
+	}
 	aclManager, err := aclstore.NewManager(context.Background(), aclstore.Params{
 		Store:             sp.ACLStore,
 		InitialAdminUsers: []string{auth.AdminUsername},
@@ -92,6 +155,13 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	var apiTokenStore simplekv.Store
+	if sp.APITokenLifetime > 0 {
+		apiTokenStore, err = sp.ProviderDataStore.KeyValueStore(context.Background(), "_api_tokens")
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create API token store")
+		}
+	}
 	auth, err := auth.New(auth.Params{
 		AdminPassword:     sp.AdminPassword,
 		Location:          sp.Location,
@@ -99,12 +169,26 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		Store:             sp.Store,
 		IdentityProviders: sp.IdentityProviders,
 		ACLManager:        aclManager,
+		GroupRules:        sp.GroupRules,
+
+		APITokenStore:    apiTokenStore,
+		APITokenLifetime: sp.APITokenLifetime,
+		TokenGenerator:   sp.TokenGenerator,
+
+		BreakGlass:       sp.BreakGlass,
+		EventDispatcher:  sp.EventDispatcher,
+		LoginRateLimiter: sp.LoginRateLimiter,
+		AuditLogger:      sp.AuditLogger,
+		ClientIP: (&httpauth.IPFilter{
+			TrustedProxies: sp.TrustedProxies,
+		}).ClientIP,
+		GroupWebhook: sp.GroupWebhook,
 	})
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
 
-	aclAuthenticator := httpauth.New(oven, auth, sp.APIMacaroonTimeout)
+	aclAuthenticator := httpauth.New(oven, auth, sp.APIMacaroonTimeout, sp.MacaroonVersions())
 	aclHandler := aclManager.NewHandler(aclstore.HandlerParams{
 		RootPath: "/acl",
 		Authenticate: func(ctx context.Context, w http.ResponseWriter, req *http.Request) (aclstore.Identity, error) {
@@ -120,12 +204,16 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 	if err := auth.SetAdminPublicKey(context.Background(), sp.AdminAgentPublicKey); err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if err := auth.SetAdminAccounts(context.Background(), sp.AdminAccounts); err != nil {
+		return nil, errgo.Mask(err)
+	}
 
 	place, err := meeting.NewPlace(meeting.Params{
-		Store:       sp.MeetingStore,
-		Metrics:     monitoring.NewMeetingMetrics(),
-		ListenAddr:  sp.PrivateAddr,
-		WaitTimeout: sp.RendezvousTimeout,
+		Store:          sp.MeetingStore,
+		Metrics:        monitoring.NewMeetingMetrics(),
+		ListenAddr:     sp.PrivateAddr,
+		WaitTimeout:    sp.RendezvousTimeout,
+		ExpiryDuration: sp.RendezvousExpiry,
 	})
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot create meeting place")
@@ -139,6 +227,7 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 		router:         httprouter.New(),
 		meetingPlace:   place,
 		storeCollector: storeCollector,
+		tls:            sp.TLSRequirement(),
 	}
 	// Disable the automatic rerouting in order to maintain
 	// compatibility. It might be worthwhile relaxing this in the
@@ -154,20 +243,58 @@ func New(sp ServerParams, versions map[string]NewAPIHandlerFunc) (*Server, error
 	srv.router.Handler("PUT", "/acl/*path", aclHandler)
 	srv.router.Handler("POST", "/acl/*path", aclHandler)
 	srv.router.Handler("GET", "/static/*path", http.StripPrefix("/static", http.FileServer(sp.StaticFileSystem)))
+	var idempotency *idempotencyStore
+	if sp.IdempotencyKeyTTL > 0 {
+		kv, err := sp.ProviderDataStore.KeyValueStore(context.Background(), "_idempotency")
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create idempotency store")
+		}
+		idempotency = &idempotencyStore{
+			store: kv,
+			ttl:   sp.IdempotencyKeyTTL,
+		}
+	}
+	var idpStatus *IDPStatus
+	if sp.ProviderDataStore != nil {
+		kv, err := sp.ProviderDataStore.KeyValueStore(context.Background(), "_idp_status")
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot create identity provider status store")
+		}
+		idpStatus = NewIDPStatus(kv, sp.IdentityProviders)
+	}
+	deprecated := make(map[string]bool)
 	for name, newAPI := range versions {
 		handlers, err := newAPI(HandlerParams{
 			ServerParams: sp,
 			Oven:         oven,
 			Authorizer:   auth,
 			MeetingPlace: place,
+			IDPStatus:    idpStatus,
 		})
 		if err != nil {
 			return nil, errgo.Notef(err, "cannot create API %s", name)
 		}
 		for _, h := range handlers {
-			srv.router.Handle(h.Method, h.Path, h.Handle)
+			handle := h.Handle
+			if idempotency != nil && h.Method != "GET" && h.Method != "HEAD" && strings.HasPrefix(h.Path, "/v1/") {
+				handle = idempotent(idempotency, handle)
+			}
+			if d, ok := sp.Deprecations[h.Path]; ok {
+				handle = deprecatedHandle(d, handle)
+				deprecated[h.Path] = true
+			}
+			srv.router.Handle(h.Method, h.Path, handle)
 		}
 	}
+	for path := range sp.Deprecations {
+		if !deprecated[path] {
+			return nil, errgo.Newf("deprecation configured for unknown endpoint %q", path)
+		}
+	}
+	if deferred != nil {
+		deferred.start(deferredWriteInterval)
+		srv.deferredStore = deferred
+	}
 	return srv, nil
 }
 
@@ -176,6 +303,14 @@ type Server struct {
 	router         *httprouter.Router
 	meetingPlace   *meeting.Place
 	storeCollector monitoring.StoreCollector
+
+	// tls holds the requirement for requests to be made over TLS, if
+	// enabled.
+	tls *httpauth.TLSRequirement
+
+	// deferredStore holds the store that defers writes while the
+	// store is read-only, if enabled.
+	deferredStore *deferringStore
 }
 
 // ServeHTTP implements http.Handler.
@@ -192,6 +327,14 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "Bakery-Protocol-Version, Macaroons, X-Requested-With, Content-Type")
 	w.Header().Set("Access-Control-Cache-Max-Age", "600")
+	if err := srv.tls.Check(req); err != nil {
+		if u := srv.tls.RedirectURL(req); u != "" {
+			http.Redirect(w, req, u, http.StatusMovedPermanently)
+			return
+		}
+		WriteError(req.Context(), w, err)
+		return
+	}
 	srv.router.ServeHTTP(w, req)
 }
 
@@ -200,6 +343,9 @@ func (s *Server) Close() {
 	logger.Debugf("Closing Server")
 	s.meetingPlace.Close()
 	prometheus.Unregister(s.storeCollector)
+	if s.deferredStore != nil {
+		s.deferredStore.Close()
+	}
 }
 
 // ServerParams contains configuration parameters for a server.
@@ -266,6 +412,11 @@ type ServerParams struct {
 	// ACLStore holds the ACLStore for the identity server.
 	ACLStore aclstore.ACLStore
 
+	// GroupStore holds the store for group records. Group records
+	// hold descriptive information about groups, they do not affect
+	// group membership.
+	GroupStore store.GroupStore
+
 	// RedirectLoginWhitelist contains a list of URLs that are
 	// trusted to be used as return_to URLs during an interactive
 	// login.
@@ -281,6 +432,481 @@ type ServerParams struct {
 	// DischargeTokenTimeout is the maximum life of a Discharge
 	// token.
 	DischargeTokenTimeout time.Duration
+
+	// MaxPendingRegistrationsPerEmail is the maximum number of
+	// pending registrations allowed for a single email address.
+	MaxPendingRegistrationsPerEmail int
+
+	// MaxPendingRegistrationsPerIP is the maximum number of pending
+	// registrations allowed from a single source IP address.
+	MaxPendingRegistrationsPerIP int
+
+	// PendingRegistrationTimeout is the time after which a pending
+	// registration no longer counts against the limits.
+	PendingRegistrationTimeout time.Duration
+
+	// RestrictLastLogin restricts the last login and last discharge
+	// times of users so that they are only returned to
+	// administrators.
+	RestrictLastLogin bool
+
+	// EmptyUsernameFallback holds the method used to derive a
+	// username when an identity provider returns an empty one.
+	EmptyUsernameFallback string
+
+	// RolesCaveat, if set, causes discharge macaroons to declare the
+	// tenant-scoped roles of the user.
+	RolesCaveat bool
+
+	// FailedLoginDelay holds the delay applied to the response
+	// after a failed password login. The delay doubles with each
+	// consecutive failure for an account. If this is zero no delay
+	// is applied.
+	FailedLoginDelay time.Duration
+
+	// MaxFailedLoginDelay holds the maximum delay applied after a
+	// failed password login.
+	MaxFailedLoginDelay time.Duration
+
+	// FailedLoginDedupWindow holds the length of time for which a
+	// repeated identical failed login is not counted as a further
+	// failure. If this is zero every failed login is counted.
+	FailedLoginDedupWindow time.Duration
+
+	// MaxMacaroonLifetime holds the maximum time for which an
+	// identity macaroon can be kept valid by renewing it. If this
+	// is zero then macaroon renewal is disabled.
+	MaxMacaroonLifetime time.Duration
+
+	// LoginPolicy holds the policy that is consulted after a user
+	// has authenticated with an identity provider, but before the
+	// login completes. If this is nil then all logins are allowed.
+	LoginPolicy loginpolicy.Policy
+
+	// RendezvousExpiry holds the time after which an interactive
+	// login that has not been completed times out. Clients waiting
+	// for the login receive a "login timed out" error. If this is
+	// zero a default of one hour is used.
+	RendezvousExpiry time.Duration
+
+	// GroupRules holds rules that add identities to groups based on
+	// their attributes. Groups from matching rules are added to the
+	// identity's groups whenever they are resolved.
+	GroupRules []store.GroupRule
+
+	// EventDispatcher holds the dispatcher used to deliver identity
+	// events, such as logins. If this is nil no events are sent.
+	EventDispatcher *events.Dispatcher
+
+	// DeletedUserResponse determines how a discharge request
+	// authenticated as a user that no longer exists is handled. If
+	// this is "interact" the user is asked to log in again,
+	// otherwise an error with the code ErrUserNoLongerExists is
+	// returned.
+	DeletedUserResponse string
+
+	// RedirectLoginParams holds, for each identity provider name,
+	// additional query parameters to add to the return_to address
+	// when a redirect login using that identity provider succeeds.
+	RedirectLoginParams map[string]idputil.RedirectParams
+
+	// RememberLastIDP, if set, causes the identity provider chooser
+	// to list first the identity provider most recently used to log
+	// in from the same browser.
+	RememberLastIDP bool
+
+	// StrictExternalIDs, if set, requires every external ID given to
+	// the API to be prefixed with the name of a configured identity
+	// provider, so that it cannot match an identity belonging to a
+	// different identity provider.
+	StrictExternalIDs bool
+
+	// BindUserAgent, if set, restricts the discharge tokens given to
+	// interactive clients so that they can only be used by a user
+	// agent with the same fingerprint as the one that received them.
+	BindUserAgent bool
+
+	// MaxConcurrentLogins holds the maximum number of login requests
+	// to each identity provider that may be in progress at the same
+	// time. Requests over the limit are rejected. If this is zero the
+	// number of logins is not limited.
+	MaxConcurrentLogins int
+
+	// UnknownAgentLogin determines what happens when an agent login
+	// is attempted for an agent that does not exist. If this is
+	// "create" then the agent is created, owned by
+	// UnknownAgentOwner and a member of UnknownAgentGroups. Any other
+	// value rejects the login.
+	UnknownAgentLogin string
+
+	// UnknownAgentOwner holds the username of the owner of agents
+	// created when UnknownAgentLogin is "create".
+	UnknownAgentOwner string
+
+	// UnknownAgentGroups holds the groups given to agents created
+	// when UnknownAgentLogin is "create".
+	UnknownAgentGroups []string
+
+	// AuthTimeCaveat, if set, causes discharge macaroons to declare
+	// the time at which the user authenticated in an "auth-time"
+	// declaration.
+	AuthTimeCaveat bool
+
+	// DefaultGroups holds groups that are added to every identity
+	// when it is first created. They are not added again once an
+	// identity exists, so a default group that is removed from a
+	// user stays removed.
+	DefaultGroups []string
+
+	// AgentRequiredCaveats holds third-party caveats that are added
+	// to the login macaroon minted for every agent. An agent cannot
+	// log in unless it has obtained a discharge for each of them.
+	AgentRequiredCaveats []checkers.Caveat
+
+	// AgentOwnerRequiredCaveats holds third-party caveats that are
+	// added, as for AgentRequiredCaveats, to the login macaroons of
+	// agents owned by a particular user, keyed by the owner's
+	// username.
+	AgentOwnerRequiredCaveats map[string][]checkers.Caveat
+
+	// AgentCaveatThirdParties holds the information about the third
+	// parties addressed by AgentRequiredCaveats and
+	// AgentOwnerRequiredCaveats, keyed by location.
+	AgentCaveatThirdParties map[string]bakery.ThirdPartyInfo
+
+	// Deprecations holds the deprecation details of any deprecated
+	// API endpoints, keyed by the path of the endpoint as it is
+	// registered (for example "/login-legacy").
+	Deprecations map[string]Deprecation
+
+	// EmailValidation holds the validation applied to email
+	// addresses supplied by identity providers before they are
+	// stored.
+	EmailValidation store.EmailValidation
+
+	// DeferUnavailableWrites allows logins to succeed while the
+	// store is temporarily read-only, for example during a database
+	// failover. Updates that only record the last login or last
+	// discharge time of an existing identity are deferred and
+	// written once the store is writable again. All other updates,
+	// including those that create an identity, still fail.
+	DeferUnavailableWrites bool
+
+	// MaxDeferredWrites holds the maximum number of updates that
+	// will be deferred when DeferUnavailableWrites is set. If this is
+	// zero a default value is used.
+	MaxDeferredWrites int
+
+	// MinMacaroonVersion holds the minimum macaroon version that
+	// will be minted in response to a request. Requests from clients
+	// that do not support this version are rejected.
+	MinMacaroonVersion bakery.Version
+
+	// MaxMacaroonVersion holds the maximum macaroon version that
+	// will be minted in response to a request. Clients that support
+	// later versions receive macaroons of this version. If this is
+	// zero bakery.LatestVersion is used.
+	MaxMacaroonVersion bakery.Version
+
+	// Onboarding holds the handler that is used to run onboarding
+	// steps the first time a user logs in. The login does not
+	// complete until onboarding has finished. If this is nil no
+	// onboarding is performed.
+	Onboarding onboarding.Handler
+
+	// OnboardingAgent holds the username of the agent used by the
+	// onboarding service to confirm that a user has completed
+	// onboarding. A login that is returned from onboarding without
+	// this confirmation fails.
+	OnboardingAgent string
+
+	// AdminAllowedNetworks holds the networks from which requests
+	// to admin endpoints are allowed. If this is empty admin
+	// requests are allowed from any network that is not in
+	// AdminDeniedNetworks.
+	AdminAllowedNetworks []*net.IPNet
+
+	// AdminDeniedNetworks holds the networks from which requests to
+	// admin endpoints are always rejected.
+	AdminDeniedNetworks []*net.IPNet
+
+	// TrustedProxies holds the networks containing reverse proxies
+	// that are trusted to report the address of the client in the
+	// X-Forwarded-For header.
+	TrustedProxies []*net.IPNet
+
+	// LoginIDPCaveat, if set, causes discharge macaroons to declare
+	// the name of the identity provider the user authenticated with
+	// in a "login-idp" declaration.
+	LoginIDPCaveat bool
+
+	// MaintenanceSchedule holds the schedule of maintenance windows
+	// during which new logins are refused. Existing sessions are not
+	// affected. If this is nil logins are always allowed.
+	MaintenanceSchedule *maintenance.Schedule
+
+	// LoginHours holds the policy restricting the times at which
+	// users may log in. Existing sessions are not affected. If this
+	// is nil logins are allowed at any time.
+	LoginHours *loginhours.Policy
+
+	// GroupWebhook, if set, holds the resolver used to get the groups
+	// of users from an external service when they log in.
+	GroupWebhook *groupwebhook.Resolver
+
+	// DeviceSessionLifetimes holds the maximum life of the discharge
+	// token created when a user logs in from each class of device,
+	// as determined by DeviceClassifier. Logins from devices of any
+	// other class use DischargeTokenTimeout.
+	DeviceSessionLifetimes map[string]time.Duration
+
+	// DeviceClassifier holds the classifier used to determine the
+	// class of device from which a user is logging in. If this is
+	// nil device.DefaultClassifier is used.
+	DeviceClassifier device.Classifier
+
+	// RelyingPartyRules holds, for each relying party host name, the
+	// rule that a user must satisfy to complete a redirect login
+	// whose return_to address is on that host, whatever the port.
+	// Keys must be in the form returned by idputil.RelyingPartyHost.
+	// Hosts with no rule allow all users.
+	RelyingPartyRules map[string]idputil.RelyingPartyRule
+
+	// DisableLegacyLogin, if set, disables the endpoints used by the
+	// legacy visit-wait and agent login protocols. Requests to those
+	// endpoints fail with a "not found" error.
+	DisableLegacyLogin bool
+
+	// UsernameCasePolicy holds the policy applied at login to
+	// usernames that differ only in case. If this is "insensitive"
+	// usernames are matched case-insensitively against existing
+	// identities from the same identity provider, which are reused;
+	// new identities are created with lower case usernames.
+	// Otherwise usernames that differ in case are distinct
+	// identities.
+	UsernameCasePolicy string
+
+	// UsernameFormat, if set, holds a text/template template used to
+	// derive the username of each new identity from the information
+	// supplied by the identity provider, see
+	// idputil.NewUsernameFormat. The format is only applied when an
+	// identity is created.
+	UsernameFormat string
+
+	// ExportRedactFields holds the names of the fields, as they
+	// appear in the JSON encoding of a params.User, that are
+	// redacted when users are exported.
+	ExportRedactFields []string
+
+	// AdminAccounts holds additional administrator accounts. Each
+	// account logs in as an agent using its own key and is treated
+	// as an admin. Individual accounts can be disabled at run time
+	// without affecting the others.
+	AdminAccounts []params.AdminAccount
+
+	// LimitToIDPTokenExpiry, if set, limits the lifetime of the
+	// discharge token created when a user logs in to the expiry time
+	// of the token issued by the identity provider, when the
+	// identity provider supplies one.
+	LimitToIDPTokenExpiry bool
+
+	// NonInteractiveLoginChain holds the login methods that are
+	// tried, in order, when a non-interactive client logs in using
+	// the /login-non-interactive endpoint. Each method is either
+	// "agent", which accepts a login macaroon held in the request,
+	// or the name of an identity provider that implements
+	// idp.NonInteractiveAuthenticator.
+	NonInteractiveLoginChain []string
+
+	// SlowStoreOperationThreshold holds the duration above which
+	// identity store operations are logged as slow. If this is zero
+	// slow operations are not logged.
+	SlowStoreOperationThreshold time.Duration
+
+	// IdentitySources maps identity provider names to the source
+	// tag recorded on the identities they create. Identities created
+	// by identity providers not in the map are tagged with the
+	// name of the identity provider.
+	IdentitySources map[string]string
+
+	// IdempotencyKeyTTL holds how long the response to a /v1 write
+	// request made with an Idempotency-Key header is kept, so that
+	// a retry of the request returns the original response. If this
+	// is zero the Idempotency-Key header is ignored.
+	IdempotencyKeyTTL time.Duration
+
+	// APITokenLifetime holds the maximum lifetime of the API tokens
+	// that administrators can create for users. API tokens
+	// authenticate requests using an "Authorization: Bearer" header.
+	// If this is zero API tokens are disabled.
+	APITokenLifetime time.Duration
+
+	// MinLoginGroups holds the minimum number of groups that a user
+	// must be a member of to complete a login. Default groups count
+	// towards the minimum. Users with fewer groups are treated as
+	// not provisioned and their logins are rejected. If this is zero
+	// no minimum is applied.
+	MinLoginGroups int
+
+	// TokenGenerator holds the generator used for random tokens and
+	// identifiers. If this is nil the default generator is used.
+	TokenGenerator *idputil.TokenGenerator
+
+	// RequestAuthCache, if set, causes the identity, group and ACL
+	// lookups made while authorizing a single API request to be
+	// remembered for the rest of that request.
+	RequestAuthCache bool
+
+	// AnonymousSessionLifetime holds the lifetime of the anonymous
+	// session macaroons issued to clients that have not yet logged
+	// in. If this is zero anonymous sessions are disabled.
+	AnonymousSessionLifetime time.Duration
+
+	// UniqueDisplayNames, if set, holds how display names are
+	// normalized when requiring every identity to have a different
+	// display name. If this is nil display names are not required to
+	// be unique.
+	UniqueDisplayNames *displayname.Params
+
+	// RelyingPartyGroups holds the group masks applied to the groups
+	// declared in discharge macaroons for particular relying
+	// parties. Relying parties without a mask are told the real
+	// names of all the requested groups.
+	RelyingPartyGroups []idputil.GroupMask
+
+	// ConditionalUserRequests, if set, causes requests for a single
+	// user to return ETag and Last-Modified headers, and to support
+	// the If-None-Match and If-Modified-Since request headers.
+	ConditionalUserRequests bool
+
+	// RequireTLS, if set, causes requests that were not made over
+	// TLS to be rejected, unless their path is listed in
+	// TLSExemptPaths. Requests from TrustedProxies are considered to
+	// have been made over TLS if the proxy reports so in the
+	// X-Forwarded-Proto header.
+	RequireTLS bool
+
+	// RedirectToTLS, if set with RequireTLS, causes GET and HEAD
+	// requests made without TLS to be redirected to the equivalent
+	// URL under Location instead of being rejected. Location must be
+	// an https URL.
+	RedirectToTLS bool
+
+	// TLSExemptPaths holds paths that may be requested without TLS
+	// when RequireTLS is set. A path ending in "/" also exempts all
+	// paths below it.
+	TLSExemptPaths []string
+
+	// LoginHandoffTimeout holds how long a login started in a browser
+	// may be continued on another device by scanning a QR code shown
+	// with the identity provider choices. If this is zero login
+	// hand-off is disabled.
+	LoginHandoffTimeout time.Duration
+
+	// IdentityAttributeSchema, if set, holds the schema that the
+	// extra-info attributes of identities must conform to when they
+	// are written through the extra-info API.
+	IdentityAttributeSchema *attrschema.Schema
+
+	// BreakGlass holds the emergency credential that grants admin
+	// access when the usual means of authentication are unavailable.
+	// If this is nil break-glass access is not enabled.
+	BreakGlass *breakglass.Credential
+
+	// IDPSessionLifetimes holds the maximum life of the discharge
+	// token created when a user logs in, keyed by the name of the
+	// identity provider the user logs in with. Identity providers
+	// that are not listed, or have a zero lifetime, use
+	// DischargeTokenTimeout. If a lifetime also applies from
+	// DeviceSessionLifetimes the shorter of the two is used.
+	IDPSessionLifetimes map[string]time.Duration
+
+	// LoginRateLimiter, if set, limits the rate at which requests may
+	// be made to the identity provider login handlers. Requests are
+	// limited for each client address and, where one is submitted,
+	// username, so that requests from one client cannot prevent
+	// another from logging in. Requests over the limit are rejected.
+	LoginRateLimiter ratelimit.Limiter
+
+	// LoginClientRateLimiter, if set, limits the rate at which each
+	// client address may make requests to the identity provider
+	// login handlers, whatever username is submitted, so that a
+	// client cannot avoid LoginRateLimiter by trying many
+	// usernames. Requests over the limit are rejected.
+	LoginClientRateLimiter ratelimit.Limiter
+
+	// AuditLogger, if set, records the outcome of every interactive
+	// and non-interactive login, whether it succeeds or fails.
+	AuditLogger audit.Logger
+}
+
+// MacaroonVersions returns the range of macaroon versions that will be
+// minted in response to requests.
+func (p ServerParams) MacaroonVersions() httpauth.VersionRange {
+	return httpauth.VersionRange{
+		Min: p.MinMacaroonVersion,
+		Max: p.MaxMacaroonVersion,
+	}
+}
+
+// AdminIPFilter returns the filter used to restrict the addresses
+// from which admin requests are accepted.
+func (p ServerParams) AdminIPFilter() *httpauth.IPFilter {
+	return &httpauth.IPFilter{
+		Allow:          p.AdminAllowedNetworks,
+		Deny:           p.AdminDeniedNetworks,
+		TrustedProxies: p.TrustedProxies,
+	}
+}
+
+// CheckExternalID checks that the given external ID is in the
+// namespace of a configured identity provider, when strict external
+// IDs have been configured. Without this an external ID could match
+// the identity that a different identity provider creates.
+func (p ServerParams) CheckExternalID(externalID string) error {
+	if !p.StrictExternalIDs {
+		return nil
+	}
+	if i := strings.IndexByte(externalID, ':'); i > 0 {
+		provider := externalID[:i]
+		for _, idp := range p.IdentityProviders {
+			if idp.Name() == provider {
+				return nil
+			}
+		}
+	}
+	return errgo.WithCausef(nil, params.ErrBadRequest, "external_id %q is not in the namespace of a configured identity provider", externalID)
+}
+
+// TLSRequirement returns the requirement for requests to be made over
+// TLS, or nil if TLS is not required.
+func (p ServerParams) TLSRequirement() *httpauth.TLSRequirement {
+	if !p.RequireTLS {
+		return nil
+	}
+	return &httpauth.TLSRequirement{
+		TrustedProxies: p.TrustedProxies,
+		ExemptPaths:    p.TLSExemptPaths,
+		Redirect:       p.RedirectToTLS,
+		Location:       p.Location,
+	}
+}
+
+// AddDefaultGroups returns a new slice containing the given groups
+// followed by any of the given default groups that are not already
+// present. See ServerParams.DefaultGroups.
+func AddDefaultGroups(groups, defaults []string) []string {
+	result := append([]string(nil), groups...)
+Outer:
+	for _, g := range defaults {
+		for _, g1 := range result {
+			if g1 == g {
+				continue Outer
+			}
+		}
+		result = append(result, g)
+	}
+	return result
 }
 
 type HandlerParams struct {
@@ -297,6 +923,25 @@ type HandlerParams struct {
 	// MeetingPlace contains the meeting place that should be used by
 	// handlers to complete rendezvous.
 	MeetingPlace *meeting.Place
+
+	// IDPStatus records which of the identity providers have been
+	// disabled.
+	IDPStatus *IDPStatus
+}
+
+// checkAgentCaveats checks that the given agent required caveats are
+// all third-party caveats addressed to one of the given third
+// parties.
+func checkAgentCaveats(caveats []checkers.Caveat, thirdParties map[string]bakery.ThirdPartyInfo) error {
+	for _, cav := range caveats {
+		if cav.Condition == "" {
+			return errgo.Newf("agent required caveat at %q has no condition", cav.Location)
+		}
+		if _, ok := thirdParties[cav.Location]; !ok {
+			return errgo.Newf("agent required caveat %q has unknown third party %q", cav.Condition, cav.Location)
+		}
+	}
+	return nil
 }
 
 // notFound is the handler that is called when a handler cannot be found
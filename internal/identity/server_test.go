@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -24,8 +25,6 @@ import (
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 
-	"github.com/canonical/candid/idp"
-	"github.com/canonical/candid/idp/static"
 	"github.com/canonical/candid/internal/auth"
 	"github.com/canonical/candid/internal/candidtest"
 	"github.com/canonical/candid/internal/debug"
@@ -57,6 +56,37 @@ func (s *serverSuite) TestNewServerWithNoVersions(c *qt.C) {
 	c.Assert(h, qt.IsNil)
 }
 
+func (s *serverSuite) TestNewServerWithInvalidLocation(c *qt.C) {
+	h, err := identity.New(identity.ServerParams{
+		Store:        s.store.Store,
+		MeetingStore: s.store.MeetingStore,
+		Location:     "candid.example.com",
+	}, map[string]identity.NewAPIHandlerFunc{
+		"v1": func(identity.HandlerParams) ([]httprequest.Handler, error) {
+			return nil, nil
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `invalid location: "candid.example.com" is not an absolute http or https URL`)
+	c.Assert(h, qt.IsNil)
+}
+
+func (s *serverSuite) TestNewServerWithUnknownDeprecation(c *qt.C) {
+	h, err := identity.New(identity.ServerParams{
+		Store:        s.store.Store,
+		MeetingStore: s.store.MeetingStore,
+		ACLStore:     s.store.ACLStore,
+		Deprecations: map[string]identity.Deprecation{
+			"/login-legcy": {},
+		},
+	}, map[string]identity.NewAPIHandlerFunc{
+		"v1": func(identity.HandlerParams) ([]httprequest.Handler, error) {
+			return nil, nil
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `deprecation configured for unknown endpoint "/login-legcy"`)
+	c.Assert(h, qt.IsNil)
+}
+
 type versionResponse struct {
 	Version string
 	Path    string
@@ -248,6 +278,108 @@ func (s *serverSuite) TestServerStaticFiles(c *qt.C) {
 	c.Assert(rr.Body.String(), qt.Equals, "test file")
 }
 
+func (s *serverSuite) TestServerRequireTLS(c *qt.C) {
+	impl := map[string]identity.NewAPIHandlerFunc{
+		"/a": func(identity.HandlerParams) ([]httprequest.Handler, error) {
+			return []httprequest.Handler{{
+				Method: "GET",
+				Path:   "/a",
+				Handle: func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+				},
+			}, {
+				Method: "POST",
+				Path:   "/a",
+				Handle: func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+				},
+			}, {
+				Method: "GET",
+				Path:   "/health",
+				Handle: func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
+				},
+			}}, nil
+		},
+	}
+	_, proxies, err := net.ParseCIDR("192.0.2.0/24")
+	c.Assert(err, qt.IsNil)
+	sp := identity.ServerParams{
+		Store:          s.store.Store,
+		MeetingStore:   s.store.MeetingStore,
+		ACLStore:       s.store.ACLStore,
+		Location:       "https://candid.example.com",
+		RequireTLS:     true,
+		TLSExemptPaths: []string{"/health"},
+		TrustedProxies: []*net.IPNet{proxies},
+	}
+	h, err := identity.New(sp, impl)
+	c.Assert(err, qt.IsNil)
+	defer h.Close()
+
+	do := func(h http.Handler, method, path, remoteAddr, proto string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://candid.example.com"+path, nil)
+		c.Assert(err, qt.IsNil)
+		req.RemoteAddr = remoteAddr
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do(h, "GET", "/a", "198.51.100.1:1234", "")
+	c.Assert(rr.Code, qt.Equals, http.StatusForbidden)
+	var perr params.Error
+	err = json.Unmarshal(rr.Body.Bytes(), &perr)
+	c.Assert(err, qt.IsNil)
+	c.Assert(perr, qt.DeepEquals, params.Error{
+		Code:    params.ErrForbidden,
+		Message: "TLS is required",
+	})
+
+	// An untrusted host cannot claim the request used TLS.
+	rr = do(h, "GET", "/a", "198.51.100.1:1234", "https")
+	c.Assert(rr.Code, qt.Equals, http.StatusForbidden)
+
+	// A trusted proxy reporting plain HTTP is rejected.
+	rr = do(h, "GET", "/a", "192.0.2.1:1234", "http")
+	c.Assert(rr.Code, qt.Equals, http.StatusForbidden)
+
+	// A trusted proxy reporting TLS is allowed.
+	rr = do(h, "GET", "/a", "192.0.2.1:1234", "https")
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+
+	// Exempt paths are allowed.
+	rr = do(h, "GET", "/health", "198.51.100.1:1234", "")
+	c.Assert(rr.Code, qt.Equals, http.StatusOK)
+
+	// Local clients are not exempt, as they may be an untrusted proxy.
+	rr = do(h, "GET", "/a", "127.0.0.1:1234", "")
+	c.Assert(rr.Code, qt.Equals, http.StatusForbidden)
+
+	sp.RedirectToTLS = true
+	h, err = identity.New(sp, impl)
+	c.Assert(err, qt.IsNil)
+	defer h.Close()
+
+	rr = do(h, "GET", "/a?x=1", "198.51.100.1:1234", "")
+	c.Assert(rr.Code, qt.Equals, http.StatusMovedPermanently)
+	c.Assert(rr.Header().Get("Location"), qt.Equals, "https://candid.example.com/a?x=1")
+
+	// The redirect is to the configured location, not the requested
+	// host.
+	req, err := http.NewRequest("GET", "http://attacker.example.com/a", nil)
+	c.Assert(err, qt.IsNil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	c.Assert(rr.Code, qt.Equals, http.StatusMovedPermanently)
+	c.Assert(rr.Header().Get("Location"), qt.Equals, "https://candid.example.com/a")
+
+	// Requests that cannot be redirected safely are rejected.
+	rr = do(h, "POST", "/a", "198.51.100.1:1234", "")
+	c.Assert(rr.Code, qt.Equals, http.StatusForbidden)
+}
+
 func assertServesVersion(c *qt.C, h http.Handler, vers string) {
 	path := vers
 	if path != "" {
@@ -279,11 +411,7 @@ type fullServerSuite struct {
 func (s *fullServerSuite) Init(c *qt.C) {
 	s.store = candidtest.NewStore()
 	sp := s.store.ServerParams()
-	sp.IdentityProviders = []idp.IdentityProvider{
-		static.NewIdentityProvider(static.Params{
-			Name: "test",
-		}),
-	}
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", nil))
 	s.srv = candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
 		"debug":      debug.NewAPIHandler,
 		"discharger": discharger.NewAPIHandler,
@@ -0,0 +1,78 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/net/trace"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// A slowLoggingStore is a store.Store that logs a warning for every
+// operation that takes longer than a threshold. Only the name of the
+// operation and its duration are logged, not its arguments.
+type slowLoggingStore struct {
+	store.Store
+	threshold time.Duration
+}
+
+// newSlowLoggingStore returns a slowLoggingStore that wraps st and logs
+// operations that take longer than threshold.
+func newSlowLoggingStore(st store.Store, threshold time.Duration) *slowLoggingStore {
+	return &slowLoggingStore{
+		Store:     st,
+		threshold: threshold,
+	}
+}
+
+// Identity implements store.Store.Identity.
+func (s *slowLoggingStore) Identity(ctx context.Context, identity *store.Identity) error {
+	defer s.observe(ctx, "Identity", time.Now())
+	return errgo.Mask(s.Store.Identity(ctx, identity), errgo.Any)
+}
+
+// FindIdentities implements store.Store.FindIdentities.
+func (s *slowLoggingStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
+	defer s.observe(ctx, "FindIdentities", time.Now())
+	ids, err := s.Store.FindIdentities(ctx, ref, filter, sort, skip, limit)
+	return ids, errgo.Mask(err, errgo.Any)
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s *slowLoggingStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	defer s.observe(ctx, "UpdateIdentity", time.Now())
+	return errgo.Mask(s.Store.UpdateIdentity(ctx, identity, update), errgo.Any)
+}
+
+// RemoveIdentity implements store.IdentityRemover.RemoveIdentity.
+func (s *slowLoggingStore) RemoveIdentity(ctx context.Context, identity *store.Identity) error {
+	defer s.observe(ctx, "RemoveIdentity", time.Now())
+	return errgo.Mask(store.RemoveIdentity(ctx, s.Store, identity), errgo.Any)
+}
+
+// IdentityCounts implements store.Store.IdentityCounts.
+func (s *slowLoggingStore) IdentityCounts(ctx context.Context) (map[string]int, error) {
+	defer s.observe(ctx, "IdentityCounts", time.Now())
+	counts, err := s.Store.IdentityCounts(ctx)
+	return counts, errgo.Mask(err, errgo.Any)
+}
+
+// observe logs the named operation, which started at the given time, if
+// it has taken longer than the threshold. The operation is also
+// recorded in the request trace, if there is one, so that it can be
+// correlated with the request that made it.
+func (s *slowLoggingStore) observe(ctx context.Context, op string, start time.Time) {
+	d := time.Since(start)
+	if d < s.threshold {
+		return
+	}
+	if t, ok := trace.FromContext(ctx); ok {
+		t.LazyPrintf("slow store operation %s took %v", op, d)
+	}
+	logger.Warningf("slow store operation %s took %v", op, d)
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/loggo"
+
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/memstore"
+)
+
+// latencyStore is a store.Store that adds latency to every
+// UpdateIdentity call.
+type latencyStore struct {
+	store.Store
+	latency time.Duration
+}
+
+func (s *latencyStore) UpdateIdentity(ctx context.Context, id *store.Identity, update store.Update) error {
+	time.Sleep(s.latency)
+	return s.Store.UpdateIdentity(ctx, id, update)
+}
+
+func TestSlowLoggingStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	candidtest.LogTo(c)
+	w := new(loggo.TestWriter)
+	loggo.RegisterWriter("test", w)
+	ctx := context.Background()
+	st := identity.NewSlowLoggingStore(&latencyStore{
+		Store:   memstore.NewStore(),
+		latency: 50 * time.Millisecond,
+	}, 20*time.Millisecond)
+
+	// Slow operations are logged.
+	err := st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	assertLogMatches(c, w.Log(), loggo.WARNING, `slow store operation UpdateIdentity took .*`)
+
+	// Fast operations are not.
+	w.Clear()
+	err = st.Identity(ctx, &store.Identity{Username: "bob"})
+	c.Assert(err, qt.IsNil)
+	for _, e := range w.Log() {
+		c.Assert(e.Message, qt.Not(qt.Matches), `slow store operation .*`)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity
+
+import (
+	"context"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// A sourceTaggingStore is a store.Store that tags every identity it
+// creates with the system that the identity originated from. The
+// source is the name of the identity provider that created the
+// identity, unless that name is mapped to a different source.
+//
+// The underlying store only records the source when an identity is
+// created, so it is safe to add to every update that might create
+// one.
+type sourceTaggingStore struct {
+	store.Store
+	sources map[string]string
+}
+
+// newSourceTaggingStore returns a sourceTaggingStore that wraps st and
+// uses the given map from identity provider name to source.
+func newSourceTaggingStore(st store.Store, sources map[string]string) *sourceTaggingStore {
+	return &sourceTaggingStore{
+		Store:   st,
+		sources: sources,
+	}
+}
+
+// RemoveIdentity implements store.IdentityRemover.RemoveIdentity.
+func (s *sourceTaggingStore) RemoveIdentity(ctx context.Context, identity *store.Identity) error {
+	return errgo.Mask(store.RemoveIdentity(ctx, s.Store, identity), errgo.Any)
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s *sourceTaggingStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	if update[store.Username] != store.Set || identity.ProviderID == "" || update[store.Source] != store.NoUpdate {
+		// This update cannot create an identity, or the caller
+		// has chosen the source itself.
+		return errgo.Mask(s.Store.UpdateIdentity(ctx, identity, update), errgo.Any)
+	}
+	id := *identity
+	id.Source = s.source(identity.ProviderID.Provider())
+	update[store.Source] = store.Set
+	err := s.Store.UpdateIdentity(ctx, &id, update)
+	identity.ID = id.ID
+	return errgo.Mask(err, errgo.Any)
+}
+
+// source returns the source for identities created by the named
+// identity provider.
+func (s *sourceTaggingStore) source(provider string) string {
+	if source, ok := s.sources[provider]; ok {
+		return source
+	}
+	return provider
+}
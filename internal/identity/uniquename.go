@@ -0,0 +1,80 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity
+
+import (
+	"context"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/displayname"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// A uniqueNameStore is a store.Store that refuses to set the display
+// name of an identity to a name that is already used by another
+// identity. Display names are compared after normalization.
+//
+// The check is made before the update is written, so two concurrent
+// updates that set the same display name may both succeed.
+type uniqueNameStore struct {
+	store.Store
+	params displayname.Params
+}
+
+// newUniqueNameStore returns a uniqueNameStore that wraps st and
+// normalizes display names with the given parameters.
+func newUniqueNameStore(st store.Store, p displayname.Params) *uniqueNameStore {
+	return &uniqueNameStore{
+		Store:  st,
+		params: p,
+	}
+}
+
+// RemoveIdentity implements store.IdentityRemover.RemoveIdentity.
+func (s *uniqueNameStore) RemoveIdentity(ctx context.Context, identity *store.Identity) error {
+	return errgo.Mask(store.RemoveIdentity(ctx, s.Store, identity), errgo.Any)
+}
+
+// UpdateIdentity implements store.Store.UpdateIdentity.
+func (s *uniqueNameStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
+	if update[store.Name] == store.Set && s.params.Normalize(identity.Name) != "" {
+		if err := s.checkName(ctx, identity); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrAlreadyExists))
+		}
+	}
+	return errgo.Mask(s.Store.UpdateIdentity(ctx, identity, update), errgo.Any)
+}
+
+// checkName returns an error with a cause of params.ErrAlreadyExists if
+// the display name of the given identity is used by a different
+// identity. Identities that keep their current display name are not
+// checked, so that existing duplicates do not stop them being updated.
+func (s *uniqueNameStore) checkName(ctx context.Context, identity *store.Identity) error {
+	current := store.Identity{
+		ID:         identity.ID,
+		ProviderID: identity.ProviderID,
+		Username:   identity.Username,
+	}
+	err := s.Store.Identity(ctx, &current)
+	switch {
+	case err == nil:
+		if s.params.Normalize(current.Name) == s.params.Normalize(identity.Name) {
+			return nil
+		}
+	case errgo.Cause(err) == store.ErrNotFound:
+		// The update will create a new identity.
+	default:
+		return errgo.Mask(err)
+	}
+	username, err := displayname.FindConflict(ctx, s.Store, s.params, identity.Name, current.ID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if username != "" {
+		return errgo.WithCausef(nil, params.ErrAlreadyExists, "display name %q is already in use", identity.Name)
+	}
+	return nil
+}
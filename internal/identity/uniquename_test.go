@@ -0,0 +1,91 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/displayname"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+	"github.com/canonical/candid/store/memstore"
+)
+
+func TestUniqueNameStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	underlying := memstore.NewStore()
+	st := identity.NewUniqueNameStore(underlying, displayname.Params{
+		TrimSpace:       true,
+		CaseInsensitive: true,
+	})
+	update := store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	}
+	err := st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Name:       "Bob Smith",
+	}, update)
+	c.Assert(err, qt.IsNil)
+
+	// A new identity cannot use a name that only differs by
+	// normalization.
+	err = st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob2"),
+		Username:   "bob2",
+		Name:       " bob smith ",
+	}, update)
+	c.Assert(err, qt.ErrorMatches, `display name " bob smith " is already in use`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrAlreadyExists)
+	id := store.Identity{Username: "bob2"}
+	err = underlying.Identity(ctx, &id)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+
+	// An existing identity cannot be renamed to a name in use.
+	err = st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+		Name:       "Alice",
+	}, update)
+	c.Assert(err, qt.IsNil)
+	err = st.UpdateIdentity(ctx, &store.Identity{
+		Username: "alice",
+		Name:     "BOB SMITH",
+	}, store.Update{
+		store.Name: store.Set,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrAlreadyExists)
+
+	// An identity can be updated without changing its name, even if
+	// the name was duplicated before the check was enabled.
+	err = underlying.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob3"),
+		Username:   "bob3",
+		Name:       "Bob Smith",
+	}, update)
+	c.Assert(err, qt.IsNil)
+	err = st.UpdateIdentity(ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob3"),
+		Username:   "bob3",
+		Name:       "bob smith",
+	}, update)
+	c.Assert(err, qt.IsNil)
+
+	// Empty display names are not checked.
+	for _, username := range []string{"anon1", "anon2"} {
+		err = st.UpdateIdentity(ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", username),
+			Username:   username,
+			Name:       " ",
+		}, update)
+		c.Assert(err, qt.IsNil)
+	}
+}
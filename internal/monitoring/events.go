@@ -0,0 +1,56 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	eventQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "candid",
+		Subsystem: "events",
+		Name:      "queue_depth",
+		Help:      "The number of events waiting to be delivered.",
+	})
+	eventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "candid",
+		Subsystem: "events",
+		Name:      "dropped_total",
+		Help:      "The number of events that were discarded without being delivered.",
+	}, []string{"reason"})
+	eventDeliveryPaused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "candid",
+		Subsystem: "events",
+		Name:      "delivery_paused",
+		Help:      "Whether event delivery is paused because of persistent failures.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(eventQueueDepth)
+	prometheus.MustRegister(eventsDropped)
+	prometheus.MustRegister(eventDeliveryPaused)
+}
+
+// EventQueueDepth records the number of events waiting to be
+// delivered.
+func EventQueueDepth(n int) {
+	eventQueueDepth.Set(float64(n))
+}
+
+// EventDropped records that an event was discarded for the given
+// reason.
+func EventDropped(reason string) {
+	eventsDropped.WithLabelValues(reason).Inc()
+}
+
+// EventDeliveryPaused records whether event delivery is paused.
+func EventDeliveryPaused(paused bool) {
+	v := 0.0
+	if paused {
+		v = 1
+	}
+	eventDeliveryPaused.Set(v)
+}
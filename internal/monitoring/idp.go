@@ -0,0 +1,190 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxRecentLogins holds the number of login outcomes retained for
+// RecentLogins.
+const maxRecentLogins = 50
+
+var (
+	loginsInProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "candid",
+		Subsystem: "idp",
+		Name:      "logins_in_progress",
+		Help:      "The number of login requests currently being handled by each identity provider.",
+	}, []string{"idp"})
+	loginsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "candid",
+		Subsystem: "idp",
+		Name:      "logins_rejected_total",
+		Help:      "The number of login requests rejected because too many were in progress.",
+	}, []string{"idp"})
+	loginsCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "candid",
+		Subsystem: "idp",
+		Name:      "logins_total",
+		Help:      "The number of logins completed with each identity provider, by result.",
+	}, []string{"idp", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(loginsInProgress)
+	prometheus.MustRegister(loginsRejected)
+	prometheus.MustRegister(loginsCompleted)
+}
+
+// idpState holds a copy of the identity provider metrics that can be
+// read back to report status.
+var idpState = struct {
+	mu          sync.Mutex
+	inProgress  map[string]int
+	rejected    map[string]int
+	ldapServers map[string]map[string]bool
+	recent      []LoginOutcome
+}{
+	inProgress:  make(map[string]int),
+	rejected:    make(map[string]int),
+	ldapServers: make(map[string]map[string]bool),
+}
+
+// LoginStarted records that a login request to the given identity
+// provider has started.
+func LoginStarted(idp string) {
+	loginsInProgress.WithLabelValues(idp).Inc()
+	idpState.mu.Lock()
+	defer idpState.mu.Unlock()
+	idpState.inProgress[idp]++
+}
+
+// LoginFinished records that a login request to the given identity
+// provider has finished.
+func LoginFinished(idp string) {
+	loginsInProgress.WithLabelValues(idp).Dec()
+	idpState.mu.Lock()
+	defer idpState.mu.Unlock()
+	idpState.inProgress[idp]--
+}
+
+// LoginRejected records that a login request to the given identity
+// provider was rejected because too many were already in progress.
+func LoginRejected(idp string) {
+	loginsRejected.WithLabelValues(idp).Inc()
+	idpState.mu.Lock()
+	defer idpState.mu.Unlock()
+	idpState.rejected[idp]++
+}
+
+// A LoginOutcome holds the result of a completed login.
+type LoginOutcome struct {
+	// Time holds the time the login completed.
+	Time time.Time
+
+	// IDP holds the name of the identity provider used for the
+	// login, if known.
+	IDP string
+
+	// Username holds the username of the identity that logged in.
+	// This is empty for failed logins.
+	Username string
+
+	// Error holds the reason a failed login failed. This is empty
+	// for successful logins.
+	Error string
+}
+
+// LoginSucceeded records that the given user successfully logged in
+// with the given identity provider.
+func LoginSucceeded(idp, username string) {
+	loginsCompleted.WithLabelValues(idp, "success").Inc()
+	addLoginOutcome(LoginOutcome{
+		Time:     time.Now(),
+		IDP:      idp,
+		Username: username,
+	})
+}
+
+// LoginFailed records that a login with the given identity provider
+// failed with the given error.
+func LoginFailed(idp string, err error) {
+	loginsCompleted.WithLabelValues(idp, "failure").Inc()
+	addLoginOutcome(LoginOutcome{
+		Time:  time.Now(),
+		IDP:   idp,
+		Error: err.Error(),
+	})
+}
+
+func addLoginOutcome(o LoginOutcome) {
+	idpState.mu.Lock()
+	defer idpState.mu.Unlock()
+	if len(idpState.recent) >= maxRecentLogins {
+		copy(idpState.recent, idpState.recent[1:])
+		idpState.recent = idpState.recent[:len(idpState.recent)-1]
+	}
+	idpState.recent = append(idpState.recent, o)
+}
+
+// RecentLogins returns the outcomes of the most recently completed
+// logins, most recent first.
+func RecentLogins() []LoginOutcome {
+	idpState.mu.Lock()
+	defer idpState.mu.Unlock()
+	outcomes := make([]LoginOutcome, len(idpState.recent))
+	for i, o := range idpState.recent {
+		outcomes[len(outcomes)-1-i] = o
+	}
+	return outcomes
+}
+
+// An IDPStatus holds the current status of an identity provider as
+// recorded by the metrics in this package.
+type IDPStatus struct {
+	// LoginsInProgress holds the number of login requests currently
+	// being handled.
+	LoginsInProgress int
+
+	// LoginsRejected holds the number of login requests rejected
+	// because too many were in progress.
+	LoginsRejected int
+
+	// Servers holds the health of each of the servers used by the
+	// identity provider, if it reports any.
+	Servers []ServerStatus
+}
+
+// A ServerStatus holds the health of a server used by an identity
+// provider.
+type ServerStatus struct {
+	Address string
+	Up      bool
+}
+
+// GetIDPStatus returns the current status of the named identity
+// provider.
+func GetIDPStatus(idp string) IDPStatus {
+	idpState.mu.Lock()
+	defer idpState.mu.Unlock()
+	st := IDPStatus{
+		LoginsInProgress: idpState.inProgress[idp],
+		LoginsRejected:   idpState.rejected[idp],
+	}
+	for addr, up := range idpState.ldapServers[idp] {
+		st.Servers = append(st.Servers, ServerStatus{
+			Address: addr,
+			Up:      up,
+		})
+	}
+	sort.Slice(st.Servers, func(i, j int) bool {
+		return st.Servers[i].Address < st.Servers[j].Address
+	})
+	return st
+}
@@ -0,0 +1,35 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ldapServerUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "candid",
+	Subsystem: "ldap",
+	Name:      "server_up",
+	Help:      "Whether an LDAP server is healthy (1) or failing (0).",
+}, []string{"idp", "server"})
+
+func init() {
+	prometheus.MustRegister(ldapServerUp)
+}
+
+// LDAPServerUp records whether the LDAP server at the given address,
+// used by the named identity provider, is healthy.
+func LDAPServerUp(idp, server string, up bool) {
+	v := 0.0
+	if up {
+		v = 1
+	}
+	ldapServerUp.WithLabelValues(idp, server).Set(v)
+	idpState.mu.Lock()
+	defer idpState.mu.Unlock()
+	if idpState.ldapServers[idp] == nil {
+		idpState.ldapServers[idp] = make(map[string]bool)
+	}
+	idpState.ldapServers[idp][server] = up
+}
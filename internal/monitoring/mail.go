@@ -0,0 +1,71 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package monitoring
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	mailQueued = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "candid",
+		Subsystem: "mail",
+		Name:      "queued_total",
+		Help:      "The number of email messages queued to be sent.",
+	})
+	mailQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "candid",
+		Subsystem: "mail",
+		Name:      "queue_depth",
+		Help:      "The number of email messages waiting to be sent.",
+	})
+	mailRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "candid",
+		Subsystem: "mail",
+		Name:      "rejected_total",
+		Help:      "The number of email messages rejected because the queue was full.",
+	})
+	mailSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "candid",
+		Subsystem: "mail",
+		Name:      "sent_total",
+		Help:      "The number of attempts to send an email message, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(mailQueued)
+	prometheus.MustRegister(mailQueueDepth)
+	prometheus.MustRegister(mailRejected)
+	prometheus.MustRegister(mailSent)
+}
+
+// MailQueued records that an email message has been queued to be
+// sent, and that n messages are now waiting.
+func MailQueued(n int) {
+	mailQueued.Inc()
+	mailQueueDepth.Set(float64(n))
+}
+
+// MailDequeued records that an email message has been taken from the
+// queue, and that n messages are still waiting.
+func MailDequeued(n int) {
+	mailQueueDepth.Set(float64(n))
+}
+
+// MailRejected records that an email message was rejected because the
+// queue was full.
+func MailRejected() {
+	mailRejected.Inc()
+}
+
+// MailSent records an attempt to send an email message, which failed
+// if err is not nil.
+func MailSent(err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	mailSent.WithLabelValues(result).Inc()
+}
@@ -0,0 +1,9 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package qrcode
+
+var (
+	RSDivisor   = rsDivisor
+	RSRemainder = rsRemainder
+)
@@ -0,0 +1,514 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package qrcode encodes short texts, such as URLs, as QR codes.
+//
+// Only the byte encoding mode and the medium error correction level
+// are supported, with symbols up to version 10. This is enough for
+// texts of up to 213 bytes.
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/errgo.v1"
+)
+
+// maxVersion holds the largest symbol version supported.
+const maxVersion = 10
+
+// A blockInfo describes how the codewords of a symbol version are
+// divided into error correction blocks at the medium error correction
+// level.
+type blockInfo struct {
+	// ecLen holds the number of error correction codewords in each
+	// block.
+	ecLen int
+
+	// blocks1 and data1 hold the number of blocks in the first group
+	// and the number of data codewords in each.
+	blocks1, data1 int
+
+	// blocks2 and data2 hold the number of blocks in the second group
+	// and the number of data codewords in each.
+	blocks2, data2 int
+}
+
+// versionBlocks holds the block structure of each version, indexed by
+// version.
+var versionBlocks = [maxVersion + 1]blockInfo{
+	1:  {10, 1, 16, 0, 0},
+	2:  {16, 1, 28, 0, 0},
+	3:  {26, 1, 44, 0, 0},
+	4:  {18, 2, 32, 0, 0},
+	5:  {24, 2, 43, 0, 0},
+	6:  {16, 4, 27, 0, 0},
+	7:  {18, 4, 31, 0, 0},
+	8:  {22, 2, 38, 2, 39},
+	9:  {22, 3, 36, 2, 37},
+	10: {26, 4, 43, 1, 44},
+}
+
+// alignmentPositions holds the centre coordinates of the alignment
+// patterns of each version, indexed by version.
+var alignmentPositions = [maxVersion + 1][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+// dataCodewords returns the number of data codewords in a symbol of
+// the given version.
+func (b blockInfo) dataCodewords() int {
+	return b.blocks1*b.data1 + b.blocks2*b.data2
+}
+
+// A Code is a QR code symbol.
+type Code struct {
+	size    int
+	modules []bool
+	// function records which modules are part of the function
+	// patterns rather than the encoded data.
+	function []bool
+}
+
+// Encode returns a QR code that encodes the given text using the
+// smallest symbol version that will hold it.
+func Encode(text string) (*Code, error) {
+	for version := 1; version <= maxVersion; version++ {
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(text) <= 8*versionBlocks[version].dataCodewords() {
+			return encode(version, countBits, []byte(text)), nil
+		}
+	}
+	return nil, errgo.Newf("text too long to encode (%d bytes)", len(text))
+}
+
+// Size returns the width and height of the symbol in modules, not
+// including the quiet zone.
+func (c *Code) Size() int {
+	return c.size
+}
+
+// Black reports whether the module at the given column and row is
+// dark.
+func (c *Code) Black(x, y int) bool {
+	return c.modules[y*c.size+x]
+}
+
+// SVG returns an SVG image of the symbol, including a quiet zone of
+// four modules, in which each module is the given number of pixels
+// wide.
+func (c *Code) SVG(scale int) []byte {
+	const border = 4
+	n := (c.size + 2*border) * scale
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, n, n, c.size+2*border, c.size+2*border)
+	buf.WriteString(`<rect width="100%" height="100%" fill="#fff"/><path fill="#000" d="`)
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if c.Black(x, y) {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+border, y+border)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// encode encodes data as a symbol of the given version.
+func encode(version, countBits int, data []byte) *Code {
+	blocks := versionBlocks[version]
+	codewords := interleave(blocks, encodeData(blocks.dataCodewords(), countBits, data))
+
+	size := 17 + 4*version
+	c := &Code{
+		size:     size,
+		modules:  make([]bool, size*size),
+		function: make([]bool, size*size),
+	}
+	c.drawFunctionPatterns(version)
+	c.drawCodewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		// Masking is its own inverse.
+		c.applyMask(mask)
+	}
+	c.applyMask(best)
+	c.drawFormatBits(best)
+	return c
+}
+
+// encodeData returns the data codewords encoding data in byte mode,
+// padded to the given number of codewords.
+func encodeData(n, countBits int, data []byte) []byte {
+	var bb bitBuffer
+	bb.append(0x4, 4)
+	bb.append(uint(len(data)), countBits)
+	for _, b := range data {
+		bb.append(uint(b), 8)
+	}
+	// Add a terminator of up to four zero bits, then pad to a
+	// whole number of bytes.
+	for i := 0; i < 4 && bb.len < 8*n; i++ {
+		bb.append(0, 1)
+	}
+	for bb.len%8 != 0 {
+		bb.append(0, 1)
+	}
+	for pad := uint(0xec); bb.len < 8*n; pad ^= 0xec ^ 0x11 {
+		bb.append(pad, 8)
+	}
+	return bb.bytes
+}
+
+// interleave splits the given data codewords into blocks, adds the
+// error correction codewords for each block, and returns the
+// codewords in the order they are placed in the symbol.
+func interleave(info blockInfo, data []byte) []byte {
+	var dataBlocks, ecBlocks [][]byte
+	divisor := rsDivisor(info.ecLen)
+	for i := 0; i < info.blocks1+info.blocks2; i++ {
+		n := info.data1
+		if i >= info.blocks1 {
+			n = info.data2
+		}
+		dataBlocks = append(dataBlocks, data[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(data[:n], divisor))
+		data = data[n:]
+	}
+	var result []byte
+	for i := 0; i < info.data1 || i < info.data2; i++ {
+		for _, b := range dataBlocks {
+			if i < len(b) {
+				result = append(result, b[i])
+			}
+		}
+	}
+	for i := 0; i < info.ecLen; i++ {
+		for _, b := range ecBlocks {
+			result = append(result, b[i])
+		}
+	}
+	return result
+}
+
+// setFunction sets the given function module.
+func (c *Code) setFunction(x, y int, black bool) {
+	c.modules[y*c.size+x] = black
+	c.function[y*c.size+x] = true
+}
+
+// drawFunctionPatterns draws the finder, timing and alignment
+// patterns, and the version information, and reserves space for the
+// format information.
+func (c *Code) drawFunctionPatterns(version int) {
+	for i := 0; i < c.size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+	c.drawFinderPattern(3, 3)
+	c.drawFinderPattern(c.size-4, 3)
+	c.drawFinderPattern(3, c.size-4)
+
+	pos := alignmentPositions[version]
+	last := len(pos) - 1
+	for i, x := range pos {
+		for j, y := range pos {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				// This would overlap a finder pattern.
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format information modules; they are drawn once
+	// the mask is known.
+	c.drawFormatBits(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			black := bits>>uint(i)&1 != 0
+			a, b := c.size-11+i%3, i/3
+			c.setFunction(a, b, black)
+			c.setFunction(b, a, black)
+		}
+	}
+}
+
+// drawFinderPattern draws a finder pattern, with its separator,
+// centred on the given module.
+func (c *Code) drawFinderPattern(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= c.size || yy < 0 || yy >= c.size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.setFunction(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+// drawFormatBits draws the format information for the medium error
+// correction level and the given mask.
+func (c *Code) drawFormatBits(mask int) {
+	// The medium error correction level is encoded as 0.
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool {
+		return bits>>uint(i)&1 != 0
+	}
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(i))
+	}
+	c.setFunction(8, 7, bit(6))
+	c.setFunction(8, 8, bit(7))
+	c.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.size-15+i, bit(i))
+	}
+	// The dark module is always set.
+	c.setFunction(8, c.size-8, true)
+}
+
+// drawCodewords places the given codewords in the data modules,
+// starting at the bottom right corner and moving in a zigzag through
+// pairs of columns.
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// Skip the vertical timing pattern.
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.size; vert++ {
+			y := vert
+			if upward {
+				y = c.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.function[y*c.size+x] || i >= 8*len(codewords) {
+					continue
+				}
+				c.modules[y*c.size+x] = codewords[i/8]>>uint(7-i%8)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by the given mask
+// pattern.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if !c.function[y*c.size+x] && masked(mask, x, y) {
+				c.modules[y*c.size+x] = !c.modules[y*c.size+x]
+			}
+		}
+	}
+}
+
+// masked reports whether the module at the given column and row is
+// inverted by the given mask pattern.
+func masked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// penalty returns the penalty score used to choose between masks. A
+// lower score indicates a symbol that is easier to read.
+func (c *Code) penalty() int {
+	p := 0
+	black := 0
+	for i := 0; i < c.size; i++ {
+		p += c.linePenalty(func(j int) bool { return c.Black(j, i) })
+		p += c.linePenalty(func(j int) bool { return c.Black(i, j) })
+	}
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			b := c.Black(x, y)
+			if b {
+				black++
+			}
+			if x < c.size-1 && y < c.size-1 && b == c.Black(x+1, y) && b == c.Black(x, y+1) && b == c.Black(x+1, y+1) {
+				p += 3
+			}
+		}
+	}
+	percent := black * 100 / (c.size * c.size)
+	return p + abs(percent-50)/5*10
+}
+
+// finderLike holds the module pattern, with four light modules on one
+// side, that resembles part of a finder pattern.
+var finderLike = []bool{true, false, true, true, true, false, true, false, false, false, false}
+
+// linePenalty returns the penalty for runs of modules of the same
+// colour and for patterns resembling finder patterns in a single row
+// or column, where module(j) returns the j'th module of the line.
+func (c *Code) linePenalty(module func(j int) bool) int {
+	p := 0
+	run := 0
+	for j := 0; j < c.size; j++ {
+		if j > 0 && module(j) == module(j-1) {
+			run++
+		} else {
+			run = 1
+		}
+		if run == 5 {
+			p += 3
+		} else if run > 5 {
+			p++
+		}
+	}
+	n := len(finderLike)
+	for j := 0; j+n <= c.size; j++ {
+		forward, backward := true, true
+		for k := 0; k < n; k++ {
+			forward = forward && module(j+k) == finderLike[k]
+			backward = backward && module(j+k) == finderLike[n-1-k]
+		}
+		if forward {
+			p += 40
+		}
+		if backward {
+			p += 40
+		}
+	}
+	return p
+}
+
+// A bitBuffer accumulates a sequence of bits.
+type bitBuffer struct {
+	bytes []byte
+	len   int
+}
+
+// append appends the low n bits of v, most significant first.
+func (bb *bitBuffer) append(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if bb.len%8 == 0 {
+			bb.bytes = append(bb.bytes, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			bb.bytes[bb.len/8] |= 0x80 >> uint(bb.len%8)
+		}
+		bb.len++
+	}
+}
+
+// rsDivisor returns the coefficients, highest power first and
+// excluding the leading 1, of the Reed-Solomon generator polynomial of
+// the given degree.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return result
+}
+
+// rsRemainder returns the Reed-Solomon error correction codewords for
+// the given data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMul(coef, factor)
+		}
+	}
+	return result
+}
+
+// gfMul returns the product of x and y in GF(2^8) modulo
+// x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
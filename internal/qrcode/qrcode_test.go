@@ -0,0 +1,432 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package qrcode_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/internal/qrcode"
+)
+
+func TestRSRemainder(t *testing.T) {
+	c := qt.New(t)
+	// The data and error correction codewords of the 1-M symbol
+	// encoding "HELLO WORLD" in alphanumeric mode.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	ec := qrcode.RSRemainder(data, qrcode.RSDivisor(10))
+	c.Assert(ec, qt.DeepEquals, []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23})
+}
+
+// formatInformation holds the format information bit strings, most
+// significant bit first, for the medium error correction level with
+// each mask.
+var formatInformation = []string{
+	"101010000010010",
+	"101000100100101",
+	"101111001111100",
+	"101101101001011",
+	"100010111111001",
+	"100000011001110",
+	"100111110010111",
+	"100101010100000",
+}
+
+var encodeTests = []struct {
+	about         string
+	text          string
+	expectVersion int
+}{{
+	about:         "empty",
+	text:          "",
+	expectVersion: 1,
+}, {
+	about:         "short",
+	text:          "hello",
+	expectVersion: 1,
+}, {
+	about:         "largest version 1",
+	text:          strings.Repeat("x", 14),
+	expectVersion: 1,
+}, {
+	about:         "smallest version 2",
+	text:          strings.Repeat("x", 15),
+	expectVersion: 2,
+}, {
+	about:         "url",
+	text:          "https://candid.example.com/login-handoff?id=0123456789abcdefghijklmnopqrstuv",
+	expectVersion: 5,
+}, {
+	about:         "version with version information",
+	text:          strings.Repeat("y", 120),
+	expectVersion: 7,
+}, {
+	about:         "version with two block groups",
+	text:          strings.Repeat("z", 180),
+	expectVersion: 9,
+}, {
+	about:         "largest supported",
+	text:          strings.Repeat("z", 213),
+	expectVersion: 10,
+}}
+
+func TestEncode(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range encodeTests {
+		c.Run(test.about, func(c *qt.C) {
+			code, err := qrcode.Encode(test.text)
+			c.Assert(err, qt.IsNil)
+			c.Assert(code.Size(), qt.Equals, 17+4*test.expectVersion)
+			assertFinderPatterns(c, code)
+			assertTimingPatterns(c, code)
+			assertVersionInformation(c, code, test.expectVersion)
+			mask := readMask(c, code)
+			data := readData(c, code, test.expectVersion, mask)
+			c.Assert(decodeBytes(c, data, test.expectVersion), qt.Equals, test.text)
+		})
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	c := qt.New(t)
+	_, err := qrcode.Encode(strings.Repeat("z", 214))
+	c.Assert(err, qt.ErrorMatches, `text too long to encode \(214 bytes\)`)
+}
+
+func TestSVG(t *testing.T) {
+	c := qt.New(t)
+	code, err := qrcode.Encode("hello")
+	c.Assert(err, qt.IsNil)
+	svg := code.SVG(4)
+	c.Assert(bytes.HasPrefix(svg, []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="116" height="116" viewBox="0 0 29 29" `)), qt.Equals, true, qt.Commentf("%s", svg))
+	// The top left module of the finder pattern is drawn inside
+	// the quiet zone.
+	c.Assert(bytes.Contains(svg, []byte(`M4 4h1v1h-1z`)), qt.Equals, true)
+	c.Assert(bytes.HasSuffix(svg, []byte(`"/></svg>`)), qt.Equals, true)
+}
+
+// assertFinderPatterns checks the finder patterns in the corners of the
+// given code.
+func assertFinderPatterns(c *qt.C, code *qrcode.Code) {
+	n := code.Size()
+	for _, corner := range [][2]int{{0, 0}, {n - 7, 0}, {0, n - 7}} {
+		for dy := 0; dy < 7; dy++ {
+			for dx := 0; dx < 7; dx++ {
+				d := max(abs(dx-3), abs(dy-3))
+				c.Assert(code.Black(corner[0]+dx, corner[1]+dy), qt.Equals, d != 2, qt.Commentf("corner %v, module %d,%d", corner, dx, dy))
+			}
+		}
+	}
+}
+
+// readMask reads both copies of the format information in the given
+// code and returns the mask it specifies.
+func readMask(c *qt.C, code *qrcode.Code) int {
+	n := code.Size()
+	var first, second []byte
+	for i := 0; i <= 5; i++ {
+		first = append(first, bit(code.Black(8, i)))
+	}
+	first = append(first, bit(code.Black(8, 7)), bit(code.Black(8, 8)), bit(code.Black(7, 8)))
+	for i := 9; i < 15; i++ {
+		first = append(first, bit(code.Black(14-i, 8)))
+	}
+	for i := 0; i < 8; i++ {
+		second = append(second, bit(code.Black(n-1-i, 8)))
+	}
+	for i := 8; i < 15; i++ {
+		second = append(second, bit(code.Black(8, n-15+i)))
+	}
+	c.Assert(string(second), qt.Equals, string(first))
+	// The bits were read least significant first.
+	for i, j := 0, len(first)-1; i < j; i, j = i+1, j-1 {
+		first[i], first[j] = first[j], first[i]
+	}
+	for mask, s := range formatInformation {
+		if s == string(first) {
+			return mask
+		}
+	}
+	c.Fatalf("unknown format information %s", first)
+	return 0
+}
+
+// The tables below are taken from ISO/IEC 18004 rather than from the
+// encoder, so that reading a code back checks the encoder against the
+// specification rather than against itself.
+
+// specBlocks holds, for each version at the medium error correction
+// level, the number of data codewords in each block and the number of
+// error correction codewords per block.
+var specBlocks = map[int]struct {
+	data []int
+	ec   int
+}{
+	1:  {[]int{16}, 10},
+	2:  {[]int{28}, 16},
+	3:  {[]int{44}, 26},
+	4:  {[]int{32, 32}, 18},
+	5:  {[]int{43, 43}, 24},
+	6:  {[]int{27, 27, 27, 27}, 16},
+	7:  {[]int{31, 31, 31, 31}, 18},
+	8:  {[]int{38, 38, 39, 39}, 22},
+	9:  {[]int{36, 36, 36, 37, 37}, 22},
+	10: {[]int{43, 43, 43, 43, 44}, 26},
+}
+
+// specTotalCodewords holds the total number of codewords in a symbol
+// of each version.
+var specTotalCodewords = map[int]int{
+	1: 26, 2: 44, 3: 70, 4: 100, 5: 134, 6: 172, 7: 196, 8: 242, 9: 292, 10: 346,
+}
+
+// specRemainderBits holds the number of bits left over after the last
+// codeword in a symbol of each version.
+var specRemainderBits = map[int]int{
+	1: 0, 2: 7, 3: 7, 4: 7, 5: 7, 6: 7, 7: 0, 8: 0, 9: 0, 10: 0,
+}
+
+// specAlignment holds the alignment pattern centre coordinates of each
+// version.
+var specAlignment = map[int][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+}
+
+// specVersionInformation holds the version information bit strings of
+// the versions that include them.
+var specVersionInformation = map[int]int{
+	7:  0x07c94,
+	8:  0x085bc,
+	9:  0x09a99,
+	10: 0x0a4d3,
+}
+
+// specMasks holds the data mask conditions, indexed by mask. A module
+// at row i and column j is inverted when the condition holds.
+var specMasks = []func(i, j int) bool{
+	func(i, j int) bool { return (i+j)%2 == 0 },
+	func(i, j int) bool { return i%2 == 0 },
+	func(i, j int) bool { return j%3 == 0 },
+	func(i, j int) bool { return (i+j)%3 == 0 },
+	func(i, j int) bool { return (i/2+j/3)%2 == 0 },
+	func(i, j int) bool { return i*j%2+i*j%3 == 0 },
+	func(i, j int) bool { return (i*j%2+i*j%3)%2 == 0 },
+	func(i, j int) bool { return ((i+j)%2+i*j%3)%2 == 0 },
+}
+
+// isFunction reports whether the module at column x and row y of a
+// symbol of the given version is part of a function pattern or holds
+// format or version information.
+func isFunction(version, x, y int) bool {
+	n := 17 + 4*version
+	switch {
+	case x <= 8 && y <= 8, x >= n-8 && y <= 8, x <= 8 && y >= n-8:
+		// Finder patterns, separators and format information.
+		return true
+	case x == 6 || y == 6:
+		// Timing patterns.
+		return true
+	case version >= 7 && (x >= n-11 && x < n-8 && y < 6 || y >= n-11 && y < n-8 && x < 6):
+		// Version information.
+		return true
+	}
+	pos := specAlignment[version]
+	last := len(pos) - 1
+	for i, cx := range pos {
+		for j, cy := range pos {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				// There is no alignment pattern over a finder
+				// pattern.
+				continue
+			}
+			if abs(x-cx) <= 2 && abs(y-cy) <= 2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// assertVersionInformation checks both copies of the version
+// information in the given code.
+func assertVersionInformation(c *qt.C, code *qrcode.Code, version int) {
+	want, ok := specVersionInformation[version]
+	if !ok {
+		return
+	}
+	n := code.Size()
+	var first, second int
+	for i := 0; i < 18; i++ {
+		if code.Black(n-11+i%3, i/3) {
+			first |= 1 << uint(i)
+		}
+		if code.Black(i/3, n-11+i%3) {
+			second |= 1 << uint(i)
+		}
+	}
+	c.Assert(first, qt.Equals, want)
+	c.Assert(second, qt.Equals, want)
+}
+
+// assertTimingPatterns checks the timing patterns and the dark module
+// in the given code.
+func assertTimingPatterns(c *qt.C, code *qrcode.Code) {
+	n := code.Size()
+	for i := 8; i < n-8; i++ {
+		c.Assert(code.Black(i, 6), qt.Equals, i%2 == 0, qt.Commentf("module %d,6", i))
+		c.Assert(code.Black(6, i), qt.Equals, i%2 == 0, qt.Commentf("module 6,%d", i))
+	}
+	c.Assert(code.Black(8, n-8), qt.Equals, true)
+}
+
+// readData reads the codewords from the given code, checks the error
+// correction codewords and returns the data codewords.
+func readData(c *qt.C, code *qrcode.Code, version, mask int) []byte {
+	n := code.Size()
+	var bits []bool
+	for right := n - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < n; vert++ {
+			y := vert
+			if upward {
+				y = n - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if isFunction(version, x, y) {
+					continue
+				}
+				bits = append(bits, code.Black(x, y) != specMasks[mask](y, x))
+			}
+		}
+	}
+	c.Assert(len(bits), qt.Equals, 8*specTotalCodewords[version]+specRemainderBits[version])
+	codewords := make([]byte, specTotalCodewords[version])
+	for i := range codewords {
+		for j := 0; j < 8; j++ {
+			if bits[8*i+j] {
+				codewords[i] |= 0x80 >> uint(j)
+			}
+		}
+	}
+
+	spec := specBlocks[version]
+	blocks := make([][]byte, len(spec.data))
+	i := 0
+	for k := 0; k < spec.data[len(spec.data)-1]; k++ {
+		for b, l := range spec.data {
+			if k < l {
+				blocks[b] = append(blocks[b], codewords[i])
+				i++
+			}
+		}
+	}
+	for k := 0; k < spec.ec; k++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[i])
+			i++
+		}
+	}
+	c.Assert(i, qt.Equals, len(codewords))
+	var data []byte
+	for b, block := range blocks {
+		assertNoErrors(c, block, spec.ec)
+		data = append(data, block[:spec.data[b]]...)
+	}
+	return data
+}
+
+// assertNoErrors checks that the given block, holding data codewords
+// followed by ecLen error correction codewords, is a valid Reed-Solomon
+// codeword by checking that all its syndromes are zero.
+func assertNoErrors(c *qt.C, block []byte, ecLen int) {
+	// Build the exponent table of GF(256) with the QR code
+	// reducing polynomial x^8 + x^4 + x^3 + x^2 + 1.
+	var exp [255]byte
+	x := 1
+	for i := range exp {
+		exp[i] = byte(x)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	mul := func(a, b byte) byte {
+		if a == 0 || b == 0 {
+			return 0
+		}
+		var la, lb int
+		for i, e := range exp {
+			if e == a {
+				la = i
+			}
+			if e == b {
+				lb = i
+			}
+		}
+		return exp[(la+lb)%255]
+	}
+	for i := 0; i < ecLen; i++ {
+		var s byte
+		for _, b := range block {
+			s = mul(s, exp[i]) ^ b
+		}
+		c.Assert(s, qt.Equals, byte(0), qt.Commentf("syndrome %d", i))
+	}
+}
+
+// decodeBytes decodes the byte mode segment at the start of the given
+// data codewords.
+func decodeBytes(c *qt.C, data []byte, version int) string {
+	c.Assert(data[0]>>4, qt.Equals, byte(0x4))
+	var n int
+	var rest []byte
+	if version < 10 {
+		n = int(data[0]&0xf)<<4 | int(data[1]>>4)
+		rest = data[1:]
+	} else {
+		n = int(data[0]&0xf)<<12 | int(data[1])<<4 | int(data[2]>>4)
+		rest = data[2:]
+	}
+	text := make([]byte, n)
+	for i := range text {
+		text[i] = rest[i]<<4 | rest[i+1]>>4
+	}
+	return string(text)
+}
+
+func bit(b bool) byte {
+	if b {
+		return '1'
+	}
+	return '0'
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package scim
+
+import (
+	"encoding/json"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// applyPatch applies the given SCIM patch operations to u. The
+// operations are applied to the JSON representation of the user, so
+// that attribute names are matched case-insensitively and attributes
+// that are not supported are ignored, as they are when a user is
+// created or replaced. Paths that contain value filters are only
+// supported for the value of an email address.
+func applyPatch(u *User, ops []PatchOperation) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return errgo.Mask(err)
+	}
+	touched := make(map[string]bool)
+	for _, op := range ops {
+		if err := applyOperation(m, op, touched); err != nil {
+			return errgo.Mask(err, isBadRequest)
+		}
+	}
+	// The display name and formatted name of a user are both derived
+	// from the single name held for an identity. Drop any that were
+	// not changed so that they do not take precedence over the parts
+	// of the name that were.
+	if !touched["displayname"] && (touched["name"] || touched["name.formatted"] || touched["name.givenname"] || touched["name.familyname"]) {
+		delete(m, key(m, "displayName"))
+	}
+	if !touched["name"] && !touched["name.formatted"] && (touched["name.givenname"] || touched["name.familyname"]) {
+		if name, ok := m[key(m, "name")].(map[string]interface{}); ok {
+			delete(name, key(name, "formatted"))
+		}
+	}
+	// The active attribute of a user also reflects a suspension
+	// reported by their identity provider. Drop it if it was not
+	// changed so that such a suspension is not recorded as though it
+	// were made through the SCIM API.
+	if !touched["active"] {
+		delete(m, key(m, "active"))
+	}
+	data, err = json.Marshal(m)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var u1 User
+	if err := json.Unmarshal(data, &u1); err != nil {
+		return errgo.WithCausef(err, errInvalidValue, "invalid patch value")
+	}
+	*u = u1
+	return nil
+}
+
+// userSchemaPrefix holds the prefix that may be used to qualify the
+// path of an attribute of the core user schema.
+const userSchemaPrefix = UserSchema + ":"
+
+// applyOperation applies a single patch operation to the JSON object m,
+// recording the paths that were changed in touched.
+func applyOperation(m map[string]interface{}, op PatchOperation, touched map[string]bool) error {
+	switch strings.ToLower(op.Op) {
+	case "add", "replace":
+		add := strings.EqualFold(op.Op, "add")
+		if op.Path != "" {
+			return errgo.Mask(setPath(m, op.Path, op.Value, add, touched), isBadRequest)
+		}
+		values, ok := op.Value.(map[string]interface{})
+		if !ok {
+			return errgo.WithCausef(nil, errInvalidValue, "value of %s operation without a path must be an object", op.Op)
+		}
+		for path, v := range values {
+			if err := setPath(m, path, v, add, touched); err != nil {
+				return errgo.Mask(err, isBadRequest)
+			}
+		}
+		return nil
+	case "remove":
+		if op.Path == "" {
+			return errgo.WithCausef(nil, errNoTarget, "path not specified")
+		}
+		if isEmailValuePath(op.Path) {
+			delete(m, key(m, "emails"))
+			touched["emails"] = true
+			return nil
+		}
+		parent, name, err := resolvePath(m, op.Path, false)
+		if err != nil {
+			return errgo.Mask(err, isBadRequest)
+		}
+		if parent != nil {
+			delete(parent, key(parent, name))
+		}
+		touched[strings.ToLower(normalizePath(op.Path))] = true
+		return nil
+	}
+	return errgo.WithCausef(nil, errInvalidSyntax, "invalid operation %q", op.Op)
+}
+
+// setPath sets the attribute at the given path in m to v. If add is
+// true and the attribute is multi-valued the values in v are appended
+// to the existing values.
+func setPath(m map[string]interface{}, path string, v interface{}, add bool, touched map[string]bool) error {
+	if isEmailValuePath(path) {
+		// An identity only holds a single email address, so
+		// setting the value of any email address sets it.
+		m[key(m, "emails")] = []interface{}{
+			map[string]interface{}{
+				"value":   v,
+				"primary": true,
+			},
+		}
+		touched["emails"] = true
+		return nil
+	}
+	parent, name, err := resolvePath(m, path, true)
+	if err != nil {
+		return errgo.Mask(err, isBadRequest)
+	}
+	k := key(parent, name)
+	if existing, ok := parent[k].([]interface{}); ok && add {
+		if vs, ok := v.([]interface{}); ok {
+			v = append(existing, vs...)
+		} else {
+			v = append(existing, v)
+		}
+	}
+	parent[k] = v
+	touched[strings.ToLower(normalizePath(path))] = true
+	return nil
+}
+
+// resolvePath returns the object that holds the attribute at the given
+// path in m, along with the name of the attribute. If create is true
+// then a missing parent object is created, otherwise a nil object is
+// returned.
+func resolvePath(m map[string]interface{}, path string, create bool) (map[string]interface{}, string, error) {
+	path = normalizePath(path)
+	if strings.ContainsAny(path, "[]") {
+		return nil, "", errgo.WithCausef(nil, errInvalidPath, "unsupported path %q", path)
+	}
+	parts := strings.Split(path, ".")
+	if len(parts) > 2 || parts[0] == "" || len(parts) == 2 && parts[1] == "" {
+		return nil, "", errgo.WithCausef(nil, errInvalidPath, "invalid path %q", path)
+	}
+	if len(parts) == 1 {
+		return m, parts[0], nil
+	}
+	k := key(m, parts[0])
+	parent, ok := m[k].(map[string]interface{})
+	if !ok {
+		if m[k] != nil {
+			return nil, "", errgo.WithCausef(nil, errInvalidPath, "%q is not a complex attribute", parts[0])
+		}
+		if !create {
+			return nil, parts[1], nil
+		}
+		parent = make(map[string]interface{})
+		m[k] = parent
+	}
+	return parent, parts[1], nil
+}
+
+// isEmailValuePath reports whether the given path refers to the value
+// of an email address selected by a filter, such as
+// `emails[type eq "work"].value`.
+func isEmailValuePath(path string) bool {
+	path = strings.ToLower(normalizePath(path))
+	return strings.HasPrefix(path, "emails[") && strings.HasSuffix(path, "].value")
+}
+
+// normalizePath removes any core user schema prefix from the given
+// path.
+func normalizePath(path string) string {
+	if len(path) > len(userSchemaPrefix) && strings.EqualFold(path[:len(userSchemaPrefix)], userSchemaPrefix) {
+		return path[len(userSchemaPrefix):]
+	}
+	return path
+}
+
+// key returns the key in m that matches name case-insensitively, or
+// name if there is none.
+func key(m map[string]interface{}, name string) string {
+	if _, ok := m[name]; ok {
+		return name
+	}
+	for k := range m {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package scim_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/internal/scim"
+)
+
+var applyPatchTests = []struct {
+	about       string
+	ops         []scim.PatchOperation
+	expect      scim.User
+	expectError string
+}{{
+	about: "replace attribute",
+	ops: []scim.PatchOperation{{
+		Op:    "replace",
+		Path:  "userName",
+		Value: "robert",
+	}},
+	expect: scim.User{
+		UserName:    "robert",
+		DisplayName: "Bob Builder",
+		Name:        &scim.Name{Formatted: "Bob Builder"},
+	},
+}, {
+	about: "case insensitive with schema prefix",
+	ops: []scim.PatchOperation{{
+		Op:    "Replace",
+		Path:  "urn:ietf:params:scim:schemas:core:2.0:User:USERNAME",
+		Value: "robert",
+	}},
+	expect: scim.User{
+		UserName:    "robert",
+		DisplayName: "Bob Builder",
+		Name:        &scim.Name{Formatted: "Bob Builder"},
+	},
+}, {
+	about: "replace display name",
+	ops: []scim.PatchOperation{{
+		Op:    "replace",
+		Path:  "displayName",
+		Value: "Robert",
+	}},
+	expect: scim.User{
+		UserName:    "bob",
+		DisplayName: "Robert",
+		Name:        &scim.Name{Formatted: "Bob Builder"},
+	},
+}, {
+	about: "replace part of name",
+	ops: []scim.PatchOperation{{
+		Op:    "replace",
+		Path:  "name.givenName",
+		Value: "Robert",
+	}},
+	expect: scim.User{
+		UserName: "bob",
+		Name:     &scim.Name{GivenName: "Robert"},
+	},
+}, {
+	about: "add email",
+	ops: []scim.PatchOperation{{
+		Op:   "add",
+		Path: "emails",
+		Value: []interface{}{
+			map[string]interface{}{"value": "bob@example.com"},
+		},
+	}, {
+		Op:   "add",
+		Path: "emails",
+		Value: map[string]interface{}{
+			"value": "bob@example.org",
+		},
+	}},
+	expect: scim.User{
+		UserName:    "bob",
+		DisplayName: "Bob Builder",
+		Name:        &scim.Name{Formatted: "Bob Builder"},
+		Emails: []scim.MultiValued{{
+			Value: "bob@example.com",
+		}, {
+			Value: "bob@example.org",
+		}},
+	},
+}, {
+	about: "remove name",
+	ops: []scim.PatchOperation{{
+		Op:   "remove",
+		Path: "name",
+	}, {
+		Op:   "remove",
+		Path: "displayName",
+	}},
+	expect: scim.User{
+		UserName: "bob",
+	},
+}, {
+	about: "remove without path",
+	ops: []scim.PatchOperation{{
+		Op: "remove",
+	}},
+	expectError: `path not specified`,
+}, {
+	about: "unsupported filter",
+	ops: []scim.PatchOperation{{
+		Op:    "replace",
+		Path:  `addresses[type eq "work"].locality`,
+		Value: "London",
+	}},
+	expectError: `unsupported path "addresses\[type eq \\"work\\"\].locality"`,
+}, {
+	about: "invalid operation",
+	ops: []scim.PatchOperation{{
+		Op:   "move",
+		Path: "userName",
+	}},
+	expectError: `invalid operation "move"`,
+}, {
+	about: "invalid value",
+	ops: []scim.PatchOperation{{
+		Op:    "replace",
+		Path:  "active",
+		Value: "maybe",
+	}},
+	expectError: `invalid patch value: .*`,
+}}
+
+func TestApplyPatch(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range applyPatchTests {
+		c.Run(test.about, func(c *qt.C) {
+			u := scim.User{
+				UserName:    "bob",
+				DisplayName: "Bob Builder",
+				Name:        &scim.Name{Formatted: "Bob Builder"},
+			}
+			err := scim.ApplyPatch(&u, test.ops)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(u, qt.DeepEquals, test.expect)
+		})
+	}
+}
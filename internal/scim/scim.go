@@ -0,0 +1,184 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package scim implements a SCIM 2.0 (RFC 7643, RFC 7644) endpoint that
+// allows an external system to provision users directly into the
+// identity manager.
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/juju/loggo"
+	"github.com/juju/simplekv"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/internal/auth/httpauth"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/params"
+)
+
+var logger = loggo.GetLogger("candid.internal.scim")
+
+const (
+	// UserSchema holds the URN of the SCIM core user schema.
+	UserSchema = "urn:ietf:params:scim:schemas:core:2.0:User"
+
+	// ListResponseSchema holds the URN of the SCIM list response
+	// message schema.
+	ListResponseSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+
+	// PatchOpSchema holds the URN of the SCIM patch operation
+	// message schema.
+	PatchOpSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+
+	// ErrorSchema holds the URN of the SCIM error message schema.
+	ErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// contentType holds the media type of SCIM responses.
+const contentType = "application/scim+json"
+
+// maxBodySize holds the maximum size of a request body that will be
+// read.
+const maxBodySize = 1 << 20
+
+var reqServer = httprequest.Server{
+	ErrorMapper: errToResp,
+}
+
+// NewAPIHandler is an identity.NewAPIHandlerFunc.
+func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error) {
+	createClaims, err := params.ProviderDataStore.KeyValueStore(context.Background(), "_scim_creates")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return reqServer.Handlers(new(params, createClaims)), nil
+}
+
+// new returns a function that will generate a new instance of the SCIM
+// API handler for a request. Every SCIM request is an admin operation,
+// so the request must come from an allowed network and be
+// authenticated as a user that may write admin data.
+func new(hParams identity.HandlerParams, createClaims simplekv.Store) func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
+	reqAuth := httpauth.New(hParams.Oven, hParams.Authorizer, hParams.APIMacaroonTimeout, hParams.MacaroonVersions())
+	adminFilter := hParams.AdminIPFilter()
+	return func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
+		if err := adminFilter.Check(p.Request); err != nil {
+			return nil, nil, errgo.Mask(err, errgo.Is(params.ErrForbidden))
+		}
+		ctx, close := hParams.Store.Context(p.Context)
+		if _, err := reqAuth.Auth(ctx, p.Request, auth.GlobalOp(auth.ActionWriteAdmin)); err != nil {
+			close()
+			return nil, nil, errgo.Mask(err, errgo.Any)
+		}
+		return &handler{
+			params:       hParams,
+			createClaims: createClaims,
+			close:        close,
+		}, ctx, nil
+	}
+}
+
+// A handler is a handler for a request to a /scim/v2 endpoint.
+type handler struct {
+	params identity.HandlerParams
+
+	// createClaims holds the claims made by requests that are
+	// creating users, see handler.claimExternalID.
+	createClaims simplekv.Store
+	close        func()
+}
+
+// Close implements io.Closer. httprequest will automatically call this
+// once a request is complete.
+func (h *handler) Close() error {
+	if h.close != nil {
+		h.close()
+		h.close = nil
+	}
+	return nil
+}
+
+// Error holds a SCIM error response.
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// An errorType is the cause of an error that has a SCIM error type.
+type errorType struct {
+	code     params.ErrorCode
+	scimType string
+}
+
+// Error implements error.
+func (e *errorType) Error() string {
+	return e.scimType
+}
+
+// ErrorCode returns the candid error code for the error, which
+// determines the status of the response.
+func (e *errorType) ErrorCode() params.ErrorCode {
+	return e.code
+}
+
+// The SCIM error types that are returned, see RFC 7644 section 3.12.
+var (
+	errInvalidFilter = &errorType{params.ErrBadRequest, "invalidFilter"}
+	errInvalidSyntax = &errorType{params.ErrBadRequest, "invalidSyntax"}
+	errInvalidPath   = &errorType{params.ErrBadRequest, "invalidPath"}
+	errNoTarget      = &errorType{params.ErrBadRequest, "noTarget"}
+	errInvalidValue  = &errorType{params.ErrBadRequest, "invalidValue"}
+	errMutability    = &errorType{params.ErrBadRequest, "mutability"}
+	errUniqueness    = &errorType{params.ErrConflict, "uniqueness"}
+)
+
+// errToResp converts an error to a SCIM error response. Errors from the
+// bakery are returned as the bakery expects them, so that clients can
+// acquire the macaroons they need.
+func errToResp(ctx context.Context, err error) (int, interface{}) {
+	status, body := identity.ReqServer.ErrorMapper(ctx, err)
+	if _, ok := errgo.Cause(err).(*httpbakery.Error); ok {
+		return status, body
+	}
+	resp := &Error{
+		Schemas: []string{ErrorSchema},
+		Status:  strconv.Itoa(status),
+		Detail:  err.Error(),
+	}
+	if et, ok := errgo.Cause(err).(*errorType); ok {
+		resp.ScimType = et.scimType
+	}
+	return status, resp
+}
+
+// readBody reads the JSON encoded body of the request into v.
+// SCIM clients send bodies with a media type of
+// "application/scim+json", so, unlike the rest of the API, the media
+// type is not checked.
+func readBody(p httprequest.Params, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(p.Response, p.Request.Body, maxBodySize))
+	if err := dec.Decode(v); err != nil {
+		return errgo.WithCausef(err, errInvalidSyntax, "cannot unmarshal request body")
+	}
+	return nil
+}
+
+// writeResponse writes v to w as the JSON encoded body of a response
+// with the given status.
+func writeResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Infof("cannot write response: %s", err)
+	}
+}
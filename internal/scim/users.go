@@ -0,0 +1,569 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// scimSource holds the source recorded on identities created through
+// the SCIM API.
+const scimSource = "scim"
+
+// maxCount holds the maximum number of users returned in a single list
+// response.
+const maxCount = 100
+
+// reservedUsernames holds the usernames that cannot be provisioned.
+var reservedUsernames = map[string]bool{
+	"admin":            true,
+	"everyone":         true,
+	auth.AdminUsername: true,
+}
+
+// User holds a SCIM user resource. The SCIM id is the ID of the
+// identity and the externalId is its provider ID, so a user that is
+// provisioned with the external ID that their identity provider
+// assigns is the same identity they get when they log in.
+type User struct {
+	Schemas     []string      `json:"schemas"`
+	ID          string        `json:"id,omitempty"`
+	ExternalID  string        `json:"externalId,omitempty"`
+	UserName    string        `json:"userName"`
+	Name        *Name         `json:"name,omitempty"`
+	DisplayName string        `json:"displayName,omitempty"`
+	Emails      []MultiValued `json:"emails,omitempty"`
+	Active      *bool         `json:"active,omitempty"`
+	Groups      []MultiValued `json:"groups,omitempty"`
+	Meta        *Meta         `json:"meta,omitempty"`
+}
+
+// Name holds the name of a SCIM user.
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+}
+
+// MultiValued holds a value of a multi-valued SCIM attribute.
+type MultiValued struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// Meta holds the metadata of a SCIM resource.
+type Meta struct {
+	ResourceType string `json:"resourceType"`
+	LastModified string `json:"lastModified,omitempty"`
+	Location     string `json:"location"`
+	Version      string `json:"version,omitempty"`
+}
+
+// ListResponse holds a SCIM list response.
+type ListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []*User  `json:"Resources"`
+}
+
+// PatchRequest holds the body of a SCIM patch request.
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+// PatchOperation holds a single operation of a SCIM patch request.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// ListUsersRequest is a request to list the users.
+type ListUsersRequest struct {
+	httprequest.Route `httprequest:"GET /scim/v2/Users"`
+	Filter            string `httprequest:"filter,form"`
+	StartIndex        int    `httprequest:"startIndex,form"`
+	Count             int    `httprequest:"count,form"`
+}
+
+// CreateUserRequest is a request to create a user. The body holds a
+// User.
+type CreateUserRequest struct {
+	httprequest.Route `httprequest:"POST /scim/v2/Users"`
+}
+
+// GetUserRequest is a request for the user with the given ID.
+type GetUserRequest struct {
+	httprequest.Route `httprequest:"GET /scim/v2/Users/:id"`
+	ID                string `httprequest:"id,path"`
+}
+
+// ReplaceUserRequest is a request to replace the user with the given
+// ID. The body holds a User.
+type ReplaceUserRequest struct {
+	httprequest.Route `httprequest:"PUT /scim/v2/Users/:id"`
+	ID                string `httprequest:"id,path"`
+}
+
+// PatchUserRequest is a request to modify the user with the given ID.
+// The body holds a PatchRequest.
+type PatchUserRequest struct {
+	httprequest.Route `httprequest:"PATCH /scim/v2/Users/:id"`
+	ID                string `httprequest:"id,path"`
+}
+
+// DeleteUserRequest is a request to remove the user with the given ID.
+type DeleteUserRequest struct {
+	httprequest.Route `httprequest:"DELETE /scim/v2/Users/:id"`
+	ID                string `httprequest:"id,path"`
+}
+
+// ListUsers lists the users. Only filters that match userName or
+// externalId exactly are supported.
+func (h *handler) ListUsers(p httprequest.Params, r *ListUsersRequest) error {
+	start := r.StartIndex
+	if start < 1 {
+		start = 1
+	}
+	count := r.Count
+	if count <= 0 || count > maxCount {
+		count = maxCount
+	}
+	resp := &ListResponse{
+		Schemas:    []string{ListResponseSchema},
+		StartIndex: start,
+		Resources:  []*User{},
+	}
+	if r.Filter != "" {
+		ref, err := parseFilter(r.Filter)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(errInvalidFilter))
+		}
+		err = h.params.Store.Identity(p.Context, ref)
+		if err == nil {
+			resp.TotalResults = 1
+			if start == 1 {
+				resp.Resources = append(resp.Resources, h.user(ref))
+			}
+		} else if errgo.Cause(err) != store.ErrNotFound {
+			return errgo.Mask(err)
+		}
+	} else {
+		counts, err := h.params.Store.IdentityCounts(p.Context)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, n := range counts {
+			resp.TotalResults += n
+		}
+		ids, err := h.params.Store.FindIdentities(p.Context, &store.Identity{}, store.Filter{}, []store.Sort{{Field: store.Username}}, start-1, count)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for i := range ids {
+			resp.Resources = append(resp.Resources, h.user(&ids[i]))
+		}
+	}
+	resp.ItemsPerPage = len(resp.Resources)
+	writeResponse(p.Response, http.StatusOK, resp)
+	return nil
+}
+
+// filterRE matches the filters supported by ListUsers.
+var filterRE = regexp.MustCompile(`^\s*(\w+)\s+(?i:eq)\s+("(?:[^"\\]|\\.)*")\s*$`)
+
+// parseFilter parses the given SCIM filter and returns the identity it
+// refers to.
+func parseFilter(filter string) (*store.Identity, error) {
+	m := filterRE.FindStringSubmatch(filter)
+	if m == nil {
+		return nil, errgo.WithCausef(nil, errInvalidFilter, "unsupported filter %q", filter)
+	}
+	var value string
+	if err := json.Unmarshal([]byte(m[2]), &value); err != nil {
+		return nil, errgo.WithCausef(nil, errInvalidFilter, "invalid value in filter %q", filter)
+	}
+	switch {
+	case strings.EqualFold(m[1], "userName"):
+		return &store.Identity{Username: value}, nil
+	case strings.EqualFold(m[1], "externalId"):
+		return &store.Identity{ProviderID: store.ProviderIdentity(value)}, nil
+	}
+	return nil, errgo.WithCausef(nil, errInvalidFilter, "unsupported filter attribute %q", m[1])
+}
+
+// CreateUser creates a user. The externalId of the user must be the
+// provider ID that the user will have when they log in, so that their
+// login reconciles to the same identity.
+func (h *handler) CreateUser(p httprequest.Params, r *CreateUserRequest) error {
+	var u User
+	if err := readBody(p, &u); err != nil {
+		return errgo.Mask(err, errgo.Is(errInvalidSyntax))
+	}
+	logger.Tracef("CreateUser %#v", u)
+	if u.ExternalID == "" {
+		return errgo.WithCausef(nil, errInvalidValue, "externalId not specified")
+	}
+	if err := h.checkExternalID(u.ExternalID); err != nil {
+		return errgo.Mask(err, errgo.Is(errInvalidValue))
+	}
+	// Updating an identity by provider ID creates it if it does not
+	// exist and updates it otherwise, so claim the external ID for
+	// the duration of the request to ensure that of any concurrent
+	// requests to create the same user only one succeeds.
+	release, err := h.claimExternalID(p.Context, u.ExternalID)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(errUniqueness))
+	}
+	defer release()
+	id := store.Identity{
+		ProviderID: store.ProviderIdentity(u.ExternalID),
+	}
+	err = h.params.Store.Identity(p.Context, &id)
+	if err == nil {
+		return errgo.WithCausef(nil, errUniqueness, "user with externalId %q already exists", u.ExternalID)
+	}
+	if errgo.Cause(err) != store.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	id = store.Identity{
+		ProviderID: store.ProviderIdentity(u.ExternalID),
+		Groups:     h.params.DefaultGroups,
+		Source:     scimSource,
+	}
+	update := store.Update{
+		store.Groups: store.Set,
+		store.Source: store.Set,
+	}
+	if err := h.setIdentity(&id, update, &u); err != nil {
+		return errgo.Mask(err, errgo.Is(errInvalidValue))
+	}
+	if err := h.params.Store.UpdateIdentity(p.Context, &id, update); err != nil {
+		return translateStoreError(err)
+	}
+	logger.Infof("provisioned user %q (%s)", id.Username, id.ProviderID)
+	return h.writeUser(p, http.StatusCreated, &id)
+}
+
+// GetUser returns the user with the given ID.
+func (h *handler) GetUser(p httprequest.Params, r *GetUserRequest) error {
+	id, err := h.identity(p.Context, r.ID)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	writeResponse(p.Response, http.StatusOK, h.user(id))
+	return nil
+}
+
+// ReplaceUser replaces the attributes of the user with the given ID.
+// Attributes that are not given are removed. The externalId of a user
+// cannot be changed.
+func (h *handler) ReplaceUser(p httprequest.Params, r *ReplaceUserRequest) error {
+	var u User
+	if err := readBody(p, &u); err != nil {
+		return errgo.Mask(err, errgo.Is(errInvalidSyntax))
+	}
+	logger.Tracef("ReplaceUser %s %#v", r.ID, u)
+	return errgo.Mask(h.replaceUser(p, r.ID, &u), errgo.Any)
+}
+
+// PatchUser modifies the attributes of the user with the given ID.
+func (h *handler) PatchUser(p httprequest.Params, r *PatchUserRequest) error {
+	var req PatchRequest
+	if err := readBody(p, &req); err != nil {
+		return errgo.Mask(err, errgo.Is(errInvalidSyntax))
+	}
+	logger.Tracef("PatchUser %s %#v", r.ID, req)
+	id, err := h.identity(p.Context, r.ID)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	u := h.user(id)
+	if err := applyPatch(u, req.Operations); err != nil {
+		return errgo.Mask(err, isBadRequest)
+	}
+	return errgo.Mask(h.replaceUser(p, r.ID, u), errgo.Any)
+}
+
+// replaceUser replaces the attributes of the user with the given ID
+// with those in u and writes the resulting user to the response.
+func (h *handler) replaceUser(p httprequest.Params, userID string, u *User) error {
+	current, err := h.identity(p.Context, userID)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if u.ExternalID != "" && u.ExternalID != string(current.ProviderID) {
+		return errgo.WithCausef(nil, errMutability, "externalId cannot be changed")
+	}
+	if reservedUsernames[current.Username] {
+		return errgo.WithCausef(nil, params.ErrForbidden, "user %q cannot be modified", current.Username)
+	}
+	id := store.Identity{
+		ID: current.ID,
+	}
+	update := store.Update{}
+	if err := h.setIdentity(&id, update, u); err != nil {
+		return errgo.Mask(err, errgo.Is(errInvalidValue))
+	}
+	if err := h.params.Store.UpdateIdentity(p.Context, &id, update); err != nil {
+		return translateStoreError(err)
+	}
+	return h.writeUser(p, http.StatusOK, &id)
+}
+
+// DeleteUser removes the user with the given ID, along with all of the
+// data held about them. If they log in again a new identity will be
+// created for them.
+func (h *handler) DeleteUser(p httprequest.Params, r *DeleteUserRequest) error {
+	id, err := h.identity(p.Context, r.ID)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if reservedUsernames[id.Username] {
+		return errgo.WithCausef(nil, params.ErrForbidden, "user %q cannot be removed", id.Username)
+	}
+	if err := store.RemoveIdentity(p.Context, h.params.Store, &store.Identity{ID: id.ID}); err != nil {
+		return translateStoreError(err)
+	}
+	logger.Infof("removed user %q (%s)", id.Username, id.ProviderID)
+	p.Response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// setIdentity sets the fields of the given identity from the given
+// user and records the fields that are to be written in the given
+// update. Attributes that the user does not have are cleared, except
+// for active, which is left unchanged if it is not given.
+func (h *handler) setIdentity(id *store.Identity, update store.Update, u *User) error {
+	if u.UserName == "" {
+		return errgo.WithCausef(nil, errInvalidValue, "userName not specified")
+	}
+	if reservedUsernames[u.UserName] {
+		return errgo.WithCausef(nil, errInvalidValue, "userName %q is reserved", u.UserName)
+	}
+	var username params.Username
+	if err := username.UnmarshalText([]byte(u.UserName)); err != nil {
+		return errgo.WithCausef(nil, errInvalidValue, "invalid userName: %s", err)
+	}
+	id.Username = u.UserName
+	update[store.Username] = store.Set
+
+	id.Name = u.name()
+	update[store.Name] = setOrClear(id.Name)
+	email, err := h.params.EmailValidation.Check(u.email())
+	if err != nil {
+		return errgo.WithCausef(nil, errInvalidValue, "%s", err)
+	}
+	id.Email = email
+	update[store.Email] = setOrClear(id.Email)
+
+	// An inactive user is deactivated in the same way as a user
+	// whose identity provider reports that their account is
+	// suspended, so that they can neither log in nor have macaroons
+	// discharged. The SCIM API has its own key so that it neither
+	// undoes nor is undone by a suspension reported by the identity
+	// provider.
+	if u.Active != nil {
+		var inactive []string
+		if !*u.Active {
+			inactive = []string{"true"}
+		}
+		id.ExtraInfo = map[string][]string{
+			idputil.InactiveExtraInfoKey: inactive,
+		}
+		update[store.ExtraInfo] = store.Set
+	}
+	return nil
+}
+
+// setOrClear returns the operation that sets the given value, or clears
+// it if it is empty.
+func setOrClear(v string) store.Operation {
+	if v == "" {
+		return store.Clear
+	}
+	return store.Set
+}
+
+// name returns the name of the user to record in the identity.
+func (u *User) name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	if u.Name == nil {
+		return ""
+	}
+	if u.Name.Formatted != "" {
+		return u.Name.Formatted
+	}
+	return strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName)
+}
+
+// email returns the email address of the user to record in the
+// identity. This is the primary email address if there is one, or the
+// first otherwise.
+func (u *User) email() string {
+	for _, e := range u.Emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return ""
+}
+
+// createClaimTimeout holds the time for which a claim made by
+// claimExternalID is held if it is not released, for example because
+// the server fails.
+const createClaimTimeout = time.Minute
+
+// claimExternalID claims the right to create the user with the given
+// external ID. If another request holds the claim an error with a cause
+// of errUniqueness is returned. The returned function releases the
+// claim.
+func (h *handler) claimExternalID(ctx context.Context, externalID string) (release func(), err error) {
+	now := time.Now()
+	expire := now.Add(createClaimTimeout)
+	err = h.createClaims.Update(ctx, externalID, expire, func(old []byte) ([]byte, error) {
+		var t time.Time
+		if len(old) > 0 && t.UnmarshalText(old) == nil && t.After(now) {
+			return nil, errgo.WithCausef(nil, errUniqueness, "user with externalId %q is already being created", externalID)
+		}
+		return expire.MarshalText()
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(errUniqueness))
+	}
+	return func() {
+		if err := h.createClaims.Set(ctx, externalID, []byte{}, time.Now()); err != nil {
+			logger.Errorf("cannot release claim on externalId %q: %s", externalID, err)
+		}
+	}, nil
+}
+
+// checkExternalID checks that the given external ID can be used as the
+// provider ID of an identity.
+func (h *handler) checkExternalID(externalID string) error {
+	if i := strings.IndexByte(externalID, ':'); i <= 0 {
+		return errgo.WithCausef(nil, errInvalidValue, "externalId %q is not of the form <idp>:<id>", externalID)
+	}
+	if err := h.params.CheckExternalID(externalID); err != nil {
+		return errgo.WithCausef(err, errInvalidValue, "")
+	}
+	return nil
+}
+
+// identity returns the identity with the given SCIM ID.
+func (h *handler) identity(ctx context.Context, userID string) (*store.Identity, error) {
+	id := store.Identity{
+		ID: userID,
+	}
+	if err := h.params.Store.Identity(ctx, &id); err != nil {
+		if errgo.Cause(err) == store.ErrNotFound {
+			return nil, errgo.WithCausef(err, params.ErrNotFound, "user %q not found", userID)
+		}
+		return nil, errgo.Mask(err)
+	}
+	return &id, nil
+}
+
+// writeUser reads the given identity back from the store and writes it
+// to the response as a user with the given status.
+func (h *handler) writeUser(p httprequest.Params, status int, id *store.Identity) error {
+	id1 := store.Identity{
+		ID: id.ID,
+	}
+	if err := h.params.Store.Identity(p.Context, &id1); err != nil {
+		return errgo.Mask(err)
+	}
+	u := h.user(&id1)
+	if status == http.StatusCreated {
+		p.Response.Header().Set("Location", u.Meta.Location)
+	}
+	writeResponse(p.Response, status, u)
+	return nil
+}
+
+// user returns the SCIM user for the given identity.
+func (h *handler) user(id *store.Identity) *User {
+	active := !idputil.IsSuspended(id)
+	u := &User{
+		Schemas:     []string{UserSchema},
+		ID:          id.ID,
+		ExternalID:  string(id.ProviderID),
+		UserName:    id.Username,
+		DisplayName: id.Name,
+		Active:      &active,
+		Meta: &Meta{
+			ResourceType: "User",
+			Location:     idputil.LocationURL(h.params.Location, "/scim/v2/Users/"+id.ID),
+			Version:      fmt.Sprintf(`W/"%d"`, id.Version),
+		},
+	}
+	if id.Name != "" {
+		u.Name = &Name{
+			Formatted: id.Name,
+		}
+	}
+	if id.Email != "" {
+		u.Emails = []MultiValued{{
+			Value:   id.Email,
+			Primary: true,
+		}}
+	}
+	for _, g := range id.Groups {
+		u.Groups = append(u.Groups, MultiValued{
+			Value:   g,
+			Display: g,
+		})
+	}
+	if !id.Modified.IsZero() {
+		u.Meta.LastModified = id.Modified.UTC().Format(time.RFC3339)
+	}
+	return u
+}
+
+// translateStoreError translates an error from the store into an error
+// to return from the API.
+func translateStoreError(err error) error {
+	switch errgo.Cause(err) {
+	case store.ErrNotFound:
+		return errgo.WithCausef(err, params.ErrNotFound, "")
+	case store.ErrDuplicateUsername:
+		return errgo.WithCausef(err, errUniqueness, "")
+	case store.ErrNotSupported:
+		return errgo.WithCausef(err, params.ErrMethodNotAllowed, "")
+	case params.ErrBadRequest:
+		return errgo.WithCausef(err, errInvalidValue, "")
+	}
+	return errgo.Mask(err)
+}
+
+// isBadRequest reports whether the given error is the cause of an error
+// that results in a bad request response.
+func isBadRequest(err error) bool {
+	et, ok := err.(*errorType)
+	return ok && et.code == params.ErrBadRequest
+}
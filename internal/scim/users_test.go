@@ -0,0 +1,467 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package scim_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/frankban/quicktest/qtsuite"
+	errgo "gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	"gopkg.in/macaroon-bakery.v2/httpbakery/agent"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	"github.com/canonical/candid/internal/scim"
+	"github.com/canonical/candid/store"
+)
+
+func TestUsers(t *testing.T) {
+	qtsuite.Run(qt.New(t), &usersSuite{})
+}
+
+type usersSuite struct {
+	store  *candidtest.Store
+	srv    *candidtest.Server
+	client *httpbakery.Client
+}
+
+func (s *usersSuite) Init(c *qt.C) {
+	s.store = candidtest.NewStore()
+	sp := s.store.ServerParams()
+	sp.DefaultGroups = []string{"everyone-provisioned"}
+	s.srv = candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"scim":       scim.NewAPIHandler,
+	})
+	s.client = s.srv.AdminClient()
+}
+
+// do performs a request with the given method, path and JSON body as
+// the admin user, and decodes the response body into resp, if it is
+// not nil. It returns the response status.
+func (s *usersSuite) do(c *qt.C, method, path string, body, resp interface{}) int {
+	return s.doWith(c, s.client, method, path, body, resp)
+}
+
+// doWith is like do but performs the request with the given client.
+func (s *usersSuite) doWith(c *qt.C, client *httpbakery.Client, method, path string, body, resp interface{}) int {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		c.Assert(err, qt.IsNil)
+	}
+	req, err := http.NewRequest(method, s.srv.URL+path, bytes.NewReader(data))
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Content-Type", "application/scim+json")
+	r, err := client.Do(req)
+	c.Assert(err, qt.IsNil)
+	defer r.Body.Close()
+	if resp != nil {
+		err = json.NewDecoder(r.Body).Decode(resp)
+		c.Assert(err, qt.IsNil)
+	}
+	return r.StatusCode
+}
+
+func (s *usersSuite) create(c *qt.C, u *scim.User) *scim.User {
+	var resp scim.User
+	status := s.do(c, "POST", "/scim/v2/Users", u, &resp)
+	c.Assert(status, qt.Equals, http.StatusCreated)
+	return &resp
+}
+
+func (s *usersSuite) TestCreateUser(c *qt.C) {
+	u := s.create(c, &scim.User{
+		Schemas:    []string{scim.UserSchema},
+		ExternalID: "test:bob-id",
+		UserName:   "bob",
+		Name: &scim.Name{
+			GivenName:  "Bob",
+			FamilyName: "Builder",
+		},
+		Emails: []scim.MultiValued{{
+			Value: "bob@example.org",
+		}, {
+			Value:   "bob@example.com",
+			Primary: true,
+		}},
+	})
+	c.Assert(u.ID, qt.Not(qt.Equals), "")
+	c.Assert(u.ExternalID, qt.Equals, "test:bob-id")
+	c.Assert(u.UserName, qt.Equals, "bob")
+	c.Assert(u.DisplayName, qt.Equals, "Bob Builder")
+	c.Assert(u.Emails, qt.DeepEquals, []scim.MultiValued{{Value: "bob@example.com", Primary: true}})
+	c.Assert(*u.Active, qt.Equals, true)
+	c.Assert(u.Meta.Location, qt.Equals, s.srv.URL+"/scim/v2/Users/"+u.ID)
+
+	// The identity is the one that the user gets when they log in
+	// with the same external ID.
+	id := s.store.AssertUser(c, &store.Identity{
+		ProviderID: "test:bob-id",
+	})
+	c.Assert(id.ID, qt.Equals, u.ID)
+	c.Assert(id.Username, qt.Equals, "bob")
+	c.Assert(id.Name, qt.Equals, "Bob Builder")
+	c.Assert(id.Email, qt.Equals, "bob@example.com")
+	c.Assert(id.Groups, qt.DeepEquals, []string{"everyone-provisioned"})
+	c.Assert(id.Source, qt.Equals, "scim")
+
+	var got scim.User
+	status := s.do(c, "GET", "/scim/v2/Users/"+u.ID, nil, &got)
+	c.Assert(status, qt.Equals, http.StatusOK)
+	c.Assert(&got, qt.DeepEquals, u)
+}
+
+func (s *usersSuite) TestCreateUserErrors(c *qt.C) {
+	s.create(c, &scim.User{
+		ExternalID: "test:bob-id",
+		UserName:   "bob",
+	})
+	tests := []struct {
+		about          string
+		user           *scim.User
+		expectStatus   int
+		expectScimType string
+	}{{
+		about: "no external ID",
+		user: &scim.User{
+			UserName: "alice",
+		},
+		expectStatus:   http.StatusBadRequest,
+		expectScimType: "invalidValue",
+	}, {
+		about: "external ID without identity provider",
+		user: &scim.User{
+			ExternalID: "alice-id",
+			UserName:   "alice",
+		},
+		expectStatus:   http.StatusBadRequest,
+		expectScimType: "invalidValue",
+	}, {
+		about: "no username",
+		user: &scim.User{
+			ExternalID: "test:alice-id",
+		},
+		expectStatus:   http.StatusBadRequest,
+		expectScimType: "invalidValue",
+	}, {
+		about: "reserved username",
+		user: &scim.User{
+			ExternalID: "test:alice-id",
+			UserName:   "admin@candid",
+		},
+		expectStatus:   http.StatusBadRequest,
+		expectScimType: "invalidValue",
+	}, {
+		about: "invalid email",
+		user: &scim.User{
+			ExternalID: "test:alice-id",
+			UserName:   "alice",
+			Emails:     []scim.MultiValued{{Value: "alice at example.com"}},
+		},
+		expectStatus:   http.StatusBadRequest,
+		expectScimType: "invalidValue",
+	}, {
+		about: "duplicate external ID",
+		user: &scim.User{
+			ExternalID: "test:bob-id",
+			UserName:   "bob2",
+		},
+		expectStatus:   http.StatusConflict,
+		expectScimType: "uniqueness",
+	}, {
+		about: "duplicate username",
+		user: &scim.User{
+			ExternalID: "test:bob2-id",
+			UserName:   "bob",
+		},
+		expectStatus:   http.StatusConflict,
+		expectScimType: "uniqueness",
+	}}
+	for _, test := range tests {
+		c.Run(test.about, func(c *qt.C) {
+			var resp scim.Error
+			status := s.do(c, "POST", "/scim/v2/Users", test.user, &resp)
+			c.Assert(status, qt.Equals, test.expectStatus)
+			c.Assert(resp.Schemas, qt.DeepEquals, []string{scim.ErrorSchema})
+			c.Assert(resp.ScimType, qt.Equals, test.expectScimType)
+		})
+	}
+}
+
+func (s *usersSuite) TestReplaceUser(c *qt.C) {
+	u := s.create(c, &scim.User{
+		ExternalID:  "test:bob-id",
+		UserName:    "bob",
+		DisplayName: "Bob Builder",
+		Emails:      []scim.MultiValued{{Value: "bob@example.com"}},
+	})
+	active := false
+	var got scim.User
+	status := s.do(c, "PUT", "/scim/v2/Users/"+u.ID, &scim.User{
+		UserName:    "robert",
+		DisplayName: "Robert Builder",
+		Active:      &active,
+	}, &got)
+	c.Assert(status, qt.Equals, http.StatusOK)
+	c.Assert(got.UserName, qt.Equals, "robert")
+	c.Assert(got.DisplayName, qt.Equals, "Robert Builder")
+	c.Assert(got.Emails, qt.HasLen, 0)
+	c.Assert(*got.Active, qt.Equals, false)
+
+	id := s.store.AssertUser(c, &store.Identity{
+		ProviderID: "test:bob-id",
+	})
+	c.Assert(id.Username, qt.Equals, "robert")
+	c.Assert(id.Email, qt.Equals, "")
+	c.Assert(idputil.IsSuspended(id), qt.Equals, true)
+
+	var serr scim.Error
+	status = s.do(c, "PUT", "/scim/v2/Users/"+u.ID, &scim.User{
+		ExternalID: "test:other-id",
+		UserName:   "robert",
+	}, &serr)
+	c.Assert(status, qt.Equals, http.StatusBadRequest)
+	c.Assert(serr.ScimType, qt.Equals, "mutability")
+
+	status = s.do(c, "PUT", "/scim/v2/Users/12345", &scim.User{
+		UserName: "robert",
+	}, &serr)
+	c.Assert(status, qt.Equals, http.StatusNotFound)
+}
+
+func (s *usersSuite) TestCreateUserConcurrently(c *qt.C) {
+	const n = 10
+	statuses := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			var resp json.RawMessage
+			statuses <- s.do(c, "POST", "/scim/v2/Users", &scim.User{
+				ExternalID: "test:bob-id",
+				UserName:   fmt.Sprintf("bob%d", i),
+			}, &resp)
+		}(i)
+	}
+	created := 0
+	for i := 0; i < n; i++ {
+		switch status := <-statuses; status {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			c.Fatalf("unexpected status %d", status)
+		}
+	}
+	c.Assert(created, qt.Equals, 1)
+}
+
+func (s *usersSuite) TestIDPSuspensionNotChanged(c *qt.C) {
+	u := s.create(c, &scim.User{
+		ExternalID: "test:bob-id",
+		UserName:   "bob",
+	})
+	err := idputil.SetSuspended(s.srv.Ctx, s.store.Store, "test:bob-id", true)
+	c.Assert(err, qt.IsNil)
+
+	// Updates that do not set active leave the suspension reported
+	// by the identity provider alone, and do not record it as a
+	// deactivation made through the SCIM API.
+	var got scim.User
+	status := s.do(c, "PUT", "/scim/v2/Users/"+u.ID, &scim.User{
+		UserName:    "bob",
+		DisplayName: "Bob Builder",
+	}, &got)
+	c.Assert(status, qt.Equals, http.StatusOK)
+	c.Assert(*got.Active, qt.Equals, false)
+	status = s.do(c, "PATCH", "/scim/v2/Users/"+u.ID, &scim.PatchRequest{
+		Schemas: []string{scim.PatchOpSchema},
+		Operations: []scim.PatchOperation{{
+			Op:    "replace",
+			Path:  "displayName",
+			Value: "Robert Builder",
+		}},
+	}, &got)
+	c.Assert(status, qt.Equals, http.StatusOK)
+	c.Assert(*got.Active, qt.Equals, false)
+	id := s.store.AssertUser(c, &store.Identity{
+		ProviderID: "test:bob-id",
+	})
+	c.Assert(id.ExtraInfo[idputil.SuspendedExtraInfoKey], qt.DeepEquals, []string{"true"})
+	c.Assert(id.ExtraInfo[idputil.InactiveExtraInfoKey], qt.HasLen, 0)
+
+	// Making the user active does not undo the suspension.
+	active := true
+	status = s.do(c, "PUT", "/scim/v2/Users/"+u.ID, &scim.User{
+		UserName: "bob",
+		Active:   &active,
+	}, &got)
+	c.Assert(status, qt.Equals, http.StatusOK)
+	c.Assert(*got.Active, qt.Equals, false)
+	id = s.store.AssertUser(c, &store.Identity{
+		ProviderID: "test:bob-id",
+	})
+	c.Assert(id.ExtraInfo[idputil.SuspendedExtraInfoKey], qt.DeepEquals, []string{"true"})
+}
+
+func (s *usersSuite) TestPatchUser(c *qt.C) {
+	u := s.create(c, &scim.User{
+		ExternalID:  "test:bob-id",
+		UserName:    "bob",
+		DisplayName: "Bob Builder",
+		Emails:      []scim.MultiValued{{Value: "bob@example.com"}},
+	})
+	var got scim.User
+	status := s.do(c, "PATCH", "/scim/v2/Users/"+u.ID, &scim.PatchRequest{
+		Schemas: []string{scim.PatchOpSchema},
+		Operations: []scim.PatchOperation{{
+			Op:    "Replace",
+			Path:  "active",
+			Value: false,
+		}, {
+			Op:    "replace",
+			Path:  `emails[type eq "work"].value`,
+			Value: "bob@example.org",
+		}, {
+			Op: "replace",
+			Value: map[string]interface{}{
+				"name.givenName":  "Robert",
+				"name.familyName": "Builder",
+			},
+		}},
+	}, &got)
+	c.Assert(status, qt.Equals, http.StatusOK)
+	c.Assert(got.UserName, qt.Equals, "bob")
+	c.Assert(got.DisplayName, qt.Equals, "Robert Builder")
+	c.Assert(got.Emails, qt.DeepEquals, []scim.MultiValued{{Value: "bob@example.org", Primary: true}})
+	c.Assert(*got.Active, qt.Equals, false)
+
+	status = s.do(c, "PATCH", "/scim/v2/Users/"+u.ID, &scim.PatchRequest{
+		Schemas: []string{scim.PatchOpSchema},
+		Operations: []scim.PatchOperation{{
+			Op:    "replace",
+			Path:  "active",
+			Value: true,
+		}, {
+			Op:   "remove",
+			Path: "emails",
+		}},
+	}, &got)
+	c.Assert(status, qt.Equals, http.StatusOK)
+	c.Assert(got.Emails, qt.HasLen, 0)
+	c.Assert(*got.Active, qt.Equals, true)
+	id := s.store.AssertUser(c, &store.Identity{
+		ProviderID: "test:bob-id",
+	})
+	c.Assert(idputil.IsSuspended(id), qt.Equals, false)
+
+	var serr scim.Error
+	status = s.do(c, "PATCH", "/scim/v2/Users/"+u.ID, &scim.PatchRequest{
+		Schemas: []string{scim.PatchOpSchema},
+		Operations: []scim.PatchOperation{{
+			Op:   "remove",
+			Path: "userName",
+		}},
+	}, &serr)
+	c.Assert(status, qt.Equals, http.StatusBadRequest)
+	c.Assert(serr.ScimType, qt.Equals, "invalidValue")
+}
+
+func (s *usersSuite) TestDeleteUser(c *qt.C) {
+	u := s.create(c, &scim.User{
+		ExternalID: "test:bob-id",
+		UserName:   "bob",
+	})
+	status := s.do(c, "DELETE", "/scim/v2/Users/"+u.ID, nil, nil)
+	c.Assert(status, qt.Equals, http.StatusNoContent)
+
+	err := s.store.Store.Identity(s.srv.Ctx, &store.Identity{
+		ProviderID: "test:bob-id",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+
+	var serr scim.Error
+	status = s.do(c, "DELETE", "/scim/v2/Users/"+u.ID, nil, &serr)
+	c.Assert(status, qt.Equals, http.StatusNotFound)
+
+	// The admin user cannot be removed.
+	admin := store.Identity{
+		Username: "admin@candid",
+	}
+	err = s.store.Store.Identity(s.srv.Ctx, &admin)
+	c.Assert(err, qt.IsNil)
+	status = s.do(c, "DELETE", "/scim/v2/Users/"+admin.ID, nil, &serr)
+	c.Assert(status, qt.Equals, http.StatusForbidden)
+}
+
+func (s *usersSuite) TestListUsers(c *qt.C) {
+	bob := s.create(c, &scim.User{
+		ExternalID: "test:bob-id",
+		UserName:   "bob",
+	})
+	s.create(c, &scim.User{
+		ExternalID: "test:alice-id",
+		UserName:   "alice",
+	})
+
+	var resp scim.ListResponse
+	status := s.do(c, "GET", `/scim/v2/Users?filter=userName+eq+"bob"`, nil, &resp)
+	c.Assert(status, qt.Equals, http.StatusOK)
+	c.Assert(resp.TotalResults, qt.Equals, 1)
+	c.Assert(resp.Resources, qt.HasLen, 1)
+	c.Assert(resp.Resources[0].ID, qt.Equals, bob.ID)
+
+	status = s.do(c, "GET", `/scim/v2/Users?filter=externalId+eq+"test:nobody"`, nil, &resp)
+	c.Assert(status, qt.Equals, http.StatusOK)
+	c.Assert(resp.TotalResults, qt.Equals, 0)
+	c.Assert(resp.Resources, qt.HasLen, 0)
+
+	status = s.do(c, "GET", "/scim/v2/Users?count=1&startIndex=2", nil, &resp)
+	c.Assert(status, qt.Equals, http.StatusOK)
+	c.Assert(resp.TotalResults, qt.Equals, 3)
+	c.Assert(resp.StartIndex, qt.Equals, 2)
+	c.Assert(resp.Resources, qt.HasLen, 1)
+	c.Assert(resp.Resources[0].UserName, qt.Equals, "alice")
+
+	var serr scim.Error
+	status = s.do(c, "GET", `/scim/v2/Users?filter=name.givenName+sw+"b"`, nil, &serr)
+	c.Assert(status, qt.Equals, http.StatusBadRequest)
+	c.Assert(serr.ScimType, qt.Equals, "invalidFilter")
+}
+
+func (s *usersSuite) TestAdminRequired(c *qt.C) {
+	key := s.srv.CreateAgent(c, "a-bob@candid", "bob")
+	client := &httpbakery.Client{
+		Client: httpbakery.NewHTTPClient(),
+		Key:    key,
+	}
+	agent.SetUpAuth(client, &agent.AuthInfo{
+		Key: key,
+		Agents: []agent.Agent{{
+			URL:      s.srv.URL,
+			Username: "a-bob@candid",
+		}},
+	})
+	var serr scim.Error
+	status := s.doWith(c, client, "POST", "/scim/v2/Users", &scim.User{
+		ExternalID: "test:alice-id",
+		UserName:   "alice",
+	}, &serr)
+	c.Assert(status, qt.Equals, http.StatusUnauthorized)
+	c.Assert(serr.Schemas, qt.DeepEquals, []string{scim.ErrorSchema})
+	c.Assert(serr.Status, qt.Equals, "401")
+
+	err := s.store.Store.Identity(s.srv.Ctx, &store.Identity{
+		ProviderID: "test:alice-id",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
@@ -0,0 +1,19 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+// SetAdminAccountDisabled disables, or re-enables, one of the configured
+// admin accounts. Other admin accounts are not affected.
+func (h *handler) SetAdminAccountDisabled(p httprequest.Params, r *params.SetAdminAccountDisabledRequest) error {
+	logger.Tracef("SetAdminAccountDisabled %#v", r)
+	err := h.params.Authorizer.SetAdminAccountDisabled(p.Context, r.Username, r.Disabled.Disabled)
+	return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+}
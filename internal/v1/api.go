@@ -28,12 +28,16 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 // new returns a function that will generate a new instance of the v1 API
 // handler for a request.
 func new(hParams identity.HandlerParams) func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
-	reqAuth := httpauth.New(hParams.Oven, hParams.Authorizer, hParams.APIMacaroonTimeout)
+	reqAuth := httpauth.New(hParams.Oven, hParams.Authorizer, hParams.APIMacaroonTimeout, hParams.MacaroonVersions())
+	adminFilter := hParams.AdminIPFilter()
 	return func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
 		t := trace.New("identity.internal.v1", p.PathPattern)
 		ctx := trace.NewContext(p.Context, t)
 		ctx, close1 := hParams.Store.Context(p.Context)
 		ctx, close2 := hParams.MeetingStore.Context(ctx)
+		if hParams.RequestAuthCache {
+			ctx = auth.ContextWithRequestCache(ctx)
+		}
 		hnd := &handler{
 			params: hParams,
 			trace:  t,
@@ -49,6 +53,14 @@ func new(hParams identity.HandlerParams) func(p httprequest.Params, arg interfac
 			hnd.Close()
 			return nil, nil, params.ErrUnauthorized
 		}
+		if auth.IsAdminOp(op) {
+			// Reject admin requests from outside the allowed
+			// networks before looking at any credentials.
+			if err := adminFilter.Check(p.Request); err != nil {
+				hnd.Close()
+				return nil, nil, errgo.Mask(err, errgo.Is(params.ErrForbidden))
+			}
+		}
 		authInfo, err := reqAuth.Auth(ctx, p.Request, op)
 		if err != nil {
 			hnd.Close()
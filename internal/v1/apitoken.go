@@ -0,0 +1,30 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+// CreateAPIToken creates a new API token that authenticates as the
+// given user. The token is returned only in this response.
+func (h *handler) CreateAPIToken(p httprequest.Params, r *params.CreateAPITokenRequest) (*params.APIToken, error) {
+	logger.Tracef("CreateAPIToken %q", r.Username)
+	token, err := h.params.Authorizer.CreateAPIToken(p.Context, r.Username, r.Body.Expires)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	return token, nil
+}
+
+// RevokeAPIToken revokes one of the given user's API tokens. The token
+// can no longer be used to authenticate.
+func (h *handler) RevokeAPIToken(p httprequest.Params, r *params.RevokeAPITokenRequest) error {
+	logger.Tracef("RevokeAPIToken %q %q", r.Username, r.ID)
+	err := h.params.Authorizer.RevokeAPIToken(p.Context, r.Username, r.ID)
+	return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+}
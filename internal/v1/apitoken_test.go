@@ -0,0 +1,192 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	v1 "github.com/canonical/candid/internal/v1"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+func newAPITokenServer(c *qt.C, lifetime time.Duration) *candidtest.Server {
+	sp := candidtest.NewStore().ServerParams()
+	sp.APITokenLifetime = lifetime
+	return candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+}
+
+// bearerGet performs a GET request to the given path authenticated
+// with the given API token.
+func bearerGet(c *qt.C, srv *candidtest.Server, path, token string) *http.Response {
+	req, err := http.NewRequest("GET", path, nil)
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return srv.Do(c, req)
+}
+
+func assertBearerUser(c *qt.C, srv *candidtest.Server, token, username string) {
+	resp := bearerGet(c, srv, "/v1/whoami", token)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	var whoami params.WhoAmIResponse
+	err := json.NewDecoder(resp.Body).Decode(&whoami)
+	c.Assert(err, qt.IsNil)
+	c.Assert(whoami.User, qt.Equals, username)
+}
+
+func assertBearerUnauthorized(c *qt.C, srv *candidtest.Server, token string) {
+	resp := bearerGet(c, srv, "/v1/whoami", token)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+}
+
+func TestAPITokenAuth(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	srv := newAPITokenServer(c, time.Hour)
+	srv.CreateUser(c, "bob")
+	client := srv.AdminIdentityClient(false)
+
+	token, err := client.CreateAPIToken(srv.Ctx, &params.CreateAPITokenRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(token.Expires.After(time.Now().Add(59*time.Minute)), qt.Equals, true)
+	assertBearerUser(c, srv, token.Token, "bob")
+
+	// The token is authorized as the user it belongs to.
+	resp := bearerGet(c, srv, "/v1/u/bob/groups", token.Token)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	resp = bearerGet(c, srv, "/v1/u/admin@candid/groups", token.Token)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+	// A token with the wrong secret does not authenticate.
+	assertBearerUnauthorized(c, srv, token.ID+".not-the-secret")
+	assertBearerUnauthorized(c, srv, "not-a-token")
+}
+
+func TestAPITokenExpiry(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	srv := newAPITokenServer(c, time.Hour)
+	srv.CreateUser(c, "bob")
+	client := srv.AdminIdentityClient(false)
+
+	_, err := client.CreateAPIToken(srv.Ctx, &params.CreateAPITokenRequest{
+		Username: "bob",
+		Body: params.CreateAPITokenBody{
+			Expires: time.Now().Add(2 * time.Hour),
+		},
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	token, err := client.CreateAPIToken(srv.Ctx, &params.CreateAPITokenRequest{
+		Username: "bob",
+		Body: params.CreateAPITokenBody{
+			Expires: time.Now().Add(500 * time.Millisecond),
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	assertBearerUser(c, srv, token.Token, "bob")
+	time.Sleep(time.Second)
+	assertBearerUnauthorized(c, srv, token.Token)
+}
+
+func TestAPITokenRevocation(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	srv := newAPITokenServer(c, time.Hour)
+	srv.CreateUser(c, "bob")
+	client := srv.AdminIdentityClient(false)
+
+	token1, err := client.CreateAPIToken(srv.Ctx, &params.CreateAPITokenRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+	token2, err := client.CreateAPIToken(srv.Ctx, &params.CreateAPITokenRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+
+	// A token can only be revoked through the user it belongs to.
+	err = client.RevokeAPIToken(srv.Ctx, &params.RevokeAPITokenRequest{
+		Username: "admin@candid",
+		ID:       token1.ID,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+
+	err = client.RevokeAPIToken(srv.Ctx, &params.RevokeAPITokenRequest{
+		Username: "bob",
+		ID:       token1.ID,
+	})
+	c.Assert(err, qt.IsNil)
+	assertBearerUnauthorized(c, srv, token1.Token)
+
+	// Other tokens are not affected.
+	assertBearerUser(c, srv, token2.Token, "bob")
+
+	err = client.RevokeAPIToken(srv.Ctx, &params.RevokeAPITokenRequest{
+		Username: "bob",
+		ID:       token1.ID,
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+}
+
+func TestAPITokenSuspendedUser(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.APITokenLifetime = time.Hour
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	srv.CreateUser(c, "bob")
+	client := srv.AdminIdentityClient(false)
+
+	token, err := client.CreateAPIToken(srv.Ctx, &params.CreateAPITokenRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+	assertBearerUser(c, srv, token.Token, "bob")
+
+	// The token cannot be used while the user is suspended.
+	pid := store.MakeProviderIdentity("test", "bob")
+	err = idputil.SetSuspended(srv.Ctx, st.Store, pid, true)
+	c.Assert(err, qt.IsNil)
+	assertBearerUnauthorized(c, srv, token.Token)
+
+	err = idputil.SetSuspended(srv.Ctx, st.Store, pid, false)
+	c.Assert(err, qt.IsNil)
+	assertBearerUser(c, srv, token.Token, "bob")
+}
+
+func TestAPITokensDisabled(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	srv := newAPITokenServer(c, 0)
+	srv.CreateUser(c, "bob")
+	_, err := srv.AdminIdentityClient(false).CreateAPIToken(srv.Ctx, &params.CreateAPITokenRequest{
+		Username: "bob",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+	assertBearerUnauthorized(c, srv, "abc.def")
+}
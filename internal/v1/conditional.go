@@ -0,0 +1,69 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// identityETag returns the entity tag that identifies the current
+// version of the given identity.
+func identityETag(id *store.Identity) string {
+	return fmt.Sprintf(`"%s-%d"`, id.ID, id.Version)
+}
+
+// checkNotModified adds ETag and Last-Modified headers describing the
+// given identity to the response. If the conditional headers in the
+// request show that the client already has the current version of the
+// identity then an error with a cause of params.ErrNotModified is
+// returned. If-None-Match takes precedence over If-Modified-Since, as
+// specified in RFC 7232.
+func checkNotModified(p httprequest.Params, id *store.Identity) error {
+	etag := identityETag(id)
+	p.Response.Header().Set("ETag", etag)
+	if !id.Modified.IsZero() {
+		p.Response.Header().Set("Last-Modified", id.Modified.UTC().Format(http.TimeFormat))
+	}
+	if inm := p.Request.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			return errgo.WithCausef(nil, params.ErrNotModified, "")
+		}
+		return nil
+	}
+	ims := p.Request.Header.Get("If-Modified-Since")
+	if ims == "" || id.Modified.IsZero() {
+		return nil
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		// An invalid date is ignored.
+		return nil
+	}
+	// HTTP dates only have a resolution of one second.
+	if !id.Modified.Truncate(time.Second).After(t) {
+		return errgo.WithCausef(nil, params.ErrNotModified, "")
+	}
+	return nil
+}
+
+// etagMatches reports whether the given If-None-Match header value
+// matches the given entity tag. Weak comparison is used.
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
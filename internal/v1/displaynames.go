@@ -0,0 +1,34 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/displayname"
+	"github.com/canonical/candid/params"
+)
+
+// DisplayNameDuplicates returns the display names that are shared by
+// more than one identity, after normalizing them as requested.
+func (h *handler) DisplayNameDuplicates(p httprequest.Params, r *params.DisplayNameDuplicatesRequest) (*params.DisplayNameDuplicatesResponse, error) {
+	duplicates, err := displayname.Duplicates(p.Context, h.params.Store, displayname.Params{
+		TrimSpace:       r.TrimSpace,
+		CaseInsensitive: r.CaseInsensitive,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := params.DisplayNameDuplicatesResponse{
+		Duplicates: make([]params.DisplayNameDuplicate, len(duplicates)),
+	}
+	for i, d := range duplicates {
+		resp.Duplicates[i].Name = d.Name
+		for _, u := range d.Usernames {
+			resp.Duplicates[i].Usernames = append(resp.Duplicates[i].Usernames, params.Username(u))
+		}
+	}
+	return &resp, nil
+}
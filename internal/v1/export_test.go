@@ -5,4 +5,8 @@ package v1
 
 var (
 	GravatarHash = gravatarHash
+	SetPageLinks = setPageLinks
+
+	ExportBatchSize = &exportBatchSize
+	TimeNow         = &timeNow
 )
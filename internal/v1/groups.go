@@ -0,0 +1,104 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// ListGroups returns the records of all groups.
+func (h *handler) ListGroups(p httprequest.Params, r *params.ListGroupsRequest) (*params.ListGroupsResponse, error) {
+	groupStore, err := h.groupStore()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	groups, err := groupStore.FindGroups(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := &params.ListGroupsResponse{
+		Groups: make([]params.Group, len(groups)),
+	}
+	for i, g := range groups {
+		resp.Groups[i] = groupFromStore(g)
+	}
+	return resp, nil
+}
+
+// Group returns the record of a group.
+func (h *handler) Group(p httprequest.Params, r *params.GroupRequest) (*params.Group, error) {
+	groupStore, err := h.groupStore()
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	g := store.Group{Name: r.Group}
+	if err := groupStore.Group(p.Context, &g); err != nil {
+		return nil, translateStoreError(err)
+	}
+	pg := groupFromStore(g)
+	return &pg, nil
+}
+
+// SetGroup creates or replaces the record of a group. The membership
+// of the group is not changed.
+func (h *handler) SetGroup(p httprequest.Params, r *params.SetGroupRequest) error {
+	logger.Tracef("SetGroup %#v", r)
+	groupStore, err := h.groupStore()
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	for k := range r.Body.Metadata {
+		if k == "" || strings.ContainsAny(k, ".$") {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "%q bad key for group metadata", k)
+		}
+	}
+	err = groupStore.UpdateGroup(p.Context, &store.Group{
+		Name:        r.Group,
+		Description: r.Body.Description,
+		Metadata:    r.Body.Metadata,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	logger.Tracef("SetGroup complete")
+	return nil
+}
+
+// DeleteGroup removes the record of a group. Any identities that are
+// members of the group remain members.
+func (h *handler) DeleteGroup(p httprequest.Params, r *params.DeleteGroupRequest) error {
+	logger.Tracef("DeleteGroup %#v", r)
+	groupStore, err := h.groupStore()
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := groupStore.RemoveGroup(p.Context, r.Group); err != nil {
+		return translateStoreError(err)
+	}
+	logger.Tracef("DeleteGroup complete")
+	return nil
+}
+
+// groupStore returns the configured group store, or an error with a
+// cause of params.ErrNotFound if there is none.
+func (h *handler) groupStore() (store.GroupStore, error) {
+	if h.params.GroupStore == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "group records not supported")
+	}
+	return h.params.GroupStore, nil
+}
+
+func groupFromStore(g store.Group) params.Group {
+	return params.Group{
+		Name:        g.Name,
+		Description: g.Description,
+		Metadata:    g.Metadata,
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	v1 "github.com/canonical/candid/internal/v1"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+func TestGroupRecords(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	st := candidtest.NewStore()
+	srv := candidtest.NewServer(c, st.ServerParams(), map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	client := srv.AdminIdentityClient(false)
+
+	resp, err := client.ListGroups(srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Groups, qt.HasLen, 0)
+
+	_, err = client.Group(srv.Ctx, &params.GroupRequest{
+		Group: "g1",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+
+	// Create the records of two groups.
+	err = client.SetGroup(srv.Ctx, &params.SetGroupRequest{
+		Group: "g1",
+		Body: params.SetGroupBody{
+			Description: "group one",
+			Metadata: map[string]string{
+				"owner":   "bob",
+				"purpose": "testing",
+			},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	err = client.SetGroup(srv.Ctx, &params.SetGroupRequest{
+		Group: "g2",
+		Body: params.SetGroupBody{
+			Description: "group two",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	g, err := client.Group(srv.Ctx, &params.GroupRequest{
+		Group: "g1",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(g, qt.DeepEquals, &params.Group{
+		Name:        "g1",
+		Description: "group one",
+		Metadata: map[string]string{
+			"owner":   "bob",
+			"purpose": "testing",
+		},
+	})
+
+	// Updating a record replaces it.
+	err = client.SetGroup(srv.Ctx, &params.SetGroupRequest{
+		Group: "g1",
+		Body: params.SetGroupBody{
+			Description: "the first group",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	resp, err = client.ListGroups(srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Groups, qt.DeepEquals, []params.Group{{
+		Name:        "g1",
+		Description: "the first group",
+	}, {
+		Name:        "g2",
+		Description: "group two",
+	}})
+
+	// Deleting a group record does not affect its members.
+	err = st.Store.UpdateIdentity(srv.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"g1"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = client.DeleteGroup(srv.Ctx, &params.DeleteGroupRequest{
+		Group: "g1",
+	})
+	c.Assert(err, qt.IsNil)
+	id := store.Identity{
+		Username: "bob",
+	}
+	err = st.Store.Identity(srv.Ctx, &id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id.Groups, qt.DeepEquals, []string{"g1"})
+
+	err = client.DeleteGroup(srv.Ctx, &params.DeleteGroupRequest{
+		Group: "g1",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+
+	resp, err = client.ListGroups(srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Groups, qt.DeepEquals, []params.Group{{
+		Name:        "g2",
+		Description: "group two",
+	}})
+}
+
+func TestSetGroupBadMetadataKey(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	srv := candidtest.NewServer(c, candidtest.NewStore().ServerParams(), map[string]identity.NewAPIHandlerFunc{
+		"v1": v1.NewAPIHandler,
+	})
+	err := srv.AdminIdentityClient(false).SetGroup(srv.Ctx, &params.SetGroupRequest{
+		Group: "g1",
+		Body: params.SetGroupBody{
+			Metadata: map[string]string{
+				"a.b": "c",
+			},
+		},
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/audit"
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
+	"github.com/canonical/candid/internal/auth/httpauth"
+	"github.com/canonical/candid/params"
+)
+
+// IDPConfig returns the configuration of the identity providers the
+// server is running with. The values of any secret parameters are
+// redacted.
+func (h *handler) IDPConfig(p httprequest.Params, r *params.IDPConfigRequest) (*params.IDPConfigResponse, error) {
+	resp := &params.IDPConfigResponse{
+		IDPs: make([]params.IDPConfig, 0, len(h.params.IdentityProviders)),
+	}
+	for _, ip := range h.params.IdentityProviders {
+		c := params.IDPConfig{
+			Name:        ip.Name(),
+			Domain:      ip.Domain(),
+			Description: ip.Description(),
+			Interactive: ip.Interactive(),
+			Hidden:      ip.Hidden(),
+			Category:    ip.Category(),
+		}
+		if cr, ok := ip.(idp.ConfigReporter); ok {
+			var ps interface{}
+			c.Type, ps = cr.ConfigParams()
+			var err error
+			c.Params, err = idputil.RedactConfig(ps)
+			if err != nil {
+				return nil, errgo.Notef(err, "cannot report configuration of identity provider %q", ip.Name())
+			}
+		}
+		resp.IDPs = append(resp.IDPs, c)
+	}
+	return resp, nil
+}
+
+// ListIDPs returns the identity providers the server is running with
+// and whether each is enabled.
+func (h *handler) ListIDPs(p httprequest.Params, r *params.ListIDPsRequest) (*params.ListIDPsResponse, error) {
+	resp := &params.ListIDPsResponse{
+		IDPs: make([]params.IDPStatus, 0, len(h.params.IdentityProviders)),
+	}
+	for _, ip := range h.params.IdentityProviders {
+		enabled, err := h.params.IDPStatus.Enabled(p.Context, ip.Name())
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		resp.IDPs = append(resp.IDPs, params.IDPStatus{
+			Name:        ip.Name(),
+			Domain:      ip.Domain(),
+			Description: ip.Description(),
+			Interactive: ip.Interactive(),
+			Enabled:     enabled,
+		})
+	}
+	return resp, nil
+}
+
+// SetIDPEnabled enables, or disables, one of the identity providers. A
+// disabled identity provider is not offered as a login choice and
+// rejects new logins. Identities that have already logged in with it
+// are not affected. The change is recorded in the audit log, if
+// configured.
+func (h *handler) SetIDPEnabled(p httprequest.Params, r *params.SetIDPEnabledRequest) error {
+	logger.Tracef("SetIDPEnabled %#v", r)
+	if err := h.params.IDPStatus.SetEnabled(p.Context, r.IDP, r.Enabled.Enabled); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	h.auditIDPStatus(p, r.IDP, r.Enabled.Enabled)
+	return nil
+}
+
+// auditIDPStatus records in the audit log, if configured, that the
+// authenticated user has enabled, or disabled, the named identity
+// provider. Failing to write the event does not fail the request.
+func (h *handler) auditIDPStatus(p httprequest.Params, name string, enabled bool) {
+	if h.params.AuditLogger == nil {
+		return
+	}
+	e := &audit.Event{
+		Time:    timeNow(),
+		Action:  audit.IDPDisabled,
+		Outcome: audit.Success,
+		IDP:     name,
+	}
+	if enabled {
+		e.Action = audit.IDPEnabled
+	}
+	if id := identityFromContext(p.Context); id != nil {
+		e.Username = id.Id()
+	}
+	filter := httpauth.IPFilter{
+		TrustedProxies: h.params.TrustedProxies,
+	}
+	if ip := filter.ClientIP(p.Request); ip != nil {
+		e.ClientIP = ip.String()
+	}
+	if err := h.params.AuditLogger.Log(p.Context, e); err != nil {
+		logger.Errorf("cannot write audit event: %s", err)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// setPageLinks adds a Link header (see RFC 8288) to the given header
+// containing the URLs of the first, previous and next pages of a
+// paginated result. The URLs are formed by setting the offset and
+// limit parameters in the given query and appending it to the given
+// base URL, which should be an absolute URL formed from the server's
+// configured location. The next link is only included if more is
+// true.
+func setPageLinks(h http.Header, base string, query url.Values, offset, limit int, more bool) {
+	link := func(offset int, rel string) string {
+		q := make(url.Values, len(query))
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("offset", strconv.Itoa(offset))
+		q.Set("limit", strconv.Itoa(limit))
+		return fmt.Sprintf("<%s?%s>; rel=%q", base, q.Encode(), rel)
+	}
+	links := []string{link(0, "first")}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	if more {
+		links = append(links, link(offset+limit, "next"))
+	}
+	h.Set("Link", strings.Join(links, ", "))
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/internal/v1"
+)
+
+var setPageLinksTests = []struct {
+	about  string
+	offset int
+	limit  int
+	more   bool
+	expect string
+}{{
+	about:  "first page",
+	offset: 0,
+	limit:  10,
+	more:   true,
+	expect: `<https://candid.example.com/v1/u?email=bob%40example.com&limit=10&offset=0>; rel="first", <https://candid.example.com/v1/u?email=bob%40example.com&limit=10&offset=10>; rel="next"`,
+}, {
+	about:  "middle page",
+	offset: 10,
+	limit:  10,
+	more:   true,
+	expect: `<https://candid.example.com/v1/u?email=bob%40example.com&limit=10&offset=0>; rel="first", <https://candid.example.com/v1/u?email=bob%40example.com&limit=10&offset=0>; rel="prev", <https://candid.example.com/v1/u?email=bob%40example.com&limit=10&offset=20>; rel="next"`,
+}, {
+	about:  "last page",
+	offset: 15,
+	limit:  10,
+	more:   false,
+	expect: `<https://candid.example.com/v1/u?email=bob%40example.com&limit=10&offset=0>; rel="first", <https://candid.example.com/v1/u?email=bob%40example.com&limit=10&offset=5>; rel="prev"`,
+}}
+
+func TestSetPageLinks(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range setPageLinksTests {
+		c.Run(test.about, func(c *qt.C) {
+			h := make(http.Header)
+			query := url.Values{
+				"email":  {"bob@example.com"},
+				"offset": {"999"},
+			}
+			v1.SetPageLinks(h, "https://candid.example.com/v1/u", query, test.offset, test.limit, test.more)
+			c.Assert(h.Get("Link"), qt.Equals, test.expect)
+			// The original query must not be modified.
+			c.Assert(query.Get("offset"), qt.Equals, "999")
+		})
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// exportBatchSize holds the number of identities read from the store
+// at a time when exporting users.
+var exportBatchSize = 100
+
+// redactedValue holds the value that replaces redacted fields in
+// exported users.
+const redactedValue = "REDACTED"
+
+// ExportUsers streams all the users in the system as newline-delimited
+// JSON. Identities are read from the store in batches ordered by
+// username, so the memory used does not depend on the number of users.
+// Any fields listed in ServerParams.ExportRedactFields are redacted.
+// The stream ends with a params.ExportUsersTrailer, which reports any
+// error that stopped the export once the response had started.
+func (h *handler) ExportUsers(p httprequest.Params, r *params.ExportUsersRequest) error {
+	ref := store.Identity{Username: r.Checkpoint}
+	var filter store.Filter
+	if r.Checkpoint != "" {
+		filter[store.Username] = store.GreaterThan
+	}
+	sort := []store.Sort{{Field: store.Username}}
+	identities, err := h.params.Store.FindIdentities(p.Context, &ref, filter, sort, 0, exportBatchSize)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	p.Response.Header().Set("Content-Type", "application/x-ndjson")
+	p.Response.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(p.Response)
+	flusher, _ := p.Response.(http.Flusher)
+	trailer := params.ExportUsersTrailer{
+		Trailer:    true,
+		Checkpoint: r.Checkpoint,
+	}
+	for len(identities) > 0 {
+		for i := range identities {
+			v, err := h.exportUser(p, &identities[i])
+			if err != nil {
+				// The response has already started so the
+				// error is reported in the trailer, from
+				// which the client can resume the export.
+				logger.Errorf("cannot export user %q: %s", identities[i].Username, err)
+				h.writeExportTrailer(enc, trailer, errgo.Notef(err, "cannot export user %q", identities[i].Username))
+				return nil
+			}
+			if err := enc.Encode(v); err != nil {
+				logger.Infof("cannot write exported user: %s", err)
+				return nil
+			}
+			trailer.Count++
+			trailer.Checkpoint = identities[i].Username
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(identities) < exportBatchSize {
+			break
+		}
+		ref.Username = identities[len(identities)-1].Username
+		filter[store.Username] = store.GreaterThan
+		identities, err = h.params.Store.FindIdentities(p.Context, &ref, filter, sort, 0, exportBatchSize)
+		if err != nil {
+			logger.Errorf("cannot export users after %q: %s", ref.Username, err)
+			h.writeExportTrailer(enc, trailer, errgo.Notef(err, "cannot export users after %q", ref.Username))
+			return nil
+		}
+	}
+	h.writeExportTrailer(enc, trailer, nil)
+	return nil
+}
+
+// writeExportTrailer writes the given trailer, recording err if it is
+// not nil, to the end of a user export.
+func (h *handler) writeExportTrailer(enc *json.Encoder, trailer params.ExportUsersTrailer, err error) {
+	if err != nil {
+		trailer.Error = &params.Error{
+			Message: err.Error(),
+		}
+	}
+	if err := enc.Encode(trailer); err != nil {
+		logger.Infof("cannot write export trailer: %s", err)
+	}
+}
+
+// exportUser returns the exported form of the given identity with any
+// configured fields redacted.
+func (h *handler) exportUser(p httprequest.Params, id *store.Identity) (interface{}, error) {
+	aid, err := h.params.Authorizer.Identity(p.Context, id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	u, err := h.userFromIdentity(p.Context, aid)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(h.params.ExportRedactFields) == 0 {
+		return u, nil
+	}
+	data, err := json.Marshal(u)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for _, f := range h.params.ExportRedactFields {
+		if _, ok := m[f]; ok {
+			m[f] = redactedValue
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v1_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/internal/candidtest"
+	"github.com/canonical/candid/internal/discharger"
+	"github.com/canonical/candid/internal/identity"
+	v1 "github.com/canonical/candid/internal/v1"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// limitRecordingStore is a store.Store that records the limits of the
+// FindIdentities calls made to it.
+type limitRecordingStore struct {
+	store.Store
+
+	mu     sync.Mutex
+	limits []int
+
+	// failAfter, if set, causes FindIdentities to fail when
+	// reading the users after the given username.
+	failAfter string
+}
+
+func (s *limitRecordingStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
+	s.mu.Lock()
+	s.limits = append(s.limits, limit)
+	failAfter := s.failAfter
+	s.mu.Unlock()
+	if failAfter != "" && ref.Username >= failAfter {
+		return nil, errgo.New("store failure")
+	}
+	return s.Store.FindIdentities(ctx, ref, filter, sort, skip, limit)
+}
+
+func TestExportUsers(t *testing.T) {
+	c := qt.New(t)
+	c.Patch(v1.ExportBatchSize, 3)
+
+	candidStore := candidtest.NewStore()
+	st := &limitRecordingStore{Store: candidStore.Store}
+	sp := candidStore.ServerParams()
+	sp.Store = st
+	sp.ExportRedactFields = []string{"email"}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+
+	var expect []string
+	for i := 0; i < 10; i++ {
+		username := fmt.Sprintf("user%02d", i)
+		err := candidStore.Store.UpdateIdentity(srv.Ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", username),
+			Username:   username,
+			Email:      username + "@example.com",
+		}, store.Update{
+			store.Username: store.Set,
+			store.Email:    store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+		expect = append(expect, username)
+	}
+
+	export := func(checkpoint string) ([]map[string]interface{}, params.ExportUsersTrailer) {
+		req, err := http.NewRequest("GET", srv.URL+"/v1/export/users?checkpoint="+checkpoint, nil)
+		c.Assert(err, qt.IsNil)
+		resp, err := srv.AdminClient().Do(req)
+		c.Assert(err, qt.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("Content-Type"), qt.Equals, "application/x-ndjson")
+		var users []map[string]interface{}
+		var trailer params.ExportUsersTrailer
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			c.Assert(trailer.Trailer, qt.IsFalse, qt.Commentf("document after trailer"))
+			var u map[string]interface{}
+			err := json.Unmarshal(sc.Bytes(), &u)
+			c.Assert(err, qt.IsNil)
+			if u["trailer"] == true {
+				err := json.Unmarshal(sc.Bytes(), &trailer)
+				c.Assert(err, qt.IsNil)
+				continue
+			}
+			users = append(users, u)
+		}
+		c.Assert(sc.Err(), qt.IsNil)
+		c.Assert(trailer.Trailer, qt.IsTrue, qt.Commentf("no trailer"))
+		c.Assert(trailer.Count, qt.Equals, len(users))
+		return users, trailer
+	}
+
+	st.mu.Lock()
+	st.limits = nil
+	st.mu.Unlock()
+	var usernames []string
+	users, trailer := export("")
+	c.Assert(trailer.Error, qt.IsNil)
+	for _, u := range users {
+		username, _ := u["username"].(string)
+		if username == "admin@candid" {
+			continue
+		}
+		usernames = append(usernames, username)
+		c.Assert(u["email"], qt.Equals, "REDACTED")
+	}
+	c.Assert(usernames, qt.DeepEquals, expect)
+
+	// The identities were read in batches rather than all at once.
+	st.mu.Lock()
+	limits := st.limits
+	st.mu.Unlock()
+	c.Assert(len(limits) > 1, qt.Equals, true)
+	for _, limit := range limits {
+		c.Assert(limit, qt.Equals, 3)
+	}
+
+	// The export can be resumed from a checkpoint.
+	usernames = nil
+	users, trailer = export("user06")
+	c.Assert(trailer.Error, qt.IsNil)
+	c.Assert(trailer.Checkpoint, qt.Equals, "user09")
+	for _, u := range users {
+		usernames = append(usernames, u["username"].(string))
+	}
+	c.Assert(usernames, qt.DeepEquals, []string{"user07", "user08", "user09"})
+
+	// An error part way through the export is reported in the
+	// trailer with the checkpoint to resume from.
+	st.mu.Lock()
+	st.failAfter = "user03"
+	st.mu.Unlock()
+	users, trailer = export("user00")
+	c.Assert(users, qt.HasLen, 3)
+	c.Assert(trailer.Checkpoint, qt.Equals, "user03")
+	c.Assert(trailer.Error, qt.Not(qt.IsNil))
+	c.Assert(trailer.Error.Message, qt.Equals, `cannot export users after "user03": store failure`)
+}
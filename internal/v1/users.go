@@ -6,9 +6,9 @@ package v1
 import (
 	"context"
 	"crypto/md5"
-	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 
@@ -17,11 +17,13 @@ import (
 	"gopkg.in/macaroon-bakery.v2/bakery"
 	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
 	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
-	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	macaroon "gopkg.in/macaroon.v2"
 
 	"github.com/canonical/candid/candidclient"
+	"github.com/canonical/candid/idp"
+	"github.com/canonical/candid/idp/idputil"
 	"github.com/canonical/candid/internal/auth"
+	"github.com/canonical/candid/internal/identity"
 	"github.com/canonical/candid/params"
 	"github.com/canonical/candid/store"
 )
@@ -44,6 +46,11 @@ func (h *handler) QueryUsers(p httprequest.Params, r *params.QueryUsersRequest)
 	}
 	if r.Email != "" {
 		identity.Email = r.Email
+		if h.params.EmailValidation != store.EmailNone {
+			// Match the normalization applied when email
+			// addresses are stored.
+			identity.Email = store.NormalizeEmail(r.Email)
+		}
 		filter[store.Email] = store.Equal
 	}
 	if len(r.LastLoginSince) > 0 {
@@ -77,13 +84,46 @@ func (h *handler) QueryUsers(p httprequest.Params, r *params.QueryUsersRequest)
 		identity.Owner = ownerIdentity.ProviderID
 		filter[store.Owner] = store.Equal
 	}
+	if r.Source != "" {
+		identity.Source = r.Source
+		filter[store.Source] = store.Equal
+	}
 
-	// TODO(mhilton) make sure this endpoint can be queried as a
-	// subset once there are more users.
-	identities, err := h.params.Store.FindIdentities(p.Context, &identity, filter, []store.Sort{{Field: store.Username}}, 0, 0)
+	if r.Offset < 0 || r.Limit < 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "offset and limit must not be negative")
+	}
+	pageSize := r.Limit
+	if r.Query != "" {
+		if r.Offset > maxSearchOffset {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "search offset must not be greater than %d", maxSearchOffset)
+		}
+		if pageSize == 0 || pageSize > maxSearchResults {
+			pageSize = maxSearchResults
+		}
+	}
+	limit := pageSize
+	if limit > 0 {
+		// Fetch an extra identity to find out whether there is
+		// another page.
+		limit++
+	}
+	var identities []store.Identity
+	var err error
+	if r.Query != "" {
+		identities, err = h.searchIdentities(p.Context, r.Query, identity, filter, r.Offset, limit)
+	} else {
+		identities, err = h.params.Store.FindIdentities(p.Context, &identity, filter, []store.Sort{{Field: store.Username}}, r.Offset, limit)
+	}
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if pageSize > 0 {
+		more := len(identities) > pageSize
+		if more {
+			identities = identities[:pageSize]
+		}
+		setPageLinks(p.Response.Header(), idputil.LocationURL(h.params.Location, "/v1/u"), p.Request.URL.Query(), r.Offset, pageSize, more)
+	}
 	usernames := make([]string, len(identities))
 	for i, id := range identities {
 		usernames[i] = id.Username
@@ -92,6 +132,80 @@ func (h *handler) QueryUsers(p httprequest.Params, r *params.QueryUsersRequest)
 	return usernames, nil
 }
 
+const (
+	// maxSearchResults holds the maximum number of identities
+	// returned from a single search.
+	maxSearchResults = 100
+
+	// maxSearchOffset holds the maximum offset that can be used in
+	// a search. Every page of results requires all the preceding
+	// results to be fetched, so this bounds the cost of a search.
+	maxSearchOffset = 1000
+)
+
+// searchFields holds the fields matched by a search, in the order in
+// which their matches are ranked.
+var searchFields = []store.Field{store.Username, store.Email, store.Name}
+
+// searchIdentities finds the identities that match ref and filter and
+// have a username, email address or name starting with q. The results
+// are ranked with any exact username match first, followed by the
+// matches for each of the searchFields in turn, each sorted by
+// username. Every query is a prefix match that can be satisfied using
+// an index on the field. Fields already constrained by filter are not
+// searched.
+func (h *handler) searchIdentities(ctx context.Context, q string, ref store.Identity, filter store.Filter, skip, limit int) ([]store.Identity, error) {
+	var identities []store.Identity
+	seen := make(map[store.ProviderIdentity]bool)
+	find := func(f store.Field, cmp store.Comparison, limit int) error {
+		if filter[f] != store.NoComparison {
+			return nil
+		}
+		ref1, filter1 := ref, filter
+		switch f {
+		case store.Username:
+			ref1.Username = q
+		case store.Email:
+			ref1.Email = q
+			if h.params.EmailValidation != store.EmailNone {
+				ref1.Email = store.NormalizeEmail(q)
+			}
+		case store.Name:
+			ref1.Name = q
+		}
+		filter1[f] = cmp
+		ids, err := h.params.Store.FindIdentities(ctx, &ref1, filter1, []store.Sort{{Field: store.Username}}, 0, limit)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, id := range ids {
+			if !seen[id.ProviderID] {
+				seen[id.ProviderID] = true
+				identities = append(identities, id)
+			}
+		}
+		return nil
+	}
+	if err := find(store.Username, store.Equal, 1); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// Each field is searched for enough results to fill the
+	// requested page even if none of the other fields match.
+	for _, f := range searchFields {
+		if err := find(f, store.HasPrefix, skip+limit); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if skip >= len(identities) {
+		return []store.Identity{}, nil
+	}
+	identities = identities[skip:]
+	if len(identities) > limit {
+		identities = identities[:limit]
+	}
+	return identities, nil
+}
+
 // User returns the user information for the request user.
 func (h *handler) User(p httprequest.Params, r *params.UserRequest) (*params.User, error) {
 	logger.Tracef("User %#v", r)
@@ -101,6 +215,11 @@ func (h *handler) User(p httprequest.Params, r *params.UserRequest) (*params.Use
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
+	if h.params.ConditionalUserRequests {
+		if err := checkNotModified(p, &id.Identity); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotModified))
+		}
+	}
 	u, err := h.userFromIdentity(p.Context, id)
 	if err != nil {
 		return nil, errgo.Mask(err)
@@ -146,7 +265,7 @@ func (h *handler) CreateAgent(p httprequest.Params, u *params.CreateAgentRequest
 		// the group?
 		return nil, errgo.Newf("cannot create an agent using an agent account")
 	}
-	agentName, err := newAgentName()
+	agentName, err := h.newAgentName()
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -182,6 +301,46 @@ func (h *handler) CreateAgent(p httprequest.Params, u *params.CreateAgentRequest
 	return resp, nil
 }
 
+// ProvisionUser creates a user that has not yet logged in, so that
+// groups may be assigned to them in advance. The user will be linked
+// to their identity provider account using the given external ID.
+func (h *handler) ProvisionUser(p httprequest.Params, r *params.ProvisionUserRequest) error {
+	logger.Tracef("ProvisionUser %#v", r)
+	if r.Body.ExternalID == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "external_id not specified")
+	}
+	if blacklistUsernames[r.Username] {
+		return errgo.WithCausef(nil, params.ErrForbidden, "username %q is reserved", r.Username)
+	}
+	if err := h.params.CheckExternalID(r.Body.ExternalID); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	id := store.Identity{
+		ProviderID: store.ProviderIdentity(r.Body.ExternalID),
+	}
+	err := h.params.Store.Identity(p.Context, &id)
+	if err == nil {
+		return errgo.WithCausef(nil, params.ErrAlreadyExists, "user with external_id %q already exists", r.Body.ExternalID)
+	}
+	if errgo.Cause(err) != store.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	id = store.Identity{
+		ProviderID: store.ProviderIdentity(r.Body.ExternalID),
+		Username:   string(r.Username),
+		Groups:     identity.AddDefaultGroups(r.Body.Groups, h.params.DefaultGroups),
+	}
+	err = h.params.Store.UpdateIdentity(p.Context, &id, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	if err != nil {
+		return translateStoreError(err)
+	}
+	logger.Tracef("ProvisionUser complete")
+	return nil
+}
+
 // SetUserDeprecated creates or updates the user with the given username. If the
 // user already exists then any IDPGroups or SSHKeys specified in the
 // request will be ignored. See SetUserGroups, ModifyUserGroups,
@@ -208,9 +367,22 @@ func (h *handler) WhoAmI(p httprequest.Params, arg *params.WhoAmIRequest) (param
 }
 
 // UserGroups returns the list of groups associated with the requested
-// user.
+// user. If r.Stored is set only the groups stored for the user are
+// returned.
 func (h *handler) UserGroups(p httprequest.Params, r *params.UserGroupsRequest) ([]string, error) {
 	logger.Tracef("UserGroups %#v", r)
+	if r.Stored {
+		id := store.Identity{
+			Username: string(r.Username),
+		}
+		if err := h.params.Store.Identity(p.Context, &id); err != nil {
+			return nil, translateStoreError(err)
+		}
+		if id.Groups == nil {
+			return []string{}, nil
+		}
+		return id.Groups, nil
+	}
 	id, err := h.params.Authorizer.Identity(p.Context, &store.Identity{
 		Username: string(r.Username),
 	})
@@ -339,6 +511,204 @@ func (h *handler) DeleteSSHKeys(p httprequest.Params, r *params.DeleteSSHKeysReq
 	return nil
 }
 
+// UserRoles returns any tenant-scoped roles stored for the given user.
+func (h *handler) UserRoles(p httprequest.Params, r *params.UserRolesRequest) (params.RolesResponse, error) {
+	logger.Tracef("UserRoles %#v", r)
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return params.RolesResponse{}, translateStoreError(err)
+	}
+	resp := params.RolesResponse{
+		Roles: id.Roles,
+	}
+	logger.Tracef("UserRoles response %#v", resp)
+	return resp, nil
+}
+
+// SetUserRoles replaces the tenant-scoped roles stored for the given
+// user. Each role must be of the form "tenant:role".
+func (h *handler) SetUserRoles(p httprequest.Params, r *params.SetUserRolesRequest) error {
+	logger.Tracef("SetUserRoles %#v", r)
+	for _, role := range r.Roles.Roles {
+		if !validRole.MatchString(role) {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid role %q, expected tenant:role", role)
+		}
+	}
+	id := store.Identity{
+		Username: string(r.Username),
+		Roles:    r.Roles.Roles,
+	}
+	err := h.params.Store.UpdateIdentity(p.Context, &id, store.Update{store.Roles: store.Set})
+	if err != nil {
+		return translateStoreError(err)
+	}
+	logger.Tracef("SetUserRoles complete")
+	return nil
+}
+
+// SimulateLogin reports the username, groups and discharge caveats
+// that the given user would receive on logging in. No credentials are
+// checked and no macaroon is issued.
+func (h *handler) SimulateLogin(p httprequest.Params, r *params.SimulateLoginRequest) (*params.SimulateLoginResponse, error) {
+	logger.Tracef("SimulateLogin %#v", r)
+	cond := r.Body.Condition
+	switch cond {
+	case "":
+		cond = "is-authenticated-user"
+	case "is-authenticated-user", "is-authenticated-userid":
+	default:
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "unsupported condition %q", cond)
+	}
+	id, err := h.params.Authorizer.Identity(p.Context, &store.Identity{
+		Username: string(r.Username),
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	groups, err := id.Groups(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if groups == nil {
+		groups = []string{}
+	}
+	caveats, err := auth.DischargeCaveats(id, cond, time.Now().Add(h.params.DischargeMacaroonTimeout), h.params.RolesCaveat)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := &params.SimulateLoginResponse{
+		Simulated: true,
+		Username:  params.Username(id.Username),
+		Groups:    groups,
+		Caveats:   make([]string, len(caveats)),
+	}
+	for i, cav := range caveats {
+		resp.Caveats[i] = cav.Condition
+	}
+	logger.Tracef("SimulateLogin response %#v", resp)
+	return resp, nil
+}
+
+// ResetPassword creates a single-use token that can be used to set a
+// new password for the given user. The user's identity provider must
+// support password resets.
+func (h *handler) ResetPassword(p httprequest.Params, r *params.ResetPasswordRequest) (*params.ResetPasswordResponse, error) {
+	logger.Tracef("ResetPassword %#v", r)
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return nil, translateStoreError(err)
+	}
+	idpName, _ := id.ProviderID.Split()
+	for _, ip := range h.params.IdentityProviders {
+		if ip.Name() != idpName {
+			continue
+		}
+		pr, ok := ip.(idp.PasswordResetter)
+		if !ok {
+			break
+		}
+		token, err := pr.ResetPassword(p.Context, &id)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		return &params.ResetPasswordResponse{
+			Token: token,
+			URL:   idputil.LocationURL(h.params.Location, "/login/"+idpName+"/reset-password"),
+		}, nil
+	}
+	return nil, errgo.WithCausef(nil, params.ErrBadRequest, "identity provider for user %q does not support password reset", r.Username)
+}
+
+// ExpirePassword requires the given user to choose a new password the
+// next time they log in. The user's identity provider must support
+// password expiry.
+func (h *handler) ExpirePassword(p httprequest.Params, r *params.ExpirePasswordRequest) error {
+	logger.Tracef("ExpirePassword %#v", r)
+	id := store.Identity{
+		Username: string(r.Username),
+	}
+	if err := h.params.Store.Identity(p.Context, &id); err != nil {
+		return translateStoreError(err)
+	}
+	idpName, _ := id.ProviderID.Split()
+	for _, ip := range h.params.IdentityProviders {
+		if ip.Name() != idpName {
+			continue
+		}
+		pe, ok := ip.(idp.PasswordExpirer)
+		if !ok {
+			break
+		}
+		return errgo.Mask(pe.ExpirePassword(p.Context, &id), errgo.Any)
+	}
+	return errgo.WithCausef(nil, params.ErrBadRequest, "identity provider for user %q does not support password expiry", r.Username)
+}
+
+// GenerateBackupCodes creates a new set of single-use backup codes for
+// the given user, replacing any they already have. The user's identity
+// provider must support backup codes.
+func (h *handler) GenerateBackupCodes(p httprequest.Params, r *params.GenerateBackupCodesRequest) (*params.GenerateBackupCodesResponse, error) {
+	logger.Tracef("GenerateBackupCodes %#v", r)
+	id, bm, err := h.backupCodeManager(p.Context, r.Username)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	codes, err := bm.GenerateBackupCodes(p.Context, id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return &params.GenerateBackupCodesResponse{
+		Codes: codes,
+	}, nil
+}
+
+// BackupCodes returns the number of unused backup codes the given user
+// has. The user's identity provider must support backup codes.
+func (h *handler) BackupCodes(p httprequest.Params, r *params.BackupCodesRequest) (*params.BackupCodesResponse, error) {
+	logger.Tracef("BackupCodes %#v", r)
+	id, bm, err := h.backupCodeManager(p.Context, r.Username)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	n, err := bm.BackupCodesRemaining(p.Context, id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return &params.BackupCodesResponse{
+		Remaining: n,
+	}, nil
+}
+
+// backupCodeManager returns the identity of the given user along with
+// their identity provider, which must support backup codes.
+func (h *handler) backupCodeManager(ctx context.Context, username params.Username) (*store.Identity, idp.BackupCodeManager, error) {
+	id := store.Identity{
+		Username: string(username),
+	}
+	if err := h.params.Store.Identity(ctx, &id); err != nil {
+		return nil, nil, translateStoreError(err)
+	}
+	idpName, _ := id.ProviderID.Split()
+	for _, ip := range h.params.IdentityProviders {
+		if ip.Name() != idpName {
+			continue
+		}
+		bm, ok := ip.(idp.BackupCodeManager)
+		if !ok {
+			break
+		}
+		return &id, bm, nil
+	}
+	return nil, nil, errgo.WithCausef(nil, params.ErrBadRequest, "identity provider for user %q does not support backup codes", username)
+}
+
+// validRole matches a valid tenant-scoped role.
+var validRole = regexp.MustCompile(`^[a-zA-Z0-9_.\-]+:[a-zA-Z0-9_.\-]+$`)
+
 // UserToken returns a token, in the form of a macaroon, identifying
 // the user. This token can only be generated by an administrator.
 func (h *handler) UserToken(p httprequest.Params, r *params.UserTokenRequest) (*bakery.Macaroon, error) {
@@ -349,14 +719,23 @@ func (h *handler) UserToken(p httprequest.Params, r *params.UserTokenRequest) (*
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
+	version, err := h.params.MacaroonVersions().RequestVersion(p.Request)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	// The token is issued on behalf of the user, so it counts as
+	// the user authenticating now.
+	now := time.Now()
 	m, err := h.params.Oven.NewMacaroon(
 		p.Context,
-		httpbakery.RequestVersion(p.Request),
+		version,
 		[]checkers.Caveat{
 			candidclient.UserDeclaration(id.Id()),
-			checkers.TimeBeforeCaveat(time.Now().Add(h.params.APIMacaroonTimeout)),
+			candidclient.AuthTimeDeclaration(now),
+			checkers.TimeBeforeCaveat(now.Add(h.params.APIMacaroonTimeout)),
 		},
 		identchecker.LoginOp,
+		auth.AuthTimeOp(now),
 	)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot mint macaroon")
@@ -381,6 +760,184 @@ func (h *handler) VerifyToken(p httprequest.Params, r *params.VerifyTokenRequest
 	return resp, nil
 }
 
+// IntrospectToken returns information about the given token. A token
+// that is not a valid macaroon generated by this service is reported
+// as inactive rather than as an error.
+func (h *handler) IntrospectToken(p httprequest.Params, r *params.IntrospectTokenRequest) (*params.IntrospectTokenResponse, error) {
+	logger.Tracef("IntrospectToken %#v", r)
+	authInfo, err := h.params.Authorizer.Auth(p.Context, []macaroon.Slice{r.Macaroons}, identchecker.LoginOp)
+	if err != nil {
+		logger.Debugf("introspected token is not active: %s", err)
+		return &params.IntrospectTokenResponse{}, nil
+	}
+	id, ok := authInfo.Identity.(*auth.Identity)
+	if !ok {
+		return &params.IntrospectTokenResponse{}, nil
+	}
+	groups, err := id.Groups(p.Context)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := &params.IntrospectTokenResponse{
+		Active:   true,
+		Username: params.Username(id.Id()),
+		Groups:   groups,
+	}
+	resp.Expires, resp.Caveats = introspectCaveats(r.Macaroons)
+	resp.SessionID, _ = h.params.Authorizer.SessionID(p.Context, []macaroon.Slice{r.Macaroons})
+	logger.Tracef("IntrospectToken response %#v", resp)
+	return resp, nil
+}
+
+// introspectCaveats returns the earliest time-before caveat in ms, if
+// there is one, and the remaining first-party caveat conditions other
+// than declared caveats.
+func introspectCaveats(ms macaroon.Slice) (*time.Time, []string) {
+	var expires *time.Time
+	var caveats []string
+	for _, m := range ms {
+		for _, cav := range m.Caveats() {
+			if cav.Location != "" {
+				continue
+			}
+			cond, arg, err := checkers.ParseCaveat(string(cav.Id))
+			if err != nil {
+				continue
+			}
+			switch cond {
+			case checkers.CondDeclared:
+			case checkers.CondTimeBefore:
+				t, err := time.Parse(time.RFC3339Nano, arg)
+				if err != nil {
+					continue
+				}
+				if expires == nil || t.Before(*expires) {
+					expires = &t
+				}
+			default:
+				caveats = append(caveats, string(cav.Id))
+			}
+		}
+	}
+	return expires, caveats
+}
+
+// timeNow is used to get the current time, it is replaced in tests.
+var timeNow = time.Now
+
+// RenewToken renews the given token, which must be a valid macaroon
+// generated by this service, by returning a new macaroon for the same
+// user with a fresh expiry time. Callers may only renew their own
+// macaroons. Renewed macaroons never remain valid beyond the configured
+// maximum lifetime after the user originally authenticated, after which
+// the user must re-authenticate. Macaroons that do not record when the
+// user authenticated cannot be renewed.
+func (h *handler) RenewToken(p httprequest.Params, r *params.RenewTokenRequest) (*bakery.Macaroon, error) {
+	logger.Tracef("RenewToken %#v", r)
+	if h.params.MaxMacaroonLifetime == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "macaroon renewal not enabled")
+	}
+	authInfo, err := h.params.Authorizer.Auth(p.Context, []macaroon.Slice{r.Macaroons}, identchecker.LoginOp)
+	if err != nil {
+		return nil, errgo.WithCausef(err, params.ErrForbidden, `verification failure`)
+	}
+	if id := identityFromContext(p.Context); id == nil || id.Id() != authInfo.Identity.Id() {
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "cannot renew another user's macaroon")
+	}
+	authTime, ok := h.params.Authorizer.AuthTime(p.Context, authInfo.Macaroons)
+	if !ok {
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "macaroon has no authentication time")
+	}
+	now := timeNow()
+	maxExpiry := authTime.Add(h.params.MaxMacaroonLifetime)
+	if t, ok := declaredMaxExpiry(r.Macaroons); ok && t.Before(maxExpiry) {
+		maxExpiry = t
+	}
+	if !now.Before(maxExpiry) {
+		return nil, errgo.WithCausef(nil, params.ErrForbidden, "macaroon has reached its maximum lifetime")
+	}
+	expiry := now.Add(h.params.DischargeTokenTimeout)
+	if expiry.After(maxExpiry) {
+		expiry = maxExpiry
+	}
+	// Keep the time of the original authentication, rather than that
+	// of the renewal, so that the maximum lifetime is always counted
+	// from it.
+	caveats := []checkers.Caveat{
+		candidclient.UserDeclaration(authInfo.Identity.Id()),
+		candidclient.AuthTimeDeclaration(authTime),
+		checkers.DeclaredCaveat("max-expiry", maxExpiry.UTC().Format(time.RFC3339)),
+		checkers.TimeBeforeCaveat(expiry),
+	}
+	ops := []bakery.Op{
+		identchecker.LoginOp,
+		auth.AuthTimeOp(authTime),
+	}
+	if idp, ok := h.params.Authorizer.LoginIDP(p.Context, authInfo.Macaroons); ok {
+		caveats = append(caveats, candidclient.LoginIDPDeclaration(idp))
+		ops = append(ops, auth.LoginIDPOp(idp))
+	}
+	if sid, ok := h.params.Authorizer.SessionID(p.Context, authInfo.Macaroons); ok {
+		caveats = append(caveats, candidclient.SessionDeclaration(sid))
+		ops = append(ops, auth.SessionIDOp(sid))
+	}
+	version, err := h.params.MacaroonVersions().RequestVersion(p.Request)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	m, err := h.params.Oven.NewMacaroon(
+		p.Context,
+		version,
+		caveats,
+		ops...,
+	)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot mint macaroon")
+	}
+	logger.Tracef("RenewToken response %#v", m)
+	return m, nil
+}
+
+// declaredMaxExpiry returns the earliest maximum expiry time declared
+// in the given macaroons by a previous renewal. Every declaration is
+// considered, so that adding a conflicting declaration cannot be used
+// to extend the lifetime.
+func declaredMaxExpiry(ms macaroon.Slice) (time.Time, bool) {
+	var maxExpiry time.Time
+	found := false
+	for _, m := range ms {
+		for _, cav := range m.Caveats() {
+			if cav.Location != "" {
+				continue
+			}
+			cond, arg, err := checkers.ParseCaveat(string(cav.Id))
+			if err != nil || cond != checkers.CondDeclared {
+				continue
+			}
+			key, value := splitDeclared(arg)
+			if key != "max-expiry" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				continue
+			}
+			if !found || t.Before(maxExpiry) {
+				maxExpiry = t
+				found = true
+			}
+		}
+	}
+	return maxExpiry, found
+}
+
+func splitDeclared(arg string) (key, value string) {
+	if i := strings.Index(arg, " "); i >= 0 {
+		return arg[:i], arg[i+1:]
+	}
+	return arg, ""
+}
+
 // UserExtraInfo returns any stored extra-info for the given user.
 func (h *handler) UserExtraInfo(p httprequest.Params, r *params.UserExtraInfoRequest) (map[string]interface{}, error) {
 	logger.Tracef("UserExtraInfo %#v", r)
@@ -422,6 +979,9 @@ func (h *handler) SetUserExtraInfo(p httprequest.Params, r *params.SetUserExtraI
 		}
 		id.ExtraInfo[k] = []string{string(buf)}
 	}
+	if err := h.checkExtraInfoSchema(p.Context, id.Username, id.ExtraInfo); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrNotFound))
+	}
 	err := h.params.Store.UpdateIdentity(p.Context, &id, store.Update{store.ExtraInfo: store.Set})
 	if err != nil {
 		return translateStoreError(err)
@@ -469,6 +1029,9 @@ func (h *handler) SetUserExtraInfoItem(p httprequest.Params, r *params.SetUserEx
 		panic(err)
 	}
 	id.ExtraInfo = map[string][]string{r.Item: {string(buf)}}
+	if err := h.checkExtraInfoSchema(p.Context, id.Username, id.ExtraInfo); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrNotFound))
+	}
 	err = h.params.Store.UpdateIdentity(p.Context, &id, store.Update{store.ExtraInfo: store.Set})
 	if err != nil {
 		return translateStoreError(err)
@@ -477,6 +1040,48 @@ func (h *handler) SetUserExtraInfoItem(p httprequest.Params, r *params.SetUserEx
 	return nil
 }
 
+// checkExtraInfoSchema checks that writing the given extra-info
+// attributes to the user with the given username leaves the user's
+// attributes conforming to the configured attribute schema, if any. It
+// returns an error with a cause of params.ErrBadRequest if they would
+// not.
+//
+// Only the attributes being written are checked against their schema,
+// so that values written under an earlier version of the schema do not
+// stop other attributes being updated. The schema applies only to
+// attributes written through this API; attributes maintained by Candid
+// itself are written directly to the store and are never checked.
+func (h *handler) checkExtraInfoSchema(ctx context.Context, username string, attrs map[string][]string) error {
+	schema := h.params.IdentityAttributeSchema
+	if schema == nil {
+		return nil
+	}
+	for k, v := range attrs {
+		if err := schema.CheckAttribute(k, v); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+	}
+	// This API can add and replace attributes but never remove
+	// them, so a required attribute that the user already has
+	// cannot be removed by a concurrent write between reading the
+	// user here and writing the new attributes. Checking the
+	// required attributes against this read is therefore safe.
+	id := store.Identity{
+		Username: username,
+	}
+	if err := h.params.Store.Identity(ctx, &id); err != nil {
+		return translateStoreError(err)
+	}
+	all := make(map[string][]string, len(id.ExtraInfo)+len(attrs))
+	for k, v := range id.ExtraInfo {
+		all[k] = v
+	}
+	for k, v := range attrs {
+		all[k] = v
+	}
+	return errgo.Mask(schema.CheckRequired(all), errgo.Is(params.ErrBadRequest))
+}
+
 func checkExtraInfoKey(key string) error {
 	if strings.ContainsAny(key, "./$") {
 		return errgo.WithCausef(nil, params.ErrBadRequest, "%q bad key for extra-info", key)
@@ -517,11 +1122,20 @@ func (h *handler) userFromIdentity(ctx context.Context, id *auth.Identity) (*par
 		sshKeys = id.ExtraInfo["sshkeys"]
 	}
 	var lastLogin *time.Time
-	if !id.LastLogin.IsZero() {
+	var lastDischarge *time.Time
+	showTimes := true
+	if h.params.RestrictLastLogin {
+		// Only users with administrative read access may see
+		// when a user last logged in.
+		showTimes, err = h.params.Authorizer.Allowed(ctx, identityFromContext(ctx), auth.UserOp(params.Username(id.Username), auth.ActionReadAdmin))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if showTimes && !id.LastLogin.IsZero() {
 		lastLogin = &id.LastLogin
 	}
-	var lastDischarge *time.Time
-	if !id.LastDischarge.IsZero() {
+	if showTimes && !id.LastDischarge.IsZero() {
 		lastDischarge = &id.LastDischarge
 	}
 	return &params.User{
@@ -536,6 +1150,7 @@ func (h *handler) userFromIdentity(ctx context.Context, id *auth.Identity) (*par
 		SSHKeys:       sshKeys,
 		LastLogin:     lastLogin,
 		LastDischarge: lastDischarge,
+		Source:        id.Source,
 	}, nil
 }
 
@@ -578,6 +1193,8 @@ func translateStoreError(err error) error {
 		cause = params.ErrNotFound
 	case store.ErrDuplicateUsername:
 		cause = params.ErrAlreadyExists
+	case params.ErrBadRequest:
+		cause = params.ErrBadRequest
 	case nil:
 		return nil
 	}
@@ -596,9 +1213,13 @@ func (h *handler) DischargeTokenForUser(p httprequest.Params, req *params.Discha
 	if err != nil {
 		return params.DischargeTokenForUserResponse{}, errgo.NoteMask(err, "cannot get identity", errgo.Is(params.ErrNotFound))
 	}
+	version, err := h.params.MacaroonVersions().RequestVersion(p.Request)
+	if err != nil {
+		return params.DischargeTokenForUserResponse{}, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 	m, err := h.params.Oven.NewMacaroon(
 		p.Context,
-		httpbakery.RequestVersion(p.Request),
+		version,
 		[]checkers.Caveat{
 			checkers.TimeBeforeCaveat(time.Now().Add(h.params.DischargeTokenTimeout)),
 			candidclient.UserDeclaration(string(req.Username)),
@@ -619,8 +1240,8 @@ func (h *handler) DischargeTokenForUser(p httprequest.Params, req *params.Discha
 // checkAuthIdentityIsMemberOf checks that the given identity is a member
 // of all the given groups.
 func checkAuthIdentityIsMemberOf(ctx context.Context, identity *auth.Identity, groups []string) error {
-	// Note that the admin user is considered a member of all groups.
-	if identity.Id() == auth.AdminUsername {
+	// Note that the admin users are considered members of all groups.
+	if identity.IsAdmin() {
 		// Admin is a member of all groups by definition.
 		return nil
 	}
@@ -643,13 +1264,13 @@ func checkAuthIdentityIsMemberOf(ctx context.Context, identity *auth.Identity, g
 	return nil
 }
 
-func newAgentName() (string, error) {
-	buf := make([]byte, 16)
-	_, err := rand.Read(buf)
+// newAgentName returns a new random name for an agent.
+func (h *handler) newAgentName() (string, error) {
+	name, err := h.params.TokenGenerator.GenerateName()
 	if err != nil {
 		return "", errgo.Mask(err)
 	}
-	return fmt.Sprintf("a-%x", buf), nil
+	return "a-" + name, nil
 }
 
 // GetUserWithID returns the user information for the request user.
@@ -661,6 +1282,11 @@ func (h *handler) GetUserWithID(p httprequest.Params, req *params.GetUserWithIDR
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
+	if h.params.ConditionalUserRequests {
+		if err := checkNotModified(p, &id.Identity); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotModified))
+		}
+	}
 	u, err := h.userFromIdentity(p.Context, id)
 	if err != nil {
 		return nil, errgo.Mask(err)
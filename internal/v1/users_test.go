@@ -4,18 +4,27 @@
 package v1_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
 	"strings"
 	"testing"
 	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/frankban/quicktest/qtsuite"
+	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/bakery/identchecker"
 	"gopkg.in/macaroon-bakery.v2/httpbakery"
 	macaroon "gopkg.in/macaroon.v2"
 
+	"github.com/canonical/candid/attrschema"
+	"github.com/canonical/candid/audit"
 	"github.com/canonical/candid/candidclient"
 	"github.com/canonical/candid/idp"
 	"github.com/canonical/candid/idp/static"
@@ -41,6 +50,17 @@ type usersSuite struct {
 
 func (s *usersSuite) Init(c *qt.C) {
 	s.store = candidtest.NewStore()
+	s.startServer(c, nil)
+	s.interactor = httpbakery.WebBrowserInteractor{
+		OpenWebBrowser: candidtest.PasswordLogin(c, "bob", "bobpassword"),
+	}
+}
+
+// startServer starts a new server for the suite using the suite's
+// store. If f is not nil it is called to modify the server parameters
+// before the server is started, so that tests can enable optional
+// features.
+func (s *usersSuite) startServer(c *qt.C, f func(*identity.ServerParams)) {
 	sp := s.store.ServerParams()
 	// Ensure that there's an identity provider for the test identities
 	// we add so that group resolution on test identities works correctly.
@@ -52,17 +72,22 @@ func (s *usersSuite) Init(c *qt.C) {
 					Password: "bobpassword",
 					Groups:   []string{"g1", "g2", "testgroup"},
 				},
+				"carol": {
+					Password:   "carolpassword",
+					TOTPSecret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+				},
 			},
+			AllowPasswordChange: true,
 		}),
 	}
+	if f != nil {
+		f(&sp)
+	}
 	s.srv = candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
 		"discharger": discharger.NewAPIHandler,
 		"v1":         v1.NewAPIHandler,
 	})
 	s.adminClient = s.srv.AdminIdentityClient(false)
-	s.interactor = httpbakery.WebBrowserInteractor{
-		OpenWebBrowser: candidtest.PasswordLogin(c, "bob", "bobpassword"),
-	}
 }
 
 func (s *usersSuite) TestRoundTripUser(c *qt.C) {
@@ -396,6 +421,10 @@ var queryUserTests = []struct {
 	about:  "query email",
 	email:  "jbloggs2@example.com",
 	expect: []string{"jbloggs2"},
+}, {
+	about:  "query email normalized",
+	email:  " jbloggs2@Example.COM",
+	expect: []string{"jbloggs2"},
 }, {
 	about:  "query email not found",
 	email:  "not-there@example.com",
@@ -477,6 +506,45 @@ func (s *usersSuite) TestQueryUsers(c *qt.C) {
 	}
 }
 
+func (s *usersSuite) TestQueryUsersPaginated(c *qt.C) {
+	for _, u := range []string{"pa", "pb", "pc"} {
+		err := s.store.Store.UpdateIdentity(
+			s.srv.Ctx,
+			&store.Identity{
+				Username:   u,
+				ProviderID: store.MakeProviderIdentity("test", u),
+				Email:      "paged@example.com",
+			},
+			store.Update{
+				store.Username: store.Set,
+				store.Email:    store.Set,
+			},
+		)
+		c.Assert(err, qt.IsNil)
+	}
+	users, err := s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Email: "paged@example.com",
+		Limit: 2,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{"pa", "pb"})
+
+	users, err = s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Email:  "paged@example.com",
+		Offset: 2,
+		Limit:  2,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{"pc"})
+}
+
+func (s *usersSuite) TestQueryUsersNegativeLimit(c *qt.C) {
+	_, err := s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Limit: -1,
+	})
+	c.Assert(err, qt.ErrorMatches, `Get http://.*/v1/u?.*: offset and limit must not be negative`)
+}
+
 func (s *usersSuite) TestQueryUsersBadLastLogin(c *qt.C) {
 	_, err := s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
 		LastLoginSince: "yesterday",
@@ -491,6 +559,94 @@ func (s *usersSuite) TestQueryUsersBadLastDischarge(c *qt.C) {
 	c.Assert(err, qt.ErrorMatches, `Get http://.*/v1/u?.*last-discharge-since=yesterday.*: cannot unmarshal last-discharge-since: parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": cannot parse "yesterday" as "2006"`)
 }
 
+func (s *usersSuite) TestQueryUsersSearch(c *qt.C) {
+	for _, id := range []store.Identity{{
+		Username: "alice",
+		Name:     "Alice Smith",
+		Email:    "alice@example.com",
+	}, {
+		Username: "al",
+		Name:     "Zed",
+		Email:    "zed@example.com",
+	}, {
+		Username: "bob",
+		Name:     "Bob",
+		Email:    "al.bob@example.com",
+	}, {
+		Username: "carol",
+		Name:     "Alan Carol",
+		Email:    "carol@example.com",
+	}} {
+		id.ProviderID = store.MakeProviderIdentity("test", id.Username)
+		err := s.store.Store.UpdateIdentity(s.srv.Ctx, &id, store.Update{
+			store.Username: store.Set,
+			store.Name:     store.Set,
+			store.Email:    store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+
+	// The exact username match is first, followed by username,
+	// email and name prefix matches.
+	users, err := s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Query: "al",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{"al", "alice", "bob"})
+
+	// Matching is case sensitive.
+	users, err = s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Query: "Al",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{"alice", "carol"})
+
+	// Results can be paged through.
+	users, err = s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Query: "al",
+		Limit: 2,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{"al", "alice"})
+	users, err = s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Query:  "al",
+		Offset: 2,
+		Limit:  2,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{"bob"})
+
+	// Search is combined with other filters, and fields that are
+	// already filtered are not searched.
+	users, err = s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Query: "Bo",
+		Email: "al.bob@example.com",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{"bob"})
+	users, err = s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Query: "al",
+		Email: "al.bob@example.com",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{})
+
+	_, err = s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Query:  "al",
+		Offset: 1001,
+	})
+	c.Assert(err, qt.ErrorMatches, `Get http://.*/v1/u?.*: search offset must not be greater than 1000`)
+}
+
+func (s *usersSuite) TestQueryUsersSearchUnauthorized(c *qt.C) {
+	client := s.srv.IdentityClient(c, "a-bob@candid", "bob")
+	_, err := client.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Owner: "bob",
+		Query: "a",
+	})
+	c.Assert(err, qt.ErrorMatches, `Get http://.*/v1/u?.*: permission denied`)
+}
+
 func (s *usersSuite) TestQueryUsersUnauthorized(c *qt.C) {
 	client := s.srv.IdentityClient(c, "a-bob@candid", "bob")
 	_, err := client.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{})
@@ -542,6 +698,56 @@ func (s *usersSuite) TestQueryAgentUsers(c *qt.C) {
 	c.Assert(users, qt.DeepEquals, []string{"a-agent@candid"})
 }
 
+func (s *usersSuite) TestQueryUsersBySource(c *qt.C) {
+	err := s.store.Store.UpdateIdentity(
+		s.srv.Ctx,
+		&store.Identity{
+			Username:   "jbloggs2",
+			ProviderID: "test:http://example.com/jbloggs2",
+			Source:     "legacy",
+		},
+		store.Update{
+			store.Username: store.Set,
+			store.Source:   store.Set,
+		},
+	)
+	c.Assert(err, qt.IsNil)
+	users, err := s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Source: "legacy",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{"jbloggs2"})
+
+	// Identities created by the server are tagged with the identity
+	// provider that created them.
+	client, err := candidclient.New(candidclient.NewParams{
+		BaseURL: s.srv.URL,
+		Client:  s.srv.Client(s.interactor),
+	})
+	c.Assert(err, qt.IsNil)
+	resp, err := client.CreateAgent(s.srv.Ctx, &params.CreateAgentRequest{
+		CreateAgentBody: params.CreateAgentBody{
+			PublicKeys: []*bakery.PublicKey{&pk1},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	user, err := s.adminClient.User(s.srv.Ctx, &params.UserRequest{
+		Username: resp.Username,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(user.Source, qt.Equals, "idm")
+	users, err = s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Source: "idm",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.Contains, string(resp.Username))
+	users, err = s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Source: "legacy",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{"jbloggs2"})
+}
+
 func (s *usersSuite) TestQueryAgentUsersOwnerNotFound(c *qt.C) {
 	client := s.srv.IdentityClient(c, "a-jbloggs2@candid", "test")
 	users, err := client.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
@@ -647,6 +853,495 @@ func (s *usersSuite) TestSSHKeys(c *qt.C) {
 	})
 }
 
+func (s *usersSuite) TestResetPassword(c *qt.C) {
+	for _, id := range []store.Identity{{
+		Username:   "bob",
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	}, {
+		Username:   "alice",
+		ProviderID: store.MakeProviderIdentity("other", "alice"),
+	}} {
+		id := id
+		err := s.store.Store.UpdateIdentity(s.srv.Ctx, &id, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	resp, err := s.adminClient.ResetPassword(s.srv.Ctx, &params.ResetPasswordRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Token, qt.Not(qt.Equals), "")
+	c.Assert(resp.URL, qt.Equals, s.srv.URL+"/login/test/reset-password")
+
+	_, err = s.adminClient.ResetPassword(s.srv.Ctx, &params.ResetPasswordRequest{
+		Username: "alice",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+	c.Assert(err, qt.ErrorMatches, `Post http://.*/v1/u/alice/reset-password: identity provider for user "alice" does not support password reset`)
+
+	client := s.srv.IdentityClient(c, "a-bob@candid", "bob")
+	_, err = client.ResetPassword(s.srv.Ctx, &params.ResetPasswordRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.ErrorMatches, `Post http://.*/v1/u/bob/reset-password: permission denied`)
+}
+
+func (s *usersSuite) TestExpirePassword(c *qt.C) {
+	for _, id := range []store.Identity{{
+		Username:   "bob",
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	}, {
+		Username:   "alice",
+		ProviderID: store.MakeProviderIdentity("other", "alice"),
+	}} {
+		id := id
+		err := s.store.Store.UpdateIdentity(s.srv.Ctx, &id, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	err := s.adminClient.ExpirePassword(s.srv.Ctx, &params.ExpirePasswordRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+
+	err = s.adminClient.ExpirePassword(s.srv.Ctx, &params.ExpirePasswordRequest{
+		Username: "alice",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+	c.Assert(err, qt.ErrorMatches, `Post http://.*/v1/u/alice/expire-password: identity provider for user "alice" does not support password expiry`)
+
+	client := s.srv.IdentityClient(c, "a-bob@candid", "bob")
+	err = client.ExpirePassword(s.srv.Ctx, &params.ExpirePasswordRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.ErrorMatches, `Post http://.*/v1/u/bob/expire-password: permission denied`)
+}
+
+func (s *usersSuite) TestBackupCodes(c *qt.C) {
+	for _, id := range []store.Identity{{
+		Username:   "carol",
+		ProviderID: store.MakeProviderIdentity("test", "carol"),
+	}, {
+		Username:   "alice",
+		ProviderID: store.MakeProviderIdentity("other", "alice"),
+	}} {
+		id := id
+		err := s.store.Store.UpdateIdentity(s.srv.Ctx, &id, store.Update{
+			store.Username: store.Set,
+		})
+		c.Assert(err, qt.IsNil)
+	}
+	resp, err := s.adminClient.GenerateBackupCodes(s.srv.Ctx, &params.GenerateBackupCodesRequest{
+		Username: "carol",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Codes, qt.HasLen, 10)
+
+	// The user can see how many backup codes they have left, but
+	// cannot generate new ones.
+	client := s.srv.IdentityClient(c, "a-carol@candid", "carol")
+	remaining, err := client.BackupCodes(s.srv.Ctx, &params.BackupCodesRequest{
+		Username: "carol",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(remaining.Remaining, qt.Equals, 10)
+	_, err = client.GenerateBackupCodes(s.srv.Ctx, &params.GenerateBackupCodesRequest{
+		Username: "carol",
+	})
+	c.Assert(err, qt.ErrorMatches, `Post http://.*/v1/u/carol/backup-codes: permission denied`)
+
+	_, err = s.adminClient.GenerateBackupCodes(s.srv.Ctx, &params.GenerateBackupCodesRequest{
+		Username: "alice",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+	c.Assert(err, qt.ErrorMatches, `Post http://.*/v1/u/alice/backup-codes: identity provider for user "alice" does not support backup codes`)
+}
+
+func TestProvisionUserStrictExternalIDs(t *testing.T) {
+	c := qt.New(t)
+	sp := candidtest.NewStore().ServerParams()
+	sp.StrictExternalIDs = true
+	sp = candidtest.WithIDPs(sp, candidtest.StaticIDP("test", nil))
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"v1": v1.NewAPIHandler,
+	})
+	client := srv.AdminIdentityClient(false)
+	err := client.ProvisionUser(srv.Ctx, &params.ProvisionUserRequest{
+		Username: "jbloggs",
+		Body: params.ProvisionUserBody{
+			ExternalID: "test:jbloggs",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	for _, externalID := range []string{"other:jbloggs", "jbloggs", ":jbloggs"} {
+		err = client.ProvisionUser(srv.Ctx, &params.ProvisionUserRequest{
+			Username: "jbloggs2",
+			Body: params.ProvisionUserBody{
+				ExternalID: externalID,
+			},
+		})
+		c.Check(errgo.Cause(err), qt.Equals, params.ErrBadRequest, qt.Commentf("%s", externalID))
+		c.Check(err, qt.ErrorMatches, `Put http://.*/v1/u/jbloggs2/provision: external_id ".*" is not in the namespace of a configured identity provider`)
+	}
+}
+
+func TestProvisionUserDefaultGroups(t *testing.T) {
+	c := qt.New(t)
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.DefaultGroups = []string{"everyone"}
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"v1": v1.NewAPIHandler,
+	})
+	client := srv.AdminIdentityClient(false)
+	err := client.ProvisionUser(srv.Ctx, &params.ProvisionUserRequest{
+		Username: "jbloggs",
+		Body: params.ProvisionUserBody{
+			ExternalID: "test:jbloggs",
+			Groups:     []string{"g1"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	st.AssertUser(c, &store.Identity{
+		ProviderID: "test:jbloggs",
+		Username:   "jbloggs",
+		Groups:     []string{"g1", "everyone"},
+	})
+}
+
+func TestConditionalUserRequests(t *testing.T) {
+	c := qt.New(t)
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.ConditionalUserRequests = true
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"v1": v1.NewAPIHandler,
+	})
+	err := st.Store.UpdateIdentity(srv.Ctx, &store.Identity{
+		ProviderID: "test:jbloggs",
+		Username:   "jbloggs",
+		Name:       "Joe Bloggs",
+	}, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	client := srv.AdminClient()
+	get := func(header, value string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+"/v1/u/jbloggs", nil)
+		c.Assert(err, qt.IsNil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := client.Do(req)
+		c.Assert(err, qt.IsNil)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("", "")
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	etag := resp.Header.Get("ETag")
+	c.Assert(etag, qt.Not(qt.Equals), "")
+	lastModified := resp.Header.Get("Last-Modified")
+	c.Assert(lastModified, qt.Not(qt.Equals), "")
+
+	resp = get("If-None-Match", etag)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotModified)
+	c.Assert(resp.Header.Get("ETag"), qt.Equals, etag)
+
+	resp = get("If-Modified-Since", lastModified)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusNotModified)
+
+	err = st.Store.UpdateIdentity(srv.Ctx, &store.Identity{
+		Username: "jbloggs",
+		Name:     "Joe Bloggs Jr",
+	}, store.Update{
+		store.Name: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	resp = get("If-None-Match", etag)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("ETag"), qt.Not(qt.Equals), etag)
+}
+
+func (s *usersSuite) TestSimulateLogin(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+		IDPGroups:  []string{"test"},
+	})
+	resp, err := s.adminClient.SimulateLogin(s.srv.Ctx, &params.SimulateLoginRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Simulated, qt.Equals, true)
+	c.Assert(resp.Username, qt.Equals, params.Username("jbloggs"))
+	c.Assert(resp.Groups, qt.DeepEquals, []string{"test"})
+	c.Assert(resp.Caveats, qt.HasLen, 2)
+	c.Assert(resp.Caveats[0], qt.Equals, "declared username jbloggs")
+	c.Assert(resp.Caveats[1], qt.Matches, `time-before .*`)
+
+	resp, err = s.adminClient.SimulateLogin(s.srv.Ctx, &params.SimulateLoginRequest{
+		Username: "jbloggs",
+		Body: params.SimulateLoginBody{
+			Condition: "is-authenticated-userid",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Caveats[0], qt.Equals, "declared userid http://example.com/jbloggs")
+
+	_, err = s.adminClient.SimulateLogin(s.srv.Ctx, &params.SimulateLoginRequest{
+		Username: "jbloggs",
+		Body: params.SimulateLoginBody{
+			Condition: "is-member-of",
+		},
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	_, err = s.adminClient.SimulateLogin(s.srv.Ctx, &params.SimulateLoginRequest{
+		Username: "not-there",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+
+	client := s.srv.IdentityClient(c, "a-bob@candid", "bob")
+	_, err = client.SimulateLogin(s.srv.Ctx, &params.SimulateLoginRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.ErrorMatches, `Post http://.*/v1/u/jbloggs/simulate-login: permission denied`)
+}
+
+func (s *usersSuite) TestIDPConfig(c *qt.C) {
+	resp, err := s.adminClient.IDPConfig(s.srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.IDPs, qt.HasLen, 1)
+	cfg := resp.IDPs[0]
+	c.Assert(cfg.Name, qt.Equals, "test")
+	c.Assert(cfg.Type, qt.Equals, "static")
+	c.Assert(cfg.Interactive, qt.Equals, true)
+	c.Assert(cfg.Params["allow-password-change"], qt.Equals, true)
+	c.Assert(cfg.Params["users"], qt.DeepEquals, map[string]interface{}{
+		"bob": map[string]interface{}{
+			"password": "REDACTED",
+			"name":     "",
+			"email":    "",
+			"groups":   []interface{}{"g1", "g2", "testgroup"},
+		},
+	})
+
+	client := s.srv.IdentityClient(c, "a-bob@candid", "bob")
+	_, err = client.IDPConfig(s.srv.Ctx, nil)
+	c.Assert(err, qt.ErrorMatches, `Get http://.*/v1/idps/config: permission denied`)
+}
+
+func (s *usersSuite) TestSetIDPEnabled(c *qt.C) {
+	client, err := candidclient.New(candidclient.NewParams{
+		BaseURL: s.srv.URL,
+		Client:  s.srv.Client(s.interactor),
+	})
+	c.Assert(err, qt.IsNil)
+	_, err = client.WhoAmI(s.srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+
+	resp, err := s.adminClient.ListIDPs(s.srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.IDPs, qt.DeepEquals, []params.IDPStatus{{
+		Name:        "test",
+		Description: "test",
+		Interactive: true,
+		Enabled:     true,
+	}})
+
+	err = s.adminClient.SetIDPEnabled(s.srv.Ctx, &params.SetIDPEnabledRequest{
+		IDP: "test",
+	})
+	c.Assert(err, qt.IsNil)
+	resp, err = s.adminClient.ListIDPs(s.srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.IDPs[0].Enabled, qt.Equals, false)
+
+	// New logins are rejected.
+	r := s.srv.Get(c, "/login/test/login")
+	defer r.Body.Close()
+	c.Assert(r.StatusCode, qt.Equals, http.StatusServiceUnavailable)
+
+	// Users that have already logged in are not affected.
+	_, err = client.WhoAmI(s.srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+
+	err = s.adminClient.SetIDPEnabled(s.srv.Ctx, &params.SetIDPEnabledRequest{
+		IDP:     "test",
+		Enabled: params.IDPEnabled{Enabled: true},
+	})
+	c.Assert(err, qt.IsNil)
+	resp, err = s.adminClient.ListIDPs(s.srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.IDPs[0].Enabled, qt.Equals, true)
+
+	err = s.adminClient.SetIDPEnabled(s.srv.Ctx, &params.SetIDPEnabledRequest{
+		IDP: "not-there",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrNotFound)
+
+	err = client.SetIDPEnabled(s.srv.Ctx, &params.SetIDPEnabledRequest{
+		IDP: "test",
+	})
+	c.Assert(err, qt.ErrorMatches, `Put http://.*/v1/idps/test/enabled: permission denied`)
+}
+
+func TestSetIDPEnabledAudited(t *testing.T) {
+	c := qt.New(t)
+	var buf bytes.Buffer
+	sp := candidtest.NewStore().ServerParams()
+	sp = candidtest.WithIDPs(sp, static.NewIdentityProvider(static.Params{Name: "test"}))
+	sp.AuditLogger = audit.NewJSONLogger(&buf, "")
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"v1": v1.NewAPIHandler,
+	})
+	client := srv.AdminIdentityClient(false)
+	err := client.SetIDPEnabled(srv.Ctx, &params.SetIDPEnabledRequest{
+		IDP: "test",
+	})
+	c.Assert(err, qt.IsNil)
+	err = client.SetIDPEnabled(srv.Ctx, &params.SetIDPEnabledRequest{
+		IDP:     "test",
+		Enabled: params.IDPEnabled{Enabled: true},
+	})
+	c.Assert(err, qt.IsNil)
+
+	var events []audit.Event
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e audit.Event
+		err := dec.Decode(&e)
+		c.Assert(err, qt.IsNil)
+		c.Assert(e.Time.IsZero(), qt.Equals, false)
+		e.Time = time.Time{}
+		c.Assert(e.ClientIP, qt.Not(qt.Equals), "")
+		e.ClientIP = ""
+		events = append(events, e)
+	}
+	c.Assert(events, qt.DeepEquals, []audit.Event{{
+		Action:   audit.IDPDisabled,
+		Outcome:  audit.Success,
+		Username: auth.AdminUsername,
+		IDP:      "test",
+	}, {
+		Action:   audit.IDPEnabled,
+		Outcome:  audit.Success,
+		Username: auth.AdminUsername,
+		IDP:      "test",
+	}})
+}
+
+func (s *usersSuite) TestProvisionUser(c *qt.C) {
+	err := s.adminClient.ProvisionUser(s.srv.Ctx, &params.ProvisionUserRequest{
+		Username: "jbloggs",
+		Body: params.ProvisionUserBody{
+			ExternalID: "other:jbloggs",
+			Groups:     []string{"g1"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	groups, err := s.adminClient.UserGroups(s.srv.Ctx, &params.UserGroupsRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1"})
+
+	// The same external ID cannot be provisioned twice.
+	err = s.adminClient.ProvisionUser(s.srv.Ctx, &params.ProvisionUserRequest{
+		Username: "jbloggs2",
+		Body: params.ProvisionUserBody{
+			ExternalID: "other:jbloggs",
+		},
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrAlreadyExists)
+
+	// Nor can the same username.
+	err = s.adminClient.ProvisionUser(s.srv.Ctx, &params.ProvisionUserRequest{
+		Username: "jbloggs",
+		Body: params.ProvisionUserBody{
+			ExternalID: "other:jbloggs2",
+		},
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrAlreadyExists)
+
+	// An external ID is required.
+	err = s.adminClient.ProvisionUser(s.srv.Ctx, &params.ProvisionUserRequest{
+		Username: "jbloggs3",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+}
+
+func (s *usersSuite) TestUserRoles(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+
+	roles, err := s.adminClient.UserRoles(s.srv.Ctx, &params.UserRolesRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(roles.Roles, qt.IsNil)
+
+	err = s.adminClient.SetUserRoles(s.srv.Ctx, &params.SetUserRolesRequest{
+		Username: "jbloggs",
+		Roles: params.SetRolesBody{
+			Roles: []string{"tenantA:admin", "tenantB:viewer"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	roles, err = s.adminClient.UserRoles(s.srv.Ctx, &params.UserRolesRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(roles.Roles, qt.DeepEquals, []string{"tenantA:admin", "tenantB:viewer"})
+
+	// Roles are not reported as extra-info.
+	extraInfo, err := s.adminClient.UserExtraInfo(s.srv.Ctx, &params.UserExtraInfoRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(extraInfo, qt.HasLen, 0)
+
+	// Setting replaces the existing roles.
+	err = s.adminClient.SetUserRoles(s.srv.Ctx, &params.SetUserRolesRequest{
+		Username: "jbloggs",
+		Roles: params.SetRolesBody{
+			Roles: []string{"tenantC:viewer"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	roles, err = s.adminClient.UserRoles(s.srv.Ctx, &params.UserRolesRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(roles.Roles, qt.DeepEquals, []string{"tenantC:viewer"})
+}
+
+func (s *usersSuite) TestSetUserRolesInvalid(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	for _, role := range []string{"admin", "tenantA:", ":admin", "tenantA:admin,tenantB:viewer", "tenant=A:admin"} {
+		err := s.adminClient.SetUserRoles(s.srv.Ctx, &params.SetUserRolesRequest{
+			Username: "jbloggs",
+			Roles: params.SetRolesBody{
+				Roles: []string{role},
+			},
+		})
+		c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+		c.Assert(err, qt.ErrorMatches, `Put http://.*/v1/u/jbloggs/roles: invalid role ".*", expected tenant:role`)
+	}
+}
+
 func (s *usersSuite) TestVerifyUserToken(c *qt.C) {
 	s.addUser(c, params.User{
 		Username:   "jbloggs",
@@ -679,6 +1374,51 @@ func (s *usersSuite) TestVerifyUserToken(c *qt.C) {
 	c.Assert(err, qt.ErrorMatches, `Post .*/v1/verify: verification failure: macaroon discharge required: authentication required`)
 }
 
+func (s *usersSuite) TestIntrospectMacaroon(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+		IDPGroups: []string{
+			"test",
+		},
+	})
+	m, err := s.adminClient.UserToken(s.srv.Ctx, &params.UserTokenRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+
+	// The introspection request is authenticated as a service agent.
+	client := s.srv.IdentityClient(c, "testagent@candid", "testgroup")
+	resp, err := client.IntrospectMacaroon(s.srv.Ctx, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp.Active, qt.Equals, true)
+	c.Assert(resp.Username, qt.Equals, params.Username("jbloggs"))
+	c.Assert(resp.Groups, qt.DeepEquals, []string{"test"})
+	c.Assert(resp.Expires, qt.Not(qt.IsNil))
+	c.Assert(resp.Caveats, qt.HasLen, 0)
+
+	badm, err := macaroon.New([]byte{}, []byte("no such macaroon"), "loc", macaroon.LatestVersion)
+	c.Assert(err, qt.IsNil)
+	resp, err = client.IntrospectMacaroon(s.srv.Ctx, macaroon.Slice{badm})
+	c.Assert(err, qt.IsNil)
+	c.Assert(resp, qt.DeepEquals, &params.IntrospectTokenResponse{})
+}
+
+func (s *usersSuite) TestRenewMacaroonNotEnabled(c *qt.C) {
+	s.addUser(c, params.User{
+		Username:   "jbloggs",
+		ExternalID: "http://example.com/jbloggs",
+	})
+	m, err := s.adminClient.UserToken(s.srv.Ctx, &params.UserTokenRequest{
+		Username: "jbloggs",
+	})
+	c.Assert(err, qt.IsNil)
+	ms := macaroon.Slice{m.M()}
+	ms1, err := s.adminClient.RenewMacaroon(s.srv.Ctx, ms)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ms1, qt.DeepEquals, ms)
+}
+
 func (s *usersSuite) TestUserTokenNotFound(c *qt.C) {
 	_, err := s.adminClient.UserToken(s.srv.Ctx, &params.UserTokenRequest{
 		Username: "not-there",
@@ -766,6 +1506,31 @@ func (s *usersSuite) TestUserGroups(c *qt.C) {
 	}
 }
 
+func (s *usersSuite) TestUserGroupsStored(c *qt.C) {
+	err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"stored"},
+	}, store.Update{
+		store.Username: store.Set,
+		store.Groups:   store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	groups, err := s.adminClient.UserGroups(s.srv.Ctx, &params.UserGroupsRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"g1", "g2", "stored", "testgroup"})
+
+	groups, err = s.adminClient.UserGroups(s.srv.Ctx, &params.UserGroupsRequest{
+		Username: "bob",
+		Stored:   true,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []string{"stored"})
+}
+
 func (s *usersSuite) TestSetUserGroups(c *qt.C) {
 	s.addUser(c, params.User{
 		Username:   "jbloggs",
@@ -1189,3 +1954,394 @@ func (s *usersSuite) TestGetUserIDGroups(c *qt.C) {
 		})
 	}
 }
+
+func (s *usersSuite) TestRestrictLastLogin(c *qt.C) {
+	s.startServer(c, func(sp *identity.ServerParams) {
+		sp.RestrictLastLogin = true
+	})
+	client := s.srv.IdentityClient(c, "a-agent@candid")
+	err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+		Username:  "a-agent@candid",
+		LastLogin: time.Now(),
+	}, store.Update{
+		store.LastLogin: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// A user reading their own details does not see the login time.
+	u, err := client.User(s.srv.Ctx, &params.UserRequest{
+		Username: "a-agent@candid",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.LastLogin, qt.IsNil)
+
+	// An administrator does.
+	u, err = s.adminClient.User(s.srv.Ctx, &params.UserRequest{
+		Username: "a-agent@candid",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(u.LastLogin, qt.Not(qt.IsNil))
+}
+
+func (s *usersSuite) TestExtraInfoSchema(c *qt.C) {
+	schema, err := attrschema.New(attrschema.Config{
+		Version: 3,
+		Attributes: map[string]attrschema.Attribute{
+			"department": {
+				Type:     "string",
+				Required: true,
+				Values:   []string{"engineering", "sales"},
+			},
+			"employee-number": {
+				Type: "integer",
+			},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	s.startServer(c, func(sp *identity.ServerParams) {
+		sp.IdentityAttributeSchema = schema
+	})
+	for _, name := range []string{"bob", "alice"} {
+		err := s.store.Store.UpdateIdentity(s.srv.Ctx, &store.Identity{
+			ProviderID: store.MakeProviderIdentity("test", name),
+			Username:   name,
+		}, store.Update{store.Username: store.Set})
+		c.Assert(err, qt.IsNil)
+	}
+
+	// A conforming write succeeds.
+	err = s.adminClient.SetUserExtraInfo(s.srv.Ctx, &params.SetUserExtraInfoRequest{
+		Username: "bob",
+		ExtraInfo: map[string]interface{}{
+			"department":      "engineering",
+			"employee-number": 1234,
+			"nickname":        map[string]interface{}{"any": "thing"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	// A non-conforming write is rejected and names the attribute.
+	err = s.adminClient.SetUserExtraInfo(s.srv.Ctx, &params.SetUserExtraInfoRequest{
+		Username: "bob",
+		ExtraInfo: map[string]interface{}{
+			"department": "marketing",
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `.*invalid attribute "department" \(schema version 3\): value "marketing" is not allowed`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	err = s.adminClient.SetUserExtraInfoItem(s.srv.Ctx, &params.SetUserExtraInfoItemRequest{
+		Username: "bob",
+		Item:     "employee-number",
+		Data:     "1234",
+	})
+	c.Assert(err, qt.ErrorMatches, `.*invalid attribute "employee-number" \(schema version 3\): value must be an integer`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	ei, err := s.adminClient.UserExtraInfo(s.srv.Ctx, &params.UserExtraInfoRequest{
+		Username: "bob",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ei["department"], qt.Equals, "engineering")
+	c.Assert(ei["employee-number"], qt.Equals, 1234.0)
+
+	// Other attributes can be written once the required ones are
+	// present.
+	err = s.adminClient.SetUserExtraInfoItem(s.srv.Ctx, &params.SetUserExtraInfoItemRequest{
+		Username: "bob",
+		Item:     "employee-number",
+		Data:     99,
+	})
+	c.Assert(err, qt.IsNil)
+
+	// The first attributes written to a user must include the
+	// required ones.
+	err = s.adminClient.SetUserExtraInfo(s.srv.Ctx, &params.SetUserExtraInfoRequest{
+		Username: "alice",
+		ExtraInfo: map[string]interface{}{
+			"employee-number": 99,
+		},
+	})
+	c.Assert(err, qt.ErrorMatches, `.*invalid attribute "department" \(schema version 3\): attribute is required`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrBadRequest)
+
+	// Attributes maintained by Candid itself are not checked.
+	err = s.adminClient.PutSSHKeys(s.srv.Ctx, &params.PutSSHKeysRequest{
+		Username: "alice",
+		Body: params.PutSSHKeysBody{
+			SSHKeys: []string{"ssh-rsa AAAA alice@example.com"},
+		},
+	})
+	c.Assert(err, qt.IsNil)
+}
+
+func TestAdminAllowedNetworks(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	newServer := func(allow string) *candidtest.Server {
+		_, n, err := net.ParseCIDR(allow)
+		c.Assert(err, qt.IsNil)
+		_, proxy, err := net.ParseCIDR("127.0.0.1/32")
+		c.Assert(err, qt.IsNil)
+		sp := candidtest.NewStore().ServerParams()
+		sp.AdminAllowedNetworks = []*net.IPNet{n}
+		sp.TrustedProxies = []*net.IPNet{proxy}
+		return candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+			"discharger": discharger.NewAPIHandler,
+			"v1":         v1.NewAPIHandler,
+		})
+	}
+
+	// Admin requests from the allowed network succeed.
+	srv := newServer("127.0.0.0/8")
+	_, err := srv.AdminIdentityClient(false).UserExtraInfo(srv.Ctx, &params.UserExtraInfoRequest{
+		Username: "admin@candid",
+	})
+	c.Assert(err, qt.IsNil)
+
+	// Admin requests from outside the allowed network are rejected,
+	// even with admin credentials.
+	srv = newServer("10.0.0.0/8")
+	_, err = srv.AdminIdentityClient(false).UserExtraInfo(srv.Ctx, &params.UserExtraInfoRequest{
+		Username: "admin@candid",
+	})
+	c.Assert(err, qt.ErrorMatches, `.*access not allowed from 127\.0\.0\.1`)
+
+	// Non-admin requests are not affected.
+	_, err = srv.AdminIdentityClient(false).WhoAmI(srv.Ctx, nil)
+	c.Assert(err, qt.IsNil)
+
+	// The client address is taken from trusted proxies and checked
+	// before any credentials.
+	req, err := http.NewRequest("GET", "/v1/u/admin@candid/extra-info", nil)
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("X-Forwarded-For", "10.1.2.3")
+	req.Header.Set(httpbakery.BakeryProtocolHeader, "1")
+	resp := srv.Do(c, req)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+	req, err = http.NewRequest("GET", "/v1/u/admin@candid/extra-info", nil)
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	resp = srv.Do(c, req)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusForbidden)
+}
+
+func TestRenewMacaroonKeepsAuthTime(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.MaxMacaroonLifetime = time.Hour
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	client := srv.IdentityClient(c, "bob@candid")
+
+	// Mint an identity macaroon as if the user had logged in an
+	// hour ago.
+	oven := bakery.NewOven(bakery.OvenParams{
+		Namespace: auth.Namespace,
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return st.BakeryRootKeyStore
+		},
+	})
+	authTime := time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	m, err := oven.NewMacaroon(srv.Ctx, bakery.LatestVersion, []checkers.Caveat{
+		candidclient.UserDeclaration("bob@candid"),
+		candidclient.AuthTimeDeclaration(authTime),
+		checkers.TimeBeforeCaveat(time.Now().Add(time.Minute)),
+	}, identchecker.LoginOp, auth.AuthTimeOp(authTime))
+	c.Assert(err, qt.IsNil)
+
+	ms, err := client.RenewMacaroon(srv.Ctx, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+	declared, err := srv.AdminIdentityClient(false).VerifyToken(srv.Ctx, &params.VerifyTokenRequest{
+		Macaroons: ms,
+	})
+	c.Assert(err, qt.IsNil)
+	t1, ok := candidclient.DeclaredAuthTime(declared)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(t1.Equal(authTime), qt.Equals, true)
+}
+
+func TestRenewMacaroon(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	now := time.Now()
+	c.Patch(v1.TimeNow, func() time.Time { return now })
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.MaxMacaroonLifetime = time.Hour
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	adminClient := srv.AdminIdentityClient(false)
+	client := srv.IdentityClient(c, "bob@candid")
+	m, err := adminClient.UserToken(srv.Ctx, &params.UserTokenRequest{
+		Username: "bob@candid",
+	})
+	c.Assert(err, qt.IsNil)
+
+	ms, err := client.RenewMacaroon(srv.Ctx, macaroon.Slice{m.M()})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ms, qt.HasLen, 1)
+	c.Assert(ms[0].Signature(), qt.Not(qt.DeepEquals), m.M().Signature())
+	declared, err := adminClient.VerifyToken(srv.Ctx, &params.VerifyTokenRequest{
+		Macaroons: ms,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(declared["username"], qt.Equals, "bob@candid")
+
+	// Renewing the renewed macaroon does not extend it beyond the
+	// maximum lifetime.
+	ms, err = client.RenewMacaroon(srv.Ctx, ms)
+	c.Assert(err, qt.IsNil)
+	now = now.Add(time.Hour)
+	_, err = client.RenewMacaroon(srv.Ctx, ms)
+	c.Assert(errgo.Cause(err), qt.Equals, candidclient.ErrReauthenticationRequired)
+}
+
+func TestRenewMacaroonCappedByAuthTime(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	st := candidtest.NewStore()
+	sp := st.ServerParams()
+	sp.MaxMacaroonLifetime = time.Hour
+	sp.DischargeTokenTimeout = 24 * time.Hour
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	client := srv.IdentityClient(c, "bob@candid")
+	oven := bakery.NewOven(bakery.OvenParams{
+		Namespace: auth.Namespace,
+		RootKeyStoreForOps: func([]bakery.Op) bakery.RootKeyStore {
+			return st.BakeryRootKeyStore
+		},
+	})
+
+	// Mint an identity macaroon as if the user had logged in almost
+	// the maximum lifetime ago.
+	authTime := time.Now().Add(-55 * time.Minute).Truncate(time.Second).UTC()
+	m, err := oven.NewMacaroon(srv.Ctx, bakery.LatestVersion, []checkers.Caveat{
+		candidclient.UserDeclaration("bob@candid"),
+		candidclient.AuthTimeDeclaration(authTime),
+		checkers.TimeBeforeCaveat(time.Now().Add(time.Minute)),
+	}, identchecker.LoginOp, auth.AuthTimeOp(authTime))
+	c.Assert(err, qt.IsNil)
+
+	// However often it is renewed, the macaroon does not outlive
+	// the maximum lifetime counted from the original login.
+	ms := macaroon.Slice{m.M()}
+	for i := 0; i < 3; i++ {
+		ms, err = client.RenewMacaroon(srv.Ctx, ms)
+		c.Assert(err, qt.IsNil)
+		expires, ok := checkers.MacaroonsExpiryTime(auth.Namespace, ms)
+		c.Assert(ok, qt.Equals, true)
+		c.Assert(expires.After(authTime.Add(time.Hour)), qt.Equals, false)
+	}
+
+	// A macaroon that does not record when the user authenticated
+	// cannot be renewed.
+	m, err = oven.NewMacaroon(srv.Ctx, bakery.LatestVersion, []checkers.Caveat{
+		candidclient.UserDeclaration("bob@candid"),
+		checkers.TimeBeforeCaveat(time.Now().Add(time.Minute)),
+	}, identchecker.LoginOp)
+	c.Assert(err, qt.IsNil)
+	_, err = client.RenewMacaroon(srv.Ctx, macaroon.Slice{m.M()})
+	c.Assert(errgo.Cause(err), qt.Equals, candidclient.ErrReauthenticationRequired)
+}
+
+func TestRenewMacaroonOtherUser(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	sp := candidtest.NewStore().ServerParams()
+	sp.MaxMacaroonLifetime = time.Hour
+	srv := candidtest.NewServer(c, sp, map[string]identity.NewAPIHandlerFunc{
+		"discharger": discharger.NewAPIHandler,
+		"v1":         v1.NewAPIHandler,
+	})
+	adminClient := srv.AdminIdentityClient(false)
+	srv.CreateAgent(c, "bob@candid")
+	m, err := adminClient.UserToken(srv.Ctx, &params.UserTokenRequest{
+		Username: "bob@candid",
+	})
+	c.Assert(err, qt.IsNil)
+
+	// Even an admin cannot renew a macaroon belonging to another
+	// user.
+	_, err = adminClient.RenewMacaroon(srv.Ctx, macaroon.Slice{m.M()})
+	c.Assert(errgo.Cause(err), qt.Equals, candidclient.ErrReauthenticationRequired)
+}
+
+func (s *usersSuite) TestIdempotencyKey(c *qt.C) {
+	s.startServer(c, func(sp *identity.ServerParams) {
+		sp.IdempotencyKeyTTL = time.Hour
+	})
+	client := s.srv.AdminClient()
+	createAgent := func(key, name string) *http.Response {
+		body, err := json.Marshal(params.CreateAgentBody{
+			FullName:   name,
+			PublicKeys: []*bakery.PublicKey{&pk1},
+		})
+		c.Assert(err, qt.IsNil)
+		req, err := http.NewRequest("POST", s.srv.URL+"/v1/u", bytes.NewReader(body))
+		c.Assert(err, qt.IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := client.Do(req)
+		c.Assert(err, qt.IsNil)
+		return resp
+	}
+	readAgent := func(resp *http.Response) params.CreateAgentResponse {
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+		var r params.CreateAgentResponse
+		err := json.NewDecoder(resp.Body).Decode(&r)
+		c.Assert(err, qt.IsNil)
+		return r
+	}
+
+	resp := createAgent("key1", "agent 1")
+	c.Assert(resp.Header.Get("Idempotent-Replayed"), qt.Equals, "")
+	agent1 := readAgent(resp)
+
+	// A retried request returns the original result without creating
+	// another agent.
+	resp = createAgent("key1", "agent 1")
+	c.Assert(resp.Header.Get("Idempotent-Replayed"), qt.Equals, "true")
+	c.Assert(readAgent(resp), qt.DeepEquals, agent1)
+	users, err := s.adminClient.QueryUsers(s.srv.Ctx, &params.QueryUsersRequest{
+		Owner: "admin@candid",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(users, qt.DeepEquals, []string{string(agent1.Username)})
+
+	// A different request with the same key is a conflict.
+	resp = createAgent("key1", "agent 2")
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusConflict)
+
+	// A different key creates a new agent.
+	agent2 := readAgent(createAgent("key2", "agent 2"))
+	c.Assert(agent2.Username, qt.Not(qt.Equals), agent1.Username)
+
+	// A failed request is not stored, so a retry is processed again
+	// rather than being reported as a conflict.
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", s.srv.URL+"/v1/u", strings.NewReader("{"))
+		c.Assert(err, qt.IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "key3")
+		resp, err := client.Do(req)
+		c.Assert(err, qt.IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+		c.Assert(resp.Header.Get("Idempotent-Replayed"), qt.Equals, "")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package loginhours provides policies that restrict the times at which
+// users may log in.
+package loginhours
+
+import (
+	"strings"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+// A Rule holds the configuration of the times at which a set of users
+// may log in. A rule applies to a user that is a member of Group, or
+// whose identity attribute Attribute has the value Value.
+type Rule struct {
+	// Group holds the group whose members the rule applies to.
+	Group string `yaml:"group"`
+
+	// Attribute and Value hold an identity attribute value that
+	// users the rule applies to must have. The attributes are the
+	// same as those supported by store.GroupRule.
+	Attribute string `yaml:"attribute"`
+	Value     string `yaml:"value"`
+
+	// Days holds the days of the week on which login is allowed, for
+	// example "monday" or "mon". If this is empty login is allowed
+	// every day.
+	Days []string `yaml:"days"`
+
+	// Start and End hold the time of day, in the form "15:04", between
+	// which login is allowed. If End is not after Start the allowed
+	// period ends on the following day.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+
+	// Timezone holds the name of the timezone in which Days, Start
+	// and End are interpreted, for example "Europe/London". If this
+	// is empty UTC is used.
+	Timezone string `yaml:"timezone"`
+}
+
+// A Policy holds a set of rules restricting when users may log in.
+type Policy struct {
+	rules []rule
+}
+
+// rule holds a parsed Rule.
+type rule struct {
+	group     string
+	attribute string
+	value     string
+	days      [7]bool
+	start     time.Duration
+	end       time.Duration
+	loc       *time.Location
+}
+
+// NewPolicy returns a policy containing the given rules.
+func NewPolicy(rs []Rule) (*Policy, error) {
+	p := &Policy{
+		rules: make([]rule, len(rs)),
+	}
+	for i, r := range rs {
+		if err := p.rules[i].parse(r); err != nil {
+			return nil, errgo.Notef(err, "invalid login hours rule %d", i)
+		}
+	}
+	return p, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+func (r *rule) parse(cr Rule) error {
+	switch {
+	case cr.Group == "" && cr.Attribute == "":
+		return errgo.Newf("one of group or attribute must be specified")
+	case cr.Group != "" && cr.Attribute != "":
+		return errgo.Newf("only one of group or attribute may be specified")
+	case cr.Attribute != "" && !store.ValidAttribute(cr.Attribute):
+		return errgo.Newf("invalid attribute %q", cr.Attribute)
+	}
+	r.group = cr.Group
+	r.attribute = cr.Attribute
+	r.value = cr.Value
+	if len(cr.Days) == 0 {
+		for i := range r.days {
+			r.days[i] = true
+		}
+	}
+	for _, d := range cr.Days {
+		day, ok := parseWeekday(d)
+		if !ok {
+			return errgo.Newf("invalid day %q", d)
+		}
+		r.days[day] = true
+	}
+	var err error
+	r.start, err = parseTimeOfDay(cr.Start)
+	if err != nil {
+		return errgo.Newf("invalid start time %q", cr.Start)
+	}
+	r.end, err = parseTimeOfDay(cr.End)
+	if err != nil {
+		return errgo.Newf("invalid end time %q", cr.End)
+	}
+	if r.end <= r.start {
+		r.end += 24 * time.Hour
+	}
+	r.loc, err = time.LoadLocation(cr.Timezone)
+	if err != nil {
+		return errgo.Notef(err, "invalid timezone")
+	}
+	return nil
+}
+
+// parseWeekday parses either the full or abbreviated name of a day of
+// the week.
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(s)
+	for name, day := range weekdays {
+		if s == name || s == name[:3] {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// parseTimeOfDay parses a time of day in the form "15:04" and returns
+// it as the time since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// appliesTo reports whether the rule applies to the given identity,
+// which is a member of the given groups.
+func (r *rule) appliesTo(id *store.Identity, groups []string) bool {
+	if r.attribute != "" {
+		return store.MatchAttribute(id, r.attribute, r.value)
+	}
+	for _, g := range groups {
+		if g == r.group {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the rule allows login at the given time. The
+// time is compared with the rule using the wall clock time in the
+// rule's timezone, so that the allowed period starts and ends at the
+// same local times on days when daylight saving time begins or ends.
+func (r *rule) allows(t time.Time) bool {
+	lt := t.In(r.loc)
+	tod := time.Duration(lt.Hour())*time.Hour +
+		time.Duration(lt.Minute())*time.Minute +
+		time.Duration(lt.Second())*time.Second +
+		time.Duration(lt.Nanosecond())
+	// An allowed period that started the previous day may still be
+	// running.
+	for i := 0; i < 2; i++ {
+		day := time.Date(lt.Year(), lt.Month(), lt.Day()-i, 12, 0, 0, 0, r.loc)
+		if !r.days[day.Weekday()] {
+			continue
+		}
+		if wall := tod + time.Duration(i)*24*time.Hour; wall >= r.start && wall < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckLogin checks whether the given identity, which is a member of
+// the given groups, may log in at the given time. Users that no rule
+// applies to may always log in. Users that one or more rules apply to
+// may log in at any time allowed by any of those rules. If the login is
+// not allowed an error with a cause of params.ErrForbidden is
+// returned.
+func (p *Policy) CheckLogin(id *store.Identity, groups []string, t time.Time) error {
+	if p == nil {
+		return nil
+	}
+	restricted := false
+	for _, r := range p.rules {
+		if !r.appliesTo(id, groups) {
+			continue
+		}
+		if r.allows(t) {
+			return nil
+		}
+		restricted = true
+	}
+	if restricted {
+		return errgo.WithCausef(nil, params.ErrForbidden, "login not permitted at this time")
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package loginhours_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/loginhours"
+	"github.com/canonical/candid/params"
+	"github.com/canonical/candid/store"
+)
+
+func mustParseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+var checkLoginTests = []struct {
+	about       string
+	rules       []loginhours.Rule
+	identity    store.Identity
+	groups      []string
+	t           string
+	expectError string
+}{{
+	about: "no rules",
+	t:     "2020-06-10T02:30:00Z",
+}, {
+	about: "group rule does not apply",
+	rules: []loginhours.Rule{{
+		Group: "contractors",
+		Start: "09:00",
+		End:   "17:00",
+	}},
+	groups: []string{"staff"},
+	t:      "2020-06-10T02:30:00Z",
+}, {
+	about: "group rule inside window",
+	rules: []loginhours.Rule{{
+		Group: "contractors",
+		Start: "09:00",
+		End:   "17:00",
+	}},
+	groups: []string{"contractors"},
+	t:      "2020-06-10T09:00:00Z",
+}, {
+	about: "group rule outside window",
+	rules: []loginhours.Rule{{
+		Group: "contractors",
+		Start: "09:00",
+		End:   "17:00",
+	}},
+	groups:      []string{"contractors"},
+	t:           "2020-06-10T17:00:00Z",
+	expectError: `login not permitted at this time`,
+}, {
+	about: "attribute rule inside window",
+	rules: []loginhours.Rule{{
+		Attribute: "email-domain",
+		Value:     "example.com",
+		Start:     "09:00",
+		End:       "17:00",
+	}},
+	identity: store.Identity{Email: "bob@example.com"},
+	t:        "2020-06-10T12:00:00Z",
+}, {
+	about: "attribute rule outside window",
+	rules: []loginhours.Rule{{
+		Attribute: "email-domain",
+		Value:     "example.com",
+		Start:     "09:00",
+		End:       "17:00",
+	}},
+	identity:    store.Identity{Email: "bob@example.com"},
+	t:           "2020-06-10T20:00:00Z",
+	expectError: `login not permitted at this time`,
+}, {
+	about: "weekday rule on weekend",
+	rules: []loginhours.Rule{{
+		Group: "contractors",
+		Days:  []string{"mon", "tue", "wed", "thu", "fri"},
+		Start: "09:00",
+		End:   "17:00",
+	}},
+	groups: []string{"contractors"},
+	// 2020-06-13 is a Saturday.
+	t:           "2020-06-13T12:00:00Z",
+	expectError: `login not permitted at this time`,
+}, {
+	about: "window crossing midnight on following day",
+	rules: []loginhours.Rule{{
+		Group: "night-shift",
+		Days:  []string{"friday"},
+		Start: "22:00",
+		End:   "06:00",
+	}},
+	groups: []string{"night-shift"},
+	// 2020-06-13 is a Saturday.
+	t: "2020-06-13T03:00:00Z",
+}, {
+	about: "window crossing midnight not started",
+	rules: []loginhours.Rule{{
+		Group: "night-shift",
+		Days:  []string{"friday"},
+		Start: "22:00",
+		End:   "06:00",
+	}},
+	groups:      []string{"night-shift"},
+	t:           "2020-06-12T03:00:00Z",
+	expectError: `login not permitted at this time`,
+}, {
+	about: "window with timezone",
+	rules: []loginhours.Rule{{
+		Group:    "contractors",
+		Start:    "09:00",
+		End:      "17:00",
+		Timezone: "Europe/London",
+	}},
+	groups: []string{"contractors"},
+	// London is on BST (UTC+1) in June.
+	t:           "2020-06-10T16:30:00Z",
+	expectError: `login not permitted at this time`,
+}, {
+	about: "window with timezone on daylight saving start",
+	rules: []loginhours.Rule{{
+		Group:    "contractors",
+		Start:    "09:00",
+		End:      "17:00",
+		Timezone: "Europe/London",
+	}},
+	groups: []string{"contractors"},
+	// London changes from GMT to BST on 2020-03-29, so this is
+	// 09:30 local time.
+	t: "2020-03-29T08:30:00Z",
+}, {
+	about: "window with timezone on daylight saving start after end",
+	rules: []loginhours.Rule{{
+		Group:    "contractors",
+		Start:    "09:00",
+		End:      "17:00",
+		Timezone: "Europe/London",
+	}},
+	groups: []string{"contractors"},
+	// 17:30 BST.
+	t:           "2020-03-29T16:30:00Z",
+	expectError: `login not permitted at this time`,
+}, {
+	about: "window with timezone on daylight saving end",
+	rules: []loginhours.Rule{{
+		Group:    "contractors",
+		Start:    "09:00",
+		End:      "17:00",
+		Timezone: "Europe/London",
+	}},
+	groups: []string{"contractors"},
+	// London changes from BST to GMT on 2020-10-25, so this is
+	// 08:30 local time.
+	t:           "2020-10-25T08:30:00Z",
+	expectError: `login not permitted at this time`,
+}, {
+	about: "any applicable rule allows login",
+	rules: []loginhours.Rule{{
+		Group: "contractors",
+		Start: "09:00",
+		End:   "17:00",
+	}, {
+		Group: "on-call",
+		Start: "00:00",
+		End:   "00:00",
+	}},
+	groups: []string{"contractors", "on-call"},
+	t:      "2020-06-10T02:30:00Z",
+}}
+
+func TestCheckLogin(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range checkLoginTests {
+		c.Run(test.about, func(c *qt.C) {
+			p, err := loginhours.NewPolicy(test.rules)
+			c.Assert(err, qt.IsNil)
+			err = p.CheckLogin(&test.identity, test.groups, mustParseTime(test.t))
+			if test.expectError == "" {
+				c.Assert(err, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+			c.Assert(errgo.Cause(err), qt.Equals, params.ErrForbidden)
+		})
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	c := qt.New(t)
+	var p *loginhours.Policy
+	c.Assert(p.CheckLogin(&store.Identity{}, []string{"contractors"}, time.Now()), qt.IsNil)
+}
+
+var newPolicyErrorTests = []struct {
+	about       string
+	rule        loginhours.Rule
+	expectError string
+}{{
+	about:       "no group or attribute",
+	rule:        loginhours.Rule{Start: "09:00", End: "17:00"},
+	expectError: `invalid login hours rule 0: one of group or attribute must be specified`,
+}, {
+	about:       "group and attribute",
+	rule:        loginhours.Rule{Group: "g", Attribute: "email", Start: "09:00", End: "17:00"},
+	expectError: `invalid login hours rule 0: only one of group or attribute may be specified`,
+}, {
+	about:       "invalid attribute",
+	rule:        loginhours.Rule{Attribute: "shoe-size", Start: "09:00", End: "17:00"},
+	expectError: `invalid login hours rule 0: invalid attribute "shoe-size"`,
+}, {
+	about:       "invalid day",
+	rule:        loginhours.Rule{Group: "g", Days: []string{"someday"}, Start: "09:00", End: "17:00"},
+	expectError: `invalid login hours rule 0: invalid day "someday"`,
+}, {
+	about:       "invalid start",
+	rule:        loginhours.Rule{Group: "g", Start: "9am", End: "17:00"},
+	expectError: `invalid login hours rule 0: invalid start time "9am"`,
+}, {
+	about:       "invalid end",
+	rule:        loginhours.Rule{Group: "g", Start: "09:00", End: "25:00"},
+	expectError: `invalid login hours rule 0: invalid end time "25:00"`,
+}, {
+	about:       "invalid timezone",
+	rule:        loginhours.Rule{Group: "g", Start: "09:00", End: "17:00", Timezone: "Nowhere/Special"},
+	expectError: `invalid login hours rule 0: invalid timezone: .*`,
+}}
+
+func TestNewPolicyErrors(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range newPolicyErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			_, err := loginhours.NewPolicy([]loginhours.Rule{test.rule})
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
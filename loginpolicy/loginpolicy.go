@@ -0,0 +1,169 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package loginpolicy provides a way for an external policy engine to
+// allow or deny logins after the user has been authenticated by an
+// identity provider.
+package loginpolicy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// DefaultTimeout is the timeout used for policy engine requests when
+// none is configured.
+const DefaultTimeout = 10 * time.Second
+
+// A Policy is consulted when a user has successfully authenticated
+// to decide whether the login should be allowed to complete.
+type Policy interface {
+	// CheckLogin returns the decision for the login of the given
+	// identity made with the given HTTP request. The groups of the
+	// identity are the groups the user will be a member of once
+	// logged in, including any default groups. If an error is
+	// returned then the login will fail.
+	CheckLogin(ctx context.Context, req *http.Request, id *store.Identity) (*Decision, error)
+}
+
+// A Decision holds the result of a policy check.
+type Decision struct {
+	// Allow holds whether the login is allowed.
+	Allow bool `json:"allow"`
+
+	// Reason optionally holds a human readable reason for the
+	// decision, this is reported to the user when a login is
+	// denied.
+	Reason string `json:"reason,omitempty"`
+}
+
+// AllowAll is a Policy that allows all logins.
+var AllowAll Policy = allowAll{}
+
+type allowAll struct{}
+
+// CheckLogin implements Policy.CheckLogin.
+func (allowAll) CheckLogin(context.Context, *http.Request, *store.Identity) (*Decision, error) {
+	return &Decision{Allow: true}, nil
+}
+
+// Input holds the information about a login that is sent to an HTTP
+// policy engine.
+type Input struct {
+	Username   string                 `json:"username"`
+	ProviderID string                 `json:"provider-id"`
+	Name       string                 `json:"name,omitempty"`
+	Email      string                 `json:"email,omitempty"`
+	Groups     []string               `json:"groups,omitempty"`
+	ExtraInfo  map[string]interface{} `json:"extra-info,omitempty"`
+	RemoteAddr string                 `json:"remote-addr,omitempty"`
+	UserAgent  string                 `json:"user-agent,omitempty"`
+	Time       time.Time              `json:"time"`
+}
+
+// HTTPPolicy is a Policy that consults an HTTP policy engine using the
+// Open Policy Agent data API. The login information is POSTed to the
+// configured URL as a JSON object of the form {"input": Input} and the
+// response is expected to be of the form {"result": Decision}. A
+// missing result is treated as a denial.
+type HTTPPolicy struct {
+	// URL holds the URL of the policy decision, for example
+	// http://localhost:8181/v1/data/candid/login.
+	URL string
+
+	// Client holds the HTTP client to use to contact the policy
+	// engine. If this is nil then http.DefaultClient will be used.
+	Client *http.Client
+
+	// Timeout holds the maximum time to wait for the policy engine
+	// to respond. If this is zero DefaultTimeout is used.
+	Timeout time.Duration
+}
+
+// CheckLogin implements Policy.CheckLogin.
+func (p *HTTPPolicy) CheckLogin(ctx context.Context, req *http.Request, id *store.Identity) (*Decision, error) {
+	in := Input{
+		Username:   id.Username,
+		ProviderID: string(id.ProviderID),
+		Name:       id.Name,
+		Email:      id.Email,
+		Groups:     id.Groups,
+		ExtraInfo:  extraInfo(id.ExtraInfo),
+		Time:       time.Now().UTC(),
+	}
+	if req != nil {
+		in.RemoteAddr = req.RemoteAddr
+		in.UserAgent = req.UserAgent()
+	}
+	body, err := json.Marshal(struct {
+		Input Input `json:"input"`
+	}{in})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	preq, err := http.NewRequest("POST", p.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	preq.Header.Set("Content-Type", "application/json")
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(preq.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errgo.Newf("cannot query login policy: no response within %v", timeout)
+		}
+		return nil, errgo.Notef(err, "cannot query login policy")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errgo.Newf("cannot query login policy: unexpected status %q", resp.Status)
+	}
+	var result struct {
+		Result *Decision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errgo.Notef(err, "cannot decode login policy response")
+	}
+	if result.Result == nil {
+		return &Decision{Allow: false, Reason: "no login policy decision"}, nil
+	}
+	return result.Result, nil
+}
+
+// extraInfo converts the raw extra info stored for an identity into
+// values suitable for sending to a policy engine. Any values that
+// cannot be decoded are omitted.
+func extraInfo(info map[string][]string) map[string]interface{} {
+	if len(info) == 0 {
+		return nil
+	}
+	m := make(map[string]interface{}, len(info))
+	for k, vs := range info {
+		values := make([]interface{}, 0, len(vs))
+		for _, v := range vs {
+			var val interface{}
+			if err := json.Unmarshal([]byte(v), &val); err != nil {
+				continue
+			}
+			values = append(values, val)
+		}
+		m[k] = values
+	}
+	return m
+}
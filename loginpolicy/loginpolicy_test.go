@@ -0,0 +1,119 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package loginpolicy_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/loginpolicy"
+	"github.com/canonical/candid/store"
+)
+
+func TestAllowAll(t *testing.T) {
+	c := qt.New(t)
+	d, err := loginpolicy.AllowAll.CheckLogin(context.Background(), nil, &store.Identity{Username: "bob"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(d, qt.DeepEquals, &loginpolicy.Decision{Allow: true})
+}
+
+func TestHTTPPolicy(t *testing.T) {
+	c := qt.New(t)
+	var input loginpolicy.Input
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.Method, qt.Equals, "POST")
+		c.Check(req.URL.Path, qt.Equals, "/v1/data/candid/login")
+		var body struct {
+			Input loginpolicy.Input `json:"input"`
+		}
+		err := json.NewDecoder(req.Body).Decode(&body)
+		c.Check(err, qt.IsNil)
+		input = body.Input
+		w.Header().Set("Content-Type", "application/json")
+		if input.Username == "bob" {
+			w.Write([]byte(`{"result": {"allow": false, "reason": "outside office hours"}}`))
+			return
+		}
+		w.Write([]byte(`{"result": {"allow": true}}`))
+	}))
+	defer srv.Close()
+
+	p := &loginpolicy.HTTPPolicy{
+		URL: srv.URL + "/v1/data/candid/login",
+	}
+	req, err := http.NewRequest("GET", "/login", nil)
+	c.Assert(err, qt.IsNil)
+	req.RemoteAddr = "1.2.3.4:5678"
+	req.Header.Set("User-Agent", "test-agent")
+	d, err := p.CheckLogin(context.Background(), req, &store.Identity{
+		ProviderID: "test:bob",
+		Username:   "bob",
+		Groups:     []string{"g1"},
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(d, qt.DeepEquals, &loginpolicy.Decision{
+		Allow:  false,
+		Reason: "outside office hours",
+	})
+	c.Assert(input.Username, qt.Equals, "bob")
+	c.Assert(input.ProviderID, qt.Equals, "test:bob")
+	c.Assert(input.Groups, qt.DeepEquals, []string{"g1"})
+	c.Assert(input.RemoteAddr, qt.Equals, "1.2.3.4:5678")
+	c.Assert(input.UserAgent, qt.Equals, "test-agent")
+
+	d, err = p.CheckLogin(context.Background(), req, &store.Identity{
+		ProviderID: "test:alice",
+		Username:   "alice",
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(d, qt.DeepEquals, &loginpolicy.Decision{Allow: true})
+}
+
+func TestHTTPPolicyNoResult(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	p := &loginpolicy.HTTPPolicy{URL: srv.URL}
+	d, err := p.CheckLogin(context.Background(), nil, &store.Identity{Username: "bob"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(d.Allow, qt.Equals, false)
+}
+
+func TestHTTPPolicyError(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	p := &loginpolicy.HTTPPolicy{URL: srv.URL}
+	_, err := p.CheckLogin(context.Background(), nil, &store.Identity{Username: "bob"})
+	c.Assert(err, qt.ErrorMatches, `cannot query login policy: unexpected status "500 Internal Server Error"`)
+}
+
+func TestHTTPPolicyTimeout(t *testing.T) {
+	c := qt.New(t)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	p := &loginpolicy.HTTPPolicy{
+		URL:     srv.URL,
+		Timeout: 10 * time.Millisecond,
+	}
+	_, err := p.CheckLogin(context.Background(), nil, &store.Identity{Username: "bob"})
+	c.Assert(err, qt.ErrorMatches, `cannot query login policy: no response within 10ms`)
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package maintenance provides schedules of recurring maintenance
+// windows during which new logins are refused.
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/utils/debugstatus"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/params"
+)
+
+// maxDuration holds the maximum length of a maintenance window.
+const maxDuration = 7 * 24 * time.Hour
+
+// A Window holds the configuration of a recurring maintenance window.
+type Window struct {
+	// Days holds the days of the week on which the window starts,
+	// for example "saturday" or "sat". If this is empty the window
+	// starts every day.
+	Days []string `yaml:"days"`
+
+	// Start holds the time of day at which the window starts, in the
+	// form "15:04".
+	Start string `yaml:"start"`
+
+	// Duration holds the length of the window, in the form accepted
+	// by time.ParseDuration.
+	Duration string `yaml:"duration"`
+
+	// Timezone holds the name of the timezone in which Days and
+	// Start are interpreted, for example "Europe/London". If this is
+	// empty UTC is used.
+	Timezone string `yaml:"timezone"`
+
+	// Message optionally holds a message that is shown to users that
+	// attempt to log in during the window.
+	Message string `yaml:"message"`
+}
+
+// A Schedule holds a set of recurring maintenance windows.
+type Schedule struct {
+	windows []window
+}
+
+// window holds a parsed Window.
+type window struct {
+	days     [7]bool
+	start    time.Duration
+	duration time.Duration
+	loc      *time.Location
+	message  string
+}
+
+// NewSchedule returns a schedule containing the given windows.
+func NewSchedule(ws []Window) (*Schedule, error) {
+	s := &Schedule{
+		windows: make([]window, len(ws)),
+	}
+	for i, w := range ws {
+		if err := s.windows[i].parse(w); err != nil {
+			return nil, errgo.Notef(err, "invalid maintenance window %d", i)
+		}
+	}
+	return s, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+func (w *window) parse(cw Window) error {
+	if len(cw.Days) == 0 {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	}
+	for _, d := range cw.Days {
+		day, ok := parseWeekday(d)
+		if !ok {
+			return errgo.Newf("invalid day %q", d)
+		}
+		w.days[day] = true
+	}
+	start, err := time.Parse("15:04", cw.Start)
+	if err != nil {
+		return errgo.Newf("invalid start time %q", cw.Start)
+	}
+	w.start = time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+	w.duration, err = time.ParseDuration(cw.Duration)
+	if err != nil {
+		return errgo.Newf("invalid duration %q", cw.Duration)
+	}
+	if w.duration <= 0 || w.duration > maxDuration {
+		return errgo.Newf("duration %v out of range", w.duration)
+	}
+	w.loc, err = time.LoadLocation(cw.Timezone)
+	if err != nil {
+		return errgo.Notef(err, "invalid timezone")
+	}
+	w.message = cw.Message
+	return nil
+}
+
+// parseWeekday parses either the full or abbreviated name of a day of
+// the week.
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(s)
+	for name, day := range weekdays {
+		if s == name || s == name[:3] {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// end returns the end of the occurrence of the window that contains t,
+// if there is one.
+func (w *window) end(t time.Time) (time.Time, bool) {
+	lt := t.In(w.loc)
+	// Look back through every day on which an occurrence of the
+	// window that is still running could have started.
+	for i := 0; time.Duration(i)*24*time.Hour <= w.start+w.duration; i++ {
+		day := time.Date(lt.Year(), lt.Month(), lt.Day()-i, 0, 0, 0, 0, w.loc)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		start := day.Add(w.start)
+		end := start.Add(w.duration)
+		if !t.Before(start) && t.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// A Period holds the details of a maintenance window that is in
+// progress.
+type Period struct {
+	// End holds the time at which the maintenance window ends.
+	End time.Time
+
+	// Message holds the configured message for the window, if any.
+	Message string
+}
+
+// Active returns the maintenance window in progress at the given time,
+// if there is one. If more than one window is in progress the one that
+// ends last is returned.
+func (s *Schedule) Active(t time.Time) (*Period, bool) {
+	if s == nil {
+		return nil, false
+	}
+	var p *Period
+	for _, w := range s.windows {
+		end, ok := w.end(t)
+		if !ok {
+			continue
+		}
+		if p == nil || end.After(p.End) {
+			p = &Period{
+				End:     end.In(w.loc),
+				Message: w.message,
+			}
+		}
+	}
+	return p, p != nil
+}
+
+// CheckLogin checks whether a login may start at the given time. If a
+// maintenance window is in progress an error with a cause of
+// params.ErrServiceUnavailable is returned.
+func (s *Schedule) CheckLogin(t time.Time) error {
+	p, ok := s.Active(t)
+	if !ok {
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrServiceUnavailable, "%s", p.String())
+}
+
+// String returns a description of the period suitable for showing to
+// users.
+func (p *Period) String() string {
+	msg := fmt.Sprintf("login is unavailable due to scheduled maintenance, please try again after %s", p.End.Format("Mon 15:04 MST"))
+	if p.Message != "" {
+		msg += ": " + p.Message
+	}
+	return msg
+}
+
+// CheckerFunc returns a debugstatus.CheckerFunc that reports whether a
+// maintenance window is in progress. The check always passes, as the
+// server is still able to serve existing sessions.
+func (s *Schedule) CheckerFunc() debugstatus.CheckerFunc {
+	return func(context.Context) (key string, result debugstatus.CheckResult) {
+		result.Name = "Scheduled maintenance"
+		result.Passed = true
+		if p, ok := s.Active(time.Now()); ok {
+			result.Value = "logins disabled until " + p.End.Format(time.RFC3339)
+		} else {
+			result.Value = "logins enabled"
+		}
+		return "maintenance", result
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package maintenance_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/maintenance"
+	"github.com/canonical/candid/params"
+)
+
+func mustParseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+var activeTests = []struct {
+	about     string
+	windows   []maintenance.Window
+	t         string
+	expectEnd string
+}{{
+	about: "daily window active",
+	windows: []maintenance.Window{{
+		Start:    "02:00",
+		Duration: "1h",
+	}},
+	t:         "2020-06-10T02:30:00Z",
+	expectEnd: "2020-06-10T03:00:00Z",
+}, {
+	about: "daily window not active",
+	windows: []maintenance.Window{{
+		Start:    "02:00",
+		Duration: "1h",
+	}},
+	t: "2020-06-10T03:00:00Z",
+}, {
+	about: "window crossing midnight",
+	windows: []maintenance.Window{{
+		Start:    "23:00",
+		Duration: "2h",
+	}},
+	t:         "2020-06-10T00:30:00Z",
+	expectEnd: "2020-06-10T01:00:00Z",
+}, {
+	about: "weekly window active",
+	windows: []maintenance.Window{{
+		Days:     []string{"saturday", "Sun"},
+		Start:    "22:00",
+		Duration: "4h",
+	}},
+	// 2020-06-14 is a Sunday.
+	t:         "2020-06-15T01:00:00Z",
+	expectEnd: "2020-06-15T02:00:00Z",
+}, {
+	about: "weekly window on other day",
+	windows: []maintenance.Window{{
+		Days:     []string{"saturday", "sunday"},
+		Start:    "22:00",
+		Duration: "4h",
+	}},
+	t: "2020-06-16T01:00:00Z",
+}, {
+	about: "window with timezone",
+	windows: []maintenance.Window{{
+		Start:    "02:00",
+		Duration: "1h",
+		Timezone: "Europe/London",
+	}},
+	// London is on BST (UTC+1) in June.
+	t:         "2020-06-10T01:30:00Z",
+	expectEnd: "2020-06-10T02:00:00Z",
+}, {
+	about: "window with timezone not active",
+	windows: []maintenance.Window{{
+		Start:    "02:00",
+		Duration: "1h",
+		Timezone: "Europe/London",
+	}},
+	t: "2020-06-10T02:30:00Z",
+}, {
+	about: "overlapping windows",
+	windows: []maintenance.Window{{
+		Start:    "02:00",
+		Duration: "1h",
+	}, {
+		Start:    "02:30",
+		Duration: "1h",
+	}},
+	t:         "2020-06-10T02:45:00Z",
+	expectEnd: "2020-06-10T03:30:00Z",
+}}
+
+func TestActive(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range activeTests {
+		c.Run(test.about, func(c *qt.C) {
+			s, err := maintenance.NewSchedule(test.windows)
+			c.Assert(err, qt.IsNil)
+			p, ok := s.Active(mustParseTime(test.t))
+			if test.expectEnd == "" {
+				c.Assert(ok, qt.IsFalse)
+				return
+			}
+			c.Assert(ok, qt.IsTrue)
+			c.Assert(p.End.Equal(mustParseTime(test.expectEnd)), qt.IsTrue, qt.Commentf("got %v", p.End))
+		})
+	}
+}
+
+func TestNilSchedule(t *testing.T) {
+	c := qt.New(t)
+	var s *maintenance.Schedule
+	_, ok := s.Active(time.Now())
+	c.Assert(ok, qt.IsFalse)
+	c.Assert(s.CheckLogin(time.Now()), qt.IsNil)
+}
+
+func TestCheckLogin(t *testing.T) {
+	c := qt.New(t)
+	s, err := maintenance.NewSchedule([]maintenance.Window{{
+		Start:    "02:00",
+		Duration: "1h",
+		Message:  "database upgrade",
+	}})
+	c.Assert(err, qt.IsNil)
+	err = s.CheckLogin(mustParseTime("2020-06-10T02:30:00Z"))
+	c.Assert(err, qt.ErrorMatches, `login is unavailable due to scheduled maintenance, please try again after Wed 03:00 UTC: database upgrade`)
+	c.Assert(errgo.Cause(err), qt.Equals, params.ErrServiceUnavailable)
+	err = s.CheckLogin(mustParseTime("2020-06-10T03:30:00Z"))
+	c.Assert(err, qt.IsNil)
+}
+
+var newScheduleErrorTests = []struct {
+	about       string
+	window      maintenance.Window
+	expectError string
+}{{
+	about: "invalid day",
+	window: maintenance.Window{
+		Days:     []string{"someday"},
+		Start:    "02:00",
+		Duration: "1h",
+	},
+	expectError: `invalid maintenance window 0: invalid day "someday"`,
+}, {
+	about: "invalid start",
+	window: maintenance.Window{
+		Start:    "2am",
+		Duration: "1h",
+	},
+	expectError: `invalid maintenance window 0: invalid start time "2am"`,
+}, {
+	about: "invalid duration",
+	window: maintenance.Window{
+		Start:    "02:00",
+		Duration: "forever",
+	},
+	expectError: `invalid maintenance window 0: invalid duration "forever"`,
+}, {
+	about: "duration too long",
+	window: maintenance.Window{
+		Start:    "02:00",
+		Duration: "200h",
+	},
+	expectError: `invalid maintenance window 0: duration 200h0m0s out of range`,
+}, {
+	about: "invalid timezone",
+	window: maintenance.Window{
+		Start:    "02:00",
+		Duration: "1h",
+		Timezone: "Nowhere/Special",
+	},
+	expectError: `invalid maintenance window 0: invalid timezone: unknown time zone Nowhere/Special`,
+}}
+
+func TestNewScheduleErrors(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range newScheduleErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			_, err := maintenance.NewSchedule([]maintenance.Window{test.window})
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
@@ -53,6 +53,14 @@ var (
 	Clock clock.Clock = clock.WallClock
 )
 
+// ErrExpired is the error cause returned by Wait when the rendezvous
+// has expired without being completed.
+var ErrExpired = errgo.New("rendezvous expired")
+
+// expiredCode is the error code used to send ErrExpired errors between
+// servers.
+const expiredCode = "rendezvous expired"
+
 // Store defines the backing store required by the
 // participants in the rendezvous.
 // Entries created in the store should be visible
@@ -304,7 +312,7 @@ func (p *Place) localWait(ctx context.Context, id string) (data0, data1 []byte,
 	}
 	if expiredErr != nil {
 		if removed {
-			return nil, nil, errgo.Newf("rendezvous expired after %v", p.expiryDuration)
+			return nil, nil, errgo.WithCausef(nil, ErrExpired, "rendezvous expired after %v", p.expiryDuration)
 		}
 		return nil, nil, errgo.Notef(err, "rendezvous wait timed out")
 	}
@@ -345,9 +353,13 @@ func (p *Place) newHandler(params httprequest.Params) (*handler, context.Context
 
 var reqServer = httprequest.Server{
 	ErrorMapper: func(ctx context.Context, err error) (httpStatus int, errorBody interface{}) {
-		return http.StatusInternalServerError, &httprequest.RemoteError{
+		rerr := &httprequest.RemoteError{
 			Message: err.Error(),
 		}
+		if errgo.Cause(err) == ErrExpired {
+			rerr.Code = expiredCode
+		}
+		return http.StatusInternalServerError, rerr
 	},
 }
 
@@ -387,6 +399,9 @@ func (p *Place) Wait(ctx context.Context, id string) (data0, data1 []byte, err e
 		Id: id,
 	})
 	if err != nil {
+		if rerr, ok := errgo.Cause(err).(*httprequest.RemoteError); ok && rerr.Code == expiredCode {
+			return nil, nil, errgo.WithCausef(nil, ErrExpired, "%s", rerr.Message)
+		}
 		return nil, nil, errgo.Mask(err)
 	}
 	return resp.Data0, resp.Data1, nil
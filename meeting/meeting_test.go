@@ -460,6 +460,50 @@ func TestWaitTimeout(t *testing.T) {
 	}
 }
 
+func TestWaitNeverCompleted(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	ctx := context.Background()
+	clock := testclock.NewClock(epoch)
+	store := newFakeStore(nil, clock)
+	c.Patch(&meeting.Clock, clock)
+	params := meeting.Params{
+		Store:          store,
+		ListenAddr:     "localhost",
+		DisableGC:      true,
+		WaitTimeout:    time.Minute,
+		ExpiryDuration: 5 * time.Second,
+	}
+	m, err := meeting.NewPlace(params)
+	c.Assert(err, qt.IsNil)
+	defer m.Close()
+
+	id, err := newId()
+	c.Assert(err, qt.IsNil)
+	err = m.NewRendezvous(ctx, id, nil)
+	c.Assert(err, qt.IsNil)
+	done := make(chan error)
+	go func() {
+		_, _, err := m.Wait(ctx, id)
+		done <- err
+	}()
+	err = clock.WaitAdvance(params.ExpiryDuration+1, time.Second, 1)
+	c.Assert(err, qt.IsNil)
+	select {
+	case err := <-done:
+		c.Assert(errgo.Cause(err), qt.Equals, meeting.ErrExpired)
+		c.Assert(err, qt.ErrorMatches, "rendezvous expired after 5s")
+	case <-time.After(time.Second):
+		c.Fatalf("timed out waiting for Wait to time out")
+	}
+
+	// The entry has been cleaned up without waiting for the garbage
+	// collector.
+	c.Assert(meeting.ItemCount(m), qt.Equals, 0)
+	_, err = store.Get(ctx, id)
+	c.Assert(err, qt.Not(qt.IsNil))
+}
+
 func TestRequestCompletedCalled(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
@@ -0,0 +1,59 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package onboarding provides a way for deployments to run additional
+// steps, such as accepting terms of service, the first time a user
+// logs in.
+package onboarding
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// A Handler runs the onboarding steps for a user that is logging in for
+// the first time. The login is not completed until completion has been
+// confirmed with an authenticated POST request to the returnTo address
+// and the user's browser is returned to it.
+type Handler interface {
+	// Onboard starts onboarding the given identity by writing a
+	// response to w. Once the onboarding steps are complete the
+	// handler must redirect the user's browser to returnTo. If
+	// onboarding fails, the handler may add an "error" query
+	// parameter to returnTo, in which case the login will fail with
+	// that error.
+	Onboard(ctx context.Context, w http.ResponseWriter, req *http.Request, id *store.Identity, returnTo string) error
+}
+
+// RedirectHandler is a Handler that sends the user to an external
+// onboarding service. The user's browser is redirected to the
+// configured URL with the query parameters "username", "email" and
+// "return_to" added. Once onboarding is complete the service must
+// confirm completion by POSTing to the value of "return_to", as the
+// configured onboarding agent, and then redirect back to it.
+type RedirectHandler struct {
+	// URL holds the URL of the external onboarding service.
+	URL string
+}
+
+// Onboard implements Handler.Onboard.
+func (h *RedirectHandler) Onboard(ctx context.Context, w http.ResponseWriter, req *http.Request, id *store.Identity, returnTo string) error {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return errgo.Notef(err, "invalid onboarding URL")
+	}
+	q := u.Query()
+	q.Set("username", id.Username)
+	if id.Email != "" {
+		q.Set("email", id.Email)
+	}
+	q.Set("return_to", returnTo)
+	u.RawQuery = q.Encode()
+	http.Redirect(w, req, u.String(), http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package onboarding_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/onboarding"
+	"github.com/canonical/candid/store"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	c := qt.New(t)
+	h := &onboarding.RedirectHandler{
+		URL: "https://onboarding.example.com/welcome?site=test",
+	}
+	req, err := http.NewRequest("GET", "/login", nil)
+	c.Assert(err, qt.IsNil)
+	rr := httptest.NewRecorder()
+	err = h.Onboard(context.Background(), rr, req, &store.Identity{
+		Username: "bob",
+		Email:    "bob@example.com",
+	}, "https://candid.example.com/login-onboarded?id=1234")
+	c.Assert(err, qt.IsNil)
+	c.Assert(rr.Code, qt.Equals, http.StatusSeeOther)
+	c.Assert(rr.Header().Get("Location"), qt.Equals, "https://onboarding.example.com/welcome?email=bob%40example.com&return_to=https%3A%2F%2Fcandid.example.com%2Flogin-onboarded%3Fid%3D1234&site=test&username=bob")
+}
+
+func TestRedirectHandlerInvalidURL(t *testing.T) {
+	c := qt.New(t)
+	h := &onboarding.RedirectHandler{
+		URL: ":bad",
+	}
+	req, err := http.NewRequest("GET", "/login", nil)
+	c.Assert(err, qt.IsNil)
+	err = h.Onboard(context.Background(), httptest.NewRecorder(), req, &store.Identity{Username: "bob"}, "/login-onboarded")
+	c.Assert(err, qt.ErrorMatches, `invalid onboarding URL: parse ":bad": missing protocol scheme`)
+}
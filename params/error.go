@@ -28,6 +28,12 @@ const (
 	ErrNoAdminCredsProvided ErrorCode = "no admin credentials provided"
 	ErrMethodNotAllowed     ErrorCode = "method not allowed"
 	ErrServiceUnavailable   ErrorCode = "service unavailable"
+	ErrTooManyRequests      ErrorCode = "too many requests"
+	ErrLoginTimedOut        ErrorCode = "login timed out"
+	ErrUserNoLongerExists   ErrorCode = "user no longer exists"
+	ErrAccessDenied         ErrorCode = "access_denied"
+	ErrConflict             ErrorCode = "conflict"
+	ErrNotModified          ErrorCode = "not modified"
 )
 
 // Error represents an error - it is returned for any response that fails.
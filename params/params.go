@@ -103,6 +103,31 @@ type QueryUsersRequest struct {
 	// Owner, if present, matches all agent identities with the given
 	// owner.
 	Owner string `httprequest:"owner,form"`
+
+	// Source, if present, matches all identities that originated
+	// from the given source system.
+	Source string `httprequest:"source,form"`
+
+	// Query, if present, searches for users with a username, email
+	// address or display name that starts with the given string.
+	// The match is case sensitive. Users whose username is exactly
+	// the query are returned first, followed by those with a
+	// matching username, email address and then display name. A
+	// search is always paginated: if Limit is zero or too large a
+	// server-defined maximum is used instead. Searching requires
+	// administrative access.
+	Query string `httprequest:"q,form"`
+
+	// Offset holds the number of matching users to skip before
+	// returning results. It is used with Limit to page through the
+	// results.
+	Offset int `httprequest:"offset,form"`
+
+	// Limit, if greater than zero, holds the maximum number of users
+	// to return. When Limit is set the response will include a Link
+	// header containing the URLs of the first, previous and next
+	// pages of results, as appropriate.
+	Limit int `httprequest:"limit,form"`
 }
 
 // UserRequest is a request for the user details of the named user.
@@ -124,6 +149,10 @@ type User struct {
 	SSHKeys       []string            `json:"ssh_keys"`
 	LastLogin     *time.Time          `json:"last_login,omitempty"`
 	LastDischarge *time.Time          `json:"last_discharge,omitempty"`
+
+	// Source holds the tag of the system the user originated from.
+	// It is set when the user is created and cannot be changed.
+	Source string `json:"source,omitempty"`
 }
 
 // SetUserRequest is a request to set the details of a user.
@@ -166,6 +195,11 @@ type CreateAgentResponse struct {
 type UserGroupsRequest struct {
 	httprequest.Route `httprequest:"GET /v1/u/:username/groups"`
 	Username          Username `httprequest:"username,path"`
+
+	// Stored, if true, requests only the groups stored for the
+	// user, excluding any that are derived from the identity
+	// provider or from group rules.
+	Stored bool `httprequest:"stored,form,omitempty"`
 }
 
 // SetUserGroupsRequest is a request to set the list of groups associated
@@ -215,6 +249,38 @@ type VerifyTokenRequest struct {
 	Macaroons         macaroon.Slice `httprequest:",body"`
 }
 
+// RenewTokenRequest is a request to renew the provided macaroon.Slice,
+// which must be valid and represent a user from identity.
+type RenewTokenRequest struct {
+	httprequest.Route `httprequest:"POST /v1/renew"`
+	Macaroons         macaroon.Slice `httprequest:",body"`
+}
+
+// IntrospectTokenRequest is a request for information about the
+// provided macaroon.Slice. The request must itself be authenticated.
+type IntrospectTokenRequest struct {
+	httprequest.Route `httprequest:"POST /v1/introspect"`
+	Macaroons         macaroon.Slice `httprequest:",body"`
+}
+
+// IntrospectTokenResponse holds the result of introspecting a
+// macaroon.Slice. If the macaroons are not valid, or do not represent
+// a user, Active is false and no other fields are set.
+type IntrospectTokenResponse struct {
+	Active   bool       `json:"active"`
+	Username Username   `json:"username,omitempty"`
+	Groups   []string   `json:"groups,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+
+	// Caveats holds any first-party caveat conditions on the
+	// macaroons other than expiry times and declarations.
+	Caveats []string `json:"caveats,omitempty"`
+
+	// SessionID holds the correlation ID of the anonymous session
+	// that was upgraded by the login, if any.
+	SessionID string `json:"session_id,omitempty"`
+}
+
 // SSHKeysRequest is a request for the list of ssh keys associated
 // with the specified user.
 type SSHKeysRequest struct {
@@ -255,6 +321,144 @@ type DeleteSSHKeysBody struct {
 	SSHKeys []string `json:"ssh-keys"`
 }
 
+// ProvisionUserRequest is a request to create a user before they have
+// logged in for the first time, so that groups may be assigned to them
+// in advance.
+type ProvisionUserRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/u/:username/provision"`
+	Username          Username          `httprequest:"username,path"`
+	Body              ProvisionUserBody `httprequest:",body"`
+}
+
+// ProvisionUserBody holds the body of a ProvisionUserRequest.
+type ProvisionUserBody struct {
+	// ExternalID holds the identity provider specific ID that the
+	// user will have when they log in.
+	ExternalID string `json:"external_id"`
+
+	// Groups holds the groups that the user will be a member of.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// UserRolesRequest is a request for the list of tenant-scoped roles
+// associated with the specified user.
+type UserRolesRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/roles"`
+	Username          Username `httprequest:"username,path"`
+}
+
+// RolesResponse holds a response to the GET /v1/u/:username/roles
+// containing the list of tenant-scoped roles associated with the user.
+// Each role is of the form "tenant:role".
+type RolesResponse struct {
+	Roles []string `json:"roles"`
+}
+
+// SetUserRolesRequest is a request to set the tenant-scoped roles
+// associated with the user. Any existing roles will be replaced.
+type SetUserRolesRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/u/:username/roles"`
+	Username          Username     `httprequest:"username,path"`
+	Roles             SetRolesBody `httprequest:",body"`
+}
+
+// SetRolesBody holds the body of a SetUserRolesRequest.
+type SetRolesBody struct {
+	Roles []string `json:"roles"`
+}
+
+// SimulateLoginRequest is a request to report what a login by the
+// given user would produce. No credentials are checked and no macaroon
+// is issued, so the response cannot be used to authenticate.
+type SimulateLoginRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/simulate-login"`
+	Username          Username          `httprequest:"username,path"`
+	Body              SimulateLoginBody `httprequest:",body"`
+}
+
+// SimulateLoginBody holds the body of a SimulateLoginRequest.
+type SimulateLoginBody struct {
+	// Condition holds the third party caveat condition to simulate
+	// discharging, either "is-authenticated-user" (the default) or
+	// "is-authenticated-userid".
+	Condition string `json:"condition,omitempty"`
+}
+
+// SimulateLoginResponse holds the response to a SimulateLoginRequest.
+type SimulateLoginResponse struct {
+	// Simulated is always true, it marks the response as the result
+	// of a simulated login that grants no credentials.
+	Simulated bool `json:"simulated"`
+
+	// Username holds the effective username of the user.
+	Username Username `json:"username"`
+
+	// Groups holds the groups the user would be a member of.
+	Groups []string `json:"groups"`
+
+	// Caveats holds the conditions of the caveats that would be
+	// added to a discharge macaroon for the user.
+	Caveats []string `json:"caveats"`
+}
+
+// ResetPasswordRequest is a request to reset the password of a user
+// whose password is managed by their identity provider.
+type ResetPasswordRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/reset-password"`
+	Username          Username `httprequest:"username,path"`
+}
+
+// ExpirePasswordRequest is a request to require a user to choose a new
+// password the next time they log in. The user's password must be
+// managed by their identity provider.
+type ExpirePasswordRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/expire-password"`
+	Username          Username `httprequest:"username,path"`
+}
+
+// GenerateBackupCodesRequest is a request to create a new set of
+// single-use backup codes for a user whose one-time codes are managed
+// by their identity provider. Any unused backup codes the user already
+// has can no longer be used.
+type GenerateBackupCodesRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/backup-codes"`
+	Username          Username `httprequest:"username,path"`
+}
+
+// GenerateBackupCodesResponse holds the response to a
+// GenerateBackupCodesRequest.
+type GenerateBackupCodesResponse struct {
+	// Codes holds the new backup codes. Each may be entered once in
+	// place of a one-time code when logging in. The codes cannot be
+	// retrieved again.
+	Codes []string `json:"codes"`
+}
+
+// BackupCodesRequest is a request for the number of unused backup
+// codes a user has.
+type BackupCodesRequest struct {
+	httprequest.Route `httprequest:"GET /v1/u/:username/backup-codes"`
+	Username          Username `httprequest:"username,path"`
+}
+
+// BackupCodesResponse holds the response to a BackupCodesRequest.
+type BackupCodesResponse struct {
+	// Remaining holds the number of unused backup codes.
+	Remaining int `json:"remaining"`
+}
+
+// ResetPasswordResponse holds the response to a ResetPasswordRequest.
+type ResetPasswordResponse struct {
+	// Token holds a single-use token that can be used to set a new
+	// password for the user.
+	Token string `json:"token"`
+
+	// URL holds the address to which the token and the new password
+	// should be POSTed, as the form values "token" and
+	// "new-password" respectively.
+	URL string `json:"url"`
+}
+
 // UserExtraInfoRequest is a request for the arbitrary extra information
 // stored about the user.
 type UserExtraInfoRequest struct {
@@ -314,6 +518,14 @@ type DischargeTokenForUserResponse struct {
 // IDPChoice lists available IDPs for authentication.
 type IDPChoice struct {
 	IDPs []IDPChoiceDetails `json:"idps"`
+
+	// HandoffURL holds a URL that can be opened on another device
+	// to continue the login there, if login hand-off is enabled.
+	HandoffURL string `json:"handoff_url,omitempty"`
+
+	// HandoffQRCode holds the URL of an SVG image of a QR code
+	// encoding HandoffURL.
+	HandoffQRCode string `json:"handoff_qrcode,omitempty"`
 }
 
 // IDPChoiceDetails provides details about a IDP choice for authentication.
@@ -323,6 +535,207 @@ type IDPChoiceDetails struct {
 	Icon        string `json:"icon"`
 	Name        string `json:"name"`
 	URL         string `json:"url"`
+	Category    string `json:"category,omitempty"`
+
+	// LastUsed is set if this is the identity provider most
+	// recently used to log in from the requesting browser.
+	LastUsed bool `json:"last_used,omitempty"`
+}
+
+// ExportUsersRequest is a request to export all the users in the
+// system. The response is a stream of newline-delimited JSON (NDJSON)
+// documents, one User per line, in username order, followed by an
+// ExportUsersTrailer. An export that does not end with a trailer, or
+// whose trailer holds an error, is incomplete.
+type ExportUsersRequest struct {
+	httprequest.Route `httprequest:"GET /v1/export/users"`
+
+	// Checkpoint, if present, holds the username of the last user
+	// received from an earlier export. The export resumes with the
+	// user following it.
+	Checkpoint string `httprequest:"checkpoint,form"`
+}
+
+// ExportUsersTrailer is the last document in the response to an
+// ExportUsersRequest.
+type ExportUsersTrailer struct {
+	// Trailer is always true. It distinguishes the trailer from the
+	// exported users.
+	Trailer bool `json:"trailer"`
+
+	// Count holds the number of users exported.
+	Count int `json:"count"`
+
+	// Error holds the error that stopped the export, if it did not
+	// complete.
+	Error *Error `json:"error,omitempty"`
+
+	// Checkpoint holds the username of the last user exported, from
+	// which an incomplete export can be resumed.
+	Checkpoint string `json:"checkpoint,omitempty"`
+}
+
+// DisplayNameDuplicatesRequest is a request for the display names that
+// are shared by more than one identity. It can be used to find the
+// conflicts that must be resolved before unique display names are
+// enforced.
+type DisplayNameDuplicatesRequest struct {
+	httprequest.Route `httprequest:"GET /v1/display-names/duplicates"`
+
+	// TrimSpace is set if leading and trailing white space is
+	// ignored when comparing display names.
+	TrimSpace bool `httprequest:"trim-space,form"`
+
+	// CaseInsensitive is set if differences in case are ignored
+	// when comparing display names.
+	CaseInsensitive bool `httprequest:"case-insensitive,form"`
+}
+
+// DisplayNameDuplicatesResponse holds the response to a
+// DisplayNameDuplicatesRequest.
+type DisplayNameDuplicatesResponse struct {
+	// Duplicates holds the duplicated display names, in order of
+	// normalized name.
+	Duplicates []DisplayNameDuplicate `json:"duplicates"`
+}
+
+// DisplayNameDuplicate holds a display name that is shared by more than
+// one identity.
+type DisplayNameDuplicate struct {
+	// Name holds the normalized display name.
+	Name string `json:"name"`
+
+	// Usernames holds the usernames of the identities with the
+	// display name.
+	Usernames []Username `json:"usernames"`
+}
+
+// AdminAccount holds the configuration of an additional administrator
+// account. Each account authenticates as an agent using its own key
+// pair and is a member of the admin group.
+type AdminAccount struct {
+	// Username holds the username of the account. It must be in
+	// the candid domain.
+	Username Username `json:"username" yaml:"username"`
+
+	// PublicKey holds the public key that the account uses to
+	// authenticate.
+	PublicKey *bakery.PublicKey `json:"public-key" yaml:"public-key"`
+}
+
+// SetAdminAccountDisabledRequest is a request to disable, or re-enable,
+// one of the configured administrator accounts. A disabled account can
+// no longer authenticate.
+type SetAdminAccountDisabledRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/admin-accounts/:username/disabled"`
+	Username          Username             `httprequest:"username,path"`
+	Disabled          AdminAccountDisabled `httprequest:",body"`
+}
+
+// AdminAccountDisabled holds the disabled state of an administrator
+// account.
+type AdminAccountDisabled struct {
+	Disabled bool `json:"disabled"`
+}
+
+// CreateAPITokenRequest is a request to create an API token for a
+// user. An API token authenticates requests that present it in an
+// "Authorization: Bearer" header as the user.
+type CreateAPITokenRequest struct {
+	httprequest.Route `httprequest:"POST /v1/u/:username/api-tokens"`
+	Username          Username           `httprequest:"username,path"`
+	Body              CreateAPITokenBody `httprequest:",body"`
+}
+
+// CreateAPITokenBody holds the body of a CreateAPITokenRequest.
+type CreateAPITokenBody struct {
+	// Expires holds the time at which the token expires. It must
+	// not be later than the maximum API token lifetime allows. If
+	// it is zero the token has the maximum lifetime.
+	Expires time.Time `json:"expires"`
+}
+
+// APIToken holds a newly created API token.
+type APIToken struct {
+	// ID holds the ID of the token, which can be used to revoke it.
+	ID string `json:"id"`
+
+	// Token holds the token to present in requests. The server does
+	// not keep a copy of it.
+	Token string `json:"token"`
+
+	// Expires holds the time at which the token expires.
+	Expires time.Time `json:"expires"`
+}
+
+// RevokeAPITokenRequest is a request to revoke one of a user's API
+// tokens.
+type RevokeAPITokenRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/u/:username/api-tokens/:id"`
+	Username          Username `httprequest:"username,path"`
+	ID                string   `httprequest:"id,path"`
+}
+
+// IDPConfigRequest is a request for the configuration of the identity
+// providers the server is running with.
+type IDPConfigRequest struct {
+	httprequest.Route `httprequest:"GET /v1/idps/config"`
+}
+
+// IDPConfigResponse holds the response to an IDPConfigRequest.
+type IDPConfigResponse struct {
+	IDPs []IDPConfig `json:"idps"`
+}
+
+// IDPConfig holds the configuration of a single identity provider.
+type IDPConfig struct {
+	Name        string `json:"name"`
+	Type        string `json:"type,omitempty"`
+	Domain      string `json:"domain,omitempty"`
+	Description string `json:"description,omitempty"`
+	Interactive bool   `json:"interactive"`
+	Hidden      bool   `json:"hidden,omitempty"`
+	Category    string `json:"category,omitempty"`
+
+	// Params holds the parameters the identity provider is
+	// configured with, in the form used in the configuration file.
+	// The values of any secret parameters are replaced with
+	// "REDACTED".
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// ListIDPsRequest is a request for the identity providers the server is
+// running with and whether each is enabled.
+type ListIDPsRequest struct {
+	httprequest.Route `httprequest:"GET /v1/idps"`
+}
+
+// ListIDPsResponse holds the response to a ListIDPsRequest.
+type ListIDPsResponse struct {
+	IDPs []IDPStatus `json:"idps"`
+}
+
+// IDPStatus holds the status of a single identity provider.
+type IDPStatus struct {
+	Name        string `json:"name"`
+	Domain      string `json:"domain,omitempty"`
+	Description string `json:"description,omitempty"`
+	Interactive bool   `json:"interactive"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// SetIDPEnabledRequest is a request to enable, or disable, one of the
+// identity providers. A disabled identity provider cannot be used to
+// log in.
+type SetIDPEnabledRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/idps/:idp/enabled"`
+	IDP               string     `httprequest:"idp,path"`
+	Enabled           IDPEnabled `httprequest:",body"`
+}
+
+// IDPEnabled holds the enabled state of an identity provider.
+type IDPEnabled struct {
+	Enabled bool `json:"enabled"`
 }
 
 // GetUserWithIDRequest is a request for the user details of the user with the
@@ -343,3 +756,48 @@ type GetUserGroupsWithIDRequest struct {
 type GroupsResponse struct {
 	Groups []string `json:"groups"`
 }
+
+// Group holds the record of a group. Identities refer to groups by
+// name, so the record of a group is independent of its membership.
+type Group struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// ListGroupsRequest is a request for the records of all groups.
+type ListGroupsRequest struct {
+	httprequest.Route `httprequest:"GET /v1/groups"`
+}
+
+// ListGroupsResponse holds the response to a ListGroupsRequest.
+type ListGroupsResponse struct {
+	Groups []Group `json:"groups"`
+}
+
+// GroupRequest is a request for the record of a group.
+type GroupRequest struct {
+	httprequest.Route `httprequest:"GET /v1/groups/:group"`
+	Group             string `httprequest:"group,path"`
+}
+
+// SetGroupRequest is a request to create or replace the record of a
+// group. It does not change the membership of the group.
+type SetGroupRequest struct {
+	httprequest.Route `httprequest:"PUT /v1/groups/:group"`
+	Group             string       `httprequest:"group,path"`
+	Body              SetGroupBody `httprequest:",body"`
+}
+
+// SetGroupBody holds the body of a SetGroupRequest.
+type SetGroupBody struct {
+	Description string            `json:"description,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// DeleteGroupRequest is a request to remove the record of a group.
+// Identities that are members of the group remain members.
+type DeleteGroupRequest struct {
+	httprequest.Route `httprequest:"DELETE /v1/groups/:group"`
+	Group             string `httprequest:"group,path"`
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package ratelimit provides limits on the rate at which requests may
+// be made.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// A Limiter limits the rate of requests that are made with each key.
+// Implementations must be safe to call concurrently. The limiter
+// returned by New holds its state in memory, so the limit applies to
+// each server separately; a deployment with many servers may use a
+// Limiter backed by a shared store, such as Redis, instead.
+type Limiter interface {
+	// Allow records a request made with the given key and reports
+	// whether the request is within the limit. If an error is
+	// returned the request is allowed.
+	Allow(ctx context.Context, key string) (bool, error)
+}
+
+// Config holds the configuration of a rate limit.
+type Config struct {
+	// RequestsPerMinute holds the sustained rate of requests that is
+	// allowed for each key. If this is zero the rate is not
+	// limited.
+	RequestsPerMinute int `yaml:"requests-per-minute"`
+
+	// Burst holds the number of requests that may be made with a
+	// key in quick succession before the rate is limited. If this
+	// is zero RequestsPerMinute is used.
+	Burst int `yaml:"burst"`
+}
+
+// Validate checks that the configuration is valid.
+func (c Config) Validate() error {
+	if c.RequestsPerMinute < 0 {
+		return errgo.Newf("requests-per-minute must not be negative")
+	}
+	if c.Burst < 0 {
+		return errgo.Newf("burst must not be negative")
+	}
+	return nil
+}
+
+// timeNow is used to get the current time, it is replaced in tests.
+var timeNow = time.Now
+
+// New returns a Limiter that holds its state in memory and enforces
+// the given limit. If the configuration does not limit the rate a nil
+// Limiter is returned.
+func New(c Config) (Limiter, error) {
+	if err := c.Validate(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if c.RequestsPerMinute == 0 {
+		return nil, nil
+	}
+	burst := c.Burst
+	if burst == 0 {
+		burst = c.RequestsPerMinute
+	}
+	return &memLimiter{
+		rate:    float64(c.RequestsPerMinute) / float64(time.Minute),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}, nil
+}
+
+// A memLimiter is a Limiter that holds a token bucket for each key in
+// memory.
+type memLimiter struct {
+	// rate holds the number of tokens added to each bucket every
+	// nanosecond.
+	rate float64
+
+	// burst holds the capacity of each bucket.
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// A bucket holds the state of the limit for a single key.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Allow implements Limiter.Allow.
+func (l *memLimiter) Allow(_ context.Context, key string) (bool, error) {
+	now := timeNow()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{
+			tokens: l.burst,
+			last:   now,
+		}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+float64(now.Sub(b.last))*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+	return true, nil
+}
+
+// sweep removes the buckets that would have refilled by the given time,
+// so that the memory used does not grow with every key ever seen. The
+// buckets are checked at most once a minute.
+func (l *memLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	refill := time.Duration(l.burst / l.rate)
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, k)
+		}
+	}
+}
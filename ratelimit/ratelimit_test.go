@@ -0,0 +1,87 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/ratelimit"
+)
+
+func TestNewNoLimit(t *testing.T) {
+	c := qt.New(t)
+	l, err := ratelimit.New(ratelimit.Config{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(l, qt.IsNil)
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	c := qt.New(t)
+	_, err := ratelimit.New(ratelimit.Config{RequestsPerMinute: -1})
+	c.Assert(err, qt.ErrorMatches, `requests-per-minute must not be negative`)
+	_, err = ratelimit.New(ratelimit.Config{RequestsPerMinute: 1, Burst: -1})
+	c.Assert(err, qt.ErrorMatches, `burst must not be negative`)
+}
+
+func TestAllow(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.Patch(ratelimit.TimeNow, func() time.Time { return now })
+	l, err := ratelimit.New(ratelimit.Config{
+		RequestsPerMinute: 6,
+		Burst:             3,
+	})
+	c.Assert(err, qt.IsNil)
+	ctx := context.Background()
+	allow := func(key string) bool {
+		ok, err := l.Allow(ctx, key)
+		c.Assert(err, qt.IsNil)
+		return ok
+	}
+
+	// The burst is allowed straight away.
+	for i := 0; i < 3; i++ {
+		c.Assert(allow("a"), qt.IsTrue, qt.Commentf("request %d", i))
+	}
+	c.Assert(allow("a"), qt.IsFalse)
+
+	// Other keys are not affected.
+	c.Assert(allow("b"), qt.IsTrue)
+
+	// A request is allowed every 10 seconds.
+	now = now.Add(9 * time.Second)
+	c.Assert(allow("a"), qt.IsFalse)
+	now = now.Add(time.Second)
+	c.Assert(allow("a"), qt.IsTrue)
+	c.Assert(allow("a"), qt.IsFalse)
+
+	// After a long pause only the burst is allowed.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		c.Assert(allow("a"), qt.IsTrue, qt.Commentf("request %d", i))
+	}
+	c.Assert(allow("a"), qt.IsFalse)
+}
+
+func TestBurstDefaultsToRate(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.Patch(ratelimit.TimeNow, func() time.Time { return now })
+	l, err := ratelimit.New(ratelimit.Config{
+		RequestsPerMinute: 5,
+	})
+	c.Assert(err, qt.IsNil)
+	for i := 0; i < 5; i++ {
+		ok, err := l.Allow(context.Background(), "a")
+		c.Assert(err, qt.IsNil)
+		c.Assert(ok, qt.IsTrue, qt.Commentf("request %d", i))
+	}
+	ok, err := l.Allow(context.Background(), "a")
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+}
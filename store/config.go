@@ -39,6 +39,14 @@ type Backend interface {
 	// ACLs for system functions.
 	ACLStore() aclstore.ACLStore
 
+	// GroupStore returns a new GroupStore implementation that uses
+	// the backend.
+	GroupStore() GroupStore
+
+	// OutboxStore returns a new OutboxStore implementation that uses
+	// the backend.
+	OutboxStore() OutboxStore
+
 	// Close closes the Backend instance.
 	Close()
 }
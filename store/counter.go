@@ -0,0 +1,91 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "gopkg.in/errgo.v1"
+)
+
+// timeNow returns the current time. It is replaced in tests.
+var timeNow = time.Now
+
+// counter is the stored form of a counter.
+type counter struct {
+	Count   int       `json:"count"`
+	Expires time.Time `json:"expires"`
+}
+
+// decodeCounter decodes a stored counter. If the counter does not
+// exist, is corrupt, or has expired at the given time a zero counter
+// is returned.
+func decodeCounter(b []byte, now time.Time) counter {
+	var c counter
+	if len(b) == 0 {
+		return c
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		// A corrupt counter is treated as zero, it will be
+		// overwritten by the next update.
+		return counter{}
+	}
+	if !c.Expires.After(now) {
+		return counter{}
+	}
+	return c
+}
+
+// IncrementCounter atomically increments the counter with the given key
+// in the given key-value store and returns the new count. Counters are
+// safe to share between multiple servers using the same store, as long
+// as the store's Update method is atomic.
+//
+// A counter expires, and so resets to zero, once the given window has
+// passed since it was first incremented; later increments do not
+// extend the window.
+func IncrementCounter(ctx context.Context, kv simplekv.Store, key string, window time.Duration) (int, error) {
+	now := timeNow()
+	var c counter
+	err := kv.Update(ctx, key, now.Add(window), func(old []byte) ([]byte, error) {
+		c = decodeCounter(old, now)
+		if c.Count == 0 {
+			c.Expires = now.Add(window)
+		}
+		c.Count++
+		return json.Marshal(c)
+	})
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return c.Count, nil
+}
+
+// CounterValue returns the current value of the counter with the given
+// key in the given key-value store. A counter that does not exist has
+// a value of zero.
+func CounterValue(ctx context.Context, kv simplekv.Store, key string) (int, error) {
+	b, err := kv.Get(ctx, key)
+	if err != nil {
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return 0, nil
+		}
+		return 0, errgo.Mask(err)
+	}
+	return decodeCounter(b, timeNow()).Count, nil
+}
+
+// ResetCounter resets the counter with the given key in the given
+// key-value store to zero.
+func ResetCounter(ctx context.Context, kv simplekv.Store, key string) error {
+	now := timeNow()
+	b, err := json.Marshal(counter{Expires: now})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(kv.Set(ctx, key, b, now))
+}
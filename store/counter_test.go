@@ -0,0 +1,58 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/simplekv/memsimplekv"
+
+	"github.com/canonical/candid/store"
+)
+
+func TestIncrementCounterExpires(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	now := time.Now()
+	c.Patch(store.TimeNow, func() time.Time { return now })
+	kv := memsimplekv.NewStore()
+
+	n, err := store.IncrementCounter(ctx, kv, "test-counter", time.Minute)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+
+	// Later increments do not extend the window.
+	now = now.Add(50 * time.Second)
+	n, err = store.IncrementCounter(ctx, kv, "test-counter", time.Minute)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 2)
+
+	// Once the window has passed the counter is reset.
+	now = now.Add(20 * time.Second)
+	n, err = store.CounterValue(ctx, kv, "test-counter")
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+	n, err = store.IncrementCounter(ctx, kv, "test-counter", time.Minute)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+}
+
+func TestResetCounter(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+
+	for i := 0; i < 3; i++ {
+		_, err := store.IncrementCounter(ctx, kv, "test-counter", time.Minute)
+		c.Assert(err, qt.IsNil)
+	}
+	err := store.ResetCounter(ctx, kv, "test-counter")
+	c.Assert(err, qt.IsNil)
+	n, err := store.CounterValue(ctx, kv, "test-counter")
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"net/mail"
+	"strings"
+	"unicode"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// An EmailValidation determines how email addresses are checked and
+// normalized before they are stored.
+type EmailValidation string
+
+const (
+	// EmailLenient normalizes email addresses and rejects only those
+	// that are clearly invalid, for example because they have no
+	// "@" or contain whitespace. This is the default.
+	EmailLenient EmailValidation = "lenient"
+
+	// EmailStrict normalizes email addresses and rejects any that
+	// are not a plain address with a fully qualified domain.
+	EmailStrict EmailValidation = "strict"
+
+	// EmailNone stores email addresses exactly as they are given.
+	EmailNone EmailValidation = "none"
+)
+
+// Validate checks that v is one of the known validation levels. The
+// empty level is valid and is equivalent to EmailLenient.
+func (v EmailValidation) Validate() error {
+	switch v {
+	case "", EmailLenient, EmailStrict, EmailNone:
+		return nil
+	}
+	return errgo.Newf("invalid email validation %q", v)
+}
+
+// Check normalizes the given email address and checks that it is valid
+// at the validation level v. An empty address is always valid. If the
+// address is invalid an error is returned.
+func (v EmailValidation) Check(email string) (string, error) {
+	if v == EmailNone || email == "" {
+		return email, nil
+	}
+	email = NormalizeEmail(email)
+	i := strings.LastIndex(email, "@")
+	if i <= 0 || i == len(email)-1 || strings.IndexFunc(email, isSpaceOrControl) >= 0 {
+		return "", errgo.Newf("invalid email address %q", email)
+	}
+	if v != EmailStrict {
+		return email, nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email || !strings.Contains(email[i+1:], ".") {
+		return "", errgo.Newf("invalid email address %q", email)
+	}
+	return email, nil
+}
+
+// NormalizeEmail returns the normalized form of the given email
+// address. Surrounding whitespace is removed and the domain is
+// converted to lower case. The local part is left unchanged as it may
+// be case sensitive.
+func NormalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		email = email[:i+1] + strings.ToLower(email[i+1:])
+	}
+	return email
+}
+
+func isSpaceOrControl(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsControl(r)
+}
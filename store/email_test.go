@@ -0,0 +1,85 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/store"
+)
+
+var emailValidationTests = []struct {
+	email       string
+	validation  store.EmailValidation
+	expectEmail string
+	expectError string
+}{{
+	email:       "",
+	validation:  store.EmailStrict,
+	expectEmail: "",
+}, {
+	email:       " Bob@Example.COM ",
+	validation:  "",
+	expectEmail: "Bob@example.com",
+}, {
+	email:       " Bob@Example.COM ",
+	validation:  store.EmailStrict,
+	expectEmail: "Bob@example.com",
+}, {
+	email:       " Bob@Example.COM ",
+	validation:  store.EmailNone,
+	expectEmail: " Bob@Example.COM ",
+}, {
+	email:       "bob@localhost",
+	validation:  store.EmailLenient,
+	expectEmail: "bob@localhost",
+}, {
+	email:       "bob@localhost",
+	validation:  store.EmailStrict,
+	expectError: `invalid email address "bob@localhost"`,
+}, {
+	email:       "Bob <bob@example.com>",
+	validation:  store.EmailLenient,
+	expectError: `invalid email address "Bob <bob@example.com>"`,
+}, {
+	email:       "bob",
+	validation:  store.EmailLenient,
+	expectError: `invalid email address "bob"`,
+}, {
+	email:       "@example.com",
+	validation:  store.EmailLenient,
+	expectError: `invalid email address "@example.com"`,
+}, {
+	email:       "bob@",
+	validation:  store.EmailLenient,
+	expectError: `invalid email address "bob@"`,
+}, {
+	email:       "bob",
+	validation:  store.EmailNone,
+	expectEmail: "bob",
+}}
+
+func TestEmailValidationCheck(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range emailValidationTests {
+		c.Run(string(test.validation)+"/"+test.email, func(c *qt.C) {
+			email, err := test.validation.Check(test.email)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(email, qt.Equals, test.expectEmail)
+		})
+	}
+}
+
+func TestEmailValidationValidate(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(store.EmailValidation("").Validate(), qt.IsNil)
+	c.Assert(store.EmailStrict.Validate(), qt.IsNil)
+	c.Assert(store.EmailValidation("paranoid").Validate(), qt.ErrorMatches, `invalid email validation "paranoid"`)
+}
@@ -17,6 +17,15 @@ var (
 	// ErrDuplicateUsername is the error cause used when an update
 	// attempts to set a username that is already in use.
 	ErrDuplicateUsername = errgo.New("duplicate username")
+
+	// ErrReadOnly is the error cause used when an update cannot be
+	// written because the store is temporarily only available for
+	// reading, for example during a database failover.
+	ErrReadOnly = errgo.New("store is read-only")
+
+	// ErrNotSupported is the error cause used when the store does
+	// not support an operation.
+	ErrNotSupported = errgo.New("not supported")
 )
 
 // NotFoundError creates a new error with a cause of ErrNotFound and an
@@ -51,3 +60,11 @@ func KeyNotFoundError(key string) error {
 	err.(*errgo.Err).SetLocation(1)
 	return err
 }
+
+// ReadOnlyError creates a new error with a cause of ErrReadOnly that
+// wraps the given underlying error.
+func ReadOnlyError(err error) error {
+	err = errgo.WithCausef(err, ErrReadOnly, "store is read-only")
+	err.(*errgo.Err).SetLocation(1)
+	return err
+}
@@ -34,3 +34,10 @@ func TestDuplicateUsernameError(t *testing.T) {
 	c.Assert(errgo.Cause(err), qt.Equals, store.ErrDuplicateUsername)
 	c.Assert(err, qt.ErrorMatches, `username test-user already in use`)
 }
+
+func TestReadOnlyError(t *testing.T) {
+	c := qt.New(t)
+	err := store.ReadOnlyError(errgo.New("not master"))
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrReadOnly)
+	c.Assert(err, qt.ErrorMatches, `store is read-only: not master`)
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"context"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// A Group holds the descriptive record of a group. Identities refer to
+// groups by name only, so a group may have members whether or not it
+// has a record, and removing a record does not change the membership
+// of any identity.
+type Group struct {
+	// Name holds the name of the group.
+	Name string
+
+	// Description holds a human-readable description of the group.
+	Description string
+
+	// Metadata holds arbitrary key/value information about the
+	// group, for example its owner or purpose.
+	Metadata map[string]string
+}
+
+// A GroupStore stores group records.
+type GroupStore interface {
+	// Group reads the record of the group with the name in the given
+	// group and completes all the fields. If there is no record for
+	// the group then an error with a cause of ErrNotFound will be
+	// returned.
+	Group(ctx context.Context, group *Group) error
+
+	// FindGroups returns all the stored group records, sorted by
+	// name.
+	FindGroups(ctx context.Context) ([]Group, error)
+
+	// UpdateGroup stores the given group record, replacing any
+	// existing record with the same name.
+	UpdateGroup(ctx context.Context, group *Group) error
+
+	// RemoveGroup removes the record of the group with the given
+	// name. If there is no record for the group then an error with a
+	// cause of ErrNotFound will be returned.
+	RemoveGroup(ctx context.Context, name string) error
+}
+
+// GroupNotFoundError creates a new error with a cause of ErrNotFound
+// and an appropriate message.
+func GroupNotFoundError(name string) error {
+	err := errgo.WithCausef(nil, ErrNotFound, "group %q not found", name)
+	err.(*errgo.Err).SetLocation(1)
+	return err
+}
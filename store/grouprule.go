@@ -0,0 +1,102 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"strings"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// providerInfoPrefix is the prefix of GroupRule attributes that refer
+// to a provider-info item. Extra-info items are not supported because
+// users can write their own extra-info.
+const providerInfoPrefix = "provider-info."
+
+// A GroupRule adds an identity to a group when one of the identity's
+// attributes has a particular value. Groups derived from rules are not
+// stored with the identity, they are evaluated whenever the effective
+// groups of the identity are determined.
+type GroupRule struct {
+	// Group contains the group that matching identities are members
+	// of.
+	Group string `yaml:"group"`
+
+	// Attribute contains the name of the identity attribute to
+	// match. This can be one of "username", "name", "email",
+	// "email-domain" or "provider", or "provider-info." followed by
+	// the key of an item recorded by the identity provider.
+	Attribute string `yaml:"attribute"`
+
+	// Value contains the value that the attribute must have for the
+	// rule to match. For a provider-info item holding more than one
+	// value, the rule matches if any of them has the value.
+	Value string `yaml:"value"`
+}
+
+// Validate checks that the rule is well formed.
+func (r GroupRule) Validate() error {
+	if r.Group == "" {
+		return errgo.New("group rule has no group")
+	}
+	if !ValidAttribute(r.Attribute) {
+		return errgo.Newf("invalid group rule attribute %q", r.Attribute)
+	}
+	return nil
+}
+
+// Match reports whether the given identity matches the rule.
+func (r GroupRule) Match(id *Identity) bool {
+	return MatchAttribute(id, r.Attribute, r.Value)
+}
+
+// ValidAttribute reports whether the given name is an identity
+// attribute that can be matched by MatchAttribute.
+func ValidAttribute(attr string) bool {
+	switch attr {
+	case "username", "name", "email", "email-domain", "provider":
+		return true
+	}
+	return strings.HasPrefix(attr, providerInfoPrefix) && len(attr) > len(providerInfoPrefix)
+}
+
+// MatchAttribute reports whether the given attribute of the given
+// identity has the given value. See GroupRule for the supported
+// attributes.
+func MatchAttribute(id *Identity, attr, value string) bool {
+	switch attr {
+	case "username":
+		return id.Username == value
+	case "name":
+		return id.Name == value
+	case "email":
+		return id.Email != "" && strings.EqualFold(id.Email, value)
+	case "email-domain":
+		i := strings.LastIndex(id.Email, "@")
+		return i >= 0 && strings.EqualFold(id.Email[i+1:], value)
+	case "provider":
+		return id.ProviderID.Provider() == value
+	}
+	if !strings.HasPrefix(attr, providerInfoPrefix) {
+		return false
+	}
+	for _, v := range id.ProviderInfo[strings.TrimPrefix(attr, providerInfoPrefix)] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleGroups returns the groups that the given rules add to the given
+// identity, in the order that the rules are specified.
+func RuleGroups(rules []GroupRule, id *Identity) []string {
+	var groups []string
+	for _, r := range rules {
+		if r.Match(id) {
+			groups = append(groups, r.Group)
+		}
+	}
+	return groups
+}
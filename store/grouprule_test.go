@@ -0,0 +1,95 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/store"
+)
+
+var groupRuleIdentity = &store.Identity{
+	ProviderID: store.MakeProviderIdentity("google", "bob"),
+	Username:   "bob",
+	Name:       "Bob Example",
+	Email:      "Bob@Example.com",
+	ProviderInfo: map[string][]string{
+		"department": {"engineering"},
+		"teams":      {"red", "blue"},
+	},
+	ExtraInfo: map[string][]string{
+		"department": {`"sales"`},
+	},
+}
+
+var groupRuleMatchTests = []struct {
+	rule        store.GroupRule
+	expectMatch bool
+}{{
+	rule:        store.GroupRule{Group: "g", Attribute: "username", Value: "bob"},
+	expectMatch: true,
+}, {
+	rule: store.GroupRule{Group: "g", Attribute: "username", Value: "alice"},
+}, {
+	rule:        store.GroupRule{Group: "g", Attribute: "name", Value: "Bob Example"},
+	expectMatch: true,
+}, {
+	rule:        store.GroupRule{Group: "g", Attribute: "email", Value: "bob@example.com"},
+	expectMatch: true,
+}, {
+	rule:        store.GroupRule{Group: "g", Attribute: "email-domain", Value: "example.com"},
+	expectMatch: true,
+}, {
+	rule: store.GroupRule{Group: "g", Attribute: "email-domain", Value: "example.org"},
+}, {
+	rule:        store.GroupRule{Group: "g", Attribute: "provider", Value: "google"},
+	expectMatch: true,
+}, {
+	rule:        store.GroupRule{Group: "g", Attribute: "provider-info.department", Value: "engineering"},
+	expectMatch: true,
+}, {
+	rule: store.GroupRule{Group: "g", Attribute: "provider-info.department", Value: "sales"},
+}, {
+	rule:        store.GroupRule{Group: "g", Attribute: "provider-info.teams", Value: "blue"},
+	expectMatch: true,
+}, {
+	rule: store.GroupRule{Group: "g", Attribute: "provider-info.teams", Value: "green"},
+}, {
+	rule: store.GroupRule{Group: "g", Attribute: "provider-info.missing", Value: ""},
+}}
+
+func TestGroupRuleMatch(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range groupRuleMatchTests {
+		c.Run(test.rule.Attribute+"="+test.rule.Value, func(c *qt.C) {
+			c.Assert(test.rule.Validate(), qt.IsNil)
+			c.Assert(test.rule.Match(groupRuleIdentity), qt.Equals, test.expectMatch)
+		})
+	}
+}
+
+func TestGroupRuleValidate(t *testing.T) {
+	c := qt.New(t)
+	err := store.GroupRule{Attribute: "username"}.Validate()
+	c.Assert(err, qt.ErrorMatches, `group rule has no group`)
+	err = store.GroupRule{Group: "g", Attribute: "phone"}.Validate()
+	c.Assert(err, qt.ErrorMatches, `invalid group rule attribute "phone"`)
+	err = store.GroupRule{Group: "g", Attribute: "provider-info."}.Validate()
+	c.Assert(err, qt.ErrorMatches, `invalid group rule attribute "provider-info."`)
+	// Users can write their own extra-info, so it cannot be used.
+	err = store.GroupRule{Group: "g", Attribute: "extra-info.department"}.Validate()
+	c.Assert(err, qt.ErrorMatches, `invalid group rule attribute "extra-info.department"`)
+}
+
+func TestRuleGroups(t *testing.T) {
+	c := qt.New(t)
+	groups := store.RuleGroups([]store.GroupRule{
+		{Group: "staff", Attribute: "email-domain", Value: "example.com"},
+		{Group: "admins", Attribute: "username", Value: "alice"},
+		{Group: "eng", Attribute: "provider-info.department", Value: "engineering"},
+	}, groupRuleIdentity)
+	c.Assert(groups, qt.DeepEquals, []string{"staff", "eng"})
+}
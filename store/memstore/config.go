@@ -18,6 +18,8 @@ func init() {
 			providerData: NewProviderDataStore(),
 			meetingStore: NewMeetingStore(),
 			aclStore:     aclstore.NewACLStore(memsimplekv.NewStore()),
+			groupStore:   NewGroupStore(),
+			outboxStore:  NewOutboxStore(),
 		}, nil
 	})
 }
@@ -28,6 +30,8 @@ type backend struct {
 	rootKeys     bakery.RootKeyStore
 	meetingStore meeting.Store
 	aclStore     aclstore.ACLStore
+	groupStore   store.GroupStore
+	outboxStore  store.OutboxStore
 }
 
 // NewBackend implements store.BackendFactory.NewBackend.
@@ -64,5 +68,15 @@ func (b *backend) ACLStore() aclstore.ACLStore {
 	return b.aclStore
 }
 
+// GroupStore implements store.Backend.GroupStore.
+func (b *backend) GroupStore() store.GroupStore {
+	return b.groupStore
+}
+
+// OutboxStore implements store.Backend.OutboxStore.
+func (b *backend) OutboxStore() store.OutboxStore {
+	return b.outboxStore
+}
+
 func (b *backend) Close() {
 }
@@ -0,0 +1,82 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package memstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/canonical/candid/store"
+)
+
+// NewGroupStore creates a new in-memory store.GroupStore
+// implementation.
+func NewGroupStore() store.GroupStore {
+	return &groupStore{
+		groups: make(map[string]store.Group),
+	}
+}
+
+type groupStore struct {
+	mu     sync.Mutex
+	groups map[string]store.Group
+}
+
+// Group implements store.GroupStore.Group.
+func (s *groupStore) Group(_ context.Context, group *store.Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[group.Name]
+	if !ok {
+		return store.GroupNotFoundError(group.Name)
+	}
+	*group = copyGroup(g)
+	return nil
+}
+
+// FindGroups implements store.GroupStore.FindGroups.
+func (s *groupStore) FindGroups(_ context.Context) ([]store.Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	groups := make([]store.Group, 0, len(s.groups))
+	for _, g := range s.groups {
+		groups = append(groups, copyGroup(g))
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+// UpdateGroup implements store.GroupStore.UpdateGroup.
+func (s *groupStore) UpdateGroup(_ context.Context, group *store.Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[group.Name] = copyGroup(*group)
+	return nil
+}
+
+// RemoveGroup implements store.GroupStore.RemoveGroup.
+func (s *groupStore) RemoveGroup(_ context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.groups[name]; !ok {
+		return store.GroupNotFoundError(name)
+	}
+	delete(s.groups, name)
+	return nil
+}
+
+func copyGroup(g store.Group) store.Group {
+	var md map[string]string
+	if len(g.Metadata) > 0 {
+		md = make(map[string]string, len(g.Metadata))
+		for k, v := range g.Metadata {
+			md[k] = v
+		}
+	}
+	g.Metadata = md
+	return g
+}
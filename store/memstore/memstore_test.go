@@ -49,6 +49,24 @@ func TestACLStore(t *testing.T) {
 	})
 }
 
+func TestGroupStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestGroupStore(c, func(c *qt.C) store.GroupStore {
+		return memstore.NewGroupStore()
+	})
+}
+
+func TestOutboxStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestOutboxStore(c, func(c *qt.C) store.OutboxStore {
+		return memstore.NewOutboxStore()
+	})
+}
+
 func TestConfigUnmarshal(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
@@ -0,0 +1,124 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package memstore
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/canonical/candid/store"
+)
+
+// NewOutboxStore creates a new in-memory store.OutboxStore
+// implementation.
+func NewOutboxStore() store.OutboxStore {
+	return &outboxStore{}
+}
+
+type outboxStore struct {
+	mu       sync.Mutex
+	nextID   int
+	messages []store.OutboxMessage
+}
+
+// Add implements store.OutboxStore.Add.
+func (s *outboxStore) Add(_ context.Context, m *store.OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.ID = strconv.Itoa(s.nextID)
+	s.nextID++
+	s.messages = append(s.messages, copyOutboxMessage(*m))
+	return nil
+}
+
+// Claim implements store.OutboxStore.Claim.
+func (s *outboxStore) Claim(_ context.Context, now, leaseUntil time.Time) (*store.OutboxMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.messages {
+		m := &s.messages[i]
+		if m.NextAttempt.After(now) || !m.Expires.After(now) {
+			continue
+		}
+		claimed := copyOutboxMessage(*m)
+		m.NextAttempt = leaseUntil
+		return &claimed, nil
+	}
+	return nil, nil
+}
+
+// Retry implements store.OutboxStore.Retry.
+func (s *outboxStore) Retry(_ context.Context, id string, attempts int, next time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.index(id); i >= 0 {
+		s.messages[i].Attempts = attempts
+		s.messages[i].NextAttempt = next
+	}
+	return nil
+}
+
+// Remove implements store.OutboxStore.Remove.
+func (s *outboxStore) Remove(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.index(id); i >= 0 {
+		s.messages = append(s.messages[:i], s.messages[i+1:]...)
+	}
+	return nil
+}
+
+// RemoveOldest implements store.OutboxStore.RemoveOldest.
+func (s *outboxStore) RemoveOldest(_ context.Context) (*store.OutboxMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.messages) == 0 {
+		return nil, nil
+	}
+	m := s.messages[0]
+	s.messages = s.messages[1:]
+	return &m, nil
+}
+
+// RemoveExpired implements store.OutboxStore.RemoveExpired.
+func (s *outboxStore) RemoveExpired(_ context.Context, now time.Time) ([]store.OutboxMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []store.OutboxMessage
+	messages := s.messages[:0]
+	for _, m := range s.messages {
+		if m.Expires.After(now) {
+			messages = append(messages, m)
+		} else {
+			expired = append(expired, m)
+		}
+	}
+	s.messages = messages
+	return expired, nil
+}
+
+// Count implements store.OutboxStore.Count.
+func (s *outboxStore) Count(_ context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages), nil
+}
+
+// index returns the index of the message with the given ID, or -1 if
+// there is no such message.
+func (s *outboxStore) index(id string) int {
+	for i, m := range s.messages {
+		if m.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func copyOutboxMessage(m store.OutboxMessage) store.OutboxMessage {
+	m.Data = append([]byte(nil), m.Data...)
+	return m
+}
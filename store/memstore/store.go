@@ -21,7 +21,11 @@ import (
 )
 
 type memStore struct {
-	mu         sync.Mutex
+	mu sync.Mutex
+
+	// identities holds the stored identities indexed by ID. The
+	// entry for an identity that has been removed is nil so that IDs
+	// are never reused.
 	identities []*store.Identity
 }
 
@@ -41,14 +45,12 @@ var adminID = store.MakeProviderIdentity("idm", "admin")
 // RemoveAll is implemented so that tests can clear out the data.
 // It removes all identities except the admin identity created at
 // init time.
-// TODO provide a standard store.Store way of removing
-// identities.
 func (s *memStore) RemoveAll() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	var identities []*store.Identity
 	for _, identity := range s.identities {
-		if identity.ProviderID == adminID {
+		if identity != nil && identity.ProviderID == adminID {
 			identities = append(identities, identity)
 		}
 	}
@@ -63,7 +65,7 @@ func (s *memStore) Identity(_ context.Context, identity *store.Identity) error {
 	switch {
 	case identity.ID != "":
 		n, err := strconv.Atoi(identity.ID)
-		if err != nil || n >= len(s.identities) {
+		if err != nil || n >= len(s.identities) || s.identities[n] == nil {
 			return store.NotFoundError(identity.ID, "", "")
 		}
 		id = s.identities[n]
@@ -88,7 +90,7 @@ func (s *memStore) Identity(_ context.Context, identity *store.Identity) error {
 // with the given providerID.
 func (s *memStore) identityFromProviderID(providerID store.ProviderIdentity) *store.Identity {
 	for _, id := range s.identities {
-		if id.ProviderID == providerID {
+		if id != nil && id.ProviderID == providerID {
 			return id
 		}
 	}
@@ -99,7 +101,7 @@ func (s *memStore) identityFromProviderID(providerID store.ProviderIdentity) *st
 // with the given username.
 func (s *memStore) identityFromUsername(username string) *store.Identity {
 	for _, id := range s.identities {
-		if id.Username == username {
+		if id != nil && id.Username == username {
 			return id
 		}
 	}
@@ -112,7 +114,7 @@ func (s *memStore) FindIdentities(ctx context.Context, ref *store.Identity, filt
 	defer s.mu.Unlock()
 	identities := make([]store.Identity, 0, len(s.identities))
 	for _, identity := range s.identities {
-		if !matchIdentity(identity, ref, filter) {
+		if identity == nil || !matchIdentity(identity, ref, filter) {
 			continue
 		}
 		var identity1 store.Identity
@@ -140,6 +142,12 @@ func matchIdentity(a, b *store.Identity, filter store.Filter) bool {
 		if c == store.NoComparison {
 			continue
 		}
+		if c == store.HasPrefix {
+			if !strings.HasPrefix(stringField(a, store.Field(f)), stringField(b, store.Field(f))) {
+				return false
+			}
+			continue
+		}
 		var r int
 		switch store.Field(f) {
 		case store.ProviderID:
@@ -148,6 +156,8 @@ func matchIdentity(a, b *store.Identity, filter store.Filter) bool {
 			r = strings.Compare(a.Username, b.Username)
 		case store.Name:
 			r = strings.Compare(a.Name, b.Name)
+		case store.FoldedName:
+			r = strings.Compare(store.FoldName(a.Name), store.FoldName(b.Name))
 		case store.Email:
 			r = strings.Compare(a.Email, b.Email)
 		case store.LastLogin:
@@ -156,6 +166,8 @@ func matchIdentity(a, b *store.Identity, filter store.Filter) bool {
 			r = cmpTime(a.LastDischarge, b.LastDischarge)
 		case store.Owner:
 			r = strings.Compare(string(a.Owner), string(b.Owner))
+		case store.Source:
+			r = strings.Compare(a.Source, b.Source)
 		default:
 			panic("unsupported filter field")
 		}
@@ -166,6 +178,27 @@ func matchIdentity(a, b *store.Identity, filter store.Filter) bool {
 	return true
 }
 
+// stringField returns the value of the given string field in the
+// given identity.
+func stringField(id *store.Identity, f store.Field) string {
+	switch f {
+	case store.ProviderID:
+		return string(id.ProviderID)
+	case store.Username:
+		return id.Username
+	case store.Name:
+		return id.Name
+	case store.Email:
+		return id.Email
+	case store.Owner:
+		return string(id.Owner)
+	case store.Source:
+		return id.Source
+	default:
+		panic("unsupported prefix field")
+	}
+}
+
 // matchCmp determines whether the given value n which is a result of a
 // "cmp" function such as strings.Compare indicates that the compared
 // values have the relationship specified by the given store.Comparison.
@@ -257,7 +290,7 @@ func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, u
 	switch {
 	case identity.ID != "":
 		n, err := strconv.Atoi(identity.ID)
-		if err != nil || n >= len(s.identities) {
+		if err != nil || n >= len(s.identities) || s.identities[n] == nil {
 			return store.NotFoundError(identity.ID, "", "")
 		}
 		id = s.identities[n]
@@ -277,6 +310,9 @@ func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, u
 			if err := s.updateIdentity(id, identity, update); err != nil {
 				return errgo.Mask(err, errgo.Is(store.ErrDuplicateUsername))
 			}
+			if update[store.Source] == store.Set {
+				id.Source = identity.Source
+			}
 			s.identities = append(s.identities, id)
 			identity.ID = id.ID
 			return nil
@@ -292,6 +328,30 @@ func (s *memStore) UpdateIdentity(_ context.Context, identity *store.Identity, u
 	return errgo.Mask(s.updateIdentity(id, identity, update), errgo.Is(store.ErrDuplicateUsername))
 }
 
+// RemoveIdentity implements store.IdentityRemover.RemoveIdentity.
+func (s *memStore) RemoveIdentity(_ context.Context, identity *store.Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var id *store.Identity
+	switch {
+	case identity.ID != "":
+		n, err := strconv.Atoi(identity.ID)
+		if err == nil && n < len(s.identities) {
+			id = s.identities[n]
+		}
+	case identity.ProviderID != "":
+		id = s.identityFromProviderID(identity.ProviderID)
+	case identity.Username != "":
+		id = s.identityFromUsername(identity.Username)
+	}
+	if id == nil {
+		return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+	}
+	n, _ := strconv.Atoi(id.ID)
+	s.identities[n] = nil
+	return nil
+}
+
 func (s *memStore) updateIdentity(dst, src *store.Identity, update store.Update) error {
 	if update[store.ProviderID] != store.NoUpdate {
 		panic(errgo.Newf("unsupported operation %v requested on ProviderID field", update[store.ProviderID]))
@@ -310,12 +370,18 @@ func (s *memStore) updateIdentity(dst, src *store.Identity, update store.Update)
 	dst.Name = updateString(dst.Name, src.Name, update[store.Name])
 	dst.Email = updateString(dst.Email, src.Email, update[store.Email])
 	dst.Groups = updateStrings(dst.Groups, src.Groups, update[store.Groups])
+	dst.Roles = updateStrings(dst.Roles, src.Roles, update[store.Roles])
+	dst.AdminDisabled = updateBool(dst.AdminDisabled, src.AdminDisabled, update[store.AdminDisabled])
 	dst.PublicKeys = updateKeys(dst.PublicKeys, src.PublicKeys, update[store.PublicKeys])
 	dst.LastDischarge = updateTime(dst.LastDischarge, src.LastDischarge, update[store.LastDischarge])
 	dst.LastLogin = updateTime(dst.LastLogin, src.LastLogin, update[store.LastLogin])
 	dst.ProviderInfo = updateMap(dst.ProviderInfo, src.ProviderInfo, update[store.ProviderInfo])
 	dst.ExtraInfo = updateMap(dst.ExtraInfo, src.ExtraInfo, update[store.ExtraInfo])
 	dst.Owner = updateProviderIdentity(dst.Owner, src.Owner, update[store.Owner])
+	if update != (store.Update{}) {
+		dst.Version++
+		dst.Modified = time.Now()
+	}
 	return nil
 }
 
@@ -358,6 +424,19 @@ func updateTime(dst, src time.Time, op store.Operation) time.Time {
 	}
 }
 
+func updateBool(dst, src bool, op store.Operation) bool {
+	switch op {
+	case store.NoUpdate:
+		return dst
+	case store.Set:
+		return src
+	case store.Clear:
+		return false
+	default:
+		panic("unsupported operation requested on bool field")
+	}
+}
+
 func updateStrings(dst, src []string, op store.Operation) []string {
 	switch op {
 	case store.NoUpdate:
@@ -447,6 +526,7 @@ func updateMap(dst, src map[string][]string, op store.Operation) map[string][]st
 func copyIdentity(dst, src *store.Identity) {
 	*dst = *src
 	dst.Groups = updateStrings(nil, src.Groups, store.Set)
+	dst.Roles = updateStrings(nil, src.Roles, store.Set)
 	dst.PublicKeys = updateKeys(nil, src.PublicKeys, store.Set)
 	dst.ProviderInfo = updateMap(make(map[string][]string), src.ProviderInfo, store.Set)
 	dst.ExtraInfo = updateMap(make(map[string][]string), src.ExtraInfo, store.Set)
@@ -458,6 +538,9 @@ func (s *memStore) IdentityCounts(_ context.Context) (map[string]int, error) {
 	defer s.mu.Unlock()
 	counts := make(map[string]int)
 	for _, id := range s.identities {
+		if id == nil {
+			continue
+		}
 		counts[id.ProviderID.Provider()]++
 	}
 	return counts, nil
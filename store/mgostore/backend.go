@@ -5,6 +5,8 @@ package mgostore
 
 import (
 	"context"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/aclstore/v2"
@@ -25,15 +27,38 @@ const aclsCollection = "acls"
 // can be used as the persistent storage for the various types of store
 // required by the identity service.
 type backend struct {
-	db       *mgo.Database
-	rootKeys *mgorootkeystore.RootKeys
-	aclStore aclstore.ACLStore
+	db             *mgo.Database
+	rootKeys       *mgorootkeystore.RootKeys
+	aclStore       aclstore.ACLStore
+	readMode       mgo.Mode
+	readAfterWrite bool
+}
+
+// BackendParams holds optional parameters for a mongodb backend.
+type BackendParams struct {
+	// ReadPreference holds the read preference used for read-only
+	// identity queries, see Params.ReadPreference for details.
+	ReadPreference string
+
+	// ReadAfterWrite, if set, causes identity reads that follow a
+	// write using the same context to be sent to the primary.
+	ReadAfterWrite bool
 }
 
 // NewBackend creates a new Backend instance using the given
 // *mgo.Database. The given Database's underlying session will be
 // copied. The Backend must be closed when finished with.
 func NewBackend(db *mgo.Database) (_ store.Backend, err error) {
+	return NewBackendWithParams(db, BackendParams{})
+}
+
+// NewBackendWithParams is like NewBackend except that it takes
+// additional parameters that affect how the database is queried.
+func NewBackendWithParams(db *mgo.Database, p BackendParams) (_ store.Backend, err error) {
+	readMode, err := parseReadPreference(p.ReadPreference)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
 	db = db.With(db.Session.Copy())
 	defer func() {
 		if err != nil {
@@ -47,6 +72,9 @@ func NewBackend(db *mgo.Database) (_ store.Backend, err error) {
 	if err := ensureMeetingIndexes(db); err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if err := ensureOutboxIndexes(db); err != nil {
+		return nil, errgo.Mask(err)
+	}
 	rk := mgorootkeystore.NewRootKeys(1000) // TODO(mhilton) make this configurable?
 	if err := ensureBakeryIndexes(rk, db); err != nil {
 		return nil, errgo.Mask(err)
@@ -56,9 +84,11 @@ func NewBackend(db *mgo.Database) (_ store.Backend, err error) {
 		return nil, errgo.Mask(err)
 	}
 	return &backend{
-		db:       db,
-		rootKeys: rk,
-		aclStore: aclstore.NewACLStore(aclStore),
+		db:             db,
+		rootKeys:       rk,
+		aclStore:       aclstore.NewACLStore(aclStore),
+		readMode:       readMode,
+		readAfterWrite: p.ReadAfterWrite,
 	}, nil
 }
 
@@ -73,21 +103,31 @@ func (b *backend) Close() {
 // information is already available. The return close function should
 // always be called once the context is not longer needed.
 func (b *backend) context(ctx context.Context) (_ context.Context, close func()) {
-	if s, _ := ctx.Value(sessionKey{}).(*mgo.Session); s != nil {
+	if st, _ := ctx.Value(sessionKey{}).(*sessionState); st != nil {
 		return ctx, func() {}
 	}
 	// TODO (mhilton) add some more advanced session pooling.
 	s := b.db.Session.Copy()
-	return context.WithValue(ctx, sessionKey{}, s), s.Close
+	return context.WithValue(ctx, sessionKey{}, &sessionState{session: s}), s.Close
 }
 
 type sessionKey struct{}
 
+// sessionState holds the session information attached to a context.
+type sessionState struct {
+	session *mgo.Session
+
+	// written is set to 1 once any writes have been made using the
+	// context. The context may be shared between goroutines, so it
+	// must be accessed atomically.
+	written int32
+}
+
 // s returns a *mgo.Session for use in subsequent queries. The returned
 // session must be closed once finished with.
 func (b *backend) s(ctx context.Context) *mgo.Session {
-	if s, _ := ctx.Value(sessionKey{}).(*mgo.Session); s != nil {
-		return s.Clone()
+	if st, _ := ctx.Value(sessionKey{}).(*sessionState); st != nil {
+		return st.session.Clone()
 	}
 	return b.db.Session.Copy()
 }
@@ -99,6 +139,33 @@ func (b *backend) c(ctx context.Context, name string) *mgo.Collection {
 	return b.db.C(name).With(b.s(ctx))
 }
 
+// readC is like c except that the returned collection should only be
+// used for reading. Queries using the returned collection will use the
+// configured read preference, unless read-after-write consistency is
+// required and a write has already been made using the given context.
+func (b *backend) readC(ctx context.Context, name string) *mgo.Collection {
+	s := b.s(ctx)
+	if b.readMode != mgo.Primary && !(b.readAfterWrite && written(ctx)) {
+		s.SetMode(b.readMode, true)
+	}
+	return b.db.C(name).With(s)
+}
+
+// setWritten records that a write has been made using the given
+// context.
+func setWritten(ctx context.Context) {
+	if st, _ := ctx.Value(sessionKey{}).(*sessionState); st != nil {
+		atomic.StoreInt32(&st.written, 1)
+	}
+}
+
+// written reports whether a write has been made using the given
+// context.
+func written(ctx context.Context) bool {
+	st, _ := ctx.Value(sessionKey{}).(*sessionState)
+	return st != nil && atomic.LoadInt32(&st.written) != 0
+}
+
 // Store implements store.Backend.Store.
 func (b *backend) Store() store.Store {
 	return &identityStore{b}
@@ -129,14 +196,39 @@ func (b *backend) DebugStatusCheckerFuncs() []debugstatus.CheckerFunc {
 	return []debugstatus.CheckerFunc{
 		debugstatus.MongoCollections(collector{b.db}),
 		b.meetingStatus,
+		b.serverStatus,
 	}
 }
 
+// serverStatus reports the mongodb servers that the backend is
+// currently connected to.
+func (b *backend) serverStatus(context.Context) (key string, result debugstatus.CheckResult) {
+	result.Name = "MongoDB servers"
+	servers := b.db.Session.LiveServers()
+	if len(servers) == 0 {
+		result.Value = "no live servers"
+		return "mongo_servers", result
+	}
+	result.Value = strings.Join(servers, ", ")
+	result.Passed = true
+	return "mongo_servers", result
+}
+
 // ACLStore implements store.Backend.ACLStore.
 func (b *backend) ACLStore() aclstore.ACLStore {
 	return b.aclStore
 }
 
+// GroupStore implements store.Backend.GroupStore.
+func (b *backend) GroupStore() store.GroupStore {
+	return &groupStore{b}
+}
+
+// OutboxStore implements store.Backend.OutboxStore.
+func (b *backend) OutboxStore() store.OutboxStore {
+	return &outboxStore{b}
+}
+
 type collector struct {
 	db *mgo.Database
 }
@@ -148,6 +240,7 @@ func (c collector) Collections() []*mgo.Collection {
 		c.db.C(meetingCollection),
 		c.db.C(identitiesCollection),
 		c.db.C(aclsCollection),
+		c.db.C(outboxCollection),
 	}
 }
 
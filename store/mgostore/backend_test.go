@@ -2,6 +2,7 @@ package mgostore_test
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
@@ -42,3 +43,28 @@ func TestNewBackend(t *testing.T) {
 	err = backend.ACLStore().CreateACL(ctx, "test", []string{"test"})
 	c.Assert(err, qt.IsNil)
 }
+
+func TestWrittenConcurrent(t *testing.T) {
+	c := qt.New(t)
+
+	ctx := mgostore.ContextWithSessionState(context.Background())
+	c.Assert(mgostore.Written(ctx), qt.Equals, false)
+
+	// Writes and reads may be made concurrently using the same
+	// context. Run with -race to check that recording the writes
+	// is safe.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			mgostore.SetWritten(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			mgostore.Written(ctx)
+		}()
+	}
+	wg.Wait()
+	c.Assert(mgostore.Written(ctx), qt.Equals, true)
+}
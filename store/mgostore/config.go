@@ -1,6 +1,12 @@
 package mgostore
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"time"
+
 	errgo "gopkg.in/errgo.v1"
 	mgo "gopkg.in/mgo.v2"
 
@@ -17,6 +23,80 @@ type Params struct {
 	// Database holds the database name to use.
 	// If this is empty, "candid" will be used.
 	Database string `yaml:"database"`
+
+	// ReadPreference holds the read preference to use for read-only
+	// identity queries. This may be one of "primary",
+	// "primary-preferred", "secondary-preferred" or "nearest". If
+	// this is empty, all queries are sent to the primary. Writes are
+	// always sent to the primary.
+	ReadPreference string `yaml:"read-preference"`
+
+	// ReadAfterWrite, if set, causes any identity reads that follow
+	// a write in the same request to be sent to the primary so that
+	// they are guaranteed to observe the write.
+	ReadAfterWrite bool `yaml:"read-after-write"`
+
+	// TLS holds the TLS configuration to use when connecting to
+	// MongoDB. If this is nil TLS is not used.
+	TLS *TLSParams `yaml:"tls"`
+}
+
+// TLSParams holds the TLS configuration used when connecting to
+// MongoDB.
+type TLSParams struct {
+	// CAFile holds the path of a PEM encoded file containing the
+	// certificates of the authorities trusted to sign the server
+	// certificate. If this is empty the system roots are used.
+	CAFile string `yaml:"ca-file"`
+
+	// CertFile and KeyFile hold the paths of the PEM encoded
+	// certificate and private key presented to the server for
+	// client certificate authentication. They must either both be
+	// set or both be empty.
+	CertFile string `yaml:"cert-file"`
+	KeyFile  string `yaml:"key-file"`
+
+	// ServerName holds the name that the server certificate is
+	// verified against. If this is empty the host name from the
+	// address is used.
+	ServerName string `yaml:"server-name"`
+
+	// InsecureSkipVerify, if set, disables verification of the
+	// server certificate. This should only be used for testing.
+	InsecureSkipVerify bool `yaml:"insecure-skip-verify"`
+}
+
+// config returns the tls.Config described by the parameters. Any
+// files are read when config is called.
+func (p *TLSParams) config() (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         p.ServerName,
+		InsecureSkipVerify: p.InsecureSkipVerify,
+	}
+	if p.CAFile != "" {
+		data, err := ioutil.ReadFile(p.CAFile)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read CA file")
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errgo.Newf("no certificates found in CA file %q", p.CAFile)
+		}
+	}
+	switch {
+	case p.CertFile == "" && p.KeyFile == "":
+	case p.CertFile == "":
+		return nil, errgo.Newf("key-file specified without cert-file")
+	case p.KeyFile == "":
+		return nil, errgo.Newf("cert-file specified without key-file")
+	default:
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot load client certificate")
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
 }
 
 func init() {
@@ -34,17 +114,81 @@ func unmarshalBackend(unmarshal func(interface{}) error) (store.BackendFactory,
 	if p.Database == "" {
 		p.Database = "candid"
 	}
+	if _, err := parseReadPreference(p.ReadPreference); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if p.TLS != nil {
+		if _, err := p.TLS.config(); err != nil {
+			return nil, errgo.Notef(err, "invalid tls configuration")
+		}
+	}
 	return p, nil
 }
 
 // NewBackend implements store.BackendFactory.
 func (p Params) NewBackend() (store.Backend, error) {
 	logger.Infof("connecting to mongo")
-	session, err := mgo.Dial(p.Address)
+	session, err := p.dial()
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot dial mongo at %q", p.Address)
 	}
 	defer session.Close()
 	db := session.DB(p.Database)
-	return NewBackend(db)
+	return NewBackendWithParams(db, BackendParams{
+		ReadPreference: p.ReadPreference,
+		ReadAfterWrite: p.ReadAfterWrite,
+	})
+}
+
+// dial connects to the configured MongoDB server. If TLS is
+// configured then all connections to the servers use it, otherwise
+// this is equivalent to mgo.Dial.
+func (p Params) dial() (*mgo.Session, error) {
+	if p.TLS == nil {
+		return mgo.Dial(p.Address)
+	}
+	conf, err := p.TLS.config()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	info, err := mgo.ParseURL(p.Address)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	info.Timeout = 10 * time.Second
+	info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conf := conf.Clone()
+		if conf.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr.String())
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			conf.ServerName = host
+		}
+		return tls.DialWithDialer(&net.Dialer{Timeout: info.Timeout}, "tcp", addr.String(), conf)
+	}
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// Use the same timeouts as mgo.Dial.
+	session.SetSyncTimeout(time.Minute)
+	session.SetSocketTimeout(time.Minute)
+	return session, nil
+}
+
+// parseReadPreference converts the given read preference name to the
+// equivalent mgo.Mode.
+func parseReadPreference(pref string) (mgo.Mode, error) {
+	switch pref {
+	case "", "primary":
+		return mgo.Primary, nil
+	case "primary-preferred":
+		return mgo.PrimaryPreferred, nil
+	case "secondary-preferred":
+		return mgo.SecondaryPreferred, nil
+	case "nearest":
+		return mgo.Nearest, nil
+	}
+	return 0, errgo.Newf("invalid read-preference %q", pref)
 }
@@ -1,7 +1,18 @@
 package mgostore_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"gopkg.in/yaml.v2"
@@ -59,3 +70,159 @@ storage:
 	c.Assert(ok, qt.Equals, true)
 	c.Assert(p.Database, qt.Equals, "candid")
 }
+
+func TestUnmarshalReadPreference(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	configData := `
+storage:
+    type: mongodb
+    address: localhost
+    read-preference: secondary-preferred
+    read-after-write: true
+`
+	var cfg struct {
+		Storage *store.Config `yaml:"storage"`
+	}
+	err := yaml.Unmarshal([]byte(configData), &cfg)
+	c.Assert(err, qt.IsNil)
+
+	p, ok := cfg.Storage.BackendFactory.(mgostore.Params)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(p.ReadPreference, qt.Equals, "secondary-preferred")
+	c.Assert(p.ReadAfterWrite, qt.Equals, true)
+}
+
+func TestUnmarshalWithInvalidReadPreference(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	configData := `
+storage:
+    type: mongodb
+    address: localhost
+    read-preference: secondary-only
+`
+	var cfg struct {
+		Storage *store.Config `yaml:"storage"`
+	}
+	err := yaml.Unmarshal([]byte(configData), &cfg)
+	c.Assert(err, qt.ErrorMatches, `cannot unmarshal mongodb configuration: invalid read-preference "secondary-only"`)
+}
+
+func TestUnmarshalTLS(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	dir := c.Mkdir()
+	certFile, keyFile := writeCertificate(c, dir)
+	configData := `
+storage:
+    type: mongodb
+    address: localhost
+    tls:
+        ca-file: ` + certFile + `
+        cert-file: ` + certFile + `
+        key-file: ` + keyFile + `
+        server-name: mongo.example.com
+`
+	var cfg struct {
+		Storage *store.Config `yaml:"storage"`
+	}
+	err := yaml.Unmarshal([]byte(configData), &cfg)
+	c.Assert(err, qt.IsNil)
+
+	p, ok := cfg.Storage.BackendFactory.(mgostore.Params)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(p.TLS, qt.DeepEquals, &mgostore.TLSParams{
+		CAFile:     certFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "mongo.example.com",
+	})
+}
+
+var unmarshalTLSErrorTests = []struct {
+	about       string
+	tls         string
+	expectError string
+}{{
+	about:       "cert without key",
+	tls:         "{cert-file: CERT}",
+	expectError: `cannot unmarshal mongodb configuration: invalid tls configuration: cert-file specified without key-file`,
+}, {
+	about:       "key without cert",
+	tls:         "{key-file: KEY}",
+	expectError: `cannot unmarshal mongodb configuration: invalid tls configuration: key-file specified without cert-file`,
+}, {
+	about:       "missing CA file",
+	tls:         "{ca-file: DIR/no-such-file}",
+	expectError: `cannot unmarshal mongodb configuration: invalid tls configuration: cannot read CA file: .*`,
+}, {
+	about:       "invalid CA file",
+	tls:         "{ca-file: KEY}",
+	expectError: `cannot unmarshal mongodb configuration: invalid tls configuration: no certificates found in CA file .*`,
+}, {
+	about:       "mismatched key",
+	tls:         "{cert-file: CERT, key-file: OTHERKEY}",
+	expectError: `cannot unmarshal mongodb configuration: invalid tls configuration: cannot load client certificate: .*`,
+}}
+
+func TestUnmarshalTLSError(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	dir := c.Mkdir()
+	certFile, keyFile := writeCertificate(c, dir)
+	_, otherKeyFile := writeCertificate(c, c.Mkdir())
+	for _, test := range unmarshalTLSErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			tlsConfig := strings.NewReplacer(
+				"OTHERKEY", otherKeyFile,
+				"CERT", certFile,
+				"KEY", keyFile,
+				"DIR", dir,
+			).Replace(test.tls)
+			configData := `
+storage:
+    type: mongodb
+    address: localhost
+    tls: ` + tlsConfig + `
+`
+			var cfg struct {
+				Storage *store.Config `yaml:"storage"`
+			}
+			err := yaml.Unmarshal([]byte(configData), &cfg)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+// writeCertificate writes a new self-signed certificate and its
+// private key to PEM files in the given directory, returning the paths
+// of the two files.
+func writeCertificate(c *qt.C, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, qt.IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "candid"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, qt.IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, qt.IsNil)
+	certFile = filepath.Join(dir, "cert.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	c.Assert(err, qt.IsNil)
+	keyFile = filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	c.Assert(err, qt.IsNil)
+	return certFile, keyFile
+}
@@ -29,6 +29,10 @@ var fieldNames = []string{
 	store.ProviderInfo:  "providerinfo",
 	store.ExtraInfo:     "extrainfo",
 	store.Owner:         "owner",
+	store.Source:        "source",
+	store.Roles:         "roles",
+	store.AdminDisabled: "admindisabled",
+	store.FoldedName:    "foldedname",
 }
 
 // identityDocument holds the in-database representation of a user in the identities
@@ -50,6 +54,10 @@ type identityDocument struct {
 	// Name holds the display name of the user.
 	Name string
 
+	// FoldedName holds the display name of the user as returned by
+	// store.FoldName.
+	FoldedName string `bson:",omitempty"`
+
 	// Groups holds a list of group names to which the user belongs.
 	Groups []string
 
@@ -72,6 +80,24 @@ type identityDocument struct {
 
 	// Owner holds the provider id of the owner.
 	Owner string
+
+	// Source holds the tag of the system the identity originated
+	// from.
+	Source string
+
+	// Roles holds the tenant-scoped roles of the user.
+	Roles []string
+
+	// AdminDisabled records that the admin account has been
+	// disabled.
+	AdminDisabled bool `bson:",omitempty"`
+
+	// Version holds the number of times the identity has been
+	// changed.
+	Version int64
+
+	// Modified holds the time the identity was last changed.
+	Modified time.Time
 }
 
 // PublicKeys converts the stored public keys into the format used by the
@@ -92,10 +118,12 @@ func (d identityDocument) PublicKeys() []bakery.PublicKey {
 }
 
 type updateDocument struct {
-	Set      bson.D `bson:"$set,omitempty"`
-	Unset    bson.D `bson:"$unset,omitempty"`
-	AddToSet bson.D `bson:"$addToSet,omitempty"`
-	PullAll  bson.D `bson:"$pullAll,omitempty"`
+	Set         bson.D `bson:"$set,omitempty"`
+	SetOnInsert bson.D `bson:"$setOnInsert,omitempty"`
+	Inc         bson.D `bson:"$inc,omitempty"`
+	Unset       bson.D `bson:"$unset,omitempty"`
+	AddToSet    bson.D `bson:"$addToSet,omitempty"`
+	PullAll     bson.D `bson:"$pullAll,omitempty"`
 }
 
 func (d *updateDocument) addUpdate(op store.Operation, name string, v interface{}) {
@@ -114,6 +142,14 @@ func (d *updateDocument) addUpdate(op store.Operation, name string, v interface{
 	}
 }
 
+// addInsert adds a value that is only set if the update creates a new
+// document.
+func (d *updateDocument) addInsert(op store.Operation, name string, v interface{}) {
+	if op == store.Set {
+		d.SetOnInsert = append(d.SetOnInsert, bson.DocElem{name, v})
+	}
+}
+
 func (d *updateDocument) IsZero() bool {
-	return len(d.Set)+len(d.Unset)+len(d.AddToSet)+len(d.PullAll) == 0
+	return len(d.Set)+len(d.SetOnInsert)+len(d.Inc)+len(d.Unset)+len(d.AddToSet)+len(d.PullAll) == 0
 }
@@ -10,6 +10,18 @@ import (
 	"github.com/canonical/candid/meeting"
 )
 
+var (
+	SetWritten = setWritten
+	Written    = written
+)
+
+// ContextWithSessionState returns a context with session information
+// attached, but no session, so that the recording of writes can be
+// tested without a database.
+func ContextWithSessionState(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionKey{}, &sessionState{})
+}
+
 var PutAtTime = func(ctx context.Context, s meeting.Store, id, address string, now time.Time) error {
 	return s.(*meetingStore).put(ctx, id, address, now)
 }
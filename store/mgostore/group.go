@@ -0,0 +1,106 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mgostore
+
+import (
+	"context"
+
+	errgo "gopkg.in/errgo.v1"
+	mgo "gopkg.in/mgo.v2"
+
+	"github.com/canonical/candid/store"
+)
+
+const groupsCollection = "groups"
+
+// groupDocument is the document stored for each group record.
+type groupDocument struct {
+	Name        string            `bson:"_id"`
+	Description string            `bson:"description,omitempty"`
+	Metadata    map[string]string `bson:"metadata,omitempty"`
+}
+
+// groupStore is an implementation of store.GroupStore that uses a
+// mongodb collection for the persistent data store.
+type groupStore struct {
+	b *backend
+}
+
+// Group implements store.GroupStore.Group.
+func (s *groupStore) Group(ctx context.Context, group *store.Group) error {
+	coll := s.b.readC(ctx, groupsCollection)
+	defer coll.Database.Session.Close()
+
+	var doc groupDocument
+	if err := coll.FindId(group.Name).One(&doc); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.GroupNotFoundError(group.Name)
+		}
+		return errgo.Mask(err)
+	}
+	*group = doc.group()
+	return nil
+}
+
+// FindGroups implements store.GroupStore.FindGroups.
+func (s *groupStore) FindGroups(ctx context.Context) ([]store.Group, error) {
+	coll := s.b.readC(ctx, groupsCollection)
+	defer coll.Database.Session.Close()
+
+	var docs []groupDocument
+	if err := coll.Find(nil).Sort("_id").All(&docs); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	groups := make([]store.Group, len(docs))
+	for i, doc := range docs {
+		groups[i] = doc.group()
+	}
+	return groups, nil
+}
+
+// UpdateGroup implements store.GroupStore.UpdateGroup.
+func (s *groupStore) UpdateGroup(ctx context.Context, group *store.Group) error {
+	coll := s.b.c(ctx, groupsCollection)
+	defer coll.Database.Session.Close()
+
+	_, err := coll.UpsertId(group.Name, groupDocument{
+		Name:        group.Name,
+		Description: group.Description,
+		Metadata:    group.Metadata,
+	})
+	if err != nil {
+		if isNotPrimary(err) {
+			return store.ReadOnlyError(err)
+		}
+		return errgo.Mask(err)
+	}
+	setWritten(ctx)
+	return nil
+}
+
+// RemoveGroup implements store.GroupStore.RemoveGroup.
+func (s *groupStore) RemoveGroup(ctx context.Context, name string) error {
+	coll := s.b.c(ctx, groupsCollection)
+	defer coll.Database.Session.Close()
+
+	if err := coll.RemoveId(name); err != nil {
+		if err == mgo.ErrNotFound {
+			return store.GroupNotFoundError(name)
+		}
+		if isNotPrimary(err) {
+			return store.ReadOnlyError(err)
+		}
+		return errgo.Mask(err)
+	}
+	setWritten(ctx)
+	return nil
+}
+
+func (doc groupDocument) group() store.Group {
+	return store.Group{
+		Name:        doc.Name,
+		Description: doc.Description,
+		Metadata:    doc.Metadata,
+	}
+}
@@ -53,6 +53,24 @@ func TestACLStore(t *testing.T) {
 	})
 }
 
+func TestGroupStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestGroupStore(c, func(c *qt.C) store.GroupStore {
+		return newFixture(c).backend.GroupStore()
+	})
+}
+
+func TestOutboxStore(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+
+	storetest.TestOutboxStore(c, func(c *qt.C) store.OutboxStore {
+		return newFixture(c).backend.OutboxStore()
+	})
+}
+
 func TestRootKeyStore(t *testing.T) {
 	c := qt.New(t)
 	defer c.Done()
@@ -0,0 +1,189 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package mgostore
+
+import (
+	"context"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/canonical/candid/store"
+)
+
+const outboxCollection = "outbox"
+
+// outboxDocument is the document stored for each outbox message.
+type outboxDocument struct {
+	ID          bson.ObjectId `bson:"_id"`
+	Data        []byte        `bson:"data"`
+	Attempts    int           `bson:"attempts,omitempty"`
+	NextAttempt time.Time     `bson:"nextattempt"`
+	Expires     time.Time     `bson:"expires"`
+}
+
+// outboxStore is an implementation of store.OutboxStore that uses a
+// mongodb collection for the persistent data store. Messages are
+// ordered by their object IDs.
+type outboxStore struct {
+	b *backend
+}
+
+// Add implements store.OutboxStore.Add.
+func (s *outboxStore) Add(ctx context.Context, m *store.OutboxMessage) error {
+	coll := s.b.c(ctx, outboxCollection)
+	defer coll.Database.Session.Close()
+
+	doc := outboxDocument{
+		ID:          bson.NewObjectId(),
+		Data:        m.Data,
+		Attempts:    m.Attempts,
+		NextAttempt: m.NextAttempt,
+		Expires:     m.Expires,
+	}
+	if err := coll.Insert(&doc); err != nil {
+		if isNotPrimary(err) {
+			return store.ReadOnlyError(err)
+		}
+		return errgo.Mask(err)
+	}
+	setWritten(ctx)
+	m.ID = doc.ID.Hex()
+	return nil
+}
+
+// Claim implements store.OutboxStore.Claim.
+func (s *outboxStore) Claim(ctx context.Context, now, leaseUntil time.Time) (*store.OutboxMessage, error) {
+	coll := s.b.c(ctx, outboxCollection)
+	defer coll.Database.Session.Close()
+
+	query := bson.D{
+		{"nextattempt", bson.D{{"$lte", now}}},
+		{"expires", bson.D{{"$gt", now}}},
+	}
+	change := mgo.Change{
+		Update: bson.D{{"$set", bson.D{{"nextattempt", leaseUntil}}}},
+	}
+	var doc outboxDocument
+	if _, err := coll.Find(query).Sort("_id").Apply(change, &doc); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	setWritten(ctx)
+	m := doc.message()
+	return &m, nil
+}
+
+// Retry implements store.OutboxStore.Retry.
+func (s *outboxStore) Retry(ctx context.Context, id string, attempts int, next time.Time) error {
+	if !bson.IsObjectIdHex(id) {
+		return nil
+	}
+	coll := s.b.c(ctx, outboxCollection)
+	defer coll.Database.Session.Close()
+
+	err := coll.UpdateId(bson.ObjectIdHex(id), bson.D{{"$set", bson.D{
+		{"attempts", attempts},
+		{"nextattempt", next},
+	}}})
+	if err != nil && err != mgo.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	setWritten(ctx)
+	return nil
+}
+
+// Remove implements store.OutboxStore.Remove.
+func (s *outboxStore) Remove(ctx context.Context, id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return nil
+	}
+	coll := s.b.c(ctx, outboxCollection)
+	defer coll.Database.Session.Close()
+
+	if err := coll.RemoveId(bson.ObjectIdHex(id)); err != nil && err != mgo.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	setWritten(ctx)
+	return nil
+}
+
+// RemoveOldest implements store.OutboxStore.RemoveOldest.
+func (s *outboxStore) RemoveOldest(ctx context.Context) (*store.OutboxMessage, error) {
+	coll := s.b.c(ctx, outboxCollection)
+	defer coll.Database.Session.Close()
+
+	var doc outboxDocument
+	if _, err := coll.Find(nil).Sort("_id").Apply(mgo.Change{Remove: true}, &doc); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	setWritten(ctx)
+	m := doc.message()
+	return &m, nil
+}
+
+// RemoveExpired implements store.OutboxStore.RemoveExpired.
+func (s *outboxStore) RemoveExpired(ctx context.Context, now time.Time) ([]store.OutboxMessage, error) {
+	coll := s.b.c(ctx, outboxCollection)
+	defer coll.Database.Session.Close()
+
+	// Each expired message is removed individually so that, when
+	// several servers are purging the same collection, every
+	// message is returned to exactly one of them.
+	var expired []store.OutboxMessage
+	query := bson.D{{"expires", bson.D{{"$lte", now}}}}
+	for {
+		var doc outboxDocument
+		if _, err := coll.Find(query).Apply(mgo.Change{Remove: true}, &doc); err != nil {
+			if err == mgo.ErrNotFound {
+				break
+			}
+			return expired, errgo.Mask(err)
+		}
+		setWritten(ctx)
+		expired = append(expired, doc.message())
+	}
+	return expired, nil
+}
+
+// Count implements store.OutboxStore.Count.
+func (s *outboxStore) Count(ctx context.Context) (int, error) {
+	coll := s.b.readC(ctx, outboxCollection)
+	defer coll.Database.Session.Close()
+
+	n, err := coll.Count()
+	return n, errgo.Mask(err)
+}
+
+func (doc outboxDocument) message() store.OutboxMessage {
+	return store.OutboxMessage{
+		ID:          doc.ID.Hex(),
+		Data:        doc.Data,
+		Attempts:    doc.Attempts,
+		NextAttempt: doc.NextAttempt,
+		Expires:     doc.Expires,
+	}
+}
+
+func ensureOutboxIndexes(db *mgo.Database) error {
+	coll := db.C(outboxCollection)
+	indexes := []mgo.Index{{
+		Key: []string{"nextattempt"},
+	}, {
+		Key: []string{"expires"},
+	}}
+	for _, index := range indexes {
+		if err := coll.EnsureIndex(index); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
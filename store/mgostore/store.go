@@ -6,6 +6,9 @@ package mgostore
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"strings"
+	"time"
 
 	errgo "gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2/bakery"
@@ -31,7 +34,7 @@ func (s *identityStore) Context(ctx context.Context) (_ context.Context, cancel
 // identity from the mongodb database. The given context must have a
 // mgo.Session added using ContextWithSession.
 func (s *identityStore) Identity(ctx context.Context, identity *store.Identity) error {
-	coll := s.b.c(ctx, identitiesCollection)
+	coll := s.b.readC(ctx, identitiesCollection)
 	defer coll.Database.Session.Close()
 
 	var doc identityDocument
@@ -53,6 +56,11 @@ func (s *identityStore) Identity(ctx context.Context, identity *store.Identity)
 	identity.ProviderInfo = doc.ProviderInfo
 	identity.ExtraInfo = doc.ExtraInfo
 	identity.Owner = store.ProviderIdentity(doc.Owner)
+	identity.Source = doc.Source
+	identity.Roles = doc.Roles
+	identity.AdminDisabled = doc.AdminDisabled
+	identity.Version = doc.Version
+	identity.Modified = doc.Modified
 	return nil
 }
 
@@ -78,7 +86,7 @@ func identityQuery(identity *store.Identity) bson.D {
 // mongodb database. The given context must have a mgo.Session added
 // using ContextWithSession.
 func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity, filter store.Filter, sort []store.Sort, skip, limit int) ([]store.Identity, error) {
-	coll := s.b.c(ctx, identitiesCollection)
+	coll := s.b.readC(ctx, identitiesCollection)
 	defer coll.Database.Session.Close()
 
 	q := coll.Find(makeQuery(ref, filter))
@@ -116,6 +124,11 @@ func (s *identityStore) FindIdentities(ctx context.Context, ref *store.Identity,
 			ProviderInfo:  doc.ProviderInfo,
 			ExtraInfo:     doc.ExtraInfo,
 			Owner:         store.ProviderIdentity(doc.Owner),
+			Source:        doc.Source,
+			Roles:         doc.Roles,
+			AdminDisabled: doc.AdminDisabled,
+			Version:       doc.Version,
+			Modified:      doc.Modified,
 		})
 	}
 	if err := it.Err(); err != nil {
@@ -129,10 +142,12 @@ func makeQuery(ref *store.Identity, filter store.Filter) bson.D {
 	query = appendComparison(query, fieldNames[store.ProviderID], filter[store.ProviderID], ref.ProviderID)
 	query = appendComparison(query, fieldNames[store.Username], filter[store.Username], ref.Username)
 	query = appendComparison(query, fieldNames[store.Name], filter[store.Name], ref.Name)
+	query = appendComparison(query, fieldNames[store.FoldedName], filter[store.FoldedName], store.FoldName(ref.Name))
 	query = appendComparison(query, fieldNames[store.Email], filter[store.Email], ref.Email)
 	query = appendComparison(query, fieldNames[store.LastLogin], filter[store.LastLogin], ref.LastLogin)
 	query = appendComparison(query, fieldNames[store.LastDischarge], filter[store.LastDischarge], ref.LastDischarge)
 	query = appendComparison(query, fieldNames[store.Owner], filter[store.Owner], ref.Owner)
+	query = appendComparison(query, fieldNames[store.Source], filter[store.Source], ref.Source)
 	return query
 }
 
@@ -144,6 +159,12 @@ func appendComparison(query bson.D, fieldName string, p store.Comparison, value
 		// TODO with Mongo 3.0, we could remove this special case
 		// and use $eq instead.
 		return append(query, bson.DocElem{fieldName, value})
+	case store.HasPrefix:
+		// An anchored case-sensitive regular expression can be
+		// satisfied using an index on the field.
+		return append(query, bson.DocElem{fieldName, bson.RegEx{
+			Pattern: "^" + regexp.QuoteMeta(fmt.Sprint(value)),
+		}})
 	default:
 		return append(query, bson.DocElem{fieldName, bson.D{{comparisonOps[p], value}}})
 	}
@@ -163,9 +184,10 @@ var comparisonOps = []string{
 func (s *identityStore) UpdateIdentity(ctx context.Context, identity *store.Identity, update store.Update) error {
 	coll := s.b.c(ctx, identitiesCollection)
 	defer coll.Database.Session.Close()
+	setWritten(ctx)
 
 	if identity.ID == "" && identity.ProviderID != "" && identity.Username != "" && update[store.Username] == store.Set {
-		return errgo.Mask(s.upsertIdentity(coll, identity, update), errgo.Is(store.ErrDuplicateUsername))
+		return errgo.Mask(s.upsertIdentity(coll, identity, update), errgo.Is(store.ErrDuplicateUsername), errgo.Is(store.ErrReadOnly))
 	}
 	updateDoc := identityUpdate(identity, update)
 	if updateDoc.IsZero() {
@@ -186,6 +208,9 @@ func (s *identityStore) UpdateIdentity(ctx context.Context, identity *store.Iden
 	if mgo.IsDup(err) {
 		return store.DuplicateUsernameError(identity.Username)
 	}
+	if isNotPrimary(err) {
+		return store.ReadOnlyError(err)
+	}
 	return errgo.Mask(err)
 }
 
@@ -195,6 +220,9 @@ func (s *identityStore) upsertIdentity(coll *mgo.Collection, identity *store.Ide
 		if mgo.IsDup(err) {
 			return store.DuplicateUsernameError(identity.Username)
 		}
+		if isNotPrimary(err) {
+			return store.ReadOnlyError(err)
+		}
 		return errgo.Mask(err)
 	}
 	id, ok := changeInfo.UpsertedId.(bson.ObjectId)
@@ -204,12 +232,61 @@ func (s *identityStore) upsertIdentity(coll *mgo.Collection, identity *store.Ide
 	return nil
 }
 
+// RemoveIdentity implements store.IdentityRemover.RemoveIdentity by
+// removing the identity document from the mongodb database. The given
+// context must have a mgo.Session added using ContextWithSession.
+func (s *identityStore) RemoveIdentity(ctx context.Context, identity *store.Identity) error {
+	coll := s.b.c(ctx, identitiesCollection)
+	defer coll.Database.Session.Close()
+	setWritten(ctx)
+
+	err := coll.Remove(identityQuery(identity))
+	if err == nil {
+		return nil
+	}
+	if err == mgo.ErrNotFound {
+		return store.NotFoundError(identity.ID, identity.ProviderID, identity.Username)
+	}
+	if isNotPrimary(err) {
+		return store.ReadOnlyError(err)
+	}
+	return errgo.Mask(err)
+}
+
+// notPrimaryCodes holds the mongodb error codes that indicate that a
+// write failed because there is currently no primary to accept it.
+var notPrimaryCodes = map[int]bool{
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// isNotPrimary reports whether the given error indicates that a write
+// failed because the replica set has no primary, such as happens
+// during an election.
+func isNotPrimary(err error) bool {
+	switch err := err.(type) {
+	case *mgo.LastError:
+		return notPrimaryCodes[err.Code] || strings.HasPrefix(err.Err, "not master")
+	case *mgo.QueryError:
+		return notPrimaryCodes[err.Code] || strings.HasPrefix(err.Message, "not master")
+	}
+	return false
+}
+
 func identityUpdate(identity *store.Identity, update store.Update) updateDocument {
 	var doc updateDocument
 	doc.addUpdate(update[store.Username], fieldNames[store.Username], identity.Username)
 	doc.addUpdate(update[store.Name], fieldNames[store.Name], identity.Name)
+	doc.addUpdate(update[store.Name], fieldNames[store.FoldedName], store.FoldName(identity.Name))
 	doc.addUpdate(update[store.Email], fieldNames[store.Email], identity.Email)
 	doc.addUpdate(update[store.Groups], fieldNames[store.Groups], identity.Groups)
+	doc.addUpdate(update[store.Roles], fieldNames[store.Roles], identity.Roles)
+	doc.addUpdate(update[store.AdminDisabled], fieldNames[store.AdminDisabled], identity.AdminDisabled)
 	doc.addUpdate(update[store.PublicKeys], fieldNames[store.PublicKeys], encodePublicKeys(identity.PublicKeys))
 	doc.addUpdate(update[store.LastLogin], fieldNames[store.LastLogin], identity.LastLogin)
 	doc.addUpdate(update[store.LastDischarge], fieldNames[store.LastDischarge], identity.LastDischarge)
@@ -220,6 +297,11 @@ func identityUpdate(identity *store.Identity, update store.Update) updateDocumen
 		doc.addUpdate(update[store.ExtraInfo], fieldNames[store.ExtraInfo]+"."+k, v)
 	}
 	doc.addUpdate(update[store.Owner], fieldNames[store.Owner], identity.Owner)
+	doc.addInsert(update[store.Source], fieldNames[store.Source], identity.Source)
+	if !doc.IsZero() {
+		doc.Set = append(doc.Set, bson.DocElem{"modified", time.Now()})
+		doc.Inc = bson.D{{"version", 1}}
+	}
 	return doc
 }
 
@@ -240,13 +322,47 @@ func ensureIdentityIndexes(db *mgo.Database) error {
 	}, {
 		Key:    []string{"providerid"},
 		Unique: true,
+	}, {
+		Key: []string{"email"},
+	}, {
+		Key: []string{"name"},
+	}, {
+		Key: []string{"foldedname"},
+	}, {
+		Key: []string{"source"},
 	}}
 	for _, index := range indexes {
 		if err := coll.EnsureIndex(index); err != nil {
 			return errgo.Mask(err)
 		}
 	}
-	return nil
+	return errgo.Mask(foldNames(coll))
+}
+
+// foldNames sets the folded name of any identity that has a display
+// name but no folded name, which will be the case for identities
+// last updated before folded names were recorded.
+func foldNames(coll *mgo.Collection) error {
+	it := coll.Find(bson.D{
+		{"name", bson.D{{"$nin", []interface{}{nil, ""}}}},
+		{"foldedname", bson.D{{"$exists", false}}},
+	}).Select(bson.D{{"name", 1}}).Iter()
+	var doc identityDocument
+	for it.Next(&doc) {
+		folded := store.FoldName(doc.Name)
+		if folded == "" {
+			continue
+		}
+		err := coll.Update(
+			bson.D{{"_id", doc.ID}, {"name", doc.Name}},
+			bson.D{{"$set", bson.D{{"foldedname", folded}}}},
+		)
+		if err != nil && err != mgo.ErrNotFound {
+			it.Close()
+			return errgo.Notef(err, "cannot set folded name")
+		}
+	}
+	return errgo.Mask(it.Close())
 }
 
 var identityCountMapReduce = mgo.MapReduce{
@@ -256,7 +372,7 @@ var identityCountMapReduce = mgo.MapReduce{
 
 // IdentityCounts implements store.Store.IdentityCounts.
 func (s *identityStore) IdentityCounts(ctx context.Context) (map[string]int, error) {
-	coll := s.b.c(ctx, identitiesCollection)
+	coll := s.b.readC(ctx, identitiesCollection)
 	defer coll.Database.Session.Close()
 
 	counts := make(map[string]int)
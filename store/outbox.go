@@ -0,0 +1,71 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// An OutboxMessage holds a message waiting for delivery in an
+// OutboxStore.
+type OutboxMessage struct {
+	// ID identifies the message within the store. It is set by the
+	// store when the message is added.
+	ID string
+
+	// Data holds the message to deliver.
+	Data []byte
+
+	// Attempts holds the number of failed delivery attempts.
+	Attempts int
+
+	// NextAttempt holds the earliest time at which the message may
+	// be delivered. While the message is being delivered this is
+	// the end of the delivery lease.
+	NextAttempt time.Time
+
+	// Expires holds the time after which the message is discarded
+	// if it has not been delivered.
+	Expires time.Time
+}
+
+// An OutboxStore stores a durable queue of messages waiting for
+// delivery. Each message is held as a separate record so that any
+// number of servers sharing the store can claim and remove messages
+// individually.
+type OutboxStore interface {
+	// Add adds the given message to the end of the queue and sets
+	// its ID.
+	Add(ctx context.Context, m *OutboxMessage) error
+
+	// Claim atomically finds the oldest message that is due for
+	// delivery at the given time and has not expired, and sets its
+	// NextAttempt to leaseUntil so that no other caller can claim
+	// it before then. The returned message holds the NextAttempt
+	// time it had before it was claimed. If no message is due then
+	// Claim returns nil.
+	Claim(ctx context.Context, now, leaseUntil time.Time) (*OutboxMessage, error)
+
+	// Retry records a failed delivery of the message with the given
+	// ID, setting its attempt count and the time at which it will
+	// next be due. It is not an error if the message does not exist.
+	Retry(ctx context.Context, id string, attempts int, next time.Time) error
+
+	// Remove removes the message with the given ID. It is not an
+	// error if the message does not exist.
+	Remove(ctx context.Context, id string) error
+
+	// RemoveOldest removes the oldest message in the queue and
+	// returns it. If the queue is empty then RemoveOldest returns
+	// nil.
+	RemoveOldest(ctx context.Context) (*OutboxMessage, error)
+
+	// RemoveExpired removes all the messages that have expired at
+	// the given time and returns them.
+	RemoveExpired(ctx context.Context, now time.Time) ([]OutboxMessage, error)
+
+	// Count returns the number of messages in the queue.
+	Count(ctx context.Context) (int, error)
+}
@@ -2,7 +2,9 @@ package sqlstore
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"fmt"
 	"strings"
 	"text/template"
 	"time"
@@ -47,12 +49,17 @@ func NewBackend(driverName string, db *sql.DB) (store.Backend, error) {
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	return &backend{
+	b := &backend{
 		db:       db,
 		driver:   driver,
 		rootKeys: postgresrootkeystore.NewRootKeys(db, "rootkeys", 1000),
 		aclStore: aclstore.NewACLStore(aclStore),
-	}, nil
+	}
+	if err := b.foldNames(); err != nil {
+		b.rootKeys.Close()
+		return nil, errgo.Notef(err, "cannot initialise database")
+	}
+	return b, nil
 }
 
 func (b *backend) Close() {
@@ -88,9 +95,36 @@ func (b *backend) ACLStore() aclstore.ACLStore {
 	return b.aclStore
 }
 
+// GroupStore returns a new store.GroupStore implementation using this
+// database for persistent storage.
+func (b *backend) GroupStore() store.GroupStore {
+	return &groupStore{b}
+}
+
+// OutboxStore returns a new store.OutboxStore implementation using
+// this database for persistent storage.
+func (b *backend) OutboxStore() store.OutboxStore {
+	return &outboxStore{b}
+}
+
 // DebugStatusCheckerFuncs implements store.Backend.DebugStatusCheckerFuncs.
 func (b *backend) DebugStatusCheckerFuncs() []debugstatus.CheckerFunc {
-	return nil
+	return []debugstatus.CheckerFunc{
+		b.poolStatus,
+	}
+}
+
+// poolStatus reports the state of the database connection pool.
+func (b *backend) poolStatus(ctx context.Context) (key string, result debugstatus.CheckResult) {
+	result.Name = "Database connection pool"
+	stats := b.db.Stats()
+	result.Value = fmt.Sprintf("%d open (%d in use, %d idle), %d waits", stats.OpenConnections, stats.InUse, stats.Idle, stats.WaitCount)
+	if err := b.db.PingContext(ctx); err != nil {
+		result.Value += ": " + err.Error()
+		return "store_pool", result
+	}
+	result.Passed = true
+	return "store_pool", result
 }
 
 // withTx runs f in a new transaction. any error returned by f will not
@@ -118,6 +152,7 @@ const (
 	tmplUpdateIdentity
 	tmplIdentityID
 	tmplUpsertIdentity
+	tmplRemoveIdentity
 	tmplClearIdentitySet
 	tmplPushIdentitySet
 	tmplPullIdentitySet
@@ -129,6 +164,19 @@ const (
 	tmplFindMeetings
 	tmplRemoveMeetings
 	tmplIdentityCounts
+	tmplUnfoldedNames
+	tmplSetFoldedName
+	tmplGetGroup
+	tmplFindGroups
+	tmplUpsertGroup
+	tmplRemoveGroup
+	tmplAddOutboxMessage
+	tmplClaimOutboxMessage
+	tmplRetryOutboxMessage
+	tmplRemoveOutboxMessage
+	tmplRemoveOldestOutboxMessage
+	tmplRemoveExpiredOutboxMessages
+	tmplCountOutboxMessages
 	numTmpl
 )
 
@@ -217,4 +265,5 @@ var comparisons = map[store.Comparison]string{
 	store.LessThan:           "<",
 	store.GreaterThanOrEqual: ">=",
 	store.LessThanOrEqual:    "<=",
+	store.HasPrefix:          " LIKE ",
 }
@@ -0,0 +1,124 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// groupStore is an implementation of store.GroupStore that uses an sql
+// table.
+type groupStore struct {
+	*backend
+}
+
+type groupParams struct {
+	argBuilder
+	Name        string
+	Description string
+	Metadata    []byte
+}
+
+// Group implements store.GroupStore.Group.
+func (s *groupStore) Group(_ context.Context, group *store.Group) error {
+	params := &groupParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Name:       group.Name,
+	}
+	row, err := s.driver.queryRow(s.db, tmplGetGroup, params)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	g, err := scanGroup(row)
+	if errgo.Cause(err) == sql.ErrNoRows {
+		return store.GroupNotFoundError(group.Name)
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	*group = g
+	return nil
+}
+
+// FindGroups implements store.GroupStore.FindGroups.
+func (s *groupStore) FindGroups(_ context.Context) ([]store.Group, error) {
+	params := &groupParams{
+		argBuilder: s.driver.argBuilderFunc(),
+	}
+	rows, err := s.driver.query(s.db, tmplFindGroups, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+	groups := []store.Group{}
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return groups, nil
+}
+
+// UpdateGroup implements store.GroupStore.UpdateGroup.
+func (s *groupStore) UpdateGroup(_ context.Context, group *store.Group) error {
+	params := &groupParams{
+		argBuilder:  s.driver.argBuilderFunc(),
+		Name:        group.Name,
+		Description: group.Description,
+	}
+	if len(group.Metadata) > 0 {
+		var err error
+		params.Metadata, err = json.Marshal(group.Metadata)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	_, err := s.driver.exec(s.db, tmplUpsertGroup, params)
+	return errgo.Mask(err)
+}
+
+// RemoveGroup implements store.GroupStore.RemoveGroup.
+func (s *groupStore) RemoveGroup(_ context.Context, name string) error {
+	params := &groupParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Name:       name,
+	}
+	res, err := s.driver.exec(s.db, tmplRemoveGroup, params)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if n == 0 {
+		return store.GroupNotFoundError(name)
+	}
+	return nil
+}
+
+func scanGroup(s scanner) (store.Group, error) {
+	var g store.Group
+	var metadata []byte
+	if err := s.Scan(&g.Name, &g.Description, &metadata); err != nil {
+		return store.Group{}, errgo.Mask(err, errgo.Is(sql.ErrNoRows))
+	}
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &g.Metadata); err != nil {
+			return store.Group{}, errgo.Notef(err, "cannot unmarshal metadata for group %q", g.Name)
+		}
+	}
+	return g, nil
+}
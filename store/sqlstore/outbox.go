@@ -0,0 +1,171 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// outboxStore is an implementation of store.OutboxStore that uses an
+// sql table. Messages are ordered by their serial IDs.
+type outboxStore struct {
+	*backend
+}
+
+type outboxParams struct {
+	argBuilder
+	ID          string
+	Data        []byte
+	Attempts    int
+	NextAttempt time.Time
+	Expires     time.Time
+	Now         time.Time
+	LeaseUntil  time.Time
+}
+
+// Add implements store.OutboxStore.Add.
+func (s *outboxStore) Add(_ context.Context, m *store.OutboxMessage) error {
+	params := &outboxParams{
+		argBuilder:  s.driver.argBuilderFunc(),
+		Data:        m.Data,
+		Attempts:    m.Attempts,
+		NextAttempt: m.NextAttempt,
+		Expires:     m.Expires,
+	}
+	row, err := s.driver.queryRow(s.db, tmplAddOutboxMessage, params)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var id int64
+	if err := row.Scan(&id); err != nil {
+		return errgo.Mask(err)
+	}
+	m.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+// Claim implements store.OutboxStore.Claim.
+func (s *outboxStore) Claim(_ context.Context, now, leaseUntil time.Time) (*store.OutboxMessage, error) {
+	params := &outboxParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Now:        now,
+		LeaseUntil: leaseUntil,
+	}
+	row, err := s.driver.queryRow(s.db, tmplClaimOutboxMessage, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	m, err := scanOutboxMessage(row)
+	if errgo.Cause(err) == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &m, nil
+}
+
+// Retry implements store.OutboxStore.Retry.
+func (s *outboxStore) Retry(_ context.Context, id string, attempts int, next time.Time) error {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		// By definition if id isn't numeric it won't exist.
+		return nil
+	}
+	params := &outboxParams{
+		argBuilder:  s.driver.argBuilderFunc(),
+		ID:          id,
+		Attempts:    attempts,
+		NextAttempt: next,
+	}
+	_, err := s.driver.exec(s.db, tmplRetryOutboxMessage, params)
+	return errgo.Mask(err)
+}
+
+// Remove implements store.OutboxStore.Remove.
+func (s *outboxStore) Remove(_ context.Context, id string) error {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return nil
+	}
+	params := &outboxParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		ID:         id,
+	}
+	_, err := s.driver.exec(s.db, tmplRemoveOutboxMessage, params)
+	return errgo.Mask(err)
+}
+
+// RemoveOldest implements store.OutboxStore.RemoveOldest.
+func (s *outboxStore) RemoveOldest(_ context.Context) (*store.OutboxMessage, error) {
+	params := &outboxParams{
+		argBuilder: s.driver.argBuilderFunc(),
+	}
+	row, err := s.driver.queryRow(s.db, tmplRemoveOldestOutboxMessage, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	m, err := scanOutboxMessage(row)
+	if errgo.Cause(err) == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &m, nil
+}
+
+// RemoveExpired implements store.OutboxStore.RemoveExpired.
+func (s *outboxStore) RemoveExpired(_ context.Context, now time.Time) ([]store.OutboxMessage, error) {
+	params := &outboxParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		Now:        now,
+	}
+	rows, err := s.driver.query(s.db, tmplRemoveExpiredOutboxMessages, params)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rows.Close()
+	var expired []store.OutboxMessage
+	for rows.Next() {
+		m, err := scanOutboxMessage(rows)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		expired = append(expired, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return expired, nil
+}
+
+// Count implements store.OutboxStore.Count.
+func (s *outboxStore) Count(_ context.Context) (int, error) {
+	row, err := s.driver.queryRow(s.db, tmplCountOutboxMessages, s.driver.argBuilderFunc())
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	var n int
+	if err := row.Scan(&n); err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return n, nil
+}
+
+func scanOutboxMessage(s scanner) (store.OutboxMessage, error) {
+	var m store.OutboxMessage
+	var id int64
+	err := s.Scan(&id, &m.Data, &m.Attempts, &m.NextAttempt, &m.Expires)
+	if err != nil {
+		return store.OutboxMessage{}, errgo.Mask(err, errgo.Is(sql.ErrNoRows))
+	}
+	m.ID = strconv.FormatInt(id, 10)
+	return m, nil
+}
@@ -31,12 +31,78 @@ DO $$
     END;
 $$;
 
+DO $$ 
+    BEGIN
+        BEGIN
+            ALTER TABLE identities ADD COLUMN source TEXT;
+        EXCEPTION
+            WHEN duplicate_column THEN RETURN;
+        END;
+    END;
+$$;
+
+CREATE INDEX IF NOT EXISTS identities_source ON identities (source);
+
+DO $$ 
+    BEGIN
+        BEGIN
+            ALTER TABLE identities ADD COLUMN admindisabled BOOLEAN;
+        EXCEPTION
+            WHEN duplicate_column THEN RETURN;
+        END;
+    END;
+$$;
+
+DO $$ 
+    BEGIN
+        BEGIN
+            ALTER TABLE identities ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
+        EXCEPTION
+            WHEN duplicate_column THEN RETURN;
+        END;
+    END;
+$$;
+
+DO $$ 
+    BEGIN
+        BEGIN
+            ALTER TABLE identities ADD COLUMN modified TIMESTAMP WITH TIME ZONE;
+        EXCEPTION
+            WHEN duplicate_column THEN RETURN;
+        END;
+    END;
+$$;
+
+-- The text_pattern_ops indexes allow prefix (LIKE 'abc%') searches to
+-- use an index whatever the collation of the database.
+CREATE INDEX IF NOT EXISTS identities_username_prefix ON identities (username text_pattern_ops);
+CREATE INDEX IF NOT EXISTS identities_name_prefix ON identities (name text_pattern_ops);
+CREATE INDEX IF NOT EXISTS identities_email_prefix ON identities (email text_pattern_ops);
+
+DO $$ 
+    BEGIN
+        BEGIN
+            ALTER TABLE identities ADD COLUMN foldedname TEXT;
+        EXCEPTION
+            WHEN duplicate_column THEN RETURN;
+        END;
+    END;
+$$;
+
+CREATE INDEX IF NOT EXISTS identities_foldedname ON identities (foldedname);
+
 CREATE TABLE IF NOT EXISTS identity_groups ( 
 	identity INTEGER REFERENCES identities NOT NULL,
 	value TEXT NOT NULL,
 	UNIQUE (identity, value)
 );
 
+CREATE TABLE IF NOT EXISTS identity_roles ( 
+	identity INTEGER REFERENCES identities NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (identity, value)
+);
+
 CREATE TABLE IF NOT EXISTS identity_publickeys ( 
 	identity INTEGER REFERENCES identities NOT NULL,
 	value BYTEA NOT NULL,
@@ -85,37 +151,57 @@ CREATE TABLE IF NOT EXISTS meetings (
 	address TEXT NOT NULL,
 	created TIMESTAMP WITH TIME ZONE NOT NULL
 );
+
+CREATE TABLE IF NOT EXISTS groups (
+	name TEXT NOT NULL PRIMARY KEY,
+	description TEXT NOT NULL,
+	metadata BYTEA
+);
+
+CREATE TABLE IF NOT EXISTS outbox (
+	id BIGSERIAL PRIMARY KEY,
+	data BYTEA NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	nextattempt TIMESTAMP WITH TIME ZONE NOT NULL,
+	expires TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS outbox_nextattempt ON outbox (nextattempt);
+CREATE INDEX IF NOT EXISTS outbox_expires ON outbox (expires);
 `
 
 var postgresTmpls = [numTmpl]string{
 	tmplIdentityFrom: `
-		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner
+		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner, source, admindisabled, version, modified
 		FROM identities
 		WHERE {{.Column}}={{.Identity | .Arg}}`,
 	tmplSelectIdentitySet: `
 		SELECT {{if .Key}}key, {{end}}value FROM {{.Table}} 
 		WHERE identity={{.Identity | .Arg}}`,
 	tmplFindIdentities: `
-		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner FROM identities
+		SELECT id, providerid, username, name, email, lastlogin, lastdischarge, owner, source, admindisabled, version, modified FROM identities
 		{{if .Where}}WHERE{{range $i, $w := .Where}}{{if gt $i 0}} AND{{end}} {{$w.Column}}{{$w.Comparison}}{{$w.Value | $.Arg}}{{end}}{{end}}
 		{{if .Sort}}ORDER BY {{join .Sort ", "}}{{end}}
 		{{if gt .Limit 0}}LIMIT {{.Limit}}{{end}}
 		{{if gt .Skip 0}}OFFSET {{.Skip}}{{end}}`,
 	tmplUpdateIdentity: `
 		UPDATE identities
-		SET {{range $i, $u := .Updates}}{{if gt $i 0}}, {{end}} {{$u.Column}}={{$u.Value | $.Arg}}{{end}}
+		SET version=version+1, modified={{.Modified | .Arg}}{{range .Updates}}, {{.Column}}={{.Value | $.Arg}}{{end}}
 		WHERE {{.Column}}={{.Identity | .Arg}}
 		RETURNING id`,
 	tmplIdentityID: `
 		SELECT id FROM identities
 		WHERE {{.Column}}={{.Identity | .Arg}}`,
 	tmplUpsertIdentity: `
-		INSERT INTO identities (providerid{{range .Updates}}, {{.Column}}{{end}})
-		VALUES ({{.Identity | .Arg}}{{range .Updates}}, {{.Value | $.Arg}}{{end}})
+		INSERT INTO identities (providerid, version, modified{{range .Updates}}, {{.Column}}{{end}}{{range .Inserts}}, {{.Column}}{{end}})
+		VALUES ({{.Identity | .Arg}}, 1, {{.Modified | .Arg}}{{range .Updates}}, {{.Value | $.Arg}}{{end}}{{range .Inserts}}, {{.Value | $.Arg}}{{end}})
 		ON CONFLICT (providerid) DO UPDATE 
-		SET{{range $i, $u := .Updates}}{{if gt $i 0}}, {{end}} {{$u.Column}}={{$u.Value | $.Arg}}{{end}}
+		SET version=identities.version+1, modified={{.Modified | .Arg}}{{range .Updates}}, {{.Column}}={{.Value | $.Arg}}{{end}}
 		WHERE identities.providerid={{.Identity | .Arg}}
 		RETURNING id`,
+	tmplRemoveIdentity: `
+		DELETE FROM identities
+		WHERE id={{.ID | .Arg}}`,
 	tmplClearIdentitySet: `
 		DELETE FROM {{.Table}}
 		WHERE identity={{.ID | .Arg}}{{if .Key}} AND key={{.Key | .Arg}}{{end}}`,
@@ -154,6 +240,65 @@ var postgresTmpls = [numTmpl]string{
 	tmplIdentityCounts: `
 		SELECT substring(providerid, '^[^:]*') as idp, COUNT(1) 
 		FROM identities GROUP BY idp`,
+	tmplUnfoldedNames: `
+		SELECT id, name FROM identities
+		WHERE foldedname IS NULL AND name IS NOT NULL`,
+	tmplSetFoldedName: `
+		UPDATE identities
+		SET foldedname={{.FoldedName | .Arg}}
+		WHERE id={{.ID | .Arg}} AND name={{.Name | .Arg}}`,
+	tmplGetGroup: `
+		SELECT name, description, metadata FROM groups
+		WHERE name={{.Name | .Arg}}`,
+	tmplFindGroups: `
+		SELECT name, description, metadata FROM groups
+		ORDER BY name`,
+	tmplUpsertGroup: `
+		INSERT INTO groups (name, description, metadata)
+		VALUES ({{.Name | .Arg}}, {{.Description | .Arg}}, {{.Metadata | .Arg}})
+		ON CONFLICT (name) DO UPDATE
+		SET description={{.Description | .Arg}}, metadata={{.Metadata | .Arg}}`,
+	tmplRemoveGroup: `
+		DELETE FROM groups
+		WHERE name={{.Name | .Arg}}`,
+	tmplAddOutboxMessage: `
+		INSERT INTO outbox (data, attempts, nextattempt, expires)
+		VALUES ({{.Data | .Arg}}, {{.Attempts | .Arg}}, {{.NextAttempt | .Arg}}, {{.Expires | .Arg}})
+		RETURNING id`,
+	tmplClaimOutboxMessage: `
+		UPDATE outbox
+		SET nextattempt={{.LeaseUntil | .Arg}}
+		FROM (
+			SELECT id, nextattempt FROM outbox
+			WHERE nextattempt <= {{.Now | .Arg}} AND expires > {{.Now | .Arg}}
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		) AS claimed
+		WHERE outbox.id=claimed.id
+		RETURNING outbox.id, outbox.data, outbox.attempts, claimed.nextattempt, outbox.expires`,
+	tmplRetryOutboxMessage: `
+		UPDATE outbox
+		SET attempts={{.Attempts | .Arg}}, nextattempt={{.NextAttempt | .Arg}}
+		WHERE id={{.ID | .Arg}}`,
+	tmplRemoveOutboxMessage: `
+		DELETE FROM outbox
+		WHERE id={{.ID | .Arg}}`,
+	tmplRemoveOldestOutboxMessage: `
+		DELETE FROM outbox
+		WHERE id=(
+			SELECT id FROM outbox
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, data, attempts, nextattempt, expires`,
+	tmplRemoveExpiredOutboxMessages: `
+		DELETE FROM outbox
+		WHERE expires <= {{.Now | .Arg}}
+		RETURNING id, data, attempts, nextattempt, expires`,
+	tmplCountOutboxMessages: `
+		SELECT COUNT(1) FROM outbox`,
 }
 
 // newPostgresDriver creates a postgres driver using the given DB.
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	sqldriver "database/sql/driver"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/juju/loggo"
@@ -24,6 +25,9 @@ var identityColumns = [store.NumFields]string{
 	store.LastLogin:     "lastlogin",
 	store.LastDischarge: "lastdischarge",
 	store.Owner:         "owner",
+	store.Source:        "source",
+	store.AdminDisabled: "admindisabled",
+	store.FoldedName:    "foldedname",
 }
 
 type identityStore struct {
@@ -119,8 +123,11 @@ func (s *identityStore) findIdentities(tx *sql.Tx, ref *store.Identity, filter s
 		if col == "" || cond == "" {
 			continue
 		}
-
-		wheres = append(wheres, where{col, cond, fieldValue(store.Field(f), ref)})
+		value := fieldValue(store.Field(f), ref)
+		if op == store.HasPrefix {
+			value = likePrefix(value)
+		}
+		wheres = append(wheres, where{col, cond, value})
 	}
 
 	sorts := make([]string, 0, len(sort))
@@ -182,13 +189,43 @@ func fieldValue(f store.Field, id *store.Identity) interface{} {
 		return nullTime{id.LastDischarge, !id.LastDischarge.IsZero()}
 	case store.Owner:
 		return sql.NullString{string(id.Owner), id.Owner != ""}
+	case store.Source:
+		return sql.NullString{id.Source, id.Source != ""}
+	case store.AdminDisabled:
+		return sql.NullBool{id.AdminDisabled, id.AdminDisabled}
+	case store.FoldedName:
+		folded := store.FoldName(id.Name)
+		return sql.NullString{folded, folded != ""}
 	}
 	return nil
 }
 
+// likePrefix returns a LIKE pattern that matches strings starting with
+// the given field value, as returned from fieldValue.
+func likePrefix(v interface{}) string {
+	var prefix string
+	switch v := v.(type) {
+	case store.ProviderIdentity:
+		prefix = string(v)
+	case string:
+		prefix = v
+	case sql.NullString:
+		prefix = v.String
+	default:
+		panic("unsupported prefix field")
+	}
+	return likeEscaper.Replace(prefix) + "%"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 func (s *identityStore) completeIdentity(tx *sql.Tx, identity *store.Identity) error {
 	var err error
-	identity.Groups, err = s.getGroups(tx, identity.ID)
+	identity.Groups, err = s.getStrings(tx, "identity_groups", identity.ID)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	identity.Roles, err = s.getStrings(tx, "identity_roles", identity.ID)
 	if err != nil {
 		return errgo.Mask(err)
 	}
@@ -215,10 +252,12 @@ type selectIdentitySetParams struct {
 	Key      bool
 }
 
-func (s *identityStore) getGroups(tx *sql.Tx, id string) ([]string, error) {
+// getStrings returns the string values held in the given set table
+// for the given identity.
+func (s *identityStore) getStrings(tx *sql.Tx, table string, id string) ([]string, error) {
 	params := selectIdentitySetParams{
 		argBuilder: s.driver.argBuilderFunc(),
-		Table:      "identity_groups",
+		Table:      table,
 		Identity:   id,
 	}
 	rows, err := s.driver.query(tx, tmplSelectIdentitySet, params)
@@ -226,15 +265,15 @@ func (s *identityStore) getGroups(tx *sql.Tx, id string) ([]string, error) {
 		return nil, errgo.Mask(err)
 	}
 	defer rows.Close()
-	var groups []string
+	var values []string
 	for rows.Next() {
-		var g string
-		if err := rows.Scan(&g); err != nil {
+		var v string
+		if err := rows.Scan(&v); err != nil {
 			return nil, errgo.Mask(err)
 		}
-		groups = append(groups, g)
+		values = append(values, v)
 	}
-	return groups, errgo.Mask(rows.Err())
+	return values, errgo.Mask(rows.Err())
 }
 
 func (s *identityStore) getPublicKeys(tx *sql.Tx, id string) ([]bakery.PublicKey, error) {
@@ -315,12 +354,21 @@ type updateIdentityParams struct {
 
 	// Updates contains the updates to apply.
 	Updates []update
+
+	// Inserts contains column values that are only set when a new
+	// identity is created.
+	Inserts []update
+
+	// Modified contains the modification time recorded on the
+	// identity.
+	Modified time.Time
 }
 
 func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd store.Update) error {
 	tmpl := tmplUpdateIdentity
 	params := updateIdentityParams{
 		argBuilder: s.driver.argBuilderFunc(),
+		Modified:   time.Now(),
 	}
 	switch {
 	case identity.ID != "":
@@ -344,13 +392,20 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 	}
 	for i, op := range upd {
 		field := store.Field(i)
-		if field == store.ProviderID {
+		if field == store.ProviderID || field == store.FoldedName {
 			continue
 		}
 		col := identityColumns[field]
 		if col == "" {
 			continue
 		}
+		if field == store.Source {
+			// The source is only ever recorded on creation.
+			if op == store.Set && tmpl == tmplUpsertIdentity {
+				params.Inserts = append(params.Inserts, update{col, fieldValue(field, identity)})
+			}
+			continue
+		}
 		var arg interface{}
 		switch op {
 		case store.Clear:
@@ -362,8 +417,15 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 			continue
 		}
 		params.Updates = append(params.Updates, update{col, arg})
+		if field == store.Name {
+			// Keep the folded name in step with the name.
+			if op == store.Set {
+				arg = fieldValue(store.FoldedName, identity)
+			}
+			params.Updates = append(params.Updates, update{identityColumns[store.FoldedName], arg})
+		}
 	}
-	if len(params.Updates) == 0 {
+	if upd == (store.Update{}) {
 		tmpl = tmplIdentityID
 	}
 	row, err := s.driver.queryRow(tx, tmpl, params)
@@ -380,7 +442,10 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 		return errgo.Notef(err, "cannot update identity")
 	}
 
-	if err := s.updateGroups(tx, identity.ID, upd[store.Groups], identity.Groups); err != nil {
+	if err := s.updateStrings(tx, "identity_groups", identity.ID, upd[store.Groups], identity.Groups); err != nil {
+		return errgo.Notef(err, "cannot update identity")
+	}
+	if err := s.updateStrings(tx, "identity_roles", identity.ID, upd[store.Roles], identity.Roles); err != nil {
 		return errgo.Notef(err, "cannot update identity")
 	}
 	if err := s.updatePublicKeys(tx, identity.ID, upd[store.PublicKeys], identity.PublicKeys); err != nil {
@@ -400,6 +465,54 @@ func (s *identityStore) updateIdentity(tx *sql.Tx, identity *store.Identity, upd
 	return nil
 }
 
+// identitySetTables holds the tables that hold values associated with
+// an identity.
+var identitySetTables = []string{
+	"identity_groups",
+	"identity_roles",
+	"identity_publickeys",
+	"identity_providerinfo",
+	"identity_extrainfo",
+}
+
+// RemoveIdentity implements store.IdentityRemover.RemoveIdentity.
+func (s *identityStore) RemoveIdentity(_ context.Context, identity *store.Identity) error {
+	return errgo.Mask(s.withTx(func(tx *sql.Tx) error {
+		return s.removeIdentity(tx, identity)
+	}), errgo.Is(store.ErrNotFound))
+}
+
+func (s *identityStore) removeIdentity(tx *sql.Tx, identity *store.Identity) error {
+	id := store.Identity{
+		ID:         identity.ID,
+		ProviderID: identity.ProviderID,
+		Username:   identity.Username,
+	}
+	// Find the ID of the identity, an empty update does not change
+	// the identity.
+	if err := s.updateIdentity(tx, &id, store.Update{}); err != nil {
+		return errgo.Mask(err, errgo.Is(store.ErrNotFound))
+	}
+	for _, table := range identitySetTables {
+		params := &updateSetParams{
+			argBuilder: s.driver.argBuilderFunc(),
+			Table:      table,
+			ID:         id.ID,
+		}
+		if _, err := s.driver.exec(tx, tmplClearIdentitySet, params); err != nil {
+			return errgo.Notef(err, "cannot remove identity")
+		}
+	}
+	params := &updateSetParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		ID:         id.ID,
+	}
+	if _, err := s.driver.exec(tx, tmplRemoveIdentity, params); err != nil {
+		return errgo.Notef(err, "cannot remove identity")
+	}
+	return nil
+}
+
 type updateSetParams struct {
 	argBuilder
 	Table  string
@@ -448,12 +561,14 @@ func (s *identityStore) updateSet(tx *sql.Tx, table, id, key string, op store.Op
 	return nil
 }
 
-func (s *identityStore) updateGroups(tx *sql.Tx, id string, op store.Operation, groups []string) error {
-	values := make([]interface{}, len(groups))
-	for i, g := range groups {
-		values[i] = g
+// updateStrings updates the string values held in the given set table
+// for the given identity.
+func (s *identityStore) updateStrings(tx *sql.Tx, table string, id string, op store.Operation, strs []string) error {
+	values := make([]interface{}, len(strs))
+	for i, v := range strs {
+		values[i] = v
 	}
-	return errgo.Mask(s.updateSet(tx, "identity_groups", id, "", op, values))
+	return errgo.Mask(s.updateSet(tx, table, id, "", op, values))
 }
 
 func (s *identityStore) updatePublicKeys(tx *sql.Tx, id string, op store.Operation, pks []bakery.PublicKey) error {
@@ -500,6 +615,45 @@ func (s *identityStore) IdentityCounts(ctx context.Context) (map[string]int, err
 	return counts, errgo.Mask(rows.Err())
 }
 
+type setFoldedNameParams struct {
+	argBuilder
+
+	ID         string
+	Name       string
+	FoldedName string
+}
+
+// foldNames sets the folded name of any identity that has a display
+// name but no folded name, which will be the case for identities
+// last updated before folded names were recorded.
+func (b *backend) foldNames() error {
+	rows, err := b.driver.query(b.db, tmplUnfoldedNames, b.driver.argBuilderFunc())
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var names []setFoldedNameParams
+	for rows.Next() {
+		var p setFoldedNameParams
+		if err := rows.Scan(&p.ID, &p.Name); err != nil {
+			rows.Close()
+			return errgo.Mask(err)
+		}
+		p.FoldedName = store.FoldName(p.Name)
+		names = append(names, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errgo.Mask(err)
+	}
+	for _, p := range names {
+		p.argBuilder = b.driver.argBuilderFunc()
+		if _, err := b.driver.exec(b.db, tmplSetFoldedName, &p); err != nil {
+			return errgo.Notef(err, "cannot set folded name")
+		}
+	}
+	return nil
+}
+
 type nullTime struct {
 	Time  time.Time
 	Valid bool
@@ -543,8 +697,9 @@ type scanner interface {
 }
 
 func scanIdentity(s scanner, identity *store.Identity) error {
-	var name, email, owner sql.NullString
-	var lastLogin, lastDischarge nullTime
+	var name, email, owner, source sql.NullString
+	var lastLogin, lastDischarge, modified nullTime
+	var adminDisabled sql.NullBool
 	err := s.Scan(
 		&identity.ID,
 		&identity.ProviderID,
@@ -554,6 +709,10 @@ func scanIdentity(s scanner, identity *store.Identity) error {
 		&lastLogin,
 		&lastDischarge,
 		&owner,
+		&source,
+		&adminDisabled,
+		&identity.Version,
+		&modified,
 	)
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
@@ -563,5 +722,8 @@ func scanIdentity(s scanner, identity *store.Identity) error {
 	identity.LastLogin = lastLogin.Time
 	identity.LastDischarge = lastDischarge.Time
 	identity.Owner = store.ProviderIdentity(owner.String)
+	identity.Source = source.String
+	identity.AdminDisabled = adminDisabled.Bool
+	identity.Modified = modified.Time
 	return nil
 }
@@ -28,9 +28,26 @@ const (
 	ProviderInfo
 	ExtraInfo
 	Owner
+	Source
+	Roles
+	AdminDisabled
+
+	// FoldedName is the Name of the identity as returned by
+	// FoldName. It is maintained by the store whenever Name is
+	// changed, and can only be used in a Filter, where the value
+	// is taken from the Name of the reference identity.
+	FoldedName
 	NumFields
 )
 
+// FoldName returns the given display name with leading and trailing
+// white space removed and converted to lower case. Display names that
+// only differ in case or surrounding white space have the same folded
+// form, so they can be found with a FoldedName filter.
+func FoldName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
 // An Operation represents a type of update that can be applied to an
 // identity record in a Store.UpdateIdentity call.
 type Operation byte
@@ -83,6 +100,12 @@ const (
 	LessThan
 	GreaterThanOrEqual
 	LessThanOrEqual
+
+	// HasPrefix matches identities where the value of the field
+	// starts with the value in the reference identity. The match is
+	// case sensitive. It may only be used with the ProviderID,
+	// Username, Name, Email, Owner and Source fields.
+	HasPrefix
 )
 
 // A Filter is used in a Store.FindEntities call to specify how the
@@ -234,4 +257,56 @@ type Identity struct {
 	// Owner contains the ProviderIdentity of the identity that owns
 	// this one.
 	Owner ProviderIdentity
+
+	// Source contains a tag identifying the system that the identity
+	// originated from. The source is only recorded when the identity
+	// is created, a Set operation on an existing identity leaves it
+	// unchanged.
+	Source string
+
+	// Roles contains the tenant-scoped roles held by the identity,
+	// each of the form "tenant:role". Roles are kept separately
+	// from ExtraInfo so that they can only be changed by an
+	// administrator.
+	Roles []string
+
+	// AdminDisabled records that the identity, which must be one
+	// of the configured additional admin accounts, has been
+	// disabled. It is kept separately from ExtraInfo so that it
+	// can only be changed through the admin account API.
+	AdminDisabled bool
+
+	// Version is maintained by the store. It is incremented every
+	// time the identity is changed, so it can be used to determine
+	// whether an identity has changed since it was last read. It is
+	// ignored by UpdateIdentity.
+	Version int64
+
+	// Modified is maintained by the store. It holds the time the
+	// identity was last changed. It is ignored by UpdateIdentity.
+	Modified time.Time
+}
+
+// An IdentityRemover is a Store that can also remove identities. Not
+// all stores support removing identities, so this is checked for at
+// run time.
+type IdentityRemover interface {
+	// RemoveIdentity removes the given identity, and all of the data
+	// associated with it, from persistant storage. The identity that
+	// is removed will be the one matching the first non-zero value of
+	// ID, ProviderID or Username. If there is no match then an error
+	// with a cause of ErrNotFound will be returned.
+	RemoveIdentity(ctx context.Context, identity *Identity) error
+}
+
+// RemoveIdentity removes the given identity from st, see
+// IdentityRemover.RemoveIdentity. If st is not an IdentityRemover then
+// an error with a cause of ErrNotSupported is returned. Stores that
+// wrap another store use this to implement IdentityRemover.
+func RemoveIdentity(ctx context.Context, st Store, identity *Identity) error {
+	r, ok := st.(IdentityRemover)
+	if !ok {
+		return errgo.WithCausef(nil, ErrNotSupported, "store cannot remove identities")
+	}
+	return errgo.Mask(r.RemoveIdentity(ctx, identity), errgo.Any)
 }
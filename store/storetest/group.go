@@ -0,0 +1,84 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package storetest
+
+import (
+	"context"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/canonical/candid/store"
+)
+
+// TestGroupStore runs tests on the given GroupStore implementation.
+func TestGroupStore(c *qt.C, newStore func(c *qt.C) store.GroupStore) {
+	s := newStore(c)
+	ctx := context.Background()
+
+	g := store.Group{Name: "g1"}
+	err := s.Group(ctx, &g)
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	c.Assert(err, qt.ErrorMatches, `group "g1" not found`)
+
+	groups, err := s.FindGroups(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.HasLen, 0)
+
+	err = s.UpdateGroup(ctx, &store.Group{
+		Name:        "g2",
+		Description: "group two",
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.UpdateGroup(ctx, &store.Group{
+		Name:        "g1",
+		Description: "group one",
+		Metadata: map[string]string{
+			"owner":   "bob",
+			"purpose": "testing",
+		},
+	})
+	c.Assert(err, qt.IsNil)
+
+	g = store.Group{Name: "g1"}
+	err = s.Group(ctx, &g)
+	c.Assert(err, qt.IsNil)
+	c.Assert(g, qt.DeepEquals, store.Group{
+		Name:        "g1",
+		Description: "group one",
+		Metadata: map[string]string{
+			"owner":   "bob",
+			"purpose": "testing",
+		},
+	})
+
+	// Updating a group replaces the existing record.
+	err = s.UpdateGroup(ctx, &store.Group{
+		Name:        "g1",
+		Description: "the first group",
+	})
+	c.Assert(err, qt.IsNil)
+
+	groups, err = s.FindGroups(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []store.Group{{
+		Name:        "g1",
+		Description: "the first group",
+	}, {
+		Name:        "g2",
+		Description: "group two",
+	}})
+
+	err = s.RemoveGroup(ctx, "g1")
+	c.Assert(err, qt.IsNil)
+	err = s.RemoveGroup(ctx, "g1")
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+
+	groups, err = s.FindGroups(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(groups, qt.DeepEquals, []store.Group{{
+		Name:        "g2",
+		Description: "group two",
+	}})
+}
@@ -5,6 +5,7 @@ package storetest
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	qt "github.com/frankban/quicktest"
@@ -200,6 +201,48 @@ func (s *keyValueSuite) TestUpdateConcurrent(c *qt.C) {
 	c.Assert(int(val[0]), qt.Equals, N*2)
 }
 
+func (s *keyValueSuite) TestIncrementCounterConcurrent(c *qt.C) {
+	ctx := context.Background()
+	kv, err := s.Store.KeyValueStore(ctx, "test")
+	c.Assert(err, qt.IsNil)
+
+	const (
+		N = 20
+		M = 5
+	)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+	for i := 0; i < M; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < N; j++ {
+				n, err := store.IncrementCounter(ctx, kv, "test-counter", time.Minute)
+				c.Check(err, qt.IsNil)
+				mu.Lock()
+				c.Check(seen[n], qt.Equals, false, qt.Commentf("count %d returned twice", n))
+				seen[n] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	n, err := store.CounterValue(ctx, kv, "test-counter")
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, N*M)
+	c.Assert(seen, qt.HasLen, N*M)
+
+	err = store.ResetCounter(ctx, kv, "test-counter")
+	c.Assert(err, qt.IsNil)
+	n, err = store.CounterValue(ctx, kv, "test-counter")
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+	n, err = store.IncrementCounter(ctx, kv, "test-counter", time.Minute)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 1)
+}
+
 func (s *keyValueSuite) TestUpdateErrorWithExistingKey(c *qt.C) {
 	ctx := context.Background()
 	kv, err := s.Store.KeyValueStore(ctx, "test")
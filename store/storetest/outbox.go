@@ -0,0 +1,101 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package storetest
+
+import (
+	"context"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/canonical/candid/store"
+)
+
+// TestOutboxStore runs tests on the given OutboxStore implementation.
+func TestOutboxStore(c *qt.C, newStore func(c *qt.C) store.OutboxStore) {
+	s := newStore(c)
+	ctx := context.Background()
+	now := time.Now().Round(time.Millisecond)
+
+	m, err := s.Claim(ctx, now, now.Add(time.Minute))
+	c.Assert(err, qt.IsNil)
+	c.Assert(m, qt.IsNil)
+
+	add := func(data string, nextAttempt, expires time.Time) string {
+		m := store.OutboxMessage{
+			Data:        []byte(data),
+			NextAttempt: nextAttempt,
+			Expires:     expires,
+		}
+		err := s.Add(ctx, &m)
+		c.Assert(err, qt.IsNil)
+		c.Assert(m.ID, qt.Not(qt.Equals), "")
+		return m.ID
+	}
+	id1 := add("m1", now, now.Add(time.Hour))
+	id2 := add("m2", now.Add(-time.Second), now.Add(time.Hour))
+	add("m3", now.Add(time.Minute), now.Add(time.Hour))
+	add("m4", now.Add(-time.Second), now.Add(-time.Second))
+	n, err := s.Count(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 4)
+
+	// Messages are claimed oldest first, and a claimed message
+	// cannot be claimed again until its lease expires.
+	m, err = s.Claim(ctx, now, now.Add(time.Minute))
+	c.Assert(err, qt.IsNil)
+	c.Assert(m, qt.Not(qt.IsNil))
+	c.Assert(m.ID, qt.Equals, id1)
+	c.Assert(string(m.Data), qt.Equals, "m1")
+	c.Assert(m.NextAttempt.Equal(now), qt.Equals, true)
+	m, err = s.Claim(ctx, now, now.Add(time.Minute))
+	c.Assert(err, qt.IsNil)
+	c.Assert(m, qt.Not(qt.IsNil))
+	c.Assert(m.ID, qt.Equals, id2)
+
+	// Neither message that is not yet due nor the expired message
+	// can be claimed.
+	m, err = s.Claim(ctx, now, now.Add(time.Minute))
+	c.Assert(err, qt.IsNil)
+	c.Assert(m, qt.IsNil)
+
+	// A retried message can be claimed once it is due.
+	err = s.Retry(ctx, id2, 1, now.Add(time.Second))
+	c.Assert(err, qt.IsNil)
+	later := now.Add(2 * time.Second)
+	m, err = s.Claim(ctx, later, later.Add(time.Minute))
+	c.Assert(err, qt.IsNil)
+	c.Assert(m, qt.Not(qt.IsNil))
+	c.Assert(m.ID, qt.Equals, id2)
+	c.Assert(m.Attempts, qt.Equals, 1)
+
+	// Removed messages are gone.
+	err = s.Remove(ctx, id1)
+	c.Assert(err, qt.IsNil)
+	err = s.Remove(ctx, id1)
+	c.Assert(err, qt.IsNil)
+	n, err = s.Count(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 3)
+
+	expired, err := s.RemoveExpired(ctx, now)
+	c.Assert(err, qt.IsNil)
+	c.Assert(expired, qt.HasLen, 1)
+	c.Assert(string(expired[0].Data), qt.Equals, "m4")
+
+	m, err = s.RemoveOldest(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(m, qt.Not(qt.IsNil))
+	c.Assert(string(m.Data), qt.Equals, "m2")
+	m, err = s.RemoveOldest(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(m, qt.Not(qt.IsNil))
+	c.Assert(string(m.Data), qt.Equals, "m3")
+	m, err = s.RemoveOldest(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(m, qt.IsNil)
+	n, err = s.Count(ctx)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 0)
+}
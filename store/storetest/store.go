@@ -278,6 +278,80 @@ var updateIdentityTests = []struct {
 	expectIdentity: &store.Identity{
 		Groups: []string{"g1", "g2", "g3", "g4"},
 	},
+}, {
+	about: "set roles",
+	startIdentity: &store.Identity{
+		Roles: []string{"t1:r1", "t1:r2"},
+	},
+	updateIdentity: &store.Identity{
+		Roles: []string{"t2:r3"},
+	},
+	update: store.Update{
+		store.Roles: store.Set,
+	},
+	expectIdentity: &store.Identity{
+		Roles: []string{"t2:r3"},
+	},
+}, {
+	about: "clear roles",
+	startIdentity: &store.Identity{
+		Roles: []string{"t1:r1", "t1:r2"},
+	},
+	updateIdentity: &store.Identity{},
+	update: store.Update{
+		store.Roles: store.Clear,
+	},
+	expectIdentity: &store.Identity{},
+}, {
+	about: "push roles",
+	startIdentity: &store.Identity{
+		Roles: []string{"t1:r1"},
+	},
+	updateIdentity: &store.Identity{
+		Roles: []string{"t2:r3"},
+	},
+	update: store.Update{
+		store.Roles: store.Push,
+	},
+	expectIdentity: &store.Identity{
+		Roles: []string{"t1:r1", "t2:r3"},
+	},
+}, {
+	about: "pull roles",
+	startIdentity: &store.Identity{
+		Roles: []string{"t1:r1", "t1:r2"},
+	},
+	updateIdentity: &store.Identity{
+		Roles: []string{"t1:r1"},
+	},
+	update: store.Update{
+		store.Roles: store.Pull,
+	},
+	expectIdentity: &store.Identity{
+		Roles: []string{"t1:r2"},
+	},
+}, {
+	about:         "set admin disabled",
+	startIdentity: &store.Identity{},
+	updateIdentity: &store.Identity{
+		AdminDisabled: true,
+	},
+	update: store.Update{
+		store.AdminDisabled: store.Set,
+	},
+	expectIdentity: &store.Identity{
+		AdminDisabled: true,
+	},
+}, {
+	about: "clear admin disabled",
+	startIdentity: &store.Identity{
+		AdminDisabled: true,
+	},
+	updateIdentity: &store.Identity{},
+	update: store.Update{
+		store.AdminDisabled: store.Clear,
+	},
+	expectIdentity: &store.Identity{},
 }, {
 	about: "set public keys",
 	startIdentity: &store.Identity{
@@ -690,6 +764,20 @@ var updateIdentityTests = []struct {
 		store.Owner: store.Clear,
 	},
 	expectIdentity: &store.Identity{},
+}, {
+	about: "source cannot be changed",
+	startIdentity: &store.Identity{
+		Source: "ldap",
+	},
+	updateIdentity: &store.Identity{
+		Source: "static",
+	},
+	update: store.Update{
+		store.Source: store.Set,
+	},
+	expectIdentity: &store.Identity{
+		Source: "ldap",
+	},
 }, {
 	about: "username not found",
 	updateIdentity: &store.Identity{
@@ -758,13 +846,15 @@ func (s *storeSuite) TestUpdateIdentity(c *qt.C) {
 
 			if test.startIdentity != nil {
 				update := store.Update{
-					store.Username:     store.Set,
-					store.Name:         store.Set,
-					store.Email:        store.Set,
-					store.Groups:       store.Set,
-					store.PublicKeys:   store.Set,
-					store.ProviderInfo: store.Set,
-					store.ExtraInfo:    store.Set,
+					store.Username:      store.Set,
+					store.Name:          store.Set,
+					store.Email:         store.Set,
+					store.Groups:        store.Set,
+					store.PublicKeys:    store.Set,
+					store.ProviderInfo:  store.Set,
+					store.ExtraInfo:     store.Set,
+					store.Roles:         store.Set,
+					store.AdminDisabled: store.Set,
 				}
 				if test.startIdentity.ProviderID == "" {
 					test.startIdentity.ProviderID = pid
@@ -778,6 +868,9 @@ func (s *storeSuite) TestUpdateIdentity(c *qt.C) {
 				if !test.startIdentity.LastLogin.IsZero() {
 					update[store.LastLogin] = store.Set
 				}
+				if test.startIdentity.Source != "" {
+					update[store.Source] = store.Set
+				}
 				err := s.Store.UpdateIdentity(s.ctx, test.startIdentity, update)
 				c.Assert(err, qt.IsNil)
 			}
@@ -866,6 +959,36 @@ func (s *storeSuite) TestInsertDuplicateUsername(c *qt.C) {
 	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
 }
 
+func (s *storeSuite) TestSameSubjectDifferentProviders(c *qt.C) {
+	id1 := store.Identity{
+		ProviderID: store.MakeProviderIdentity("idp1", "subject"),
+		Username:   "user1",
+	}
+	err := s.Store.UpdateIdentity(s.ctx, &id1, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	id2 := store.Identity{
+		ProviderID: store.MakeProviderIdentity("idp2", "subject"),
+		Username:   "user2",
+	}
+	err = s.Store.UpdateIdentity(s.ctx, &id2, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(id1.ID, qt.Not(qt.Equals), id2.ID)
+
+	for _, expect := range []store.Identity{id1, id2} {
+		id := store.Identity{
+			ProviderID: expect.ProviderID,
+		}
+		err = s.Store.Identity(s.ctx, &id)
+		c.Assert(err, qt.IsNil)
+		c.Assert(id.ID, qt.Equals, expect.ID)
+		c.Assert(id.Username, qt.Equals, expect.Username)
+	}
+}
+
 func (s *storeSuite) TestUpdateIDDuplicateUsername(c *qt.C) {
 	err := s.Store.UpdateIdentity(
 		s.ctx,
@@ -969,6 +1092,12 @@ func (s *storeSuite) TestIdentity(c *qt.C) {
 	}
 	err = s.Store.Identity(s.ctx, &identity2)
 	c.Assert(err, qt.IsNil)
+	// The version and modification time are maintained by the
+	// store.
+	c.Assert(identity2.Version, qt.Equals, int64(1))
+	c.Assert(identity2.Modified.IsZero(), qt.Equals, false)
+	identity.Version = identity2.Version
+	identity.Modified = identity2.Modified
 	c.Assert(identity2, qt.DeepEquals, identity)
 
 	identity3 := store.Identity{
@@ -1011,6 +1140,80 @@ func (s *storeSuite) TestIdentityNotFoundBadID(c *qt.C) {
 	c.Assert(err, qt.ErrorMatches, `identity "1234" not found`)
 }
 
+func (s *storeSuite) TestRemoveIdentity(c *qt.C) {
+	k := bakery.MustGenerateKey()
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Groups:     []string{"g1", "g2"},
+		PublicKeys: []bakery.PublicKey{k.Public},
+		ProviderInfo: map[string][]string{
+			"pk1": {"pv1"},
+		},
+		ExtraInfo: map[string][]string{
+			"ek1": {"ev1"},
+		},
+	}
+	err := s.Store.UpdateIdentity(s.ctx, &identity, store.Update{
+		store.Username:     store.Set,
+		store.Groups:       store.Set,
+		store.PublicKeys:   store.Set,
+		store.ProviderInfo: store.Set,
+		store.ExtraInfo:    store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	err = s.Store.UpdateIdentity(s.ctx, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "alice"),
+		Username:   "alice",
+	}, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	err = store.RemoveIdentity(s.ctx, s.Store, &store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+	})
+	c.Assert(err, qt.IsNil)
+
+	err = s.Store.Identity(s.ctx, &store.Identity{ID: identity.ID})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	err = s.Store.Identity(s.ctx, &store.Identity{Username: "bob"})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	alice := store.Identity{Username: "alice"}
+	err = s.Store.Identity(s.ctx, &alice)
+	c.Assert(err, qt.IsNil)
+
+	// The username and provider ID can be used again and the new
+	// identity has none of the data of the removed one.
+	identity2 := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+	}
+	err = s.Store.UpdateIdentity(s.ctx, &identity2, store.Update{
+		store.Username: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity2.ID, qt.Not(qt.Equals), identity.ID)
+	c.Assert(identity2.ID, qt.Not(qt.Equals), alice.ID)
+	err = s.Store.Identity(s.ctx, &identity2)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identity2.Groups, qt.HasLen, 0)
+	c.Assert(identity2.PublicKeys, qt.HasLen, 0)
+	c.Assert(identity2.ProviderInfo["pk1"], qt.HasLen, 0)
+	c.Assert(identity2.ExtraInfo["ek1"], qt.HasLen, 0)
+}
+
+func (s *storeSuite) TestRemoveIdentityNotFound(c *qt.C) {
+	err := store.RemoveIdentity(s.ctx, s.Store, &store.Identity{
+		Username: "no-such-user",
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+	c.Assert(err, qt.ErrorMatches, `user no-such-user not found`)
+
+	err = store.RemoveIdentity(s.ctx, s.Store, &store.Identity{})
+	c.Assert(errgo.Cause(err), qt.Equals, store.ErrNotFound)
+}
+
 var testIdentities = []store.Identity{{
 	ProviderID:    store.MakeProviderIdentity("test", "test1"),
 	Username:      "test1",
@@ -1070,6 +1273,7 @@ var testIdentities = []store.Identity{{
 	LastLogin:     time.Date(2017, 1, 7, 0, 0, 0, 0, time.UTC),
 	LastDischarge: time.Date(2017, 2, 3, 0, 0, 0, 0, time.UTC),
 	Owner:         "test:test2",
+	Source:        "legacy",
 }, {
 	ProviderID:    store.MakeProviderIdentity("test", "test8"),
 	Username:      "test8",
@@ -1078,6 +1282,7 @@ var testIdentities = []store.Identity{{
 	LastLogin:     time.Date(2017, 1, 8, 0, 0, 0, 0, time.UTC),
 	LastDischarge: time.Date(2017, 2, 2, 0, 0, 0, 0, time.UTC),
 	Owner:         "test:test3",
+	Source:        "legacy",
 }, {
 	ProviderID:    store.MakeProviderIdentity("test", "test9"),
 	Username:      "test9",
@@ -1231,6 +1436,15 @@ var findIdentitiesTests = []struct {
 		store.Name: store.Equal,
 	},
 	expect: []int{0},
+}, {
+	about: "folded name equal",
+	ref: store.Identity{
+		Name: " TEST user 1 ",
+	},
+	filter: store.Filter{
+		store.FoldedName: store.Equal,
+	},
+	expect: []int{0},
 }, {
 	about: "name not equal",
 	ref: store.Identity{
@@ -1384,6 +1598,63 @@ var findIdentitiesTests = []struct {
 		store.Owner: store.Equal,
 	},
 	expect: []int{5},
+}, {
+	about: "match source",
+	ref: store.Identity{
+		Source: "legacy",
+	},
+	filter: store.Filter{
+		store.Source: store.Equal,
+	},
+	sort:   []store.Sort{{Field: store.Username}},
+	expect: []int{6, 7},
+}, {
+	about: "username prefix",
+	ref: store.Identity{
+		Username: "test",
+	},
+	filter: store.Filter{
+		store.Username: store.HasPrefix,
+	},
+	sort:   []store.Sort{{Field: store.Username}},
+	expect: []int{0, 1, 2, 3, 4, 5, 6, 7, 8},
+}, {
+	about: "email prefix",
+	ref: store.Identity{
+		Email: "test9@",
+	},
+	filter: store.Filter{
+		store.Email: store.HasPrefix,
+	},
+	sort:   []store.Sort{{Field: store.Username}},
+	expect: []int{6, 8},
+}, {
+	about: "name prefix is case sensitive",
+	ref: store.Identity{
+		Name: "test user",
+	},
+	filter: store.Filter{
+		store.Name: store.HasPrefix,
+	},
+}, {
+	about: "prefix with pattern characters",
+	ref: store.Identity{
+		Username: "test_",
+	},
+	filter: store.Filter{
+		store.Username: store.HasPrefix,
+	},
+}, {
+	about: "prefix combined with other filter",
+	ref: store.Identity{
+		Name:  "Test User",
+		Owner: "test:test2",
+	},
+	filter: store.Filter{
+		store.Name:  store.HasPrefix,
+		store.Owner: store.Equal,
+	},
+	expect: []int{6},
 }}
 
 func (s *storeSuite) TestFindIdentities(c *qt.C) {
@@ -1419,6 +1690,9 @@ func (s *storeSuite) TestFindIdentities(c *qt.C) {
 		if testIdentities[i].Owner != "" {
 			update[store.Owner] = store.Set
 		}
+		if testIdentities[i].Source != "" {
+			update[store.Source] = store.Set
+		}
 		err := s.Store.UpdateIdentity(s.ctx, &testIdentities[i], update)
 		c.Assert(err, qt.IsNil)
 	}
@@ -1434,6 +1708,42 @@ func (s *storeSuite) TestFindIdentities(c *qt.C) {
 	}
 }
 
+func (s *storeSuite) TestFoldedNameFollowsName(c *qt.C) {
+	identity := store.Identity{
+		ProviderID: store.MakeProviderIdentity("test", "bob"),
+		Username:   "bob",
+		Name:       "Alice",
+	}
+	err := s.Store.UpdateIdentity(s.ctx, &identity, store.Update{
+		store.Username: store.Set,
+		store.Name:     store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+	identity.Name = "Bob"
+	err = s.Store.UpdateIdentity(s.ctx, &identity, store.Update{
+		store.Name: store.Set,
+	})
+	c.Assert(err, qt.IsNil)
+
+	var filter store.Filter
+	filter[store.FoldedName] = store.Equal
+	identities, err := s.Store.FindIdentities(s.ctx, &store.Identity{Name: "alice"}, filter, nil, 0, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identities, qt.HasLen, 0)
+	identities, err = s.Store.FindIdentities(s.ctx, &store.Identity{Name: "BOB "}, filter, nil, 0, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identities, qt.HasLen, 1)
+	c.Assert(identities[0].Username, qt.Equals, "bob")
+
+	err = s.Store.UpdateIdentity(s.ctx, &identity, store.Update{
+		store.Name: store.Clear,
+	})
+	c.Assert(err, qt.IsNil)
+	identities, err = s.Store.FindIdentities(s.ctx, &store.Identity{Name: "bob"}, filter, nil, 0, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(identities, qt.HasLen, 0)
+}
+
 func (s *storeSuite) TestIdentityCounts(c *qt.C) {
 	idps := []string{"a", "b", "c", "a", "b", "a"}
 	for i, idp := range idps {